@@ -0,0 +1,253 @@
+// Command loadgen sends a mix of requests to a running todo API from
+// concurrent clients and reports the throughput and latency percentiles,
+// overall and per operation.
+//
+//	go run ./cmd/loadgen -url http://localhost:8080 -c 64 -duration 30s
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// operation is a kind of request in the mix.
+type operation struct {
+	name string
+	// request fills in req; ids are the todos created before the run.
+	request func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand)
+	want    int
+}
+
+var operations = []operation{
+	{"get", func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand) {
+		req.SetRequestURI(base + "/v1/todos/" + strconv.Itoa(ids[rnd.Intn(len(ids))]))
+	}, fasthttp.StatusOK},
+	{"list", func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand) {
+		req.SetRequestURI(base + "/v1/todos?limit=50")
+	}, fasthttp.StatusOK},
+	{"search", func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand) {
+		req.SetRequestURI(base + "/v1/search?q=report")
+	}, fasthttp.StatusOK},
+	{"create", func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand) {
+		req.Header.SetMethod("POST")
+		req.SetRequestURI(base + "/v1/todos")
+		req.Header.SetContentType("application/json")
+		req.SetBodyString(`{"title": "Load test", "description": "Prepare the Q3 report", "tags": ["loadgen"]}`)
+	}, fasthttp.StatusCreated},
+	{"update", func(req *fasthttp.Request, base string, ids []int, rnd *rand.Rand) {
+		req.Header.SetMethod("PUT")
+		req.SetRequestURI(base + "/v1/todos/" + strconv.Itoa(ids[rnd.Intn(len(ids))]))
+		req.Header.SetContentType("application/json")
+		req.SetBodyString(`{"title": "Load test ` + strconv.Itoa(rnd.Int()) + `"}`)
+	}, fasthttp.StatusOK},
+}
+
+// stats collects the outcome of the requests of one operation.
+type stats struct {
+	latencies []time.Duration
+	errors    int
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "base URL of the API")
+	concurrency := flag.Int("c", 16, "number of concurrent clients")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send requests")
+	mix := flag.String("mix", "get=50,list=15,search=5,create=15,update=15", "comma-separated operation=weight entries; operations: get, list, search, create, update")
+	seed := flag.Int("seed", 100, "number of todos created before the run for get and update")
+	apiKey := flag.String("api-key", "", "API key sent in the X-API-Key header")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each request")
+	flag.Parse()
+
+	weighted, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadgen: invalid -mix: %s\n", err)
+		os.Exit(2)
+	}
+	if *concurrency < 1 || *duration <= 0 || *seed < 1 {
+		fmt.Fprintln(os.Stderr, "loadgen: -c, -duration and -seed must be positive")
+		os.Exit(2)
+	}
+	*base = strings.TrimSuffix(*base, "/")
+	client := &fasthttp.Client{MaxConnsPerHost: *concurrency, ReadTimeout: *timeout, WriteTimeout: *timeout}
+	prepare := func(req *fasthttp.Request) {
+		if *apiKey != "" {
+			req.Header.Set("X-API-Key", *apiKey)
+		}
+	}
+
+	ids, err := seedTodos(client, *base, *seed, prepare)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadgen: creating the todos: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("url=%s c=%d duration=%s mix=%s\n\n", *base, *concurrency, *duration, *mix)
+	results := make([]map[string]*stats, *concurrency)
+	var firstErr atomic.Value
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for w := range results {
+		results[w] = make(map[string]*stats)
+		wg.Add(1)
+		go func(own map[string]*stats, rnd *rand.Rand) {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			for time.Now().Before(deadline) {
+				op := weighted[rnd.Intn(len(weighted))]
+				req.Reset()
+				prepare(req)
+				op.request(req, *base, ids, rnd)
+				began := time.Now()
+				err := client.DoTimeout(req, resp, *timeout)
+				took := time.Since(began)
+				s := own[op.name]
+				if s == nil {
+					s = &stats{}
+					own[op.name] = s
+				}
+				switch {
+				case err != nil:
+					s.errors++
+					firstErr.CompareAndSwap(nil, fmt.Sprintf("%s: %s", op.name, err))
+				case resp.StatusCode() != op.want:
+					s.errors++
+					firstErr.CompareAndSwap(nil, fmt.Sprintf("%s: status %d: %.200s", op.name, resp.StatusCode(), resp.Body()))
+				default:
+					s.latencies = append(s.latencies, took)
+				}
+			}
+		}(results[w], rand.New(rand.NewSource(int64(w)+time.Now().UnixNano())))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	merged := make(map[string]*stats)
+	total := &stats{}
+	for _, own := range results {
+		for name, s := range own {
+			m := merged[name]
+			if m == nil {
+				m = &stats{}
+				merged[name] = m
+			}
+			m.latencies = append(m.latencies, s.latencies...)
+			m.errors += s.errors
+			total.latencies = append(total.latencies, s.latencies...)
+			total.errors += s.errors
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "operation\trequests\terrors\treq/s\tp50\tp90\tp99\tp99.9\tmax\t")
+	for _, op := range operations {
+		if s := merged[op.name]; s != nil {
+			printStats(w, op.name, s, elapsed)
+		}
+	}
+	printStats(w, "total", total, elapsed)
+	w.Flush()
+	if msg := firstErr.Load(); msg != nil {
+		fmt.Printf("\nfirst error: %s\n", msg)
+		os.Exit(1)
+	}
+}
+
+// parseMix parses operation=weight entries into a slice holding every
+// operation as many times as its weight, to pick from at random.
+func parseMix(mix string) ([]operation, error) {
+	var weighted []operation
+	for _, entry := range strings.Split(mix, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(value)
+		if !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected operation=weight", entry)
+		}
+		found := false
+		for _, op := range operations {
+			if op.name == strings.TrimSpace(name) {
+				for i := 0; i < weight; i++ {
+					weighted = append(weighted, op)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+	}
+	if len(weighted) == 0 {
+		return nil, fmt.Errorf("no operation has a weight")
+	}
+	return weighted, nil
+}
+
+// seedTodos creates n todos and returns their IDs.
+func seedTodos(client *fasthttp.Client, base string, n int, prepare func(*fasthttp.Request)) ([]int, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	ids := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		req.Reset()
+		prepare(req)
+		req.Header.SetMethod("POST")
+		req.SetRequestURI(base + "/v1/todos")
+		req.Header.SetContentType("application/json")
+		req.SetBodyString(`{"title": "Load test seed ` + strconv.Itoa(i) + `", "tags": ["loadgen"]}`)
+		if err := client.Do(req, resp); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() != fasthttp.StatusCreated {
+			return nil, fmt.Errorf("status %d: %.200s", resp.StatusCode(), resp.Body())
+		}
+		var created struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(resp.Body(), &created); err != nil || created.ID == 0 {
+			return nil, fmt.Errorf("unexpected response %.200s", resp.Body())
+		}
+		ids = append(ids, created.ID)
+	}
+	return ids, nil
+}
+
+// printStats prints a row of the report.
+func printStats(w *tabwriter.Writer, name string, s *stats, elapsed time.Duration) {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	n := len(s.latencies)
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.0f\t%s\t%s\t%s\t%s\t%s\t\n", name, n+s.errors, s.errors,
+		float64(n)/elapsed.Seconds(), percentile(s.latencies, 50), percentile(s.latencies, 90),
+		percentile(s.latencies, 99), percentile(s.latencies, 99.9), percentile(s.latencies, 100))
+}
+
+// percentile returns the p-th percentile of the sorted latencies, rounded
+// for display.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	i = max(0, min(i, len(sorted)-1))
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,418 @@
+// Command todoctl manages the todos of a running todo API from the shell.
+//
+//	todoctl add -priority high Buy milk
+//	todoctl list
+//	todoctl done 12
+//	todoctl rm 12
+//	todoctl export -format csv -out todos.csv
+//
+// The server and the API key are read from a JSON config file such as
+// {"server": "http://localhost:8080", "token": "k1"}, by default
+// todoctl/config.json in the user config directory, and can be overridden
+// with the TODOCTL_SERVER and TODOCTL_TOKEN environment variables or the
+// -server and -token flags.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// config holds the connection settings of todoctl.
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// todo holds the fields of a todo todoctl shows in tables, and the whole
+// todo for JSON output.
+type todo struct {
+	raw       json.RawMessage
+	ID        int        `json:"id"`
+	Title     string     `json:"title"`
+	Status    string     `json:"status"`
+	Completed bool       `json:"completed"`
+	Priority  string     `json:"priority"`
+	Project   string     `json:"project"`
+	Tags      []string   `json:"tags"`
+	DueAt     *time.Time `json:"due_at"`
+}
+
+func (t *todo) UnmarshalJSON(b []byte) error {
+	type fields todo
+	t.raw = append(json.RawMessage(nil), b...)
+	return json.Unmarshal(b, (*fields)(t))
+}
+
+// client sends requests to the API.
+type client struct {
+	base  string
+	token string
+	http  *fasthttp.Client
+}
+
+// apiError is an error response of the API.
+type apiError struct {
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	var body struct {
+		Error  string `json:"error"`
+		Errors []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal([]byte(e.body), &body) == nil && body.Error != "" {
+		msg := fmt.Sprintf("%d %s", e.status, body.Error)
+		for _, fe := range body.Errors {
+			msg += fmt.Sprintf("\n  %s %s", fe.Field, fe.Message)
+		}
+		return msg
+	}
+	return fmt.Sprintf("%d %s", e.status, strings.TrimSpace(e.body))
+}
+
+// do sends a request with an optional JSON body and returns the body of the
+// response, failing unless its status is 2xx.
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(method)
+	req.SetRequestURI(c.base + "/v1" + path)
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.SetContentType("application/json")
+		req.SetBody(b)
+	}
+	if err := c.http.DoTimeout(req, resp, 30*time.Second); err != nil {
+		return nil, err
+	}
+	if code := resp.StatusCode(); code < 200 || code > 299 {
+		return nil, &apiError{status: code, body: string(resp.Body())}
+	}
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+// loadConfig reads the config file at path. A missing file is fine unless
+// it was named explicitly.
+func loadConfig(path string, explicit bool) (config, error) {
+	cfg := config{Server: "http://localhost:8080"}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "todoctl", "config.json")
+}
+
+const usage = `usage: todoctl [flags] command [args]
+
+Commands:
+  list [-all] [-project name]         list open todos, or all with -all
+  add [-priority p] [-project name] [-tags a,b] [-due time] title...
+                                      add a todo
+  done id...                          complete todos
+  rm id...                            delete todos
+  export [-format json|csv|zip] [-out file]
+                                      export all todos
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	configPath := flag.String("config", "", "config file (default "+defaultConfigPath()+")")
+	server := flag.String("server", "", "base URL of the API, overriding the config file")
+	token := flag.String("token", "", "API key, overriding the config file")
+	flag.StringVar(&output, "o", "table", "output format of list, add and done: table or json")
+	flag.Parse()
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	cfg, err := loadConfig(path, explicit)
+	if err != nil {
+		fatal(err)
+	}
+	for _, s := range []struct {
+		dst       *string
+		env, flag string
+	}{
+		{&cfg.Server, os.Getenv("TODOCTL_SERVER"), *server},
+		{&cfg.Token, os.Getenv("TODOCTL_TOKEN"), *token},
+	} {
+		if s.env != "" {
+			*s.dst = s.env
+		}
+		if s.flag != "" {
+			*s.dst = s.flag
+		}
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{base: strings.TrimSuffix(cfg.Server, "/"), token: cfg.Token, http: &fasthttp.Client{}}
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "list":
+		err = list(c, args)
+	case "add":
+		err = add(c, args)
+	case "done":
+		err = done(c, args)
+	case "rm":
+		err = remove(c, args)
+	case "export":
+		err = export(c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "todoctl: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "todoctl: %s\n", err)
+	os.Exit(1)
+}
+
+// output is the format todos are printed in, "table" or "json". It can be
+// set before or after the command.
+var output string
+
+// parseFlags parses the flags of a command, which include -o.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.StringVar(&output, "o", output, "output format: table or json")
+	fs.Parse(args)
+	if output != "table" && output != "json" {
+		fmt.Fprintln(os.Stderr, "todoctl: -o must be table or json")
+		os.Exit(2)
+	}
+}
+
+// parseIDs parses the todo IDs given as arguments.
+func parseIDs(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no todo IDs given")
+	}
+	ids := make([]int, len(args))
+	for i, arg := range args {
+		id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid todo ID %q", arg)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// printTodos writes todos to stdout in the output format.
+func printTodos(todos []todo) error {
+	if output == "json" {
+		raws := make([]json.RawMessage, len(todos))
+		for i, t := range todos {
+			raws[i] = t.raw
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(raws)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPRIORITY\tPROJECT\tDUE\tTITLE")
+	for _, t := range todos {
+		due := "-"
+		if t.DueAt != nil {
+			due = t.DueAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", t.ID, orDash(t.Status), orDash(t.Priority), orDash(t.Project), due, t.Title)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func list(c *client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	all := fs.Bool("all", false, "include completed todos")
+	project := fs.String("project", "", "only list the todos of this project")
+	parseFlags(fs, args)
+
+	body, err := c.do("GET", "/todos", nil)
+	if err != nil {
+		return err
+	}
+	var todos []todo
+	if err := json.Unmarshal(body, &todos); err != nil {
+		return err
+	}
+	shown := []todo{}
+	for _, t := range todos {
+		if (*all || !t.Completed) && (*project == "" || t.Project == *project) {
+			shown = append(shown, t)
+		}
+	}
+	return printTodos(shown)
+}
+
+func add(c *client, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	priority := fs.String("priority", "", "priority: low, medium, high or urgent")
+	project := fs.String("project", "", "project")
+	tags := fs.String("tags", "", "comma-separated tags")
+	due := fs.String("due", "", "due date, RFC 3339 or YYYY-MM-DD")
+	parseFlags(fs, args)
+
+	title := strings.Join(fs.Args(), " ")
+	if title == "" {
+		return errors.New("add needs a title")
+	}
+	req := map[string]interface{}{"title": title}
+	if *priority != "" {
+		req["priority"] = *priority
+	}
+	if *project != "" {
+		req["project"] = *project
+	}
+	if *tags != "" {
+		req["tags"] = strings.Split(*tags, ",")
+	}
+	if *due != "" {
+		// The API takes RFC 3339 timestamps; dates are due at midnight.
+		if day, err := time.ParseInLocation("2006-01-02", *due, time.Local); err == nil {
+			*due = day.Format(time.RFC3339)
+		}
+		req["due_at"] = *due
+	}
+	body, err := c.do("POST", "/todos", req)
+	if err != nil {
+		return err
+	}
+	var created todo
+	if err := json.Unmarshal(body, &created); err != nil {
+		return err
+	}
+	return printTodos([]todo{created})
+}
+
+// done completes the todos through their toggle endpoint, which completes
+// their subtasks too. Todos already completed are left as they are.
+func done(c *client, args []string) error {
+	fs := flag.NewFlagSet("done", flag.ExitOnError)
+	parseFlags(fs, args)
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	completed := []todo{}
+	for _, id := range ids {
+		path := "/todos/" + strconv.Itoa(id)
+		body, err := c.do("GET", path, nil)
+		if err != nil {
+			return fmt.Errorf("todo %d: %w", id, err)
+		}
+		var t todo
+		if err := json.Unmarshal(body, &t); err != nil {
+			return err
+		}
+		if !t.Completed {
+			if body, err = c.do("POST", path+"/toggle", nil); err != nil {
+				return fmt.Errorf("todo %d: %w", id, err)
+			}
+			if err := json.Unmarshal(body, &t); err != nil {
+				return err
+			}
+		}
+		completed = append(completed, t)
+	}
+	return printTodos(completed)
+}
+
+func remove(c *client, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := c.do("DELETE", "/todos/"+strconv.Itoa(id), nil); err != nil {
+			return fmt.Errorf("todo %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func export(c *client, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "export format: json, csv or zip")
+	out := fs.String("out", "", "file to write the export to (default stdout)")
+	fs.Parse(args)
+
+	if *format == "zip" && *out == "" {
+		return errors.New("zip exports need -out")
+	}
+	body, err := c.do("POST", "/todos/export", map[string]interface{}{"filter": struct{}{}, "format": *format})
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = w.Write(body)
+	return err
+}
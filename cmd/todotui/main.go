@@ -0,0 +1,657 @@
+// Command todotui shows the todos of a running todo API as a live board in
+// the terminal, with a column per status, and completes, edits and adds
+// todos from the keyboard.
+//
+//	go run ./cmd/todotui -server http://localhost:8080
+//
+// The board follows the server's event stream, GET /v1/events, so changes
+// made elsewhere show up as they happen. It reads the server and API key
+// like todoctl: from todoctl/config.json in the user config directory, the
+// TODOCTL_SERVER and TODOCTL_TOKEN environment variables, or the -server
+// and -token flags. The terminal is switched to raw mode with stty, so
+// todotui runs on Unix-like systems only.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// columns are the statuses of the board, in order.
+var columns = []string{"backlog", "in_progress", "blocked", "done"}
+
+// todo holds the fields of a todo the board shows, and the subtasks, which
+// are sent back unchanged when the title is edited.
+type todo struct {
+	ID        int             `json:"id"`
+	Title     string          `json:"title"`
+	Status    string          `json:"status"`
+	Completed bool            `json:"completed"`
+	Priority  string          `json:"priority"`
+	Project   string          `json:"project"`
+	Assignee  string          `json:"assignee"`
+	Tags      []string        `json:"tags"`
+	Subtasks  json.RawMessage `json:"subtasks"`
+}
+
+// matches reports whether the todo contains filter, case-insensitively, in
+// its title, project, assignee, priority or tags.
+func (t *todo) matches(filter string) bool {
+	if filter == "" {
+		return true
+	}
+	text := strings.ToLower(strings.Join(append([]string{t.Title, t.Project, t.Assignee, t.Priority}, t.Tags...), " "))
+	return strings.Contains(text, strings.ToLower(filter))
+}
+
+// api sends requests to the server.
+type api struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func (a *api) request(method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.base+"/v1"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	return req, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, failing unless its status is 2xx.
+func (a *api) do(method, path string, body, out interface{}) error {
+	req, err := a.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// event is the data of a Server-Sent Event of GET /events.
+type event struct {
+	Type   string `json:"type"`
+	TodoID int    `json:"todo_id"`
+	Todo   *todo  `json:"todo"`
+}
+
+// follow reads the event stream and calls fn for every event until the
+// stream ends.
+func (a *api) follow(connected func(), fn func(event)) error {
+	req, err := a.request("GET", "/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("event stream: " + resp.Status)
+	}
+	connected()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e event
+		if json.Unmarshal([]byte(data), &e) == nil {
+			fn(e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// mode is what keys do: move around the board, or edit a line of text.
+type mode int
+
+const (
+	modeBoard mode = iota
+	modeFilter
+	modeEdit
+	modeAdd
+)
+
+// board is the state of the UI. mu guards all of it, since events arrive
+// while keys are handled.
+type board struct {
+	mu      sync.Mutex
+	todos   map[int]*todo
+	filter  string
+	col     int
+	row     [4]int
+	mode    mode
+	input   []rune
+	editID  int
+	status  string
+	live    bool
+	width   int
+	height  int
+	redraws chan struct{}
+}
+
+func (b *board) redraw() {
+	select {
+	case b.redraws <- struct{}{}:
+	default:
+	}
+}
+
+// setStatus shows msg in the status line.
+func (b *board) setStatus(msg string) {
+	b.mu.Lock()
+	b.status = msg
+	b.mu.Unlock()
+	b.redraw()
+}
+
+// column returns the todos of column c that match the filter, by ID.
+func (b *board) column(c int) []*todo {
+	var list []*todo
+	for _, t := range b.todos {
+		status := t.Status
+		if status == "" {
+			status = "backlog"
+			if t.Completed {
+				status = "done"
+			}
+		}
+		if status == columns[c] && t.matches(b.filter) {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// selected returns the todo under the cursor, if any.
+func (b *board) selected() *todo {
+	list := b.column(b.col)
+	if len(list) == 0 {
+		return nil
+	}
+	if b.row[b.col] >= len(list) {
+		b.row[b.col] = len(list) - 1
+	}
+	return list[b.row[b.col]]
+}
+
+// reload replaces the todos with those on the server.
+func (b *board) reload(a *api) error {
+	var list []*todo
+	if err := a.do("GET", "/todos", nil, &list); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.todos = make(map[int]*todo, len(list))
+	for _, t := range list {
+		b.todos[t.ID] = t
+	}
+	b.mu.Unlock()
+	b.redraw()
+	return nil
+}
+
+// apply updates the board with an event of the stream.
+func (b *board) apply(e event) {
+	b.mu.Lock()
+	switch {
+	case e.Type == "todo.deleted":
+		delete(b.todos, e.TodoID)
+	case e.Todo != nil:
+		b.todos[e.TodoID] = e.Todo
+	}
+	b.mu.Unlock()
+	b.redraw()
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	if n == 1 {
+		return "…"
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// pad truncates or pads s with spaces to exactly n runes.
+func pad(s string, n int) string {
+	s = truncate(s, n)
+	return s + strings.Repeat(" ", n-utf8.RuneCountInString(s))
+}
+
+const help = "←→↑↓/hjkl move  space complete  e edit  a add  / filter  r reload  q quit"
+
+// render draws the board.
+func (b *board) render(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	live := "\x1b[33mconnecting…\x1b[0m"
+	if b.live {
+		live = "\x1b[32mlive\x1b[0m"
+	}
+	title := fmt.Sprintf("Todos — %d  %s", len(b.todos), live)
+	if b.filter != "" {
+		title += "  filter: " + b.filter
+	}
+	out.WriteString(title + "\r\n\r\n")
+
+	colWidth := b.width / len(columns)
+	rows := b.height - 5
+	lists := make([][]*todo, len(columns))
+	header := ""
+	for c := range columns {
+		lists[c] = b.column(c)
+		name := strings.ToUpper(strings.ReplaceAll(columns[c], "_", " "))
+		header += "\x1b[1m" + pad(fmt.Sprintf(" %s (%d)", name, len(lists[c])), colWidth) + "\x1b[0m"
+	}
+	out.WriteString(header + "\r\n")
+	for r := 0; r < rows; r++ {
+		for c := range columns {
+			// Scroll the column so the cursor stays visible.
+			offset := 0
+			if b.row[c] >= rows {
+				offset = b.row[c] - rows + 1
+			}
+			i := r + offset
+			if i >= len(lists[c]) {
+				out.WriteString(strings.Repeat(" ", colWidth))
+				continue
+			}
+			t := lists[c][i]
+			mark := " "
+			if t.Priority == "high" || t.Priority == "urgent" {
+				mark = "!"
+			}
+			cell := pad(fmt.Sprintf(" %s#%d %s", mark, t.ID, t.Title), colWidth-1) + " "
+			if c == b.col && i == b.row[c] && b.mode == modeBoard {
+				cell = "\x1b[7m" + cell + "\x1b[0m"
+			}
+			out.WriteString(cell)
+		}
+		out.WriteString("\r\n")
+	}
+
+	switch b.mode {
+	case modeFilter:
+		out.WriteString("filter: " + string(b.input) + "█\r\n")
+	case modeEdit:
+		out.WriteString(fmt.Sprintf("title of #%d: %s█\r\n", b.editID, string(b.input)))
+	case modeAdd:
+		out.WriteString("new todo: " + string(b.input) + "█\r\n")
+	default:
+		out.WriteString(truncate(b.status, b.width) + "\r\n")
+	}
+	out.WriteString("\x1b[2m" + truncate(help, b.width) + "\x1b[0m")
+	io.WriteString(w, out.String())
+}
+
+// key names the keys todotui tells apart.
+type key string
+
+const (
+	keyUp        key = "up"
+	keyDown      key = "down"
+	keyLeft      key = "left"
+	keyRight     key = "right"
+	keyEnter     key = "enter"
+	keyEscape    key = "esc"
+	keyBackspace key = "backspace"
+	keyCtrlC     key = "ctrl-c"
+)
+
+// readKeys reads keys from r, which must be a terminal in raw mode, and
+// sends them to keys: the named ones above, or the typed character.
+func readKeys(r io.Reader, keys chan<- key) {
+	in := bufio.NewReader(r)
+	for {
+		c, _, err := in.ReadRune()
+		if err != nil {
+			close(keys)
+			return
+		}
+		switch c {
+		case 3:
+			keys <- keyCtrlC
+		case '\r', '\n':
+			keys <- keyEnter
+		case 127, 8:
+			keys <- keyBackspace
+		case 27:
+			// Arrow keys are sent as ESC [ A to D; a lone ESC is Escape.
+			if in.Buffered() == 0 {
+				keys <- keyEscape
+				continue
+			}
+			if b, _ := in.ReadByte(); b != '[' {
+				keys <- keyEscape
+				continue
+			}
+			b, _ := in.ReadByte()
+			switch b {
+			case 'A':
+				keys <- keyUp
+			case 'B':
+				keys <- keyDown
+			case 'C':
+				keys <- keyRight
+			case 'D':
+				keys <- keyLeft
+			}
+		default:
+			keys <- key(c)
+		}
+	}
+}
+
+// handle acts on a key and reports whether todotui should quit. Requests
+// to the server are sent in the background; the board changes when their
+// events arrive.
+func (b *board) handle(a *api, k key) (quit bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.redraw()
+
+	if b.mode != modeBoard {
+		switch k {
+		case keyEscape, keyCtrlC:
+			if b.mode == modeFilter {
+				b.filter = ""
+			}
+			b.mode = modeBoard
+		case keyEnter:
+			text := strings.TrimSpace(string(b.input))
+			switch b.mode {
+			case modeFilter:
+				b.filter = text
+			case modeEdit:
+				if t, ok := b.todos[b.editID]; ok && text != "" && text != t.Title {
+					id, subtasks := t.ID, t.Subtasks
+					// Updates replace the subtasks, so the current ones are
+					// sent along.
+					if subtasks == nil {
+						subtasks = json.RawMessage("[]")
+					}
+					go b.send(a, "PUT", "/todos/"+strconv.Itoa(id),
+						map[string]interface{}{"title": text, "subtasks": subtasks},
+						fmt.Sprintf("Renamed #%d", id))
+				}
+			case modeAdd:
+				if text != "" {
+					go b.send(a, "POST", "/todos", map[string]string{"title": text}, "Added "+text)
+				}
+			}
+			b.mode = modeBoard
+		case keyBackspace:
+			if len(b.input) > 0 {
+				b.input = b.input[:len(b.input)-1]
+			}
+			if b.mode == modeFilter {
+				b.filter = string(b.input)
+			}
+		default:
+			if r := []rune(string(k)); len(r) == 1 {
+				b.input = append(b.input, r[0])
+				if b.mode == modeFilter {
+					b.filter = string(b.input)
+				}
+			}
+		}
+		return false
+	}
+
+	switch k {
+	case "q", keyCtrlC:
+		return true
+	case keyLeft, "h":
+		b.col = (b.col + len(columns) - 1) % len(columns)
+	case keyRight, "l":
+		b.col = (b.col + 1) % len(columns)
+	case keyUp, "k":
+		if b.row[b.col] > 0 {
+			b.row[b.col]--
+		}
+	case keyDown, "j":
+		if b.row[b.col] < len(b.column(b.col))-1 {
+			b.row[b.col]++
+		}
+	case " ", "x":
+		if t := b.selected(); t != nil {
+			verb := "Completed"
+			if t.Completed {
+				verb = "Reopened"
+			}
+			go b.send(a, "POST", "/todos/"+strconv.Itoa(t.ID)+"/toggle", nil, fmt.Sprintf("%s #%d", verb, t.ID))
+		}
+	case "e":
+		if t := b.selected(); t != nil {
+			b.mode, b.editID, b.input = modeEdit, t.ID, []rune(t.Title)
+		}
+	case "a":
+		b.mode, b.input = modeAdd, nil
+	case "/":
+		b.mode, b.input = modeFilter, []rune(b.filter)
+	case "r":
+		go func() {
+			if err := b.reload(a); err != nil {
+				b.setStatus("Reload failed: " + err.Error())
+			}
+		}()
+	}
+	return false
+}
+
+// send sends a request and reports the outcome in the status line.
+func (b *board) send(a *api, method, path string, body interface{}, done string) {
+	if err := a.do(method, path, body, nil); err != nil {
+		b.setStatus("Failed: " + err.Error())
+		return
+	}
+	b.setStatus(done)
+}
+
+// stty runs stty on the terminal with the given arguments.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalSize returns the width and height of the terminal.
+func terminalSize() (width, height int) {
+	size, err := stty("size")
+	if err == nil {
+		if rows, cols, ok := strings.Cut(size, " "); ok {
+			height, _ = strconv.Atoi(rows)
+			width, _ = strconv.Atoi(cols)
+		}
+	}
+	if width < 40 || height < 10 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// loadConfig reads the todoctl config file at path, if there is one.
+func loadConfig(path string, explicit bool) (server, token string, err error) {
+	cfg := struct {
+		Server string `json:"server"`
+		Token  string `json:"token"`
+	}{Server: "http://localhost:8080"}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg.Server, cfg.Token, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg.Server, cfg.Token, nil
+}
+
+func main() {
+	defaultPath := ""
+	if dir, err := os.UserConfigDir(); err == nil {
+		defaultPath = filepath.Join(dir, "todoctl", "config.json")
+	}
+	configPath := flag.String("config", "", "todoctl config file (default "+defaultPath+")")
+	serverFlag := flag.String("server", "", "base URL of the API, overriding the config file")
+	tokenFlag := flag.String("token", "", "API key, overriding the config file")
+	flag.Parse()
+
+	path := *configPath
+	if path == "" {
+		path = defaultPath
+	}
+	server, token, err := loadConfig(path, *configPath != "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "todotui: %s\n", err)
+		os.Exit(1)
+	}
+	for _, s := range []struct {
+		dst       *string
+		env, flag string
+	}{
+		{&server, os.Getenv("TODOCTL_SERVER"), *serverFlag},
+		{&token, os.Getenv("TODOCTL_TOKEN"), *tokenFlag},
+	} {
+		if s.env != "" {
+			*s.dst = s.env
+		}
+		if s.flag != "" {
+			*s.dst = s.flag
+		}
+	}
+
+	a := &api{base: strings.TrimSuffix(server, "/"), token: token, client: &http.Client{Timeout: 30 * time.Second}}
+	b := &board{todos: map[int]*todo{}, redraws: make(chan struct{}, 1), status: "Connected to " + a.base}
+	if err := b.reload(a); err != nil {
+		fmt.Fprintf(os.Stderr, "todotui: %s\n", err)
+		os.Exit(1)
+	}
+
+	saved, err := stty("-g")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "todotui: standard input is not a terminal")
+		os.Exit(1)
+	}
+	stty("raw", "-echo")
+	// Switch to the alternate screen and hide the cursor while running.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		stty(saved)
+	}()
+	b.width, b.height = terminalSize()
+
+	// Follow the event stream, reloading after every reconnect so no
+	// change is missed.
+	go func() {
+		for {
+			err := a.follow(func() {
+				b.mu.Lock()
+				b.live = true
+				b.mu.Unlock()
+				b.reload(a)
+			}, b.apply)
+			b.mu.Lock()
+			b.live = false
+			b.mu.Unlock()
+			b.setStatus("Disconnected: " + err.Error())
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	keys := make(chan key)
+	go readKeys(os.Stdin, keys)
+	resize := time.NewTicker(time.Second)
+	defer resize.Stop()
+	b.redraw()
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok || b.handle(a, k) {
+				return
+			}
+		case <-b.redraws:
+			b.render(os.Stdout)
+		case <-resize.C:
+			if w, h := terminalSize(); w != b.width || h != b.height {
+				b.mu.Lock()
+				b.width, b.height = w, h
+				b.mu.Unlock()
+				b.redraw()
+			}
+		}
+	}
+}
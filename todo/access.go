@@ -0,0 +1,143 @@
+package todo
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// principal is a caller identified by an API key, together with its role
+// and the projects it may see.
+type principal struct {
+	name string
+	role role
+	// all grants access to every project, including todos without one.
+	all      bool
+	projects map[string]bool
+	// allTenants grants access to every tenant namespace, tenants to the
+	// listed ones. Every principal may use the default namespace.
+	allTenants bool
+	tenants    map[string]bool
+}
+
+// apiKeys maps API keys to their principals. It is set once at startup;
+// when it is empty every caller may see everything.
+var apiKeys map[string]*principal
+
+// parseAPIKeys parses a comma-separated list of
+// "name:key=projects@role#tenants" entries, where projects is a
+// "|"-separated list of project names or "*" for all projects, role one of
+// roles, defaultRole if left out, and tenants a "|"-separated list of the
+// tenant namespaces the key may use or "*" for all of them, none if left
+// out. The name, which identifies the caller in the audit log and in access
+// tokens, is optional, e.g., "alice:s3cret=work|home#acme,ops=*@admin#*".
+// Keys and names must be unique.
+func parseAPIKeys(spec string) (map[string]*principal, error) {
+	keys := make(map[string]*principal)
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, projects, ok := strings.Cut(entry, "=")
+		if !ok || key == "" || projects == "" {
+			return nil, fmt.Errorf("invalid API key entry %q, expected key=projects", entry)
+		}
+		p := &principal{
+			name:     "api-key-" + strconv.Itoa(len(keys)+1),
+			role:     defaultRole,
+			projects: make(map[string]bool),
+			tenants:  make(map[string]bool),
+		}
+		if rest, tenants, ok := strings.Cut(projects, "#"); ok {
+			if rest == "" || tenants == "" {
+				return nil, fmt.Errorf("invalid tenants in API key entry %q, expected tenant IDs or *", entry)
+			}
+			for _, tenant := range strings.Split(tenants, "|") {
+				if tenant == "*" {
+					p.allTenants = true
+				} else {
+					p.tenants[tenant] = true
+				}
+			}
+			projects = rest
+		}
+		if rest, name, ok := strings.Cut(projects, "@"); ok {
+			r, known := roles[name]
+			if !known || rest == "" {
+				return nil, fmt.Errorf("invalid role in API key entry %q, expected viewer, editor or admin", entry)
+			}
+			p.role, projects = r, rest
+		}
+		if name, k, ok := strings.Cut(key, ":"); ok {
+			p.name, key = name, k
+		}
+		for _, project := range strings.Split(projects, "|") {
+			if project == "*" {
+				p.all = true
+			} else {
+				p.projects[project] = true
+			}
+		}
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("duplicate API key in entry %q", entry)
+		}
+		if names[p.name] {
+			return nil, fmt.Errorf("duplicate API key name %q in entry %q", p.name, entry)
+		}
+		keys[key] = p
+		names[p.name] = true
+	}
+	return keys, nil
+}
+
+// callerKey returns the API key or access token sent with the request,
+// either as a bearer token or in the X-API-Key header. Requests for the
+// server-rendered UI may send it in its cookie instead, see uiLogin.
+func callerKey(ctx *fasthttp.RequestCtx) string {
+	if key := ctx.Request.Header.Peek("X-API-Key"); len(key) > 0 {
+		return string(key)
+	}
+	auth := ctx.Request.Header.Peek("Authorization")
+	if token, ok := bytes.CutPrefix(auth, []byte("Bearer ")); ok {
+		return string(token)
+	}
+	if bytes.HasPrefix(ctx.Path(), []byte("/ui/")) {
+		return string(ctx.Request.Header.Cookie(uiKeyCookie))
+	}
+	return ""
+}
+
+// authenticate returns the principal making the request. When no API keys
+// are configured it returns an unrestricted principal. ok is false if keys
+// are configured and the request carries no valid one.
+func authenticate(ctx *fasthttp.RequestCtx) (p *principal, ok bool) {
+	return principalFor(callerKey(ctx))
+}
+
+// principalFor returns the principal of the API key or access token sent
+// by a caller, like authenticate does for HTTP requests.
+func principalFor(key string) (p *principal, ok bool) {
+	if len(apiKeys) == 0 {
+		return &principal{name: "anonymous", role: roleAdmin, all: true, allTenants: true}, true
+	}
+	if p, ok = apiKeys[key]; ok {
+		return p, true
+	}
+	return principalForToken(key)
+}
+
+// inTenant reports whether p may use the namespace of the given tenant.
+func (p *principal) inTenant(id string) bool {
+	return p.allTenants || p.tenants[id]
+}
+
+// canSee reports whether p may see todos of the given project. Todos without
+// a project are only visible to principals with access to all projects.
+func (p *principal) canSee(project string) bool {
+	return p.all || (project != "" && p.projects[project])
+}
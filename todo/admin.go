@@ -0,0 +1,184 @@
+package todo
+
+import (
+	"crypto/subtle"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// adminToken guards the /admin/stats and /admin/config endpoints; empty
+// disables them.
+var adminToken string
+
+// startTime is when the server started.
+var startTime = time.Now()
+
+// maxCountedRoutes bounds the number of routes with their own request
+// counter; requests for further routes are counted as "other".
+const maxCountedRoutes = 256
+
+var (
+	routeCountsMu sync.Mutex
+	routeCounts   = make(map[string]uint64)
+)
+
+// countRequests wraps h, counting requests per method and route. Numeric
+// path segments are replaced by {id}, project names by {project}, tenant
+// names by {tenant} and the users of shares by {user}.
+func countRequests(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		route := string(ctx.Method()) + " " + routePattern(string(ctx.Path()))
+		routeCountsMu.Lock()
+		if _, ok := routeCounts[route]; !ok && len(routeCounts) >= maxCountedRoutes {
+			route = "other"
+		}
+		routeCounts[route]++
+		routeCountsMu.Unlock()
+		h(ctx)
+	}
+}
+
+// routePattern returns the route a request path belongs to.
+func routePattern(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case i > 0 && segments[i-1] == "projects" && s != "":
+			segments[i] = "{project}"
+		case i > 0 && (segments[i-1] == "tenants" || segments[i-1] == "namespaces") && s != "":
+			segments[i] = "{tenant}"
+		case i > 0 && segments[i-1] == "share" && s != "":
+			segments[i] = "{user}"
+		case s != "" && strings.Trim(s, "0123456789") == "" || isUUID(s):
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// requireAdmin reports whether the request carries the admin token in an
+// X-Admin-Token header or an API key with the admin role, responding with
+// an error if it doesn't.
+func requireAdmin(ctx *fasthttp.RequestCtx) bool {
+	if caller, ok := authenticate(ctx); ok && len(apiKeys) > 0 && caller.role == roleAdmin {
+		return true
+	}
+	if adminToken == "" {
+		ctx.Error("Admin endpoints are disabled, set an admin token to enable them", fasthttp.StatusForbidden)
+		return false
+	}
+	token := ctx.Request.Header.Peek("X-Admin-Token")
+	if subtle.ConstantTimeCompare(token, []byte(adminToken)) != 1 {
+		ctx.Error("Invalid admin token", fasthttp.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// getAdminConfig handles GET /admin/config and reports the effective
+// configuration and where each value came from.
+func getAdminConfig(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"settings": effectiveConfig(),
+	})
+}
+
+// adminStats is the body of GET /admin/stats.
+type adminStats struct {
+	Todos struct {
+		Total      int            `json:"total"`
+		Overdue    int            `json:"overdue"`
+		ByStatus   map[string]int `json:"by_status"`
+		ByPriority map[string]int `json:"by_priority"`
+		ByTag      map[string]int `json:"by_tag"`
+	} `json:"todos"`
+	Uploads struct {
+		Files int   `json:"files"`
+		Bytes int64 `json:"bytes"`
+	} `json:"uploads"`
+	// Memory estimates the memory used by the todos from the size of their
+	// JSON encodings, next to the heap size of the whole process.
+	Memory struct {
+		TodosBytes int    `json:"todos_bytes"`
+		HeapBytes  uint64 `json:"heap_bytes"`
+	} `json:"memory"`
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	Requests      map[string]uint64 `json:"requests"`
+	// SlowRequests counts the requests that took longer than their latency
+	// budget, see latencyBudget.
+	SlowRequests map[string]uint64 `json:"slow_requests"`
+}
+
+// getAdminStats handles GET /admin/stats.
+func getAdminStats(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+
+	var stats adminStats
+	stats.Todos.ByStatus = make(map[string]int, len(statuses))
+	for _, status := range statuses {
+		stats.Todos.ByStatus[status] = 0
+	}
+	stats.Todos.ByPriority = make(map[string]int)
+	stats.Todos.ByTag = make(map[string]int)
+	now := time.Now()
+	store.each(func(todo *Todo) bool {
+		stats.Todos.Total++
+		stats.Todos.ByStatus[todo.Status]++
+		if !todo.Completed && todo.DueAt != nil && todo.DueAt.Before(now) {
+			stats.Todos.Overdue++
+		}
+		priority := todo.Priority
+		if priority == "" {
+			priority = "none"
+		}
+		stats.Todos.ByPriority[priority]++
+		for _, tag := range todo.Tags {
+			stats.Todos.ByTag[tag]++
+		}
+		stats.Memory.TodosBytes += len(todo.raw)
+		return true
+	})
+
+	filepath.WalkDir("uploads", func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			stats.Uploads.Files++
+			stats.Uploads.Bytes += info.Size()
+		}
+		return nil
+	})
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.Memory.HeapBytes = mem.HeapAlloc
+	stats.UptimeSeconds = time.Since(startTime).Seconds()
+
+	routeCountsMu.Lock()
+	stats.Requests = make(map[string]uint64, len(routeCounts))
+	for route, n := range routeCounts {
+		stats.Requests[route] = n
+	}
+	routeCountsMu.Unlock()
+
+	slowCountsMu.Lock()
+	stats.SlowRequests = make(map[string]uint64, len(slowCounts))
+	for route, n := range slowCounts {
+		stats.SlowRequests[route] = n
+	}
+	slowCountsMu.Unlock()
+
+	writeJSON(ctx, fasthttp.StatusOK, stats)
+}
@@ -0,0 +1,171 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// archiveActor names the changes made by automatic archival in the
+// activity log.
+const archiveActor = "archive"
+
+// archiveAfter is how long after completion the archive task archives
+// todos, see -archive-after; zero disables it. It is set once at startup.
+var archiveAfter time.Duration
+
+// errNotCompleted is returned when archiving a todo that isn't completed.
+var errNotCompleted = errors.New("todo is not completed")
+
+// archived reports whether the todo was archived. Archived todos are left
+// out of GET /todos and listed by GET /archive instead; reopening a todo
+// takes it out of the archive, see saved.
+func (t *Todo) archived() bool {
+	return t.ArchivedAt != nil
+}
+
+// setArchived archives or unarchives the todo of ns with the given ID and
+// returns its JSON encoding. It fails with errNotCompleted for todos that
+// aren't completed.
+func setArchived(ns *namespace, actor string, id int, archive bool) ([]byte, bool, error) {
+	raw, ok, err := ns.changeTodo(actor, id, func(todo *Todo) error {
+		if todo.archived() == archive {
+			return errNoChange
+		}
+		if archive && !todo.Completed {
+			return errNotCompleted
+		}
+		now := time.Now()
+		todo.ArchivedAt = nil
+		if archive {
+			todo.ArchivedAt = &now
+		}
+		todo.UpdatedAt = now
+		return nil
+	})
+	if err == errNoChange {
+		raw, ok = ns.store.raw(id)
+		err = nil
+	}
+	return raw, ok, err
+}
+
+// archiveTodo handles POST /todos/{id}/archive. Archiving an archived todo
+// changes nothing.
+func archiveTodo(ctx *fasthttp.RequestCtx, id int) {
+	raw, ok, err := setArchived(namespaceOf(ctx), actorOf(ctx), id, true)
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	if err != nil {
+		writeRequestError(ctx, fasthttp.StatusConflict, "Only completed todos can be archived", "complete the todo first")
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// unarchiveTodo handles DELETE /todos/{id}/archive, which puts the todo
+// back on the list.
+func unarchiveTodo(ctx *fasthttp.RequestCtx, id int) {
+	raw, ok, err := setArchived(namespaceOf(ctx), actorOf(ctx), id, false)
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// getArchive handles GET /archive, listing the archived todos the caller
+// may see, most recently archived first.
+func getArchive(ctx *fasthttp.RequestCtx) {
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	type entry struct {
+		id         int
+		archivedAt time.Time
+		raw        []byte
+	}
+	var entries []entry
+	done := traceOp(ctx, "store.scan")
+	namespaceOf(ctx).store.each(func(todo *Todo) bool {
+		if todo.archived() && (visible == nil || visible(todo)) {
+			entries = append(entries, entry{todo.ID, *todo.ArchivedAt, todo.raw})
+		}
+		return true
+	})
+	done()
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].archivedAt.Equal(entries[j].archivedAt) {
+			return entries[i].archivedAt.After(entries[j].archivedAt)
+		}
+		return entries[i].id < entries[j].id
+	})
+	raws := make([][]byte, len(entries))
+	for i, e := range entries {
+		raws[i] = e.raw
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, joinJSON(raws))
+}
+
+// archiveResult summarizes an archive run: the IDs of the todos archived
+// in the default namespace and, by tenant, in the tenant namespaces.
+type archiveResult struct {
+	Archived []int            `json:"archived"`
+	Tenants  map[string][]int `json:"tenants,omitempty"`
+}
+
+// archiveCompleted is the archive task: it archives the todos of all
+// namespaces completed more than archiveAfter ago.
+func archiveCompleted(ctx context.Context, p *jobProgress) (interface{}, error) {
+	result := archiveResult{Archived: []int{}}
+	if archiveAfter <= 0 {
+		return result, nil
+	}
+	cutoff := time.Now().Add(-archiveAfter)
+	scopes := allNamespaces()
+	due := make([][]int, len(scopes))
+	total := 0
+	for i, ns := range scopes {
+		ns.store.each(func(todo *Todo) bool {
+			if !todo.archived() && todo.CompletedAt != nil && todo.CompletedAt.Before(cutoff) {
+				due[i] = append(due[i], todo.ID)
+			}
+			return true
+		})
+		sort.Ints(due[i])
+		total += len(due[i])
+	}
+	p.setTotal(total)
+	for i, ns := range scopes {
+		for _, id := range due[i] {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			// The todo may have been reopened or archived meanwhile.
+			if _, ok, err := setArchived(ns, archiveActor, id, true); ok && err == nil {
+				if ns == defaultNamespace {
+					result.Archived = append(result.Archived, id)
+				} else {
+					if result.Tenants == nil {
+						result.Tenants = make(map[string][]int)
+					}
+					result.Tenants[ns.id] = append(result.Tenants[ns.id], id)
+				}
+			}
+			p.advance(1)
+		}
+	}
+	return result, nil
+}
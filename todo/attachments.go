@@ -0,0 +1,385 @@
+package todo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Attachment is a file attached to a todo, such as an image, a PDF or a
+// text file. The file itself is kept in the uploads directory at Path.
+type Attachment struct {
+	ID int `json:"id"`
+	// Name is the file name the client uploaded the file as.
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MIMEType string `json:"mime_type"`
+	// Checksum is the hex-encoded SHA-256 digest of the contents.
+	Checksum  string    `json:"checksum"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// attachmentFields are the multipart fields carrying uploaded files;
+// "images" is the field used before todos had attachments.
+var attachmentFields = []string{"attachments", "images"}
+
+// inlineTypes are the MIME types of attachments that may be downloaded for
+// display in the browser with ?disposition=inline. Everything else is
+// always sent as a download.
+var inlineTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+
+// uploadedFiles returns the files uploaded in form, in the order of
+// attachmentFields.
+func uploadedFiles(form *multipart.Form) []*multipart.FileHeader {
+	var files []*multipart.FileHeader
+	for _, field := range attachmentFields {
+		files = append(files, form.File[field]...)
+	}
+	return files
+}
+
+// saveAttachments saves the files uploaded in form to the namespace's
+// uploads directory, responding with an error if one can't be saved.
+func saveAttachments(ctx *fasthttp.RequestCtx, form *multipart.Form) ([]Attachment, bool) {
+	var list []Attachment
+	for _, fileHeader := range uploadedFiles(form) {
+		done := traceOp(ctx, "file.save")
+		a, err := saveAttachment(namespaceOf(ctx).uploads, fileHeader)
+		done()
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return nil, false
+		}
+		list = append(list, a)
+	}
+	return list, true
+}
+
+// saveAttachment saves an uploaded file to disk, in the directory dir, and
+// returns it as an attachment without an ID. Images are processed as in
+// processImage.
+func saveAttachment(dir string, fileHeader *multipart.FileHeader) (Attachment, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer file.Close()
+
+	// Create a unique filename using a timestamp.
+	filename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), fileHeader.Filename)
+	filePath := filepath.Join(dir, filename)
+	out, err := os.Create(filePath)
+	if err != nil {
+		return Attachment{}, err
+	}
+	a, err := copyAttachment(out, file, fileHeader.Filename, fileHeader.Header.Get("Content-Type"))
+	out.Close()
+	if err != nil {
+		return Attachment{}, err
+	}
+	a.Path = filePath
+	return processImage(a)
+}
+
+// inUploads reports whether path names a file directly in the uploads
+// directory dir, where attachments are saved. Paths elsewhere, which
+// imported todos may carry, must not be served.
+func inUploads(dir, path string) bool {
+	path = filepath.Clean(path)
+	return filepath.Dir(path) == filepath.Clean(dir) && !strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// copyAttachment copies the contents of the file name from r to w and
+// returns its attachment, with the size, checksum and MIME type filled in.
+// declared is the type the client sent, if any.
+func copyAttachment(w io.Writer, r io.Reader, name, declared string) (Attachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Attachment{}, err
+	}
+	head = head[:n]
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return Attachment{}, err
+	}
+	return Attachment{
+		Name:      name,
+		Size:      size,
+		MIMEType:  attachmentType(name, declared, head),
+		Checksum:  hex.EncodeToString(h.Sum(nil)),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// attachmentType returns the MIME type of the file name starting with
+// head: the type the client declared, if specific, else the one its
+// extension stands for, else the one its contents look like.
+func attachmentType(name, declared string, head []byte) string {
+	if mediaType, params, err := mime.ParseMediaType(declared); err == nil && mediaType != "application/octet-stream" {
+		return mime.FormatMediaType(mediaType, params)
+	}
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	if head == nil {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head)
+}
+
+// attach adds a to the attachments of todo with the next free ID. IDs are
+// not reused while the server runs, see assignSubtaskIDs. It must be
+// called with the todo's shard locked, or before the todo is stored.
+func attach(todo *Todo, a Attachment) {
+	a.ID = max(todo.nextAttachmentID, 1)
+	todo.nextAttachmentID = a.ID + 1
+	todo.Attachments = append(todo.Attachments, a)
+}
+
+// trackAttachmentIDs makes sure the todo's next attachment ID is above the
+// IDs of all its attachments, such as those of an imported todo.
+func trackAttachmentIDs(todo *Todo) {
+	for _, a := range todo.Attachments {
+		if a.ID >= todo.nextAttachmentID {
+			todo.nextAttachmentID = a.ID + 1
+		}
+	}
+}
+
+// upgradeImages turns the image paths of a todo stored before todos had
+// attachments into attachments, reading the files for their size and
+// checksum where they still exist.
+func upgradeImages(todo *Todo) {
+	for _, path := range todo.Images {
+		a := Attachment{Path: path, Name: uploadName(path), CreatedAt: todo.CreatedAt}
+		if f, err := os.Open(path); err == nil {
+			a, _ = copyAttachment(io.Discard, f, a.Name, "")
+			a.Path, a.CreatedAt = path, todo.CreatedAt
+			f.Close()
+		} else {
+			a.MIMEType = attachmentType(a.Name, "", nil)
+		}
+		attach(todo, a)
+	}
+	todo.Images = nil
+}
+
+// uploadName returns the name a file in the uploads directory was uploaded
+// as, dropping the timestamp prefix of saveAttachment.
+func uploadName(path string) string {
+	name := filepath.Base(path)
+	if _, rest, ok := strings.Cut(name, "_"); ok {
+		return rest
+	}
+	return name
+}
+
+// findAttachment returns the attachment aid of todo, or nil.
+func findAttachment(todo *Todo, aid int) *Attachment {
+	for i := range todo.Attachments {
+		if todo.Attachments[i].ID == aid {
+			return &todo.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// routeAttachments routes requests for /todos/{id}/attachments and
+// /todos/{id}/attachments/{aid}[/content]; rest is the part after
+// "attachments".
+func routeAttachments(ctx *fasthttp.RequestCtx, method string, id int, rest string) {
+	if rest == "" {
+		switch method {
+		case "GET":
+			getAttachments(ctx, id)
+		case "POST":
+			createAttachments(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+	idPart, content := strings.CutSuffix(strings.TrimPrefix(rest, "/"), "/content")
+	aid, err := strconv.Atoi(idPart)
+	if err != nil {
+		ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+		return
+	}
+	switch {
+	case content && (method == "GET" || method == "HEAD"):
+		downloadAttachment(ctx, id, aid)
+	case !content && method == "GET":
+		getAttachment(ctx, id, aid)
+	case !content && method == "DELETE":
+		deleteAttachment(ctx, id, aid)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// getAttachments handles GET /todos/{id}/attachments, oldest first.
+func getAttachments(ctx *fasthttp.RequestCtx, id int) {
+	todo, ok := namespaceOf(ctx).store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	list := todo.Attachments
+	if list == nil {
+		list = []Attachment{}
+	}
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// createAttachments handles POST /todos/{id}/attachments with a multipart
+// body of files in the attachments field, and responds with the new
+// attachments.
+func createAttachments(ctx *fasthttp.RequestCtx, id int) {
+	form, ok := parseTodoForm(ctx)
+	if !ok {
+		return
+	}
+	if form.File == nil || len(uploadedFiles(form)) == 0 {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "No files",
+			"send the files as multipart/form-data in the attachments field")
+		return
+	}
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	added, ok := saveAttachments(ctx, form)
+	if !ok {
+		return
+	}
+	done := traceOp(ctx, "store.update")
+	_, ok, err := ns.changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		first := len(todo.Attachments)
+		for _, a := range added {
+			attach(todo, a)
+		}
+		added = append(added[:0], todo.Attachments[first:]...)
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	done()
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	if len(added) == 1 {
+		ctx.Response.Header.Set("Location", apiPrefix+"/todos/"+strconv.Itoa(id)+"/attachments/"+strconv.Itoa(added[0].ID))
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, added)
+}
+
+// getAttachment handles GET /todos/{id}/attachments/{aid}, which returns
+// the attachment's metadata.
+func getAttachment(ctx *fasthttp.RequestCtx, id, aid int) {
+	todo, ok := namespaceOf(ctx).store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	a := findAttachment(&todo, aid)
+	if a == nil {
+		ctx.Error("Attachment not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, a)
+}
+
+// downloadAttachment handles GET /todos/{id}/attachments/{aid}/content and
+// sends the file as a download under its original name. With
+// ?disposition=inline, images, PDFs and plain text are sent for display
+// instead.
+func downloadAttachment(ctx *fasthttp.RequestCtx, id, aid int) {
+	ns := namespaceOf(ctx)
+	todo, ok := ns.store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	a := findAttachment(&todo, aid)
+	if a == nil {
+		ctx.Error("Attachment not found", fasthttp.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(a.Path); err != nil || !inUploads(ns.uploads, a.Path) {
+		ctx.Error("Attachment file is missing", fasthttp.StatusGone)
+		return
+	}
+	disposition := "attachment"
+	mediaType, _, _ := mime.ParseMediaType(a.MIMEType)
+	if string(ctx.QueryArgs().Peek("disposition")) == "inline" && containsString(inlineTypes, mediaType) {
+		disposition = "inline"
+	}
+	fasthttp.ServeFileUncompressed(ctx, a.Path)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK && ctx.Response.StatusCode() != fasthttp.StatusPartialContent {
+		return
+	}
+	ctx.SetContentType(a.MIMEType)
+	ctx.Response.Header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	ctx.Response.Header.Set("X-Content-Type-Options", "nosniff")
+	ctx.Response.Header.Set("Content-Security-Policy", "sandbox")
+	ctx.Response.Header.Set("ETag", `"`+a.Checksum+`"`)
+}
+
+// deleteAttachment handles DELETE /todos/{id}/attachments/{aid}. The file
+// stays in the uploads directory, so undo can bring the attachment back,
+// until the next garbage collection.
+func deleteAttachment(ctx *fasthttp.RequestCtx, id, aid int) {
+	found := false
+	done := traceOp(ctx, "store.update")
+	_, ok, err := namespaceOf(ctx).changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		for i, a := range todo.Attachments {
+			if a.ID == aid {
+				todo.Attachments = append(todo.Attachments[:i:i], todo.Attachments[i+1:]...)
+				if len(todo.Attachments) == 0 {
+					todo.Attachments = nil
+				}
+				found = true
+				todo.UpdatedAt = time.Now()
+				return nil
+			}
+		}
+		return errNoChange
+	})
+	done()
+	if writeStoreError(ctx, err) {
+		return
+	}
+	switch {
+	case !ok:
+		todoNotFound(ctx, id)
+	case !found:
+		ctx.Error("Attachment not found", fasthttp.StatusNotFound)
+	case err != nil:
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+	default:
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}
+}
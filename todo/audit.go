@@ -0,0 +1,298 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Audit actions.
+const (
+	auditCreated = "created"
+	auditUpdated = "updated"
+	auditDeleted = "deleted"
+	auditUndone  = "undone"
+)
+
+// AuditEntry records one change to a todo.
+type AuditEntry struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	TodoID int       `json:"todo_id"`
+	// Changes lists the fields whose values differ before and after the
+	// change. It is computed when the entry is read.
+	Changes []AuditChange `json:"changes"`
+	// Undoes is the ID of the entry reverted by an "undone" entry.
+	Undoes int `json:"undoes,omitempty"`
+
+	before, after []byte
+}
+
+// AuditChange is the old and new value of a changed todo field. Old is left
+// out for created todos and New for deleted ones.
+type AuditChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+// auditLog is the history of all changes made to todos; entries are only
+// removed by retention policies, see prune. It keeps the JSON encodings of
+// the todo before and after each change, which are shared with the store
+// rather than copied.
+type auditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+	// byTodo indexes entries by todo ID.
+	byTodo map[int][]int
+	// lastID is the ID of the most recent entry.
+	lastID int
+}
+
+// activity is the audit log of the server's store.
+var activity = &auditLog{byTodo: make(map[int][]int)}
+
+// record appends a change to the log. Updates that left the todo unchanged
+// are ignored.
+func (l *auditLog) record(actor, action string, id int, before, after []byte) {
+	if action == auditUpdated && bytes.Equal(before, after) {
+		return
+	}
+	l.append(AuditEntry{Actor: actor, Action: action, TodoID: id, before: before, after: after})
+}
+
+// append adds e to the log, numbering and timestamping it.
+func (l *auditLog) append(e AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked(e)
+}
+
+func (l *auditLog) appendLocked(e AuditEntry) {
+	l.lastID++
+	e.ID = l.lastID
+	e.Time = time.Now()
+	l.entries = append(l.entries, e)
+	l.byTodo[e.TodoID] = append(l.byTodo[e.TodoID], len(l.entries)-1)
+}
+
+// since returns the entries recorded after t, oldest first.
+func (l *auditLog) since(t time.Time) []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Time.After(t) })
+	return append([]AuditEntry(nil), l.entries[i:]...)
+}
+
+// recent returns up to n of the most recent entries for which keep returns
+// true, newest first.
+func (l *auditLog) recent(n int, keep func(e *AuditEntry) bool) []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var list []AuditEntry
+	for i := len(l.entries) - 1; i >= 0 && len(list) < n; i-- {
+		if keep(&l.entries[i]) {
+			list = append(list, l.entries[i])
+		}
+	}
+	return list
+}
+
+// history returns the entries of the todo with the given ID, oldest first.
+func (l *auditLog) history(id int) []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	list := make([]AuditEntry, 0, len(l.byTodo[id]))
+	for _, i := range l.byTodo[id] {
+		list = append(list, l.entries[i])
+	}
+	return list
+}
+
+// creator returns the actor that created the todo with the given ID, or ""
+// if its creation isn't recorded.
+func (l *auditLog) creator(id int) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, i := range l.byTodo[id] {
+		if e := l.entries[i]; e.Action == auditCreated {
+			return e.Actor
+		}
+	}
+	return ""
+}
+
+// recordCreator records that actor created the todo with the given ID,
+// encoded as raw, unless the log already has its creation. Replicas record
+// the creators of the todos of their primary with it.
+func (l *auditLog) recordCreator(actor string, id int, raw []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, i := range l.byTodo[id] {
+		if l.entries[i].Action == auditCreated {
+			return
+		}
+	}
+	l.appendLocked(AuditEntry{Actor: actor, Action: auditCreated, TodoID: id, after: raw})
+}
+
+// last returns the most recent JSON encoding of the todo with the given
+// ID in the log, which for a deleted todo is the one before its deletion,
+// or nil if the log has none.
+func (l *auditLog) last(id int) []byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	indexes := l.byTodo[id]
+	for i := len(indexes) - 1; i >= 0; i-- {
+		if e := l.entries[indexes[i]]; e.after != nil {
+			return e.after
+		} else if e.before != nil {
+			return e.before
+		}
+	}
+	return nil
+}
+
+// deletions returns the IDs of the deleted todos, those whose last recorded
+// change removed them, with the time they were deleted.
+func (l *auditLog) deletions() map[int]time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	deleted := make(map[int]time.Time)
+	for id, indexes := range l.byTodo {
+		if last := l.entries[indexes[len(indexes)-1]]; last.after == nil {
+			deleted[id] = last.Time
+		}
+	}
+	return deleted
+}
+
+// prune removes the entries for which drop returns true and returns how
+// many it removed.
+func (l *auditLog) prune(drop func(e *AuditEntry) bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.entries[:0]
+	for i := range l.entries {
+		if !drop(&l.entries[i]) {
+			kept = append(kept, l.entries[i])
+		}
+	}
+	removed := len(l.entries) - len(kept)
+	clear(l.entries[len(kept):])
+	l.entries = kept
+	l.byTodo = make(map[int][]int)
+	for i, e := range l.entries {
+		l.byTodo[e.TodoID] = append(l.byTodo[e.TodoID], i)
+	}
+	return removed
+}
+
+// withChanges fills in the Changes of the entries.
+func withChanges(entries []AuditEntry) []AuditEntry {
+	for i := range entries {
+		entries[i].Changes = diffJSON(entries[i].before, entries[i].after)
+	}
+	return entries
+}
+
+// diffJSON compares the top-level fields of two JSON objects. updated_at is
+// skipped since it changes with every update.
+func diffJSON(before, after []byte) []AuditChange {
+	var old, cur map[string]json.RawMessage
+	if before != nil {
+		json.Unmarshal(before, &old)
+	}
+	if after != nil {
+		json.Unmarshal(after, &cur)
+	}
+
+	fields := make(map[string]bool)
+	for f := range old {
+		fields[f] = true
+	}
+	for f := range cur {
+		fields[f] = true
+	}
+	delete(fields, "updated_at")
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	changes := []AuditChange{}
+	for _, f := range names {
+		if !bytes.Equal(old[f], cur[f]) {
+			changes = append(changes, AuditChange{Field: f, Old: old[f], New: cur[f]})
+		}
+	}
+	return changes
+}
+
+// actorOf returns the name recorded as the author of changes made by the
+// request.
+func actorOf(ctx *fasthttp.RequestCtx) string {
+	if p, ok := authenticate(ctx); ok {
+		return p.name
+	}
+	return "anonymous"
+}
+
+// getTodoHistory handles GET /todos/{id}/history and lists the changes made
+// to a todo, oldest first. The history outlives the todo's deletion.
+func getTodoHistory(ctx *fasthttp.RequestCtx, id int) {
+	s := namespaceOf(ctx).store
+	entries := s.audit.history(id)
+	if len(entries) == 0 && !s.exists(id) {
+		ctx.Error("Todo not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, withChanges(entries))
+}
+
+// getAudit handles GET /audit?since= and lists the changes made to all
+// todos after the RFC 3339 time since (all changes by default), oldest
+// first. ?limit= caps the number of entries. When API keys are configured
+// only keys with access to all projects may read it.
+func getAudit(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	if !caller.all {
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	var since time.Time
+	if args.Has("since") {
+		t, err := time.Parse(time.RFC3339, string(args.Peek("since")))
+		if err != nil {
+			ctx.Error("Invalid since, expected an RFC 3339 timestamp", fasthttp.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	entries := namespaceOf(ctx).store.audit.since(since)
+	if args.Has("limit") {
+		n, err := strconv.Atoi(string(args.Peek("limit")))
+		if err != nil || n <= 0 {
+			ctx.Error("Invalid limit", fasthttp.StatusBadRequest)
+			return
+		}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	writeJSON(ctx, fasthttp.StatusOK, withChanges(entries))
+}
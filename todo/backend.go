@@ -0,0 +1,328 @@
+package todo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// todoBackend persists the todos of a store outside the process, so several
+// instances can share them. The store keeps serving reads from memory and
+// writes every change through to the backend while holding the lock of the
+// todo's shard, so changes to a todo reach the backend in order. A change
+// the backend doesn't accept isn't made in memory either.
+//
+// Every persisted todo has a version, starting at 1, that each save
+// increments. Changes name the version they are based on, so a change made
+// by another instance in the meantime makes them fail with
+// errVersionConflict instead of being overwritten.
+type todoBackend interface {
+	// load returns all persisted todos, ordered by ID.
+	load() ([]storedTodo, error)
+	// fetch returns a persisted todo, with a nil encoding if it doesn't
+	// exist.
+	fetch(id int) (storedTodo, error)
+	// nextID reserves a todo ID no instance sharing the backend used yet.
+	nextID() (int, error)
+	// reserveID makes sure nextID never returns id or a lower ID.
+	reserveID(id int) error
+	// save persists the JSON encoding of a todo if the backend holds it at
+	// version expect, or doesn't hold it for expect 0; remove deletes it
+	// the same way. With anyVersion they overwrite whatever the backend
+	// holds. Both notify the other instances.
+	save(todo *Todo, expect int64) error
+	remove(id int, expect int64) error
+	// watch calls fn with the IDs of todos changed by other instances
+	// until ctx is done, and with 0 when changes may have been missed,
+	// e.g., after a reconnect.
+	watch(ctx context.Context, fn func(id int))
+}
+
+// storedTodo is the JSON encoding of a persisted todo and its version.
+type storedTodo struct {
+	raw     []byte
+	version int64
+}
+
+// anyVersion makes todoBackend.save and remove skip the version check.
+const anyVersion = -1
+
+// errVersionConflict is returned by backends when a todo was changed by
+// another instance since the store read it.
+var errVersionConflict = errors.New("the todo was changed by another instance, try again")
+
+// storeError is returned by changes to a store that its backend didn't
+// accept. The change isn't made.
+type storeError struct {
+	op  string
+	err error
+}
+
+func (e *storeError) Error() string {
+	return fmt.Sprintf("%s in the %s store: %s", e.op, storageBackend, e.err)
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+// writeStoreError responds to a change the store refused, either because
+// of the tenant's todo quota or because its backend didn't accept it, and
+// reports whether err was such an error. Backend conflicts get 409
+// Conflict, so the client can retry with the current todo, other backend
+// failures 503 Service Unavailable.
+func writeStoreError(ctx *fasthttp.RequestCtx, err error) bool {
+	var quota *quotaError
+	var failed *storeError
+	switch {
+	case errors.As(err, &quota):
+		writeRequestError(ctx, fasthttp.StatusForbidden, "Todo quota exceeded", err.Error())
+	case errors.Is(err, errVersionConflict):
+		writeRequestError(ctx, fasthttp.StatusConflict, "Edit conflict", err.Error())
+	case errors.As(err, &failed):
+		ctx.Response.Header.Set("Retry-After", "5")
+		writeRequestError(ctx, fasthttp.StatusServiceUnavailable, "Storage unavailable",
+			"the change wasn't saved, try again later")
+	default:
+		return false
+	}
+	return true
+}
+
+// storageBackend names the backend holding the todos, see -store. It is set
+// once at startup.
+var storageBackend = "memory"
+
+// backendErrors counts the writes to the backend that failed.
+var backendErrors atomic.Uint64
+
+// backendFailed logs and counts a failed backend operation.
+func backendFailed(op string, err error) {
+	backendErrors.Add(1)
+	log.Printf("Error %s in the %s store: %s", op, storageBackend, err)
+}
+
+// persist writes the change of the todo with the given ID, or its deletion
+// when todo is nil, through to the backend, if the store has one, and
+// appends it to the change log replicas follow. expect is the version of
+// the todo the change is based on, 0 for new todos; on success the todo
+// gets the next version. If the backend fails, persist returns a
+// storeError and the change must not be made; after a conflict the todo is
+// reloaded from the backend first, see reload. The caller holds the lock
+// of the todo's shard.
+func (s *todoStore) persist(id int, todo *Todo, expect int64) error {
+	if s.backend != nil {
+		var err error
+		if todo == nil {
+			err = s.backend.remove(id, expect)
+		} else {
+			err = s.backend.save(todo, expect)
+		}
+		if err != nil {
+			backendFailed(fmt.Sprintf("persisting todo %d", id), err)
+			if errors.Is(err, errVersionConflict) {
+				s.reload(id)
+			}
+			return &storeError{op: fmt.Sprintf("persisting todo %d", id), err: err}
+		}
+		if todo != nil {
+			todo.version = expect + 1
+		}
+	}
+	if s.changes != nil {
+		var raw []byte
+		if todo != nil {
+			raw = todo.raw
+		}
+		s.changes.append(id, raw)
+	}
+	return nil
+}
+
+// reload replaces the todo with the given ID by the version in the
+// backend, after a change based on an older version was refused. The
+// caller holds the lock of the todo's shard.
+func (s *todoStore) reload(id int) {
+	stored, err := s.backend.fetch(id)
+	if err != nil {
+		backendFailed(fmt.Sprintf("fetching todo %d", id), err)
+		return
+	}
+	sh := s.shardFor(id)
+	if stored.raw == nil {
+		delete(sh.todos, id)
+	} else if todo, err := s.decode(stored); err == nil {
+		sh.todos[id] = todo
+	}
+	todosChanged()
+}
+
+// attach loads the todos persisted in b into the empty store and makes the
+// store write all changes through to b. Changes other instances make to b
+// are applied to the store until the server shuts down.
+func (s *todoStore) attach(b todoBackend) error {
+	stored, err := b.load()
+	if err != nil {
+		return err
+	}
+	for _, t := range stored {
+		if err := s.apply(0, t); err != nil {
+			return err
+		}
+	}
+	s.backend = b
+	background.spawn("store-watch", func(ctx context.Context) {
+		b.watch(ctx, func(id int) {
+			if id == 0 {
+				if err := s.resync(b); err != nil {
+					backendFailed("reloading todos", err)
+				}
+				return
+			}
+			stored, err := b.fetch(id)
+			if err != nil {
+				backendFailed(fmt.Sprintf("fetching todo %d", id), err)
+				return
+			}
+			if err := s.applyRemote(id, stored); err != nil {
+				backendFailed(fmt.Sprintf("decoding todo %d", id), err)
+			}
+		})
+	})
+	return nil
+}
+
+// detach undoes attach: it empties the store, together with the history
+// of its todos, and stops writing changes through to the backend. Watching
+// the backend stops with the background components.
+func (s *todoStore) detach() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.todos = make(map[int]*Todo)
+		sh.mu.Unlock()
+	}
+	s.nextID.Store(1)
+	s.lastPosition.Store(0)
+	s.uuidsMu.Lock()
+	s.uuids = make(map[string]int)
+	s.uuidsMu.Unlock()
+	if s.audit != nil {
+		s.audit.mu.Lock()
+		s.audit.entries = nil
+		s.audit.byTodo = make(map[int][]int)
+		s.audit.mu.Unlock()
+	}
+	s.backend = nil
+	todosChanged()
+}
+
+// resync reloads all todos from b after changes may have been missed,
+// removing those b no longer has.
+func (s *todoStore) resync(b todoBackend) error {
+	stored, err := b.load()
+	if err != nil {
+		return err
+	}
+	persisted := make(map[int]bool, len(stored))
+	for _, t := range stored {
+		var head struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(t.raw, &head); err != nil {
+			return err
+		}
+		if err := s.applyRemote(head.ID, t); err != nil {
+			return err
+		}
+		persisted[head.ID] = true
+	}
+	for _, id := range s.ids() {
+		if !persisted[id] {
+			s.applyRemote(id, storedTodo{})
+		}
+	}
+	return nil
+}
+
+// applyRemote applies a change made elsewhere, by another instance sharing
+// the backend or by the primary of a replica: it stores the todo with the
+// given ID, or removes it when its encoding is nil, invalidates cached
+// responses and tells local event watchers, such as gRPC WatchTodos
+// streams. Rules, webhooks and the other subscribers of the event bus
+// aren't told; the instance making the change ran them.
+func (s *todoStore) applyRemote(id int, stored storedTodo) error {
+	cur, existed := s.current(id)
+	if (stored.raw == nil && !existed) || (existed && bytes.Equal(cur.raw, stored.raw) && cur.version == stored.version) {
+		return nil
+	}
+	if err := s.apply(id, stored); err != nil {
+		return err
+	}
+	todosChanged()
+	e := Event{Type: "todo.updated", TodoID: id, Time: time.Now()}
+	switch {
+	case stored.raw == nil:
+		e.Type = "todo.deleted"
+	case !existed:
+		e.Type = "todo.created"
+	}
+	feedWatchers(e)
+	return nil
+}
+
+// current returns the JSON encoding and version of the todo with the given
+// ID.
+func (s *todoStore) current(id int) (storedTodo, bool) {
+	sh := s.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	todo, ok := sh.todos[id]
+	if !ok {
+		return storedTodo{}, false
+	}
+	return storedTodo{raw: todo.raw, version: todo.version}, true
+}
+
+// apply stores a persisted todo as is, or removes the todo with the given
+// ID when its encoding is nil, without writing it back to the backend or
+// recording it in the audit log.
+func (s *todoStore) apply(id int, stored storedTodo) error {
+	if stored.raw == nil {
+		sh := s.shardFor(id)
+		sh.mu.Lock()
+		delete(sh.todos, id)
+		sh.mu.Unlock()
+		return nil
+	}
+	todo, err := s.decode(stored)
+	if err != nil {
+		return err
+	}
+	sh := s.shardFor(todo.ID)
+	sh.mu.Lock()
+	sh.todos[todo.ID] = todo
+	sh.mu.Unlock()
+	return nil
+}
+
+// decode returns the todo of a persisted JSON encoding, ready to be
+// stored.
+func (s *todoStore) decode(stored storedTodo) (*Todo, error) {
+	todo := &Todo{}
+	if err := json.Unmarshal(stored.raw, todo); err != nil {
+		return nil, err
+	}
+	todo.version = stored.version
+	s.reserve(todo.ID)
+	s.alias(todo)
+	s.place(todo)
+	saved(todo)
+	return todo, nil
+}
@@ -0,0 +1,50 @@
+package todo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// backupTask returns a job writing an export archive into the backups
+// directory and deleting all but the newest keep backups.
+func backupTask(keep int) jobFunc {
+	export := exportArchive(defaultNamespace, "backups", nil)
+	return func(ctx context.Context, p *jobProgress) (interface{}, error) {
+		result, err := export(ctx, p)
+		if err != nil {
+			return result, err
+		}
+		return result, pruneBackups(keep)
+	}
+}
+
+// pruneBackups removes the oldest backup archives so at most keep remain.
+// A keep of zero or less keeps everything.
+func pruneBackups(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir("backups")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".zip") {
+			names = append(names, entry.Name())
+		}
+	}
+	// Archive names embed a nanosecond timestamp of equal length, so they
+	// sort chronologically.
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join("backups", names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package todo
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// benchStores are the store implementations the bench command can measure,
+// by name.
+var benchStores = map[string]func(shards int) *todoStore{
+	"memory": newTodoStore,
+}
+
+// benchWorkload is a standardized operation measured by the bench command.
+// op is called with increasing numbers from all workers at once.
+type benchWorkload struct {
+	name string
+	op   func(s *todoStore, i int) error
+}
+
+// benchWorkloads returns the workloads, run in this order against a store
+// holding todos todos.
+func benchWorkloads(todos int, upload *multipart.FileHeader) []benchWorkload {
+	terms := []string{"report", "q3"}
+	return []benchWorkload{
+		{"create", func(s *todoStore, i int) error {
+			s.insert("bench", &Todo{Title: "Write report", Description: "Quarterly numbers", Tags: []string{"work"}})
+			return nil
+		}},
+		{"get", func(s *todoStore, i int) error {
+			s.raw(i%todos + 1)
+			return nil
+		}},
+		{"update", func(s *todoStore, i int) error {
+			_, _, err := s.update("bench", i%todos+1, func(todo *Todo) error {
+				todo.Title = "Write report " + strconv.Itoa(i)
+				return nil
+			})
+			return err
+		}},
+		{"create-delete", func(s *todoStore, i int) error {
+			todo := &Todo{Title: "Short-lived"}
+			s.insert("bench", todo)
+			s.remove("bench", todo.ID)
+			return nil
+		}},
+		{"list", func(s *todoStore, i int) error {
+			joinJSON(s.rawList(nil))
+			return nil
+		}},
+		{"search", func(s *todoStore, i int) error {
+			s.each(func(todo *Todo) bool {
+				matchesTerms(todo, terms)
+				return true
+			})
+			return nil
+		}},
+		{"upload", func(s *todoStore, i int) error {
+			a, err := saveAttachment("uploads", upload)
+			if err != nil {
+				return err
+			}
+			_, _, err = s.update("bench", i%todos+1, func(todo *Todo) error {
+				todo.Attachments = nil
+				attach(todo, a)
+				return nil
+			})
+			return err
+		}},
+	}
+}
+
+// benchResult is the outcome of one workload.
+type benchResult struct {
+	ops     int64
+	elapsed time.Duration
+	err     error
+}
+
+// RunBench implements the bench command, which measures the throughput of
+// the workloads against a store and prints comparable numbers. It returns
+// the exit code.
+func RunBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	storeName := fs.String("store", "memory", "store implementation to measure")
+	shards := fs.Int("shards", defaultShardCount, "number of shards of the memory store")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "number of concurrent workers")
+	duration := fs.Duration("duration", time.Second, "how long each workload runs")
+	todos := fs.Int("todos", 1000, "number of todos in the store when a workload starts")
+	only := fs.String("workloads", "", "comma-separated workloads to run (empty runs all)")
+	fs.Parse(args)
+
+	newStore, ok := benchStores[*storeName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "bench: unknown store %q\n", *storeName)
+		return 2
+	}
+	if *shards < 1 || *workers < 1 || *todos < 1 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "bench: -shards, -workers, -todos and -duration must be positive")
+		return 2
+	}
+
+	// Uploaded files go to a scratch directory that is removed afterwards.
+	dir, err := os.MkdirTemp("", "todo-bench")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %s\n", err)
+		return 1
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %s\n", err)
+		return 1
+	}
+	defer os.Chdir(wd)
+	os.MkdirAll("uploads", os.ModePerm)
+	upload, err := benchUpload()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %s\n", err)
+		return 1
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(*only, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+
+	fmt.Printf("store=%s shards=%d workers=%d duration=%s todos=%d go=%s\n\n",
+		*storeName, *shards, *workers, *duration, *todos, runtime.Version())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "workload\tops\tops/s\tavg\t")
+	code := 0
+	for _, wl := range benchWorkloads(*todos, upload) {
+		if len(selected) > 0 && !selected[wl.name] {
+			continue
+		}
+		s := newStore(*shards)
+		for i := 0; i < *todos; i++ {
+			s.insert("bench", &Todo{Title: fmt.Sprintf("Todo %d", i), Description: "Prepare the Q3 report", Project: "work"})
+		}
+		r := runWorkload(s, wl, *workers, *duration)
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %s: %s\n", wl.name, r.err)
+			code = 1
+			continue
+		}
+		perSec := float64(r.ops) / r.elapsed.Seconds()
+		avg := time.Duration(0)
+		if r.ops > 0 {
+			avg = r.elapsed * time.Duration(*workers) / time.Duration(r.ops)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f\t%s\t\n", wl.name, r.ops, perSec, avg)
+	}
+	w.Flush()
+	return code
+}
+
+// runWorkload runs wl on s from workers goroutines for duration and stops
+// at the first error.
+func runWorkload(s *todoStore, wl benchWorkload, workers int, duration time.Duration) benchResult {
+	var (
+		counter atomic.Int64
+		stop    atomic.Bool
+		errOnce sync.Once
+		result  benchResult
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	deadline := start.Add(duration)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() && time.Now().Before(deadline) {
+				i := int(counter.Add(1))
+				if err := wl.op(s, i); err != nil {
+					errOnce.Do(func() { result.err = err })
+					stop.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	result.ops = counter.Load()
+	return result
+}
+
+// benchUpload returns a 16 KiB image upload as parsed from a multipart form.
+func benchUpload() (*multipart.FileHeader, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("attachments", "bench.png")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(bytes.Repeat([]byte{0x89}, 16<<10))
+	mw.Close()
+
+	form, err := multipart.NewReader(&body, mw.Boundary()).ReadForm(32 << 10)
+	if err != nil {
+		return nil, err
+	}
+	return form.File["attachments"][0], nil
+}
@@ -0,0 +1,64 @@
+package todo
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Build information, injected at build time with
+//
+//	go build -ldflags "-X todo-app-memory/todo.buildVersion=v1.2.0 -X todo-app-memory/todo.buildCommit=$(git rev-parse HEAD) -X todo-app-memory/todo.buildDate=$(date -u +%FT%TZ)"
+//
+// The commit defaults to the one recorded by the Go toolchain, if any.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// features lists the optional features and whether they are enabled. It is
+// set once at startup.
+var features map[string]bool
+
+// enabledFeatures returns the optional features cfg turns on or off.
+func enabledFeatures(cfg Config) map[string]bool {
+	return map[string]bool{
+		"access_control": cfg.APIKeys != "",
+		"admin":          cfg.AdminToken != "",
+		"cache":          cfg.CacheTTL > 0,
+		"compression":    cfg.CompressMinSize >= 0,
+		"grpc":           cfg.GRPCAddr != "",
+		"http2":          cfg.HTTP2Addr != "",
+		"idempotency":    cfg.IdempotencyWindow > 0,
+		"strict_json":    cfg.StrictJSON,
+		"tracing":        cfg.OTLPEndpoint != "",
+		"undo":           cfg.UndoDepth > 0,
+		"write_behind":   cfg.WriteBehind,
+	}
+}
+
+// getVersion handles GET /version and reports what is running, for bug
+// reports.
+func getVersion(ctx *fasthttp.RequestCtx) {
+	commit := buildCommit
+	if commit == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					commit = s.Value
+				}
+			}
+		}
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"version":     buildVersion,
+		"commit":      commit,
+		"build_date":  buildDate,
+		"go_version":  runtime.Version(),
+		"api_version": apiVersion,
+		"storage":     storageBackend,
+		"features":    features,
+	})
+}
@@ -0,0 +1,225 @@
+package todo
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// exportSelection is the body of POST /todos/export. Todos are selected by
+// ID, by filter or both, in which case they must match both.
+type exportSelection struct {
+	IDs    []int         `json:"ids"`
+	Filter *exportFilter `json:"filter"`
+	// Format is "json" (the default), "csv" or "zip".
+	Format string `json:"format"`
+}
+
+// exportFilter selects todos by their fields. Empty fields match any todo.
+type exportFilter struct {
+	// Q holds search terms as for GET /search.
+	Q         string `json:"q"`
+	Project   string `json:"project"`
+	Assignee  string `json:"assignee"`
+	Priority  string `json:"priority"`
+	Completed *bool  `json:"completed"`
+	// Tags must all be tags of a todo.
+	Tags []string `json:"tags"`
+}
+
+// matches reports whether todo passes the filter.
+func (f *exportFilter) matches(todo *Todo) bool {
+	switch {
+	case f.Project != "" && todo.Project != f.Project,
+		f.Assignee != "" && todo.Assignee != f.Assignee,
+		f.Priority != "" && todo.Priority != f.Priority,
+		f.Completed != nil && todo.Completed != *f.Completed:
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !hasTag(todo, tag) {
+			return false
+		}
+	}
+	return matchesTerms(todo, strings.Fields(strings.ToLower(f.Q)))
+}
+
+func hasTag(todo *Todo, tag string) bool {
+	for _, t := range todo.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// exportSelectedTodos handles POST /todos/export and responds with the
+// selected todos as JSON, CSV or a zip archive in the format accepted by
+// POST /import. Unlike POST /export, it answers right away, and only
+// includes todos the caller may see.
+func exportSelectedTodos(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	var sel exportSelection
+	if !decodeJSONBody(ctx, &sel) {
+		return
+	}
+	if sel.IDs == nil && sel.Filter == nil {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "No todos selected",
+			`send "ids", a "filter" or both; POST /export exports all todos`)
+		return
+	}
+	switch sel.Format {
+	case "":
+		sel.Format = "json"
+	case "json", "csv", "zip":
+	default:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid format "+sel.Format,
+			`format must be "json", "csv" or "zip"`)
+		return
+	}
+
+	ns := namespaceOf(ctx)
+	var todos []Todo
+	if sel.IDs != nil {
+		var missing []string
+		seen := make(map[int]bool)
+		for _, id := range sel.IDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			todo, ok := ns.store.get(id)
+			if !ok || ns.permission(caller, &todo) == permNone {
+				missing = append(missing, strconv.Itoa(id))
+				continue
+			}
+			todos = append(todos, todo)
+		}
+		if len(missing) > 0 {
+			ctx.Error("Todos not found: "+strings.Join(missing, ", "), fasthttp.StatusNotFound)
+			return
+		}
+	} else {
+		for _, todo := range ns.store.list() {
+			if ns.permission(caller, &todo) != permNone {
+				todos = append(todos, todo)
+			}
+		}
+	}
+	if sel.Filter != nil {
+		selected := todos[:0]
+		for i := range todos {
+			if sel.Filter.matches(&todos[i]) {
+				selected = append(selected, todos[i])
+			}
+		}
+		todos = selected
+	}
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+	if todos == nil {
+		todos = []Todo{}
+	}
+
+	var body []byte
+	var err error
+	switch sel.Format {
+	case "json":
+		writeJSON(ctx, fasthttp.StatusOK, todos)
+		return
+	case "csv":
+		body, err = todosCSV(todos)
+		ctx.SetContentType("text/csv; charset=utf-8")
+	case "zip":
+		body, err = todosZip(todos)
+		ctx.SetContentType("application/zip")
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="todos.`+sel.Format+`"`)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(body)
+}
+
+// todosCSV encodes todos as CSV with a header row. Tags are separated by
+// commas and subtasks are counted.
+func todosCSV(todos []Todo) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{
+		"id", "title", "description", "completed", "status", "priority", "project", "tags",
+		"assignee", "due_at", "created_at", "updated_at", "completed_at", "subtasks",
+	})
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, todo := range todos {
+		w.Write([]string{
+			strconv.Itoa(todo.ID),
+			todo.Title,
+			todo.Description,
+			strconv.FormatBool(todo.Completed),
+			todo.Status,
+			todo.Priority,
+			todo.Project,
+			strings.Join(todo.Tags, ","),
+			todo.Assignee,
+			formatTime(todo.DueAt),
+			formatTime(&todo.CreatedAt),
+			formatTime(&todo.UpdatedAt),
+			formatTime(todo.CompletedAt),
+			strconv.Itoa(len(todo.Subtasks)),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// todosZip returns a zip archive of todos and their attached files, in the format
+// accepted by POST /import.
+func todosZip(todos []Todo) ([]byte, error) {
+	data, err := json.Marshal(todos)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("todos.json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, todo := range todos {
+		for _, a := range todo.Attachments {
+			if seen[a.Path] {
+				continue
+			}
+			seen[a.Path] = true
+			if _, err := addZipFile(zw, a.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
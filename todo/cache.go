@@ -0,0 +1,123 @@
+package todo
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxCacheEntries bounds the number of cached responses; the cache is
+// emptied when it fills up.
+const maxCacheEntries = 1024
+
+// todosVersion is incremented on every change to the todos. Cached responses
+// remember the version they were rendered at and are stale once it moves on.
+var todosVersion atomic.Uint64
+
+// todosChanged must be called after every mutation of the todos.
+func todosChanged() {
+	todosVersion.Add(1)
+}
+
+type cacheEntry struct {
+	body        []byte
+	contentType string
+	version     uint64
+	expires     time.Time
+}
+
+// responseCache caches GET /todos and GET /todos/{id} responses by caller
+// and request URI so read-heavy workloads don't re-marshal the same todos over and over.
+type responseCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+var cache = &responseCache{entries: make(map[string]cacheEntry)}
+
+// cacheHandler wraps h with the response cache. A ttl of zero disables caching.
+func cacheHandler(h fasthttp.RequestHandler, ttl time.Duration) fasthttp.RequestHandler {
+	if ttl <= 0 {
+		return h
+	}
+	cache.ttl = ttl
+	return func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		// Todos shared with the caller and the next todo differ between
+		// callers, and the next todo also changes with time.
+		if string(ctx.Method()) != "GET" || (path != "/todos" && !strings.HasPrefix(path, "/todos/")) ||
+			ctx.QueryArgs().Has("shared") || path == "/todos/next" {
+			h(ctx)
+			return
+		}
+
+		key := namespaceOf(ctx).id + " " + string(ctx.RequestURI())
+		if len(apiKeys) > 0 {
+			// Callers see different todos.
+			caller, ok := authenticate(ctx)
+			if !ok {
+				h(ctx)
+				return
+			}
+			key = caller.name + " " + key
+		}
+		if entry, ok := cache.get(key); ok {
+			cache.hits.Add(1)
+			ctx.Response.Header.Set("X-Cache", "HIT")
+			ctx.SetContentType(entry.contentType)
+			ctx.SetStatusCode(fasthttp.StatusOK)
+			ctx.SetBody(entry.body)
+			return
+		}
+		cache.misses.Add(1)
+
+		// Read the version before rendering so a write racing with h makes
+		// the entry stale instead of caching outdated data as fresh.
+		version := todosVersion.Load()
+		h(ctx)
+		ctx.Response.Header.Set("X-Cache", "MISS")
+		if ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.Response.IsBodyStream() {
+			return
+		}
+		cache.set(key, cacheEntry{
+			body:        append([]byte(nil), ctx.Response.Body()...),
+			contentType: string(ctx.Response.Header.ContentType()),
+			version:     version,
+			expires:     time.Now().Add(cache.ttl),
+		})
+	}
+}
+
+// get returns the fresh entry for key, if any.
+func (c *responseCache) get(key string) (cacheEntry, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || entry.version != todosVersion.Load() || time.Now().After(entry.expires) {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *responseCache) set(key string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[key] = entry
+}
+
+// size returns the number of cached responses, stale or not.
+func (c *responseCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
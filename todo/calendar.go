@@ -0,0 +1,104 @@
+package todo
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// calendarPath is the path of the iCalendar feed. Calendar apps can't send
+// API keys, so the feed takes a token in the URL instead, see feedToken.
+const calendarPath = "/todos/calendar.ics"
+
+// getCalendar handles GET /todos/calendar.ics and responds with an
+// iCalendar feed of the open todos the token's principal may see, its own
+// and those shared with it, that have a due date or a reminder. Every todo
+// is an event at its due date, or at its reminder if it has no due date,
+// and reminders are alarms.
+func getCalendar(ctx *fasthttp.RequestCtx) {
+	caller, ok := feedPrincipal(ctx)
+	if !ok {
+		return
+	}
+	ns := namespaceOf(ctx)
+	var todos []Todo
+	ns.store.listed(func(todo *Todo) bool {
+		if !todo.Completed && (todo.DueAt != nil || todo.RemindAt != nil) && ns.permission(caller, todo) != permNone {
+			todos = append(todos, todo.clone())
+		}
+		return true
+	})
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+
+	ctx.SetContentType("text/calendar; charset=utf-8")
+	ctx.Response.Header.Set("Content-Disposition", `inline; filename="todos.ics"`)
+	ctx.SetBody(appendCalendar(nil, todos, string(ctx.Host())))
+}
+
+// appendCalendar appends the iCalendar (RFC 5545) encoding of todos to b.
+// host makes the UIDs of the events globally unique.
+func appendCalendar(b []byte, todos []Todo, host string) []byte {
+	b = appendICSLine(b, "BEGIN:VCALENDAR")
+	b = appendICSLine(b, "VERSION:2.0")
+	b = appendICSLine(b, "PRODID:-//go-fasthttp-todo//Todos//EN")
+	b = appendICSLine(b, "CALSCALE:GREGORIAN")
+	b = appendICSLine(b, "X-WR-CALNAME:Todos")
+	for _, todo := range todos {
+		start := todo.DueAt
+		if start == nil {
+			start = todo.RemindAt
+		}
+		b = appendICSLine(b, "BEGIN:VEVENT")
+		b = appendICSLine(b, "UID:todo-"+strconv.Itoa(todo.ID)+"@"+host)
+		b = appendICSLine(b, "DTSTAMP:"+icsTime(todo.UpdatedAt))
+		b = appendICSLine(b, "DTSTART:"+icsTime(*start))
+		b = appendICSLine(b, "DTEND:"+icsTime(*start))
+		b = appendICSLine(b, "SUMMARY:"+icsText(todo.Title))
+		if todo.Description != "" {
+			b = appendICSLine(b, "DESCRIPTION:"+icsText(todo.Description))
+		}
+		if len(todo.Tags) > 0 {
+			tags := make([]string, len(todo.Tags))
+			for i, tag := range todo.Tags {
+				tags[i] = icsText(tag)
+			}
+			b = appendICSLine(b, "CATEGORIES:"+strings.Join(tags, ","))
+		}
+		if todo.RemindAt != nil {
+			b = appendICSLine(b, "BEGIN:VALARM")
+			b = appendICSLine(b, "ACTION:DISPLAY")
+			b = appendICSLine(b, "DESCRIPTION:"+icsText(todo.Title))
+			b = appendICSLine(b, "TRIGGER;VALUE=DATE-TIME:"+icsTime(*todo.RemindAt))
+			b = appendICSLine(b, "END:VALARM")
+		}
+		b = appendICSLine(b, "END:VEVENT")
+	}
+	return appendICSLine(b, "END:VCALENDAR")
+}
+
+// icsTime formats t as an iCalendar UTC date-time.
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsText escapes s as an iCalendar text value.
+var icsText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace
+
+// appendICSLine appends an iCalendar content line to b, folding it into
+// lines of at most 75 octets without splitting UTF-8 sequences.
+func appendICSLine(b []byte, line string) []byte {
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b = append(b, line[:cut]...)
+		b = append(b, "\r\n "...)
+		line = line[cut:]
+	}
+	b = append(b, line...)
+	return append(b, "\r\n"...)
+}
@@ -0,0 +1,106 @@
+package todo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// copyUploadedFile copies the uploaded file at path to a new file in dir
+// and returns the new path, so the copy outlives the original.
+func copyUploadedFile(dir, path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	filePath := filepath.Join(dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), uploadName(path)))
+	out, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// cloneTodo handles POST /todos/{id}/clone and creates a copy of the todo
+// with a new ID. The copy is open, with all its subtasks reset, and starts
+// a recurring series of its own; links, comments and shares stay with the
+// original. An optional JSON body such as {"title": "Q4 report",
+// "attachments": true} sets the title of the copy and copies the attached
+// files too; without attachments the copy has none. "images" is accepted
+// for attachments.
+func cloneTodo(ctx *fasthttp.RequestCtx, id int) {
+	var req struct {
+		Title       *string `json:"title"`
+		Attachments bool    `json:"attachments"`
+		Images      bool    `json:"images"`
+	}
+	if len(ctx.PostBody()) > 0 && !decodeJSONBody(ctx, &req) {
+		return
+	}
+	ns := namespaceOf(ctx)
+	original, ok := ns.store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+
+	now := time.Now()
+	c := &Todo{
+		Title:       original.Title,
+		Description: original.Description,
+		Priority:    original.Priority,
+		Project:     original.Project,
+		Tags:        original.Tags,
+		Assignee:    original.Assignee,
+		DueAt:       original.DueAt,
+		RemindAt:    original.RemindAt,
+		ExpiresAt:   original.ExpiresAt,
+		Recurrence:  original.Recurrence,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if req.Title != nil {
+		c.Title = strings.TrimSpace(*req.Title)
+	}
+	for _, st := range original.Subtasks {
+		st.Completed = false
+		c.Subtasks = append(c.Subtasks, st)
+	}
+	if errs := validateTodo(c); len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid todo", errs)
+		return
+	}
+	if req.Attachments || req.Images {
+		for _, a := range original.Attachments {
+			done := traceOp(ctx, "file.save")
+			copied, err := copyUploadedFile(ns.uploads, a.Path)
+			done()
+			if err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+				return
+			}
+			a.Path = copied
+			attach(c, a)
+		}
+	}
+
+	done := traceOp(ctx, "store.insert")
+	raw, err := ns.addTodo(actorOf(ctx), c)
+	done()
+	if err != nil {
+		writeStoreError(ctx, err)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusCreated, raw)
+}
@@ -0,0 +1,559 @@
+package todo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Clustering of in-memory servers. The nodes elect a leader the way Raft
+// does: a follower that hears nothing from a leader for an election
+// timeout asks the others for their votes in a new term, and becomes
+// leader with the votes of a majority. The leader takes all writes; the
+// followers tail its replication feed, serve reads from their copy and
+// forward writes to it.
+const (
+	// clusterHeartbeat is how often the leader tells the followers it is
+	// alive. A follower hearing nothing for clusterElectionTimeout, plus up
+	// to as much again at random, runs for leader; a leader not heard back
+	// from by a majority for as long steps down.
+	clusterHeartbeat       = 250 * time.Millisecond
+	clusterElectionTimeout = 6 * clusterHeartbeat
+	// clusterRPCTimeout bounds the votes and heartbeats sent to a node.
+	clusterRPCTimeout = clusterHeartbeat
+	// clusterForwardedHeader marks writes a follower forwarded to the
+	// leader, which aren't forwarded again.
+	clusterForwardedHeader = "X-Cluster-Forwarded"
+)
+
+// The roles of a cluster node.
+const (
+	nodeFollower  = "follower"
+	nodeCandidate = "candidate"
+	nodeLeader    = "leader"
+)
+
+// clusterPosition is how far the todos of a node got: the term of the
+// leader they came from and the sequence number of its last change the
+// node applied. Nodes vote only for candidates at least as far as
+// themselves, so a leader has every change a majority of nodes applied.
+type clusterPosition struct {
+	Term uint64 `json:"term"`
+	Seq  uint64 `json:"seq"`
+}
+
+// before reports whether p is behind q.
+func (p clusterPosition) before(q clusterPosition) bool {
+	return p.Term < q.Term || (p.Term == q.Term && p.Seq < q.Seq)
+}
+
+// voteRequest asks a node for its vote in Term, and voteResponse answers
+// it with the term of the node.
+type voteRequest struct {
+	Term      uint64          `json:"term"`
+	Candidate string          `json:"candidate"`
+	Position  clusterPosition `json:"position"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// heartbeatRequest tells a node that Leader leads Term, and
+// heartbeatResponse answers it with the term of the node.
+type heartbeatRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+}
+
+type heartbeatResponse struct {
+	Term uint64 `json:"term"`
+	OK   bool   `json:"ok"`
+}
+
+// clusterNode is the state of this server in a cluster. Terms and votes
+// live in memory like the todos: a restarted node starts over with no
+// todos, is behind every other node and so can't be elected before it
+// caught up.
+type clusterNode struct {
+	// self is the URL the other nodes reach this one at, peers those of the
+	// other nodes.
+	self  string
+	peers []string
+	// call sends an RPC to the node at peer and decodes its response.
+	call func(ctx context.Context, peer, rpc string, req, resp interface{}) error
+	// position returns how far the todos of the node got.
+	position func() clusterPosition
+	// changed is called with the new role and leader, and the term, when
+	// either changes.
+	changed func(role, leader string, term uint64)
+
+	mu       sync.Mutex
+	role     string
+	term     uint64
+	votedFor string
+	leader   string
+	// deadline is when a follower or candidate runs for leader next, and
+	// when a leader not heard back from by a majority steps down.
+	deadline time.Time
+}
+
+// cluster is set when the server is a node of a cluster.
+var cluster *clusterNode
+
+// newClusterNode returns a follower of no leader yet, which runs for
+// leader unless it hears from one within an election timeout.
+func newClusterNode(self string, peers []string) *clusterNode {
+	n := &clusterNode{self: self, peers: peers, role: nodeFollower, call: callClusterNode}
+	n.deadline = time.Now().Add(electionTimeout())
+	return n
+}
+
+// parseClusterPeers checks the URLs of -cluster-url and -cluster-peers and
+// returns them without trailing slashes.
+func parseClusterPeers(self, peers string) (string, []string, error) {
+	self, err := parsePrimaryURL(self)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid cluster URL: %w", err)
+	}
+	seen := map[string]bool{self: true}
+	var urls []string
+	for _, p := range strings.Split(peers, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		u, err := parsePrimaryURL(p)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cluster peer: %w", err)
+		}
+		if seen[u] {
+			return "", nil, fmt.Errorf("cluster peer %s is listed twice or is this node", u)
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return "", nil, errors.New("a cluster needs at least one peer")
+	}
+	return self, urls, nil
+}
+
+// electionTimeout returns a random timeout between clusterElectionTimeout
+// and twice as long, so that nodes rarely run for leader at once.
+func electionTimeout() time.Duration {
+	return clusterElectionTimeout + rand.N(clusterElectionTimeout)
+}
+
+// majority is the number of nodes, counting this one, that elect a leader.
+func (n *clusterNode) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// status returns the role, leader and term of the node.
+func (n *clusterNode) status() (role, leader string, term uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role, n.leader, n.term
+}
+
+// leading reports whether the node is the leader.
+func (n *clusterNode) leading() bool {
+	role, _, _ := n.status()
+	return role == nodeLeader
+}
+
+// become switches the node to role under leader in term, and reports the
+// change once the lock of the node is released by the caller. The caller
+// holds the lock.
+func (n *clusterNode) become(role, leader string, term uint64, now time.Time) (notify func()) {
+	if term > n.term {
+		n.votedFor = ""
+	}
+	changed := role != n.role || leader != n.leader || term != n.term
+	n.role, n.leader, n.term = role, leader, term
+	if role == nodeLeader {
+		n.deadline = now.Add(clusterElectionTimeout)
+	} else {
+		n.deadline = now.Add(electionTimeout())
+	}
+	if !changed || n.changed == nil {
+		return func() {}
+	}
+	return func() { n.changed(role, leader, term) }
+}
+
+// run runs for leader when the node hears from no leader, and sends the
+// heartbeats while it leads, until ctx is done.
+func (n *clusterNode) run(ctx context.Context) {
+	ticker := time.NewTicker(clusterHeartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			role, due := n.role, now.After(n.deadline)
+			n.mu.Unlock()
+			switch {
+			case role == nodeLeader:
+				n.broadcast(ctx, now)
+			case due:
+				n.campaign(ctx, now)
+			}
+		}
+	}
+}
+
+// campaign runs for leader in a new term and becomes leader if a majority
+// votes for the node.
+func (n *clusterNode) campaign(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	notify := n.become(nodeCandidate, "", n.term+1, now)
+	n.votedFor = n.self
+	req := voteRequest{Term: n.term, Candidate: n.self, Position: n.position()}
+	n.mu.Unlock()
+	notify()
+	log.Printf("Running for cluster leader in term %d", req.Term)
+
+	votes := 1
+	for _, resp := range n.fanOut(ctx, "vote", req, func() interface{} { return &voteResponse{} }) {
+		vote := resp.(*voteResponse)
+		if n.observe(vote.Term, now) {
+			return
+		}
+		if vote.Granted {
+			votes++
+		}
+	}
+	n.mu.Lock()
+	if votes < n.majority() || n.role != nodeCandidate || n.term != req.Term {
+		n.mu.Unlock()
+		return
+	}
+	notify = n.become(nodeLeader, n.self, req.Term, now)
+	n.mu.Unlock()
+	notify()
+	log.Printf("Elected cluster leader in term %d with %d votes", req.Term, votes)
+	n.broadcast(ctx, now)
+}
+
+// broadcast sends a heartbeat to every peer. A leader that isn't heard
+// back from by a majority within an election timeout steps down, so a
+// leader cut off from the others stops taking writes.
+func (n *clusterNode) broadcast(ctx context.Context, now time.Time) {
+	n.mu.Lock()
+	if n.role != nodeLeader {
+		n.mu.Unlock()
+		return
+	}
+	req := heartbeatRequest{Term: n.term, Leader: n.self}
+	n.mu.Unlock()
+
+	acks := 1
+	for _, resp := range n.fanOut(ctx, "heartbeat", req, func() interface{} { return &heartbeatResponse{} }) {
+		hb := resp.(*heartbeatResponse)
+		if n.observe(hb.Term, now) {
+			return
+		}
+		if hb.OK {
+			acks++
+		}
+	}
+	n.mu.Lock()
+	if n.role != nodeLeader || n.term != req.Term {
+		n.mu.Unlock()
+		return
+	}
+	if acks >= n.majority() {
+		n.deadline = now.Add(clusterElectionTimeout)
+		n.mu.Unlock()
+		return
+	}
+	if now.Before(n.deadline) {
+		n.mu.Unlock()
+		return
+	}
+	notify := n.become(nodeFollower, "", n.term, now)
+	n.mu.Unlock()
+	notify()
+	log.Printf("Stepped down as cluster leader in term %d, a majority of nodes is unreachable", req.Term)
+}
+
+// fanOut sends the RPC to all peers at once and returns the responses of
+// those that answered, decoded into values returned by newResp.
+func (n *clusterNode) fanOut(ctx context.Context, rpc string, req interface{}, newResp func() interface{}) []interface{} {
+	ctx, cancel := context.WithTimeout(ctx, clusterRPCTimeout)
+	defer cancel()
+	results := make(chan interface{}, len(n.peers))
+	for _, peer := range n.peers {
+		go func() {
+			resp := newResp()
+			if err := n.call(ctx, peer, rpc, req, resp); err != nil {
+				resp = nil
+			}
+			results <- resp
+		}()
+	}
+	var responses []interface{}
+	for range n.peers {
+		if resp := <-results; resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	return responses
+}
+
+// observe handles the term of a response, stepping down to a follower of
+// no leader yet if it is newer than the node's. It reports whether it
+// was.
+func (n *clusterNode) observe(term uint64, now time.Time) bool {
+	n.mu.Lock()
+	if term <= n.term {
+		n.mu.Unlock()
+		return false
+	}
+	notify := n.become(nodeFollower, "", term, now)
+	n.mu.Unlock()
+	notify()
+	return true
+}
+
+// vote answers a candidate's request for the node's vote. The node votes
+// once per term, for a candidate whose todos got at least as far as its
+// own.
+func (n *clusterNode) vote(req voteRequest, now time.Time) voteResponse {
+	n.mu.Lock()
+	notify := func() {}
+	if req.Term > n.term {
+		notify = n.become(nodeFollower, "", req.Term, now)
+	}
+	resp := voteResponse{Term: n.term}
+	if req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && !req.Position.before(n.position()) {
+		n.votedFor = req.Candidate
+		n.deadline = now.Add(electionTimeout())
+		resp.Granted = true
+	}
+	n.mu.Unlock()
+	notify()
+	return resp
+}
+
+// heartbeat accepts the leader of the request unless the node knows of a
+// newer term.
+func (n *clusterNode) heartbeat(req heartbeatRequest, now time.Time) heartbeatResponse {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return heartbeatResponse{Term: n.term}
+	}
+	notify := n.become(nodeFollower, req.Leader, req.Term, now)
+	n.mu.Unlock()
+	notify()
+	return heartbeatResponse{Term: req.Term, OK: true}
+}
+
+// callClusterNode posts an RPC to /admin/cluster/{rpc} of the node at peer,
+// authenticated with the admin token the nodes share.
+func callClusterNode(ctx context.Context, peer, rpc string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(r)
+	w := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(w)
+	r.SetRequestURI(peer + apiPrefix + "/admin/cluster/" + rpc)
+	r.Header.SetMethod("POST")
+	r.Header.SetContentType("application/json")
+	r.Header.Set("X-Admin-Token", adminToken)
+	r.SetBody(body)
+	deadline, _ := ctx.Deadline()
+	if err := fasthttp.DoDeadline(r, w, deadline); err != nil {
+		return err
+	}
+	if w.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("%s responded with %d", peer, w.StatusCode())
+	}
+	return json.Unmarshal(w.Body(), resp)
+}
+
+// startCluster makes the server a node of the cluster of self and peers.
+// Followers replicate the leader they hear from and stop when they are
+// elected themselves.
+func startCluster(self string, peers []string) {
+	n := newClusterNode(self, peers)
+	p := &clusterProgress{}
+	n.position = p.position
+	n.changed = p.changed
+	cluster = n
+	background.spawn("cluster", n.run)
+}
+
+// clusterProgress tracks the position of this node, from its own changes
+// while it leads and from the feed of the leader while it follows.
+type clusterProgress struct {
+	mu sync.Mutex
+	// led is the term the node leads or last led in while its own changes
+	// are the newest it has, and zero while it follows a leader.
+	led uint64
+	// last is the position the node reached before it followed the current
+	// leader, which holds until it has the leader's snapshot.
+	last clusterPosition
+}
+
+func (p *clusterProgress) position() clusterPosition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current()
+}
+
+// current returns the position of the node. The caller holds p.mu.
+func (p *clusterProgress) current() clusterPosition {
+	if p.led != 0 {
+		return clusterPosition{Term: p.led, Seq: store.changes.last()}
+	}
+	if r := currentReplica(); r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.epoch != "" {
+			return clusterPosition{Term: r.term, Seq: r.seq}
+		}
+	}
+	return p.last
+}
+
+// changed stops replicating when the node is elected, and replicates the
+// leader it learns of otherwise.
+func (p *clusterProgress) changed(role, leader string, term uint64) {
+	switch {
+	case role == nodeLeader:
+		stopReplica()
+		p.mu.Lock()
+		p.led = term
+		p.mu.Unlock()
+		log.Printf("Leading the cluster in term %d", term)
+	case leader == "":
+	case replicaPrimary() == leader:
+		// The leader was reelected; its changes continue.
+		r := currentReplica()
+		r.mu.Lock()
+		r.term = term
+		r.mu.Unlock()
+	default:
+		p.mu.Lock()
+		p.last = p.current()
+		p.led = 0
+		p.mu.Unlock()
+		stopReplica()
+		r := startReplica(leader)
+		r.mu.Lock()
+		r.term = term
+		r.mu.Unlock()
+		log.Printf("Following cluster leader %s in term %d", leader, term)
+	}
+}
+
+// stopReplica stops following the primary, if the server follows one.
+func stopReplica() {
+	replicaMu.Lock()
+	r := replica
+	replica = nil
+	replicaMu.Unlock()
+	if r != nil {
+		r.stop()
+	}
+}
+
+// readOnly reports whether changes are made elsewhere: on the primary of a
+// replica, or on the leader of a cluster the server doesn't lead.
+func readOnly() bool {
+	return replicaPrimary() != "" || (cluster != nil && !cluster.leading())
+}
+
+// forwardToLeader sends a write a follower received to the cluster leader
+// and relays its response. Writes arriving while no leader is known, or
+// that were already forwarded by another node, get 503 Service
+// Unavailable; clients retry them once a leader is elected.
+func forwardToLeader(ctx *fasthttp.RequestCtx, leader string) {
+	if leader == "" || len(ctx.Request.Header.Peek(clusterForwardedHeader)) > 0 {
+		ctx.Response.Header.Set("Retry-After", "1")
+		ctx.Error("The cluster has no leader right now, retry shortly", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	ctx.Request.CopyTo(req)
+	req.SetRequestURI(leader + string(ctx.RequestURI()))
+	// Keep the Host header of the client, which picks the tenant.
+	req.UseHostHeader = true
+	req.Header.Set(clusterForwardedHeader, "1")
+	if err := fasthttp.DoTimeout(req, &ctx.Response, 30*time.Second); err != nil {
+		ctx.Response.Reset()
+		ctx.Response.Header.Set("Retry-After", "1")
+		ctx.Error(fmt.Sprintf("Forwarding to the cluster leader failed: %s", err), fasthttp.StatusServiceUnavailable)
+	}
+}
+
+// clusterRPC handles POST /admin/cluster/vote and /admin/cluster/heartbeat,
+// the requests the nodes of a cluster send each other.
+func clusterRPC(ctx *fasthttp.RequestCtx, rpc string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	if cluster == nil {
+		ctx.Error("This server is not part of a cluster", fasthttp.StatusConflict)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(ctx.PostBody()))
+	switch rpc {
+	case "vote":
+		var req voteRequest
+		if err := dec.Decode(&req); err != nil {
+			ctx.Error("Invalid vote request", fasthttp.StatusBadRequest)
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusOK, cluster.vote(req, time.Now()))
+	case "heartbeat":
+		var req heartbeatRequest
+		if err := dec.Decode(&req); err != nil || req.Leader == "" {
+			ctx.Error("Invalid heartbeat", fasthttp.StatusBadRequest)
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusOK, cluster.heartbeat(req, time.Now()))
+	}
+}
+
+// getCluster handles GET /admin/cluster and reports the role of the node,
+// the leader it knows of and the current term.
+func getCluster(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	if cluster == nil {
+		ctx.Error("This server is not part of a cluster", fasthttp.StatusNotFound)
+		return
+	}
+	role, leader, term := cluster.status()
+	status := map[string]interface{}{
+		"self":  cluster.self,
+		"peers": cluster.peers,
+		"role":  role,
+		"term":  term,
+	}
+	if leader != "" {
+		status["leader"] = leader
+	}
+	writeJSON(ctx, fasthttp.StatusOK, status)
+}
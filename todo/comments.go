@@ -0,0 +1,269 @@
+package todo
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxCommentLength is the longest comment body accepted, in characters.
+const maxCommentLength = 10000
+
+// Comment is a note left on a todo by one of its collaborators. Body holds
+// Markdown.
+type Comment struct {
+	ID        int       `json:"id"`
+	TodoID    int       `json:"todo_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// commentTable holds the comments on the todos of a namespace. Comments
+// outlive their todo so undoing its deletion brings them back.
+type commentTable struct {
+	mu sync.RWMutex
+	// byTodo maps todo IDs to their comments, oldest first.
+	byTodo map[int][]*Comment
+	nextID int
+}
+
+func newCommentTable() *commentTable {
+	return &commentTable{byTodo: make(map[int][]*Comment), nextID: 1}
+}
+
+// commentInput is the body of requests creating or editing comments.
+type commentInput struct {
+	Body string `json:"body"`
+}
+
+// list returns copies of the comments on the todo id.
+func (t *commentTable) list(id int) []Comment {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	list := make([]Comment, len(t.byTodo[id]))
+	for i, c := range t.byTodo[id] {
+		list[i] = *c
+	}
+	return list
+}
+
+// find returns the comment cid on the todo id. t.mu must be held.
+func (t *commentTable) find(id, cid int) (*Comment, int) {
+	for i, c := range t.byTodo[id] {
+		if c.ID == cid {
+			return c, i
+		}
+	}
+	return nil, -1
+}
+
+// reset removes all comments and returns how many there were.
+func (t *commentTable) reset() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, list := range t.byTodo {
+		n += len(list)
+	}
+	t.byTodo = make(map[int][]*Comment)
+	t.nextID = 1
+	return n
+}
+
+// routeComments routes requests for /todos/{id}/comments and
+// /todos/{id}/comments/{cid}; rest is the part after "comments".
+func routeComments(ctx *fasthttp.RequestCtx, method string, id int, rest string) {
+	if rest == "" {
+		switch method {
+		case "GET":
+			getComments(ctx, id)
+		case "POST":
+			createComment(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+	cid, err := strconv.Atoi(strings.TrimPrefix(rest, "/"))
+	if err != nil {
+		ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+		return
+	}
+	switch method {
+	case "GET":
+		getComment(ctx, id, cid)
+	case "PUT":
+		updateComment(ctx, id, cid)
+	case "DELETE":
+		deleteComment(ctx, id, cid)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// decodeComment parses and validates the JSON comment in the request body.
+func decodeComment(ctx *fasthttp.RequestCtx) (string, bool) {
+	var in commentInput
+	if !decodeJSONBody(ctx, &in) {
+		return "", false
+	}
+	body := strings.TrimSpace(in.Body)
+	switch {
+	case body == "":
+		ctx.Error("Comment body is required", fasthttp.StatusBadRequest)
+		return "", false
+	case utf8.RuneCountInString(body) > maxCommentLength:
+		ctx.Error("Comment body must not be longer than "+strconv.Itoa(maxCommentLength)+" characters", fasthttp.StatusBadRequest)
+		return "", false
+	}
+	return body, true
+}
+
+// getComments handles GET /todos/{id}/comments, oldest first.
+func getComments(ctx *fasthttp.RequestCtx, id int) {
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, ns.comments.list(id))
+}
+
+// createComment handles POST /todos/{id}/comments with a JSON body such as
+// {"body": "Done, see **PR 12**"}. The caller is the author.
+func createComment(ctx *fasthttp.RequestCtx, id int) {
+	body, ok := decodeComment(ctx)
+	if !ok {
+		return
+	}
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	now := time.Now()
+	t := ns.comments
+	t.mu.Lock()
+	c := &Comment{
+		ID:        t.nextID,
+		TodoID:    id,
+		Author:    actorOf(ctx),
+		Body:      body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	t.nextID++
+	t.byTodo[id] = append(t.byTodo[id], c)
+	snapshot := *c
+	t.mu.Unlock()
+	// Cached todo responses may include comments.
+	todosChanged()
+
+	ctx.Response.Header.Set("Location", apiPrefix+"/todos/"+strconv.Itoa(id)+"/comments/"+strconv.Itoa(c.ID))
+	writeJSON(ctx, fasthttp.StatusCreated, snapshot)
+}
+
+// getComment handles GET /todos/{id}/comments/{cid}.
+func getComment(ctx *fasthttp.RequestCtx, id, cid int) {
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	t := ns.comments
+	t.mu.RLock()
+	c, _ := t.find(id, cid)
+	var snapshot Comment
+	if c != nil {
+		snapshot = *c
+	}
+	t.mu.RUnlock()
+	if c == nil {
+		ctx.Error("Comment not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// updateComment handles PUT /todos/{id}/comments/{cid}. Only the author may
+// edit a comment.
+func updateComment(ctx *fasthttp.RequestCtx, id, cid int) {
+	body, ok := decodeComment(ctx)
+	if !ok {
+		return
+	}
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	t := ns.comments
+	t.mu.Lock()
+	c, _ := t.find(id, cid)
+	switch {
+	case c == nil:
+		t.mu.Unlock()
+		ctx.Error("Comment not found", fasthttp.StatusNotFound)
+		return
+	case c.Author != actorOf(ctx):
+		t.mu.Unlock()
+		ctx.Error("Only the author can edit a comment", fasthttp.StatusForbidden)
+		return
+	}
+	c.Body = body
+	c.UpdatedAt = time.Now()
+	snapshot := *c
+	t.mu.Unlock()
+	// Cached todo responses may include comments.
+	todosChanged()
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// deleteComment handles DELETE /todos/{id}/comments/{cid}. Only the author
+// may delete a comment.
+func deleteComment(ctx *fasthttp.RequestCtx, id, cid int) {
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	t := ns.comments
+	t.mu.Lock()
+	c, i := t.find(id, cid)
+	switch {
+	case c == nil:
+		t.mu.Unlock()
+		ctx.Error("Comment not found", fasthttp.StatusNotFound)
+		return
+	case c.Author != actorOf(ctx):
+		t.mu.Unlock()
+		ctx.Error("Only the author can delete a comment", fasthttp.StatusForbidden)
+		return
+	}
+	list := t.byTodo[id]
+	t.byTodo[id] = append(list[:i:i], list[i+1:]...)
+	if len(t.byTodo[id]) == 0 {
+		delete(t.byTodo, id)
+	}
+	t.mu.Unlock()
+	todosChanged()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// withComments returns the JSON encoding of a todo, raw, with its comments
+// in t added in a "comments" field.
+func withComments(raw []byte, t *commentTable, id int) []byte {
+	list, _ := json.Marshal(t.list(id))
+	out := make([]byte, 0, len(raw)+len(list)+13)
+	out = append(out, raw[:len(raw)-1]...)
+	out = append(out, `,"comments":`...)
+	out = append(out, list...)
+	return append(out, '}')
+}
@@ -0,0 +1,57 @@
+package todo
+
+import (
+	"bytes"
+
+	"github.com/valyala/fasthttp"
+)
+
+// compressHandler wraps h and compresses response bodies according to the
+// request's Accept-Encoding header, preferring br over gzip over deflate.
+// Bodies shorter than minSize, streamed bodies and responses that already
+// carry a Content-Encoding are left untouched.
+func compressHandler(h fasthttp.RequestHandler, minSize, level, brotliLevel int) fasthttp.RequestHandler {
+	if minSize < 0 {
+		return h
+	}
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+
+		ctx.Response.Header.Add("Vary", "Accept-Encoding")
+		if ctx.Response.IsBodyStream() || len(ctx.Response.Header.ContentEncoding()) > 0 {
+			return
+		}
+		body := ctx.Response.Body()
+		if len(body) < minSize || !isCompressible(ctx.Response.Header.ContentType()) {
+			return
+		}
+
+		defer traceOp(ctx, "response.compress")()
+		var compressed []byte
+		var encoding string
+		switch {
+		case ctx.Request.Header.HasAcceptEncoding("br"):
+			compressed, encoding = fasthttp.AppendBrotliBytesLevel(nil, body, brotliLevel), "br"
+		case ctx.Request.Header.HasAcceptEncoding("gzip"):
+			compressed, encoding = fasthttp.AppendGzipBytesLevel(nil, body, level), "gzip"
+		case ctx.Request.Header.HasAcceptEncoding("deflate"):
+			compressed, encoding = fasthttp.AppendDeflateBytesLevel(nil, body, level), "deflate"
+		default:
+			return
+		}
+		if len(compressed) >= len(body) {
+			return
+		}
+		ctx.Response.SetBodyRaw(compressed)
+		ctx.Response.Header.SetContentEncoding(encoding)
+	}
+}
+
+// isCompressible reports whether a response with the given content type is
+// worth compressing. Images and archives are already compressed.
+func isCompressible(contentType []byte) bool {
+	return bytes.HasPrefix(contentType, []byte("text/")) ||
+		bytes.Contains(contentType, []byte("json")) ||
+		bytes.Contains(contentType, []byte("xml")) ||
+		bytes.Contains(contentType, []byte("javascript"))
+}
@@ -0,0 +1,487 @@
+package todo
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the server. Every value can be set
+// with a command-line flag or, as a fallback, an environment variable.
+type Config struct {
+	Addr string
+	// UnixSocket is the path of a Unix socket to listen on instead of
+	// Addr, created with the octal permissions UnixSocketMode.
+	UnixSocket     string
+	UnixSocketMode string
+	// SystemdSocket listens on the socket passed by systemd socket
+	// activation instead of Addr.
+	SystemdSocket bool
+	// Limits of the HTTP server. Requests exceeding them get 413 Request
+	// Entity Too Large or 408 Request Timeout; connections beyond
+	// Concurrency are refused with 503 Service Unavailable.
+	MaxBodySize  int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	Concurrency  int
+	// StreamTimeout replaces WriteTimeout for the streaming responses of
+	// GET /events, GET /mcp/sse and the replication feed, which end once
+	// it passes; their clients reconnect.
+	StreamTimeout time.Duration
+	// ShutdownTimeout is how long background tasks get to stop on
+	// SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration
+	// GRPCAddr is the TCP address of the gRPC API; empty disables it.
+	GRPCAddr string
+	// ReplicaOf is the URL of the primary the server replicates as a
+	// read-only replica; empty makes it a primary.
+	ReplicaOf string
+	// ClusterURL is the URL the other nodes of a cluster reach this server
+	// at, and ClusterPeers holds theirs, comma-separated; empty disables
+	// clustering.
+	ClusterURL   string
+	ClusterPeers string
+	// Seed is a fixtures file whose todos are added at startup, see
+	// parseFixtures; with SeedWipe all todos are removed first.
+	Seed     string
+	SeedWipe bool
+	// EnableReset allows POST /admin/reset.
+	EnableReset bool
+	// IDFormat picks how new todos are identified: "int" for sequential
+	// IDs, "snowflake" for IDs unique across instances with different
+	// IDNode, or "uuid" to give todos a UUID besides their sequential ID.
+	IDFormat string
+	IDNode   int
+	// HTTP2Addr is the TCP address of the HTTP/2 listener, see serveHTTP2;
+	// empty disables it. With HTTP2Cert and HTTP2Key it uses TLS.
+	HTTP2Addr string
+	HTTP2Cert string
+	HTTP2Key  string
+
+	// Store is the backend holding the todos: "memory", "redis", "sqlite" or
+	// "postgres".
+	Store string
+	// Settings of the Redis store, see redisStore. RedisTTL, if positive,
+	// expires todos that weren't changed for that long.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+	RedisPoolSize int
+	RedisTTL      time.Duration
+	// DB is the database file of the sqlite store or the connection URL of
+	// the postgres store. DBMaxConns limits the open connections, and
+	// DBPollInterval is how often the postgres store polls for changes of
+	// other instances.
+	DB             string
+	DBMaxConns     int
+	DBPollInterval time.Duration
+	// WriteBehind queues writes to the store backend instead of waiting
+	// for them, see writeBehind.
+	WriteBehind         bool
+	WriteBehindBatch    int
+	WriteBehindInterval time.Duration
+	WriteBehindQueue    int
+
+	// CompressMinSize is the smallest response body (in bytes) that gets
+	// compressed; smaller bodies are sent as-is. A negative value disables
+	// compression entirely.
+	CompressMinSize int
+	// CompressLevel is the gzip/deflate level; BrotliLevel is used for br.
+	CompressLevel int
+	BrotliLevel   int
+
+	// CacheTTL is how long GET responses for todos stay cached. Writes
+	// invalidate the cache immediately. Zero disables the cache.
+	CacheTTL time.Duration
+	// ConsistencyWait is how long reads sent with a consistency token wait
+	// for the write it names, see consistencyHandler.
+	ConsistencyWait time.Duration
+	// SlowThreshold is the duration above which requests are logged with
+	// the timing of their store and file operations. Zero disables it.
+	SlowThreshold time.Duration
+	// LatencyBudgets overrides SlowThreshold for some routes, see
+	// parseLatencyBudgets.
+	LatencyBudgets string
+	// OTLPEndpoint is the OTLP/HTTP collector spans are exported to; empty
+	// disables tracing. OTLPHeaders are comma-separated key=value headers
+	// sent with every export, and TraceSampleRatio the share of requests
+	// without a sampled parent that are traced.
+	OTLPEndpoint     string
+	OTLPHeaders      string
+	ServiceName      string
+	TraceSampleRatio float64
+
+	// Cron expressions of the maintenance tasks; an empty value disables a task.
+	BackupSchedule string
+	GCSchedule     string
+	// EscalationSchedule is how often escalation rules are evaluated.
+	EscalationSchedule string
+	// DueSchedule is how often todos are checked for passed due dates.
+	DueSchedule string
+	// RetentionSchedule is how often the retention policies of tenants are
+	// applied.
+	RetentionSchedule string
+	// ArchiveSchedule is how often todos completed more than ArchiveAfter
+	// ago are archived; a zero ArchiveAfter archives none.
+	ArchiveSchedule string
+	ArchiveAfter    time.Duration
+	// DigestSchedule is how often users who opted in are checked for a due
+	// digest email, see sendDigests.
+	DigestSchedule string
+	// BackupKeep is how many backup archives are kept.
+	BackupKeep int
+
+	// APIKeys lists the API keys of callers and the projects each may see,
+	// see parseAPIKeys. Empty disables access control.
+	APIKeys string
+	// JWTSecret signs the access tokens of sessions; empty uses a random
+	// secret, so tokens don't survive restarts.
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// OIDCProviders enables logging in with external providers, see
+	// parseOAuthClients, and OIDCUsers maps their identities to API key
+	// names, see parseIdentityUsers.
+	OIDCProviders string
+	OIDCUsers     string
+	// PublicURL is the URL the server is reached at, for the callback URLs
+	// of login providers; empty uses the Host of each request.
+	PublicURL string
+	// Maximum lengths of the title and description of a todo.
+	MaxTitle       int
+	MaxDescription int
+	// Limits of the subtasks of a todo.
+	MaxSubtasks         int
+	MaxSubtaskTitle     int
+	UniqueSubtaskTitles bool
+
+	// StatusTransitions is the workflow of todo statuses, see
+	// parseStatusTransitions.
+	StatusTransitions string
+	// CompletionMode is "derived" to complete todos with their subtasks, or
+	// "manual" to complete them only explicitly.
+	CompletionMode string
+
+	// NextWeights is the scoring of GET /todos/next, see parseNextWeights.
+	NextWeights string
+
+	// ValidationRules sets the levels of the soft validation rules, see
+	// parseRuleLevels.
+	ValidationRules string
+
+	// TenantDomain, when set, maps subdomains of it to tenant namespaces.
+	TenantDomain string
+
+	// AdminToken must be sent in an X-Admin-Token header to use
+	// /admin/stats and /admin/config; empty disables them.
+	AdminToken string
+
+	// StrictJSON rejects JSON bodies with unknown fields; requests can
+	// override it with ?strict=.
+	StrictJSON bool
+	// IdempotencyWindow is how long responses to POST /todos with an
+	// Idempotency-Key are replayed. Zero disables it.
+	IdempotencyWindow time.Duration
+
+	// UndoDepth is how many recent changes of a todo can be undone.
+	UndoDepth int
+
+	// ReminderInterval is how often todos are checked for due reminders.
+	ReminderInterval time.Duration
+	// ExpiryInterval is how often expired todos are reaped, see runExpiry;
+	// zero disables it. ExpiryAction is "delete" or "archive".
+	ExpiryInterval time.Duration
+	ExpiryAction   string
+	// MaxUploadSize is the largest file accepted by resumable uploads, and
+	// UploadExpiry how long an unfinished one is kept after its last
+	// chunk; see tus.go.
+	MaxUploadSize int
+	UploadExpiry  time.Duration
+	// StripImageMetadata removes EXIF and other metadata from uploaded
+	// JPEG and PNG images, AutoOrientImages rotates them upright by their
+	// EXIF orientation, and ImageQuality is the JPEG quality, 1 to 100,
+	// rotated photos are encoded with; see exif.go.
+	StripImageMetadata bool
+	AutoOrientImages   bool
+	ImageQuality       int
+	// NotifyChannels is a comma-separated list of the channels reminders
+	// are sent through: "log", "webhook" and "email".
+	NotifyChannels   string
+	NotifyWebhookURL string
+	// NotifySinks is a comma-separated list of the named Slack, Discord
+	// and webhook destinations of rule notifications, see parseNotifySinks.
+	NotifySinks string
+	// TelegramToken is the token of the Telegram bot answering chat
+	// commands; empty disables the bot.
+	TelegramToken string
+	// MCPStdio serves the Model Context Protocol on stdin and stdout, see
+	// serveMCPStdio, for clients that start the server themselves.
+	MCPStdio bool
+	// WebUI is the web UI served at /: "spa" for the embedded single-page
+	// app, see webHandler, "htmx" for the server-rendered UI, see routeUI,
+	// or "off".
+	WebUI string
+	// HTMXURL is where pages of the server-rendered UI load htmx from.
+	HTMXURL string
+	// SMTP settings of the email channel. SMTPTo is comma-separated.
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPTo       string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// LoadConfig parses command-line flags, using environment variables as defaults.
+func LoadConfig() Config {
+	var cfg Config
+	registerFlags(flag.CommandLine, &cfg)
+	flag.Parse()
+	return cfg
+}
+
+// DefaultConfig returns the settings used when no flags are given, taking
+// environment variables into account, for programs embedding the API.
+func DefaultConfig() Config {
+	var cfg Config
+	registerFlags(flag.NewFlagSet("todo", flag.ContinueOnError), &cfg)
+	return cfg
+}
+
+// registerFlags defines the flags of the settings in fs, storing their
+// values in cfg.
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Addr, "addr", envString("TODO_ADDR", ":8080"), "TCP address to listen on")
+	fs.StringVar(&cfg.UnixSocket, "unix-socket", envString("TODO_UNIX_SOCKET", ""), "path of a Unix socket to listen on instead of -addr")
+	fs.StringVar(&cfg.UnixSocketMode, "unix-socket-mode", envString("TODO_UNIX_SOCKET_MODE", "0660"), "octal permissions of the Unix socket")
+	fs.BoolVar(&cfg.SystemdSocket, "systemd-socket", envBool("TODO_SYSTEMD_SOCKET", false), "listen on the socket passed by systemd socket activation instead of -addr")
+	fs.IntVar(&cfg.MaxBodySize, "max-body-size", envInt("TODO_MAX_BODY_SIZE", 10<<20), "maximum request body size in bytes")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", envDuration("TODO_READ_TIMEOUT", 30*time.Second), "maximum time to read a request, including its body")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", envDuration("TODO_WRITE_TIMEOUT", 30*time.Second), "maximum time to write a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("TODO_IDLE_TIMEOUT", 2*time.Minute), "how long idle keep-alive connections stay open")
+	fs.DurationVar(&cfg.StreamTimeout, "stream-timeout", envDuration("TODO_STREAM_TIMEOUT", time.Hour), "how long event streams and the replication feed stay open before clients have to reconnect")
+	fs.IntVar(&cfg.Concurrency, "concurrency", envInt("TODO_CONCURRENCY", 10000), "maximum number of concurrent connections")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", envDuration("TODO_SHUTDOWN_TIMEOUT", 10*time.Second), "how long background tasks get to stop on shutdown")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", envString("TODO_GRPC_ADDR", ""), "TCP address of the gRPC API (empty disables it)")
+	fs.StringVar(&cfg.HTTP2Addr, "http2-addr", envString("TODO_HTTP2_ADDR", ""), "TCP address to serve the API over HTTP/2 on (empty disables it)")
+	fs.StringVar(&cfg.HTTP2Cert, "http2-cert", envString("TODO_HTTP2_CERT", ""), "TLS certificate file of the HTTP/2 listener (empty serves cleartext h2c)")
+	fs.StringVar(&cfg.HTTP2Key, "http2-key", envString("TODO_HTTP2_KEY", ""), "TLS key file of the HTTP/2 listener")
+	fs.StringVar(&cfg.Store, "store", envString("TODO_STORE", "memory"), "backend holding the todos: memory, redis, sqlite or postgres")
+	fs.StringVar(&cfg.RedisAddr, "redis-addr", envString("TODO_REDIS_ADDR", "localhost:6379"), "address of the Redis server of the redis store")
+	fs.StringVar(&cfg.RedisPassword, "redis-password", envString("TODO_REDIS_PASSWORD", ""), "Redis password (empty disables authentication)")
+	fs.IntVar(&cfg.RedisDB, "redis-db", envInt("TODO_REDIS_DB", 0), "Redis database number")
+	fs.StringVar(&cfg.RedisPrefix, "redis-prefix", envString("TODO_REDIS_PREFIX", "todo:"), "prefix of the Redis keys, to share a server between deployments")
+	fs.IntVar(&cfg.RedisPoolSize, "redis-pool-size", envInt("TODO_REDIS_POOL_SIZE", 10), "maximum number of connections to Redis")
+	fs.DurationVar(&cfg.RedisTTL, "redis-ttl", envDuration("TODO_REDIS_TTL", 0), "expire todos in Redis that weren't changed for this long (0 keeps them)")
+	fs.StringVar(&cfg.DB, "db", envString("TODO_DB", "todos.db"), "database file of the sqlite store, or connection URL of the postgres store")
+	fs.IntVar(&cfg.DBMaxConns, "db-max-conns", envInt("TODO_DB_MAX_CONNS", 10), "maximum number of database connections")
+	fs.BoolVar(&cfg.WriteBehind, "write-behind", envBool("TODO_WRITE_BEHIND", false), "write changes to the store backend from a background queue instead of before responding")
+	fs.IntVar(&cfg.WriteBehindBatch, "write-behind-batch", envInt("TODO_WRITE_BEHIND_BATCH", 100), "maximum number of changes written to the backend at once")
+	fs.DurationVar(&cfg.WriteBehindInterval, "write-behind-interval", envDuration("TODO_WRITE_BEHIND_INTERVAL", 50*time.Millisecond), "how often queued changes are written to the backend")
+	fs.IntVar(&cfg.WriteBehindQueue, "write-behind-queue", envInt("TODO_WRITE_BEHIND_QUEUE", 10000), "maximum number of todos with queued changes before writes wait")
+	fs.DurationVar(&cfg.DBPollInterval, "db-poll-interval", envDuration("TODO_DB_POLL_INTERVAL", time.Second), "how often the postgres store polls for changes of other instances")
+	fs.StringVar(&cfg.ReplicaOf, "replica-of", envString("TODO_REPLICA_OF", ""), "URL of the primary to follow as a read-only replica (empty makes this server a primary)")
+	fs.StringVar(&cfg.ClusterURL, "cluster-url", envString("TODO_CLUSTER_URL", ""), "URL the other cluster nodes reach this server at (empty disables clustering)")
+	fs.StringVar(&cfg.ClusterPeers, "cluster-peers", envString("TODO_CLUSTER_PEERS", ""), "comma-separated URLs of the other cluster nodes")
+	fs.StringVar(&cfg.Seed, "seed", envString("TODO_SEED", ""), "JSON file of todos added at startup, for demos and tests")
+	fs.BoolVar(&cfg.SeedWipe, "seed-wipe", envBool("TODO_SEED_WIPE", false), "remove all todos before seeding")
+	fs.BoolVar(&cfg.EnableReset, "enable-reset", envBool("TODO_ENABLE_RESET", false), "allow POST /admin/reset to delete all todos, for test environments")
+	fs.StringVar(&cfg.IDFormat, "id-format", envString("TODO_ID_FORMAT", "int"), "identifiers of new todos: int, snowflake, or uuid to also give them a UUIDv7")
+	fs.IntVar(&cfg.IDNode, "id-node", envInt("TODO_ID_NODE", 0), "node number of snowflake IDs (0-1023), unique per instance")
+	fs.IntVar(&cfg.CompressMinSize, "compress-min-size", envInt("TODO_COMPRESS_MIN_SIZE", 1024), "minimum response size in bytes to compress (-1 disables compression)")
+	fs.IntVar(&cfg.CompressLevel, "compress-level", envInt("TODO_COMPRESS_LEVEL", 6), "gzip/deflate compression level (1-9)")
+	fs.IntVar(&cfg.BrotliLevel, "brotli-level", envInt("TODO_BROTLI_LEVEL", 4), "brotli compression level (0-11)")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", envDuration("TODO_CACHE_TTL", 5*time.Second), "how long GET responses stay cached (0 disables the cache)")
+	fs.DurationVar(&cfg.ConsistencyWait, "consistency-wait", envDuration("TODO_CONSISTENCY_WAIT", 2*time.Second), "how long reads with a consistency token wait for the write it names")
+	fs.DurationVar(&cfg.SlowThreshold, "slow-threshold", envDuration("TODO_SLOW_THRESHOLD", 500*time.Millisecond), "duration above which requests are logged as slow with their store and file operations (0 disables)")
+	fs.StringVar(&cfg.LatencyBudgets, "latency-budgets", envString("TODO_LATENCY_BUDGETS", ""), "per-route slow thresholds as comma-separated [method ]route=duration entries, e.g. GET /todos=100ms")
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", envString("OTEL_EXPORTER_OTLP_ENDPOINT", "")), "OTLP/HTTP collector URL OpenTelemetry spans are exported to (empty disables tracing)")
+	fs.StringVar(&cfg.OTLPHeaders, "otlp-headers", envString("OTEL_EXPORTER_OTLP_HEADERS", ""), "comma-separated key=value headers sent to the OTLP collector")
+	fs.StringVar(&cfg.ServiceName, "otel-service-name", envString("OTEL_SERVICE_NAME", "todo-app"), "service name of the exported spans")
+	fs.Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", envFloat("OTEL_TRACES_SAMPLER_ARG", 1), "share of requests without a sampled traceparent that are traced, from 0 to 1")
+	fs.StringVar(&cfg.BackupSchedule, "backup-schedule", envString("TODO_BACKUP_SCHEDULE", "0 3 * * *"), "cron expression for backups (empty disables)")
+	fs.IntVar(&cfg.BackupKeep, "backup-keep", envInt("TODO_BACKUP_KEEP", 7), "number of backup archives to keep (0 keeps all)")
+	fs.StringVar(&cfg.GCSchedule, "gc-schedule", envString("TODO_GC_SCHEDULE", "@hourly"), "cron expression for uploads garbage collection (empty disables)")
+	fs.StringVar(&cfg.EscalationSchedule, "escalation-schedule", envString("TODO_ESCALATION_SCHEDULE", "*/5 * * * *"), "cron expression for evaluating escalation rules (empty disables)")
+	fs.StringVar(&cfg.DueSchedule, "due-schedule", envString("TODO_DUE_SCHEDULE", "* * * * *"), "cron expression for checking due dates (empty disables)")
+	fs.StringVar(&cfg.RetentionSchedule, "retention-schedule", envString("TODO_RETENTION_SCHEDULE", "@hourly"), "cron expression for applying tenant retention policies (empty disables)")
+	fs.StringVar(&cfg.ArchiveSchedule, "archive-schedule", envString("TODO_ARCHIVE_SCHEDULE", "@hourly"), "cron expression for archiving todos completed longer than -archive-after ago (empty disables)")
+	fs.StringVar(&cfg.DigestSchedule, "digest-schedule", envString("TODO_DIGEST_SCHEDULE", "0 7 * * *"), "cron expression for sending due digest emails (empty disables)")
+	fs.DurationVar(&cfg.ArchiveAfter, "archive-after", envDuration("TODO_ARCHIVE_AFTER", 0), "how long after completion todos are archived automatically, e.g. 720h (0 disables)")
+	fs.StringVar(&cfg.APIKeys, "api-keys", envString("TODO_API_KEYS", ""), "comma-separated name:key=project|project entries granting access to projects (* for all)")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret", envString("TODO_JWT_SECRET", ""), "secret signing session access tokens (empty uses a random one)")
+	fs.DurationVar(&cfg.AccessTokenTTL, "access-token-ttl", envDuration("TODO_ACCESS_TOKEN_TTL", 15*time.Minute), "lifetime of session access tokens")
+	fs.DurationVar(&cfg.RefreshTokenTTL, "refresh-token-ttl", envDuration("TODO_REFRESH_TOKEN_TTL", 30*24*time.Hour), "how long sessions last without being refreshed")
+	fs.StringVar(&cfg.OIDCProviders, "oidc-providers", envString("TODO_OIDC_PROVIDERS", ""), "comma-separated provider:client_id:client_secret entries enabling login with google or github")
+	fs.StringVar(&cfg.OIDCUsers, "oidc-users", envString("TODO_OIDC_USERS", ""), "comma-separated provider:identity=user entries mapping external identities to API key names")
+	fs.StringVar(&cfg.PublicURL, "public-url", envString("TODO_PUBLIC_URL", ""), "URL the server is reached at, for login callbacks (empty uses the request Host)")
+	fs.IntVar(&cfg.MaxTitle, "max-title", envInt("TODO_MAX_TITLE", 200), "maximum length of a todo title in characters")
+	fs.IntVar(&cfg.MaxDescription, "max-description", envInt("TODO_MAX_DESCRIPTION", 10000), "maximum length of a todo description in characters")
+	fs.IntVar(&cfg.MaxSubtasks, "max-subtasks", envInt("TODO_MAX_SUBTASKS", 100), "maximum number of subtasks per todo")
+	fs.IntVar(&cfg.MaxSubtaskTitle, "max-subtask-title", envInt("TODO_MAX_SUBTASK_TITLE", 200), "maximum length of a subtask title in characters")
+	fs.BoolVar(&cfg.UniqueSubtaskTitles, "unique-subtask-titles", envBool("TODO_UNIQUE_SUBTASK_TITLES", false), "reject todos with two subtasks of the same title")
+	fs.StringVar(&cfg.StatusTransitions, "status-transitions", envString("TODO_STATUS_TRANSITIONS", defaultStatusTransitions), "allowed status changes as comma-separated from=to|to entries (* allows all)")
+	fs.StringVar(&cfg.CompletionMode, "completion-mode", envString("TODO_COMPLETION_MODE", "derived"), "how todos with subtasks are completed: derived (when all subtasks are) or manual (only by completed or status)")
+	fs.StringVar(&cfg.ValidationRules, "validation-rules", envString("TODO_VALIDATION_RULES", defaultRuleLevels), "levels (off, warn, reject) of the soft validation rules as comma-separated rule=level entries")
+	fs.StringVar(&cfg.NextWeights, "next-weights", envString("TODO_NEXT_WEIGHTS", defaultNextWeights), "scoring of GET /todos/next as comma-separated factor=weight entries (factors: priority, due, age)")
+	fs.StringVar(&cfg.TenantDomain, "tenant-domain", envString("TODO_TENANT_DOMAIN", ""), "domain whose subdomains select tenant namespaces, e.g. todo.example.com (empty disables)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", envString("TODO_ADMIN_TOKEN", ""), "token required by the admin stats and config endpoints (empty disables them)")
+	fs.BoolVar(&cfg.StrictJSON, "strict-json", envBool("TODO_STRICT_JSON", false), "reject JSON bodies with unknown fields (requests may override with ?strict=)")
+	fs.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", envDuration("TODO_IDEMPOTENCY_WINDOW", 24*time.Hour), "how long responses to requests with an Idempotency-Key are replayed (0 disables)")
+	fs.IntVar(&cfg.UndoDepth, "undo-depth", envInt("TODO_UNDO_DEPTH", 10), "how many recent changes of a todo can be undone (0 disables undo)")
+	fs.DurationVar(&cfg.ReminderInterval, "reminder-interval", envDuration("TODO_REMINDER_INTERVAL", 15*time.Second), "how often to check for due reminders")
+	fs.DurationVar(&cfg.ExpiryInterval, "expiry-interval", envDuration("TODO_EXPIRY_INTERVAL", 30*time.Second), "how often to remove todos past their expires_at (0 disables)")
+	fs.StringVar(&cfg.ExpiryAction, "expiry-action", envString("TODO_EXPIRY_ACTION", "delete"), "what happens to expired todos: delete, or archive to complete and archive them")
+	fs.IntVar(&cfg.MaxUploadSize, "max-upload-size", envInt("TODO_MAX_UPLOAD_SIZE", 1<<30), "largest file accepted by resumable uploads, in bytes")
+	fs.DurationVar(&cfg.UploadExpiry, "upload-expiry", envDuration("TODO_UPLOAD_EXPIRY", 24*time.Hour), "how long unfinished resumable uploads are kept after their last chunk")
+	fs.BoolVar(&cfg.StripImageMetadata, "strip-image-metadata", envBool("TODO_STRIP_IMAGE_METADATA", true), "remove EXIF metadata, such as GPS positions, from uploaded JPEG and PNG images")
+	fs.BoolVar(&cfg.AutoOrientImages, "auto-orient-images", envBool("TODO_AUTO_ORIENT_IMAGES", true), "rotate uploaded JPEG and PNG images upright by their EXIF orientation")
+	fs.IntVar(&cfg.ImageQuality, "image-quality", envInt("TODO_IMAGE_QUALITY", 90), "JPEG quality, 1 to 100, of uploaded photos re-encoded when rotated")
+	fs.StringVar(&cfg.NotifyChannels, "notify-channels", envString("TODO_NOTIFY_CHANNELS", "log"), "comma-separated reminder channels: log, webhook, email")
+	fs.StringVar(&cfg.NotifyWebhookURL, "notify-webhook-url", envString("TODO_NOTIFY_WEBHOOK_URL", ""), "URL reminders are POSTed to by the webhook channel")
+	fs.StringVar(&cfg.TelegramToken, "telegram-token", envString("TODO_TELEGRAM_TOKEN", ""), "token of the Telegram bot for chat commands (empty disables the bot)")
+	fs.BoolVar(&cfg.MCPStdio, "mcp-stdio", envBool("TODO_MCP_STDIO", false), "serve the Model Context Protocol on stdin and stdout, stopping when stdin ends")
+	fs.StringVar(&cfg.WebUI, "web-ui", envString("TODO_WEB_UI", "spa"), "web UI served at /: spa, htmx for the server-rendered UI, or off")
+	fs.StringVar(&cfg.HTMXURL, "htmx-url", envString("TODO_HTMX_URL", "https://unpkg.com/htmx.org@2.0.4/dist/htmx.min.js"), "URL pages of the server-rendered UI load htmx from")
+	fs.StringVar(&cfg.NotifySinks, "notify-sinks", envString("TODO_NOTIFY_SINKS", ""), "comma-separated name=driver:url rule notification sinks; drivers: slack, discord, webhook")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", envString("TODO_SMTP_ADDR", ""), "SMTP server (host:port) of the email channel")
+	fs.StringVar(&cfg.SMTPFrom, "smtp-from", envString("TODO_SMTP_FROM", ""), "sender address of reminder emails")
+	fs.StringVar(&cfg.SMTPTo, "smtp-to", envString("TODO_SMTP_TO", ""), "comma-separated recipients of reminder emails")
+	fs.StringVar(&cfg.SMTPUsername, "smtp-username", envString("TODO_SMTP_USERNAME", ""), "SMTP username (empty disables authentication)")
+	fs.StringVar(&cfg.SMTPPassword, "smtp-password", envString("TODO_SMTP_PASSWORD", ""), "SMTP password")
+}
+
+// secretFlags are the flags whose values are redacted by GET /admin/config.
+var secretFlags = map[string]bool{
+	"admin-token":        true,
+	"db":                 true,
+	"api-keys":           true,
+	"jwt-secret":         true,
+	"notify-webhook-url": true,
+	"notify-sinks":       true,
+	"telegram-token":     true,
+	"oidc-providers":     true,
+	"redis-password":     true,
+	"smtp-password":      true,
+	"otlp-headers":       true,
+}
+
+// standardEnv maps the flags whose fallback is a standard environment
+// variable, rather than one starting with TODO_, to that variable.
+var standardEnv = map[string]string{
+	"otlp-endpoint":      "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"otlp-headers":       "OTEL_EXPORTER_OTLP_HEADERS",
+	"otel-service-name":  "OTEL_SERVICE_NAME",
+	"trace-sample-ratio": "OTEL_TRACES_SAMPLER_ARG",
+}
+
+// envKey returns the environment variable that is the fallback of the flag
+// name, e.g. TODO_CACHE_TTL for -cache-ttl.
+func envKey(name string) string {
+	if key, ok := standardEnv[name]; ok {
+		return key
+	}
+	return "TODO_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configSetting is one effective setting as reported by GET /admin/config.
+type configSetting struct {
+	Name  string `json:"name"`
+	Env   string `json:"env"`
+	Value string `json:"value"`
+	// Source is "flag", "env", "config" or "default".
+	Source string `json:"source"`
+}
+
+// runningConfig is the configuration the server runs with. It is set
+// once by NewServer.
+var runningConfig Config
+
+// effectiveConfig returns the settings the server runs with, in the order
+// of their flag names, with secrets redacted. Settings not given as flags
+// or environment variables come from the default or, when the API is
+// embedded, from the program embedding it ("config").
+func effectiveConfig() []configSetting {
+	fromFlag := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fromFlag[f.Name] = true })
+
+	// Bind the flags to a copy of the running configuration to read its
+	// values the way they are written on the command line.
+	var cfg Config
+	fs := flag.NewFlagSet("todo", flag.ContinueOnError)
+	registerFlags(fs, &cfg)
+	cfg = runningConfig
+
+	var settings []configSetting
+	fs.VisitAll(func(f *flag.Flag) {
+		s := configSetting{Name: f.Name, Env: envKey(f.Name), Value: f.Value.String(), Source: "default"}
+		if _, ok := os.LookupEnv(s.Env); ok {
+			s.Source = "env"
+		} else if s.Value != f.DefValue {
+			s.Source = "config"
+		}
+		if fromFlag[f.Name] {
+			s.Source = "flag"
+		}
+		if secretFlags[f.Name] && s.Value != "" {
+			s.Value = "[redacted]"
+		}
+		settings = append(settings, s)
+	})
+	return settings
+}
+
+// envString returns the value of the environment variable key, or def if unset.
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable key, or def
+// if it is unset or not a valid integer.
+func envInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// envDuration returns the duration value of the environment variable key,
+// or def if it is unset or not a valid duration.
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// envFloat returns the floating-point value of the environment variable
+// key, or def if it is unset or not a valid number.
+func envFloat(key string, def float64) float64 {
+	if v, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+// envBool returns the boolean value of the environment variable key, or def
+// if it is unset or not a valid boolean.
+func envBool(key string, def bool) bool {
+	if v, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
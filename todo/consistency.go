@@ -0,0 +1,66 @@
+package todo
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// consistencyHeader carries consistency tokens: the sequence number of the
+// todos after a write in responses, and the sequence number a read must
+// observe in requests.
+const consistencyHeader = "X-Consistency-Token"
+
+// consistencyPoll is how often a read waiting for a write checks whether
+// the todos have caught up.
+const consistencyPoll = 5 * time.Millisecond
+
+// consistencyHandler wraps h with read-your-writes consistency. Successful
+// writes respond with a token naming the sequence number of the todos
+// after the write, todosVersion. Reads sent with a token wait up to wait
+// until the todos reached that sequence number, so a client reading from a
+// server that lags behind the one it wrote to still sees its writes. Reads
+// that can't be served in time get 503 Service Unavailable.
+func consistencyHandler(h fasthttp.RequestHandler, wait time.Duration) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() && !ctx.IsHead() {
+			h(ctx)
+			if code := ctx.Response.StatusCode(); code >= 200 && code <= 299 {
+				ctx.Response.Header.Set(consistencyHeader, strconv.FormatUint(todosVersion.Load(), 10))
+			}
+			return
+		}
+		token := ctx.Request.Header.Peek(consistencyHeader)
+		if len(token) == 0 {
+			h(ctx)
+			return
+		}
+		seq, err := strconv.ParseUint(string(token), 10, 64)
+		if err != nil {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid consistency token",
+				"send back the "+consistencyHeader+" header of a write response")
+			return
+		}
+		if !awaitVersion(seq, wait) {
+			ctx.Response.Header.Set("Retry-After", "1")
+			writeRequestError(ctx, fasthttp.StatusServiceUnavailable, "Not caught up with the write yet",
+				"retry later or read from the server that accepted the write")
+			return
+		}
+		h(ctx)
+	}
+}
+
+// awaitVersion waits up to wait until todosVersion reaches seq and reports
+// whether it did.
+func awaitVersion(seq uint64, wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for todosVersion.Load() < seq {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(consistencyPoll)
+	}
+	return true
+}
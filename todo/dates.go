@@ -0,0 +1,142 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Representations of timestamps in responses.
+const (
+	dateRFC3339     = "rfc3339"
+	dateEpochMillis = "epoch-millis"
+	dateOnly        = "date-only"
+)
+
+// timestampKeys are the fields holding timestamps that don't end in _at.
+var timestampKeys = map[string]bool{
+	"time":     true,
+	"last_run": true,
+	"next_run": true,
+}
+
+// dateFormatHandler rewrites the timestamps of the JSON responses of h in
+// the representation the client asked for with ?date_format= or an Accept
+// profile, e.g. application/json; profile=epoch-millis:
+//
+//   - rfc3339, the default: "2024-05-01T09:30:00Z";
+//   - epoch-millis: milliseconds since the Unix epoch, 1714555800000;
+//   - date-only: the calendar date of the timestamp, "2024-05-01".
+//
+// Timestamps are the values of fields ending in _at and of timestampKeys.
+func dateFormatHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+
+		format := requestedDateFormat(ctx)
+		if format == dateRFC3339 || ctx.Response.IsBodyStream() ||
+			!bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json")) {
+			return
+		}
+		// Protocol buffers have their own timestamp type.
+		if preferredFormat(string(ctx.Request.Header.Peek("Accept"))) == formatProtobuf {
+			return
+		}
+		root, err := parseJSONTree(ctx.Response.Body())
+		if err != nil {
+			return
+		}
+		formatTimestamps(root, format)
+		ctx.SetBody(appendJSONNode(nil, root))
+	}
+}
+
+// requestedDateFormat returns the timestamp representation asked for by
+// the request, rfc3339 if none.
+func requestedDateFormat(ctx *fasthttp.RequestCtx) string {
+	if v := ctx.QueryArgs().Peek("date_format"); v != nil {
+		if format, ok := validDateFormat(string(v)); ok {
+			return format
+		}
+	}
+	for _, accept := range strings.Split(string(ctx.Request.Header.Peek("Accept")), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		for _, profile := range strings.Fields(params["profile"]) {
+			if format, ok := validDateFormat(profile); ok {
+				return format
+			}
+		}
+	}
+	return dateRFC3339
+}
+
+func validDateFormat(s string) (string, bool) {
+	switch s = strings.ReplaceAll(strings.ToLower(s), "_", "-"); s {
+	case dateRFC3339, dateEpochMillis, dateOnly:
+		return s, true
+	}
+	return "", false
+}
+
+// formatTimestamps rewrites the timestamps in node and its children.
+func formatTimestamps(node *jsonNode, format string) {
+	for i, item := range node.items {
+		if node.kind == 'o' && item.kind == 's' {
+			key := node.keys[i]
+			if !strings.HasSuffix(key, "_at") && !timestampKeys[key] {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, item.str)
+			if err != nil {
+				continue
+			}
+			if format == dateEpochMillis {
+				node.items[i] = &jsonNode{kind: 'n', num: json.Number(strconv.FormatInt(t.UnixMilli(), 10))}
+			} else {
+				item.str = t.Format(time.DateOnly)
+			}
+			continue
+		}
+		formatTimestamps(item, format)
+	}
+}
+
+// appendJSONNode encodes node as JSON.
+func appendJSONNode(b []byte, node *jsonNode) []byte {
+	switch node.kind {
+	case 'o', 'a':
+		open, close := byte('['), byte(']')
+		if node.kind == 'o' {
+			open, close = '{', '}'
+		}
+		b = append(b, open)
+		for i, item := range node.items {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if node.kind == 'o' {
+				key, _ := json.Marshal(node.keys[i])
+				b = append(append(b, key...), ':')
+			}
+			b = appendJSONNode(b, item)
+		}
+		return append(b, close)
+	case 's':
+		s, _ := json.Marshal(node.str)
+		return append(b, s...)
+	case 'n':
+		return append(b, node.num...)
+	case 'b':
+		return strconv.AppendBool(b, node.b)
+	default:
+		return append(b, "null"...)
+	}
+}
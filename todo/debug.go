@@ -0,0 +1,120 @@
+package todo
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/pprofhandler"
+)
+
+// Runtime debug endpoints for operators profiling the running server. They
+// all require the admin token, see requireAdmin.
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() any { return time.Since(startTime).Seconds() }))
+}
+
+// isDebugPath reports whether path is one of the debug endpoints.
+func isDebugPath(path string) bool {
+	return path == "/debug/pprof" || strings.HasPrefix(path, "/debug/")
+}
+
+// getPprof handles /debug/pprof/ and the profiles below it, such as
+// /debug/pprof/profile?seconds=30 for the CPU and /debug/pprof/heap for
+// the heap, in the format read by go tool pprof.
+func getPprof(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	if string(ctx.Path()) == "/debug/pprof" {
+		ctx.Redirect("/debug/pprof/", fasthttp.StatusMovedPermanently)
+		return
+	}
+	pprofhandler.PprofHandler(ctx)
+}
+
+// getDebugVars handles GET /debug/vars and returns the variables published
+// with the expvar package, such as memstats, as a JSON object. Secrets
+// given as flags are redacted from cmdline.
+func getDebugVars(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	cmdline, err := json.Marshal(redactArgs(os.Args))
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	vars["cmdline"] = cmdline
+	writeJSON(ctx, fasthttp.StatusOK, vars)
+}
+
+// redactArgs returns a copy of the command line args with the values of
+// secretFlags replaced by [redacted], whether given as -flag=value or as
+// -flag value.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 1; i < len(redacted); i++ {
+		arg := redacted[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !secretFlags[name] {
+			continue
+		}
+		if hasValue {
+			redacted[i] = arg[:strings.Index(arg, "=")+1] + "[redacted]"
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = "[redacted]"
+		}
+	}
+	return redacted
+}
+
+// gcStats reports the effect of a garbage collection triggered by POST
+// /debug/gc.
+type gcStats struct {
+	HeapBeforeBytes uint64  `json:"heap_before_bytes"`
+	HeapAfterBytes  uint64  `json:"heap_after_bytes"`
+	ReleasedToOS    bool    `json:"released_to_os"`
+	DurationMS      float64 `json:"duration_ms"`
+}
+
+// triggerGC handles POST /debug/gc and runs a garbage collection, with
+// ?release=true also returning as much memory as possible to the operating
+// system. Unlike POST /admin/gc it is about the process heap, not uploads.
+func triggerGC(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := gcStats{HeapBeforeBytes: mem.HeapAlloc, ReleasedToOS: ctx.QueryArgs().GetBool("release")}
+	start := time.Now()
+	if stats.ReleasedToOS {
+		debug.FreeOSMemory()
+	} else {
+		runtime.GC()
+	}
+	stats.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	runtime.ReadMemStats(&mem)
+	stats.HeapAfterBytes = mem.HeapAlloc
+	writeJSON(ctx, fasthttp.StatusOK, stats)
+}
@@ -0,0 +1,182 @@
+package todo
+
+import (
+	"sort"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Link types that make one todo depend on another: a todo blocked by
+// another can't be started before that one is completed.
+const (
+	linkBlockedBy = "blocked-by"
+	linkBlocks    = "blocks"
+)
+
+// blockers returns the IDs of the todos that todo is blocked by.
+func (t *Todo) blockers() []int {
+	var ids []int
+	for _, l := range t.Links {
+		if l.Type == linkBlockedBy {
+			ids = append(ids, l.TodoID)
+		}
+	}
+	return ids
+}
+
+// blocksCycle reports whether making the todo id blocked by blocker would
+// create a cycle, that is whether blocker already depends on id, directly
+// or through other todos of s.
+func blocksCycle(s *todoStore, id, blocker int) bool {
+	seen := map[int]bool{blocker: true}
+	queue := []int{blocker}
+	for len(queue) > 0 {
+		todo, ok := s.get(queue[0])
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+		for _, next := range todo.blockers() {
+			if next == id {
+				return true
+			}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+// dependencyNode is a todo of a dependency graph. A todo is ready when it
+// is open and all its blockers are completed.
+type dependencyNode struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Status    string `json:"status"`
+	Completed bool   `json:"completed"`
+	Ready     bool   `json:"ready"`
+}
+
+// dependencyEdge says that the todo TodoID is blocked by BlockedBy.
+type dependencyEdge struct {
+	TodoID    int `json:"todo_id"`
+	BlockedBy int `json:"blocked_by"`
+}
+
+// getDependencies handles GET /todos/{id}/dependencies and responds with
+// the dependency graph of the todo: the todos it is blocked by and those it
+// blocks, directly or through other todos, and the edges between them.
+func getDependencies(ctx *fasthttp.RequestCtx, id int) {
+	ns := namespaceOf(ctx)
+	root, ok := ns.store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	todos := map[int]Todo{id: root}
+	edges := make(map[dependencyEdge]bool)
+	queue := []Todo{root}
+	for len(queue) > 0 {
+		todo := queue[0]
+		queue = queue[1:]
+		for _, l := range todo.Links {
+			var edge dependencyEdge
+			switch l.Type {
+			case linkBlockedBy:
+				edge = dependencyEdge{TodoID: todo.ID, BlockedBy: l.TodoID}
+			case linkBlocks:
+				edge = dependencyEdge{TodoID: l.TodoID, BlockedBy: todo.ID}
+			default:
+				continue
+			}
+			if _, seen := todos[l.TodoID]; !seen {
+				other, ok := ns.store.get(l.TodoID)
+				if !ok {
+					continue
+				}
+				todos[l.TodoID] = other
+				queue = append(queue, other)
+			}
+			edges[edge] = true
+		}
+	}
+
+	graph := struct {
+		TodoID int              `json:"todo_id"`
+		Nodes  []dependencyNode `json:"nodes"`
+		Edges  []dependencyEdge `json:"edges"`
+	}{TodoID: id, Nodes: []dependencyNode{}, Edges: []dependencyEdge{}}
+	for edge := range edges {
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.TodoID != b.TodoID {
+			return a.TodoID < b.TodoID
+		}
+		return a.BlockedBy < b.BlockedBy
+	})
+	for _, todo := range todos {
+		ready := !todo.Completed
+		for _, blocker := range todo.blockers() {
+			if other, ok := todos[blocker]; ok && !other.Completed {
+				ready = false
+			}
+		}
+		graph.Nodes = append(graph.Nodes, dependencyNode{
+			ID:        todo.ID,
+			Title:     todo.Title,
+			Status:    todo.Status,
+			Completed: todo.Completed,
+			Ready:     ready,
+		})
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, graph)
+}
+
+// getReadyTodos handles GET /todos?ready=true, listing the open todos whose
+// blockers are all completed, ordered by ID. Archived todos are left out.
+func getReadyTodos(ctx *fasthttp.RequestCtx) {
+	type entry struct {
+		id       int
+		blockers []int
+		raw      []byte
+	}
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	var open []entry
+	completed := make(map[int]bool)
+	ns := namespaceOf(ctx)
+	done := traceOp(ctx, "store.scan")
+	ns.store.each(func(todo *Todo) bool {
+		// Blockers the caller can't see still count.
+		completed[todo.ID] = todo.Completed
+		if !todo.Completed && !todo.archived() && (visible == nil || visible(todo)) {
+			open = append(open, entry{todo.ID, todo.blockers(), todo.raw})
+		}
+		return true
+	})
+	done()
+	sort.Slice(open, func(i, j int) bool { return open[i].id < open[j].id })
+
+	raws := [][]byte{}
+	for _, e := range open {
+		ready := true
+		for _, blocker := range e.blockers {
+			// Blockers that were deleted no longer block.
+			if c, ok := completed[blocker]; ok && !c {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			raws = append(raws, e.raw)
+		}
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, joinJSON(raws))
+}
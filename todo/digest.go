@@ -0,0 +1,219 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Profile holds the settings of a user, the principal of an API key.
+type Profile struct {
+	User  string `json:"user"`
+	Email string `json:"email,omitempty"`
+	// Digest is how often the user gets an email of their overdue and
+	// upcoming todos: "off" (the default), "daily" or "weekly".
+	Digest       string     `json:"digest"`
+	LastDigestAt *time.Time `json:"last_digest_at,omitempty"`
+}
+
+var (
+	profiles   = make(map[string]*Profile)
+	profilesMu sync.Mutex
+)
+
+// digestPeriods maps the digest settings to how far ahead a digest looks,
+// which is also how long at least passes between two digests.
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// digestMailer sends a digest email to an address. It is set at startup
+// when -smtp-addr and -smtp-from are.
+var digestMailer func(to string, n notification) error
+
+func (p *Profile) validate() error {
+	if p.Digest == "" {
+		p.Digest = "off"
+	}
+	if _, ok := digestPeriods[p.Digest]; !ok && p.Digest != "off" {
+		return fmt.Errorf(`invalid digest %q, expected "off", "daily" or "weekly"`, p.Digest)
+	}
+	p.Email = strings.TrimSpace(p.Email)
+	if p.Email != "" {
+		if _, err := mail.ParseAddress(p.Email); err != nil {
+			return fmt.Errorf("invalid email %q", p.Email)
+		}
+	}
+	if p.Digest != "off" && p.Email == "" {
+		return errors.New("a digest needs an email")
+	}
+	return nil
+}
+
+// getProfile handles GET /me/profile and responds with the caller's
+// profile.
+func getProfile(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	profilesMu.Lock()
+	profile := Profile{User: caller.name, Digest: "off"}
+	if p, ok := profiles[caller.name]; ok {
+		profile = *p
+	}
+	profilesMu.Unlock()
+	writeJSON(ctx, fasthttp.StatusOK, profile)
+}
+
+// updateProfile handles PUT /me/profile with a JSON body such as
+// {"email": "alice@example.com", "digest": "weekly"}, replacing the
+// caller's settings.
+func updateProfile(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	var profile Profile
+	if !decodeJSONBody(ctx, &profile) {
+		return
+	}
+	if err := profile.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	profile.User = caller.name
+
+	profilesMu.Lock()
+	if old, ok := profiles[caller.name]; ok {
+		profile.LastDigestAt = old.LastDigestAt
+	} else {
+		profile.LastDigestAt = nil
+	}
+	profiles[caller.name] = &profile
+	snapshot := profile
+	profilesMu.Unlock()
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// principalNamed returns the principal of the user with the given name.
+func principalNamed(name string) (*principal, bool) {
+	if len(apiKeys) == 0 {
+		return principalFor("")
+	}
+	for _, p := range apiKeys {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// buildDigest returns the digest of the open todos assigned to the user
+// that are overdue at now or due within period, as far as the user may see
+// them. ok is false if there are none.
+func buildDigest(user *principal, now time.Time, period time.Duration) (n notification, ok bool) {
+	var overdue, upcoming []Todo
+	store.listed(func(todo *Todo) bool {
+		if todo.Completed || todo.DueAt == nil || todo.Assignee != user.name || !user.canSee(todo.Project) {
+			return true
+		}
+		switch {
+		case todo.DueAt.Before(now):
+			overdue = append(overdue, todo.clone())
+		case todo.DueAt.Before(now.Add(period)):
+			upcoming = append(upcoming, todo.clone())
+		}
+		return true
+	})
+	if len(overdue) == 0 && len(upcoming) == 0 {
+		return notification{}, false
+	}
+
+	var b strings.Builder
+	section := func(heading string, todos []Todo) {
+		if len(todos) == 0 {
+			return
+		}
+		sort.Slice(todos, func(i, j int) bool { return todos[i].DueAt.Before(*todos[j].DueAt) })
+		fmt.Fprintf(&b, "%s:\r\n", heading)
+		for _, todo := range todos {
+			fmt.Fprintf(&b, "- #%d %s (due %s)\r\n", todo.ID, todo.Title, todo.DueAt.Format(time.RFC1123))
+		}
+		b.WriteString("\r\n")
+	}
+	section("Overdue", overdue)
+	section("Upcoming", upcoming)
+	return notification{
+		Kind:    "digest",
+		Title:   fmt.Sprintf("Todo digest: %d overdue, %d upcoming", len(overdue), len(upcoming)),
+		Message: strings.TrimSpace(b.String()),
+		Time:    now,
+	}, true
+}
+
+// digestResult summarizes one run of the digest job.
+type digestResult struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+// sendDigests is a scheduled task emailing every user who opted in their
+// digest once its period has passed since their last one. Users without
+// overdue or upcoming todos get no email.
+func sendDigests(ctx context.Context, p *jobProgress) (interface{}, error) {
+	now := time.Now()
+	profilesMu.Lock()
+	var due []Profile
+	for _, profile := range profiles {
+		period, ok := digestPeriods[profile.Digest]
+		// Allow for the schedule firing a little early.
+		if ok && (profile.LastDigestAt == nil || now.Sub(*profile.LastDigestAt) >= period-time.Hour) {
+			due = append(due, *profile)
+		}
+	}
+	profilesMu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].User < due[j].User })
+
+	var result digestResult
+	if len(due) > 0 && digestMailer == nil {
+		return result, errors.New("digests need -smtp-addr and -smtp-from")
+	}
+	p.setTotal(len(due))
+	for _, profile := range due {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		p.advance(1)
+		user, ok := principalNamed(profile.User)
+		if !ok {
+			continue
+		}
+		n, ok := buildDigest(user, now, digestPeriods[profile.Digest])
+		if ok {
+			if err := digestMailer(profile.Email, n); err != nil {
+				log.Printf("digest for %s: %s", profile.User, err)
+				result.Failed++
+				continue
+			}
+			result.Sent++
+		}
+		profilesMu.Lock()
+		if current, ok := profiles[profile.User]; ok {
+			current.LastDigestAt = &now
+		}
+		profilesMu.Unlock()
+	}
+	return result, nil
+}
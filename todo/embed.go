@@ -0,0 +1,104 @@
+package todo
+
+import (
+	"errors"
+	"time"
+)
+
+// Store gives programs embedding the API direct access to the todos of the
+// default namespace. Changes made through it behave like those made through
+// the API: they are validated, recorded in the activity log under the
+// actor, published to webhooks and rules, and invalidate cached responses.
+type Store struct {
+	s *todoStore
+}
+
+// ErrNotFound is returned for todos that don't exist.
+var ErrNotFound = errors.New("todo not found")
+
+// ValidationError reports the problems with an invalid todo.
+type ValidationError struct {
+	// Fields maps the fields with problems to the first problem found.
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid todo"
+}
+
+// Store returns the store holding the todos of the server.
+func (s *Server) Store() *Store {
+	return &Store{s: defaultNamespace.store}
+}
+
+// List returns all todos, ordered by ID.
+func (st *Store) List() []Todo {
+	return st.s.list()
+}
+
+// Get returns the todo with the given ID.
+func (st *Store) Get(id int) (Todo, bool) {
+	return st.s.get(id)
+}
+
+// Create validates and adds a todo and returns it as stored, with its ID.
+func (st *Store) Create(actor string, todo Todo) (Todo, error) {
+	todo.ID = 0
+	if errs := validateTodo(&todo); len(errs) > 0 {
+		return Todo{}, newValidationError(errs)
+	}
+	now := time.Now()
+	todo.CreatedAt, todo.UpdatedAt = now, now
+	t := todo.clone()
+	if _, err := addTodo(actor, &t); err != nil {
+		return Todo{}, err
+	}
+	stored, _ := st.s.get(t.ID)
+	return stored, nil
+}
+
+// Update changes the todo with the given ID through fn and returns it as
+// stored. The change is discarded if fn returns an error or the result is
+// invalid.
+func (st *Store) Update(actor string, id int, fn func(todo *Todo) error) (Todo, error) {
+	_, ok, err := changeTodo(actor, id, func(todo *Todo) error {
+		if err := fn(todo); err != nil {
+			return err
+		}
+		if errs := validateTodo(todo); len(errs) > 0 {
+			return newValidationError(errs)
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if !ok {
+		return Todo{}, ErrNotFound
+	}
+	if err != nil {
+		return Todo{}, err
+	}
+	stored, _ := st.s.get(id)
+	return stored, nil
+}
+
+// Delete removes the todo with the given ID.
+func (st *Store) Delete(actor string, id int) error {
+	removed, err := removeTodo(actor, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func newValidationError(errs []fieldError) *ValidationError {
+	e := &ValidationError{Fields: make(map[string]string)}
+	for _, fe := range errs {
+		if _, ok := e.Fields[fe.Field]; !ok {
+			e.Fields[fe.Field] = fe.Message
+		}
+	}
+	return e
+}
@@ -0,0 +1,132 @@
+package todo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// envelopeMeta is the metadata added to enveloped responses.
+type envelopeMeta struct {
+	RequestID  string  `json:"request_id"`
+	DurationMS float64 `json:"duration_ms"`
+	// Pagination describes the page of a list response.
+	Pagination *pagination `json:"pagination,omitempty"`
+}
+
+// pagination describes the items of a list response. NextCursor is set for
+// pages of todos, see getTodoPage.
+type pagination struct {
+	Count      int    `json:"count"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// envelopeHandler wraps the JSON responses of h in an envelope for clients
+// that ask for one with ?envelope=1 or an Accept header of
+// application/json; profile=envelope:
+//
+//	{"data": ..., "meta": {"request_id": "...", "duration_ms": 0.4}}
+//
+// Errors are returned as {"error": ..., "meta": ...}, and warnings about
+// written todos, see softRules, as a "warnings" member of the envelope or,
+// without one, of the todo. Every response gets an X-Request-ID header,
+// taken from the request when the client sent one.
+func envelopeHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		requestID := string(ctx.Request.Header.Peek("X-Request-ID"))
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+
+		h(ctx)
+
+		ctx.Response.Header.Set("X-Request-ID", requestID)
+		warnings := warningsOf(ctx)
+		if !wantsEnvelope(ctx) || ctx.Response.IsBodyStream() {
+			if len(warnings) > 0 && bytes.HasPrefix(ctx.Response.Body(), []byte("{")) {
+				ctx.SetBody(withWarnings(ctx.Response.Body(), warnings))
+			}
+			return
+		}
+		meta := envelopeMeta{
+			RequestID:  requestID,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		body := ctx.Response.Body()
+		isJSON := bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json"))
+
+		envelope := map[string]interface{}{"meta": &meta}
+		if len(warnings) > 0 {
+			envelope["warnings"] = warnings
+		}
+		switch status := ctx.Response.StatusCode(); {
+		case status >= 400 && isJSON:
+			envelope["error"] = json.RawMessage(body)
+		case status >= 400:
+			envelope["error"] = map[string]interface{}{
+				"status":  status,
+				"message": strings.TrimSpace(string(body)),
+			}
+		case isJSON:
+			envelope["data"] = json.RawMessage(body)
+			if bytes.HasPrefix(body, []byte("[")) {
+				var items []json.RawMessage
+				if json.Unmarshal(body, &items) == nil {
+					meta.Pagination = &pagination{Count: len(items)}
+				}
+			} else if bytes.Contains(body, []byte(`"next_cursor":`)) {
+				var page struct {
+					Todos      []json.RawMessage `json:"todos"`
+					NextCursor *string           `json:"next_cursor"`
+				}
+				if json.Unmarshal(body, &page) == nil && page.Todos != nil {
+					meta.Pagination = &pagination{Count: len(page.Todos)}
+					if page.NextCursor != nil {
+						meta.Pagination.NextCursor = *page.NextCursor
+					}
+				}
+			}
+		case status == fasthttp.StatusNoContent:
+			ctx.SetStatusCode(fasthttp.StatusOK)
+			envelope["data"] = nil
+		default:
+			// Not JSON, such as metrics or downloads; leave it alone.
+			return
+		}
+		writeJSON(ctx, ctx.Response.StatusCode(), envelope)
+	}
+}
+
+// wantsEnvelope reports whether the client asked for enveloped responses.
+func wantsEnvelope(ctx *fasthttp.RequestCtx) bool {
+	switch string(ctx.QueryArgs().Peek("envelope")) {
+	case "1", "true":
+		return true
+	}
+	for _, accept := range strings.Split(string(ctx.Request.Header.Peek("Accept")), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		for _, profile := range strings.Fields(params["profile"]) {
+			if profile == "envelope" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
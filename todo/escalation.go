@@ -0,0 +1,179 @@
+package todo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// EscalationRule escalates open todos of a given priority that have been
+// around for longer than After, e.g. "high priority todos open for more than
+// 3 days become urgent". Rules are evaluated periodically by the scheduler.
+type EscalationRule struct {
+	ID int `json:"id"`
+	// Project limits the rule to todos of one project; empty means all.
+	Project  string `json:"project,omitempty"`
+	Priority string `json:"priority"`
+	// After is the age at which a todo is escalated, as a Go duration
+	// ("36h") or a number of days ("3d").
+	After string `json:"after"`
+	// Action is "event" to only emit a todo.escalated event, or "bump" to
+	// also raise the todo's priority to BumpTo.
+	Action string `json:"action"`
+	BumpTo string `json:"bump_to,omitempty"`
+
+	after time.Duration
+	// fired holds the IDs of the todos the rule already escalated.
+	fired map[int]bool
+}
+
+var (
+	escalationRules  = make(map[int]*EscalationRule)
+	nextEscalationID = 1
+	escalationsMu    sync.Mutex
+)
+
+// parseAge parses a duration that may also be given in days, such as "3d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// validate checks the rule and fills in its parsed fields.
+func (r *EscalationRule) validate() error {
+	if r.Priority == "" || !validPriority(r.Priority) {
+		return fmt.Errorf("invalid priority %q", r.Priority)
+	}
+	after, err := parseAge(r.After)
+	if err != nil || after <= 0 {
+		return fmt.Errorf("invalid after %q", r.After)
+	}
+	r.after = after
+	switch r.Action {
+	case "event":
+		r.BumpTo = ""
+	case "bump":
+		if r.BumpTo == "" || !validPriority(r.BumpTo) || r.BumpTo == r.Priority {
+			return fmt.Errorf("invalid bump_to %q", r.BumpTo)
+		}
+	default:
+		return fmt.Errorf("invalid action %q, expected \"event\" or \"bump\"", r.Action)
+	}
+	return nil
+}
+
+// getEscalationRules handles GET /escalations.
+func getEscalationRules(ctx *fasthttp.RequestCtx) {
+	escalationsMu.Lock()
+	list := make([]EscalationRule, 0, len(escalationRules))
+	for _, rule := range escalationRules {
+		list = append(list, *rule)
+	}
+	escalationsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// createEscalationRule handles POST /escalations with a JSON rule as body.
+func createEscalationRule(ctx *fasthttp.RequestCtx) {
+	var rule EscalationRule
+	if !decodeJSONBody(ctx, &rule) {
+		return
+	}
+	if err := rule.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	escalationsMu.Lock()
+	rule.ID = nextEscalationID
+	nextEscalationID++
+	rule.fired = make(map[int]bool)
+	escalationRules[rule.ID] = &rule
+	escalationsMu.Unlock()
+
+	writeJSON(ctx, fasthttp.StatusCreated, rule)
+}
+
+// deleteEscalationRule handles DELETE /escalations/{id}.
+func deleteEscalationRule(ctx *fasthttp.RequestCtx, id int) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	if _, ok := escalationRules[id]; !ok {
+		ctx.Error("Escalation rule not found", fasthttp.StatusNotFound)
+		return
+	}
+	delete(escalationRules, id)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// escalationResult summarizes one evaluation of the escalation rules.
+type escalationResult struct {
+	Escalated int `json:"escalated"`
+}
+
+// evaluateEscalations applies every escalation rule to the open todos. Each
+// rule escalates a todo at most once.
+func evaluateEscalations(ctx context.Context, p *jobProgress) (interface{}, error) {
+	now := time.Now()
+	var events []Event
+	changed := false
+
+	escalationsMu.Lock()
+	ruleIDs := make([]int, 0, len(escalationRules))
+	for id := range escalationRules {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Ints(ruleIDs)
+	p.setTotal(len(ruleIDs))
+
+	for _, ruleID := range ruleIDs {
+		rule := escalationRules[ruleID]
+		store.updateAll("escalation", func(todo *Todo) bool {
+			if todo.Completed || todo.CreatedAt.IsZero() || rule.fired[todo.ID] ||
+				todo.Priority != rule.Priority ||
+				(rule.Project != "" && todo.Project != rule.Project) ||
+				now.Sub(todo.CreatedAt) < rule.after {
+				return false
+			}
+			rule.fired[todo.ID] = true
+			data := map[string]interface{}{
+				"rule":     rule.ID,
+				"priority": todo.Priority,
+				"age":      now.Sub(todo.CreatedAt).Round(time.Second).String(),
+			}
+			events = append(events, Event{Type: "todo.escalated", TodoID: todo.ID, Time: now, Data: data})
+			if rule.Action != "bump" {
+				return false
+			}
+			data["bumped_to"] = rule.BumpTo
+			todo.Priority = rule.BumpTo
+			todo.UpdatedAt = now
+			changed = true
+			return true
+		})
+		p.advance(1)
+	}
+	escalationsMu.Unlock()
+
+	if changed {
+		todosChanged()
+	}
+	for _, e := range events {
+		publish(e)
+	}
+	return escalationResult{Escalated: len(events)}, nil
+}
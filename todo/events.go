@@ -0,0 +1,63 @@
+package todo
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event describes something that happened to a todo, such as an escalation.
+type Event struct {
+	Type   string      `json:"type"`
+	TodoID int         `json:"todo_id,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+
+	// ns is the namespace of the todo, nil for the default namespace.
+	ns *namespace
+}
+
+// namespace returns the namespace of the event's todo.
+func (e Event) namespace() *namespace {
+	if e.ns == nil {
+		return defaultNamespace
+	}
+	return e.ns
+}
+
+var (
+	subscribers   []func(Event)
+	subscribersMu sync.RWMutex
+)
+
+// subscribe registers fn to be called for every published event. Subscribers
+// run synchronously on the publishing goroutine, so they must not block.
+func subscribe(fn func(Event)) {
+	subscribersMu.Lock()
+	subscribers = append(subscribers, fn)
+	subscribersMu.Unlock()
+}
+
+// publish delivers e to all subscribers. It must not be called with mu held.
+func publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// logEvent writes escalations to the server log, so that the todos rules
+// escalated can be found there. Other events are left out, as there is one
+// for every change.
+func logEvent(e Event) {
+	if e.Type != "todo.escalated" {
+		return
+	}
+	data, _ := json.Marshal(e.Data)
+	log.Printf("event %s todo=%d data=%s", e.Type, e.TodoID, data)
+}
@@ -0,0 +1,333 @@
+package todo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"os"
+)
+
+// Uploaded photos often carry EXIF metadata, such as the GPS position they
+// were taken at and the camera's serial number. Before an uploaded JPEG or
+// PNG image is attached, processImage strips that metadata and rotates the
+// image upright by its EXIF orientation, which only some viewers honor.
+
+var (
+	// stripImageMetadata, autoOrientImages and imageQuality are set from
+	// the Config fields of the same names.
+	stripImageMetadata = true
+	autoOrientImages   = true
+	imageQuality       = 90
+)
+
+// maxOrientPixels is the largest image decoded to be rotated. Larger ones
+// keep their orientation tag instead.
+const maxOrientPixels = 50_000_000
+
+// exifOrientationTag is the EXIF tag holding the orientation, 1 to 8.
+const exifOrientationTag = 0x0112
+
+var (
+	jpegExifPrefix = []byte("Exif\x00\x00")
+	jpegICCPrefix  = []byte("ICC_PROFILE\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// processImage strips the metadata from and orients the uploaded image of
+// a, as configured, and returns a with its new size and checksum. Files
+// that aren't JPEG or PNG images, or can't be parsed as one, are left as
+// they are.
+func processImage(a Attachment) (Attachment, error) {
+	if !stripImageMetadata && !autoOrientImages {
+		return a, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(a.MIMEType)
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		return a, nil
+	}
+	data, err := os.ReadFile(a.Path)
+	if err != nil {
+		return a, err
+	}
+	var out []byte
+	var ok bool
+	if mediaType == "image/jpeg" {
+		out, ok = cleanJPEG(data)
+	} else {
+		out, ok = cleanPNG(data)
+	}
+	if !ok || bytes.Equal(out, data) {
+		return a, nil
+	}
+	if err := os.WriteFile(a.Path, out, 0o644); err != nil {
+		return a, err
+	}
+	sum := sha256.Sum256(out)
+	a.Size = int64(len(out))
+	a.Checksum = hex.EncodeToString(sum[:])
+	return a, nil
+}
+
+// jpegSegment is a marker segment of a JPEG file: its marker and all its
+// bytes, including the marker. The last one holds the rest of the file,
+// from the start of the scan.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegSegments splits a JPEG file into its segments, after the SOI marker.
+func jpegSegments(data []byte) ([]jpegSegment, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, false
+	}
+	var segments []jpegSegment
+	for i := 2; i < len(data); {
+		if data[i] != 0xff {
+			return nil, false
+		}
+		// Markers may be preceded by fill bytes.
+		start := i
+		for i < len(data) && data[i] == 0xff {
+			i++
+		}
+		if i >= len(data) {
+			return nil, false
+		}
+		marker := data[i]
+		i++
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// The scan and everything after it is kept as it is.
+			return append(segments, jpegSegment{marker, data[start:]}), true
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			segments = append(segments, jpegSegment{marker, data[start:i]})
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, false
+		}
+		end := i + int(binary.BigEndian.Uint16(data[i:]))
+		if end > len(data) || end < i+2 {
+			return nil, false
+		}
+		segments = append(segments, jpegSegment{marker, data[start:end]})
+		i = end
+	}
+	return nil, false
+}
+
+// cleanJPEG returns the JPEG file data without metadata and rotated
+// upright, as configured. ok is false if data isn't a JPEG file.
+func cleanJPEG(data []byte) ([]byte, bool) {
+	segments, ok := jpegSegments(data)
+	if !ok {
+		return nil, false
+	}
+	orientation := 1
+	for _, s := range segments {
+		if body := s.data[min(4, len(s.data)):]; s.marker == 0xe1 && bytes.HasPrefix(body, jpegExifPrefix) {
+			orientation = exifOrientation(body[len(jpegExifPrefix):])
+			break
+		}
+	}
+	if autoOrientImages && orientation != 1 {
+		if img, ok := decodeForOrientation(data, jpeg.Decode); ok {
+			// Encoding anew drops all metadata, including the orientation.
+			var buf bytes.Buffer
+			if jpeg.Encode(&buf, orient(img, orientation), &jpeg.Options{Quality: imageQuality}) == nil {
+				return buf.Bytes(), true
+			}
+		}
+	}
+	if !stripImageMetadata {
+		return data, true
+	}
+
+	out := append(make([]byte, 0, len(data)), 0xff, 0xd8)
+	for _, s := range segments {
+		body := s.data[min(4, len(s.data)):]
+		switch {
+		case s.marker == 0xe1 && bytes.HasPrefix(body, jpegExifPrefix):
+			// Keep the orientation of images that weren't rotated.
+			if orientation != 1 {
+				tiff := minimalExif(orientation)
+				out = append(out, 0xff, 0xe1)
+				out = binary.BigEndian.AppendUint16(out, uint16(2+len(jpegExifPrefix)+len(tiff)))
+				out = append(append(out, jpegExifPrefix...), tiff...)
+			}
+		case s.marker == 0xe2 && bytes.HasPrefix(body, jpegICCPrefix), s.marker == 0xee:
+			// Color profiles and Adobe's color transform are needed to
+			// show the image right.
+			out = append(out, s.data...)
+		case s.marker >= 0xe1 && s.marker <= 0xef, s.marker == 0xfe:
+			// Other application segments, such as XMP and IPTC, and
+			// comments.
+		default:
+			out = append(out, s.data...)
+		}
+	}
+	return out, true
+}
+
+// cleanPNG returns the PNG file data without metadata and rotated upright,
+// as configured. ok is false if data isn't a PNG file.
+func cleanPNG(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false
+	}
+	type chunk struct {
+		typ  string
+		data []byte
+	}
+	var chunks []chunk
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, false
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i+12 {
+			return nil, false
+		}
+		chunks = append(chunks, chunk{string(data[i+4 : i+8]), data[i:end]})
+		i = end
+	}
+	orientation := 1
+	for _, c := range chunks {
+		if c.typ == "eXIf" {
+			orientation = exifOrientation(c.data[8 : len(c.data)-4])
+		}
+	}
+	if autoOrientImages && orientation != 1 {
+		if img, ok := decodeForOrientation(data, png.Decode); ok {
+			var buf bytes.Buffer
+			if png.Encode(&buf, orient(img, orientation)) == nil {
+				return buf.Bytes(), true
+			}
+		}
+	}
+	if !stripImageMetadata {
+		return data, true
+	}
+
+	out := append(make([]byte, 0, len(data)), pngSignature...)
+	for _, c := range chunks {
+		switch c.typ {
+		case "eXIf":
+			if orientation != 1 {
+				tiff := minimalExif(orientation)
+				out = binary.BigEndian.AppendUint32(out, uint32(len(tiff)))
+				start := len(out)
+				out = append(append(out, "eXIf"...), tiff...)
+				out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			// Text chunks hold XMP, comments, authors and the like.
+		default:
+			out = append(out, c.data...)
+		}
+	}
+	return out, true
+}
+
+// decodeForOrientation decodes the image in data unless it is too large to
+// be rotated.
+func decodeForOrientation(data []byte, decode func(r io.Reader) (image.Image, error)) (image.Image, bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxOrientPixels {
+		return nil, false
+	}
+	img, err := decode(bytes.NewReader(data))
+	return img, err == nil
+}
+
+// exifOrientation returns the orientation in the first IFD of EXIF data, a
+// TIFF structure, or 1 if it has none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		// A SHORT value is stored in the first bytes of the value field.
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// minimalExif returns EXIF data holding nothing but the orientation.
+func minimalExif(orientation int) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	// Padding of the value field and the offset of the next IFD, none.
+	return append(tiff, 0, 0, 0, 0, 0, 0)
+}
+
+// orient returns img turned upright from the EXIF orientation, 2 to 8:
+// mirrored, rotated or both.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+		}
+	}
+	return dst
+}
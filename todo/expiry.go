@@ -0,0 +1,122 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// expiryActor names the changes made by the expiry reaper in the activity
+// log.
+const expiryActor = "expiry"
+
+// parseTTL parses the ttl field of a todo form, a positive Go duration
+// such as "24h", into the expiry time it stands for.
+func parseTTL(s string, now time.Time) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, errors.New("not positive")
+	}
+	expiresAt := now.Add(ttl)
+	return &expiresAt, nil
+}
+
+// parseExpiry returns the expiry time given by the expires_at or ttl field
+// of a todo form, reporting problems with them as field errors. Only one
+// of the two may be set.
+func parseExpiry(expiresAtStr, ttlStr string, now time.Time) (*time.Time, []fieldError) {
+	if expiresAtStr != "" && ttlStr != "" {
+		return nil, []fieldError{{Field: "ttl", Message: "can't be combined with expires_at"}}
+	}
+	if ttlStr != "" {
+		expiresAt, err := parseTTL(ttlStr, now)
+		if err != nil {
+			return nil, []fieldError{{Field: "ttl", Message: `must be a positive duration such as "24h"`}}
+		}
+		return expiresAt, nil
+	}
+	expiresAt, err := parseDueAt(expiresAtStr)
+	if err != nil {
+		return nil, []fieldError{{Field: "expires_at", Message: "must be an RFC 3339 timestamp"}}
+	}
+	return expiresAt, nil
+}
+
+// expired reports whether the todo has expired at now.
+func (t *Todo) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
+
+// runExpiry is the expiry reaper: every interval it deletes the expired
+// todos of all namespaces or, with archive, completes and archives them,
+// clearing their expiry so that reopening them keeps them.
+func runExpiry(ctx context.Context, interval time.Duration, archive bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// Replicas and cluster followers leave expiry to the primary.
+		if readOnly() {
+			continue
+		}
+		for _, ns := range allNamespaces() {
+			reapExpired(ns, now, archive)
+		}
+	}
+}
+
+// reapExpired deletes or archives the todos of ns that have expired at now
+// and returns their IDs. Deletions publish todo.deleted events. Todos the
+// workflow doesn't let move to done aren't archived until it does.
+func reapExpired(ns *namespace, now time.Time, archive bool) []int {
+	var due []int
+	ns.store.each(func(todo *Todo) bool {
+		if todo.expired(now) {
+			due = append(due, todo.ID)
+		}
+		return true
+	})
+	sort.Ints(due)
+
+	var reaped []int
+	for _, id := range due {
+		if !archive {
+			if removed, _ := ns.removeTodo(expiryActor, id); removed {
+				reaped = append(reaped, id)
+			}
+			continue
+		}
+		_, ok, err := ns.changeTodo(expiryActor, id, func(todo *Todo) error {
+			// The expiry may have been changed meanwhile.
+			if !todo.expired(now) {
+				return errNoChange
+			}
+			// Todos the workflow keeps from being done are left for a
+			// later run.
+			if setStatus(todo, statusDone) != nil {
+				return errNoChange
+			}
+			archivedAt := now
+			todo.ArchivedAt = &archivedAt
+			todo.ExpiresAt = nil
+			todo.UpdatedAt = now
+			return nil
+		})
+		if ok && err == nil {
+			reaped = append(reaped, id)
+		}
+	}
+	return reaped
+}
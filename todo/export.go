@@ -0,0 +1,139 @@
+package todo
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// exportResult summarizes a finished export job.
+type exportResult struct {
+	Todos int    `json:"todos"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+	URL   string `json:"url"`
+}
+
+// exportTodos handles POST /export. It starts a background job that writes
+// every todo of the request's namespace the caller may see and its attached
+// files into a zip archive in
+// the format accepted by POST /import. Once the job is done the archive can
+// be downloaded by the caller from GET /jobs/{id}/result.
+func exportTodos(ctx *fasthttp.RequestCtx) {
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	job := startJob("export", actorOf(ctx), exportArchive(namespaceOf(ctx), "exports", visible))
+	respondJobStarted(ctx, job)
+}
+
+// exportArchive returns a job writing the export archive of the todos of ns
+// visible passes, or of all its todos if it is nil, into dir.
+func exportArchive(ns *namespace, dir string, visible func(todo *Todo) bool) jobFunc {
+	return func(ctx context.Context, p *jobProgress) (interface{}, error) {
+		return writeExport(ctx, p, ns, dir, visible)
+	}
+}
+
+func writeExport(ctx context.Context, p *jobProgress, ns *namespace, dir string, visible func(todo *Todo) bool) (interface{}, error) {
+	list := ns.store.list()
+	if visible != nil {
+		list = slices.DeleteFunc(list, func(todo Todo) bool { return !visible(&todo) })
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var attached []string
+	seen := make(map[string]bool)
+	for _, todo := range list {
+		for _, a := range todo.Attachments {
+			if !seen[a.Path] {
+				seen[a.Path] = true
+				attached = append(attached, a.Path)
+			}
+		}
+	}
+	p.setTotal(1 + len(attached))
+
+	filePath := filepath.Join(dir, fmt.Sprintf("todos_%d.zip", time.Now().UnixNano()))
+	out, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	w, err := zw.Create("todos.json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	p.advance(1)
+
+	files := 0
+	for _, path := range attached {
+		if err := ctx.Err(); err != nil {
+			os.Remove(filePath)
+			return nil, err
+		}
+		ok, err := addZipFile(zw, path)
+		if err != nil {
+			os.Remove(filePath)
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if ok {
+			files++
+		}
+		p.advance(1)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	p.setFile(filePath)
+	return exportResult{
+		Todos: len(list),
+		Files: files,
+		Size:  info.Size(),
+		URL:   fmt.Sprintf("%s/jobs/%d/result", apiPrefix, p.job.ID),
+	}, nil
+}
+
+// addZipFile copies the file at path into zw under its base name. Files that
+// no longer exist on disk are skipped and reported with ok == false.
+func addZipFile(zw *zip.Writer, path string) (ok bool, err error) {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	w, err := zw.Create(filepath.Base(path))
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,122 @@
+package todo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// watcherBuffer is how many events a watcher may fall behind before it is
+// dropped.
+const watcherBuffer = 256
+
+var (
+	watchers      = make(map[int]chan Event)
+	nextWatcherID = 1
+	watchersMu    sync.Mutex
+)
+
+// watchEvents registers a watcher receiving every published event. The
+// returned stop function unregisters it. A watcher that falls too far behind
+// is dropped and its channel closed, so slow consumers never hold up
+// publishers.
+func watchEvents() (<-chan Event, func()) {
+	ch := make(chan Event, watcherBuffer)
+	watchersMu.Lock()
+	id := nextWatcherID
+	nextWatcherID++
+	watchers[id] = ch
+	watchersMu.Unlock()
+
+	stop := func() {
+		watchersMu.Lock()
+		defer watchersMu.Unlock()
+		if _, ok := watchers[id]; ok {
+			delete(watchers, id)
+			close(ch)
+		}
+	}
+	return ch, stop
+}
+
+// feedWatchers is subscribed to the event bus and hands events to the
+// watchers.
+func feedWatchers(e Event) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for id, ch := range watchers {
+		select {
+		case ch <- e:
+		default:
+			delete(watchers, id)
+			close(ch)
+		}
+	}
+}
+
+// sseMessage is the data of an event sent by GET /events.
+type sseMessage struct {
+	Type   string          `json:"type"`
+	TodoID int             `json:"todo_id"`
+	Time   time.Time       `json:"time"`
+	Todo   json.RawMessage `json:"todo,omitempty"`
+}
+
+// getEventStream handles GET /events and streams todo events as
+// Server-Sent Events until the client goes away, each with the todo as it
+// is now unless it was deleted. Callers only get the events of todos they
+// have a permission on, and of deletions. A comment is sent every 15 seconds while
+// nothing happens, so proxies keep the connection open. Clients that fall
+// too far behind are disconnected and have to reconnect, and streams end
+// when the server shuts down.
+func getEventStream(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	ns := namespaceOf(ctx)
+	events, stop := watchEvents()
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer stop()
+		heartbeat := time.NewTicker(replicationHeartbeat)
+		defer heartbeat.Stop()
+		w.WriteString(": connected\n\n")
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-feedsStopped.Done():
+				return
+			case <-heartbeat.C:
+				w.WriteString(": ping\n\n")
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if e.TodoID == 0 || !strings.HasPrefix(e.Type, "todo.") || e.namespace() != ns {
+					continue
+				}
+				msg := sseMessage{Type: e.Type, TodoID: e.TodoID, Time: e.Time}
+				if e.Type != "todo.deleted" {
+					todo, ok := ns.store.get(e.TodoID)
+					if !ok || ns.permission(caller, &todo) == permNone {
+						continue
+					}
+					msg.Todo, _ = ns.store.raw(e.TodoID)
+				}
+				data, _ := json.Marshal(msg)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package todo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// atomPath is the path of the Atom feed of recent activity.
+const atomPath = "/todos/feed.atom"
+
+// feedToken returns the secret token of the feeds of the principal with
+// the given name. Feed readers and calendar apps can't send API keys, so
+// the feeds take the token in their URL instead. It is derived from the
+// JWT secret, so feed URLs stay valid across restarts only with
+// -jwt-secret set.
+func feedToken(name string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("feed:" + name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// feedPrincipal returns the principal whose feed token the request
+// carries in ?token=, responding with 401 Unauthorized if there is none.
+// Without API keys the feeds are open to everybody, like the rest of the
+// API.
+func feedPrincipal(ctx *fasthttp.RequestCtx) (*principal, bool) {
+	if len(apiKeys) == 0 {
+		return principalFor("")
+	}
+	token := ctx.QueryArgs().Peek("token")
+	for _, p := range apiKeys {
+		if hmac.Equal(token, []byte(feedToken(p.name))) {
+			return p, true
+		}
+	}
+	writeRequestError(ctx, fasthttp.StatusUnauthorized, "Invalid feed token",
+		"get the URLs of your feeds from GET /feeds/token")
+	return nil, false
+}
+
+// getFeedToken handles GET /feeds/token and responds with the caller's
+// feed token and the URLs of their feeds.
+func getFeedToken(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	token := feedToken(caller.name)
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{
+		"token":    token,
+		"calendar": apiPrefix + calendarPath + "?token=" + token,
+		"atom":     apiPrefix + atomPath + "?token=" + token,
+	})
+}
+
+// The Atom (RFC 4287) elements of the activity feed.
+type (
+	atomFeed struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string      `xml:"id"`
+		Title   string      `xml:"title"`
+		Updated string      `xml:"updated"`
+		Link    atomLink    `xml:"link"`
+		Entries []atomEntry `xml:"entry"`
+	}
+	atomEntry struct {
+		ID      string     `xml:"id"`
+		Title   string     `xml:"title"`
+		Updated string     `xml:"updated"`
+		Author  atomAuthor `xml:"author"`
+		Link    atomLink   `xml:"link"`
+		Summary string     `xml:"summary,omitempty"`
+	}
+	atomAuthor struct {
+		Name string `xml:"name"`
+	}
+	atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+)
+
+// activityTodo holds the fields of a todo encoding the activity feed uses.
+type activityTodo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Completed   bool   `json:"completed"`
+	Project     string `json:"project"`
+}
+
+// getAtomFeed handles GET /todos/feed.atom and responds with an Atom feed
+// of the todos recently created or completed, newest first, as far as the
+// token's principal may see them. ?limit= caps the number of entries, 50
+// by default.
+func getAtomFeed(ctx *fasthttp.RequestCtx) {
+	caller, ok := feedPrincipal(ctx)
+	if !ok {
+		return
+	}
+	limit := 50
+	if v := ctx.QueryArgs().Peek("limit"); v != nil {
+		n, err := strconv.Atoi(string(v))
+		if err != nil || n < 1 || n > maxPageSize {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid limit",
+				"limit must be a number from 1 to "+strconv.Itoa(maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	base := "http://" + string(ctx.Host()) + apiPrefix
+	feed := atomFeed{
+		ID:      base + atomPath,
+		Title:   "Todo activity",
+		Updated: startTime.UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: base + atomPath, Rel: "self"},
+	}
+	entries := namespaceOf(ctx).store.audit.recent(limit, func(e *AuditEntry) bool {
+		var before, after activityTodo
+		if e.Action != auditCreated && e.Action != auditUpdated ||
+			e.after == nil || json.Unmarshal(e.after, &after) != nil || !caller.canSee(after.Project) {
+			return false
+		}
+		if e.Action == auditCreated {
+			return true
+		}
+		return after.Completed && json.Unmarshal(e.before, &before) == nil && !before.Completed
+	})
+	for _, e := range entries {
+		var todo activityTodo
+		json.Unmarshal(e.after, &todo)
+		verb := "Created"
+		if e.Action != auditCreated {
+			verb = "Completed"
+		}
+		link := base + "/todos/" + strconv.Itoa(e.TodoID)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      base + "/audit#" + strconv.Itoa(e.ID),
+			Title:   verb + ": " + todo.Title,
+			Updated: e.Time.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: e.Actor},
+			Link:    atomLink{Href: link},
+			Summary: todo.Description,
+		})
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Time.UTC().Format(time.RFC3339)
+	}
+
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetContentType("application/atom+xml; charset=utf-8")
+	ctx.SetBody(append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,122 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// todoContentTypes lists the request body encodings accepted for todos.
+const todoContentTypes = "multipart/form-data, application/x-www-form-urlencoded or application/json"
+
+// parseTodoForm parses the body of a request creating or updating a todo.
+// The fields are the same whatever the encoding: multipart/form-data (the
+// only one carrying files), application/x-www-form-urlencoded, or a JSON
+// object. All are returned as a multipart form. On failure it responds with
+// 415 Unsupported Media Type for other content types, 413 Request Entity Too
+// Large for oversized bodies and 400 Bad Request for malformed ones, each
+// with a JSON body explaining how to fix the request, and reports false.
+func parseTodoForm(ctx *fasthttp.RequestCtx) (*multipart.Form, bool) {
+	defer traceOp(ctx, "request.parse")()
+	contentType := string(ctx.Request.Header.ContentType())
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	switch {
+	case contentType == "":
+		writeRequestError(ctx, fasthttp.StatusUnsupportedMediaType, "Missing Content-Type",
+			"send the todo as "+todoContentTypes)
+		return nil, false
+	case err != nil:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Malformed Content-Type header",
+			err.Error())
+		return nil, false
+	case mediaType == "application/x-www-form-urlencoded":
+		return urlencodedForm(ctx), true
+	case mediaType == "application/json":
+		return jsonForm(ctx)
+	case mediaType != "multipart/form-data":
+		writeRequestError(ctx, fasthttp.StatusUnsupportedMediaType, "Unsupported Content-Type "+mediaType,
+			"send the todo as "+todoContentTypes)
+		return nil, false
+	case params["boundary"] == "":
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Missing multipart boundary",
+			"the Content-Type header must carry a boundary parameter, e.g., multipart/form-data; boundary=xyz")
+		return nil, false
+	}
+
+	form, err := ctx.MultipartForm()
+	switch {
+	case err == nil:
+		return form, true
+	case errors.Is(err, fasthttp.ErrBodyTooLarge), errors.Is(err, multipart.ErrMessageTooLarge):
+		writeRequestError(ctx, fasthttp.StatusRequestEntityTooLarge, "Request body too large",
+			"send fewer or smaller files")
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Truncated multipart body",
+			"the body ended before the closing boundary; check that it uses the boundary from the Content-Type header")
+	default:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Malformed multipart body",
+			"the body could not be parsed as multipart/form-data with the boundary from the Content-Type header")
+	}
+	return nil, false
+}
+
+// urlencodedForm returns the fields of an application/x-www-form-urlencoded
+// body.
+func urlencodedForm(ctx *fasthttp.RequestCtx) *multipart.Form {
+	form := &multipart.Form{Value: make(map[string][]string)}
+	ctx.PostArgs().VisitAll(func(key, value []byte) {
+		form.Value[string(key)] = append(form.Value[string(key)], string(value))
+	})
+	return form
+}
+
+// jsonForm returns the fields of a JSON object body. Strings are taken as
+// they are and null as an empty value; tags may also be given as an array
+// of strings. Other values, such as the subtasks array, are kept as JSON.
+func jsonForm(ctx *fasthttp.RequestCtx) (*multipart.Form, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ctx.PostBody(), &fields); err != nil || fields == nil {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Malformed JSON body",
+			`the body must be a JSON object such as {"title": "Buy milk"}`)
+		return nil, false
+	}
+	if strictRequested(ctx) {
+		if unknown := unknownKeys(fields, todoFields); len(unknown) > 0 {
+			writeUnknownFields(ctx, unknown)
+			return nil, false
+		}
+	}
+
+	form := &multipart.Form{Value: make(map[string][]string, len(fields))}
+	for key, raw := range fields {
+		raw = bytes.TrimSpace(raw)
+		var value string
+		var tags []string
+		switch {
+		case bytes.Equal(raw, []byte("null")):
+		case raw[0] == '"':
+			json.Unmarshal(raw, &value)
+		case key == "tags" && json.Unmarshal(raw, &tags) == nil:
+			value = strings.Join(tags, ",")
+		default:
+			value = string(raw)
+		}
+		form.Value[key] = []string{value}
+	}
+	return form, true
+}
+
+// writeRequestError responds with status and a JSON body holding an error
+// message and a hint for fixing the request.
+func writeRequestError(ctx *fasthttp.RequestCtx, status int, msg, hint string) {
+	writeJSON(ctx, status, map[string]string{
+		"error": msg,
+		"hint":  hint,
+	})
+}
@@ -0,0 +1,95 @@
+package todo
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The fuzz targets check that malformed requests can't panic the server:
+//
+//	go test ./todo -run '^$' -fuzz FuzzRouting -fuzztime 1m
+
+// serveFuzzRequest runs a request through the whole handler chain of the
+// test server and fails on panics and 5xx responses.
+func serveFuzzRequest(t *testing.T, method, uri, contentType string, body []byte) {
+	h := testHandler(t)
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if contentType != "" {
+		req.Header.SetContentType(contentType)
+	}
+	req.SetBody(body)
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	h(&ctx)
+	if status := ctx.Response.StatusCode(); status >= 500 {
+		t.Errorf("%s %s: status %d: %s", method, uri, status, ctx.Response.Body())
+	}
+}
+
+func FuzzRoutePattern(f *testing.F) {
+	for _, path := range []string{
+		"/todos/7", "/v1/todos/7/subtasks/2", "/projects/home/todos", "/tenants/acme/todos",
+		"/debug/pprof/heap", "/v2/todos", "/todos//", "/v", "/",
+	} {
+		f.Add(path)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		routePattern(path)
+		pathVersion(path)
+		pathTodoID(path)
+		isDebugPath(path)
+	})
+}
+
+func FuzzRouting(f *testing.F) {
+	for _, seed := range []struct{ method, uri string }{
+		{"GET", "/v1/todos/1"},
+		{"GET", "/todos?cursor=abc&limit=-1"},
+		{"GET", "/v1/todos/1/subtasks/99999999999999999999"},
+		{"DELETE", "/v1/todos/-1"},
+		{"PATCH", "/v1/todos/1/subtasks/0"},
+		{"GET", "/v1/search?q=%ff&limit=0"},
+		{"GET", "/v1/todos?group_by=status&view=summary"},
+		{"OPTIONS", "/v1/projects/%2e%2e/todos"},
+		{"GET", "/v9/todos"},
+	} {
+		f.Add(seed.method, seed.uri)
+	}
+	f.Fuzz(func(t *testing.T, method, uri string) {
+		serveFuzzRequest(t, method, uri, "", nil)
+	})
+}
+
+func FuzzParseSubtasks(f *testing.F) {
+	for _, s := range []string{
+		``, `[]`, `[{"title": "Milk"}]`, `[{"title": "Milk", "completed": true}, {"title": ""}]`,
+		`[{"title": "Milk", "extra": 1}]`, `{"title": "Milk"}`, `[null]`, `[1, "a"]`,
+	} {
+		f.Add(s, false)
+		f.Add(s, true)
+	}
+	f.Fuzz(func(t *testing.T, s string, strict bool) {
+		subtasks, errs := parseSubtasks(s, strict)
+		if len(errs) == 0 && len(subtasks) > subtaskRules.maxCount {
+			t.Errorf("accepted %d subtasks, more than %d", len(subtasks), subtaskRules.maxCount)
+		}
+	})
+}
+
+func FuzzTodoForm(f *testing.F) {
+	const multipartType = "multipart/form-data; boundary=xyz"
+	f.Add(multipartType, []byte("--xyz\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nBuy milk\r\n--xyz--\r\n"))
+	f.Add(multipartType, []byte("--xyz\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nBuy milk\r\n"+
+		"--xyz\r\nContent-Disposition: form-data; name=\"images\"; filename=\"a.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n--xyz--\r\n"))
+	f.Add(multipartType, []byte("--xyz\r\nContent-Disposition: form-data; name=\"subtasks\"\r\n\r\n[{\"title\": \"a\"}]\r\n--xyz"))
+	f.Add("multipart/form-data", []byte("--xyz--"))
+	f.Add("application/json", []byte(`{"title": "Buy milk", "tags": ["errand"], "subtasks": [{"title": "Go"}], "due_at": "2026-01-02"}`))
+	f.Add("application/json", []byte(`{"title": null, "tags": [1]}`))
+	f.Add("application/x-www-form-urlencoded", []byte("title=Buy+milk&priority=high&tags=a,b"))
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		serveFuzzRequest(t, "POST", "/v1/todos", contentType, body)
+	})
+}
@@ -0,0 +1,93 @@
+package todo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// gcGracePeriod is how old an unreferenced upload must be before it is removed.
+const gcGracePeriod = time.Minute
+
+// gcResult summarizes a finished uploads garbage collection job.
+type gcResult struct {
+	Scanned int      `json:"scanned"`
+	Removed []string `json:"removed"`
+}
+
+// collectGarbage handles POST /admin/gc. It starts a background job that
+// deletes files in the uploads directories of all namespaces no todo refers
+// to anymore, such as attachments of deleted todos or attachments removed
+// or replaced by an update, once undo can't bring them back.
+func collectGarbage(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	job := startJob("gc", actorOf(ctx), sweepUploads)
+	respondJobStarted(ctx, job)
+}
+
+func sweepUploads(ctx context.Context, p *jobProgress) (interface{}, error) {
+	scopes := allNamespaces()
+	entries := make([][]os.DirEntry, len(scopes))
+	total := 0
+	for i, ns := range scopes {
+		list, err := os.ReadDir(ns.uploads)
+		// A tenant dropped since allNamespaces has no directory anymore.
+		if err != nil && !(ns != defaultNamespace && os.IsNotExist(err)) {
+			return nil, err
+		}
+		entries[i] = list
+		total += len(list)
+	}
+	p.setTotal(total)
+
+	result := gcResult{Removed: []string{}}
+	for i, ns := range scopes {
+		for _, entry := range entries[i] {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			p.advance(1)
+			if entry.IsDir() {
+				continue
+			}
+			result.Scanned++
+			filePath := filepath.Join(ns.uploads, entry.Name())
+			// Files saved moments ago may belong to a todo that is still
+			// being created, so leave them for the next sweep.
+			if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < gcGracePeriod {
+				continue
+			}
+			// Check references right before removing so files attached
+			// while the sweep is running are kept.
+			if isReferenced(ns, filePath) {
+				continue
+			}
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return result, err
+			}
+			result.Removed = append(result.Removed, filePath)
+		}
+	}
+	return result, nil
+}
+
+// isReferenced reports whether any todo of ns, whose uploads directory
+// holds the file at path, has the file attached, or could get it back by
+// undoing one of its undoDepth most recent changes.
+func isReferenced(ns *namespace, path string) bool {
+	found := false
+	ns.store.each(func(todo *Todo) bool {
+		for _, a := range todo.Attachments {
+			if a.Path == path {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found || ns.store.audit.restores(path, undoDepth)
+}
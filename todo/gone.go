@@ -0,0 +1,46 @@
+package todo
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// deletion returns the activity log entry that removed the todo id, if the
+// todo existed and its last recorded change removed it.
+func (l *auditLog) deletion(id int) (AuditEntry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	indexes := l.byTodo[id]
+	if len(indexes) == 0 {
+		return AuditEntry{}, false
+	}
+	last := l.entries[indexes[len(indexes)-1]]
+	return last, last.after == nil
+}
+
+// todoNotFound responds to a request for the missing todo id. Todos that
+// were deleted get 410 Gone, pointing to their history and to the undo
+// endpoint that restores them; IDs that never existed get 404 Not Found.
+func todoNotFound(ctx *fasthttp.RequestCtx, id int) {
+	entry, ok := namespaceOf(ctx).store.audit.deletion(id)
+	if !ok {
+		ctx.Error("Todo not found", fasthttp.StatusNotFound)
+		return
+	}
+	base := apiPrefix + "/todos/" + strconv.Itoa(id)
+	writeJSON(ctx, fasthttp.StatusGone, struct {
+		Error     string    `json:"error"`
+		DeletedAt time.Time `json:"deleted_at"`
+		DeletedBy string    `json:"deleted_by"`
+		History   string    `json:"history"`
+		Restore   string    `json:"restore,omitempty"`
+	}{
+		Error:     "Todo was deleted",
+		DeletedAt: entry.Time,
+		DeletedBy: entry.Actor,
+		History:   base + "/history",
+		Restore:   base + "/undo",
+	})
+}
@@ -0,0 +1,637 @@
+package todo
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes used by the server.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcResourceExhausted  = 8
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcMaxMessageSize is the largest request message accepted.
+const grpcMaxMessageSize = 4 << 20
+
+// grpcService is the full name of the service defined in proto/todo.proto.
+const grpcService = "todo.v1.TodoService"
+
+// grpcError is an error carrying a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcStoreError returns the status for a change the store refused, like
+// writeStoreError, or nil if err isn't such an error.
+func grpcStoreError(err error) error {
+	var quota *quotaError
+	var failed *storeError
+	switch {
+	case errors.As(err, &quota):
+		return grpcErrorf(grpcResourceExhausted, "%s", err)
+	case errors.Is(err, errVersionConflict):
+		return grpcErrorf(grpcAborted, "%s", err)
+	case errors.As(err, &failed):
+		return grpcErrorf(grpcUnavailable, "the change wasn't saved, try again later")
+	}
+	return nil
+}
+
+// grpcUnaryMethods implements the unary RPCs of the service. They get the
+// namespace, the caller and the encoded request, and return the encoded
+// response.
+var grpcUnaryMethods = map[string]func(ns *namespace, caller *principal, req []byte) ([]byte, error){
+	"ListTodos":  grpcListTodos,
+	"GetTodo":    grpcGetTodo,
+	"CreateTodo": grpcCreateTodo,
+	"UpdateTodo": grpcUpdateTodo,
+	"DeleteTodo": grpcDeleteTodo,
+}
+
+// grpcWrites are the methods that change todos. When access control is
+// enabled they need a key with the editor role, the others one with the
+// viewer role.
+var grpcWrites = map[string]bool{
+	"CreateTodo": true,
+	"UpdateTodo": true,
+	"DeleteTodo": true,
+}
+
+// serveGRPC runs the gRPC API on addr. gRPC needs HTTP/2; the server speaks
+// it over cleartext TCP (h2c), the way gRPC clients connect without TLS.
+// It returns nil once ctx is done.
+func serveGRPC(ctx context.Context, addr string) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   http.HandlerFunc(handleGRPC),
+		Protocols: &protocols,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// handleGRPC dispatches a gRPC call to its method.
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != "POST" || (contentType != "application/grpc" && contentType != "application/grpc+proto") {
+		http.Error(w, "Only gRPC requests with protocol buffers are served on this port", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	err := func() error {
+		if service != grpcService {
+			return grpcErrorf(grpcUnimplemented, "unknown service %s", service)
+		}
+		req, err := readGRPCMessage(r.Body)
+		if err != nil {
+			return err
+		}
+		if primary := replicaPrimary(); grpcWrites[method] && primary != "" {
+			return grpcErrorf(grpcUnavailable, "read-only replica, send writes to the primary at %s", primary)
+		}
+		if grpcWrites[method] && readOnly() {
+			return grpcErrorf(grpcUnavailable, "the cluster has no leader right now, retry shortly")
+		}
+		// Without API keys the caller is anonymous and may do everything.
+		caller, ok := grpcCaller(r)
+		if !ok {
+			return grpcErrorf(grpcUnauthenticated, "missing or invalid API key")
+		}
+		need := roleViewer
+		if grpcWrites[method] {
+			need = roleEditor
+		}
+		if caller.role < need {
+			return grpcErrorf(grpcPermissionDenied, "%s needs the %s role, the key has the %s role", method, need, caller.role)
+		}
+		ns, err := grpcNamespace(r, caller)
+		if err != nil {
+			return err
+		}
+		if method == "WatchTodos" {
+			return grpcWatchTodos(w, r, ns, caller, req)
+		}
+		fn, ok := grpcUnaryMethods[method]
+		if !ok {
+			return grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+		}
+		resp, err := fn(ns, caller, req)
+		if err != nil {
+			return err
+		}
+		return writeGRPCMessage(w, resp)
+	}()
+	writeGRPCStatus(w, err)
+}
+
+// grpcCaller returns the caller identified by the API key sent in the
+// authorization or x-api-key metadata.
+func grpcCaller(r *http.Request) (*principal, bool) {
+	key := r.Header.Get("X-Api-Key")
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key == "" {
+		key = token
+	}
+	return principalFor(key)
+}
+
+// grpcNamespace returns the namespace of the tenant named in the
+// x-tenant-id metadata, like the X-Tenant-ID header of the HTTP API, or the
+// default namespace without one. Unknown tenants, and tenants the caller's
+// key doesn't grant, get NOT_FOUND.
+func grpcNamespace(r *http.Request, caller *principal) (*namespace, error) {
+	id := r.Header.Get("X-Tenant-Id")
+	if id == "" {
+		return defaultNamespace, nil
+	}
+	namespacesMu.RLock()
+	ns, ok := namespaces[id]
+	namespacesMu.RUnlock()
+	if !ok || !caller.inTenant(id) {
+		return nil, grpcErrorf(grpcNotFound, "unknown tenant %s", id)
+	}
+	return ns, nil
+}
+
+// grpcPermission returns the permission the caller has on the todo of ns
+// with the given ID, responding to callers that may not see it as if it
+// didn't exist, and to those with a lower permission than need with
+// PERMISSION_DENIED.
+func grpcPermission(ns *namespace, caller *principal, id int, need permission) error {
+	todo, ok := ns.store.get(id)
+	if !ok {
+		return grpcErrorf(grpcNotFound, "todo %d not found", id)
+	}
+	switch perm := ns.permission(caller, &todo); {
+	case perm == permNone:
+		return grpcErrorf(grpcNotFound, "todo %d not found", id)
+	case perm < need:
+		return grpcErrorf(grpcPermissionDenied, "the caller may not change todo %d", id)
+	}
+	return nil
+}
+
+// readGRPCMessage reads one length-prefixed message of a gRPC request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessageSize {
+		return nil, grpcErrorf(grpcResourceExhausted, "request message larger than %d bytes", grpcMaxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes one length-prefixed message and flushes it to the
+// client.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := w.Write(append(frame, msg...)); err != nil {
+		return grpcErrorf(grpcUnavailable, "%s", err)
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// writeGRPCStatus sends the status of the call in the grpc-status and
+// grpc-message trailers.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code, msg = gerr.code, gerr.msg
+		} else {
+			code, msg = grpcInternal, err.Error()
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", percentEncode(msg))
+	}
+}
+
+// percentEncode escapes a grpc-message value as the gRPC protocol requires.
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// decodeIDRequest decodes a request whose only field is an int64 ID.
+func decodeIDRequest(req []byte) (int, error) {
+	var id int64
+	err := decodeFields(req, func(num, typ int, r *protoReader) (bool, error) {
+		if num != 1 {
+			return false, nil
+		}
+		var err error
+		id, err = readInt(typ, r)
+		return true, err
+	})
+	if err != nil {
+		return 0, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return int(id), nil
+}
+
+// grpcTodoResponse encodes the todo whose JSON encoding is raw.
+func grpcTodoResponse(raw []byte) ([]byte, error) {
+	var todo Todo
+	if err := json.Unmarshal(raw, &todo); err != nil {
+		return nil, err
+	}
+	return appendTodoProto(nil, &todo), nil
+}
+
+func grpcListTodos(ns *namespace, caller *principal, req []byte) ([]byte, error) {
+	var pageSize int64
+	var pageToken string
+	err := decodeFields(req, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		switch num {
+		case 1:
+			pageSize, err = readInt(typ, r)
+		case 2:
+			pageToken, err = readString(typ, r)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+
+	visible := func(todo *Todo) bool {
+		return ns.permission(caller, todo) != permNone
+	}
+	var resp []byte
+	if pageSize == 0 && pageToken == "" {
+		for _, todo := range ns.store.listedTodos(visible) {
+			resp = appendMessageField(resp, 1, appendTodoProto(nil, &todo))
+		}
+		return resp, nil
+	}
+	if pageSize < 0 || pageSize > maxPageSize {
+		return nil, grpcErrorf(grpcInvalidArgument, "page_size must be from 1 to %d", maxPageSize)
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	after := 0
+	if pageToken != "" {
+		if after, err = decodeCursor(pageToken); err != nil {
+			return nil, grpcErrorf(grpcInvalidArgument, "invalid page_token")
+		}
+	}
+	raws, next := ns.store.rawPage(visible, after, int(pageSize))
+	for _, raw := range raws {
+		var todo Todo
+		if err := json.Unmarshal(raw, &todo); err != nil {
+			return nil, err
+		}
+		resp = appendMessageField(resp, 1, appendTodoProto(nil, &todo))
+	}
+	return appendStringField(resp, 2, next), nil
+}
+
+func grpcGetTodo(ns *namespace, caller *principal, req []byte) ([]byte, error) {
+	id, err := decodeIDRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	todo, ok := ns.store.get(id)
+	if !ok || ns.permission(caller, &todo) == permNone {
+		return nil, grpcErrorf(grpcNotFound, "todo %d not found", id)
+	}
+	return appendTodoProto(nil, &todo), nil
+}
+
+// decodeTodoRequest decodes the todo (field 1) and, for updates, the paths
+// of the update mask (field 2) of a request.
+func decodeTodoRequest(req []byte) (*Todo, []string, error) {
+	todo := &Todo{}
+	var paths []string
+	err := decodeFields(req, func(num, typ int, r *protoReader) (bool, error) {
+		switch num {
+		case 1:
+			msg, err := readMessage(typ, r)
+			if err == nil {
+				todo, err = decodeTodoProto(msg)
+			}
+			return true, err
+		case 2:
+			msg, err := readMessage(typ, r)
+			if err != nil {
+				return true, err
+			}
+			return true, decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+				if num != 1 {
+					return false, nil
+				}
+				path, err := readString(typ, r)
+				paths = append(paths, path)
+				return true, err
+			})
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return todo, paths, nil
+}
+
+// validateTodoFields checks the writable fields of a todo sent over gRPC.
+func validateTodoFields(todo *Todo) error {
+	if !validPriority(todo.Priority) {
+		return grpcErrorf(grpcInvalidArgument, "invalid priority %q", todo.Priority)
+	}
+	if err := validateRecurrence(todo.Recurrence); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if todo.Status != "" && !validStatus(todo.Status) {
+		return grpcErrorf(grpcInvalidArgument, "invalid status %q", todo.Status)
+	}
+	if errs := normalizeSubtasks(todo.Subtasks); len(errs) > 0 {
+		return grpcErrorf(grpcInvalidArgument, "%s %s", errs[0].Field, errs[0].Message)
+	}
+	return nil
+}
+
+func grpcCreateTodo(ns *namespace, caller *principal, req []byte) ([]byte, error) {
+	in, _, err := decodeTodoRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTodoFields(in); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	todo := &Todo{
+		Title:       in.Title,
+		Description: in.Description,
+		Subtasks:    in.Subtasks,
+		Priority:    in.Priority,
+		Project:     in.Project,
+		Tags:        in.Tags,
+		Assignee:    in.Assignee,
+		DueAt:       in.DueAt,
+		RemindAt:    in.RemindAt,
+		ExpiresAt:   in.ExpiresAt,
+		Recurrence:  in.Recurrence,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if errs := validateTodo(todo); len(errs) > 0 {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s %s", errs[0].Field, errs[0].Message)
+	}
+	switch {
+	case in.Status != "":
+		setStatus(todo, in.Status)
+	case in.Completed:
+		completeBySubtasks(todo)
+		setCompleted(todo, true)
+	default:
+		completeBySubtasks(todo)
+	}
+	raw, err := ns.addTodo(caller.name, todo)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	return grpcTodoResponse(raw)
+}
+
+// grpcUpdatableFields are the update mask paths UpdateTodo accepts.
+var grpcUpdatableFields = []string{
+	"title", "description", "priority", "project", "tags", "assignee",
+	"due_at", "remind_at", "expires_at", "recurrence", "subtasks", "status",
+	"completed",
+}
+
+func grpcUpdateTodo(ns *namespace, caller *principal, req []byte) ([]byte, error) {
+	in, paths, err := decodeTodoRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTodoFields(in); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		paths = grpcUpdatableFields
+	}
+	for _, path := range paths {
+		if !containsString(grpcUpdatableFields, path) {
+			return nil, grpcErrorf(grpcInvalidArgument, "field %q cannot be updated", path)
+		}
+	}
+
+	raw, ok, err := ns.changeTodo(caller.name, in.ID, func(todo *Todo) error {
+		switch perm := ns.permission(caller, todo); {
+		case perm == permNone:
+			return grpcErrorf(grpcNotFound, "todo %d not found", in.ID)
+		case perm < permEditor:
+			return grpcErrorf(grpcPermissionDenied, "the caller may not change todo %d", in.ID)
+		}
+		if containsString(paths, "subtasks") {
+			if err := assignSubtaskIDs(todo, in.Subtasks); err != nil {
+				return err
+			}
+		}
+		for _, path := range paths {
+			switch path {
+			case "title":
+				todo.Title = in.Title
+			case "description":
+				todo.Description = in.Description
+			case "priority":
+				todo.Priority = in.Priority
+			case "project":
+				todo.Project = in.Project
+			case "tags":
+				todo.Tags = in.Tags
+			case "assignee":
+				todo.Assignee = in.Assignee
+			case "due_at":
+				todo.DueAt = in.DueAt
+			case "remind_at":
+				todo.RemindAt = in.RemindAt
+			case "expires_at":
+				todo.ExpiresAt = in.ExpiresAt
+			case "recurrence":
+				todo.Recurrence = in.Recurrence
+			case "subtasks":
+				todo.Subtasks = in.Subtasks
+			}
+		}
+		// The status goes last so it wins over the completed flag, which
+		// wins over completion by subtasks, like in PUT /todos/{id}. The
+		// status can't be cleared, so an empty one is left alone.
+		switch {
+		case containsString(paths, "status") && in.Status != "":
+			if err := setStatus(todo, in.Status); err != nil {
+				return err
+			}
+		case containsString(paths, "completed"):
+			completeBySubtasks(todo)
+			if err := setCompleted(todo, in.Completed); err != nil {
+				return err
+			}
+		case containsString(paths, "subtasks"):
+			completeBySubtasks(todo)
+		}
+		if errs := validateTodo(todo); len(errs) > 0 {
+			return &validationError{"Invalid todo", errs}
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	var statusErr *statusError
+	var gerr *grpcError
+	switch {
+	case !ok:
+		return nil, grpcErrorf(grpcNotFound, "todo %d not found", in.ID)
+	case errors.As(err, &gerr):
+		return nil, err
+	case grpcStoreError(err) != nil:
+		return nil, grpcStoreError(err)
+	case errors.As(err, &statusErr):
+		return nil, grpcErrorf(grpcFailedPrecondition, "%s", err)
+	case err != nil:
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return grpcTodoResponse(raw)
+}
+
+func grpcDeleteTodo(ns *namespace, caller *principal, req []byte) ([]byte, error) {
+	id, err := decodeIDRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcPermission(ns, caller, id, permOwner); err != nil {
+		return nil, err
+	}
+	removed, err := ns.removeTodo(caller.name, id)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	if !removed {
+		return nil, grpcErrorf(grpcNotFound, "todo %d not found", id)
+	}
+	return nil, nil
+}
+
+// grpcWatchTodos streams a TodoEvent for every event of a todo of ns the
+// caller may see until the client goes away. Clients that fall too far behind get
+// an UNAVAILABLE status and have to call again.
+func grpcWatchTodos(w http.ResponseWriter, r *http.Request, ns *namespace, caller *principal, req []byte) error {
+	var types []string
+	err := decodeFields(req, func(num, typ int, r *protoReader) (bool, error) {
+		if num != 1 {
+			return false, nil
+		}
+		t, err := readString(typ, r)
+		types = append(types, t)
+		return true, err
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+
+	events, stop := watchEvents()
+	defer stop()
+	// Send the response headers right away so the client knows the stream
+	// is established.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return grpcErrorf(grpcUnavailable, "too far behind the event stream")
+			}
+			if e.TodoID == 0 || e.namespace() != ns || (len(types) > 0 && !containsString(types, e.Type)) {
+				continue
+			}
+			// Deleted todos are checked as they were before their deletion.
+			todo, ok := ns.store.get(e.TodoID)
+			if !ok {
+				raw := ns.store.audit.last(e.TodoID)
+				if raw == nil || json.Unmarshal(raw, &todo) != nil {
+					continue
+				}
+			}
+			if ns.permission(caller, &todo) == permNone {
+				continue
+			}
+			var msg []byte
+			msg = appendStringField(msg, 1, e.Type)
+			msg = appendIntField(msg, 2, int64(e.TodoID))
+			msg = appendTimestampField(msg, 3, &e.Time)
+			if ok && e.Type != "todo.deleted" {
+				msg = appendMessageField(msg, 4, appendTodoProto(nil, &todo))
+			}
+			if err := writeGRPCMessage(w, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package todo
+
+import (
+	"context"
+
+	"github.com/valyala/fasthttp"
+)
+
+// backendPinger is implemented by backends that can check their connection.
+type backendPinger interface {
+	ping(ctx context.Context) error
+}
+
+// getHealth handles GET /health for load balancers and orchestrators: 200
+// if the server can serve requests, 503 if the backend holding the todos
+// is unreachable. The in-memory store is always healthy.
+func getHealth(ctx *fasthttp.RequestCtx) {
+	health := map[string]interface{}{
+		"status":  "ok",
+		"storage": storageBackend,
+	}
+	status := fasthttp.StatusOK
+	if p, ok := store.backend.(backendPinger); ok {
+		if err := p.ping(ctx); err != nil {
+			health["status"] = "unavailable"
+			health["error"] = err.Error()
+			status = fasthttp.StatusServiceUnavailable
+		}
+	}
+	writeJSON(ctx, status, health)
+}
@@ -0,0 +1,363 @@
+package todo
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// htmxFiles holds the templates of the server-rendered UI.
+//
+//go:embed htmx/*.html
+var htmxFiles embed.FS
+
+var htmxTemplates = template.Must(template.ParseFS(htmxFiles, "htmx/*.html"))
+
+// uiMode is the web UI served, see Config.WebUI, and htmxURL where the
+// pages of the server-rendered UI load htmx from.
+var (
+	uiMode  = "spa"
+	htmxURL string
+)
+
+// uiKeyCookie holds the API key of a user logged in to the server-rendered
+// UI. It is only sent to /ui/, see callerKey.
+const uiKeyCookie = "todo_ui_key"
+
+// uiListLimit is the most todos the server-rendered UI lists at once.
+const uiListLimit = 100
+
+// uiTodo is a todo as rendered in the list, with what the caller may do
+// with it.
+type uiTodo struct {
+	Todo
+	Editor, Owner bool
+}
+
+// uiList is the list of todos, the fragment swapped in by the filter.
+type uiList struct {
+	Todos []uiTodo
+	// More is the number of matching todos left out, see uiListLimit.
+	More int
+}
+
+type uiPage struct {
+	HTMXURL string
+	// User is the name of the logged in user, empty without API keys.
+	User     string
+	Query    string
+	ShowDone bool
+	// Editor tells whether the user may add todos.
+	Editor bool
+	List   uiList
+}
+
+// routeUI routes requests for the server-rendered UI under /ui/. Pages are
+// rendered whole for browsers and as fragments for the requests htmx makes
+// from them, see isHTMXRequest.
+func routeUI(ctx *fasthttp.RequestCtx, method, path string) {
+	if uiMode != "htmx" {
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+		return
+	}
+	switch path {
+	case "/ui/login":
+		switch method {
+		case "GET":
+			renderUI(ctx, fasthttp.StatusOK, "login", "")
+		case "POST":
+			uiLogin(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	case "/ui/logout":
+		if method == "POST" {
+			setUIKeyCookie(ctx, "")
+			ctx.Redirect("/ui/login", fasthttp.StatusSeeOther)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	caller, ok := uiCaller(ctx)
+	if !ok {
+		return
+	}
+	if path == "/ui/todos" {
+		switch method {
+		case "GET":
+			uiListTodos(ctx, caller)
+		case "POST":
+			uiAddTodo(ctx, caller)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+	idStr, sub, _ := strings.Cut(strings.TrimPrefix(path, "/ui/todos/"), "/")
+	id, err := strconv.Atoi(idStr)
+	if !strings.HasPrefix(path, "/ui/todos/") || err != nil {
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+		return
+	}
+	switch {
+	case sub == "toggle" && method == "POST":
+		uiToggleTodo(ctx, caller, id)
+	case sub == "" && method == "DELETE":
+		uiDeleteTodo(ctx, caller, id)
+	case sub == "toggle" || sub == "":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	default:
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+	}
+}
+
+// isHTMXRequest reports whether htmx sent the request to swap in a
+// fragment, rather than a browser loading the page.
+func isHTMXRequest(ctx *fasthttp.RequestCtx) bool {
+	return string(ctx.Request.Header.Peek("HX-Request")) == "true" &&
+		len(ctx.Request.Header.Peek("HX-History-Restore-Request")) == 0
+}
+
+// renderUI responds with the template name executed with data.
+func renderUI(ctx *fasthttp.RequestCtx, status int, name string, data interface{}) {
+	var b bytes.Buffer
+	if err := htmxTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.Response.Header.Add("Vary", "HX-Request")
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(status)
+	ctx.SetBody(b.Bytes())
+}
+
+// uiError responds with an error message, which htmx shows in the error
+// line of the page instead of swapping it into the request's target.
+func uiError(ctx *fasthttp.RequestCtx, status int, msg string) {
+	ctx.Response.Header.Set("HX-Retarget", "#error")
+	ctx.Response.Header.Set("HX-Reswap", "innerHTML")
+	renderUI(ctx, status, "error", msg)
+}
+
+// uiCaller returns the logged in user, sending them to the login page if
+// there is none.
+func uiCaller(ctx *fasthttp.RequestCtx) (*principal, bool) {
+	caller, ok := authenticate(ctx)
+	switch {
+	case ok:
+		return caller, true
+	case isHTMXRequest(ctx):
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		ctx.Response.Header.Set("HX-Redirect", "/ui/login")
+	default:
+		ctx.Redirect("/ui/login", fasthttp.StatusSeeOther)
+	}
+	return nil, false
+}
+
+// uiLogin handles POST /ui/login, keeping a valid API key in a cookie.
+func uiLogin(ctx *fasthttp.RequestCtx) {
+	key := string(ctx.PostArgs().Peek("key"))
+	if _, ok := principalFor(key); !ok || len(apiKeys) == 0 {
+		renderUI(ctx, fasthttp.StatusUnauthorized, "login", "Unknown API key.")
+		return
+	}
+	setUIKeyCookie(ctx, key)
+	ctx.Redirect("/ui/todos", fasthttp.StatusSeeOther)
+}
+
+// setUIKeyCookie sets the key cookie of the server-rendered UI, or removes
+// it if key is empty. It is strictly same-site, so other sites can't make
+// browsers send requests with it.
+func setUIKeyCookie(ctx *fasthttp.RequestCtx, key string) {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(uiKeyCookie)
+	cookie.SetValue(key)
+	cookie.SetPath("/ui/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(ctx.IsTLS())
+	cookie.SetSameSite(fasthttp.CookieSameSiteStrictMode)
+	if key == "" {
+		cookie.SetExpire(fasthttp.CookieExpireDelete)
+	}
+	ctx.Response.Header.SetCookie(cookie)
+}
+
+// uiTodoFor returns the todo as rendered for the caller.
+func uiTodoFor(ctx *fasthttp.RequestCtx, caller *principal, todo Todo) uiTodo {
+	perm := namespaceOf(ctx).permission(caller, &todo)
+	editor := len(apiKeys) == 0 || caller.role >= roleEditor
+	return uiTodo{Todo: todo, Editor: editor && perm >= permEditor, Owner: editor && perm == permOwner}
+}
+
+// uiListTodos handles GET /ui/todos, listing the todos the caller may see,
+// newest first. q filters them by title, description, project and tags,
+// and done=true includes completed ones.
+func uiListTodos(ctx *fasthttp.RequestCtx, caller *principal) {
+	args := ctx.QueryArgs()
+	query := strings.TrimSpace(string(args.Peek("q")))
+	showDone := args.GetBool("done")
+	needle := strings.ToLower(query)
+	ns := namespaceOf(ctx)
+	var todos []Todo
+	ns.store.listed(func(todo *Todo) bool {
+		if todo.Completed && !showDone || ns.permission(caller, todo) == permNone {
+			return true
+		}
+		text := strings.ToLower(strings.Join(append([]string{todo.Title, todo.Description, todo.Project}, todo.Tags...), " "))
+		if strings.Contains(text, needle) {
+			todos = append(todos, todo.clone())
+		}
+		return true
+	})
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID > todos[j].ID })
+
+	var list uiList
+	if len(todos) > uiListLimit {
+		list.More = len(todos) - uiListLimit
+		todos = todos[:uiListLimit]
+	}
+	for _, todo := range todos {
+		list.Todos = append(list.Todos, uiTodoFor(ctx, caller, todo))
+	}
+	if isHTMXRequest(ctx) {
+		renderUI(ctx, fasthttp.StatusOK, "list", list)
+		return
+	}
+	page := uiPage{
+		HTMXURL:  htmxURL,
+		Query:    query,
+		ShowDone: showDone,
+		Editor:   len(apiKeys) == 0 || caller.role >= roleEditor,
+		List:     list,
+	}
+	if len(apiKeys) > 0 {
+		page.User = caller.name
+	}
+	renderUI(ctx, fasthttp.StatusOK, "page", page)
+}
+
+// uiAddTodo handles POST /ui/todos, creating a todo with the title sent in
+// the form and responding with its list item.
+func uiAddTodo(ctx *fasthttp.RequestCtx, caller *principal) {
+	if len(apiKeys) > 0 && (caller.role < roleEditor || !caller.canSee("")) {
+		uiError(ctx, fasthttp.StatusForbidden, "You may not add todos here.")
+		return
+	}
+	now := time.Now()
+	todo := &Todo{Title: strings.TrimSpace(string(ctx.PostArgs().Peek("title"))), CreatedAt: now, UpdatedAt: now}
+	if errs := validateTodo(todo); len(errs) > 0 {
+		uiError(ctx, fasthttp.StatusUnprocessableEntity, "Invalid todo: "+errs[0].Field+" "+errs[0].Message)
+		return
+	}
+	if rejected, _ := checkSoftRules(nil, todo); len(rejected) > 0 {
+		uiError(ctx, fasthttp.StatusUnprocessableEntity, "Rejected: "+rejected[0].Field+" "+rejected[0].Message)
+		return
+	}
+	raw, err := namespaceOf(ctx).addTodo(actorOf(ctx), todo)
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		uiError(ctx, fasthttp.StatusForbidden, "Todo quota exceeded: "+err.Error()+".")
+		return
+	} else if err != nil {
+		uiError(ctx, fasthttp.StatusServiceUnavailable, "The todo couldn't be saved, try again.")
+		return
+	}
+	uiRenderTodo(ctx, caller, raw)
+}
+
+// uiRenderTodo responds with the list item of the todo encoded in raw.
+func uiRenderTodo(ctx *fasthttp.RequestCtx, caller *principal, raw []byte) {
+	var todo Todo
+	if err := json.Unmarshal(raw, &todo); err != nil {
+		uiError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		return
+	}
+	renderUI(ctx, fasthttp.StatusOK, "todo", uiTodoFor(ctx, caller, todo))
+}
+
+// uiToggleTodo handles POST /ui/todos/{id}/toggle like toggleTodo,
+// responding with the todo's new list item.
+func uiToggleTodo(ctx *fasthttp.RequestCtx, caller *principal, id int) {
+	ns := namespaceOf(ctx)
+	raw, ok, err := ns.changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		if ns.permission(caller, todo) == permNone {
+			return errNotVisible
+		}
+		if !uiTodoFor(ctx, caller, *todo).Editor {
+			return errReadOnly
+		}
+		completed := !todo.Completed
+		status := statusInProgress
+		if completed {
+			status = statusDone
+		}
+		if err := setStatus(todo, status); err != nil {
+			return err
+		}
+		for i := range todo.Subtasks {
+			todo.Subtasks[i].Completed = completed
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	var failed *storeError
+	switch {
+	case !ok || err == errNotVisible:
+		uiError(ctx, fasthttp.StatusNotFound, "That todo no longer exists.")
+	case err == errReadOnly:
+		uiError(ctx, fasthttp.StatusForbidden, "You may not change this todo.")
+	case errors.Is(err, errVersionConflict):
+		uiError(ctx, fasthttp.StatusConflict, "The todo was changed elsewhere, try again.")
+	case errors.As(err, &failed):
+		uiError(ctx, fasthttp.StatusServiceUnavailable, "The todo couldn't be saved, try again.")
+	case err != nil:
+		uiError(ctx, fasthttp.StatusConflict, err.Error())
+	default:
+		uiRenderTodo(ctx, caller, raw)
+	}
+}
+
+// errReadOnly rejects changes to todos the user may only see.
+var errReadOnly = errors.New("todo is read-only")
+
+// uiDeleteTodo handles DELETE /ui/todos/{id}, responding with nothing to
+// remove the todo's list item.
+func uiDeleteTodo(ctx *fasthttp.RequestCtx, caller *principal, id int) {
+	ns := namespaceOf(ctx)
+	todo, ok := ns.store.get(id)
+	switch {
+	case ok && ns.permission(caller, &todo) == permNone:
+		ok = false
+	case ok && !uiTodoFor(ctx, caller, todo).Owner:
+		uiError(ctx, fasthttp.StatusForbidden, "You may not delete this todo.")
+		return
+	case ok:
+		var err error
+		if ok, err = ns.removeTodo(actorOf(ctx), id); errors.Is(err, errVersionConflict) {
+			uiError(ctx, fasthttp.StatusConflict, "The todo was changed elsewhere, try again.")
+			return
+		} else if err != nil {
+			uiError(ctx, fasthttp.StatusServiceUnavailable, "The todo couldn't be deleted, try again.")
+			return
+		}
+	}
+	if !ok {
+		uiError(ctx, fasthttp.StatusNotFound, "That todo no longer exists.")
+		return
+	}
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
@@ -0,0 +1,114 @@
+package todo
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// http2SkippedHeaders are response headers of fasthttp that net/http sets
+// itself or that HTTP/2 forbids.
+var http2SkippedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+	"Date":              true,
+}
+
+// serveHTTP2 serves handler, the same API as the fasthttp server, over
+// HTTP/2 on addr, for clients multiplexing many small requests over one
+// connection. fasthttp only speaks HTTP/1.1, so this listener is a net/http
+// server passing each request on to handler. It speaks HTTP/2 over TLS
+// when cfg has a certificate and cleartext HTTP/2 with prior knowledge
+// (h2c) otherwise; HTTP/1.1 clients are served too. It returns nil once
+// ctx is done.
+func serveHTTP2(ctx context.Context, cfg Config, handler fasthttp.RequestHandler) error {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.HTTP2Cert == "")
+	srv := &http.Server{
+		Addr:         cfg.HTTP2Addr,
+		Handler:      fasthttpBridge(handler, cfg.MaxBodySize),
+		Protocols:    &protocols,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	var err error
+	if cfg.HTTP2Cert != "" {
+		err = srv.ListenAndServeTLS(cfg.HTTP2Cert, cfg.HTTP2Key)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// fasthttpBridge returns a net/http handler serving requests with the
+// fasthttp handler h. Request bodies larger than maxBodySize are rejected
+// like the fasthttp server does.
+func fasthttpBridge(h fasthttp.RequestHandler, maxBodySize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx fasthttp.RequestCtx
+		remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		ctx.Init(&fasthttp.Request{}, remote, nil)
+		defer ctx.Response.CloseBodyStream()
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)+1))
+		switch {
+		case len(body) > maxBodySize:
+			writeRequestError(&ctx, fasthttp.StatusRequestEntityTooLarge, "Request body too large",
+				"the body must not exceed "+strconv.Itoa(maxBodySize)+" bytes")
+		case err != nil:
+			writeRequestError(&ctx, fasthttp.StatusBadRequest, "Malformed request",
+				"the request body could not be read")
+		default:
+			req := &ctx.Request
+			req.Header.SetMethod(r.Method)
+			req.SetRequestURI(r.URL.RequestURI())
+			req.Header.SetHost(r.Host)
+			for name, values := range r.Header {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			req.SetBody(body)
+			h(&ctx)
+		}
+
+		ctx.Response.Header.VisitAll(func(name, value []byte) {
+			if !http2SkippedHeaders[string(name)] {
+				w.Header().Add(string(name), string(value))
+			}
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		if r.Method != "HEAD" {
+			ctx.Response.BodyWriteTo(flushWriter{w})
+		}
+	})
+}
+
+// flushWriter flushes every write to the client, so streamed bodies such
+// as NDJSON lists arrive as they are produced.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = http.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
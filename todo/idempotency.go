@@ -0,0 +1,106 @@
+package todo
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted.
+const maxIdempotencyKey = 255
+
+// idempotencyWindow is how long responses are kept for replay; zero
+// disables Idempotency-Key handling.
+var idempotencyWindow = 24 * time.Hour
+
+// idempotentResponse is the response to the first request with a key.
+type idempotentResponse struct {
+	// fingerprint identifies the request body, so reusing a key for a
+	// different request can be told from a retry.
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var (
+	idempotencyMu        sync.Mutex
+	idempotencyResponses = make(map[string]*idempotentResponse)
+	idempotencySwept     time.Time
+)
+
+// idempotent runs h unless the request carries an Idempotency-Key that was
+// seen before within idempotencyWindow, in which case the response of the
+// first request is sent again with an Idempotent-Replayed header. Keys are
+// scoped to the caller. Reusing a key with a different body is rejected
+// with 422, and retrying while the first request is still running with 409.
+func idempotent(ctx *fasthttp.RequestCtx, h fasthttp.RequestHandler) {
+	key := string(ctx.Request.Header.Peek("Idempotency-Key"))
+	if key == "" || idempotencyWindow <= 0 {
+		h(ctx)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid Idempotency-Key",
+			"use a unique value of at most 255 characters, such as a UUID, per logical request")
+		return
+	}
+	key = namespaceOf(ctx).id + "\x00" + actorOf(ctx) + "\x00" + key
+	fingerprint := sha256.Sum256(append(append([]byte(nil), ctx.Request.Header.ContentType()...), ctx.PostBody()...))
+
+	now := time.Now()
+	idempotencyMu.Lock()
+	if now.Sub(idempotencySwept) > time.Minute {
+		for k, r := range idempotencyResponses {
+			if r.done && now.After(r.expires) {
+				delete(idempotencyResponses, k)
+			}
+		}
+		idempotencySwept = now
+	}
+	prev, ok := idempotencyResponses[key]
+	if ok && (!prev.done || now.Before(prev.expires)) {
+		idempotencyMu.Unlock()
+		switch {
+		case prev.fingerprint != fingerprint:
+			writeRequestError(ctx, fasthttp.StatusUnprocessableEntity, "Idempotency-Key reused with a different request",
+				"send a new Idempotency-Key for every new request")
+		case !prev.done:
+			writeRequestError(ctx, fasthttp.StatusConflict, "A request with this Idempotency-Key is in progress",
+				"wait for the first request to finish, then retry")
+		default:
+			ctx.Response.Header.Set("Idempotent-Replayed", "true")
+			ctx.SetContentType(prev.contentType)
+			ctx.SetStatusCode(prev.status)
+			ctx.SetBody(prev.body)
+		}
+		return
+	}
+	entry := &idempotentResponse{fingerprint: fingerprint}
+	idempotencyResponses[key] = entry
+	idempotencyMu.Unlock()
+
+	finished := false
+	defer func() {
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+		// Server errors may be transient, and a panicking handler sent no
+		// response at all, so a retry should run again rather than find the
+		// key in progress forever.
+		if status := ctx.Response.StatusCode(); !finished || status >= 500 {
+			delete(idempotencyResponses, key)
+			return
+		}
+		entry.done = true
+		entry.status = ctx.Response.StatusCode()
+		entry.contentType = string(ctx.Response.Header.ContentType())
+		entry.body = append([]byte(nil), ctx.Response.Body()...)
+		entry.expires = time.Now().Add(idempotencyWindow)
+	}()
+	h(ctx)
+	finished = true
+}
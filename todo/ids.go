@@ -0,0 +1,120 @@
+package todo
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// IDGenerator hands out the IDs of new todos. NextID must be safe for
+// concurrent use and never return the same positive ID twice, including
+// across the servers sharing a backend.
+type IDGenerator interface {
+	NextID() (int, error)
+}
+
+// idFormat picks the ID generator of every store, see newIDGenerator and
+// -id-format. It is set once at startup.
+var idFormat = "int"
+
+// newIDGenerator returns the ID generator of s for idFormat: sequential
+// IDs for "int", snowflake IDs for "snowflake", and sequential IDs with a
+// UUID for "uuid".
+func newIDGenerator(s *todoStore) IDGenerator {
+	switch idFormat {
+	case "snowflake":
+		return snowflakes
+	case "uuid":
+		return uuidIDs{sequentialIDs{s}}
+	}
+	return sequentialIDs{s}
+}
+
+// newID returns a fresh todo ID from the store's generator, falling back
+// to the store's own counter if the generator fails. IDs the backend
+// fails to reserve can't be replaced that way, since other instances may
+// hand them out too; newID returns the storeError then.
+func (s *todoStore) newID() (int, error) {
+	id, err := s.idGen.NextID()
+	var failed *storeError
+	if errors.As(err, &failed) {
+		return 0, err
+	}
+	if err != nil {
+		log.Printf("Error generating a todo ID: %s", err)
+		return int(s.nextID.Add(1) - 1), nil
+	}
+	return id, nil
+}
+
+// sequentialIDs numbers the todos of a store 1, 2, 3 and so on. With a
+// backend, IDs are reserved there so they are unique across all instances
+// sharing it.
+type sequentialIDs struct {
+	s *todoStore
+}
+
+func (g sequentialIDs) NextID() (int, error) {
+	if g.s.backend != nil {
+		id, err := g.s.backend.nextID()
+		if err != nil {
+			backendFailed("reserving an ID", err)
+			return 0, &storeError{op: "reserving an ID", err: err}
+		}
+		g.s.reserve(id)
+		return id, nil
+	}
+	return int(g.s.nextID.Add(1) - 1), nil
+}
+
+// Layout of snowflake IDs: milliseconds since snowflakeEpoch, followed by
+// the node number and a sequence number counting the IDs of a millisecond.
+// They fit in 53 bits, so JavaScript numbers hold them exactly: the 41
+// bits left for the time last until 2093.
+const (
+	snowflakeNodeBits  = 10
+	snowflakeSeqBits   = 2
+	snowflakeTimeShift = snowflakeNodeBits + snowflakeSeqBits
+	maxSnowflakeNode   = 1<<snowflakeNodeBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflakeIDs generates IDs that are unique across instances with
+// different node numbers without coordinating with each other, and that
+// sort by creation time. If the clock goes back, or more IDs are needed in
+// a millisecond than the sequence number holds, IDs continue from the last
+// one rather than waiting.
+type snowflakeIDs struct {
+	mu   sync.Mutex
+	node int64
+	// last is the millisecond of the last ID, seq its sequence number.
+	last int64
+	seq  int64
+}
+
+// snowflakes generates the IDs of all stores with -id-format snowflake.
+// Its node is set once at startup, see -id-node.
+var snowflakes = &snowflakeIDs{}
+
+func (g *snowflakeIDs) NextID() (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Since(snowflakeEpoch).Milliseconds()
+	switch {
+	case now > g.last:
+		g.last, g.seq = now, 0
+	case g.seq < 1<<snowflakeSeqBits-1:
+		g.seq++
+	default:
+		g.last, g.seq = g.last+1, 0
+	}
+	return int(g.last<<snowflakeTimeShift | g.node<<snowflakeSeqBits | g.seq), nil
+}
+
+// uuidIDs numbers todos like the wrapped generator and gives them a UUID
+// too, see identify.
+type uuidIDs struct {
+	IDGenerator
+}
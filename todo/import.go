@@ -0,0 +1,175 @@
+package todo
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/valyala/fasthttp"
+)
+
+// importResult summarizes a finished import job.
+type importResult struct {
+	Todos int `json:"todos"`
+	Files int `json:"files"`
+}
+
+// importTodos handles POST /import. The request carries a zip archive, either
+// as the raw body (Content-Type: application/zip) or as the "archive" field of
+// a multipart form. The archive must contain a todos.json file holding a JSON
+// array of todos; every other file is restored into the uploads directory of
+// the request's namespace.
+// The import runs as a background job whose progress can be polled at
+// GET /jobs/{id}.
+func importTodos(ctx *fasthttp.RequestCtx) {
+	data, err := readArchive(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		ctx.Error("Invalid zip archive", fasthttp.StatusBadRequest)
+		return
+	}
+
+	ns := namespaceOf(ctx)
+	actor := actorOf(ctx)
+	job := startJob("import", actor, func(ctx context.Context, p *jobProgress) (interface{}, error) {
+		return restoreArchive(ctx, ns, zr, actor, p)
+	})
+	respondJobStarted(ctx, job)
+}
+
+// readArchive returns a copy of the zip archive sent with the request. The
+// copy outlives the request so the import can continue in the background.
+func readArchive(ctx *fasthttp.RequestCtx) ([]byte, error) {
+	if bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("application/zip")) {
+		return append([]byte(nil), ctx.PostBody()...), nil
+	}
+	fileHeader, err := ctx.FormFile("archive")
+	if err != nil {
+		return nil, errors.New("missing zip archive")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// restoreArchive restores the files and todos contained in zr into ns. Todos keep
+// their IDs and replace existing todos with the same ID. They are only added
+// once every file has been restored, so a failed or canceled import leaves
+// the todo list untouched, as does one that would take the actor's tenant
+// beyond its todo quota. If the backend fails, the import stops there.
+func restoreArchive(ctx context.Context, ns *namespace, zr *zip.Reader, actor string, p *jobProgress) (interface{}, error) {
+	p.setTotal(len(zr.File))
+
+	var imported []Todo
+	foundTodos := false
+	restored := make(map[string]string)
+
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		switch {
+		case f.FileInfo().IsDir():
+		case f.Name == "todos.json":
+			if err := readZipJSON(f, &imported); err != nil {
+				return nil, fmt.Errorf("todos.json: %w", err)
+			}
+			foundTodos = true
+		default:
+			savedPath, err := restoreZipFile(f, ns.uploads)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			restored[filepath.Base(f.Name)] = savedPath
+		}
+		p.advance(1)
+	}
+	if !foundTodos {
+		return nil, errors.New("archive does not contain todos.json")
+	}
+
+	for i := range imported {
+		todo := &imported[i]
+		// Point attachments, and the images of older archives, at the
+		// restored copies of their files. Those whose files are neither in
+		// the archive nor in the uploads directory are dropped.
+		attachments := todo.Attachments[:0]
+		for _, a := range todo.Attachments {
+			if savedPath, ok := restored[filepath.Base(a.Path)]; ok {
+				a.Path = savedPath
+			}
+			if inUploads(ns.uploads, a.Path) {
+				attachments = append(attachments, a)
+			}
+		}
+		todo.Attachments = attachments
+		images := todo.Images[:0]
+		for _, image := range todo.Images {
+			if savedPath, ok := restored[filepath.Base(image)]; ok {
+				image = savedPath
+			}
+			if inUploads(ns.uploads, image) {
+				images = append(images, image)
+			}
+		}
+		todo.Images = images
+	}
+	err := ns.withinQuota(actor, newTodos(ns.store, imported), func() error {
+		for i := range imported {
+			if err := ns.store.put(actor, &imported[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	todosChanged()
+	if err != nil {
+		return nil, err
+	}
+
+	return importResult{Todos: len(imported), Files: len(restored)}, nil
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// restoreZipFile extracts f into the uploads directory dir and returns its
+// path. Only the base name of the entry is used so archives cannot write
+// outside the uploads directory.
+func restoreZipFile(f *zip.File, dir string) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	filePath := filepath.Join(dir, filepath.Base(f.Name))
+	out, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, rc); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
@@ -0,0 +1,2644 @@
+package todo
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The integration tests send requests through the whole handler chain of
+// the test server, see testClient. They share the server, and its todos,
+// with each other and the benchmarks, so they only rely on the todos they
+// create themselves.
+
+// apiRequest is a request to the test server, built in the style of
+// httpexpect:
+//
+//	resp := newRequest(t, "GET", "/v1/todos/1").expect(fasthttp.StatusOK)
+type apiRequest struct {
+	t   *testing.T
+	req *fasthttp.Request
+}
+
+// apiResponse is the response to an apiRequest.
+type apiResponse struct {
+	t      *testing.T
+	status int
+	header fasthttp.ResponseHeader
+	body   []byte
+}
+
+func newRequest(t *testing.T, method, path string) *apiRequest {
+	t.Helper()
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://test" + path)
+	return &apiRequest{t: t, req: req}
+}
+
+func (r *apiRequest) header(key, value string) *apiRequest {
+	r.req.Header.Set(key, value)
+	return r
+}
+
+func (r *apiRequest) json(body string) *apiRequest {
+	r.req.Header.SetContentType("application/json")
+	r.req.SetBodyString(body)
+	return r
+}
+
+// multipart sends fields and files, by field name, as multipart/form-data.
+func (r *apiRequest) multipart(fields map[string]string, files map[string][]byte) *apiRequest {
+	r.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for name, data := range files {
+		part, err := mw.CreateFormFile(name, name+".png")
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	mw.Close()
+	r.req.Header.SetContentType(mw.FormDataContentType())
+	r.req.SetBody(body.Bytes())
+	return r
+}
+
+// do sends the request and returns the response, whatever its status.
+func (r *apiRequest) do() *apiResponse {
+	r.t.Helper()
+	var resp fasthttp.Response
+	if err := testClient(r.t).Do(r.req, &resp); err != nil {
+		r.t.Fatalf("%s %s: %s", r.req.Header.Method(), r.req.URI().RequestURI(), err)
+	}
+	out := &apiResponse{t: r.t, status: resp.StatusCode(), body: append([]byte(nil), resp.Body()...)}
+	resp.Header.CopyTo(&out.header)
+	return out
+}
+
+// expect sends the request and fails the test unless the response has the
+// status want.
+func (r *apiRequest) expect(want int) *apiResponse {
+	r.t.Helper()
+	resp := r.do()
+	if resp.status != want {
+		r.t.Fatalf("%s %s: status %d, want %d: %s", r.req.Header.Method(), r.req.URI().RequestURI(), resp.status, want, resp.body)
+	}
+	return resp
+}
+
+// decode unmarshals the JSON body of the response into v.
+func (r *apiResponse) decode(v any) {
+	r.t.Helper()
+	if err := json.Unmarshal(r.body, v); err != nil {
+		r.t.Fatalf("decoding %s: %s", r.body, err)
+	}
+}
+
+// withAPIKeys enables access control with the API keys in spec, as given
+// to -api-keys, until the test ends.
+func withAPIKeys(t *testing.T, spec string) {
+	t.Helper()
+	// Starting the server sets the keys from its configuration.
+	startTestServer(t)
+	keys, err := parseAPIKeys(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKeys = keys
+	t.Cleanup(func() { apiKeys = nil })
+}
+
+// createTestTodo creates a todo from a JSON object and returns it.
+func createTestTodo(t *testing.T, body string) Todo {
+	t.Helper()
+	var todo Todo
+	newRequest(t, "POST", "/v1/todos").json(body).expect(fasthttp.StatusCreated).decode(&todo)
+	if todo.ID == 0 {
+		t.Fatalf("created todo has no ID")
+	}
+	return todo
+}
+
+func todoPath(id int) string {
+	return "/v1/todos/" + strconv.Itoa(id)
+}
+
+func TestTodoLifecycle(t *testing.T) {
+	created := createTestTodo(t, `{"title": "Buy milk", "tags": ["errand"], "priority": "high", "subtasks": [{"title": "Find a shop"}]}`)
+	if created.Title != "Buy milk" || created.Status != statusBacklog || len(created.Subtasks) != 1 {
+		t.Fatalf("created %+v", created)
+	}
+
+	var got Todo
+	newRequest(t, "GET", todoPath(created.ID)).expect(fasthttp.StatusOK).decode(&got)
+	if got.Title != created.Title || !containsString(got.Tags, "errand") {
+		t.Errorf("got %+v, want %+v", got, created)
+	}
+
+	var updated Todo
+	newRequest(t, "PUT", todoPath(created.ID)).
+		json(`{"title": "Buy oat milk", "status": "in_progress", "subtasks": [{"title": "Find a shop", "completed": true}]}`).
+		expect(fasthttp.StatusOK).decode(&updated)
+	if updated.Title != "Buy oat milk" || updated.Status != "in_progress" || !updated.Subtasks[0].Completed {
+		t.Errorf("updated %+v", updated)
+	}
+
+	var history []json.RawMessage
+	newRequest(t, "GET", todoPath(created.ID)+"/history").expect(fasthttp.StatusOK).decode(&history)
+	if len(history) != 2 {
+		t.Errorf("history has %d entries, want 2", len(history))
+	}
+
+	newRequest(t, "DELETE", todoPath(created.ID)).expect(fasthttp.StatusNoContent)
+	newRequest(t, "GET", todoPath(created.ID)).expect(fasthttp.StatusGone)
+	newRequest(t, "POST", todoPath(created.ID)+"/undo").expect(fasthttp.StatusOK)
+	newRequest(t, "GET", todoPath(created.ID)).expect(fasthttp.StatusOK)
+}
+
+func TestArchive(t *testing.T) {
+	created := createTestTodo(t, `{"title": "File the taxes"}`)
+	path := todoPath(created.ID)
+	newRequest(t, "POST", path+"/archive").expect(fasthttp.StatusConflict)
+
+	newRequest(t, "PUT", path).json(`{"status": "done"}`).expect(fasthttp.StatusOK)
+	var archived Todo
+	newRequest(t, "POST", path+"/archive").expect(fasthttp.StatusOK).decode(&archived)
+	if archived.ArchivedAt == nil {
+		t.Fatalf("archived todo has no archived_at: %+v", archived)
+	}
+	listed := func(path string) bool {
+		var todos []Todo
+		newRequest(t, "GET", path).expect(fasthttp.StatusOK).decode(&todos)
+		for _, todo := range todos {
+			if todo.ID == created.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if listed("/v1/todos") || !listed("/v1/archive") {
+		t.Fatal("expected the archived todo on the archive instead of the list")
+	}
+
+	// Reopening the todo takes it out of the archive.
+	newRequest(t, "PUT", path).json(`{"status": "in_progress"}`).expect(fasthttp.StatusOK)
+	if !listed("/v1/todos") || listed("/v1/archive") {
+		t.Fatal("expected the reopened todo on the list")
+	}
+}
+
+func TestToggleAndCompleteAllSubtasks(t *testing.T) {
+	created := createTestTodo(t, `{"title": "Pack", "subtasks": [{"title": "Socks"}, {"title": "Shirts", "completed": true}]}`)
+	path := todoPath(created.ID)
+
+	var todo Todo
+	newRequest(t, "POST", path+"/subtasks/complete-all").expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed || todo.Status != statusDone || !checkAllSubtasksCompleted(todo.Subtasks) {
+		t.Fatalf("after complete-all: %+v", todo)
+	}
+	newRequest(t, "POST", path+"/toggle").expect(fasthttp.StatusOK).decode(&todo)
+	if todo.Completed || todo.Status != statusInProgress || todo.Subtasks[0].Completed || todo.Subtasks[1].Completed {
+		t.Fatalf("after reopening toggle: %+v", todo)
+	}
+	newRequest(t, "POST", path+"/toggle").expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed || !checkAllSubtasksCompleted(todo.Subtasks) {
+		t.Fatalf("after completing toggle: %+v", todo)
+	}
+	newRequest(t, "GET", path+"/toggle").expect(fasthttp.StatusMethodNotAllowed)
+}
+
+func TestDerivedCompletionFollowsTheWorkflow(t *testing.T) {
+	blocked := createTestTodo(t, `{"title": "Move house", "status": "blocked", "subtasks": [{"title": "Boxes"}, {"title": "Van"}]}`)
+	path := todoPath(blocked.ID)
+	stillBlocked := func(when string) {
+		t.Helper()
+		var todo Todo
+		newRequest(t, "GET", path).expect(fasthttp.StatusOK).decode(&todo)
+		if todo.Completed || todo.Status != statusBlocked {
+			t.Fatalf("%s: %+v, want it blocked", when, todo)
+		}
+	}
+
+	// The default workflow doesn't go from blocked to done.
+	newRequest(t, "POST", path+"/subtasks/complete-all").expect(fasthttp.StatusConflict)
+	stillBlocked("after complete-all")
+	newRequest(t, "PATCH", path).json(`{"subtasks": [{"title": "Boxes", "completed": true}, {"title": "Van", "completed": true}]}`).expect(fasthttp.StatusOK)
+	stillBlocked("after completing the subtasks")
+
+	target := createTestTodo(t, `{"title": "Relocate"}`)
+	newRequest(t, "POST", "/v1/todos/merge").json(fmt.Sprintf(`{"target": %d, "sources": [%d], "action": "archive"}`, target.ID, blocked.ID)).
+		expect(fasthttp.StatusConflict)
+	stillBlocked("after merging it into another todo")
+}
+
+func TestCompletedOverride(t *testing.T) {
+	plain := createTestTodo(t, `{"title": "Call mom", "completed": true}`)
+	if !plain.Completed || plain.Status != statusDone {
+		t.Fatalf("created %+v, want it completed", plain)
+	}
+	var todo Todo
+	newRequest(t, "PUT", todoPath(plain.ID)).json(`{"completed": false}`).expect(fasthttp.StatusOK).decode(&todo)
+	if todo.Completed || todo.Status != statusInProgress {
+		t.Fatalf("reopened %+v", todo)
+	}
+	newRequest(t, "PATCH", todoPath(plain.ID)).json(`{"completed": true}`).expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed || todo.Title != "Call mom" {
+		t.Fatalf("patched %+v, want it completed with its title", todo)
+	}
+
+	// In derived mode the subtasks decide.
+	withSubtasks := createTestTodo(t, `{"title": "Shop", "completed": true, "subtasks": [{"title": "Bread"}]}`)
+	if withSubtasks.Completed {
+		t.Fatalf("created %+v, want it open like its subtask", withSubtasks)
+	}
+	newRequest(t, "PATCH", todoPath(withSubtasks.ID)).json(`{"title": "Shop for dinner"}`).expect(fasthttp.StatusOK).decode(&todo)
+	if len(todo.Subtasks) != 1 {
+		t.Fatalf("patched %+v, want it to keep its subtask", todo)
+	}
+
+	completionMode = "manual"
+	defer func() { completionMode = "derived" }()
+	newRequest(t, "PUT", todoPath(withSubtasks.ID)).json(`{"completed": true, "subtasks": [{"id": 1, "title": "Bread"}]}`).expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed || todo.Subtasks[0].Completed {
+		t.Fatalf("manually completed %+v", todo)
+	}
+	newRequest(t, "PUT", todoPath(withSubtasks.ID)).json(`{"subtasks": [{"id": 1, "title": "Bread"}]}`).expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed {
+		t.Fatalf("updating the subtasks reopened %+v in manual mode", todo)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	quotes := createTestTodo(t, `{"title": "Get quotes"}`)
+	pick := createTestTodo(t, `{"title": "Pick a contractor"}`)
+	build := createTestTodo(t, `{"title": "Build the shed"}`)
+	newRequest(t, "POST", todoPath(pick.ID)+"/links").json(fmt.Sprintf(`{"type": "blocked-by", "todo_id": %d}`, quotes.ID)).expect(fasthttp.StatusCreated)
+	newRequest(t, "POST", todoPath(pick.ID)+"/links").json(fmt.Sprintf(`{"type": "blocks", "todo_id": %d}`, build.ID)).expect(fasthttp.StatusCreated)
+	newRequest(t, "POST", todoPath(quotes.ID)+"/links").json(fmt.Sprintf(`{"type": "blocked-by", "todo_id": %d}`, build.ID)).expect(fasthttp.StatusConflict)
+
+	ready := func() []int {
+		var todos []Todo
+		newRequest(t, "GET", "/v1/todos?ready=true").expect(fasthttp.StatusOK).decode(&todos)
+		var ids []int
+		for _, todo := range todos {
+			ids = append(ids, todo.ID)
+		}
+		return ids
+	}
+	if ids := ready(); !containsInt(ids, quotes.ID) || containsInt(ids, pick.ID) {
+		t.Fatalf("ready todos %v", ids)
+	}
+	newRequest(t, "PUT", todoPath(quotes.ID)).json(`{"status": "done"}`).expect(fasthttp.StatusOK)
+	if ids := ready(); containsInt(ids, quotes.ID) || !containsInt(ids, pick.ID) || containsInt(ids, build.ID) {
+		t.Fatalf("ready todos %v after completing the blocker", ids)
+	}
+
+	var graph struct {
+		Nodes []dependencyNode `json:"nodes"`
+		Edges []dependencyEdge `json:"edges"`
+	}
+	newRequest(t, "GET", todoPath(build.ID)+"/dependencies").expect(fasthttp.StatusOK).decode(&graph)
+	if len(graph.Nodes) != 3 || len(graph.Edges) != 2 || graph.Edges[0] != (dependencyEdge{TodoID: pick.ID, BlockedBy: quotes.ID}) {
+		t.Fatalf("dependency graph %+v", graph)
+	}
+}
+
+func TestLinksNeedPermissionOnTarget(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var mine, his Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "alice-key").
+		json(`{"title": "Book the venue", "project": "work"}`).expect(fasthttp.StatusCreated).decode(&mine)
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Book a holiday", "project": "home"}`).expect(fasthttp.StatusCreated).decode(&his)
+
+	link := fmt.Sprintf(`{"type": "relates-to", "todo_id": %d}`, his.ID)
+	newRequest(t, "POST", todoPath(mine.ID)+"/links").header("X-API-Key", "alice-key").json(link).expect(fasthttp.StatusNotFound)
+	newRequest(t, "POST", todoPath(his.ID)+"/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "viewer"}`).expect(fasthttp.StatusCreated)
+	newRequest(t, "POST", todoPath(mine.ID)+"/links").header("X-API-Key", "alice-key").json(link).expect(fasthttp.StatusNotFound)
+	var got Todo
+	newRequest(t, "GET", todoPath(his.ID)).header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).decode(&got)
+	if len(got.Links) != 0 {
+		t.Errorf("bob's todo got links %+v", got.Links)
+	}
+
+	newRequest(t, "POST", todoPath(his.ID)+"/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "editor"}`).expect(fasthttp.StatusCreated)
+	newRequest(t, "POST", todoPath(mine.ID)+"/links").header("X-API-Key", "alice-key").json(link).expect(fasthttp.StatusCreated)
+}
+
+func TestTemplates(t *testing.T) {
+	var tmpl Template
+	newRequest(t, "POST", "/v1/templates").
+		json(`{"name": "Onboarding", "title": "Onboard {{client}}", "subtasks": ["Call {{ client }} on {{date}}"], "tags": ["sales"]}`).
+		expect(fasthttp.StatusCreated).decode(&tmpl)
+	if len(tmpl.Variables) != 1 || tmpl.Variables[0] != "client" {
+		t.Fatalf("template variables %v, want [client]", tmpl.Variables)
+	}
+	newRequest(t, "POST", "/v1/templates").json(`{"name": "Empty"}`).expect(fasthttp.StatusBadRequest)
+
+	path := fmt.Sprintf("/v1/todos/from-template/%d", tmpl.ID)
+	newRequest(t, "POST", path).json(`{}`).expect(fasthttp.StatusUnprocessableEntity)
+	var todo Todo
+	newRequest(t, "POST", path).json(`{"variables": {"client": "Acme"}}`).expect(fasthttp.StatusCreated).decode(&todo)
+	want := "Call Acme on " + time.Now().Format("2006-01-02")
+	if todo.Title != "Onboard Acme" || len(todo.Subtasks) != 1 || todo.Subtasks[0].Title != want || !containsString(todo.Tags, "sales") {
+		t.Fatalf("created %+v from the template", todo)
+	}
+
+	newRequest(t, "DELETE", fmt.Sprintf("/v1/templates/%d", tmpl.ID)).expect(fasthttp.StatusNoContent)
+	newRequest(t, "POST", path).json(`{"variables": {"client": "Acme"}}`).expect(fasthttp.StatusNotFound)
+}
+
+func TestCloneTodo(t *testing.T) {
+	original := createTestTodo(t, `{"title": "Q3 report", "status": "done", "tags": ["work"], "subtasks": [{"title": "Draft", "completed": true}]}`)
+	var clone Todo
+	newRequest(t, "POST", todoPath(original.ID)+"/clone").json(`{"title": "Q4 report"}`).expect(fasthttp.StatusCreated).decode(&clone)
+	if clone.ID == original.ID || clone.Title != "Q4 report" || clone.Completed || clone.Status != statusBacklog {
+		t.Fatalf("cloned %+v", clone)
+	}
+	if len(clone.Subtasks) != 1 || clone.Subtasks[0].Completed || !containsString(clone.Tags, "work") {
+		t.Fatalf("clone has subtasks %+v and tags %v", clone.Subtasks, clone.Tags)
+	}
+	newRequest(t, "POST", todoPath(original.ID)+"/clone").json(`{"title": " "}`).expect(fasthttp.StatusUnprocessableEntity)
+	newRequest(t, "POST", todoPath(999999)+"/clone").expect(fasthttp.StatusNotFound)
+}
+
+func TestMergeTodos(t *testing.T) {
+	target := createTestTodo(t, `{"title": "Plan the offsite", "description": "Venue", "tags": ["team"], "subtasks": [{"title": "Pick a date"}]}`)
+	dup := createTestTodo(t, `{"title": "Offsite", "description": "Catering", "tags": ["team", "food"], "subtasks": [{"title": "Order lunch", "completed": true}]}`)
+	old := createTestTodo(t, `{"title": "Offsite budget", "status": "done"}`)
+
+	var result mergeResult
+	newRequest(t, "POST", "/v1/todos/merge").
+		json(fmt.Sprintf(`{"target": %d, "sources": [%d, %d]}`, target.ID, dup.ID, old.ID)).
+		expect(fasthttp.StatusOK).decode(&result)
+	var merged Todo
+	if err := json.Unmarshal(result.Todo, &merged); err != nil {
+		t.Fatal(err)
+	}
+	if result.SubtasksAdded != 1 || len(merged.Subtasks) != 2 || merged.Subtasks[1].ID == merged.Subtasks[0].ID {
+		t.Fatalf("merged subtasks %+v", merged.Subtasks)
+	}
+	if merged.Description != "Venue\n\nCatering" || len(result.TagsAdded) != 1 || !containsString(merged.Tags, "food") {
+		t.Fatalf("merged %+v with result %+v", merged, result)
+	}
+	newRequest(t, "GET", todoPath(dup.ID)).expect(fasthttp.StatusGone)
+
+	// A missing todo leaves all of them unchanged.
+	other := createTestTodo(t, `{"title": "Other", "subtasks": [{"title": "Keep me"}]}`)
+	newRequest(t, "POST", "/v1/todos/merge").
+		json(fmt.Sprintf(`{"target": %d, "sources": [%d, 999999], "action": "archive"}`, target.ID, other.ID)).
+		expect(fasthttp.StatusNotFound)
+	var unchanged Todo
+	newRequest(t, "GET", todoPath(other.ID)).expect(fasthttp.StatusOK).decode(&unchanged)
+	if unchanged.archived() {
+		t.Fatalf("failed merge archived %+v", unchanged)
+	}
+	newRequest(t, "POST", "/v1/todos/merge").json(fmt.Sprintf(`{"target": %d, "sources": [%d]}`, target.ID, target.ID)).expect(fasthttp.StatusBadRequest)
+}
+
+func TestMergeNeedsPermission(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var mine, theirs Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "alice-key").
+		json(`{"title": "Team lunch", "project": "work"}`).expect(fasthttp.StatusCreated).decode(&mine)
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Family dinner", "project": "home", "description": "private"}`).expect(fasthttp.StatusCreated).decode(&theirs)
+	merge := func(action string) *apiRequest {
+		return newRequest(t, "POST", "/v1/todos/merge").header("X-API-Key", "alice-key").
+			json(fmt.Sprintf(`{"target": %d, "sources": [%d], "action": %q}`, mine.ID, theirs.ID, action))
+	}
+
+	merge("delete").expect(fasthttp.StatusNotFound)
+	newRequest(t, "GET", todoPath(theirs.ID)).header("X-API-Key", "bob-key").expect(fasthttp.StatusOK)
+
+	// Editors of a todo may archive it into theirs, but only owners may
+	// delete it.
+	newRequest(t, "POST", todoPath(theirs.ID)+"/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "editor"}`).expect(fasthttp.StatusCreated)
+	merge("delete").expect(fasthttp.StatusForbidden)
+	merge("archive").expect(fasthttp.StatusOK)
+}
+
+func TestCalendarFeed(t *testing.T) {
+	due := createTestTodo(t, `{"title": "Dentist; bring card", "due_at": "2030-03-01T09:30:00Z", "remind_at": "2030-03-01T08:30:00Z"}`)
+	undated := createTestTodo(t, `{"title": "Someday"}`)
+
+	resp := newRequest(t, "GET", "/v1/todos/calendar.ics").expect(fasthttp.StatusOK)
+	if ct := string(resp.header.ContentType()); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatalf("content type %q", ct)
+	}
+	ics := string(resp.body)
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		fmt.Sprintf("UID:todo-%d@", due.ID),
+		"DTSTART:20300301T093000Z\r\n",
+		"SUMMARY:Dentist\\; bring card\r\n",
+		"TRIGGER;VALUE=DATE-TIME:20300301T083000Z\r\n",
+	} {
+		if !strings.Contains(ics, want) {
+			t.Errorf("feed lacks %q:\n%s", want, ics)
+		}
+	}
+	if strings.Contains(ics, fmt.Sprintf("UID:todo-%d@", undated.ID)) {
+		t.Errorf("feed has the todo without dates:\n%s", ics)
+	}
+
+	long := appendICSLine(nil, "DESCRIPTION:"+strings.Repeat("é", 60))
+	for _, line := range strings.Split(strings.TrimSuffix(string(long), "\r\n"), "\r\n") {
+		if len(line) > 75 || !utf8.ValidString(strings.TrimPrefix(line, " ")) {
+			t.Fatalf("badly folded line %q", line)
+		}
+	}
+}
+
+func TestCalendarFeedHasSharedTodos(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var todo Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Pick up the kids", "project": "home", "due_at": "2030-04-01T15:00:00Z"}`).
+		expect(fasthttp.StatusCreated).decode(&todo)
+	uid := fmt.Sprintf("UID:todo-%d@", todo.ID)
+	var token map[string]string
+	newRequest(t, "GET", "/v1/feeds/token").header("X-API-Key", "alice-key").expect(fasthttp.StatusOK).decode(&token)
+	calendar := "/v1/todos/calendar.ics?token=" + token["token"]
+
+	if ics := newRequest(t, "GET", calendar).expect(fasthttp.StatusOK).body; bytes.Contains(ics, []byte(uid)) {
+		t.Fatalf("alice's feed has bob's todo before it was shared")
+	}
+	newRequest(t, "POST", todoPath(todo.ID)+"/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "viewer"}`).expect(fasthttp.StatusCreated)
+	if ics := newRequest(t, "GET", calendar).expect(fasthttp.StatusOK).body; !bytes.Contains(ics, []byte(uid)) {
+		t.Errorf("alice's feed lacks the todo shared with her")
+	}
+}
+
+func TestOccurrencesKeepTheirSeriesCreator(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	// complete completes a todo without publishing, so the occurrence is
+	// only created by the call of createNextOccurrence below.
+	complete := func(actor string, id int) int {
+		t.Helper()
+		if _, _, err := store.update(actor, id, func(todo *Todo) error {
+			return setStatus(todo, statusDone)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		next, ok := createNextOccurrence(defaultNamespace, id, time.Now())
+		if !ok {
+			t.Fatalf("todo %d got no next occurrence", id)
+		}
+		return next
+	}
+
+	// Alice only sees the todos without a project she created.
+	var mine Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "alice-key").
+		json(`{"title": "Feed the cat", "recurrence": "daily"}`).expect(fasthttp.StatusCreated).decode(&mine)
+	next := complete("alice", mine.ID)
+	if creator := store.creator(next); creator != "alice" {
+		t.Errorf("the occurrence was created by %q, want alice", creator)
+	}
+	newRequest(t, "GET", todoPath(next)).header("X-API-Key", "alice-key").expect(fasthttp.StatusOK)
+
+	// Occurrences alice can't see aren't listed.
+	var theirs Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Take out the bins", "project": "home", "recurrence": "weekly"}`).expect(fasthttp.StatusCreated).decode(&theirs)
+	newRequest(t, "POST", todoPath(theirs.ID)+"/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "viewer"}`).expect(fasthttp.StatusCreated)
+	complete("bob", theirs.ID)
+	var occurrences []Todo
+	newRequest(t, "GET", todoPath(theirs.ID)+"/occurrences").header("X-API-Key", "alice-key").expect(fasthttp.StatusOK).decode(&occurrences)
+	if len(occurrences) != 1 || occurrences[0].ID != theirs.ID {
+		t.Errorf("alice sees occurrences %+v, want only the shared todo", occurrences)
+	}
+	newRequest(t, "GET", todoPath(theirs.ID)+"/occurrences").header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).decode(&occurrences)
+	if len(occurrences) != 2 {
+		t.Errorf("bob sees %d occurrences, want 2", len(occurrences))
+	}
+}
+
+func TestActivityFeed(t *testing.T) {
+	created := createTestTodo(t, `{"title": "Ship <v2>"}`)
+	newRequest(t, "PUT", todoPath(created.ID)).json(`{"status": "done"}`).expect(fasthttp.StatusOK)
+
+	resp := newRequest(t, "GET", "/v1/todos/feed.atom?limit=5").expect(fasthttp.StatusOK)
+	var feed atomFeed
+	if err := xml.Unmarshal(resp.body, &feed); err != nil {
+		t.Fatalf("decoding %s: %s", resp.body, err)
+	}
+	if len(feed.Entries) < 2 || feed.Entries[0].Title != "Completed: Ship <v2>" || feed.Entries[1].Title != "Created: Ship <v2>" {
+		t.Fatalf("feed entries %+v", feed.Entries)
+	}
+	newRequest(t, "GET", "/v1/todos/feed.atom?limit=0").expect(fasthttp.StatusBadRequest)
+}
+
+// sinkRecorder is a notification sink sending what it is notified of to a
+// channel.
+type sinkRecorder chan notification
+
+func (r sinkRecorder) notify(n notification) error {
+	r <- n
+	return nil
+}
+
+func TestRuleNotificationSinks(t *testing.T) {
+	if _, err := parseNotifySinks("ops=slack:https://hooks.slack.com/x, dev=discord:https://discord.com/api/webhooks/1/a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"ops=irc:https://example.com", "ops=slack", "ops=slack:ftp://example.com", "a=slack:https://x,a=discord:https://y"} {
+		if _, err := parseNotifySinks(spec); err == nil {
+			t.Errorf("parseNotifySinks(%q) succeeded", spec)
+		}
+	}
+
+	startTestServer(t)
+	sent := make(sinkRecorder, 1)
+	notifySinks["test-ops"] = sent
+	defer delete(notifySinks, "test-ops")
+	newRequest(t, "POST", "/v1/rules").
+		json(`{"trigger": "created", "actions": [{"type": "notify", "value": "x", "sink": "nowhere"}]}`).
+		expect(fasthttp.StatusBadRequest)
+	var rule Rule
+	newRequest(t, "POST", "/v1/rules").
+		json(`{"trigger": "created", "conditions": [{"field": "title", "op": "eq", "value": "Pager duty"}, {"field": "priority", "op": "eq", "value": "high"}],
+			"actions": [{"type": "notify", "value": "High-priority todo", "sink": "test-ops"}]}`).
+		expect(fasthttp.StatusCreated).decode(&rule)
+	defer newRequest(t, "DELETE", "/v1/rules/"+strconv.Itoa(rule.ID)).expect(fasthttp.StatusNoContent)
+
+	createTestTodo(t, `{"title": "Pager duty", "priority": "low"}`)
+	todo := createTestTodo(t, `{"title": "Pager duty", "priority": "high"}`)
+	select {
+	case n := <-sent:
+		if n.TodoID != todo.ID || n.Message != "High-priority todo" || n.Title != "Pager duty" {
+			t.Fatalf("notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification sent")
+	}
+}
+
+func TestEmailDigests(t *testing.T) {
+	newRequest(t, "PUT", "/v1/me/profile").json(`{"digest": "hourly", "email": "me@example.com"}`).expect(fasthttp.StatusBadRequest)
+	newRequest(t, "PUT", "/v1/me/profile").json(`{"digest": "daily"}`).expect(fasthttp.StatusBadRequest)
+	var profile Profile
+	newRequest(t, "PUT", "/v1/me/profile").json(`{"digest": "daily", "email": "me@example.com"}`).expect(fasthttp.StatusOK).decode(&profile)
+	if profile.User != "anonymous" || profile.Digest != "daily" {
+		t.Fatalf("profile %+v", profile)
+	}
+	defer newRequest(t, "PUT", "/v1/me/profile").json(`{}`).expect(fasthttp.StatusOK)
+
+	now := time.Now().UTC()
+	createTestTodo(t, `{"title": "Overdue report", "assignee": "anonymous", "due_at": "`+now.Add(-time.Hour).Format(time.RFC3339)+`"}`)
+	createTestTodo(t, `{"title": "Upcoming call", "assignee": "anonymous", "due_at": "`+now.Add(time.Hour).Format(time.RFC3339)+`"}`)
+	createTestTodo(t, `{"title": "Next month", "assignee": "anonymous", "due_at": "`+now.Add(30*24*time.Hour).Format(time.RFC3339)+`"}`)
+
+	var sent []notification
+	digestMailer = func(to string, n notification) error {
+		if to != "me@example.com" {
+			t.Errorf("digest sent to %s", to)
+		}
+		sent = append(sent, n)
+		return nil
+	}
+	defer func() { digestMailer = nil }()
+	p := &jobProgress{job: &Job{}}
+	for range 2 {
+		if _, err := sendDigests(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d digests, want 1", len(sent))
+	}
+	msg := sent[0].Message
+	if !strings.Contains(msg, "Overdue report") || !strings.Contains(msg, "Upcoming call") || strings.Contains(msg, "Next month") {
+		t.Fatalf("digest %q", msg)
+	}
+}
+
+func TestTelegramCommands(t *testing.T) {
+	const chat = 4711
+	if reply := telegramReply(chat, "/list"); !strings.Contains(reply, "isn't linked") {
+		t.Fatalf("unlinked /list replied %q", reply)
+	}
+	if reply := telegramReply(chat, "/link nope"); !strings.Contains(reply, "invalid") {
+		t.Fatalf("/link with a bad code replied %q", reply)
+	}
+	var link struct {
+		Code string `json:"code"`
+	}
+	newRequest(t, "POST", "/v1/me/telegram").expect(fasthttp.StatusCreated).decode(&link)
+	if reply := telegramReply(chat, "/link@TodoBot "+link.Code); reply != "Linked to anonymous." {
+		t.Fatalf("/link replied %q", reply)
+	}
+	if reply := telegramReply(chat, "/link "+link.Code); !strings.Contains(reply, "invalid") {
+		t.Fatalf("reused code replied %q", reply)
+	}
+	defer newRequest(t, "DELETE", "/v1/me/telegram").expect(fasthttp.StatusNoContent)
+
+	reply := telegramReply(chat, "/add Water the plants")
+	id, err := strconv.Atoi(strings.Fields(strings.TrimPrefix(reply, "Added #"))[0])
+	if err != nil {
+		t.Fatalf("/add replied %q", reply)
+	}
+	if reply := telegramReply(chat, "/list"); !strings.Contains(reply, fmt.Sprintf("#%d Water the plants", id)) {
+		t.Fatalf("/list replied %q", reply)
+	}
+	if reply := telegramReply(chat, fmt.Sprintf("/done %d", id)); !strings.HasPrefix(reply, "Done:") {
+		t.Fatalf("/done replied %q", reply)
+	}
+	var todo Todo
+	newRequest(t, "GET", todoPath(id)).expect(fasthttp.StatusOK).decode(&todo)
+	if !todo.Completed {
+		t.Fatal("todo completed through the bot is open")
+	}
+	if reply := telegramReply(chat, fmt.Sprintf("/done %d", id)); !strings.Contains(reply, "already done") {
+		t.Fatalf("second /done replied %q", reply)
+	}
+	if reply := telegramReply(chat, "/add "); !strings.HasPrefix(reply, "Invalid todo") {
+		t.Fatalf("/add without a title replied %q", reply)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	c := &fasthttp.Client{Dial: testClient(t).Dial, StreamResponseBody: true}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://test/v1/events")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	defer resp.CloseBodyStream()
+	if ct := string(resp.Header.ContentType()); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	lines := bufio.NewScanner(resp.BodyStream())
+	lines.Scan() // Wait for the stream to be set up.
+
+	// next returns the next event of the stream about the todo with the
+	// given ID.
+	next := func(id int) (string, sseMessage) {
+		t.Helper()
+		var event string
+		for lines.Scan() {
+			line := lines.Text()
+			if e, ok := strings.CutPrefix(line, "event: "); ok {
+				event = e
+			}
+			var msg sseMessage
+			if data, ok := strings.CutPrefix(line, "data: "); ok && json.Unmarshal([]byte(data), &msg) == nil && msg.TodoID == id {
+				return event, msg
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return "", sseMessage{}
+	}
+	created := createTestTodo(t, `{"title": "Streamed"}`)
+	if event, msg := next(created.ID); event != "todo.created" || !strings.Contains(string(msg.Todo), `"Streamed"`) {
+		t.Fatalf("got %s %+v, want todo.created with the todo", event, msg)
+	}
+	newRequest(t, "DELETE", todoPath(created.ID)).expect(fasthttp.StatusNoContent)
+	if event, msg := next(created.ID); event != "todo.deleted" || msg.Todo != nil {
+		t.Fatalf("got %s %+v, want todo.deleted without a todo", event, msg)
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	page := newRequest(t, "GET", "/").expect(fasthttp.StatusOK)
+	if ct := string(page.header.ContentType()); !strings.HasPrefix(ct, "text/html") || !bytes.Contains(page.body, []byte("/ui/app.js")) {
+		t.Fatalf("GET / returned %s: %s", ct, page.body)
+	}
+	script := newRequest(t, "GET", "/ui/app.js").expect(fasthttp.StatusOK)
+	if ct := string(script.header.ContentType()); !strings.Contains(ct, "javascript") {
+		t.Errorf("app.js content type %q", ct)
+	}
+	etag := string(script.header.Peek("ETag"))
+	newRequest(t, "GET", "/ui/app.js").header("If-None-Match", etag).expect(fasthttp.StatusNotModified)
+	newRequest(t, "GET", "/ui/missing.js").expect(fasthttp.StatusNotFound)
+}
+
+func TestHTMXUI(t *testing.T) {
+	startTestServer(t)
+	uiMode = "htmx"
+	defer func() { uiMode = "spa" }()
+
+	newRequest(t, "GET", "/").expect(fasthttp.StatusFound)
+	add := newRequest(t, "POST", "/ui/todos").header("HX-Request", "true")
+	add.req.Header.SetContentType("application/x-www-form-urlencoded")
+	add.req.SetBodyString("title=Water+the+%3Cplants%3E")
+	item := add.expect(fasthttp.StatusOK)
+	match := regexp.MustCompile(`id="todo-(\d+)"`).FindSubmatch(item.body)
+	if match == nil || !bytes.Contains(item.body, []byte("Water the &lt;plants&gt;")) {
+		t.Fatalf("added %s", item.body)
+	}
+	id, _ := strconv.Atoi(string(match[1]))
+
+	page := newRequest(t, "GET", "/ui/todos?q=plants").expect(fasthttp.StatusOK)
+	if !bytes.Contains(page.body, []byte("<!doctype html>")) || !bytes.Contains(page.body, match[0]) {
+		t.Errorf("page lacks the todo: %s", page.body)
+	}
+	list := newRequest(t, "GET", "/ui/todos?q=plants").header("HX-Request", "true").expect(fasthttp.StatusOK)
+	if !bytes.HasPrefix(list.body, []byte(`<ul id="todos">`)) || !bytes.Contains(list.body, match[0]) {
+		t.Errorf("fragment %s", list.body)
+	}
+
+	toggled := newRequest(t, "POST", fmt.Sprintf("/ui/todos/%d/toggle", id)).expect(fasthttp.StatusOK)
+	if !bytes.Contains(toggled.body, []byte(`class="done"`)) {
+		t.Errorf("toggled %s", toggled.body)
+	}
+	hidden := newRequest(t, "GET", "/ui/todos?q=plants").header("HX-Request", "true").expect(fasthttp.StatusOK)
+	if bytes.Contains(hidden.body, match[0]) {
+		t.Errorf("completed todo listed without done=true: %s", hidden.body)
+	}
+
+	failed := newRequest(t, "POST", fmt.Sprintf("/ui/todos/%d/toggle", 1<<30)).expect(fasthttp.StatusNotFound)
+	if string(failed.header.Peek("HX-Retarget")) != "#error" {
+		t.Errorf("error not retargeted: %s", failed.header.String())
+	}
+	newRequest(t, "DELETE", fmt.Sprintf("/ui/todos/%d", id)).expect(fasthttp.StatusOK)
+	newRequest(t, "GET", todoPath(id)).expect(fasthttp.StatusGone)
+}
+
+func TestMCPStdio(t *testing.T) {
+	startTestServer(t)
+	in := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"protocolVersion": "2024-11-05"}}`,
+		`{"jsonrpc": "2.0", "method": "notifications/initialized"}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "tools/list"}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "tools/call", "params": {"name": "create_todo", "arguments": {"title": "Ask the agent", "project": "mcp"}}}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "tools/call", "params": {"name": "create_todo", "arguments": {"title": "Bad", "priority": "asap"}}}`,
+		`{"jsonrpc": "2.0", "id": 5, "method": "no/such/method"}`,
+	}, "\n")
+	var out bytes.Buffer
+	serveMCPStdio(context.Background(), strings.NewReader(in), &out)
+
+	type mcpReply struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	var replies []mcpReply
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var reply mcpReply
+		if err := json.Unmarshal([]byte(line), &reply); err != nil {
+			t.Fatalf("reply %s: %s", line, err)
+		}
+		replies = append(replies, reply)
+	}
+	if len(replies) != 5 {
+		t.Fatalf("got %d replies, want 5 (none for the notification): %s", len(replies), out.String())
+	}
+	if !strings.Contains(string(replies[1].Result), `"complete_todo"`) {
+		t.Errorf("tools/list returned %s", replies[1].Result)
+	}
+	var created struct {
+		Content []struct{ Text string } `json:"content"`
+		IsError bool                    `json:"isError"`
+	}
+	json.Unmarshal(replies[2].Result, &created)
+	var todo Todo
+	if created.IsError || len(created.Content) != 1 || json.Unmarshal([]byte(created.Content[0].Text), &todo) != nil || todo.Project != "mcp" {
+		t.Fatalf("create_todo returned %s", replies[2].Result)
+	}
+	newRequest(t, "GET", todoPath(todo.ID)).expect(fasthttp.StatusOK)
+	if !strings.Contains(string(replies[3].Result), `"isError":true`) {
+		t.Errorf("invalid create_todo returned %s", replies[3].Result)
+	}
+	if replies[4].Error == nil || replies[4].Error.Code != rpcMethodNotFound {
+		t.Errorf("unknown method returned %+v", replies[4])
+	}
+
+	list, err := mcpListTodos(defaultNamespace, mcpStdioPrincipal, json.RawMessage(`{"project": "mcp"}`))
+	if err != nil || !strings.Contains(list, `"Ask the agent"`) {
+		t.Errorf("list_todos returned %s, %v", list, err)
+	}
+	done, err := mcpCompleteTodo(defaultNamespace, mcpStdioPrincipal, json.RawMessage(fmt.Sprintf(`{"id": %d}`, todo.ID)))
+	if err != nil || !strings.Contains(done, `"completed":true`) {
+		t.Errorf("complete_todo returned %s, %v", done, err)
+	}
+	if list, _ := mcpListTodos(defaultNamespace, mcpStdioPrincipal, json.RawMessage(`{"project": "mcp"}`)); list != "[]" {
+		t.Errorf("list_todos returned completed todos: %s", list)
+	}
+}
+
+func TestMCPSSE(t *testing.T) {
+	c := &fasthttp.Client{Dial: testClient(t).Dial, StreamResponseBody: true}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://test/v1/mcp/sse")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	defer resp.CloseBodyStream()
+	lines := bufio.NewScanner(resp.BodyStream())
+	var endpoint string
+	for endpoint == "" && lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			endpoint = data
+		}
+	}
+	if !strings.HasPrefix(endpoint, "/v1/mcp/messages?session_id=") {
+		t.Fatalf("endpoint %q", endpoint)
+	}
+
+	newRequest(t, "POST", endpoint).json(`{"jsonrpc": "2.0", "id": 7, "method": "ping"}`).expect(fasthttp.StatusAccepted)
+	for lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			if data != `{"jsonrpc":"2.0","id":7,"result":{}}` {
+				t.Fatalf("got %s", data)
+			}
+			break
+		}
+	}
+	newRequest(t, "POST", "/v1/mcp/messages?session_id=nope").json(`{"jsonrpc": "2.0", "id": 1, "method": "ping"}`).
+		expect(fasthttp.StatusNotFound)
+}
+
+func TestQuickAdd(t *testing.T) {
+	// A Friday afternoon.
+	now := time.Date(2026, time.October, 16, 14, 30, 0, 0, time.UTC)
+	at := func(month time.Month, day, hour, minute int) string {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC).Format(time.RFC3339)
+	}
+	for _, tc := range []struct {
+		text, title, due, dueAt string
+	}{
+		{"Pay rent tomorrow 5pm #finance !high", "Pay rent", "tomorrow 5pm", at(time.October, 17, 17, 0)},
+		{"Call mom", "Call mom", "", ""},
+		{"Standup at 9:15 am", "Standup", "at 9:15 am", at(time.October, 17, 9, 15)},
+		{"Standup at 16:00", "Standup", "at 16:00", at(time.October, 16, 16, 0)},
+		{"Ship it by friday", "Ship it", "by friday", at(time.October, 23, 9, 0)},
+		{"Review next monday at noon", "Review", "next monday at noon", at(time.October, 19, 12, 0)},
+		{"Renew passport on Nov 3rd", "Renew passport", "on Nov 3rd", at(time.November, 3, 9, 0)},
+		{"Taxes 1 March", "Taxes", "1 March", time.Date(2027, time.March, 1, 9, 0, 0, 0, time.UTC).Format(time.RFC3339)},
+		{"Check oven in 2 hours", "Check oven", "in 2 hours", at(time.October, 16, 16, 30)},
+		{"Party tonight", "Party", "tonight", at(time.October, 16, 20, 0)},
+		{"Buy 2 apples for issue #12", "Buy 2 apples for issue #12", "", ""},
+	} {
+		got := parseQuickAdd(tc.text, now)
+		dueAt := ""
+		if got.DueAt != nil {
+			dueAt = got.DueAt.Format(time.RFC3339)
+		}
+		if got.Title != tc.title || got.Due != tc.due || dueAt != tc.dueAt {
+			t.Errorf("%q: got title %q, due %q at %q; want %q, %q at %q", tc.text, got.Title, got.Due, dueAt, tc.title, tc.due, tc.dueAt)
+		}
+	}
+
+	var created quickAddResponse
+	newRequest(t, "POST", "/v1/todos/quickadd").
+		json(`{"text": "Pay rent tomorrow 5pm #finance !high", "timezone": "America/New_York"}`).
+		expect(fasthttp.StatusCreated).decode(&created)
+	var todo Todo
+	if err := json.Unmarshal(created.Todo, &todo); err != nil {
+		t.Fatal(err)
+	}
+	if todo.Title != "Pay rent" || todo.Priority != "high" || !containsString(todo.Tags, "finance") || todo.DueAt == nil {
+		t.Fatalf("created %+v", todo)
+	}
+	ny, _ := time.LoadLocation("America/New_York")
+	if due := todo.DueAt.In(ny); due.Hour() != 17 || due.Minute() != 0 {
+		t.Errorf("due at %s, want 5pm in New York", due)
+	}
+	if created.Parsed.Due != "tomorrow 5pm" {
+		t.Errorf("parsed %+v", created.Parsed)
+	}
+
+	var plain, preview quickAddResponse
+	req := newRequest(t, "POST", "/v1/todos/quickadd")
+	req.req.SetBodyString("Water plants #home")
+	req.expect(fasthttp.StatusCreated).decode(&plain)
+	if plain.Parsed.Title != "Water plants" || len(plain.Parsed.Tags) != 1 {
+		t.Errorf("plain text body parsed as %+v", plain.Parsed)
+	}
+	newRequest(t, "POST", "/v1/todos/quickadd").json(`{"text": "Dry run", "dry_run": true}`).
+		expect(fasthttp.StatusOK).decode(&preview)
+	if preview.Todo != nil || preview.Parsed.Title != "Dry run" {
+		t.Errorf("dry run returned %+v", preview)
+	}
+	newRequest(t, "POST", "/v1/todos/quickadd").json(`{"text": "#only-tags !low"}`).expect(fasthttp.StatusUnprocessableEntity)
+	newRequest(t, "POST", "/v1/todos/quickadd").json(`{"text": "x", "timezone": "Mars/Olympus"}`).expect(fasthttp.StatusUnprocessableEntity)
+}
+
+func TestMarkdownRendering(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"Ship **v2** and `go`", "<p>Ship <strong>v2</strong> and <code>go</code></p>\n"},
+		{"# Plan\n\n- one\n- _two_", "<h1>Plan</h1>\n<ul>\n<li>one\n</li>\n<li><em>two</em>\n</li>\n</ul>\n"},
+		{"```sh\necho <hi>\n```", "<pre><code class=\"language-sh\">echo &lt;hi&gt;\n</code></pre>\n"},
+		{"[x](javascript:alert(1)) [y](https://a.example \"t\")", "<p>[x](javascript:alert(1)) <a href=\"https://a.example\" title=\"t\" rel=\"nofollow noopener noreferrer\">y</a></p>\n"},
+		{"[x](JavaScript:alert) ![i](data:image/png)", "<p><a rel=\"nofollow noopener noreferrer\">x</a> <img alt=\"i\"></p>\n"},
+		{"hi<script>alert(1)</script> <b onclick=\"x()\">b</b> <div>d</div><!-- c -->", "<p>hi <b>b</b> d</p>\n"},
+		{"snake_case_name & <em>open", "<p>snake_case_name &amp; <em>open</em></p>\n"},
+	}
+	for _, c := range cases {
+		if got := renderMarkdown(c.in); got != c.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	created := createTestTodo(t, `{"title":"Markdown","description":"**bold** <img src=x onerror=alert(1)>"}`)
+	var todo map[string]any
+	newRequest(t, "GET", todoPath(created.ID)+"?render=html").expect(fasthttp.StatusOK).decode(&todo)
+	if todo["description"] != "**bold** <img src=x onerror=alert(1)>" {
+		t.Errorf("description = %q, want the markdown", todo["description"])
+	}
+	if todo["description_html"] != "<p><strong>bold</strong> <img src=\"x\"></p>\n" {
+		t.Errorf("description_html = %q", todo["description_html"])
+	}
+	var list []map[string]any
+	newRequest(t, "GET", "/v1/todos?render=html").expect(fasthttp.StatusOK).decode(&list)
+	for _, item := range list {
+		if _, ok := item["description_html"]; !ok {
+			t.Errorf("todo %v has no description_html", item["id"])
+		}
+	}
+	var plain map[string]any
+	newRequest(t, "GET", todoPath(created.ID)).expect(fasthttp.StatusOK).decode(&plain)
+	if _, ok := plain["description_html"]; ok {
+		t.Errorf("description_html without ?render=html")
+	}
+	newRequest(t, "GET", todoPath(created.ID)+"?render=pdf").expect(fasthttp.StatusBadRequest)
+}
+
+func TestAttachments(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Paperwork"}`)
+	path := todoPath(todo.ID) + "/attachments"
+
+	// Upload a PDF, with its type declared, and a text file whose type
+	// comes from its extension.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	pdf := []byte("%PDF-1.7\n% contract")
+	part, _ := mw.CreatePart(map[string][]string{
+		"Content-Disposition": {`form-data; name="attachments"; filename="contract.pdf"`},
+		"Content-Type":        {"application/pdf"},
+	})
+	part.Write(pdf)
+	part, _ = mw.CreateFormFile("attachments", "notes \"draft\".txt")
+	part.Write([]byte("remember the stamp"))
+	mw.Close()
+	req := newRequest(t, "POST", path)
+	req.req.Header.SetContentType(mw.FormDataContentType())
+	req.req.SetBody(body.Bytes())
+	var added []Attachment
+	req.expect(fasthttp.StatusCreated).decode(&added)
+	if len(added) != 2 || added[0].ID != 1 || added[1].ID != 2 {
+		t.Fatalf("added %+v, want attachments 1 and 2", added)
+	}
+	sum := sha256.Sum256(pdf)
+	if a := added[0]; a.Name != "contract.pdf" || a.MIMEType != "application/pdf" || a.Size != int64(len(pdf)) ||
+		a.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("PDF attachment %+v", a)
+	}
+	if a := added[1]; !strings.HasPrefix(a.MIMEType, "text/plain") || a.Name != `notes "draft".txt` {
+		t.Errorf("text attachment %+v", a)
+	}
+
+	var list []Attachment
+	newRequest(t, "GET", path).expect(fasthttp.StatusOK).decode(&list)
+	if len(list) != 2 {
+		t.Errorf("listed %d attachments, want 2", len(list))
+	}
+	var got Attachment
+	newRequest(t, "GET", path+"/1").expect(fasthttp.StatusOK).decode(&got)
+	if got.Checksum != added[0].Checksum {
+		t.Errorf("attachment 1 = %+v", got)
+	}
+
+	resp := newRequest(t, "GET", path+"/1/content").expect(fasthttp.StatusOK)
+	if !bytes.Equal(resp.body, pdf) || string(resp.header.ContentType()) != "application/pdf" ||
+		string(resp.header.Peek("Content-Disposition")) != `attachment; filename=contract.pdf` {
+		t.Errorf("download: %s %q %q", resp.header.ContentType(), resp.header.Peek("Content-Disposition"), resp.body)
+	}
+	resp = newRequest(t, "GET", path+"/2/content?disposition=inline").expect(fasthttp.StatusOK)
+	if string(resp.header.Peek("Content-Disposition")) != `inline; filename="notes \"draft\".txt"` {
+		t.Errorf("inline download: Content-Disposition %q", resp.header.Peek("Content-Disposition"))
+	}
+
+	newRequest(t, "DELETE", path+"/1").expect(fasthttp.StatusNoContent)
+	newRequest(t, "GET", path+"/1").expect(fasthttp.StatusNotFound)
+	newRequest(t, "DELETE", path+"/1").expect(fasthttp.StatusNotFound)
+	newRequest(t, "GET", path+"/x").expect(fasthttp.StatusBadRequest)
+	newRequest(t, "POST", path).json(`{}`).expect(fasthttp.StatusBadRequest)
+
+	// Todos stored with images get them as attachments.
+	s := newTodoStore(1)
+	s.insert("test", &Todo{Title: "legacy", Images: []string{added[1].Path, "uploads/1_gone.png"}})
+	legacy, _ := s.get(1)
+	if len(legacy.Images) != 0 || len(legacy.Attachments) != 2 ||
+		legacy.Attachments[0].Checksum != added[1].Checksum || legacy.Attachments[1].Name != "gone.png" ||
+		legacy.Attachments[1].MIMEType != "image/png" {
+		t.Errorf("legacy images became %+v", legacy.Attachments)
+	}
+}
+
+func TestImportedAttachmentsStayInUploads(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, _ := zw.Create("todos.json")
+	w.Write([]byte(`[{"id": 800001, "title": "Imported", "status": "backlog", "attachments": [
+		{"id": 1, "name": "passwd", "path": "/etc/passwd"},
+		{"id": 2, "name": "secret", "path": "uploads/../secret.txt"},
+		{"id": 3, "name": "notes.txt", "path": "uploads/1_notes.txt"}
+	], "images": ["/etc/hosts"]}]`))
+	w, _ = zw.Create("uploads/1_notes.txt")
+	w.Write([]byte("restored"))
+	zw.Close()
+
+	var job Job
+	req := newRequest(t, "POST", "/v1/import").header("Content-Type", "application/zip")
+	req.req.SetBody(archive.Bytes())
+	req.expect(fasthttp.StatusAccepted).decode(&job)
+	waitForJob(t, job, "")
+
+	var todo Todo
+	newRequest(t, "GET", todoPath(800001)).expect(fasthttp.StatusOK).decode(&todo)
+	if len(todo.Attachments) != 1 || todo.Attachments[0].Name != "notes.txt" {
+		t.Fatalf("imported attachments %+v", todo.Attachments)
+	}
+	body := newRequest(t, "GET", todoPath(800001)+"/attachments/3/content").expect(fasthttp.StatusOK).body
+	if string(body) != "restored" {
+		t.Errorf("downloaded %q", body)
+	}
+	if !inUploads("uploads", "uploads/1_a.png") || inUploads("uploads", "/etc/passwd") ||
+		inUploads("uploads", "uploads/../x") || inUploads("uploads", "uploads/.partial") {
+		t.Error("inUploads accepts the wrong paths")
+	}
+}
+
+// waitForJob polls the job, as the caller with the API key, until it is
+// done and fails the test if it doesn't finish successfully.
+func waitForJob(t *testing.T, job Job, key string) Job {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); job.State != jobDone; time.Sleep(10 * time.Millisecond) {
+		if job.State == jobFailed || time.Now().After(deadline) {
+			t.Fatalf("%s job %+v", job.Kind, job)
+		}
+		newRequest(t, "GET", "/v1/jobs/"+strconv.Itoa(job.ID)).header("X-API-Key", key).expect(fasthttp.StatusOK).decode(&job)
+	}
+	return job
+}
+
+func TestExportOnlyHoldsVisibleTodos(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Hide the spare key", "project": "home"}`).expect(fasthttp.StatusCreated)
+
+	var job Job
+	newRequest(t, "POST", "/v1/export").header("X-API-Key", "alice-key").expect(fasthttp.StatusAccepted).decode(&job)
+	job = waitForJob(t, job, "alice-key")
+	path := "/v1/jobs/" + strconv.Itoa(job.ID)
+	newRequest(t, "GET", path).header("X-API-Key", "bob-key").expect(fasthttp.StatusNotFound)
+	newRequest(t, "GET", path+"/result").header("X-API-Key", "bob-key").expect(fasthttp.StatusNotFound)
+	var listed []Job
+	newRequest(t, "GET", "/v1/jobs").header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).decode(&listed)
+	for _, j := range listed {
+		if j.ID == job.ID {
+			t.Errorf("bob sees alice's export job")
+		}
+	}
+
+	archive := newRequest(t, "GET", path+"/result").header("X-API-Key", "alice-key").expect(fasthttp.StatusOK).body
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("todos.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var todos []Todo
+	if err := json.NewDecoder(f).Decode(&todos); err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) == 0 {
+		t.Fatal("alice's export is empty")
+	}
+	for _, todo := range todos {
+		if todo.Title == "Hide the spare key" {
+			t.Errorf("alice's export holds bob's todo %d", todo.ID)
+		}
+	}
+}
+
+func TestResumableUploads(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Big file"}`)
+	resp := newRequest(t, "OPTIONS", "/v1/uploads").expect(fasthttp.StatusNoContent)
+	if string(resp.header.Peek("Tus-Version")) != "1.0.0" || !strings.Contains(string(resp.header.Peek("Tus-Extension")), "creation") {
+		t.Errorf("OPTIONS: Tus-Version %q, Tus-Extension %q", resp.header.Peek("Tus-Version"), resp.header.Peek("Tus-Extension"))
+	}
+	newRequest(t, "POST", "/v1/uploads").header("Upload-Length", "10").expect(fasthttp.StatusPreconditionFailed)
+
+	tus := func(method, path string) *apiRequest {
+		return newRequest(t, method, path).header("Tus-Resumable", "1.0.0")
+	}
+	chunk := func(method, path, offset, data string) *apiRequest {
+		r := tus(method, path).header("Upload-Offset", offset).header("Content-Type", "application/offset+octet-stream")
+		r.req.SetBodyString(data)
+		return r
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	metadata := "todo_id " + b64([]byte(strconv.Itoa(todo.ID))) + ",filename " + b64([]byte("notes.txt")) + ",filetype " + b64([]byte("text/plain"))
+
+	// The first chunk comes with the creation.
+	create := chunk("POST", "/v1/uploads", "0", "0123").header("Upload-Length", "10").header("Upload-Metadata", metadata)
+	resp = create.expect(fasthttp.StatusCreated)
+	location := string(resp.header.Peek("Location"))
+	if !strings.HasPrefix(location, "/v1/uploads/") || string(resp.header.Peek("Upload-Offset")) != "4" ||
+		len(resp.header.Peek("Upload-Expires")) == 0 {
+		t.Fatalf("created upload at %q, offset %q", location, resp.header.Peek("Upload-Offset"))
+	}
+	resp = tus("HEAD", location).expect(fasthttp.StatusOK)
+	if string(resp.header.Peek("Upload-Offset")) != "4" || string(resp.header.Peek("Upload-Length")) != "10" {
+		t.Errorf("HEAD: offset %q, length %q", resp.header.Peek("Upload-Offset"), resp.header.Peek("Upload-Length"))
+	}
+	chunk("PATCH", location, "2", "23456789").expect(fasthttp.StatusConflict)
+	chunk("PATCH", location, "4", "4567890123").expect(fasthttp.StatusRequestEntityTooLarge)
+	tus("PATCH", location).header("Upload-Offset", "4").json(`"456789"`).expect(fasthttp.StatusUnsupportedMediaType)
+	resp = chunk("PATCH", location, "4", "45").expect(fasthttp.StatusNoContent)
+	if string(resp.header.Peek("Upload-Offset")) != "6" {
+		t.Errorf("offset after a chunk: %q", resp.header.Peek("Upload-Offset"))
+	}
+	resp = chunk("PATCH", location, "6", "6789").expect(fasthttp.StatusNoContent)
+	attachment := string(resp.header.Peek("X-Attachment-Location"))
+	if attachment != todoPath(todo.ID)+"/attachments/1" {
+		t.Errorf("completed upload attached at %q", attachment)
+	}
+	var a Attachment
+	newRequest(t, "GET", attachment).expect(fasthttp.StatusOK).decode(&a)
+	sum := sha256.Sum256([]byte("0123456789"))
+	if a.Name != "notes.txt" || a.Size != 10 || a.MIMEType != "text/plain" || a.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("attachment %+v", a)
+	}
+	tus("HEAD", location).expect(fasthttp.StatusNotFound)
+
+	// Terminated and expired uploads are gone.
+	resp = tus("POST", "/v1/uploads").header("Upload-Length", "10").header("Upload-Metadata", metadata).expect(fasthttp.StatusCreated)
+	location = string(resp.header.Peek("Location"))
+	tus("DELETE", location).expect(fasthttp.StatusNoContent)
+	tus("HEAD", location).expect(fasthttp.StatusNotFound)
+	resp = tus("POST", "/v1/uploads").header("Upload-Length", "10").header("Upload-Metadata", metadata).expect(fasthttp.StatusCreated)
+	location = string(resp.header.Peek("Location"))
+	reapUploads(time.Now().Add(uploadExpiry + time.Minute))
+	tus("HEAD", location).expect(fasthttp.StatusNotFound)
+
+	tus("POST", "/v1/uploads").header("Upload-Length", "10").header("Upload-Metadata", "filename "+b64([]byte("a.txt"))).
+		expect(fasthttp.StatusBadRequest)
+	tus("POST", "/v1/uploads").header("Upload-Length", strconv.Itoa(maxUploadSize+1)).header("Upload-Metadata", metadata).
+		expect(fasthttp.StatusRequestEntityTooLarge)
+}
+
+func TestResumableUploadsNeedPermission(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var theirs Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Tax return", "project": "home"}`).expect(fasthttp.StatusCreated).decode(&theirs)
+	b64 := base64.StdEncoding.EncodeToString
+	metadata := "todo_id " + b64([]byte(strconv.Itoa(theirs.ID))) + ",filename " + b64([]byte("payslip.pdf"))
+	create := func() *apiRequest {
+		return newRequest(t, "POST", "/v1/uploads").header("X-API-Key", "alice-key").header("Tus-Resumable", "1.0.0").
+			header("Upload-Length", "4").header("Upload-Metadata", metadata)
+	}
+	share := func(role string) {
+		newRequest(t, "POST", todoPath(theirs.ID)+"/share").header("X-API-Key", "bob-key").
+			json(`{"user": "alice", "role": "` + role + `"}`).expect(fasthttp.StatusCreated)
+	}
+
+	create().expect(fasthttp.StatusNotFound)
+	share("viewer")
+	create().expect(fasthttp.StatusForbidden)
+
+	// Losing access during the upload keeps the file from being attached.
+	share("editor")
+	location := string(create().expect(fasthttp.StatusCreated).header.Peek("Location"))
+	newRequest(t, "DELETE", todoPath(theirs.ID)+"/share/alice").header("X-API-Key", "bob-key").expect(fasthttp.StatusNoContent)
+	patch := newRequest(t, "PATCH", location).header("X-API-Key", "alice-key").header("Tus-Resumable", "1.0.0").
+		header("Upload-Offset", "0").header("Content-Type", "application/offset+octet-stream")
+	patch.req.SetBodyString("%PDF")
+	patch.expect(fasthttp.StatusNotFound)
+	var got Todo
+	newRequest(t, "GET", todoPath(theirs.ID)).header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).decode(&got)
+	if len(got.Attachments) != 0 {
+		t.Errorf("attached %+v", got.Attachments)
+	}
+}
+
+func TestImageMetadata(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Holiday photos"}`)
+	path := todoPath(todo.ID) + "/attachments"
+	upload := func(name, mimeType string, data []byte) (Attachment, []byte) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreatePart(map[string][]string{
+			"Content-Disposition": {`form-data; name="attachments"; filename="` + name + `"`},
+			"Content-Type":        {mimeType},
+		})
+		part.Write(data)
+		mw.Close()
+		req := newRequest(t, "POST", path)
+		req.req.Header.SetContentType(mw.FormDataContentType())
+		req.req.SetBody(body.Bytes())
+		var added []Attachment
+		req.expect(fasthttp.StatusCreated).decode(&added)
+		stored := newRequest(t, "GET", path+"/"+strconv.Itoa(added[0].ID)+"/content").expect(fasthttp.StatusOK).body
+		sum := sha256.Sum256(stored)
+		if added[0].Size != int64(len(stored)) || added[0].Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: attachment %+v doesn't describe the stored file", name, added[0])
+		}
+		return added[0], stored
+	}
+
+	// A 16x8 photo, red on the left and blue on the right, taken with the
+	// camera turned clockwise (orientation 6), with a location in its
+	// description, XMP and a comment.
+	photo := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			photo.Set(x, y, c)
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, photo, &jpeg.Options{Quality: 95})
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00\x02\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x010e) // ImageDescription
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 12)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 38)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 6)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "48.8584N 2.29E\x00"...)
+	segment := func(marker byte, data string) []byte {
+		s := []byte{0xff, marker}
+		s = binary.BigEndian.AppendUint16(s, uint16(len(data)+2))
+		return append(s, data...)
+	}
+	jpg := []byte{0xff, 0xd8}
+	jpg = append(jpg, segment(0xe1, "Exif\x00\x00"+string(tiff))...)
+	jpg = append(jpg, segment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>48.8584N</x:xmpmeta>")...)
+	jpg = append(jpg, segment(0xfe, "taken at 48.8584N")...)
+	jpg = append(jpg, encoded.Bytes()[2:]...)
+	if got := exifOrientation(tiff); got != 6 {
+		t.Fatalf("exifOrientation = %d, want 6", got)
+	}
+
+	// The photo is turned upright, with the red half on top, and loses its
+	// metadata.
+	_, stored := upload("eiffel.jpg", "image/jpeg", jpg)
+	if bytes.Contains(stored, []byte("48.8584N")) || bytes.Contains(stored, []byte("Exif")) {
+		t.Error("rotated photo kept its metadata")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 {
+		t.Fatalf("rotated photo is %dx%d, want 8x16", b.Dx(), b.Dy())
+	}
+	if r, _, b, _ := img.At(4, 3).RGBA(); r < 0xc000 || b > 0x4000 {
+		t.Errorf("top of the rotated photo isn't red")
+	}
+	if r, _, b, _ := img.At(4, 12).RGBA(); b < 0xc000 || r > 0x4000 {
+		t.Errorf("bottom of the rotated photo isn't blue")
+	}
+
+	// Without auto-orientation, the photo keeps its orientation, and the
+	// rest of the image data is untouched.
+	autoOrientImages = false
+	defer func() { autoOrientImages = true }()
+	_, stored = upload("eiffel.jpg", "image/jpeg", jpg)
+	if bytes.Contains(stored, []byte("48.8584N")) || !bytes.HasSuffix(stored, encoded.Bytes()[2:]) {
+		t.Error("photo wasn't stripped losslessly")
+	}
+	segments, _ := jpegSegments(stored)
+	if len(segments) == 0 || segments[0].marker != 0xe1 || exifOrientation(segments[0].data[10:]) != 6 {
+		t.Error("stripped photo lost its orientation")
+	}
+
+	// With both off, images are stored as uploaded.
+	stripImageMetadata = false
+	defer func() { stripImageMetadata = true }()
+	if _, stored = upload("eiffel.jpg", "image/jpeg", jpg); !bytes.Equal(stored, jpg) {
+		t.Error("photo was changed with processing off")
+	}
+	stripImageMetadata = true
+
+	// PNG text chunks go, and so does an upright orientation.
+	var pngData bytes.Buffer
+	png.Encode(&pngData, photo)
+	chunk := func(typ, data string) []byte {
+		c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		c = append(append(c, typ...), data...)
+		return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+	}
+	ihdrEnd := len(pngSignature) + 25
+	pngFile := append([]byte{}, pngData.Bytes()[:ihdrEnd]...)
+	pngFile = append(pngFile, chunk("tEXt", "Comment\x0048.8584N")...)
+	pngFile = append(pngFile, chunk("eXIf", string(minimalExif(1)))...)
+	pngFile = append(pngFile, pngData.Bytes()[ihdrEnd:]...)
+	if _, stored = upload("eiffel.png", "image/png", pngFile); !bytes.Equal(stored, pngData.Bytes()) {
+		t.Error("PNG wasn't stripped")
+	}
+
+	// Anything else is left alone.
+	if _, stored = upload("fake.jpg", "image/jpeg", []byte("not a photo")); string(stored) != "not a photo" {
+		t.Errorf("invalid image stored as %q", stored)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	expiring := createTestTodo(t, `{"title": "Ephemeral", "ttl": "1h"}`)
+	kept := createTestTodo(t, `{"title": "Kept", "expires_at": "2099-01-01T00:00:00Z"}`)
+	if expiring.ExpiresAt == nil || time.Until(*expiring.ExpiresAt) > time.Hour {
+		t.Fatalf("expires_at %v, want within an hour", expiring.ExpiresAt)
+	}
+
+	reaped := reapExpired(defaultNamespace, time.Now().Add(2*time.Hour), false)
+	if !containsInt(reaped, expiring.ID) || containsInt(reaped, kept.ID) {
+		t.Fatalf("reaped %v, want %d but not %d", reaped, expiring.ID, kept.ID)
+	}
+	newRequest(t, "GET", todoPath(expiring.ID)).expect(fasthttp.StatusGone)
+	newRequest(t, "GET", todoPath(kept.ID)).expect(fasthttp.StatusOK)
+}
+
+func TestCreateTodoEncodings(t *testing.T) {
+	var form Todo
+	newRequest(t, "POST", "/v1/todos").
+		header("Content-Type", "application/x-www-form-urlencoded").
+		expect(fasthttp.StatusUnprocessableEntity)
+	req := newRequest(t, "POST", "/v1/todos").header("Content-Type", "application/x-www-form-urlencoded")
+	req.req.SetBodyString("title=Water+plants&tags=home,garden")
+	req.expect(fasthttp.StatusCreated).decode(&form)
+	if form.Title != "Water plants" || len(form.Tags) != 2 {
+		t.Errorf("created %+v from a URL-encoded form", form)
+	}
+
+	var upload Todo
+	image := []byte("\x89PNG\r\n\x1a\nimage")
+	newRequest(t, "POST", "/v1/todos").
+		multipart(map[string]string{"title": "Frame photo"}, map[string][]byte{"images": image}).
+		expect(fasthttp.StatusCreated).decode(&upload)
+	if len(upload.Attachments) != 1 {
+		t.Fatalf("created %+v, want one attachment", upload)
+	}
+	saved, err := os.ReadFile(upload.Attachments[0].Path)
+	if err != nil || !bytes.Equal(saved, image) {
+		t.Errorf("uploaded image saved as %q, %v", saved, err)
+	}
+
+	// JSON updates keep the attachments, only multipart bodies replace them.
+	var updated Todo
+	newRequest(t, "PUT", todoPath(upload.ID)).json(`{"title": "Frame the photo"}`).expect(fasthttp.StatusOK).decode(&updated)
+	if len(updated.Attachments) != 1 || updated.Attachments[0] != upload.Attachments[0] {
+		t.Errorf("attachments after a JSON update: %v, want %v", updated.Attachments, upload.Attachments)
+	}
+}
+
+// encodingTestDocument exercises every branch of the XML and MessagePack
+// encoders: all length classes of strings, maps and arrays, all integer
+// sizes, floats, and keys that aren't valid XML names.
+func encodingTestDocument() string {
+	var keys []string
+	for i := range 17 {
+		keys = append(keys, fmt.Sprintf(`"k%d": %d`, i, i))
+	}
+	var items []string
+	for i := range 17 {
+		items = append(items, strconv.Itoa(-i))
+	}
+	return `{
+		"title": "Milk & <eggs> \"fresh\" ünïcode",
+		"short": "` + strings.Repeat("a", 40) + `",
+		"medium": "` + strings.Repeat("b", 300) + `",
+		"long": "` + strings.Repeat("c", 70000) + `",
+		"ints": [0, 127, 128, -1, -32, -33, -128, -129, 255, 32767, -32769, 65536, 2147483647, -2147483649, 1099511627776],
+		"floats": [1.5, -0.25, 1e300],
+		"flags": [true, false, null],
+		"empty": {"object": {}, "array": [], "string": ""},
+		"big": {` + strings.Join(keys, ", ") + `},
+		"many": [` + strings.Join(items, ", ") + `],
+		"1st": "digit", "xmlish": "reserved", "with space": "a", "a&b": "b", "ключ": "c", "entry": "plain"
+	}`
+}
+
+// flattenJSON lists the leaves of a JSON document in order as path=value
+// lines, the way appendXMLElement lays them out: array items are "item"
+// elements, and null values and empty objects and arrays empty elements.
+func flattenJSON(t *testing.T, data string) []string {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var out []string
+	var value func(path string)
+	value = func(path string) {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch v := tok.(type) {
+		case json.Delim:
+			empty := true
+			for dec.More() {
+				empty = false
+				if v == '[' {
+					value(path + "/item")
+					continue
+				}
+				key, _ := dec.Token()
+				value(path + "/" + key.(string))
+			}
+			dec.Token()
+			if empty {
+				out = append(out, path+"=")
+			}
+		case string:
+			out = append(out, path+"="+v)
+		case json.Number:
+			out = append(out, path+"="+v.String())
+		case bool:
+			out = append(out, path+"="+strconv.FormatBool(v))
+		case nil:
+			out = append(out, path+"=")
+		}
+	}
+	value("response")
+	return out
+}
+
+// flattenXML lists the leaf elements of an XML document like flattenJSON,
+// naming <entry> elements by their key.
+func flattenXML(t *testing.T, data []byte) []string {
+	t.Helper()
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var out, path []string
+	var text strings.Builder
+	leaf := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("decoding the XML response: %s", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := tok.Name.Local
+			for _, attr := range tok.Attr {
+				if name == "entry" && attr.Name.Local == "key" {
+					name = attr.Value
+				}
+			}
+			path = append(path, name)
+			text.Reset()
+			leaf = true
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if leaf {
+				out = append(out, strings.Join(path, "/")+"="+text.String())
+			}
+			path = path[:len(path)-1]
+			leaf = false
+		}
+	}
+}
+
+// decodeMsgpack decodes a MessagePack value into the types json.Unmarshal
+// uses, except that integers are int64.
+func decodeMsgpack(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	c, b := b[0], b[1:]
+	size := func(n int) (int, error) {
+		if len(b) < n {
+			return 0, io.ErrUnexpectedEOF
+		}
+		var v uint64
+		for _, x := range b[:n] {
+			v = v<<8 | uint64(x)
+		}
+		b = b[n:]
+		return int(v), nil
+	}
+	var n int
+	var err error
+	switch {
+	case c <= 0x7f:
+		return int64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c >= 0xa0 && c <= 0xbf, c == 0xd9, c == 0xda, c == 0xdb:
+		switch c {
+		case 0xd9:
+			n, err = size(1)
+		case 0xda:
+			n, err = size(2)
+		case 0xdb:
+			n, err = size(4)
+		default:
+			n = int(c & 0x1f)
+		}
+		if err != nil || len(b) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return string(b[:n]), b[n:], nil
+	case c >= 0x80 && c <= 0x8f, c == 0xde, c == 0xdf:
+		switch c {
+		case 0xde:
+			n, err = size(2)
+		case 0xdf:
+			n, err = size(4)
+		default:
+			n = int(c & 0x0f)
+		}
+		m := map[string]any{}
+		for range n {
+			var k, v any
+			if k, b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+			if v, b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("map key %v isn't a string", k)
+			}
+			m[key] = v
+		}
+		return m, b, err
+	case c >= 0x90 && c <= 0x9f, c == 0xdc, c == 0xdd:
+		switch c {
+		case 0xdc:
+			n, err = size(2)
+		case 0xdd:
+			n, err = size(4)
+		default:
+			n = int(c & 0x0f)
+		}
+		list := []any{}
+		for range n {
+			var v any
+			if v, b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+		}
+		return list, b, err
+	case c >= 0xd0 && c <= 0xd3:
+		width := 1 << (c - 0xd0)
+		if n, err = size(width); err != nil {
+			return nil, nil, err
+		}
+		shift := 64 - 8*width
+		return int64(n) << shift >> shift, b, nil
+	case c == 0xcb:
+		if len(b) < 8 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case c == 0xc0:
+		return nil, b, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, b, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected MessagePack type %#x", c)
+}
+
+// jsonValue decodes a JSON document like decodeMsgpack decodes MessagePack.
+func jsonValue(t *testing.T, data string) any {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	var convert func(v any) any
+	convert = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, item := range v {
+				v[k] = convert(item)
+			}
+		case []any:
+			for i, item := range v {
+				v[i] = convert(item)
+			}
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n
+			}
+			f, _ := v.Float64()
+			return f
+		}
+		return v
+	}
+	return convert(v)
+}
+
+func TestResponseEncodersRoundTrip(t *testing.T) {
+	doc := encodingTestDocument()
+	root, err := parseJSONTree([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := append([]byte(xml.Header), appendXMLElement(nil, "response", root)...)
+	if got, want := flattenXML(t, encoded), flattenJSON(t, doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("XML round trip:\n got %.300q\nwant %.300q", got, want)
+	}
+
+	got, rest, err := decodeMsgpack(appendMsgpack(nil, root))
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decoding MessagePack: %v, %d bytes left", err, len(rest))
+	}
+	if want := jsonValue(t, doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("MessagePack round trip:\n got %.300v\nwant %.300v", got, want)
+	}
+
+	due := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	created := time.Date(2026, 10, 16, 9, 30, 0, 123456789, time.UTC)
+	todo := Todo{
+		ID: 42, UUID: "0193b5d6-8a4c-7b2e-9f10-3c4d5e6f7a8b",
+		Title: "Milk & <eggs> ünïcode", Description: strings.Repeat("d", 300),
+		Completed: true, Status: statusDone,
+		Attachments: []Attachment{{ID: 1, Name: "photo.png", Size: 1 << 33, MIMEType: "image/png",
+			Checksum: strings.Repeat("ab", 32), Path: "uploads/photo.png", CreatedAt: created}},
+		Subtasks: []Subtask{{ID: 1, Title: "Buy", Completed: true}, {ID: 2, Title: "Carry"}},
+		Priority: "high", Project: "home", Tags: []string{"errand", "food"}, Assignee: "bob",
+		DueAt: &due, RemindAt: &created, ExpiresAt: &due,
+		CreatedAt: created, UpdatedAt: due, CompletedAt: &due, ArchivedAt: &created,
+		Recurrence: "0 9 * * 1", SeriesID: 7, NextOccurrence: 43,
+		Links:    []Link{{Type: "blocks", TodoID: 41}},
+		Position: -1.5,
+	}
+	decoded, err := decodeTodoProto(appendTodoProto(nil, &todo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decoded, todo) {
+		t.Errorf("protocol buffers round trip:\n got %+v\nwant %+v", *decoded, todo)
+	}
+}
+
+func TestNegotiatedResponsesRoundTrip(t *testing.T) {
+	created := createTestTodo(t, `{"title": "Milk & <eggs>", "description": "ünïcode", "priority": "high",
+		"tags": ["errand", "food"], "subtasks": [{"title": "Buy"}, {"title": "Carry"}], "due_at": "2030-01-02T03:04:05Z"}`)
+	resp := newRequest(t, "GET", todoPath(created.ID)).expect(fasthttp.StatusOK)
+	doc := string(resp.body)
+
+	resp = newRequest(t, "GET", todoPath(created.ID)).header("Accept", "application/xml").expect(fasthttp.StatusOK)
+	if got, want := flattenXML(t, resp.body), flattenJSON(t, doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("XML response:\n got %q\nwant %q", got, want)
+	}
+
+	resp = newRequest(t, "GET", todoPath(created.ID)).header("Accept", "application/msgpack").expect(fasthttp.StatusOK)
+	got, rest, err := decodeMsgpack(resp.body)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decoding the MessagePack response: %v, %d bytes left", err, len(rest))
+	}
+	if want := jsonValue(t, doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("MessagePack response:\n got %v\nwant %v", got, want)
+	}
+
+	resp = newRequest(t, "GET", todoPath(created.ID)).header("Accept", "application/x-protobuf").expect(fasthttp.StatusOK)
+	decoded, err := decodeTodoProto(resp.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var todo Todo
+	json.Unmarshal([]byte(doc), &todo)
+	gotJSON, _ := json.Marshal(decoded)
+	wantJSON, _ := json.Marshal(todo)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("protocol buffers response:\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Errors"}`)
+	for _, tt := range []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"missing content type", "POST", "/v1/todos", "", `{"title": "a"}`, fasthttp.StatusUnsupportedMediaType},
+		{"unsupported content type", "POST", "/v1/todos", "text/plain", "a", fasthttp.StatusUnsupportedMediaType},
+		{"malformed JSON", "POST", "/v1/todos", "application/json", `{"title": `, fasthttp.StatusBadRequest},
+		{"missing title", "POST", "/v1/todos", "application/json", `{}`, fasthttp.StatusUnprocessableEntity},
+		{"invalid status", "POST", "/v1/todos", "application/json", `{"title": "a", "status": "someday"}`, fasthttp.StatusUnprocessableEntity},
+		{"invalid subtasks", "POST", "/v1/todos", "application/json", `{"title": "a", "subtasks": {"title": "b"}}`, fasthttp.StatusUnprocessableEntity},
+		{"invalid ttl", "POST", "/v1/todos", "application/json", `{"title": "a", "ttl": "-1h"}`, fasthttp.StatusUnprocessableEntity},
+		{"ttl and expiry", "POST", "/v1/todos", "application/json", `{"title": "a", "ttl": "1h", "expires_at": "2030-01-01T00:00:00Z"}`, fasthttp.StatusUnprocessableEntity},
+		{"invalid completed", "POST", "/v1/todos", "application/json", `{"title": "a", "completed": "maybe"}`, fasthttp.StatusUnprocessableEntity},
+		{"multipart without boundary", "POST", "/v1/todos", "multipart/form-data", "", fasthttp.StatusBadRequest},
+		{"truncated multipart", "POST", "/v1/todos", "multipart/form-data; boundary=xyz", "--xyz\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\na", fasthttp.StatusBadRequest},
+		{"invalid ID", "GET", "/v1/todos/abc", "", "", fasthttp.StatusBadRequest},
+		{"unknown todo", "GET", "/v1/todos/999999", "", "", fasthttp.StatusNotFound},
+		{"method not allowed", "POST", todoPath(todo.ID), "", "", fasthttp.StatusMethodNotAllowed},
+		{"unknown route", "GET", "/v1/nothing", "", "", fasthttp.StatusNotFound},
+		{"unsupported version", "GET", "/v9/todos", "", "", fasthttp.StatusNotFound},
+		{"invalid list format", "GET", "/v1/todos?format=yaml", "", "", fasthttp.StatusBadRequest},
+		{"empty comment", "POST", todoPath(todo.ID) + "/comments", "application/json", `{"body": " "}`, fasthttp.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, tt.method, tt.path)
+			if tt.contentType != "" {
+				req.header("Content-Type", tt.contentType)
+			}
+			req.req.SetBodyString(tt.body)
+			req.expect(tt.want)
+		})
+	}
+}
+
+func TestRejectedUpdateIsDiscarded(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Keep me", "description": "d1"}`)
+	newRequest(t, "PUT", todoPath(todo.ID)).json(`{"title": "   "}`).expect(fasthttp.StatusUnprocessableEntity)
+	newRequest(t, "PUT", todoPath(todo.ID)).json(`{"status": "someday"}`).expect(fasthttp.StatusUnprocessableEntity)
+
+	var got Todo
+	newRequest(t, "GET", todoPath(todo.ID)).expect(fasthttp.StatusOK).decode(&got)
+	if got.Title != "Keep me" || got.Status != todo.Status {
+		t.Errorf("rejected updates were kept: %+v", got)
+	}
+	newRequest(t, "PUT", todoPath(todo.ID)).json(`{"description": "d2"}`).expect(fasthttp.StatusOK).decode(&got)
+	if got.Title != "Keep me" || got.Description != "d2" {
+		t.Errorf("updated %+v", got)
+	}
+}
+
+func TestListsOnlyShowVisibleTodos(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var home, work Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Fix the sink", "project": "home"}`).expect(fasthttp.StatusCreated).decode(&home)
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Ship it", "project": "work"}`).expect(fasthttp.StatusCreated).decode(&work)
+
+	for _, path := range []string{
+		"/v1/todos", "/v1/todos?sort=position", "/v1/todos?view=summary", "/v1/todos?limit=10&cursor=" + encodeCursor(home.ID-1),
+		"/v1/todos?group_by=status", "/v1/todos?format=ndjson", "/v1/todos?ready=true",
+	} {
+		// Bob's response is cached first, and mustn't be served to Alice.
+		body := newRequest(t, "GET", path).header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).body
+		if !bytes.Contains(body, []byte("Fix the sink")) {
+			t.Errorf("%s: bob doesn't see his home todo", path)
+		}
+		body = newRequest(t, "GET", path).header("X-API-Key", "alice-key").expect(fasthttp.StatusOK).body
+		if bytes.Contains(body, []byte("Fix the sink")) || !bytes.Contains(body, []byte("Ship it")) {
+			t.Errorf("%s: alice doesn't see just the work todo", path)
+		}
+	}
+	newRequest(t, "GET", "/v1/todos").expect(fasthttp.StatusUnauthorized)
+	newRequest(t, "GET", todoPath(home.ID)).header("X-API-Key", "alice-key").expect(fasthttp.StatusNotFound)
+}
+
+func TestDeletedTodosKeepTheirPermissions(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	var home Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Spare key under the mat", "project": "home"}`).expect(fasthttp.StatusCreated).decode(&home)
+	newRequest(t, "DELETE", todoPath(home.ID)).header("X-API-Key", "bob-key").expect(fasthttp.StatusNoContent)
+
+	newRequest(t, "GET", todoPath(home.ID)+"/history").header("X-API-Key", "alice-key").expect(fasthttp.StatusNotFound)
+	newRequest(t, "POST", todoPath(home.ID)+"/undo").header("X-API-Key", "alice-key").expect(fasthttp.StatusNotFound)
+	newRequest(t, "GET", todoPath(home.ID)+"/history").header("X-API-Key", "bob-key").expect(fasthttp.StatusOK)
+	newRequest(t, "POST", todoPath(home.ID)+"/undo").header("X-API-Key", "bob-key").expect(fasthttp.StatusOK)
+}
+
+func TestProjectStatsNeedPermission(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor")
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Paint the fence", "project": "garden"}`).expect(fasthttp.StatusCreated)
+
+	newRequest(t, "GET", "/v1/projects/garden/stats").header("X-API-Key", "alice-key").expect(fasthttp.StatusNotFound)
+	newRequest(t, "GET", "/v1/projects/garden/stats").header("X-API-Key", "bob-key").expect(fasthttp.StatusOK)
+	newRequest(t, "POST", "/v1/projects/garden/share").header("X-API-Key", "bob-key").
+		json(`{"user": "alice", "role": "viewer"}`).expect(fasthttp.StatusCreated)
+	newRequest(t, "GET", "/v1/projects/garden/stats").header("X-API-Key", "alice-key").expect(fasthttp.StatusOK)
+}
+
+// createTestNamespace provisions the namespace of a tenant.
+func createTestNamespace(t *testing.T, id string) {
+	t.Helper()
+	newRequest(t, "POST", "/v1/admin/namespaces").header("X-Admin-Token", testAdminToken).
+		json(`{"id": "` + id + `"}`).expect(fasthttp.StatusCreated)
+}
+
+func TestAPIKeysMustBeUnique(t *testing.T) {
+	for _, spec := range []string{
+		"alice:k1=*,bob:k1=work",
+		"alice:k1=*,alice:k2=work@viewer",
+		"k1=*,api-key-1:k2=work",
+	} {
+		if _, err := parseAPIKeys(spec); err == nil {
+			t.Errorf("parseAPIKeys(%q) accepted a duplicate", spec)
+		}
+	}
+	if _, err := parseAPIKeys("alice:k1=*,bob:k2=work"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTenantsNeedAccessAndKeepTheirShares(t *testing.T) {
+	createTestNamespace(t, "acme-shares")
+	withAPIKeys(t, "alice:alice-key=*@editor#acme-shares,bob:bob-key=*@editor,carol:carol-key=work@editor#*")
+	tenant := func(r *apiRequest) *apiRequest { return r.header("X-Tenant-ID", "acme-shares") }
+
+	tenant(newRequest(t, "GET", "/v1/todos")).header("X-API-Key", "bob-key").expect(fasthttp.StatusNotFound)
+	tenant(newRequest(t, "POST", "/v1/todos")).header("X-API-Key", "bob-key").
+		json(`{"title": "Sneak in"}`).expect(fasthttp.StatusNotFound)
+
+	var todo Todo
+	tenant(newRequest(t, "POST", "/v1/todos")).header("X-API-Key", "alice-key").
+		json(`{"title": "Order toner", "project": "office"}`).expect(fasthttp.StatusCreated).decode(&todo)
+	path := todoPath(todo.ID)
+	tenant(newRequest(t, "GET", path)).header("X-API-Key", "carol-key").expect(fasthttp.StatusNotFound)
+	tenant(newRequest(t, "POST", path+"/share")).header("X-API-Key", "alice-key").
+		json(`{"user": "carol", "role": "viewer"}`).expect(fasthttp.StatusCreated)
+	tenant(newRequest(t, "GET", path)).header("X-API-Key", "carol-key").expect(fasthttp.StatusOK)
+	tenant(newRequest(t, "PUT", path)).header("X-API-Key", "carol-key").
+		json(`{"title": "Order paper"}`).expect(fasthttp.StatusForbidden)
+
+	// The share stays in the tenant's namespace.
+	var shares []Share
+	if resp := newRequest(t, "GET", path+"/share").header("X-API-Key", "bob-key").do(); resp.status == fasthttp.StatusOK {
+		resp.decode(&shares)
+	}
+	for _, s := range shares {
+		if s.User == "carol" {
+			t.Errorf("the tenant's share landed on todo %d of the default namespace", todo.ID)
+		}
+	}
+}
+
+func TestTenantNamespacesAreIsolated(t *testing.T) {
+	createTestNamespace(t, "acme-isolated")
+	tenant := func(r *apiRequest) *apiRequest { return r.header("X-Tenant-ID", "acme-isolated") }
+	const title = "Renew the acme-isolated lease"
+
+	var todo, other Todo
+	tenant(newRequest(t, "POST", "/v1/todos")).json(`{"title": "` + title + `"}`).
+		expect(fasthttp.StatusCreated).decode(&todo)
+	tenant(newRequest(t, "POST", "/v1/todos")).json(`{"title": "Sign the acme-isolated lease"}`).
+		expect(fasthttp.StatusCreated).decode(&other)
+	path, otherPath := todoPath(todo.ID), todoPath(other.ID)
+
+	tenant(newRequest(t, "POST", path+"/comments")).json(`{"body": "Call the landlord"}`).
+		expect(fasthttp.StatusCreated)
+	var comments []Comment
+	tenant(newRequest(t, "GET", path+"/comments")).expect(fasthttp.StatusOK).decode(&comments)
+	if len(comments) != 1 {
+		t.Errorf("the tenant's todo has %d comments, want 1", len(comments))
+	}
+	if resp := newRequest(t, "GET", path+"/comments").do(); resp.status == fasthttp.StatusOK {
+		resp.decode(&comments)
+		for _, c := range comments {
+			if c.Body == "Call the landlord" {
+				t.Errorf("the tenant's comment landed on todo %d of the default namespace", todo.ID)
+			}
+		}
+	}
+
+	tenant(newRequest(t, "POST", otherPath+"/links")).json(`{"type": "blocked-by", "todo_id": ` + strconv.Itoa(todo.ID) + `}`).
+		expect(fasthttp.StatusCreated)
+	var links []Link
+	tenant(newRequest(t, "GET", path+"/links")).expect(fasthttp.StatusOK).decode(&links)
+	if len(links) != 1 || links[0] != (Link{Type: linkBlocks, TodoID: other.ID}) {
+		t.Errorf("links of the tenant's todo = %+v, want the backlink to %d", links, other.ID)
+	}
+
+	tenant(newRequest(t, "POST", path+"/attachments")).multipart(nil, map[string][]byte{"attachments": []byte("lease")}).
+		expect(fasthttp.StatusCreated)
+	var attachments []Attachment
+	tenant(newRequest(t, "GET", path+"/attachments")).expect(fasthttp.StatusOK).decode(&attachments)
+	if len(attachments) != 1 || !strings.HasPrefix(attachments[0].Path, filepath.Join("uploads", "tenants", "acme-isolated")) {
+		t.Fatalf("attachments of the tenant's todo = %+v", attachments)
+	}
+	content := tenant(newRequest(t, "GET", path+"/attachments/"+strconv.Itoa(attachments[0].ID)+"/content")).
+		expect(fasthttp.StatusOK).body
+	if string(content) != "lease" {
+		t.Errorf("downloaded %q, want %q", content, "lease")
+	}
+
+	tenant(newRequest(t, "DELETE", otherPath)).expect(fasthttp.StatusNoContent)
+	tenant(newRequest(t, "GET", otherPath)).expect(fasthttp.StatusGone)
+	tenant(newRequest(t, "POST", otherPath+"/undo")).expect(fasthttp.StatusOK)
+	tenant(newRequest(t, "GET", otherPath)).expect(fasthttp.StatusOK)
+
+	tenant(newRequest(t, "PUT", path)).json(`{"completed": true}`).expect(fasthttp.StatusOK)
+	tenant(newRequest(t, "POST", path+"/archive")).expect(fasthttp.StatusOK)
+	var archived []Todo
+	tenant(newRequest(t, "GET", "/v1/archive")).expect(fasthttp.StatusOK).decode(&archived)
+	if len(archived) != 1 || archived[0].Title != title {
+		t.Errorf("the tenant's archive holds %+v, want its archived todo", archived)
+	}
+	newRequest(t, "GET", "/v1/archive").expect(fasthttp.StatusOK).decode(&archived)
+	for _, a := range archived {
+		if a.Title == title {
+			t.Errorf("the default namespace's archive holds the tenant's todo")
+		}
+	}
+
+	var job Job
+	tenant(newRequest(t, "POST", "/v1/export")).expect(fasthttp.StatusAccepted).decode(&job)
+	job = waitForJob(t, job, "")
+	archive := newRequest(t, "GET", "/v1/jobs/"+strconv.Itoa(job.ID)+"/result").expect(fasthttp.StatusOK).body
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("todos.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var exported []Todo
+	if err := json.NewDecoder(f).Decode(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 2 {
+		t.Errorf("the tenant's export holds %d todos, want its 2", len(exported))
+	}
+	if _, err := zr.Open(filepath.Base(attachments[0].Path)); err != nil {
+		t.Errorf("the tenant's export lacks its attachment: %s", err)
+	}
+}
+
+func TestTodoQuotaCoversEveryCreate(t *testing.T) {
+	withAPIKeys(t, "dana:dana-key=*@editor")
+	newRequest(t, "PUT", "/v1/admin/tenants/dana").header("X-Admin-Token", testAdminToken).
+		json(`{"max_todos": 1}`).expect(fasthttp.StatusCreated)
+	t.Cleanup(func() {
+		newRequest(t, "DELETE", "/v1/admin/tenants/dana").header("X-Admin-Token", testAdminToken).do()
+	})
+	dana := func(r *apiRequest) *apiRequest { return r.header("X-API-Key", "dana-key") }
+
+	var todo Todo
+	dana(newRequest(t, "POST", "/v1/todos")).json(`{"title": "Book the venue"}`).
+		expect(fasthttp.StatusCreated).decode(&todo)
+	dana(newRequest(t, "POST", "/v1/todos")).json(`{"title": "Book the band"}`).expect(fasthttp.StatusForbidden)
+	dana(newRequest(t, "POST", "/v1/todos/quickadd")).json(`{"text": "Book the band tomorrow"}`).
+		expect(fasthttp.StatusForbidden)
+	dana(newRequest(t, "POST", todoPath(todo.ID)+"/clone")).expect(fasthttp.StatusForbidden)
+
+	dana(newRequest(t, "DELETE", todoPath(todo.ID))).expect(fasthttp.StatusNoContent)
+	dana(newRequest(t, "POST", "/v1/todos/quickadd")).json(`{"text": "Book the band tomorrow"}`).
+		expect(fasthttp.StatusCreated)
+}
+
+func TestListSearchAndPaginate(t *testing.T) {
+	term := fmt.Sprintf("zebra%d", time.Now().UnixNano())
+	var ids []int
+	for i := 0; i < 3; i++ {
+		ids = append(ids, createTestTodo(t, `{"title": "Feed the `+term+` `+strconv.Itoa(i)+`"}`).ID)
+	}
+
+	var found []Todo
+	newRequest(t, "GET", "/v1/search?q="+term).expect(fasthttp.StatusOK).decode(&found)
+	if len(found) != 3 || found[0].ID != ids[0] {
+		t.Errorf("search found %d todos, want %v", len(found), ids)
+	}
+
+	var all []Todo
+	newRequest(t, "GET", "/v1/todos").expect(fasthttp.StatusOK).decode(&all)
+	seen := 0
+	for _, todo := range all {
+		if containsInt(ids, todo.ID) {
+			seen++
+		}
+	}
+	if seen != 3 {
+		t.Errorf("list has %d of the todos, want 3", seen)
+	}
+
+	// Walk the pages of two todos up to the created ones.
+	var page struct {
+		Todos      []Todo  `json:"todos"`
+		NextCursor *string `json:"next_cursor"`
+	}
+	newRequest(t, "GET", "/v1/todos?limit=2").expect(fasthttp.StatusOK).decode(&page)
+	pages := 1
+	for page.NextCursor != nil && pages < len(all) {
+		if len(page.Todos) != 2 {
+			t.Fatalf("page %d has %d todos, want 2", pages, len(page.Todos))
+		}
+		cursor := *page.NextCursor
+		page.Todos, page.NextCursor = nil, nil
+		newRequest(t, "GET", "/v1/todos?limit=2&cursor="+cursor).expect(fasthttp.StatusOK).decode(&page)
+		pages++
+	}
+	if want := (len(all) + 1) / 2; pages != want {
+		t.Errorf("walked %d pages, want %d", pages, want)
+	}
+}
+
+func TestComments(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Discuss"}`)
+	path := todoPath(todo.ID) + "/comments"
+	newRequest(t, "POST", path).json(`{"body": "First"}`).expect(fasthttp.StatusCreated)
+	newRequest(t, "POST", path).json(`{"body": "Second"}`).expect(fasthttp.StatusCreated)
+
+	var comments []struct {
+		TodoID int    `json:"todo_id"`
+		Body   string `json:"body"`
+	}
+	newRequest(t, "GET", path).expect(fasthttp.StatusOK).decode(&comments)
+	if len(comments) != 2 || comments[0].Body != "First" || comments[1].TodoID != todo.ID {
+		t.Errorf("comments %+v", comments)
+	}
+	newRequest(t, "GET", "/v1/todos/999999/comments").expect(fasthttp.StatusNotFound)
+}
+
+func TestConcurrentCreatesGetUniqueIDs(t *testing.T) {
+	const n = 50
+	ids := make([]int, n)
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := newRequest(t, "POST", "/v1/todos").json(`{"title": "Race ` + strconv.Itoa(i) + `"}`)
+			resp := req.do()
+			if resp.status != fasthttp.StatusCreated {
+				errs <- fmt.Sprintf("create %d: status %d: %s", i, resp.status, resp.body)
+				return
+			}
+			var todo Todo
+			if err := json.Unmarshal(resp.body, &todo); err != nil {
+				errs <- err.Error()
+				return
+			}
+			ids[i] = todo.ID
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if id != 0 && seen[id] {
+			t.Errorf("ID %d was given to two todos", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestConcurrentUpdatesOfOneTodo(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Contended"}`)
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := newRequest(t, "PUT", todoPath(todo.ID)).json(`{"title": "Contended ` + strconv.Itoa(i) + `"}`).do()
+			if resp.status != fasthttp.StatusOK {
+				errs <- fmt.Sprintf("update %d: status %d: %s", i, resp.status, resp.body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var got Todo
+	newRequest(t, "GET", todoPath(todo.ID)).expect(fasthttp.StatusOK).decode(&got)
+	if !strings.HasPrefix(got.Title, "Contended ") {
+		t.Errorf("title %q after concurrent updates", got.Title)
+	}
+	var history []json.RawMessage
+	newRequest(t, "GET", todoPath(todo.ID)+"/history").expect(fasthttp.StatusOK).decode(&history)
+	if len(history) < 2 {
+		t.Errorf("history has %d entries after %d updates", len(history), n)
+	}
+}
+
+func TestResponseMiddleware(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Negotiate", "description": "`+strings.Repeat("long ", 400)+`"}`)
+
+	resp := newRequest(t, "GET", todoPath(todo.ID)).header("Accept", "application/xml").expect(fasthttp.StatusOK)
+	if ct := string(resp.header.ContentType()); !strings.HasPrefix(ct, "application/xml") {
+		t.Errorf("Content-Type %q, want application/xml", ct)
+	}
+
+	resp = newRequest(t, "GET", todoPath(todo.ID)).header("Accept-Encoding", "gzip").expect(fasthttp.StatusOK)
+	if enc := string(resp.header.ContentEncoding()); enc != "gzip" {
+		t.Errorf("Content-Encoding %q, want gzip", enc)
+	}
+
+	resp = newRequest(t, "GET", "/todos/"+strconv.Itoa(todo.ID)).expect(fasthttp.StatusOK)
+	if len(resp.header.Peek("Deprecation")) == 0 {
+		t.Errorf("unversioned path served without a Deprecation header")
+	}
+	if len(resp.header.Peek("X-Request-ID")) == 0 {
+		t.Errorf("response without X-Request-ID")
+	}
+}
+
+func TestOperationalEndpoints(t *testing.T) {
+	for _, path := range []string{"/health", "/version", "/metrics", wellKnownPath} {
+		newRequest(t, "GET", path).expect(fasthttp.StatusOK)
+	}
+	for _, path := range []string{"/v1/admin/stats", "/v1/admin/config", "/v1/admin/jobs", "/debug/vars"} {
+		newRequest(t, "GET", path).expect(fasthttp.StatusUnauthorized)
+		newRequest(t, "GET", path).header("X-Admin-Token", "wrong").expect(fasthttp.StatusUnauthorized)
+		newRequest(t, "GET", path).header("X-Admin-Token", testAdminToken).expect(fasthttp.StatusOK)
+	}
+	newRequest(t, "POST", "/debug/gc").header("X-Admin-Token", testAdminToken).expect(fasthttp.StatusOK)
+	newRequest(t, "POST", "/v1/admin/gc").expect(fasthttp.StatusUnauthorized)
+	newRequest(t, "POST", "/v1/admin/gc").header("X-Admin-Token", testAdminToken).expect(fasthttp.StatusAccepted)
+}
+
+func TestSweepUploadsCoversTenants(t *testing.T) {
+	createTestNamespace(t, "acme-gc")
+	tenant := func(r *apiRequest) *apiRequest { return r.header("X-Tenant-ID", "acme-gc") }
+	var todo Todo
+	tenant(newRequest(t, "POST", "/v1/todos")).json(`{"title": "File the invoices"}`).
+		expect(fasthttp.StatusCreated).decode(&todo)
+	var attached []Attachment
+	tenant(newRequest(t, "POST", todoPath(todo.ID)+"/attachments")).multipart(nil, map[string][]byte{"attachments": []byte("invoice")}).
+		expect(fasthttp.StatusCreated).decode(&attached)
+	orphan := filepath.Join("uploads", "tenants", "acme-gc", "orphan.txt")
+	if err := os.WriteFile(orphan, []byte("left over"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * gcGracePeriod)
+	for _, path := range []string{orphan, attached[0].Path} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sweepUploads(context.Background(), &jobProgress{job: &Job{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("the tenant's unused upload is still there: %v", err)
+	}
+	if _, err := os.Stat(attached[0].Path); err != nil {
+		t.Errorf("the tenant's attachment was removed: %s", err)
+	}
+}
+
+func TestSweepUploadsKeepsWhatUndoRestores(t *testing.T) {
+	todo := createTestTodo(t, `{"title": "Scan the receipts"}`)
+	path := todoPath(todo.ID)
+	var attached []Attachment
+	newRequest(t, "POST", path+"/attachments").multipart(nil, map[string][]byte{"attachments": []byte("receipt")}).
+		expect(fasthttp.StatusCreated).decode(&attached)
+	old := time.Now().Add(-2 * gcGracePeriod)
+	if err := os.Chtimes(attached[0].Path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	newRequest(t, "DELETE", path).expect(fasthttp.StatusNoContent)
+
+	if _, err := sweepUploads(context.Background(), &jobProgress{job: &Job{}}); err != nil {
+		t.Fatal(err)
+	}
+	newRequest(t, "POST", path+"/undo").expect(fasthttp.StatusOK)
+	body := newRequest(t, "GET", path+"/attachments/"+strconv.Itoa(attached[0].ID)+"/content").expect(fasthttp.StatusOK).body
+	if string(body) != "receipt" {
+		t.Errorf("restored attachment holds %q, want %q", body, "receipt")
+	}
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcCall calls a method of the gRPC API with the API key key and returns
+// the grpc-status and the response messages.
+func grpcCall(t *testing.T, method, key string, msg []byte) (int, [][]byte) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	r := httptest.NewRequest("POST", "/"+grpcService+"/"+method, bytes.NewReader(append(frame, msg...)))
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("X-Api-Key", key)
+	w := httptest.NewRecorder()
+	handleGRPC(w, r)
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	var msgs [][]byte
+	for len(body) >= 5 {
+		n := 5 + int(binary.BigEndian.Uint32(body[1:]))
+		msgs = append(msgs, body[5:n])
+		body = body[n:]
+	}
+	status, _ := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	return status, msgs
+}
+
+func TestGRPCAccessControl(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=work@editor,bob:bob-key=*@editor,eve:eve-key=work@viewer")
+	var home, work Todo
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Water the plants", "project": "home"}`).expect(fasthttp.StatusCreated).decode(&home)
+	newRequest(t, "POST", "/v1/todos").header("X-API-Key", "bob-key").
+		json(`{"title": "Quarterly review", "project": "work"}`).expect(fasthttp.StatusCreated).decode(&work)
+	id := func(id int) []byte { return appendIntField(nil, 1, int64(id)) }
+
+	if status, _ := grpcCall(t, "ListTodos", "", nil); status != grpcUnauthenticated {
+		t.Errorf("ListTodos without a key: status %d", status)
+	}
+	if status, _ := grpcCall(t, "GetTodo", "", id(home.ID)); status != grpcUnauthenticated {
+		t.Errorf("GetTodo without a key: status %d", status)
+	}
+	status, msgs := grpcCall(t, "ListTodos", "alice-key", nil)
+	if status != grpcOK || len(msgs) != 1 {
+		t.Fatalf("ListTodos: status %d, %d messages", status, len(msgs))
+	}
+	var titles []string
+	decodeFields(msgs[0], func(num, typ int, r *protoReader) (bool, error) {
+		msg, err := readMessage(typ, r)
+		if todo, err := decodeTodoProto(msg); err == nil {
+			titles = append(titles, todo.Title)
+		}
+		return true, err
+	})
+	if containsString(titles, home.Title) || !containsString(titles, work.Title) {
+		t.Errorf("alice listed home todo or missed the work one")
+	}
+	if status, _ := grpcCall(t, "GetTodo", "alice-key", id(home.ID)); status != grpcNotFound {
+		t.Errorf("GetTodo of a hidden todo: status %d", status)
+	}
+	if status, _ := grpcCall(t, "GetTodo", "alice-key", id(work.ID)); status != grpcOK {
+		t.Errorf("GetTodo of a visible todo: status %d", status)
+	}
+	if status, _ := grpcCall(t, "DeleteTodo", "alice-key", id(home.ID)); status != grpcNotFound {
+		t.Errorf("DeleteTodo of a hidden todo: status %d", status)
+	}
+	update := appendMessageField(nil, 1, appendTodoProto(nil, &Todo{ID: home.ID, Title: "Mine now"}))
+	update = appendMessageField(update, 2, appendStringField(nil, 1, "title"))
+	if status, _ := grpcCall(t, "UpdateTodo", "alice-key", update); status != grpcNotFound {
+		t.Errorf("UpdateTodo of a hidden todo: status %d", status)
+	}
+	if status, _ := grpcCall(t, "DeleteTodo", "eve-key", id(work.ID)); status != grpcPermissionDenied {
+		t.Errorf("DeleteTodo by a viewer: status %d", status)
+	}
+	newRequest(t, "GET", todoPath(home.ID)).header("X-API-Key", "bob-key").expect(fasthttp.StatusOK).decode(&home)
+	if home.Title != "Water the plants" {
+		t.Errorf("hidden todo changed to %+v", home)
+	}
+}
+
+func TestRolesGuardRoutes(t *testing.T) {
+	for _, tt := range []struct {
+		method, path string
+		want         role
+	}{
+		{"GET", "/todos", roleViewer},
+		{"POST", "/todos", roleEditor},
+		{"POST", "/todos/export", roleViewer},
+		{"POST", "/export", roleEditor},
+		{"GET", "/jobs", roleViewer},
+		{"GET", "/jobs/7/result", roleViewer},
+		{"DELETE", "/jobs/7", roleEditor},
+		{"GET", "/admin/jobs", roleAdmin},
+		{"GET", "/rules", roleViewer},
+		{"POST", "/rules", roleAdmin},
+		{"POST", "/import", roleAdmin},
+		{"PUT", "/me/profile", roleViewer},
+		{"GET", "/health", roleNone},
+	} {
+		if got := requiredRole(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s requires %s, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	withAPIKeys(t, "viewer:viewer-key=*@viewer,editor:editor-key=*@editor,admin:admin-key=*@admin")
+	for _, tt := range []struct {
+		method, path, key string
+		want              int
+	}{
+		{"GET", "/v1/todos", "", fasthttp.StatusUnauthorized},
+		{"GET", "/v1/health", "", fasthttp.StatusOK},
+		{"GET", "/v1/todos", "viewer-key", fasthttp.StatusOK},
+		{"POST", "/v1/todos", "viewer-key", fasthttp.StatusForbidden},
+		{"POST", "/v1/export", "viewer-key", fasthttp.StatusForbidden},
+		{"GET", "/v1/jobs", "viewer-key", fasthttp.StatusOK},
+		{"DELETE", "/v1/jobs/1", "viewer-key", fasthttp.StatusForbidden},
+		{"GET", "/v1/admin/jobs", "editor-key", fasthttp.StatusForbidden},
+		{"GET", "/v1/admin/jobs", "admin-key", fasthttp.StatusOK},
+		{"POST", "/v1/webhooks", "editor-key", fasthttp.StatusForbidden},
+	} {
+		req := newRequest(t, tt.method, tt.path).json(`{"title": "Not allowed"}`)
+		if tt.key != "" {
+			req.header("X-API-Key", tt.key)
+		}
+		req.expect(tt.want)
+	}
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case deliveries <- delivery{r.Header.Get("X-Webhook-Signature"), body}:
+		default:
+		}
+	}))
+	defer receiver.Close()
+
+	var hook Webhook
+	newRequest(t, "POST", "/v1/webhooks").json(`{"url": "` + receiver.URL + `", "events": ["todo.created"], "secret": "hook-secret"}`).
+		expect(fasthttp.StatusCreated).decode(&hook)
+	defer newRequest(t, "DELETE", "/v1/webhooks/"+strconv.Itoa(hook.ID)).expect(fasthttp.StatusNoContent)
+	todo := createTestTodo(t, `{"title": "Sign the lease"}`)
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't called")
+	}
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(d.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(d.signature), []byte(want)) {
+		t.Errorf("signature %q, want %q", d.signature, want)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(d.body, &payload); err != nil || payload.TodoID != todo.ID {
+		t.Errorf("payload %s for todo %d: %v", d.body, todo.ID, err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	key := fmt.Sprintf("create-%d", time.Now().UnixNano())
+	create := func(body string) *apiRequest {
+		return newRequest(t, "POST", "/v1/todos").header("Idempotency-Key", key).json(body)
+	}
+	var first, replayed Todo
+	create(`{"title": "Renew the passport"}`).expect(fasthttp.StatusCreated).decode(&first)
+	resp := create(`{"title": "Renew the passport"}`).expect(fasthttp.StatusCreated)
+	resp.decode(&replayed)
+	if replayed.ID != first.ID || string(resp.header.Peek("Idempotent-Replayed")) != "true" {
+		t.Errorf("retry created todo %d, want the replay of %d", replayed.ID, first.ID)
+	}
+	create(`{"title": "Renew the driving licence"}`).expect(fasthttp.StatusUnprocessableEntity)
+
+	// A handler that panics must not leave the key in progress.
+	request := func() *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.Set("Idempotency-Key", key+"-panic")
+		ctx.Request.SetBodyString(`{"title": "Boom"}`)
+		return &ctx
+	}
+	func() {
+		defer func() { recover() }()
+		idempotent(request(), func(*fasthttp.RequestCtx) { panic("boom") })
+	}()
+	ran := false
+	retry := request()
+	idempotent(retry, func(ctx *fasthttp.RequestCtx) {
+		ran = true
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+	})
+	if !ran {
+		t.Errorf("retry after a panic got %d: %s", retry.Response.StatusCode(), retry.Response.Body())
+	}
+}
+
+func TestAccessTokens(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=*@editor")
+	bearer := func(r *apiRequest, token string) *apiRequest { return r.header("Authorization", "Bearer "+token) }
+	var tokens tokenResponse
+	newRequest(t, "POST", "/v1/auth/login").header("X-API-Key", "alice-key").expect(fasthttp.StatusOK).decode(&tokens)
+	bearer(newRequest(t, "GET", "/v1/todos"), tokens.AccessToken).expect(fasthttp.StatusOK)
+	claims, err := parseAccessToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned and expired tokens of an open session are rejected.
+	unsigned := claims
+	unsigned.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	payload, _ := json.Marshal(unsigned)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + "."
+	bearer(newRequest(t, "GET", "/v1/todos"), none).expect(fasthttp.StatusUnauthorized)
+	expired := claims
+	expired.IssuedAt = time.Now().Add(-time.Hour).Unix()
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	bearer(newRequest(t, "GET", "/v1/todos"), signAccessToken(expired)).expect(fasthttp.StatusUnauthorized)
+
+	// Refreshing rotates the refresh token; reusing an old one closes the
+	// session.
+	var rotated tokenResponse
+	refresh := func(token string) *apiRequest {
+		return newRequest(t, "POST", "/v1/auth/refresh").json(`{"refresh_token": "` + token + `"}`)
+	}
+	refresh(tokens.RefreshToken).expect(fasthttp.StatusOK).decode(&rotated)
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatal("refreshing kept the refresh token")
+	}
+	bearer(newRequest(t, "GET", "/v1/todos"), rotated.AccessToken).expect(fasthttp.StatusOK)
+	refresh(tokens.RefreshToken).expect(fasthttp.StatusUnauthorized)
+	refresh(rotated.RefreshToken).expect(fasthttp.StatusUnauthorized)
+	bearer(newRequest(t, "GET", "/v1/todos"), rotated.AccessToken).expect(fasthttp.StatusUnauthorized)
+}
+
+func TestOAuthLogin(t *testing.T) {
+	withAPIKeys(t, "alice:alice-key=*@editor")
+	clients := map[string]oauthClient{"github": {id: "client", secret: "secret"}, "google": {id: "client", secret: "secret"}}
+	oauthClients = clients
+	t.Cleanup(func() { oauthClients = make(map[string]oauthClient) })
+
+	resp := newRequest(t, "GET", "/v1/auth/github/login").expect(fasthttp.StatusFound)
+	location, err := url.Parse(string(resp.header.Peek("Location")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	if state == "" || location.Query().Get("code_challenge") == "" {
+		t.Fatalf("login redirected to %s", location)
+	}
+	newRequest(t, "GET", "/v1/auth/github/callback?code=c&state=forged").expect(fasthttp.StatusBadRequest)
+	// States are bound to their provider and only used once.
+	newRequest(t, "GET", "/v1/auth/google/callback?code=c&state="+state).expect(fasthttp.StatusBadRequest)
+	newRequest(t, "GET", "/v1/auth/github/callback?code=c&state="+state).expect(fasthttp.StatusBadRequest)
+
+	// GitHub users are identified by their ID, which can't be renamed.
+	if id, ok := oauthProviders["github"].identity(map[string]interface{}{"id": 583231.0, "login": "octocat"}); !ok || id != "583231" {
+		t.Errorf("GitHub identity %q, %v", id, ok)
+	}
+	if _, err := parseIdentityUsers("github:octocat=alice", clients); err == nil {
+		t.Error("a GitHub login was accepted as identity")
+	}
+}
+
+func TestShareRoles(t *testing.T) {
+	createTestNamespace(t, "acme-roles")
+	withAPIKeys(t, "owner:owner-key=home@editor#acme-roles,guest:guest-key=work@editor#acme-roles")
+	owner := func(r *apiRequest) *apiRequest { return r.header("X-API-Key", "owner-key") }
+	guest := func(r *apiRequest) *apiRequest { return r.header("X-API-Key", "guest-key") }
+
+	for _, tenant := range []string{"", "acme-roles"} {
+		inTenant := func(r *apiRequest) *apiRequest {
+			if tenant != "" {
+				r.header("X-Tenant-ID", tenant)
+			}
+			return r
+		}
+		var todo Todo
+		owner(inTenant(newRequest(t, "POST", "/v1/todos"))).json(`{"title": "Paint the fence", "project": "home"}`).
+			expect(fasthttp.StatusCreated).decode(&todo)
+		path := todoPath(todo.ID)
+		guest(inTenant(newRequest(t, "GET", path))).expect(fasthttp.StatusNotFound)
+
+		owner(inTenant(newRequest(t, "POST", path+"/share"))).json(`{"user": "guest", "role": "viewer"}`).
+			expect(fasthttp.StatusCreated)
+		guest(inTenant(newRequest(t, "GET", path))).expect(fasthttp.StatusOK)
+		guest(inTenant(newRequest(t, "PUT", path))).json(`{"title": "Paint it red"}`).expect(fasthttp.StatusForbidden)
+
+		owner(inTenant(newRequest(t, "POST", path+"/share"))).json(`{"user": "guest", "role": "editor"}`).
+			expect(fasthttp.StatusCreated)
+		guest(inTenant(newRequest(t, "PUT", path))).json(`{"title": "Paint it red"}`).expect(fasthttp.StatusOK)
+		guest(inTenant(newRequest(t, "DELETE", path))).expect(fasthttp.StatusForbidden)
+		guest(inTenant(newRequest(t, "POST", path+"/share"))).json(`{"user": "guest", "role": "editor"}`).
+			expect(fasthttp.StatusForbidden)
+
+		owner(inTenant(newRequest(t, "DELETE", path+"/share/guest"))).expect(fasthttp.StatusNoContent)
+		guest(inTenant(newRequest(t, "GET", path))).expect(fasthttp.StatusNotFound)
+	}
+}
+
+func TestClusterFollowersForwardWrites(t *testing.T) {
+	type received struct{ method, uri, host, body, forwarded string }
+	got := make(chan received, 1)
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case got <- received{r.Method, r.URL.RequestURI(), r.Host, string(body), r.Header.Get(clusterForwardedHeader)}:
+		default:
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id": 1}`)
+	}))
+	defer leader.Close()
+
+	node := newClusterNode("http://follower.internal", []string{leader.URL})
+	cluster = node
+	defer func() { cluster = nil }()
+	local := 0
+	handler := replicaHandler(func(ctx *fasthttp.RequestCtx) {
+		local++
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	})
+	request := func(method string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI("/v1/todos?strict=1")
+		ctx.Request.Header.SetHost("acme.todo.example")
+		ctx.Request.SetBodyString(`{"title": "Forwarded"}`)
+		return &ctx
+	}
+
+	// Without a leader writes are refused, and reads are served locally.
+	ctx := request("POST")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("write without a leader got %d, want 503", ctx.Response.StatusCode())
+	}
+	handler(request("GET"))
+	if local != 1 {
+		t.Error("read wasn't served locally")
+	}
+
+	node.heartbeat(heartbeatRequest{Term: 1, Leader: leader.URL}, time.Now())
+	ctx = request("POST")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated || string(ctx.Response.Body()) != `{"id": 1}` {
+		t.Errorf("forwarded write got %d: %s, want the leader's response", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	want := received{"POST", "/v1/todos?strict=1", "acme.todo.example", `{"title": "Forwarded"}`, "1"}
+	if r := <-got; r != want {
+		t.Errorf("leader received %+v, want %+v", r, want)
+	}
+	if local != 1 {
+		t.Errorf("the follower handled the write itself")
+	}
+
+	// A write forwarded once isn't forwarded again.
+	ctx = request("POST")
+	ctx.Request.Header.Set(clusterForwardedHeader, "1")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("write forwarded twice got %d, want 503", ctx.Response.StatusCode())
+	}
+}
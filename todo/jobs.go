@@ -0,0 +1,244 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Job states.
+const (
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// Job is a long-running operation executed in the background. Clients poll
+// GET /jobs/{id} for its progress instead of waiting on the request that
+// started it.
+type Job struct {
+	ID         int         `json:"id"`
+	Kind       string      `json:"kind"`
+	State      string      `json:"state"`
+	Processed  int         `json:"processed"`
+	Total      int         `json:"total"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+	// file is the path of a downloadable artifact produced by the job.
+	file string
+	// owner is the name of the caller who started the job, "" for jobs
+	// the server starts itself.
+	owner string
+}
+
+// visibleTo reports whether caller may see the job and download its
+// result: only its owner and admins may when access control is enabled.
+func (job *Job) visibleTo(caller *principal) bool {
+	return len(apiKeys) == 0 || caller.role == roleAdmin || job.owner == caller.name
+}
+
+// jobFunc is the body of a job. It reports progress through job and must
+// return promptly once ctx is canceled.
+type jobFunc func(ctx context.Context, job *jobProgress) (interface{}, error)
+
+// jobProgress lets a running job report how far along it is.
+type jobProgress struct {
+	job *Job
+}
+
+// setTotal sets the number of steps the job has to perform.
+func (p *jobProgress) setTotal(n int) {
+	jobsMu.Lock()
+	p.job.Total = n
+	jobsMu.Unlock()
+}
+
+// advance marks n more steps as done.
+func (p *jobProgress) advance(n int) {
+	jobsMu.Lock()
+	p.job.Processed += n
+	jobsMu.Unlock()
+}
+
+// setFile records a downloadable artifact, served at GET /jobs/{id}/result.
+func (p *jobProgress) setFile(path string) {
+	jobsMu.Lock()
+	p.job.file = path
+	jobsMu.Unlock()
+}
+
+// jobRetention is how long finished jobs stay listed. Scheduled tasks start
+// new jobs all the time, so old ones have to go.
+const jobRetention = 24 * time.Hour
+
+var (
+	jobs      = make(map[int]*Job)
+	nextJobID = 1
+	jobsMu    sync.RWMutex
+)
+
+// startJob registers a job of the given kind, owned by the named caller, and
+// runs fn in a new goroutine. It returns a snapshot of the freshly created
+// job. Jobs are canceled when the server shuts down.
+func startJob(kind, owner string, fn jobFunc) Job {
+	ctx, cancel := context.WithCancel(background.ctx)
+
+	jobsMu.Lock()
+	pruneJobs()
+	job := &Job{
+		ID:        nextJobID,
+		Kind:      kind,
+		State:     jobRunning,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+		owner:     owner,
+	}
+	nextJobID++
+	jobs[job.ID] = job
+	snapshot := *job
+	jobsMu.Unlock()
+
+	// finish records the outcome of the job.
+	finish := func(result interface{}, err error) {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Result = result
+		switch {
+		case errors.Is(err, context.Canceled):
+			job.State = jobCanceled
+		case err != nil:
+			job.State = jobFailed
+			job.Error = err.Error()
+		default:
+			job.State = jobDone
+		}
+	}
+	started := background.spawn("jobs", func(context.Context) {
+		defer cancel()
+		finish(fn(ctx, &jobProgress{job: job}))
+	})
+	if !started {
+		cancel()
+		finish(nil, context.Canceled)
+	}
+
+	return snapshot
+}
+
+// pruneJobs forgets jobs that finished more than jobRetention ago. It must
+// be called with jobsMu held for writing.
+func pruneJobs() {
+	for id, job := range jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+// respondJobStarted writes the 202 Accepted response for a newly started job.
+func respondJobStarted(ctx *fasthttp.RequestCtx, job Job) {
+	ctx.Response.Header.Set("Location", apiPrefix+"/jobs/"+strconv.Itoa(job.ID))
+	writeJSON(ctx, fasthttp.StatusAccepted, job)
+}
+
+// jobOf returns a snapshot of the job with the given ID if the caller may
+// see it, otherwise it responds with 404 Not Found, or 401 Unauthorized
+// without a valid API key.
+func jobOf(ctx *fasthttp.RequestCtx, id int) (*Job, Job, bool) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return nil, Job{}, false
+	}
+	jobsMu.RLock()
+	job, ok := jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	jobsMu.RUnlock()
+
+	if !ok || !snapshot.visibleTo(caller) {
+		ctx.Error("Job not found", fasthttp.StatusNotFound)
+		return nil, Job{}, false
+	}
+	return job, snapshot, true
+}
+
+// getJobs handles GET /jobs and lists the jobs the caller may see, oldest
+// first.
+func getJobs(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	jobsMu.RLock()
+	list := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.visibleTo(caller) {
+			list = append(list, *job)
+		}
+	}
+	jobsMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// getJob handles GET /jobs/{id} and reports the status of a single job.
+func getJob(ctx *fasthttp.RequestCtx, id int) {
+	_, snapshot, ok := jobOf(ctx, id)
+	if !ok {
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// cancelJob handles DELETE /jobs/{id} by asking a running job to stop.
+// Finished jobs are left untouched.
+func cancelJob(ctx *fasthttp.RequestCtx, id int) {
+	job, snapshot, ok := jobOf(ctx, id)
+	if !ok {
+		return
+	}
+	if snapshot.State != jobRunning {
+		ctx.Error("Job is not running", fasthttp.StatusConflict)
+		return
+	}
+	job.cancel()
+	writeJSON(ctx, fasthttp.StatusAccepted, snapshot)
+}
+
+// getJobResult handles GET /jobs/{id}/result and sends the artifact produced
+// by a finished job, such as an export archive.
+func getJobResult(ctx *fasthttp.RequestCtx, id int) {
+	_, snapshot, ok := jobOf(ctx, id)
+	if !ok {
+		return
+	}
+	state, file := snapshot.State, snapshot.file
+
+	switch {
+	case state == jobRunning:
+		ctx.Error("Job is still running", fasthttp.StatusConflict)
+	case file == "":
+		ctx.Error("Job has no downloadable result", fasthttp.StatusNotFound)
+	default:
+		ctx.Response.Header.Set("Content-Disposition", `attachment; filename="`+filepath.Base(file)+`"`)
+		ctx.SendFile(file)
+	}
+}
@@ -0,0 +1,113 @@
+package todo
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lifecycle tracks the goroutines of the background components, such as the
+// scheduler and webhook deliveries, so they can be counted and stopped
+// together when the server shuts down.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// running and started count the goroutines of every component.
+	running map[string]int
+	started map[string]uint64
+}
+
+// background is the lifecycle of the server's background components.
+var background = newLifecycle()
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]int),
+		started: make(map[string]uint64),
+	}
+}
+
+// spawn runs fn in a new goroutine counted under component. fn must return
+// soon after ctx is done. Once shutdown has begun fn isn't started and spawn
+// reports false.
+func (l *lifecycle) spawn(component string, fn func(ctx context.Context)) bool {
+	l.mu.Lock()
+	if l.ctx.Err() != nil {
+		l.mu.Unlock()
+		return false
+	}
+	l.running[component]++
+	l.started[component]++
+	l.wg.Add(1)
+	l.mu.Unlock()
+
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			l.running[component]--
+			l.mu.Unlock()
+			l.wg.Done()
+		}()
+		fn(l.ctx)
+	}()
+	return true
+}
+
+// shutdown stops all components and waits up to timeout for their
+// goroutines to return. It reports false if some are still running.
+func (l *lifecycle) shutdown(timeout time.Duration) bool {
+	l.mu.Lock()
+	l.cancel()
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// componentCount is the number of goroutines of a background component.
+type componentCount struct {
+	component string
+	running   int
+	started   uint64
+}
+
+// counts returns the goroutine counts of every component that ever ran,
+// ordered by component.
+func (l *lifecycle) counts() []componentCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]componentCount, 0, len(l.started))
+	for c, n := range l.started {
+		list = append(list, componentCount{component: c, running: l.running[c], started: n})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].component < list[j].component })
+	return list
+}
+
+// sleepCtx waits for d and reports false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
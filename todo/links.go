@@ -0,0 +1,208 @@
+package todo
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Link relates a todo to another todo.
+type Link struct {
+	Type   string `json:"type"`
+	TodoID int    `json:"todo_id"`
+}
+
+// linkInverses maps every link type to the type of its backlink.
+var linkInverses = map[string]string{
+	"relates-to":    "relates-to",
+	"duplicates":    "duplicated-by",
+	"duplicated-by": "duplicates",
+	"caused-by":     "causes",
+	"causes":        "caused-by",
+	linkBlockedBy:   linkBlocks,
+	linkBlocks:      linkBlockedBy,
+}
+
+// addLink adds link to the todo unless it is already there and reports
+// whether the todo changed.
+func addLink(todo *Todo, link Link) bool {
+	for _, l := range todo.Links {
+		if l == link {
+			return false
+		}
+	}
+	todo.Links = append(todo.Links, link)
+	return true
+}
+
+// dropLinks removes the links to target of the given type, or of any type
+// if linkType is empty, and reports whether the todo changed.
+func dropLinks(todo *Todo, target int, linkType string) bool {
+	kept := todo.Links[:0]
+	for _, l := range todo.Links {
+		if l.TodoID != target || (linkType != "" && l.Type != linkType) {
+			kept = append(kept, l)
+		}
+	}
+	changed := len(kept) != len(todo.Links)
+	if len(kept) == 0 {
+		kept = nil
+	}
+	todo.Links = kept
+	return changed
+}
+
+// getLinks handles GET /todos/{id}/links.
+func getLinks(ctx *fasthttp.RequestCtx, id int) {
+	todo, ok := namespaceOf(ctx).store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	links := todo.Links
+	if links == nil {
+		links = []Link{}
+	}
+	writeJSON(ctx, fasthttp.StatusOK, links)
+}
+
+// createLink handles POST /todos/{id}/links with a JSON body such as
+// {"type": "duplicates", "todo_id": 7}. The backlink ("duplicated-by") is
+// added to the other todo, which the caller must be allowed to edit.
+// Dependencies that would form a cycle are rejected.
+func createLink(ctx *fasthttp.RequestCtx, id int) {
+	var link Link
+	if !decodeJSONBody(ctx, &link) {
+		return
+	}
+	inverse, ok := linkInverses[link.Type]
+	if !ok {
+		ctx.Error("Invalid link type", fasthttp.StatusBadRequest)
+		return
+	}
+	if link.TodoID == id {
+		ctx.Error("A todo cannot link to itself", fasthttp.StatusBadRequest)
+		return
+	}
+	// The backlink changes the other todo, so the caller must be allowed to
+	// edit it.
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	ns := namespaceOf(ctx)
+	target, ok := ns.store.get(link.TodoID)
+	if !ok || ns.permission(caller, &target) < permEditor {
+		ctx.Error("Linked todo not found", fasthttp.StatusNotFound)
+		return
+	}
+	if link.Type == linkBlockedBy && blocksCycle(ns.store, id, link.TodoID) || link.Type == linkBlocks && blocksCycle(ns.store, link.TodoID, id) {
+		writeRequestError(ctx, fasthttp.StatusConflict, "Dependency would create a cycle",
+			"the other todo already depends on this one; see GET /todos/{id}/dependencies")
+		return
+	}
+
+	now := time.Now()
+	actor := actorOf(ctx)
+	raw, ok, err := ns.store.update(actor, id, func(todo *Todo) error {
+		if !addLink(todo, link) {
+			return errNoChange
+		}
+		todo.UpdatedAt = now
+		return nil
+	})
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	_, ok, err = ns.store.update(actor, link.TodoID, func(todo *Todo) error {
+		if !addLink(todo, Link{Type: inverse, TodoID: id}) {
+			return errNoChange
+		}
+		todo.UpdatedAt = now
+		return nil
+	})
+	if err != nil && err != errNoChange {
+		// The backlink wasn't saved; undo the link.
+		ns.store.update(actor, id, func(todo *Todo) error {
+			dropLinks(todo, link.TodoID, link.Type)
+			return nil
+		})
+		todosChanged()
+		writeStoreError(ctx, err)
+		return
+	}
+	if !ok {
+		// The other todo was deleted in the meantime; undo the link.
+		ns.store.update(actor, id, func(todo *Todo) error {
+			dropLinks(todo, link.TodoID, link.Type)
+			return nil
+		})
+		todosChanged()
+		ctx.Error("Linked todo not found", fasthttp.StatusNotFound)
+		return
+	}
+	todosChanged()
+	if raw == nil {
+		raw, _ = ns.store.raw(id)
+	}
+	writeRawJSON(ctx, fasthttp.StatusCreated, raw)
+}
+
+// deleteLink handles DELETE /todos/{id}/links/{target} and removes every
+// link between the two todos, in both directions.
+func deleteLink(ctx *fasthttp.RequestCtx, id, target int) {
+	ns := namespaceOf(ctx)
+	now := time.Now()
+	actor := actorOf(ctx)
+	removed := false
+	unlink := func(from, to int) (bool, error) {
+		_, ok, err := ns.store.update(actor, from, func(todo *Todo) error {
+			if !dropLinks(todo, to, "") {
+				return errNoChange
+			}
+			removed = true
+			todo.UpdatedAt = now
+			return nil
+		})
+		if err == errNoChange {
+			err = nil
+		}
+		return ok, err
+	}
+	ok, err := unlink(id, target)
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		ctx.Error("Todo not found", fasthttp.StatusNotFound)
+		return
+	}
+	if _, err := unlink(target, id); writeStoreError(ctx, err) {
+		todosChanged()
+		return
+	}
+	if !removed {
+		ctx.Error("Link not found", fasthttp.StatusNotFound)
+		return
+	}
+	todosChanged()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// unlinkAll removes the backlinks pointing at a deleted todo of the
+// namespace.
+func (ns *namespace) unlinkAll(actor string, deleted *Todo) {
+	for _, link := range deleted.Links {
+		ns.store.update(actor, link.TodoID, func(todo *Todo) error {
+			if !dropLinks(todo, deleted.ID, "") {
+				return errNoChange
+			}
+			return nil
+		})
+	}
+}
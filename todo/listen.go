@@ -0,0 +1,93 @@
+package todo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket
+// activation; see sd_listen_fds(3).
+const systemdFirstFD = 3
+
+// listen returns the listener of the API server and its address for logs:
+// the socket passed by systemd with -systemd-socket, a Unix socket with
+// -unix-socket, or the TCP address -addr otherwise. Reverse proxies on the
+// same host can reach the server through a Unix socket without exposing a
+// port.
+func listen(cfg Config) (net.Listener, string, error) {
+	switch {
+	case cfg.SystemdSocket && cfg.UnixSocket != "":
+		return nil, "", errors.New("-systemd-socket and -unix-socket are mutually exclusive")
+	case cfg.SystemdSocket:
+		ln, err := systemdListener()
+		if err != nil {
+			return nil, "", err
+		}
+		return ln, "systemd:" + ln.Addr().String(), nil
+	case cfg.UnixSocket != "":
+		ln, err := unixListener(cfg.UnixSocket, cfg.UnixSocketMode)
+		if err != nil {
+			return nil, "", err
+		}
+		return ln, "unix:" + cfg.UnixSocket, nil
+	}
+	// fasthttp's ListenAndServe listens on IPv4 only, too.
+	ln, err := net.Listen("tcp4", cfg.Addr)
+	return ln, cfg.Addr, err
+}
+
+// unixListener listens on the Unix socket at path with the permissions of
+// mode, an octal file mode such as "0660". A socket left behind by a
+// previous run is replaced; other files are not. The socket is removed
+// when the listener is closed.
+func unixListener(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, fmt.Errorf("invalid socket mode %q, expected octal permissions such as 0660", mode)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListener returns the first socket passed by systemd socket
+// activation, as announced by the LISTEN_PID and LISTEN_FDS environment
+// variables. They are cleared so child processes don't inherit them.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_PID is not set to this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_FDS is not set")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket passed by systemd: %w", err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,1369 @@
+package todo
+
+import (
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Subtask represents a subtask for a todo. IDs are allocated by the server
+// and unique within the todo.
+type Subtask struct {
+	ID        int    `json:"id,omitempty"`
+	Title     string `json:"title"`
+	Completed bool   `json:"completed"`
+}
+
+// Todo represents a todo item.
+type Todo struct {
+	ID int `json:"id,omitempty"`
+	// UUID is a UUIDv7 given to new todos with -id-format uuid. Requests
+	// can name the todo by either.
+	UUID        string `json:"uuid,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Completed   bool   `json:"completed"`
+	// Status is the workflow status: backlog, in_progress, blocked or
+	// done. It is done exactly when the todo is completed.
+	Status      string       `json:"status"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Images holds the image paths of todos stored before todos had
+	// attachments. saved turns them into attachments, so it is empty
+	// otherwise.
+	Images   []string   `json:"images,omitempty"`
+	Subtasks []Subtask  `json:"subtasks,omitempty"`
+	Priority string     `json:"priority,omitempty"`
+	Project  string     `json:"project,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	Assignee string     `json:"assignee,omitempty"`
+	DueAt    *time.Time `json:"due_at,omitempty"`
+	// RemindAt is when a reminder about the todo is sent. It is cleared
+	// once the reminder has fired.
+	RemindAt *time.Time `json:"remind_at,omitempty"`
+	// ExpiresAt is when the todo is deleted, or archived, by the expiry
+	// reaper, see runExpiry.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// CompletedAt is set by the store when the todo becomes completed.
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// ArchivedAt is set when the completed todo is archived, see archived.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+
+	// Recurrence is "daily", "weekly", "monthly" or a cron expression.
+	// Completing a recurring todo creates its next occurrence.
+	Recurrence string `json:"recurrence,omitempty"`
+	// SeriesID is the ID of the first todo of a recurring series.
+	SeriesID int `json:"series_id,omitempty"`
+	// NextOccurrence is the ID of the todo created when this one was completed.
+	NextOccurrence int `json:"next_occurrence,omitempty"`
+
+	// Links relate the todo to other todos. Every link has a matching
+	// backlink on the other todo.
+	Links []Link `json:"links,omitempty"`
+
+	// Position orders todos manually, lowest first; see moveTodo. New todos
+	// are placed last.
+	Position float64 `json:"position"`
+
+	// nextSubtaskID is the ID the next new subtask gets.
+	nextSubtaskID int
+	// nextAttachmentID is the ID the next new attachment gets.
+	nextAttachmentID int
+	// raw caches the JSON encoding of the todo. The store refreshes it on
+	// every mutation.
+	raw []byte
+	// version is the revision of the todo in the store's backend, see
+	// todoBackend.save; zero if the backend doesn't have it.
+	version int64
+}
+
+// Todo priorities, from least to most pressing.
+var priorities = []string{"low", "medium", "high", "urgent"}
+
+// validPriority reports whether p is a known priority. An empty priority is
+// allowed and means the todo has none.
+func validPriority(p string) bool {
+	if p == "" {
+		return true
+	}
+	for _, known := range priorities {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags splits a comma-separated list of tags, dropping blanks and duplicates.
+func parseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// parseDueAt parses an RFC 3339 due date. An empty string means no due date.
+func parseDueAt(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshJSON re-encodes the todo into its cached JSON representation.
+// The store calls it after every change to the todo.
+func (t *Todo) refreshJSON() {
+	raw, err := json.Marshal(t)
+	if err != nil {
+		// A Todo only holds strings, numbers and booleans, so encoding
+		// cannot fail.
+		panic(err)
+	}
+	t.raw = raw
+}
+
+// requestHandler performs basic routing based on URL path and HTTP method.
+func requestHandler(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	method := string(ctx.Method())
+
+	if path == "/todos" {
+		switch method {
+		case "GET":
+			getTodos(ctx)
+		case "POST":
+			idempotent(ctx, createTodo)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/todos/next" {
+		if method == "GET" {
+			getNextTodo(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/todos/quickadd" {
+		if method == "POST" {
+			quickAddTodo(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/todos/export" {
+		if method == "POST" {
+			exportSelectedTodos(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == calendarPath {
+		if method == "GET" {
+			getCalendar(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == atomPath {
+		if method == "GET" {
+			getAtomFeed(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/ui/") {
+		routeUI(ctx, method, path)
+		return
+	}
+
+	if path == "/mcp/sse" {
+		if method == "GET" {
+			getMCPStream(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/mcp/messages" {
+		if method == "POST" {
+			postMCPMessage(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/events" {
+		if method == "GET" {
+			getEventStream(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/me/profile" {
+		switch method {
+		case "GET":
+			getProfile(ctx)
+		case "PUT":
+			updateProfile(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/me/telegram" {
+		switch method {
+		case "POST":
+			createTelegramLink(ctx)
+		case "DELETE":
+			deleteTelegramLinks(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/feeds/token" {
+		if method == "GET" {
+			getFeedToken(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/todos/merge" {
+		if method == "POST" {
+			mergeTodos(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/todos/from-template/") {
+		id, err := strconv.Atoi(path[len("/todos/from-template/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		if method == "POST" {
+			createTodoFromTemplate(ctx, id)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/todos/") {
+		idStr, sub, hasSub := strings.Cut(path[len("/todos/"):], "/")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+
+		if hasSub {
+			routeTodoSubresource(ctx, method, id, sub)
+			return
+		}
+
+		switch method {
+		case "GET":
+			getTodo(ctx, id)
+		case "PUT":
+			updateTodo(ctx, id, false)
+		case "PATCH":
+			updateTodo(ctx, id, true)
+		case "DELETE":
+			deleteTodo(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/projects/") {
+		project, sub, _ := strings.Cut(path[len("/projects/"):], "/")
+		if project != "" && isShareRoute(sub) {
+			routeProjectShares(ctx, method, project, strings.TrimPrefix(sub, "share"))
+			return
+		}
+		if project == "" || sub != "stats" {
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+			return
+		}
+		if method == "GET" {
+			getProjectStats(ctx, project)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/archive" {
+		if method == "GET" {
+			getArchive(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/uploads" || strings.HasPrefix(path, "/uploads/") {
+		routeUploads(ctx, method, path[len("/uploads"):])
+		return
+	}
+
+	if path == "/import" {
+		if method == "POST" {
+			importTodos(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/export" {
+		if method == "POST" {
+			exportTodos(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/gc" {
+		if method == "POST" {
+			collectGarbage(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/escalations" {
+		switch method {
+		case "GET":
+			getEscalationRules(ctx)
+		case "POST":
+			createEscalationRule(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/escalations/") {
+		id, err := strconv.Atoi(path[len("/escalations/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		if method == "DELETE" {
+			deleteEscalationRule(ctx, id)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/rules" {
+		switch method {
+		case "GET":
+			getRules(ctx)
+		case "POST":
+			createRule(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/rules/") {
+		id, err := strconv.Atoi(path[len("/rules/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		switch method {
+		case "GET":
+			getRule(ctx, id)
+		case "PUT":
+			updateRule(ctx, id)
+		case "DELETE":
+			deleteRule(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/audit" {
+		if method == "GET" {
+			getAudit(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/search" {
+		if method == "GET" {
+			searchTodos(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/templates" {
+		switch method {
+		case "GET":
+			getTemplates(ctx)
+		case "POST":
+			createTemplate(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/templates/") {
+		id, err := strconv.Atoi(path[len("/templates/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		switch method {
+		case "GET":
+			getTemplate(ctx, id)
+		case "PUT":
+			updateTemplate(ctx, id)
+		case "DELETE":
+			deleteTemplate(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/webhooks" {
+		switch method {
+		case "GET":
+			getWebhooks(ctx)
+		case "POST":
+			createWebhook(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/webhooks/") {
+		id, err := strconv.Atoi(path[len("/webhooks/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		switch method {
+		case "GET":
+			getWebhook(ctx, id)
+		case "PUT":
+			updateWebhook(ctx, id)
+		case "DELETE":
+			deleteWebhook(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/debug/pprof" || strings.HasPrefix(path, "/debug/pprof/") {
+		if method == "GET" || method == "POST" {
+			getPprof(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/debug/vars" {
+		if method == "GET" {
+			getDebugVars(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/debug/gc" {
+		if method == "POST" {
+			triggerGC(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/metrics" {
+		if method == "GET" {
+			getMetrics(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/stats" {
+		if method == "GET" {
+			getAdminStats(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/config" {
+		if method == "GET" {
+			getAdminConfig(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/replication" {
+		if method == "GET" {
+			getReplication(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/replication/feed" {
+		if method == "GET" {
+			getReplicationFeed(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/replication/promote" {
+		if method == "POST" {
+			promoteReplica(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/cluster" {
+		if method == "GET" {
+			getCluster(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/cluster/vote" || path == "/admin/cluster/heartbeat" {
+		if method == "POST" {
+			clusterRPC(ctx, strings.TrimPrefix(path, "/admin/cluster/"))
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/auth/login" || path == "/auth/refresh" || path == "/auth/logout" {
+		if method != "POST" {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+		switch path {
+		case "/auth/login":
+			login(ctx)
+		case "/auth/refresh":
+			refreshTokens(ctx)
+		default:
+			logout(ctx)
+		}
+		return
+	}
+
+	if path == "/auth/sessions" {
+		if method == "GET" {
+			getSessions(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if rest, ok := strings.CutPrefix(path, "/auth/"); ok {
+		if provider, action, _ := strings.Cut(rest, "/"); action == "login" || action == "callback" {
+			routeOAuth(ctx, method, provider, action)
+			return
+		}
+	}
+
+	if path == "/admin/reset" {
+		if method == "POST" {
+			postReset(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/seed" {
+		if method == "POST" {
+			postSeed(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/retention" {
+		if method == "POST" {
+			runRetention(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/tenants" {
+		if method == "GET" {
+			getTenants(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/admin/tenants/") {
+		name := path[len("/admin/tenants/"):]
+		if name == "" || strings.Contains(name, "/") {
+			ctx.Error("Invalid tenant", fasthttp.StatusBadRequest)
+			return
+		}
+		switch method {
+		case "GET":
+			getTenant(ctx, name)
+		case "PUT":
+			putTenant(ctx, name)
+		case "DELETE":
+			deleteTenant(ctx, name)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/namespaces" {
+		switch method {
+		case "GET":
+			getNamespaces(ctx)
+		case "POST":
+			createNamespace(ctx)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/admin/namespaces/") {
+		id := path[len("/admin/namespaces/"):]
+		switch method {
+		case "GET":
+			getNamespace(ctx, id)
+		case "DELETE":
+			deleteNamespace(ctx, id)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == wellKnownPath {
+		if method == "GET" {
+			getCapabilities(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/health" {
+		if method == "GET" {
+			getHealth(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/version" {
+		if method == "GET" {
+			getVersion(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/admin/jobs" {
+		if method == "GET" {
+			getScheduledTasks(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if path == "/jobs" {
+		if method == "GET" {
+			getJobs(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasPrefix(path, "/jobs/") {
+		rest := path[len("/jobs/"):]
+		idStr, sub, _ := strings.Cut(rest, "/")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case sub == "" && method == "GET":
+			getJob(ctx, id)
+		case sub == "" && method == "DELETE":
+			cancelJob(ctx, id)
+		case sub == "result" && method == "GET":
+			getJobResult(ctx, id)
+		case sub == "" || sub == "result":
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		default:
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+		}
+		return
+	}
+
+	ctx.Error("Not found", fasthttp.StatusNotFound)
+}
+
+// routeTodoSubresource routes requests for /todos/{id}/{sub}.
+func routeTodoSubresource(ctx *fasthttp.RequestCtx, method string, id int, sub string) {
+	switch {
+	case sub == "move" && method == "PUT":
+		moveTodo(ctx, id)
+	case sub == "move":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "undo" && method == "POST":
+		undoTodo(ctx, id)
+	case sub == "undo":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "clone" && method == "POST":
+		cloneTodo(ctx, id)
+	case sub == "clone":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "toggle" && method == "POST":
+		toggleTodo(ctx, id)
+	case sub == "subtasks/complete-all" && method == "POST":
+		completeAllSubtasks(ctx, id)
+	case sub == "toggle" || sub == "subtasks/complete-all":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "archive" && method == "POST":
+		archiveTodo(ctx, id)
+	case sub == "archive" && method == "DELETE":
+		unarchiveTodo(ctx, id)
+	case sub == "archive":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "history" && method == "GET":
+		getTodoHistory(ctx, id)
+	case sub == "history":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "occurrences" && method == "GET":
+		getOccurrences(ctx, id)
+	case sub == "occurrences":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "dependencies" && method == "GET":
+		getDependencies(ctx, id)
+	case sub == "dependencies":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "links" && method == "GET":
+		getLinks(ctx, id)
+	case sub == "links" && method == "POST":
+		createLink(ctx, id)
+	case sub == "links":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case sub == "reminder" && method == "DELETE":
+		cancelReminder(ctx, id)
+	case sub == "reminder/snooze" && method == "POST":
+		snoozeReminder(ctx, id)
+	case sub == "reminder" || sub == "reminder/snooze":
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	case isShareRoute(sub):
+		routeShares(ctx, method, id, strings.TrimPrefix(sub, "share"))
+	case sub == "attachments" || strings.HasPrefix(sub, "attachments/"):
+		routeAttachments(ctx, method, id, sub[len("attachments"):])
+	case sub == "comments" || strings.HasPrefix(sub, "comments/"):
+		routeComments(ctx, method, id, sub[len("comments"):])
+	case strings.HasPrefix(sub, "links/"):
+		target, err := strconv.Atoi(sub[len("links/"):])
+		if err != nil {
+			ctx.Error("Invalid ID", fasthttp.StatusBadRequest)
+			return
+		}
+		if method == "DELETE" {
+			deleteLink(ctx, id, target)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+	default:
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+	}
+}
+
+// writeJSON marshals v and writes it as the response body with the given status code.
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v interface{}) {
+	done := traceOp(ctx, "response.marshal")
+	resp, err := json.Marshal(v)
+	done()
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	writeRawJSON(ctx, status, resp)
+}
+
+// writeRawJSON writes an already encoded JSON document as the response body.
+func writeRawJSON(ctx *fasthttp.RequestCtx, status int, body []byte) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(status)
+	ctx.SetBody(body)
+}
+
+// getTodos returns all todos the caller may see, ordered by ID, as a JSON
+// array. The array is
+// assembled from each todo's cached JSON instead of marshaling every todo.
+// ?format=ndjson streams them instead, see getTodosNDJSON.
+func getTodos(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	switch string(args.Peek("format")) {
+	case "", "json":
+	case "ndjson":
+		getTodosNDJSON(ctx)
+		return
+	default:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid format",
+			`format must be "json" (the default) or "ndjson"`)
+		return
+	}
+	view := string(args.Peek("view"))
+	if !validView(view) {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid view",
+			`view must be "full" (the default) or "summary"`)
+		return
+	}
+	sortBy := string(args.Peek("sort"))
+	if sortBy != "" && sortBy != "id" && sortBy != "position" {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid sort",
+			`sort must be "id" (the default) or "position"`)
+		return
+	}
+	byPosition := sortBy == "position"
+	if args.GetBool("shared") {
+		getSharedTodos(ctx)
+		return
+	}
+	if args.GetBool("ready") {
+		getReadyTodos(ctx)
+		return
+	}
+	switch string(args.Peek("group_by")) {
+	case "":
+	case "status":
+		getTodoBoard(ctx, view == "summary")
+		return
+	default:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid group_by",
+			`group_by must be "status"`)
+		return
+	}
+	if args.Has("cursor") || args.Has("limit") {
+		if byPosition {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Pages are ordered by ID",
+				"leave out sort=position when paginating with cursor or limit")
+			return
+		}
+		getTodoPage(ctx, view == "summary")
+		return
+	}
+	if view == "summary" {
+		getTodoSummaries(ctx, byPosition)
+		return
+	}
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	done := traceOp(ctx, "store.list")
+	var raws [][]byte
+	if byPosition {
+		raws = namespaceOf(ctx).store.rawListByPosition(visible)
+	} else {
+		raws = namespaceOf(ctx).store.rawList(visible)
+	}
+	done()
+	done = traceOp(ctx, "response.marshal")
+	body := joinJSON(raws)
+	done()
+	writeRawJSON(ctx, fasthttp.StatusOK, body)
+}
+
+// joinJSON assembles a JSON array from already encoded elements.
+func joinJSON(raws [][]byte) []byte {
+	size := 2
+	for _, raw := range raws {
+		size += len(raw) + 1
+	}
+
+	body := make([]byte, 0, size)
+	body = append(body, '[')
+	for i, raw := range raws {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, raw...)
+	}
+	body = append(body, ']')
+	return body
+}
+
+// getTodo returns a single todo identified by its id. ?include=comments
+// adds its comments, see shapeHandler.
+func getTodo(ctx *fasthttp.RequestCtx, id int) {
+	ns := namespaceOf(ctx)
+	done := traceOp(ctx, "store.get")
+	raw, ok := ns.store.raw(id)
+	done()
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	if includes(ctx, "comments") {
+		done := traceOp(ctx, "comments.list")
+		raw = withComments(raw, ns.comments, id)
+		done()
+	}
+
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// createTodo handles POST /todos by parsing multipart/form-data,
+// saving uploaded files, and adding the new todo to the in-memory state.
+func createTodo(ctx *fasthttp.RequestCtx) {
+	mForm, ok := parseTodoForm(ctx)
+	if !ok {
+		return
+	}
+
+	// Retrieve text fields, collecting every problem with them.
+	var errs []fieldError
+	title, _ := formValue(mForm, "title")
+	description, _ := formValue(mForm, "description")
+	priority, _ := formValue(mForm, "priority")
+	if !validPriority(priority) {
+		errs = append(errs, invalidPriority)
+	}
+	project, _ := formValue(mForm, "project")
+	tags, _ := formValue(mForm, "tags")
+	assignee, _ := formValue(mForm, "assignee")
+	dueAtStr, _ := formValue(mForm, "due_at")
+	dueAt, err := parseDueAt(dueAtStr)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "due_at", Message: "must be an RFC 3339 timestamp"})
+	}
+	remindAtStr, _ := formValue(mForm, "remind_at")
+	remindAt, err := parseDueAt(remindAtStr)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "remind_at", Message: "must be an RFC 3339 timestamp"})
+	}
+	now := time.Now()
+	expiresAtStr, _ := formValue(mForm, "expires_at")
+	ttl, _ := formValue(mForm, "ttl")
+	expiresAt, expiryErrs := parseExpiry(expiresAtStr, ttl, now)
+	errs = append(errs, expiryErrs...)
+	recurrence, _ := formValue(mForm, "recurrence")
+	if err := validateRecurrence(recurrence); err != nil {
+		errs = append(errs, fieldError{Field: "recurrence", Message: err.Error()})
+	}
+	status, _ := formValue(mForm, "status")
+	if status != "" && !validStatus(status) {
+		errs = append(errs, invalidStatus)
+	}
+	completedStr, hasCompleted := formValue(mForm, "completed")
+	completed, err := strconv.ParseBool(completedStr)
+	if hasCompleted && err != nil {
+		errs = append(errs, invalidCompleted)
+	}
+	subtasksStr, _ := formValue(mForm, "subtasks")
+	subtasks, subtaskErrs := parseSubtasks(subtasksStr, strictRequested(ctx))
+	if unknown := unknownFields(subtaskErrs); len(unknown) > 0 {
+		writeUnknownFields(ctx, unknown)
+		return
+	}
+	errs = append(errs, subtaskErrs...)
+
+	// Create the new todo. It is completed when all its subtasks are,
+	// unless its completed flag or a status says otherwise.
+	newTodo := &Todo{
+		Title:       title,
+		Description: description,
+		Subtasks:    subtasks,
+		Priority:    priority,
+		Project:     project,
+		Tags:        parseTags(tags),
+		Assignee:    assignee,
+		DueAt:       dueAt,
+		RemindAt:    remindAt,
+		ExpiresAt:   expiresAt,
+		Recurrence:  recurrence,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if errs = append(errs, validateTodo(newTodo)...); len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid todo", errs)
+		return
+	}
+	switch {
+	case status != "":
+		if err := setStatus(newTodo, status); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	case hasCompleted:
+		completeBySubtasks(newTodo)
+		setCompleted(newTodo, completed)
+	default:
+		completeBySubtasks(newTodo)
+	}
+	rejected, warnings := checkSoftRules(nil, newTodo)
+	if len(rejected) > 0 {
+		writeValidationErrors(ctx, "Rejected by validation rules", rejected)
+		return
+	}
+
+	// Process uploaded files.
+	if mForm.File != nil {
+		attachments, ok := saveAttachments(ctx, mForm)
+		if !ok {
+			return
+		}
+		for _, a := range attachments {
+			attach(newTodo, a)
+		}
+	}
+
+	addWarnings(ctx, warnings)
+	done := traceOp(ctx, "store.insert")
+	raw, err := namespaceOf(ctx).addTodo(actorOf(ctx), newTodo)
+	done()
+	if err != nil {
+		writeStoreError(ctx, err)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusCreated, raw)
+}
+
+// addTodo adds a todo to the default namespace, see namespace.addTodo.
+func addTodo(actor string, todo *Todo) ([]byte, error) {
+	return defaultNamespace.addTodo(actor, todo)
+}
+
+// numberSubtasks numbers the subtasks of a new todo. IDs sent for new todos
+// are ignored.
+func numberSubtasks(todo *Todo) {
+	subtasks := todo.Subtasks
+	for i := range subtasks {
+		subtasks[i].ID = 0
+	}
+	assignSubtaskIDs(todo, subtasks)
+}
+
+// changeTodo updates a todo of the default namespace, see
+// namespace.changeTodo.
+func changeTodo(actor string, id int, fn func(todo *Todo) error) ([]byte, bool, error) {
+	return defaultNamespace.changeTodo(actor, id, fn)
+}
+
+// updateTodo handles PUT /todos/{id} to update an existing todo, and with
+// patch PATCH /todos/{id}, which keeps the subtasks unless it sends them.
+func updateTodo(ctx *fasthttp.RequestCtx, id int, patch bool) {
+	// First, check if the todo exists.
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+
+	mForm, ok := parseTodoForm(ctx)
+	if !ok {
+		return
+	}
+
+	// Text fields are only updated if provided. Every problem with them is
+	// collected.
+	var errs []fieldError
+	title, hasTitle := formValue(mForm, "title")
+	description, hasDescription := formValue(mForm, "description")
+	priority, hasPriority := formValue(mForm, "priority")
+	if !validPriority(priority) {
+		errs = append(errs, invalidPriority)
+	}
+	project, hasProject := formValue(mForm, "project")
+	tags, hasTags := formValue(mForm, "tags")
+	assignee, hasAssignee := formValue(mForm, "assignee")
+	dueAtStr, hasDueAt := formValue(mForm, "due_at")
+	dueAt, err := parseDueAt(dueAtStr)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "due_at", Message: "must be an RFC 3339 timestamp"})
+	}
+	remindAtStr, hasRemindAt := formValue(mForm, "remind_at")
+	remindAt, err := parseDueAt(remindAtStr)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "remind_at", Message: "must be an RFC 3339 timestamp"})
+	}
+	expiresAtStr, hasExpiresAt := formValue(mForm, "expires_at")
+	ttl, hasTTL := formValue(mForm, "ttl")
+	expiresAt, expiryErrs := parseExpiry(expiresAtStr, ttl, time.Now())
+	errs = append(errs, expiryErrs...)
+	recurrence, hasRecurrence := formValue(mForm, "recurrence")
+	if err := validateRecurrence(recurrence); err != nil {
+		errs = append(errs, fieldError{Field: "recurrence", Message: err.Error()})
+	}
+	status, hasStatus := formValue(mForm, "status")
+	if hasStatus && !validStatus(status) {
+		errs = append(errs, invalidStatus)
+	}
+	completedStr, hasCompleted := formValue(mForm, "completed")
+	completed, err := strconv.ParseBool(completedStr)
+	if hasCompleted && err != nil {
+		errs = append(errs, invalidCompleted)
+	}
+	subtasksStr, hasSubtasks := formValue(mForm, "subtasks")
+	subtasks, subtaskErrs := parseSubtasks(subtasksStr, strictRequested(ctx))
+	if unknown := unknownFields(subtaskErrs); len(unknown) > 0 {
+		writeUnknownFields(ctx, unknown)
+		return
+	}
+	if errs = append(errs, subtaskErrs...); len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid todo", errs)
+		return
+	}
+
+	// Process any newly uploaded files.
+	var attachments []Attachment
+	if mForm.File != nil {
+		if attachments, ok = saveAttachments(ctx, mForm); !ok {
+			return
+		}
+	}
+
+	// Update the todo.
+	var warnings []fieldError
+	done := traceOp(ctx, "store.update")
+	raw, ok, err := ns.changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		old := *todo
+		if err := assignSubtaskIDs(todo, subtasks); err != nil {
+			return err
+		}
+		if hasTitle {
+			todo.Title = title
+		}
+		if hasDescription {
+			todo.Description = description
+		}
+		if hasPriority {
+			todo.Priority = priority
+		}
+		if hasProject {
+			todo.Project = project
+		}
+		if hasTags {
+			todo.Tags = parseTags(tags)
+		}
+		if hasAssignee {
+			todo.Assignee = assignee
+		}
+		if hasDueAt {
+			todo.DueAt = dueAt
+		}
+		if hasRemindAt {
+			todo.RemindAt = remindAt
+		}
+		if hasExpiresAt || hasTTL {
+			todo.ExpiresAt = expiresAt
+		}
+		if hasRecurrence {
+			todo.Recurrence = recurrence
+		}
+		if !patch || hasSubtasks {
+			todo.Subtasks = subtasks
+		}
+		// Only multipart bodies can carry files, which replace the
+		// attachments; other encodings keep them.
+		if mForm.File != nil {
+			todo.Attachments = nil
+			for _, a := range attachments {
+				attach(todo, a)
+			}
+		}
+		// A status wins over the completed flag, which wins over
+		// completion by subtasks where completionMode allows it. Subtasks
+		// don't move a todo where the workflow doesn't let it go, such as
+		// a blocked one to done; it keeps its status.
+		switch {
+		case hasStatus:
+			if err := setStatus(todo, status); err != nil {
+				return err
+			}
+		case hasCompleted:
+			completeBySubtasks(todo)
+			if err := setCompleted(todo, completed); err != nil {
+				return err
+			}
+		default:
+			completeBySubtasks(todo)
+		}
+		if errs := validateTodo(todo); len(errs) > 0 {
+			return &validationError{"Invalid todo", errs}
+		}
+		var rejected []fieldError
+		if rejected, warnings = checkSoftRules(&old, todo); len(rejected) > 0 {
+			return &validationError{"Rejected by validation rules", rejected}
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	done()
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		// The todo was deleted while the request was being processed.
+		todoNotFound(ctx, id)
+		return
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	}
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		writeValidationErrors(ctx, invalid.msg, invalid.errs)
+		return
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	addWarnings(ctx, warnings)
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// deleteTodo handles DELETE /todos/{id} by removing the todo from the in-memory state.
+func deleteTodo(ctx *fasthttp.RequestCtx, id int) {
+	done := traceOp(ctx, "store.remove")
+	removed, err := namespaceOf(ctx).removeTodo(actorOf(ctx), id)
+	done()
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !removed {
+		todoNotFound(ctx, id)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// removeTodo deletes a todo of the default namespace, see
+// namespace.removeTodo.
+func removeTodo(actor string, id int) (bool, error) {
+	return defaultNamespace.removeTodo(actor, id)
+}
+
+// formValue returns the first value of the form field key and whether the
+// field was present at all.
+func formValue(mForm *multipart.Form, key string) (string, bool) {
+	if vals, ok := mForm.Value[key]; ok && len(vals) > 0 {
+		return vals[0], true
+	}
+	return "", false
+}
+
+// checkAllSubtasksCompleted returns true if there is at least one subtask and all are completed.
+func checkAllSubtasksCompleted(subtasks []Subtask) bool {
+	if len(subtasks) == 0 {
+		return false
+	}
+	for _, s := range subtasks {
+		if !s.Completed {
+			return false
+		}
+	}
+	return true
+}
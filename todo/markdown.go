@@ -0,0 +1,611 @@
+package todo
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Descriptions are markdown. Clients that can't render it themselves ask
+// for ?render=html and get every description as HTML too, rendered by
+// renderMarkdown and cleaned by sanitizeHTML.
+
+// markdownHandler wraps h, adding a description_html field next to every
+// description in the JSON responses to GET requests with ?render=html.
+func markdownHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		render := ctx.QueryArgs().Peek("render")
+		if render == nil || !ctx.IsGet() {
+			h(ctx)
+			return
+		}
+		if string(render) != "html" {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid render",
+				`render must be "html", or left out for markdown only`)
+			return
+		}
+		h(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.Response.IsBodyStream() ||
+			!bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json")) {
+			return
+		}
+		defer traceOp(ctx, "response.markdown")()
+		root, err := parseJSONTree(ctx.Response.Body())
+		if err != nil {
+			return
+		}
+		addDescriptionHTML(root)
+		ctx.SetBody(appendJSONNode(nil, root))
+	}
+}
+
+// addDescriptionHTML adds description_html to every object in node with a
+// description.
+func addDescriptionHTML(node *jsonNode) {
+	for _, item := range node.items {
+		addDescriptionHTML(item)
+	}
+	if node.kind != 'o' {
+		return
+	}
+	for i, key := range node.keys {
+		if key == "description" && node.items[i].kind == 's' {
+			rendered := &jsonNode{kind: 's', str: renderMarkdown(node.items[i].str)}
+			node.keys = append(node.keys[:i+1], append([]string{"description_html"}, node.keys[i+1:]...)...)
+			node.items = append(node.items[:i+1], append([]*jsonNode{rendered}, node.items[i+1:]...)...)
+			return
+		}
+	}
+}
+
+var (
+	mdHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule       = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence      = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^` \t]*)")
+	mdListItem   = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	mdQuote      = regexp.MustCompile(`^ {0,3}> ?`)
+	mdHTMLTag    = regexp.MustCompile(`^(?:<!--[\s\S]*?-->|</?[A-Za-z][A-Za-z0-9-]*(?:\s+[A-Za-z_:][\w:.-]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*\s*/?>)`)
+	mdAutolink   = regexp.MustCompile(`^<((?:https?://|mailto:)[^\s<>]+)>`)
+	mdEntity     = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	mdLinkTarget = regexp.MustCompile(`^\(\s*(<[^<>\n]*>|[^\s()]*)(?:\s+"([^"]*)")?\s*\)`)
+)
+
+// renderMarkdown renders markdown as sanitized HTML. It knows paragraphs,
+// ATX headings, fenced code blocks, block quotes, ordered and unordered
+// lists, thematic breaks and hard line breaks, and inline code, emphasis,
+// strong emphasis, strikethrough, links, images and autolinks. Inline HTML
+// is kept as far as sanitizeHTML allows.
+func renderMarkdown(src string) string {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\t", "    "), "\n")
+	renderBlocks(&b, lines, false)
+	return sanitizeHTML(b.String())
+}
+
+// renderBlocks renders lines as blocks. The paragraphs of tight lists are
+// rendered without <p>.
+func renderBlocks(b *strings.Builder, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			fence := m[1]
+			i++
+			var code []string
+			for ; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code")
+			if m[2] != "" {
+				b.WriteString(` class="language-` + html.EscapeString(m[2]) + `"`)
+			}
+			b.WriteString(">")
+			for _, l := range code {
+				b.WriteString(html.EscapeString(l) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+
+		case mdRule.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, false)
+			b.WriteString("</blockquote>\n")
+
+		case mdListItem.MatchString(line):
+			i = renderList(b, lines, i)
+
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && (len(para) == 0 || !startsBlock(lines[i])); i++ {
+				para = append(para, strings.TrimLeft(lines[i], " "))
+			}
+			text := renderInline(strings.Join(para, "\n"))
+			if tight {
+				b.WriteString(text + "\n")
+			} else {
+				b.WriteString("<p>" + text + "</p>\n")
+			}
+		}
+	}
+}
+
+// startsBlock reports whether line starts a block other than a paragraph.
+func startsBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) ||
+		mdQuote.MatchString(line) || mdListItem.MatchString(line)
+}
+
+// renderList renders the list starting at lines[start] and returns the
+// index of the line after it. Items continue on lines indented past their
+// marker and on unindented lines right after them; a list is tight unless
+// blank lines separate its items or blocks.
+func renderList(b *strings.Builder, lines []string, start int) int {
+	first := mdListItem.FindStringSubmatch(lines[start])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	marker := first[2][len(first[2])-1:]
+	sameList := func(m []string) bool {
+		return m != nil && len(m[1]) <= len(first[1])+1 && strings.HasSuffix(m[2], marker) &&
+			(m[2][0] >= '0' && m[2][0] <= '9') == ordered
+	}
+	var items [][]string
+	tight := true
+	i := start
+	for i < len(lines) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		if !sameList(m) {
+			break
+		}
+		width := len(m[0])
+		if m[3] == "" {
+			width++
+		}
+		item := []string{lines[i][len(m[0]):]}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			switch {
+			case strings.TrimSpace(line) == "":
+				// A blank line continues the item if it is followed by an
+				// indented line.
+				j := i
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j < len(lines) && len(lines[j])-len(strings.TrimLeft(lines[j], " ")) >= width {
+					tight = false
+					item = append(item, lines[i:j]...)
+					i = j
+					continue
+				}
+				if j < len(lines) && sameList(mdListItem.FindStringSubmatch(lines[j])) {
+					tight = false
+				}
+				i = j
+				goto next
+			case indent >= width:
+				item = append(item, line[width:])
+			case !startsBlock(line) && strings.TrimSpace(item[len(item)-1]) != "":
+				item = append(item, line)
+			default:
+				goto next
+			}
+			i++
+		}
+	next:
+		items = append(items, item)
+		if strings.TrimSpace(lines[i-1]) == "" && (i >= len(lines) || !sameList(mdListItem.FindStringSubmatch(lines[i]))) {
+			break
+		}
+	}
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n, _ := strconv.Atoi(strings.TrimRight(first[2], ".)")); n != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(n) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		renderBlocks(b, item, tight)
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// renderInline renders the inline markdown of text as HTML.
+func renderInline(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(text) && unicode.IsPunct(rune(text[i+1])) || c == '\\' && i+1 < len(text) && unicode.IsSymbol(rune(text[i+1])):
+			b.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			fence := rest[:run]
+			if end := strings.Index(rest[run:], fence); end >= 0 {
+				code := rest[run : run+end]
+				if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(strings.ReplaceAll(code, "\n", " ")) + "</code>")
+				i += run + end + run
+				continue
+			}
+			b.WriteString(fence)
+			i += run
+			continue
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if inner, n, ok := delimited(text, i, rest[:2]); ok {
+				b.WriteString("<strong>" + renderInline(inner) + "</strong>")
+				i += n
+				continue
+			}
+		case strings.HasPrefix(rest, "~~"):
+			if inner, n, ok := delimited(text, i, "~~"); ok {
+				b.WriteString("<del>" + renderInline(inner) + "</del>")
+				i += n
+				continue
+			}
+		case c == '*' || c == '_':
+			if inner, n, ok := delimited(text, i, rest[:1]); ok {
+				b.WriteString("<em>" + renderInline(inner) + "</em>")
+				i += n
+				continue
+			}
+		case c == '!' && strings.HasPrefix(rest, "!["):
+			if label, url, title, n, ok := linkAt(rest[1:]); ok {
+				b.WriteString(`<img src="` + html.EscapeString(url) + `" alt="` + html.EscapeString(label) + `"`)
+				if title != "" {
+					b.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				b.WriteString(">")
+				i += 1 + n
+				continue
+			}
+		case c == '[':
+			if label, url, title, n, ok := linkAt(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(url) + `"`)
+				if title != "" {
+					b.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				b.WriteString(">" + renderInline(label) + "</a>")
+				i += n
+				continue
+			}
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(rest); m != nil {
+				url := html.EscapeString(m[1])
+				b.WriteString(`<a href="` + url + `">` + url + "</a>")
+				i += len(m[0])
+				continue
+			}
+			if m := mdHTMLTag.FindString(rest); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+		case c == '&':
+			if m := mdEntity.FindString(rest); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+		case c == '\n':
+			if strings.HasSuffix(b.String(), "  ") {
+				trimmed := strings.TrimRight(b.String(), " ")
+				b.Reset()
+				b.WriteString(trimmed + "<br>\n")
+			} else {
+				b.WriteByte('\n')
+			}
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(text[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// delimited returns the text between the delimiter at text[i] and the next
+// one closing it, and the length of the whole span. Delimiters must hug
+// the text they enclose, and underscores must not be within words.
+func delimited(text string, i int, delim string) (string, int, bool) {
+	start := i + len(delim)
+	if start >= len(text) || text[start] == ' ' || text[start] == '\n' {
+		return "", 0, false
+	}
+	wordChar := func(j int) bool {
+		return j >= 0 && j < len(text) && (unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j])))
+	}
+	if delim[0] == '_' && wordChar(i-1) {
+		return "", 0, false
+	}
+	for j := start + 1; j+len(delim) <= len(text); j++ {
+		if text[j:j+len(delim)] != delim || text[j-1] == ' ' || text[j-1] == '\n' {
+			continue
+		}
+		if len(delim) == 1 && j+1 < len(text) && text[j+1] == delim[0] {
+			// Part of a double delimiter.
+			j++
+			continue
+		}
+		if delim[0] == '_' && wordChar(j+len(delim)) {
+			continue
+		}
+		return text[start:j], j + len(delim) - i, true
+	}
+	return "", 0, false
+}
+
+// linkAt parses a link, [label](url "title"), at the start of s and returns
+// its parts and length.
+func linkAt(s string) (label, url, title string, n int, ok bool) {
+	depth := 0
+	for j := 0; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			m := mdLinkTarget.FindStringSubmatch(s[j+1:])
+			if m == nil {
+				return "", "", "", 0, false
+			}
+			return s[1:j], strings.Trim(m[1], "<>"), m[2], j + 1 + len(m[0]), true
+		}
+	}
+	return "", "", "", 0, false
+}
+
+// sanitizedTags lists the HTML elements sanitizeHTML keeps, with their
+// allowed attributes.
+var sanitizedTags = map[string][]string{
+	"a": {"href", "title"}, "img": {"src", "alt", "title"},
+	"p": nil, "br": nil, "hr": nil, "blockquote": nil, "pre": nil, "code": {"class"},
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"strong": nil, "b": nil, "em": nil, "i": nil, "del": nil, "s": nil,
+	"kbd": nil, "sub": nil, "sup": nil, "mark": nil,
+}
+
+// voidTags are the sanitized elements without contents or end tags.
+var voidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// droppedTags are the elements sanitizeHTML removes along with their
+// contents, rather than keeping their text.
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true, "template": true,
+	"noscript": true, "textarea": true, "title": true, "svg": true, "math": true, "select": true,
+}
+
+var codeClass = regexp.MustCompile(`^language-[A-Za-z0-9_+#-]+$`)
+
+// sanitizeHTML keeps only the elements and attributes of sanitizedTags in
+// s, with safe URLs, and escapes all text. Other elements are removed but
+// keep their text, except droppedTags, and comments are removed. Links get
+// rel="nofollow noopener noreferrer", and elements left open are closed.
+func sanitizeHTML(s string) string {
+	var b strings.Builder
+	var open []string
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			b.WriteString(escapeHTMLText(s))
+			break
+		}
+		b.WriteString(escapeHTMLText(s[:lt]))
+		s = s[lt:]
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		name, closing, attrs, n, ok := parseHTMLTag(s)
+		if !ok {
+			b.WriteString("&lt;")
+			s = s[1:]
+			continue
+		}
+		s = s[n:]
+		if droppedTags[name] {
+			if !closing {
+				end := strings.Index(strings.ToLower(s), "</"+name)
+				if end < 0 {
+					break
+				}
+				s = s[end:]
+			}
+			continue
+		}
+		allowed, ok := sanitizedTags[name]
+		if !ok {
+			continue
+		}
+		if closing {
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j] == name {
+					for k := len(open) - 1; k >= j; k-- {
+						b.WriteString("</" + open[k] + ">")
+					}
+					open = open[:j]
+					break
+				}
+			}
+			continue
+		}
+		b.WriteString("<" + name)
+		for _, attr := range attrs {
+			if !containsString(allowed, attr[0]) {
+				continue
+			}
+			value := html.UnescapeString(attr[1])
+			switch {
+			case (attr[0] == "href" || attr[0] == "src") && !safeURL(value, attr[0] == "href"):
+				continue
+			case attr[0] == "class" && !codeClass.MatchString(value):
+				continue
+			case attr[0] == "start":
+				if _, err := strconv.Atoi(value); err != nil {
+					continue
+				}
+			}
+			b.WriteString(" " + attr[0] + `="` + html.EscapeString(value) + `"`)
+		}
+		if name == "a" {
+			b.WriteString(` rel="nofollow noopener noreferrer"`)
+		}
+		b.WriteString(">")
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+	for j := len(open) - 1; j >= 0; j-- {
+		b.WriteString("</" + open[j] + ">")
+	}
+	return b.String()
+}
+
+// escapeHTMLText escapes text for HTML, keeping the characters it already
+// escapes as they are.
+func escapeHTMLText(s string) string {
+	return html.EscapeString(html.UnescapeString(s))
+}
+
+// parseHTMLTag parses the tag at the start of s, returning its lowercased
+// name, whether it is an end tag, its attributes with lowercased names, and
+// its length. ok is false if s doesn't start with a tag.
+func parseHTMLTag(s string) (name string, closing bool, attrs [][2]string, n int, ok bool) {
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' || i > start && s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	if i == start {
+		return "", false, nil, 0, false
+	}
+	name = strings.ToLower(s[start:i])
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	for i < len(s) {
+		for i < len(s) && (isSpace(s[i]) || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return name, closing, attrs, i + 1, true
+		}
+		attrStart := i
+		for i < len(s) && !isSpace(s[i]) && !strings.ContainsRune("/>=\"'", rune(s[i])) {
+			i++
+		}
+		if i == attrStart {
+			// A stray quote.
+			i++
+			continue
+		}
+		attr := [2]string{strings.ToLower(s[attrStart:i]), ""}
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				end := strings.IndexByte(s[i+1:], s[i])
+				if end < 0 {
+					return "", false, nil, 0, false
+				}
+				attr[1] = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valueStart := i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				attr[1] = s[valueStart:i]
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	return "", false, nil, 0, false
+}
+
+// safeURL reports whether a link or image URL is relative or uses a safe
+// scheme: http and https, and mailto for links.
+func safeURL(u string, link bool) bool {
+	// Browsers ignore whitespace and control characters within schemes.
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	colon := strings.IndexByte(u, ':')
+	if colon < 0 || strings.ContainsAny(u[:colon], "/?#") {
+		return true
+	}
+	switch strings.ToLower(u[:colon]) {
+	case "http", "https":
+		return true
+	case "mailto":
+		return link
+	}
+	return false
+}
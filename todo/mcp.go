@@ -0,0 +1,462 @@
+package todo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The todos are also served to LLM agents and editors as a Model Context
+// Protocol server, a JSON-RPC 2.0 API offering the tools in mcpTools. Local
+// clients start the server as a subprocess and talk to it over stdin and
+// stdout, see serveMCPStdio; remote ones use the SSE transport, opening an
+// event stream with GET /mcp/sse and sending their requests to POST
+// /mcp/messages, see getMCPStream.
+
+// mcpProtocolVersion is the protocol version the server implements, which
+// it answers every client's initialize request with.
+const mcpProtocolVersion = "2024-11-05"
+
+// mcpListLimit is how many todos list_todos returns unless asked for a
+// different limit, and mcpMaxListLimit the most it returns.
+const (
+	mcpListLimit    = 50
+	mcpMaxListLimit = 500
+)
+
+// mcpMaxMessageSize is the size of the largest message read from stdin.
+const mcpMaxMessageSize = 1 << 20
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// mcpTool is a tool offered to MCP clients. call works on the todos of ns
+// and returns the text of the result, or the error to report to the client.
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+	call        func(ns *namespace, caller *principal, args json.RawMessage) (string, error)
+}
+
+// mcpTools lists the tools of the MCP server.
+var mcpTools = []mcpTool{
+	{
+		Name:        "list_todos",
+		Description: "List todos, newest first. By default only open todos are listed.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"query": {"type": "string", "description": "Only todos whose title, description or tags contain this text"},
+			"project": {"type": "string", "description": "Only todos of this project"},
+			"include_completed": {"type": "boolean", "description": "Also list completed todos"},
+			"limit": {"type": "integer", "minimum": 1, "maximum": 500, "description": "Most todos to return, 50 by default"}}}`),
+		call: mcpListTodos,
+	},
+	{
+		Name:        "get_todo",
+		Description: "Get a todo with its subtasks by ID.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`),
+		call:        mcpGetTodo,
+	},
+	{
+		Name:        "create_todo",
+		Description: "Create a todo and return it.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"title": {"type": "string"},
+			"description": {"type": "string"},
+			"priority": {"type": "string", "enum": ["low", "medium", "high", "urgent"]},
+			"project": {"type": "string"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"assignee": {"type": "string"},
+			"due_at": {"type": "string", "format": "date-time", "description": "RFC 3339 timestamp"}},
+			"required": ["title"]}`),
+		call: mcpCreateTodo,
+	},
+	{
+		Name:        "complete_todo",
+		Description: "Complete a todo and its subtasks, and return it. Completed todos are left as they are.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`),
+		call:        mcpCompleteTodo,
+	},
+}
+
+// handleMCP handles a JSON-RPC message of an MCP client working on the todos
+// of ns and returns the response to send, nil for notifications.
+func handleMCP(ns *namespace, caller *principal, message []byte) []byte {
+	var req rpcRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		return rpcReply(json.RawMessage("null"), nil, &rpcError{rpcParseError, "Parse error: " + err.Error()})
+	}
+	if req.ID == nil {
+		// Notifications, like notifications/initialized, need no answer.
+		return nil
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcReply(req.ID, nil, &rpcError{rpcInvalidRequest, "Invalid request"})
+	}
+	result, rpcErr := callMCP(ns, caller, req.Method, req.Params)
+	return rpcReply(req.ID, result, rpcErr)
+}
+
+func rpcReply(id json.RawMessage, result interface{}, rpcErr *rpcError) []byte {
+	out, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", ID: id, Result: result, Error: rpcErr})
+	return out
+}
+
+// callMCP calls an MCP method.
+func callMCP(ns *namespace, caller *principal, method string, params json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "todo-app-memory", "version": buildVersion},
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpTools}, nil
+	case "tools/call":
+		var p struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, "Invalid params: " + err.Error()}
+		}
+		for _, tool := range mcpTools {
+			if tool.Name != p.Name {
+				continue
+			}
+			if len(p.Arguments) == 0 {
+				p.Arguments = json.RawMessage("{}")
+			}
+			text, err := tool.call(ns, caller, p.Arguments)
+			if err != nil {
+				text = err.Error()
+			}
+			return map[string]interface{}{
+				"content": []map[string]string{{"type": "text", "text": text}},
+				"isError": err != nil,
+			}, nil
+		}
+		return nil, &rpcError{rpcInvalidParams, "Unknown tool " + p.Name}
+	}
+	return nil, &rpcError{rpcMethodNotFound, "Method not found: " + method}
+}
+
+// mcpArgs decodes the arguments of a tool call into v.
+func mcpArgs(args json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(string(args)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+// mcpCanWrite returns an error unless the caller may change todos.
+func mcpCanWrite(caller *principal) error {
+	if len(apiKeys) > 0 && caller.role < roleEditor {
+		return errors.New("your API key may only read todos")
+	}
+	return nil
+}
+
+func mcpListTodos(ns *namespace, caller *principal, args json.RawMessage) (string, error) {
+	var a struct {
+		Query            string `json:"query"`
+		Project          string `json:"project"`
+		IncludeCompleted bool   `json:"include_completed"`
+		Limit            int    `json:"limit"`
+	}
+	if err := mcpArgs(args, &a); err != nil {
+		return "", err
+	}
+	switch {
+	case a.Limit == 0:
+		a.Limit = mcpListLimit
+	case a.Limit < 0 || a.Limit > mcpMaxListLimit:
+		return "", fmt.Errorf("limit must be between 1 and %d", mcpMaxListLimit)
+	}
+	query := strings.ToLower(a.Query)
+	todos := []Todo{}
+	ns.store.listed(func(todo *Todo) bool {
+		if todo.Completed && !a.IncludeCompleted || ns.permission(caller, todo) == permNone ||
+			a.Project != "" && todo.Project != a.Project {
+			return true
+		}
+		text := strings.ToLower(strings.Join(append([]string{todo.Title, todo.Description}, todo.Tags...), " "))
+		if strings.Contains(text, query) {
+			todos = append(todos, todo.clone())
+		}
+		return true
+	})
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID > todos[j].ID })
+	if len(todos) > a.Limit {
+		todos = todos[:a.Limit]
+	}
+	out, err := json.Marshal(todos)
+	return string(out), err
+}
+
+func mcpGetTodo(ns *namespace, caller *principal, args json.RawMessage) (string, error) {
+	var a struct {
+		ID int `json:"id"`
+	}
+	if err := mcpArgs(args, &a); err != nil {
+		return "", err
+	}
+	todo, ok := ns.store.get(a.ID)
+	if !ok || ns.permission(caller, &todo) == permNone {
+		return "", fmt.Errorf("todo %d not found", a.ID)
+	}
+	raw, _ := ns.store.raw(a.ID)
+	return string(raw), nil
+}
+
+func mcpCreateTodo(ns *namespace, caller *principal, args json.RawMessage) (string, error) {
+	var a struct {
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Priority    string   `json:"priority"`
+		Project     string   `json:"project"`
+		Tags        []string `json:"tags"`
+		Assignee    string   `json:"assignee"`
+		DueAt       string   `json:"due_at"`
+	}
+	if err := mcpArgs(args, &a); err != nil {
+		return "", err
+	}
+	if err := mcpCanWrite(caller); err != nil {
+		return "", err
+	}
+	if len(apiKeys) > 0 && !caller.canSee(a.Project) {
+		return "", fmt.Errorf("your API key may not add todos to project %q", a.Project)
+	}
+	if !validPriority(a.Priority) {
+		return "", errors.New("priority " + invalidPriority.Message)
+	}
+	dueAt, err := parseDueAt(a.DueAt)
+	if err != nil {
+		return "", errors.New("due_at must be an RFC 3339 timestamp")
+	}
+	now := time.Now()
+	todo := &Todo{
+		Title:       a.Title,
+		Description: a.Description,
+		Priority:    a.Priority,
+		Project:     a.Project,
+		Tags:        a.Tags,
+		Assignee:    a.Assignee,
+		DueAt:       dueAt,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if errs := validateTodo(todo); len(errs) > 0 {
+		return "", fmt.Errorf("invalid todo: %s %s", errs[0].Field, errs[0].Message)
+	}
+	if rejected, _ := checkSoftRules(nil, todo); len(rejected) > 0 {
+		return "", fmt.Errorf("rejected by validation rules: %s %s", rejected[0].Field, rejected[0].Message)
+	}
+	raw, err := ns.addTodo("mcp:"+caller.name, todo)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func mcpCompleteTodo(ns *namespace, caller *principal, args json.RawMessage) (string, error) {
+	var a struct {
+		ID int `json:"id"`
+	}
+	if err := mcpArgs(args, &a); err != nil {
+		return "", err
+	}
+	if err := mcpCanWrite(caller); err != nil {
+		return "", err
+	}
+	raw, ok, err := ns.changeTodo("mcp:"+caller.name, a.ID, func(todo *Todo) error {
+		if ns.permission(caller, todo) < permEditor {
+			return errNotVisible
+		}
+		if todo.Completed {
+			return errNoChange
+		}
+		if err := setStatus(todo, statusDone); err != nil {
+			return err
+		}
+		for i := range todo.Subtasks {
+			todo.Subtasks[i].Completed = true
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	switch {
+	case !ok || errors.Is(err, errNotVisible):
+		return "", fmt.Errorf("todo %d not found", a.ID)
+	case errors.Is(err, errNoChange):
+		raw, _ = ns.store.raw(a.ID)
+	case err != nil:
+		return "", fmt.Errorf("can't complete todo %d: %w", a.ID, err)
+	}
+	return string(raw), nil
+}
+
+// mcpStdioPrincipal is the caller of MCP requests over stdio. The client
+// started the server itself, so it may do everything. It works on the
+// default namespace.
+var mcpStdioPrincipal = &principal{name: "stdio", role: roleAdmin, all: true, allTenants: true}
+
+// serveMCPStdio serves MCP on r and w, one JSON-RPC message per line, until
+// r ends or ctx is canceled.
+func serveMCPStdio(ctx context.Context, r io.Reader, w io.Writer) {
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, mcpMaxMessageSize)
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			if reply := handleMCP(defaultNamespace, mcpStdioPrincipal, line); reply != nil {
+				if _, err := w.Write(append(reply, '\n')); err != nil {
+					log.Printf("MCP: writing to stdout: %s", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// mcpSession is a client connected to the SSE transport. Its requests work
+// on the namespace the session was opened in, and the responses to them are
+// queued in replies until its stream sends them.
+type mcpSession struct {
+	ns      *namespace
+	caller  *principal
+	replies chan []byte
+}
+
+var (
+	mcpSessionsMu sync.Mutex
+	mcpSessions   = make(map[string]*mcpSession)
+)
+
+// getMCPStream handles GET /mcp/sse, opening an MCP session over the SSE
+// transport. Its first event, endpoint, tells the client where to POST its
+// requests, and the responses follow as message events. Sessions last as
+// long as their stream.
+func getMCPStream(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	id := randomToken(16)
+	session := &mcpSession{ns: namespaceOf(ctx), caller: caller, replies: make(chan []byte, 64)}
+	mcpSessionsMu.Lock()
+	mcpSessions[id] = session
+	mcpSessionsMu.Unlock()
+
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			mcpSessionsMu.Lock()
+			delete(mcpSessions, id)
+			mcpSessionsMu.Unlock()
+		}()
+		heartbeat := time.NewTicker(replicationHeartbeat)
+		defer heartbeat.Stop()
+		fmt.Fprintf(w, "event: endpoint\ndata: %s/mcp/messages?session_id=%s\n\n", apiPrefix, id)
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-feedsStopped.Done():
+				return
+			case <-heartbeat.C:
+				w.WriteString(": ping\n\n")
+			case reply := <-session.replies:
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", reply)
+			}
+		}
+	})
+}
+
+// postMCPMessage handles POST /mcp/messages?session_id=, a JSON-RPC message
+// of a client of the SSE transport. Its response is sent on the session's
+// stream; the request itself is only acknowledged with 202 Accepted.
+func postMCPMessage(ctx *fasthttp.RequestCtx) {
+	mcpSessionsMu.Lock()
+	session, ok := mcpSessions[string(ctx.QueryArgs().Peek("session_id"))]
+	mcpSessionsMu.Unlock()
+	caller, _ := authenticate(ctx)
+	if !ok || caller == nil || caller.name != session.caller.name {
+		writeRequestError(ctx, fasthttp.StatusNotFound, "Unknown MCP session",
+			"open a session with GET /v1/mcp/sse, with the same API key, and use the endpoint it sends")
+		return
+	}
+	if reply := handleMCP(session.ns, session.caller, ctx.PostBody()); reply != nil {
+		select {
+		case session.replies <- reply:
+		default:
+			ctx.Error("Too many pending MCP responses", fasthttp.StatusServiceUnavailable)
+			return
+		}
+	}
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+}
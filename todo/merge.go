@@ -0,0 +1,205 @@
+package todo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// mergeRequest is the body of POST /todos/merge.
+type mergeRequest struct {
+	Target  int   `json:"target"`
+	Sources []int `json:"sources"`
+	// Action is what happens to the sources: "delete" (the default) or
+	// "archive".
+	Action string `json:"action"`
+}
+
+// mergeResult describes a merge.
+type mergeResult struct {
+	Todo             json.RawMessage `json:"todo"`
+	Merged           []int           `json:"merged"`
+	Action           string          `json:"action"`
+	SubtasksAdded    int             `json:"subtasks_added"`
+	AttachmentsAdded int             `json:"attachments_added"`
+	TagsAdded        []string        `json:"tags_added"`
+}
+
+// mergeInto adds the subtasks, attachments, tags and description of the sources
+// to target and records what was added in result. Completed subtasks stay
+// completed, and get new IDs on target.
+func mergeInto(target *Todo, sources []*Todo, result *mergeResult) error {
+	subtasks := target.Subtasks
+	descriptions := []string{}
+	if d := strings.TrimSpace(target.Description); d != "" {
+		descriptions = append(descriptions, d)
+	}
+	for _, src := range sources {
+		for _, st := range src.Subtasks {
+			st.ID = 0
+			subtasks = append(subtasks, st)
+			result.SubtasksAdded++
+		}
+		for _, a := range src.Attachments {
+			if !slices.ContainsFunc(target.Attachments, func(b Attachment) bool { return b.Path == a.Path }) {
+				attach(target, a)
+				result.AttachmentsAdded++
+			}
+		}
+		for _, tag := range src.Tags {
+			if !slices.Contains(target.Tags, tag) {
+				target.Tags = append(target.Tags, tag)
+				result.TagsAdded = append(result.TagsAdded, tag)
+			}
+		}
+		if d := strings.TrimSpace(src.Description); d != "" && !slices.Contains(descriptions, d) {
+			descriptions = append(descriptions, d)
+		}
+	}
+	if errs := normalizeSubtasks(subtasks); len(errs) > 0 {
+		return &validationError{"Merged todo is invalid", errs}
+	}
+	if err := assignSubtaskIDs(target, subtasks); err != nil {
+		return err
+	}
+	target.Subtasks = subtasks
+	target.Description = strings.Join(descriptions, "\n\n")
+	// A target the workflow keeps where it is keeps its status.
+	completeBySubtasks(target)
+	if errs := validateTodo(target); len(errs) > 0 {
+		return &validationError{"Merged todo is invalid", errs}
+	}
+	return nil
+}
+
+// mergeTodos handles POST /todos/merge with a JSON body such as
+// {"target": 3, "sources": [4, 5], "action": "archive"}. The subtasks,
+// attachments, tags and descriptions of the sources are added to the target,
+// and the sources are deleted or archived, all in one step: either every
+// todo changes or none does, even if the backend fails part way, see
+// todoStore.updateMany. Archiving moves the sources to done, so it is
+// refused with 409 Conflict if the workflow doesn't allow that for one.
+func mergeTodos(ctx *fasthttp.RequestCtx) {
+	var req mergeRequest
+	if !decodeJSONBody(ctx, &req) {
+		return
+	}
+	if req.Action == "" {
+		req.Action = "delete"
+	}
+	switch {
+	case req.Action != "delete" && req.Action != "archive":
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid action", `action must be "delete" (the default) or "archive"`)
+		return
+	case req.Target <= 0 || len(req.Sources) == 0:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Nothing to merge", "set target to the ID of the todo to merge into, and sources to the IDs of the todos to merge")
+		return
+	}
+	ids := append([]int{req.Target}, req.Sources...)
+	for i, id := range ids {
+		if slices.Contains(ids[:i], id) {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Duplicate todo", "list every todo once, and the target not among the sources")
+			return
+		}
+	}
+	// The merge changes every todo, and deleting the sources takes the
+	// permission DELETE /todos/{id} does.
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	ns := namespaceOf(ctx)
+	for _, id := range ids {
+		todo, ok := ns.store.get(id)
+		if !ok {
+			todoNotFound(ctx, id)
+			return
+		}
+		need := permEditor
+		if id != req.Target && req.Action == "delete" {
+			need = permOwner
+		}
+		switch perm := ns.permission(caller, &todo); {
+		case perm == permNone:
+			ctx.Error("Todo not found", fasthttp.StatusNotFound)
+			return
+		case perm < need:
+			ctx.Error("Forbidden", fasthttp.StatusForbidden)
+			return
+		}
+	}
+
+	result := mergeResult{Merged: req.Sources, Action: req.Action + "d", TagsAdded: []string{}}
+	actor := actorOf(ctx)
+	done := traceOp(ctx, "store.update")
+	removed, missing, err := ns.store.updateMany(actor, ids, func(todos []*Todo) ([]int, error) {
+		now := time.Now()
+		target, sources := todos[0], todos[1:]
+		if err := mergeInto(target, sources, &result); err != nil {
+			return nil, err
+		}
+		target.UpdatedAt = now
+		if req.Action == "delete" {
+			return req.Sources, nil
+		}
+		for _, src := range sources {
+			if err := setStatus(src, statusDone); err != nil {
+				return nil, fmt.Errorf("todo %d can't be archived: %w", src.ID, err)
+			}
+			archivedAt := now
+			src.ArchivedAt = &archivedAt
+			src.UpdatedAt = now
+		}
+		return nil, nil
+	})
+	done()
+	if missing != 0 {
+		todoNotFound(ctx, missing)
+		return
+	}
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		writeValidationErrors(ctx, invalid.msg, invalid.errs)
+		return
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	}
+	if writeStoreError(ctx, err) {
+		// Changes the backend didn't take back stay made.
+		if len(removed) > 0 {
+			todosChanged()
+		}
+		for _, todo := range removed {
+			ns.unlinkAll(actor, todo)
+		}
+		return
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	todosChanged()
+	for _, todo := range removed {
+		ns.unlinkAll(actor, todo)
+		ns.publish(Event{Type: "todo.deleted", TodoID: todo.ID})
+	}
+	if req.Action == "archive" {
+		for _, id := range req.Sources {
+			ns.publish(Event{Type: "todo.updated", TodoID: id})
+		}
+	}
+	ns.publish(Event{Type: "todo.updated", TodoID: req.Target})
+	// Rules triggered by the events may have changed the target.
+	result.Todo, _ = ns.store.raw(req.Target)
+	writeJSON(ctx, fasthttp.StatusOK, result)
+}
@@ -0,0 +1,56 @@
+package todo
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/valyala/fasthttp"
+)
+
+// getMetrics handles GET /metrics and reports server metrics in the
+// Prometheus text exposition format.
+func getMetrics(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+
+	fmt.Fprintln(ctx, "# HELP todo_cache_hits_total Responses served from the response cache.")
+	fmt.Fprintln(ctx, "# TYPE todo_cache_hits_total counter")
+	fmt.Fprintf(ctx, "todo_cache_hits_total %d\n", cache.hits.Load())
+	fmt.Fprintln(ctx, "# HELP todo_cache_misses_total Cacheable responses that had to be rendered.")
+	fmt.Fprintln(ctx, "# TYPE todo_cache_misses_total counter")
+	fmt.Fprintf(ctx, "todo_cache_misses_total %d\n", cache.misses.Load())
+	fmt.Fprintln(ctx, "# HELP todo_cache_entries Responses currently held by the response cache.")
+	fmt.Fprintln(ctx, "# TYPE todo_cache_entries gauge")
+	fmt.Fprintf(ctx, "todo_cache_entries %d\n", cache.size())
+
+	counts := background.counts()
+	fmt.Fprintln(ctx, "# HELP todo_background_goroutines Running goroutines of the background components.")
+	fmt.Fprintln(ctx, "# TYPE todo_background_goroutines gauge")
+	for _, c := range counts {
+		fmt.Fprintf(ctx, "todo_background_goroutines{component=%q} %d\n", c.component, c.running)
+	}
+	fmt.Fprintln(ctx, "# HELP todo_background_goroutines_started_total Goroutines started by the background components.")
+	fmt.Fprintln(ctx, "# TYPE todo_background_goroutines_started_total counter")
+	for _, c := range counts {
+		fmt.Fprintf(ctx, "todo_background_goroutines_started_total{component=%q} %d\n", c.component, c.started)
+	}
+	fmt.Fprintln(ctx, "# HELP todo_goroutines Goroutines of the whole process, including request handlers.")
+	fmt.Fprintln(ctx, "# TYPE todo_goroutines gauge")
+	fmt.Fprintf(ctx, "todo_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(ctx, "# HELP todo_store_backend_errors_total Failed writes to the store backend, such as Redis.")
+	fmt.Fprintln(ctx, "# TYPE todo_store_backend_errors_total counter")
+	fmt.Fprintf(ctx, "todo_store_backend_errors_total %d\n", backendErrors.Load())
+	if spanExporter != nil {
+		fmt.Fprintln(ctx, "# HELP todo_trace_spans_dropped_total Spans dropped because the export queue was full.")
+		fmt.Fprintln(ctx, "# TYPE todo_trace_spans_dropped_total counter")
+		fmt.Fprintf(ctx, "todo_trace_spans_dropped_total %d\n", spansDropped.Load())
+	}
+	if writeBehindQueue != nil {
+		fmt.Fprintln(ctx, "# HELP todo_store_write_behind_queue Todos with changes waiting to be written to the store backend.")
+		fmt.Fprintln(ctx, "# TYPE todo_store_write_behind_queue gauge")
+		fmt.Fprintf(ctx, "todo_store_write_behind_queue %d\n", writeBehindQueue())
+		fmt.Fprintln(ctx, "# HELP todo_store_write_behind_flushed_total Changes written to the store backend by the write-behind queue.")
+		fmt.Fprintln(ctx, "# TYPE todo_store_write_behind_flushed_total counter")
+		fmt.Fprintf(ctx, "todo_store_write_behind_flushed_total %d\n", writeBehindFlushed.Load())
+	}
+}
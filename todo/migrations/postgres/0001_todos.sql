@@ -0,0 +1,30 @@
+-- Todos are stored as their JSON encoding. Subtasks and images are
+-- extracted into their own JSONB columns so they can be indexed and
+-- queried without decoding the whole todo.
+CREATE TABLE todos (
+	id         BIGINT PRIMARY KEY,
+	position   DOUBLE PRECISION NOT NULL,
+	data       JSONB NOT NULL,
+	subtasks   JSONB GENERATED ALWAYS AS (COALESCE(data->'subtasks', '[]'::jsonb)) STORED,
+	images     JSONB GENERATED ALWAYS AS (COALESCE(data->'images', '[]'::jsonb)) STORED,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX todos_position ON todos (position);
+CREATE INDEX todos_subtasks ON todos USING GIN (subtasks);
+
+-- todo_ids holds the last todo ID handed out.
+CREATE TABLE todo_ids (
+	next_id BIGINT NOT NULL
+);
+
+INSERT INTO todo_ids (next_id) VALUES (0);
+
+-- todo_changes announces changed todos to the other instances, which poll
+-- it. Old rows are deleted by the instances.
+CREATE TABLE todo_changes (
+	seq        BIGSERIAL PRIMARY KEY,
+	id         BIGINT NOT NULL,
+	instance   TEXT NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- Images became attachments, which carry the name, size, MIME type and
+-- checksum of their files.
+ALTER TABLE todos DROP COLUMN images;
+ALTER TABLE todos ADD COLUMN attachments JSONB GENERATED ALWAYS AS (COALESCE(data->'attachments', '[]'::jsonb)) STORED;
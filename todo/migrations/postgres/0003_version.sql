@@ -0,0 +1,4 @@
+-- version counts the saves of a todo, so an instance can tell whether
+-- another instance changed it since it was read. Existing todos start at
+-- version 1.
+ALTER TABLE todos ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
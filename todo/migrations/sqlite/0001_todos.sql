@@ -0,0 +1,17 @@
+-- Todos are stored as their JSON encoding; position is kept in its own
+-- column to order them without decoding.
+CREATE TABLE todos (
+	id         INTEGER PRIMARY KEY,
+	position   REAL NOT NULL,
+	data       TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+
+CREATE INDEX todos_position ON todos (position);
+
+-- todo_ids holds the last todo ID handed out.
+CREATE TABLE todo_ids (
+	next_id INTEGER NOT NULL
+);
+
+INSERT INTO todo_ids (next_id) VALUES (0);
@@ -0,0 +1,3 @@
+-- version counts the saves of a todo, so an instance can tell whether it
+-- changed since it was read. Existing todos start at version 1.
+ALTER TABLE todos ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
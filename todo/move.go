@@ -0,0 +1,161 @@
+package todo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// moveRequest is the body of PUT /todos/{id}/move. Exactly one of its
+// fields must be set.
+type moveRequest struct {
+	Before *int `json:"before"`
+	After  *int `json:"after"`
+	Index  *int `json:"index"`
+}
+
+// sortByPosition orders todos by position, then ID.
+func sortByPosition(todos []Todo) {
+	sort.Slice(todos, func(i, j int) bool {
+		if todos[i].Position != todos[j].Position {
+			return todos[i].Position < todos[j].Position
+		}
+		return todos[i].ID < todos[j].ID
+	})
+}
+
+// moveTodo handles PUT /todos/{id}/move, which places a todo before or
+// after another one, or at an index of the list ordered by position, for
+// drag-and-drop ordering. Only the moved todo gets a new position, between
+// those of its new neighbors, unless they are too close together; then all
+// todos are renumbered.
+func moveTodo(ctx *fasthttp.RequestCtx, id int) {
+	var req moveRequest
+	if !decodeJSONBody(ctx, &req) {
+		return
+	}
+	set := 0
+	for _, p := range []*int{req.Before, req.After, req.Index} {
+		if p != nil {
+			set++
+		}
+	}
+	if set != 1 {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid move",
+			`send exactly one of "before" or "after" with the ID of another todo, or "index"`)
+		return
+	}
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+
+	// The other todos in order; the moved todo goes in front of others[i].
+	var others []Todo
+	for _, todo := range ns.store.list() {
+		if todo.ID != id {
+			others = append(others, todo)
+		}
+	}
+	sortByPosition(others)
+	i := len(others)
+	switch {
+	case req.Index != nil:
+		if *req.Index < 0 {
+			ctx.Error("Invalid index", fasthttp.StatusBadRequest)
+			return
+		}
+		i = min(*req.Index, len(others))
+	default:
+		target := req.Before
+		if target == nil {
+			target = req.After
+		}
+		if *target == id {
+			ctx.Error("A todo cannot be moved relative to itself", fasthttp.StatusBadRequest)
+			return
+		}
+		i = -1
+		for j := range others {
+			if others[j].ID == *target {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			ctx.Error("Target todo not found", fasthttp.StatusNotFound)
+			return
+		}
+		if req.After != nil {
+			i++
+		}
+	}
+
+	actor := actorOf(ctx)
+	position, ok := positionAt(ns.store, others, i)
+	if !ok {
+		position = renumberPositions(ns.store, actor, others, i)
+	}
+	raw, ok, err := ns.changeTodo(actor, id, func(todo *Todo) error {
+		if todo.Position == position {
+			return errNoChange
+		}
+		todo.Position = position
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// positionAt returns a position in front of ordered[i] and after
+// ordered[i-1], the todos of s in order. It reports false if there is no
+// room between the two.
+func positionAt(s *todoStore, ordered []Todo, i int) (float64, bool) {
+	switch {
+	case i == len(ordered):
+		return s.nextPosition(), true
+	case i == 0:
+		// Zero means no position, see todoStore.place.
+		if p := ordered[0].Position - 1; p != 0 {
+			return p, true
+		}
+		return -1, true
+	}
+	lo, hi := ordered[i-1].Position, ordered[i].Position
+	mid := lo + (hi-lo)/2
+	return mid, lo < mid && mid < hi
+}
+
+// renumberPositions gives the todos of s in ordered the positions 1, 2, ...
+// with a gap before ordered[i], and returns the position in the gap.
+func renumberPositions(s *todoStore, actor string, ordered []Todo, i int) float64 {
+	positions := make(map[int]float64, len(ordered))
+	for j, todo := range ordered {
+		n := j + 1
+		if j >= i {
+			n++
+		}
+		positions[todo.ID] = float64(n)
+	}
+	now := time.Now()
+	s.updateAll(actor, func(todo *Todo) bool {
+		p, ok := positions[todo.ID]
+		if !ok || todo.Position == p {
+			return false
+		}
+		todo.Position = p
+		todo.UpdatedAt = now
+		return true
+	})
+	todosChanged()
+	return float64(i + 1)
+}
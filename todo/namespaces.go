@@ -0,0 +1,344 @@
+package todo
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// namespace holds the data of one tenant apart from all others: its todos
+// with their own ID sequence, their activity log, comments and shares, and
+// the directory of their uploads.
+type namespace struct {
+	id        string
+	store     *todoStore
+	shares    *shareTable
+	comments  *commentTable
+	uploads   string
+	createdAt time.Time
+}
+
+// defaultNamespace serves requests that name no tenant. Webhooks, rules,
+// escalations, digests and the other automation configured for the server
+// only act on its todos.
+var defaultNamespace = &namespace{
+	store:     store,
+	shares:    newShareTable(store.changes),
+	comments:  newCommentTable(),
+	uploads:   "uploads",
+	createdAt: startTime,
+}
+
+var (
+	namespacesMu sync.RWMutex
+	namespaces   = make(map[string]*namespace)
+)
+
+// tenantDomain, when set, makes requests to subdomains of it, such as
+// acme.todo.example.com for todo.example.com, use the namespace of the
+// subdomain's tenant.
+var tenantDomain string
+
+// namespaceKey is the user value holding the namespace of a request.
+const namespaceKey = "namespace"
+
+// validTenantID matches tenant IDs; they double as DNS labels.
+var validTenantID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// newNamespace returns an empty namespace for the tenant id and creates its
+// uploads directory.
+func newNamespace(id string) (*namespace, error) {
+	s := newTodoStore(defaultShardCount)
+	s.audit = &auditLog{byTodo: make(map[int][]int)}
+	ns := &namespace{
+		id:        id,
+		store:     s,
+		shares:    newShareTable(nil),
+		comments:  newCommentTable(),
+		uploads:   filepath.Join("uploads", "tenants", id),
+		createdAt: time.Now(),
+	}
+	if err := os.MkdirAll(ns.uploads, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// namespaceOf returns the namespace a request operates on.
+func namespaceOf(ctx *fasthttp.RequestCtx) *namespace {
+	if ns, ok := ctx.UserValue(namespaceKey).(*namespace); ok {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// allNamespaces returns the default namespace followed by those of the
+// tenants, for the background tasks working on all of them.
+func allNamespaces() []*namespace {
+	namespacesMu.RLock()
+	defer namespacesMu.RUnlock()
+	list := []*namespace{defaultNamespace}
+	for _, ns := range namespaces {
+		list = append(list, ns)
+	}
+	return list
+}
+
+// tenantOf returns the tenant named by a request in an X-Tenant-ID header
+// or, if tenantDomain is set, by the subdomain it was sent to. It returns
+// "" for requests to the default namespace.
+func tenantOf(ctx *fasthttp.RequestCtx) string {
+	if id := ctx.Request.Header.Peek("X-Tenant-ID"); len(id) > 0 {
+		return string(id)
+	}
+	if tenantDomain == "" {
+		return ""
+	}
+	host := string(ctx.Host())
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	sub, ok := strings.CutSuffix(strings.ToLower(host), "."+tenantDomain)
+	if !ok || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// isShareRoute reports whether sub, the part of a path after a todo or
+// project, addresses its shares.
+func isShareRoute(sub string) bool {
+	return sub == "share" || strings.HasPrefix(sub, "share/")
+}
+
+// namespaceHandler wraps h, making requests for a tenant operate on the
+// tenant's namespace. Unknown tenants, and tenants the caller's API key
+// doesn't grant, get 404 Not Found.
+func namespaceHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := tenantOf(ctx)
+		if id == "" {
+			h(ctx)
+			return
+		}
+		caller, ok := authenticate(ctx)
+		if !ok {
+			ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+			return
+		}
+		namespacesMu.RLock()
+		ns, ok := namespaces[id]
+		namespacesMu.RUnlock()
+		if !ok || !caller.inTenant(id) {
+			writeRequestError(ctx, fasthttp.StatusNotFound, "Unknown tenant "+id,
+				"tenants are provisioned with POST /admin/namespaces")
+			return
+		}
+		ctx.SetUserValue(namespaceKey, ns)
+		h(ctx)
+	}
+}
+
+// addTodo numbers the subtasks of a new todo, stores it in ns and publishes
+// a todo.created event. It returns the todo's JSON encoding, including any
+// changes made by rules, or a quotaError if the actor's tenant may not
+// create more todos and a storeError if the backend doesn't accept it. The
+// caller must not touch todo afterwards.
+func (ns *namespace) addTodo(actor string, todo *Todo) ([]byte, error) {
+	numberSubtasks(todo)
+	var raw []byte
+	err := ns.withinQuota(actor, 1, func() (err error) {
+		raw, err = ns.store.insert(actor, todo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	todosChanged()
+
+	id := todo.ID
+	ns.publish(Event{Type: "todo.created", TodoID: id})
+	// Rules triggered by the event may have changed the todo.
+	if current, ok := ns.store.raw(id); ok {
+		raw = current
+	}
+	return raw, nil
+}
+
+// changeTodo updates the todo of ns with the given ID through fn, like
+// store.update, and publishes a todo.updated event. The returned JSON
+// encoding includes any changes made by rules.
+func (ns *namespace) changeTodo(actor string, id int, fn func(todo *Todo) error) ([]byte, bool, error) {
+	raw, ok, err := ns.store.update(actor, id, fn)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	todosChanged()
+
+	ns.publish(Event{Type: "todo.updated", TodoID: id})
+	// Rules triggered by the event may have changed the todo.
+	if current, ok := ns.store.raw(id); ok {
+		raw = current
+	}
+	return raw, true, nil
+}
+
+// removeTodo deletes a todo of ns, drops the links other todos have to it
+// and publishes a todo.deleted event. It reports false if there was no such
+// todo, and returns a storeError if the backend doesn't accept the
+// deletion.
+func (ns *namespace) removeTodo(actor string, id int) (bool, error) {
+	todo, ok, err := ns.store.remove(actor, id)
+	if !ok || err != nil {
+		return false, err
+	}
+	ns.unlinkAll(actor, todo)
+	todosChanged()
+	ns.publish(Event{Type: "todo.deleted", TodoID: id})
+	return true, nil
+}
+
+// publish publishes an event of a todo of ns.
+func (ns *namespace) publish(e Event) {
+	if ns != defaultNamespace {
+		e.ns = ns
+	}
+	publish(e)
+}
+
+// permission returns the permission the caller has on a todo of the
+// namespace. Without access control everybody owns every todo.
+func (ns *namespace) permission(caller *principal, todo *Todo) permission {
+	if len(apiKeys) == 0 || caller.canSee(todo.Project) || ns.store.audit.creator(todo.ID) == caller.name {
+		return permOwner
+	}
+	return ns.shares.permission(caller.name, todo)
+}
+
+// projectPermission returns the permission the caller has on a whole
+// project of the namespace: owner with access to it, else the role it was
+// shared with.
+func (ns *namespace) projectPermission(caller *principal, project string) permission {
+	if len(apiKeys) == 0 || caller.canSee(project) {
+		return permOwner
+	}
+	return ns.shares.projectPermission(caller.name, project)
+}
+
+// count returns the number of todos in the namespace.
+func (ns *namespace) count() int {
+	n := 0
+	ns.store.each(func(*Todo) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// namespaceInfo describes a namespace in the admin API.
+type namespaceInfo struct {
+	ID        string    `json:"id"`
+	Todos     int       `json:"todos"`
+	Uploads   string    `json:"uploads"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (ns *namespace) info() namespaceInfo {
+	return namespaceInfo{ID: ns.id, Todos: ns.count(), Uploads: ns.uploads, CreatedAt: ns.createdAt}
+}
+
+// getNamespaces handles GET /admin/namespaces and lists the tenant
+// namespaces by ID.
+func getNamespaces(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	namespacesMu.RLock()
+	list := make([]*namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		list = append(list, ns)
+	}
+	namespacesMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	infos := make([]namespaceInfo, len(list))
+	for i, ns := range list {
+		infos[i] = ns.info()
+	}
+	writeJSON(ctx, fasthttp.StatusOK, infos)
+}
+
+// createNamespace handles POST /admin/namespaces with a JSON body such as
+// {"id": "acme"} and provisions an empty namespace for the tenant.
+func createNamespace(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	var in struct {
+		ID string `json:"id"`
+	}
+	if !decodeJSONBody(ctx, &in) {
+		return
+	}
+	if !validTenantID.MatchString(in.ID) {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid tenant ID",
+			"use 1 to 63 lowercase letters, digits and inner hyphens, such as acme-corp")
+		return
+	}
+	namespacesMu.Lock()
+	defer namespacesMu.Unlock()
+	if _, ok := namespaces[in.ID]; ok {
+		ctx.Error("Tenant already exists", fasthttp.StatusConflict)
+		return
+	}
+	ns, err := newNamespace(in.ID)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	namespaces[in.ID] = ns
+	ctx.Response.Header.Set("Location", apiPrefix+"/admin/namespaces/"+in.ID)
+	writeJSON(ctx, fasthttp.StatusCreated, ns.info())
+}
+
+// getNamespace handles GET /admin/namespaces/{id}.
+func getNamespace(ctx *fasthttp.RequestCtx, id string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	namespacesMu.RLock()
+	ns, ok := namespaces[id]
+	namespacesMu.RUnlock()
+	if !ok {
+		ctx.Error("Tenant not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, ns.info())
+}
+
+// deleteNamespace handles DELETE /admin/namespaces/{id} and drops the
+// tenant's todos, activity log and uploads for good.
+func deleteNamespace(ctx *fasthttp.RequestCtx, id string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	namespacesMu.Lock()
+	ns, ok := namespaces[id]
+	delete(namespaces, id)
+	namespacesMu.Unlock()
+	if !ok {
+		ctx.Error("Tenant not found", fasthttp.StatusNotFound)
+		return
+	}
+	if err := os.RemoveAll(ns.uploads); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	todosChanged()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package todo
+
+import (
+	"bufio"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ndjsonFlushEvery is the number of todos after which a streamed list is
+// flushed to the client.
+const ndjsonFlushEvery = 100
+
+// getTodosNDJSON handles GET /todos?format=ndjson and streams all todos,
+// ordered by ID, as newline-delimited JSON: one todo per line. Unlike the
+// JSON array, the response is never assembled in memory; only the IDs are
+// collected up front, and each todo is encoded from its cached JSON as it
+// is written. Todos deleted while the list is streamed are left out.
+func getTodosNDJSON(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	for _, arg := range []string{"view", "group_by", "limit", "cursor", "shared"} {
+		if args.Has(arg) {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid format",
+				"format=ndjson streams every todo and can't be combined with "+arg)
+			return
+		}
+	}
+	if sortBy := string(args.Peek("sort")); sortBy != "" && sortBy != "id" {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid format",
+			"format=ndjson streams todos ordered by ID")
+		return
+	}
+
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	s := namespaceOf(ctx).store
+	done := traceOp(ctx, "store.ids")
+	ids := s.listedIDs(visible)
+	done()
+	shape, _ := ctx.UserValue(shapeKey).(*todoShape)
+
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		written := 0
+		for _, id := range ids {
+			raw, ok := s.raw(id)
+			if !ok {
+				continue
+			}
+			if shape != nil && shape.fields != nil {
+				raw = shape.todo(raw)
+			}
+			w.Write(raw)
+			w.WriteByte('\n')
+			if written++; written%ndjsonFlushEvery == 0 {
+				if err := w.Flush(); err != nil {
+					// The client went away.
+					return
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Response formats GET endpoints can be negotiated into.
+const (
+	formatJSON     = "application/json"
+	formatXML      = "application/xml"
+	formatMsgpack  = "application/msgpack"
+	formatProtobuf = "application/x-protobuf"
+)
+
+// formatAliases maps accepted media types to the formats they select.
+var formatAliases = map[string]string{
+	"application/json":        formatJSON,
+	"application/*":           formatJSON,
+	"*/*":                     formatJSON,
+	"application/xml":         formatXML,
+	"text/xml":                formatXML,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+	"application/x-protobuf":  formatProtobuf,
+	"application/protobuf":    formatProtobuf,
+}
+
+// negotiateHandler converts the JSON responses of GET requests into the
+// format preferred by the Accept header: XML, MessagePack or, for todos,
+// protocol buffers (see proto/todo.proto). JSON is the fallback when the
+// client accepts none of them.
+func negotiateHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() {
+			h(ctx)
+			return
+		}
+		path := string(ctx.Path())
+		// Summaries and boards have no protocol buffers message.
+		notTodos := string(ctx.QueryArgs().Peek("view")) == "summary" || ctx.QueryArgs().Has("group_by")
+		h(ctx)
+		ctx.Response.Header.Add("Vary", "Accept")
+
+		format := preferredFormat(string(ctx.Request.Header.Peek("Accept")))
+		if format == formatJSON || ctx.Response.StatusCode() != fasthttp.StatusOK ||
+			ctx.Response.IsBodyStream() ||
+			!bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json")) {
+			return
+		}
+
+		defer traceOp(ctx, "response.convert")()
+		body := ctx.Response.Body()
+		var out []byte
+		var err error
+		switch format {
+		case formatXML:
+			var root *jsonNode
+			if root, err = parseJSONTree(body); err == nil {
+				out = append([]byte(xml.Header), appendXMLElement(nil, "response", root)...)
+			}
+		case formatMsgpack:
+			var root *jsonNode
+			if root, err = parseJSONTree(body); err == nil {
+				out = appendMsgpack(nil, root)
+			}
+		case formatProtobuf:
+			var ok bool
+			if !notTodos {
+				out, ok, err = todoProtoResponse(path, body)
+			}
+			if err == nil && !ok {
+				ctx.Error("Protocol buffers are only available for todos", fasthttp.StatusNotAcceptable)
+				return
+			}
+		}
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetContentType(format)
+		ctx.SetBody(out)
+	}
+}
+
+// preferredFormat returns the supported format with the highest quality in
+// an Accept header, JSON if there is none.
+func preferredFormat(accept string) string {
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := formatAliases[mediaType]
+		if !ok && strings.HasSuffix(mediaType, "+json") {
+			format, ok = formatJSON, true
+		}
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// todoProtoResponse encodes the todo or list of todos in a JSON response as
+// a todo.v1.Todo or todo.v1.ListTodosResponse message. It reports false for
+// responses that aren't todos.
+func todoProtoResponse(path string, body []byte) ([]byte, bool, error) {
+	path = strings.TrimSuffix(path, "/")
+	rest, isTodo := strings.CutPrefix(path, "/todos/")
+	switch {
+	case path == "/todos" || path == "/search" || (isTodo && strings.HasSuffix(rest, "/occurrences")):
+		var page todoPage
+		if bytes.HasPrefix(body, []byte("{")) {
+			if err := json.Unmarshal(body, &page); err != nil {
+				return nil, false, err
+			}
+		} else if err := json.Unmarshal(body, &page.Todos); err != nil {
+			return nil, false, err
+		}
+		var out []byte
+		for i := range page.Todos {
+			out = appendMessageField(out, 1, appendTodoProto(nil, &page.Todos[i]))
+		}
+		if page.NextCursor != nil {
+			out = appendStringField(out, 2, *page.NextCursor)
+		}
+		return out, true, nil
+	case isTodo && !strings.Contains(rest, "/"):
+		var todo Todo
+		if err := json.Unmarshal(body, &todo); err != nil {
+			return nil, false, err
+		}
+		return appendTodoProto(nil, &todo), true, nil
+	}
+	return nil, false, nil
+}
+
+// jsonNode is a parsed JSON value that keeps the order of object keys.
+type jsonNode struct {
+	kind  byte // 'o'bject, 'a'rray, 's'tring, 'n'umber, 'b'ool or 'z' for null
+	str   string
+	num   json.Number
+	b     bool
+	keys  []string
+	items []*jsonNode
+}
+
+// parseJSONTree parses a JSON document into a jsonNode tree.
+func parseJSONTree(data []byte) (*jsonNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return parseJSONNode(dec)
+}
+
+func parseJSONNode(dec *json.Decoder) (*jsonNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		node := &jsonNode{kind: 'a'}
+		if v == '{' {
+			node.kind = 'o'
+		}
+		for dec.More() {
+			if node.kind == 'o' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			item, err := parseJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+		_, err := dec.Token() // closing delimiter
+		return node, err
+	case string:
+		return &jsonNode{kind: 's', str: v}, nil
+	case json.Number:
+		return &jsonNode{kind: 'n', num: v}, nil
+	case bool:
+		return &jsonNode{kind: 'b', b: v}, nil
+	default:
+		return &jsonNode{kind: 'z'}, nil
+	}
+}
+
+// appendXMLElement encodes node as an XML element called name. Object keys
+// become child elements and array items <item> elements; null values are
+// empty elements.
+func appendXMLElement(b []byte, name string, node *jsonNode) []byte {
+	if !validXMLName(name) {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		b = append(b, `<entry key="`...)
+		b = append(b, key.Bytes()...)
+		b = append(b, `">`...)
+		b = appendXMLContent(b, node)
+		return append(b, "</entry>"...)
+	}
+	b = append(b, '<')
+	b = append(b, name...)
+	b = append(b, '>')
+	b = appendXMLContent(b, node)
+	b = append(b, "</"...)
+	b = append(b, name...)
+	return append(b, '>')
+}
+
+func appendXMLContent(b []byte, node *jsonNode) []byte {
+	switch node.kind {
+	case 'o':
+		for i, key := range node.keys {
+			b = appendXMLElement(b, key, node.items[i])
+		}
+	case 'a':
+		for _, item := range node.items {
+			b = appendXMLElement(b, "item", item)
+		}
+	case 's':
+		var text bytes.Buffer
+		xml.EscapeText(&text, []byte(node.str))
+		b = append(b, text.Bytes()...)
+	case 'n':
+		b = append(b, node.num...)
+	case 'b':
+		b = strconv.AppendBool(b, node.b)
+	}
+	return b
+}
+
+// validXMLName reports whether name can be used as an element name as is.
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case i > 0 && (c == '-' || c == '.' || (c >= '0' && c <= '9')):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// appendMsgpack encodes node in the MessagePack format.
+func appendMsgpack(b []byte, node *jsonNode) []byte {
+	switch node.kind {
+	case 'o':
+		b = appendMsgpackHeader(b, len(node.keys), 0x80, 0xde)
+		for i, key := range node.keys {
+			b = appendMsgpackString(b, key)
+			b = appendMsgpack(b, node.items[i])
+		}
+	case 'a':
+		b = appendMsgpackHeader(b, len(node.items), 0x90, 0xdc)
+		for _, item := range node.items {
+			b = appendMsgpack(b, item)
+		}
+	case 's':
+		b = appendMsgpackString(b, node.str)
+	case 'n':
+		if n, err := node.num.Int64(); err == nil {
+			b = appendMsgpackInt(b, n)
+		} else {
+			f, _ := node.num.Float64()
+			b = append(b, 0xcb)
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+		}
+	case 'b':
+		if node.b {
+			b = append(b, 0xc3)
+		} else {
+			b = append(b, 0xc2)
+		}
+	default:
+		b = append(b, 0xc0)
+	}
+	return b
+}
+
+// appendMsgpackHeader encodes the length of a map or array: in the fix type
+// for up to 15 entries, otherwise in the 16-bit (code16) or 32-bit
+// (code16+1) type.
+func appendMsgpackHeader(b []byte, n int, fix, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, code16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, code16+1), uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
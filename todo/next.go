@@ -0,0 +1,169 @@
+package todo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// nextWeights weigh the factors scoring the todos considered by GET
+// /todos/next. Each factor is between 0 and 1.
+type nextWeights struct {
+	// Priority is 1 for urgent todos and 0 for todos without a priority.
+	Priority float64
+	// Due is 1 for overdue todos, falling to 0 for todos due in a week or
+	// more and those without a due date.
+	Due float64
+	// Age is 0 for new todos, rising to 1 for todos created a month ago.
+	Age float64
+}
+
+// defaultNextWeights is the scoring used unless configured otherwise.
+const defaultNextWeights = "priority=2,due=2,age=1"
+
+// nextScoring is the scoring of GET /todos/next. It is set once at startup.
+var nextScoring = mustParseNextWeights(defaultNextWeights)
+
+// Horizons over which the due and age factors change.
+const (
+	nextDueHorizon = 7 * 24 * time.Hour
+	nextAgeHorizon = 30 * 24 * time.Hour
+)
+
+// parseNextWeights parses comma-separated factor=weight entries such as
+// "priority=2,due=1". Factors left out weigh 0.
+func parseNextWeights(s string) (nextWeights, error) {
+	var w nextWeights
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || weight < 0 {
+			return w, fmt.Errorf("invalid weight %q, expected factor=number", entry)
+		}
+		switch strings.TrimSpace(name) {
+		case "priority":
+			w.Priority = weight
+		case "due":
+			w.Due = weight
+		case "age":
+			w.Age = weight
+		default:
+			return w, fmt.Errorf("unknown factor %q, expected priority, due or age", name)
+		}
+	}
+	return w, nil
+}
+
+func mustParseNextWeights(s string) nextWeights {
+	w, err := parseNextWeights(s)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+// score returns how pressing the todo is at now; higher scores go first.
+func (w nextWeights) score(todo *Todo, now time.Time) float64 {
+	priority := 0.0
+	for i, p := range priorities {
+		if todo.Priority == p {
+			priority = float64(i+1) / float64(len(priorities))
+		}
+	}
+	due := 0.0
+	if todo.DueAt != nil {
+		due = 1 - clamp(todo.DueAt.Sub(now).Hours()/nextDueHorizon.Hours())
+	}
+	age := clamp(now.Sub(todo.CreatedAt).Hours() / nextAgeHorizon.Hours())
+	return w.Priority*priority + w.Due*due + w.Age*age
+}
+
+// clamp limits x to the range from 0 to 1.
+func clamp(x float64) float64 {
+	switch {
+	case x < 0:
+		return 0
+	case x > 1:
+		return 1
+	}
+	return x
+}
+
+// actionable reports whether the todo can be worked on by the caller: it is
+// open, not blocked and assigned to the caller or to nobody. Without access
+// control todos assigned to anybody are actionable.
+func actionable(todo *Todo, caller *principal) bool {
+	if todo.Completed || todo.Status == statusBlocked {
+		return false
+	}
+	return len(apiKeys) == 0 || todo.Assignee == "" || todo.Assignee == caller.name
+}
+
+// getNextTodo handles GET /todos/next and responds with the single todo the
+// caller should work on next: the actionable todo with the highest score,
+// ties going to the one due first and then the oldest. A weights parameter
+// such as "priority=1,due=3" replaces the configured scoring. It responds
+// with 204 No Content if there's nothing to do.
+func getNextTodo(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	weights := nextScoring
+	if arg := ctx.QueryArgs().Peek("weights"); len(arg) > 0 {
+		w, err := parseNextWeights(string(arg))
+		if err != nil {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid weights", err.Error())
+			return
+		}
+		weights = w
+	}
+
+	ns := namespaceOf(ctx)
+	now := time.Now()
+	var (
+		best      *Todo
+		bestScore float64
+	)
+	done := traceOp(ctx, "store.scan")
+	ns.store.each(func(todo *Todo) bool {
+		if !actionable(todo, caller) || ns.permission(caller, todo) == permNone {
+			return true
+		}
+		score := weights.score(todo, now)
+		if best == nil || score > bestScore || score == bestScore && nextBefore(todo, best) {
+			copied := *todo
+			best, bestScore = &copied, score
+		}
+		return true
+	})
+	done()
+	if best == nil {
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+	ctx.Response.Header.Set("X-Next-Score", strconv.FormatFloat(bestScore, 'f', 3, 64))
+	writeRawJSON(ctx, fasthttp.StatusOK, best.raw)
+}
+
+// nextBefore breaks ties between equally scored todos: the one due first,
+// then the one created first, goes first.
+func nextBefore(a, b *Todo) bool {
+	switch {
+	case a.DueAt != nil && b.DueAt == nil:
+		return true
+	case a.DueAt == nil && b.DueAt != nil:
+		return false
+	case a.DueAt != nil && !a.DueAt.Equal(*b.DueAt):
+		return a.DueAt.Before(*b.DueAt)
+	}
+	return a.ID < b.ID
+}
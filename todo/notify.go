@@ -0,0 +1,124 @@
+package todo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// notification is a message about a todo delivered to the user, such as a
+// due reminder.
+type notification struct {
+	Kind    string    `json:"kind"`
+	TodoID  int       `json:"todo_id"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// notifier delivers notifications over one channel.
+type notifier interface {
+	notify(n notification) error
+}
+
+// logNotifier writes notifications to the server log.
+type logNotifier struct{}
+
+func (logNotifier) notify(n notification) error {
+	log.Printf("notification %s todo=%d: %s", n.Kind, n.TodoID, n.Message)
+	return nil
+}
+
+// webhookNotifier POSTs notifications as JSON to a URL.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) notify(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return postJSON(w.url, body, nil, 10*time.Second)
+}
+
+// emailNotifier sends notifications by email through an SMTP server.
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (e emailNotifier) notify(n notification) error {
+	var auth smtp.Auth
+	if e.username != "" {
+		host, _, _ := strings.Cut(e.addr, ":")
+		auth = smtp.PlainAuth("", e.username, e.password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		e.from, strings.Join(e.to, ", "), n.Title, n.Message)
+	return smtp.SendMail(e.addr, auth, e.from, e.to, []byte(msg))
+}
+
+// postJSON POSTs body to url with the given extra headers and fails unless
+// the response has a 2xx status.
+func postJSON(url string, body []byte, headers map[string]string, timeout time.Duration) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(url)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBody(body)
+	if err := fasthttp.DoTimeout(req, resp, timeout); err != nil {
+		return err
+	}
+	if code := resp.StatusCode(); code < 200 || code > 299 {
+		return fmt.Errorf("%s responded with status %d", url, code)
+	}
+	return nil
+}
+
+// buildNotifiers returns the notifiers for the comma-separated list of
+// channels ("log", "webhook", "email") configured in cfg.
+func buildNotifiers(cfg Config) ([]notifier, error) {
+	var notifiers []notifier
+	for _, channel := range strings.Split(cfg.NotifyChannels, ",") {
+		switch strings.TrimSpace(channel) {
+		case "":
+		case "log":
+			notifiers = append(notifiers, logNotifier{})
+		case "webhook":
+			if cfg.NotifyWebhookURL == "" {
+				return nil, fmt.Errorf("the webhook channel needs -notify-webhook-url")
+			}
+			notifiers = append(notifiers, webhookNotifier{url: cfg.NotifyWebhookURL})
+		case "email":
+			if cfg.SMTPAddr == "" || cfg.SMTPFrom == "" || cfg.SMTPTo == "" {
+				return nil, fmt.Errorf("the email channel needs -smtp-addr, -smtp-from and -smtp-to")
+			}
+			notifiers = append(notifiers, emailNotifier{
+				addr:     cfg.SMTPAddr,
+				from:     cfg.SMTPFrom,
+				to:       strings.Split(cfg.SMTPTo, ","),
+				username: cfg.SMTPUsername,
+				password: cfg.SMTPPassword,
+			})
+		default:
+			return nil, fmt.Errorf("unknown notification channel %q", channel)
+		}
+	}
+	return notifiers, nil
+}
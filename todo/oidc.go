@@ -0,0 +1,327 @@
+package todo
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// oauthProvider is an external identity provider users can log in with
+// through the OAuth 2.0 authorization code flow.
+type oauthProvider struct {
+	authURL     string
+	tokenURL    string
+	userinfoURL string
+	scope       string
+	// identity extracts the identity of the user from the userinfo
+	// response; ok is false if it has none that can be trusted.
+	identity func(info map[string]interface{}) (id string, ok bool)
+}
+
+// oauthProviders are the supported login providers by name. Google users
+// are identified by their verified email address, GitHub users by their
+// numeric user ID: logins can be renamed and then claimed by someone else.
+var oauthProviders = map[string]oauthProvider{
+	"google": {
+		authURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:    "https://oauth2.googleapis.com/token",
+		userinfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		scope:       "openid email",
+		identity: func(info map[string]interface{}) (string, bool) {
+			email, _ := info["email"].(string)
+			verified, _ := info["email_verified"].(bool)
+			return strings.ToLower(email), email != "" && verified
+		},
+	},
+	"github": {
+		authURL:     "https://github.com/login/oauth/authorize",
+		tokenURL:    "https://github.com/login/oauth/access_token",
+		userinfoURL: "https://api.github.com/user",
+		scope:       "read:user",
+		identity: func(info map[string]interface{}) (string, bool) {
+			id, _ := info["id"].(float64)
+			return strconv.FormatFloat(id, 'f', -1, 64), id > 0
+		},
+	},
+}
+
+// oauthClient holds the credentials of the service with a login provider.
+type oauthClient struct {
+	id, secret string
+}
+
+// Login settings, set once at startup.
+var (
+	// oauthClients maps the enabled login providers to the credentials of
+	// the service.
+	oauthClients = make(map[string]oauthClient)
+	// identityUsers maps "provider:identity" to the local user, the name of
+	// an API key, that external identity logs in as.
+	identityUsers = make(map[string]string)
+	// publicURL is the URL the service is reached at, used to build the
+	// callback URLs of the providers. Empty uses the Host of the request.
+	publicURL string
+)
+
+// Limits of the login flow.
+const (
+	// oauthStateTTL is how long users have to log in with the provider.
+	oauthStateTTL = 10 * time.Minute
+	// oauthTimeout bounds each request to a provider.
+	oauthTimeout = 10 * time.Second
+	// maxOAuthStates caps the logins waiting for the provider's callback,
+	// which anyone can start.
+	maxOAuthStates = 10000
+)
+
+// oauthState is a login waiting for the provider's callback.
+type oauthState struct {
+	provider string
+	// verifier is the PKCE code verifier of the login.
+	verifier string
+	expires  time.Time
+}
+
+var (
+	oauthStatesMu sync.Mutex
+	oauthStates   = make(map[string]oauthState)
+)
+
+// parseOAuthClients parses a comma-separated list of
+// "provider:client_id:client_secret" entries.
+func parseOAuthClients(spec string) (map[string]oauthClient, error) {
+	clients := make(map[string]oauthClient)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid provider entry %q, expected provider:client_id:client_secret", entry)
+		}
+		if _, ok := oauthProviders[parts[0]]; !ok {
+			return nil, fmt.Errorf("unknown provider %q, expected google or github", parts[0])
+		}
+		clients[parts[0]] = oauthClient{id: parts[1], secret: parts[2]}
+	}
+	return clients, nil
+}
+
+// parseIdentityUsers parses a comma-separated list of
+// "provider:identity=user" entries such as "github:octocat=alice". Every
+// provider must be enabled in clients and every user be the name of an API
+// key.
+func parseIdentityUsers(spec string, clients map[string]oauthClient) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, user, ok := strings.Cut(entry, "=")
+		provider, id, ok2 := strings.Cut(identity, ":")
+		if !ok || !ok2 || id == "" || user == "" {
+			return nil, fmt.Errorf("invalid identity entry %q, expected provider:identity=user", entry)
+		}
+		if _, ok := clients[provider]; !ok {
+			return nil, fmt.Errorf("provider %q of entry %q is not enabled", provider, entry)
+		}
+		if _, err := strconv.ParseUint(id, 10, 64); provider == "github" && err != nil {
+			return nil, fmt.Errorf("invalid GitHub identity in entry %q, expected the numeric user ID", entry)
+		}
+		if !knownUser(user) || len(apiKeys) == 0 {
+			return nil, fmt.Errorf("user %q of entry %q is not the name of an API key", user, entry)
+		}
+		users[provider+":"+strings.ToLower(id)] = user
+	}
+	return users, nil
+}
+
+// callbackURL returns the URL the provider redirects users back to.
+func callbackURL(ctx *fasthttp.RequestCtx, provider string) string {
+	base := publicURL
+	if base == "" {
+		base = "http://" + string(ctx.Host())
+		if ctx.IsTLS() {
+			base = "https://" + string(ctx.Host())
+		}
+	}
+	return strings.TrimSuffix(base, "/") + apiPrefix + "/auth/" + provider + "/callback"
+}
+
+// routeOAuth routes requests for /auth/{provider}/login and
+// /auth/{provider}/callback.
+func routeOAuth(ctx *fasthttp.RequestCtx, method, provider, action string) {
+	if method != "GET" {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !requireSessions(ctx) {
+		return
+	}
+	client, ok := oauthClients[provider]
+	if !ok {
+		ctx.Error("Unknown login provider", fasthttp.StatusNotFound)
+		return
+	}
+	if action == "login" {
+		oauthLogin(ctx, provider, client)
+	} else {
+		oauthCallback(ctx, provider, client)
+	}
+}
+
+// oauthLogin handles GET /auth/{provider}/login and redirects the user to
+// the provider to log in. While maxOAuthStates logins are waiting, it
+// responds with 503 Service Unavailable.
+func oauthLogin(ctx *fasthttp.RequestCtx, provider string, client oauthClient) {
+	p := oauthProviders[provider]
+	state := randomToken(16)
+	verifier := randomToken(32)
+	now := time.Now()
+	oauthStatesMu.Lock()
+	for s, pending := range oauthStates {
+		if now.After(pending.expires) {
+			delete(oauthStates, s)
+		}
+	}
+	if len(oauthStates) >= maxOAuthStates {
+		oauthStatesMu.Unlock()
+		ctx.Response.Header.Set("Retry-After", "60")
+		ctx.Error("Too many logins in progress, try again later", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	oauthStates[state] = oauthState{provider: provider, verifier: verifier, expires: now.Add(oauthStateTTL)}
+	oauthStatesMu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.id},
+		"redirect_uri":          {callbackURL(ctx, provider)},
+		"scope":                 {p.scope},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	ctx.Redirect(p.authURL+"?"+q.Encode(), fasthttp.StatusFound)
+}
+
+// oauthCallback handles GET /auth/{provider}/callback, where the provider
+// sends the user after logging in. It looks up the local user of the
+// external identity and opens a session for them, responding with its
+// tokens like POST /auth/login.
+func oauthCallback(ctx *fasthttp.RequestCtx, provider string, client oauthClient) {
+	args := ctx.QueryArgs()
+	if reason := args.Peek("error"); len(reason) > 0 {
+		ctx.Error("Login failed: "+string(reason), fasthttp.StatusUnauthorized)
+		return
+	}
+	state := string(args.Peek("state"))
+	oauthStatesMu.Lock()
+	pending, ok := oauthStates[state]
+	delete(oauthStates, state)
+	oauthStatesMu.Unlock()
+	if !ok || pending.provider != provider || time.Now().After(pending.expires) {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid login state",
+			"start over at "+apiPrefix+"/auth/"+provider+"/login")
+		return
+	}
+
+	p := oauthProviders[provider]
+	token, err := exchangeCode(p, client, string(args.Peek("code")), callbackURL(ctx, provider), pending.verifier)
+	if err != nil {
+		ctx.Error("Login failed: "+err.Error(), fasthttp.StatusBadGateway)
+		return
+	}
+	info, err := fetchUserinfo(p, token)
+	if err != nil {
+		ctx.Error("Login failed: "+err.Error(), fasthttp.StatusBadGateway)
+		return
+	}
+	identity, ok := p.identity(info)
+	if !ok {
+		ctx.Error("The provider didn't confirm an identity", fasthttp.StatusUnauthorized)
+		return
+	}
+	user, ok := identityUsers[provider+":"+identity]
+	if !ok {
+		writeRequestError(ctx, fasthttp.StatusForbidden, "No user for "+provider+" identity "+identity,
+			"map it to an API key name with -oidc-users")
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, startSession(ctx, user, provider))
+}
+
+// exchangeCode trades the authorization code for an access token of the
+// provider.
+func exchangeCode(p oauthProvider, client oauthClient, code, redirectURI, verifier string) (string, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(p.tokenURL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBodyString(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {client.id},
+		"client_secret": {client.secret},
+		"code_verifier": {verifier},
+	}.Encode())
+	if err := fasthttp.DoTimeout(req, resp, oauthTimeout); err != nil {
+		return "", err
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.Unmarshal(resp.Body(), &out); err != nil {
+		return "", fmt.Errorf("token endpoint responded with status %d", resp.StatusCode())
+	}
+	if out.AccessToken == "" {
+		if out.Error != "" {
+			return "", fmt.Errorf("token endpoint: %s", out.Error)
+		}
+		return "", fmt.Errorf("token endpoint responded with status %d", resp.StatusCode())
+	}
+	return out.AccessToken, nil
+}
+
+// fetchUserinfo returns the provider's description of the user the access
+// token belongs to.
+func fetchUserinfo(p oauthProvider, token string) (map[string]interface{}, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(p.userinfoURL)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.SetUserAgent("todo-app")
+	if err := fasthttp.DoTimeout(req, resp, oauthTimeout); err != nil {
+		return nil, err
+	}
+	if code := resp.StatusCode(); code != fasthttp.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint responded with status %d", code)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(resp.Body(), &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
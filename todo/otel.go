@@ -0,0 +1,331 @@
+package todo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Export of the OpenTelemetry spans of requests over OTLP/HTTP.
+const (
+	// spanBatchSize is the number of spans exported at once, and
+	// spanQueueSize the number waiting for export; further spans are
+	// dropped.
+	spanBatchSize = 512
+	spanQueueSize = 4096
+	// spanExportInterval is how often queued spans are exported.
+	spanExportInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// span is a finished or running OpenTelemetry span.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	status   int
+}
+
+// spanAttr is an attribute of a span; value is a string or an int.
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+// spanExporter sends spans in batches to an OTLP/HTTP collector with the
+// JSON encoding. It is nil when tracing is disabled; it is set once at
+// startup.
+var spanExporter *otlpExporter
+
+// spansDropped counts the spans dropped because the export queue was full.
+var spansDropped atomic.Uint64
+
+// otlpExporter queues spans and exports them from a background goroutine.
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	service     string
+	sampleRatio float64
+	client      *http.Client
+	queue       chan *span
+}
+
+// newOTLPExporter returns an exporter posting to the traces endpoint of the
+// collector at endpoint, e.g., http://localhost:4318, with the extra
+// headers given as comma-separated key=value pairs. Requests without a
+// sampled parent are sampled with ratio.
+func newOTLPExporter(endpoint, headers, service string, ratio float64) (*otlpExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid sample ratio %g, expected 0 to 1", ratio)
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		headers:     make(map[string]string),
+		service:     service,
+		sampleRatio: ratio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *span, spanQueueSize),
+	}
+	for _, pair := range strings.Split(headers, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", pair)
+		}
+		e.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return e, nil
+}
+
+// run exports queued spans every spanExportInterval or once a batch is
+// full, and the remaining ones when ctx is done.
+func (e *otlpExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			log.Printf("Error exporting %d spans: %s", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// enqueue queues finished spans for export, dropping them if the queue is
+// full rather than slowing down requests.
+func (e *otlpExporter) enqueue(spans ...*span) {
+	for _, s := range spans {
+		select {
+		case e.queue <- s:
+		default:
+			spansDropped.Add(1)
+		}
+	}
+}
+
+// export posts spans to the collector.
+func (e *otlpExporter) export(spans []*span) error {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs([]spanAttr{{"service.name", e.service}, {"service.version", buildVersion}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "todo-app-memory/todo"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp returns the span in the JSON encoding of OTLP.
+func (s *span) otlp() map[string]interface{} {
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != 0 {
+		m["status"] = map[string]interface{}{"code": s.status}
+	}
+	return m
+}
+
+func otlpAttrs(attrs []spanAttr) []interface{} {
+	encoded := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.value.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": a.key, "value": value})
+	}
+	return encoded
+}
+
+// startServerSpan starts the span of a request, continuing the trace of
+// the W3C traceparent header if the request has a valid one. It returns
+// nil if the request isn't sampled.
+func startServerSpan(ctx *fasthttp.RequestCtx, start time.Time) *span {
+	s := &span{kind: spanKindServer, start: start}
+	traceID, parentID, sampled, ok := parseTraceparent(string(ctx.Request.Header.Peek("traceparent")))
+	if ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		rand.Read(s.traceID[:])
+		// Sample by the trace ID, as the TraceIdRatioBased sampler does, so
+		// all services sampling by ratio keep the same traces.
+		if spanExporter.sampleRatio < 1 &&
+			float64(binary.BigEndian.Uint64(s.traceID[8:])>>1) >= spanExporter.sampleRatio*float64(math.MaxInt64) {
+			return nil
+		}
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// parseTraceparent parses a W3C traceparent header of the form
+// 00-{trace ID}-{parent span ID}-{flags}.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// finishServerSpan ends the span of a request and queues it for export
+// together with the spans of the operations it made.
+func finishServerSpan(ctx *fasthttp.RequestCtx, t *requestTrace, end time.Time) {
+	s := t.span
+	route := routePattern(string(ctx.Path()))
+	status := ctx.Response.StatusCode()
+	s.name = string(ctx.Method()) + " " + route
+	s.end = end
+	s.attrs = append(s.attrs,
+		spanAttr{"http.request.method", string(ctx.Method())},
+		spanAttr{"http.route", route},
+		spanAttr{"url.path", string(ctx.Path())},
+		spanAttr{"http.response.status_code", status},
+		spanAttr{"todo.namespace", namespaceName(namespaceOf(ctx))},
+	)
+	if id, ok := pathTodoID(string(ctx.Path())); ok {
+		s.attrs = append(s.attrs, spanAttr{"todo.id", id})
+	}
+	if requestID := ctx.Response.Header.Peek("X-Request-ID"); len(requestID) > 0 {
+		s.attrs = append(s.attrs, spanAttr{"http.request.id", string(requestID)})
+	}
+	if status >= 500 {
+		s.status = spanStatusError
+	}
+
+	spans := []*span{s}
+	for _, op := range t.ops {
+		child := &span{
+			traceID:  s.traceID,
+			parentID: s.spanID,
+			name:     op.name,
+			kind:     spanKindInternal,
+			start:    op.start,
+			end:      op.start.Add(op.took),
+		}
+		rand.Read(child.spanID[:])
+		spans = append(spans, child)
+	}
+	spanExporter.enqueue(spans...)
+}
+
+// pathTodoID returns the ID of the todo a request path refers to, such as
+// 7 for /todos/7 and /todos/7/subtasks/2.
+func pathTodoID(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/todos/")
+	if !ok {
+		return 0, false
+	}
+	segment, _, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(segment)
+	return id, err == nil
+}
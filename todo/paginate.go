@@ -0,0 +1,99 @@
+package todo
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Page sizes of cursor pagination.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor returns the opaque cursor of the page after the todo id.
+// Pages are ordered by ID and new todos get higher IDs, so iterating with
+// cursors neither skips nor repeats todos when others are added or removed.
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+// decodeCursor returns the ID a cursor continues after.
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	s, ok := strings.CutPrefix(string(b), "id:")
+	if !ok {
+		return 0, errInvalidCursor
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 {
+		return 0, errInvalidCursor
+	}
+	return id, nil
+}
+
+// todoPage is the body of a paginated GET /todos response.
+type todoPage struct {
+	Todos      []Todo  `json:"todos"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// getTodoPage handles GET /todos?cursor=&limit=. It responds with up to
+// limit todos after the cursor, as summaries if summary is set, and the
+// cursor of the next page, which is null on the last page.
+func getTodoPage(ctx *fasthttp.RequestCtx, summary bool) {
+	args := ctx.QueryArgs()
+	limit := defaultPageSize
+	if v := args.Peek("limit"); v != nil {
+		n, err := strconv.Atoi(string(v))
+		if err != nil || n < 1 || n > maxPageSize {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid limit",
+				"limit must be a number from 1 to "+strconv.Itoa(maxPageSize))
+			return
+		}
+		limit = n
+	}
+	after := 0
+	if v := args.Peek("cursor"); len(v) > 0 {
+		id, err := decodeCursor(string(v))
+		if err != nil {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid cursor",
+				"pass the next_cursor of a previous page unchanged, or omit it to start from the beginning")
+			return
+		}
+		after = id
+	}
+
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	done := traceOp(ctx, "store.page")
+	raws, next := namespaceOf(ctx).store.rawPage(visible, after, limit)
+	done()
+	if summary {
+		var err error
+		if raws, err = summarizeRaw(raws); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+	}
+	body := append([]byte(`{"todos":`), joinJSON(raws)...)
+	body = append(body, `,"next_cursor":`...)
+	if next == "" {
+		body = append(body, "null"...)
+	} else {
+		body = strconv.AppendQuote(body, next)
+	}
+	body = append(body, '}')
+	writeRawJSON(ctx, fasthttp.StatusOK, body)
+}
@@ -0,0 +1,29 @@
+package todo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// openPostgres opens a pgx pool of up to maxConns connections to the
+// database at url and wraps it in a *sql.DB for the postgres store. pgx
+// keeps the statements prepared on each connection of the pool, so they
+// are prepared once per connection rather than once per use. The returned
+// function closes the pool, which closing the *sql.DB doesn't.
+func openPostgres(url string, maxConns int) (*sql.DB, func(), error) {
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.MaxConns = int32(maxConns)
+	cfg.MaxConnIdleTime = 5 * time.Minute
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdlib.OpenDBFromPool(pool), pool.Close, nil
+}
@@ -0,0 +1,440 @@
+package todo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// Protocol buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedProto = errors.New("malformed protocol buffers message")
+
+// The append functions encode proto3 fields. Scalars with their default
+// value are left out, as proto3 requires.
+
+func appendTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func appendIntField(b []byte, num int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendTag(b, num, wireVarint), uint64(v))
+}
+
+func appendBoolField(b []byte, num int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return append(appendTag(b, num, wireVarint), 1)
+}
+
+func appendStringField(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendDoubleField(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(appendTag(b, num, wireFixed64), math.Float64bits(v))
+}
+
+// appendMessageField encodes a nested message. Unlike scalars, it is always
+// written so the receiver can tell an empty message from a missing one.
+func appendMessageField(b []byte, num int, msg []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendTimestampField encodes t as a google.protobuf.Timestamp. A nil t is
+// left out.
+func appendTimestampField(b []byte, num int, t *time.Time) []byte {
+	if t == nil {
+		return b
+	}
+	var ts []byte
+	ts = appendIntField(ts, 1, t.Unix())
+	ts = appendIntField(ts, 2, int64(t.Nanosecond()))
+	return appendMessageField(b, num, ts)
+}
+
+// protoReader decodes the fields of a message one by one.
+type protoReader struct {
+	b []byte
+}
+
+func (r *protoReader) done() bool {
+	return len(r.b) == 0
+}
+
+// next returns the number and wire type of the next field.
+func (r *protoReader) next() (num, typ int, err error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errMalformedProto
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil || n > uint64(len(r.b)) {
+		return nil, errMalformedProto
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// skip discards the value of a field of wire type typ, such as a field the
+// server doesn't know.
+func (r *protoReader) skip(typ int) error {
+	switch typ {
+	case wireVarint:
+		_, err := r.varint()
+		return err
+	case wireBytes:
+		_, err := r.bytes()
+		return err
+	case wireFixed64:
+		if len(r.b) < 8 {
+			return errMalformedProto
+		}
+		r.b = r.b[8:]
+	case wireFixed32:
+		if len(r.b) < 4 {
+			return errMalformedProto
+		}
+		r.b = r.b[4:]
+	default:
+		return errMalformedProto
+	}
+	return nil
+}
+
+// decodeFields calls fn with the number, wire type and reader positioned on
+// the value of every field of msg. fn must consume the value, or return
+// false to have it skipped.
+func decodeFields(msg []byte, fn func(num, typ int, r *protoReader) (bool, error)) error {
+	r := &protoReader{b: msg}
+	for !r.done() {
+		num, typ, err := r.next()
+		if err != nil {
+			return err
+		}
+		handled, err := fn(num, typ, r)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err := r.skip(typ); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readInt, readBool, readDouble, readString and readMessage consume a field
+// value of the expected wire type.
+
+func readInt(typ int, r *protoReader) (int64, error) {
+	if typ != wireVarint {
+		return 0, errMalformedProto
+	}
+	v, err := r.varint()
+	return int64(v), err
+}
+
+func readBool(typ int, r *protoReader) (bool, error) {
+	v, err := readInt(typ, r)
+	return v != 0, err
+}
+
+func readDouble(typ int, r *protoReader) (float64, error) {
+	if typ != wireFixed64 || len(r.b) < 8 {
+		return 0, errMalformedProto
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+	r.b = r.b[8:]
+	return v, nil
+}
+
+func readString(typ int, r *protoReader) (string, error) {
+	b, err := readMessage(typ, r)
+	return string(b), err
+}
+
+func readMessage(typ int, r *protoReader) ([]byte, error) {
+	if typ != wireBytes {
+		return nil, errMalformedProto
+	}
+	return r.bytes()
+}
+
+// readTimestamp consumes a google.protobuf.Timestamp.
+func readTimestamp(typ int, r *protoReader) (*time.Time, error) {
+	msg, err := readMessage(typ, r)
+	if err != nil {
+		return nil, err
+	}
+	var secs, nanos int64
+	err = decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		switch num {
+		case 1:
+			secs, err = readInt(typ, r)
+		case 2:
+			nanos, err = readInt(typ, r)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(secs, int64(int32(nanos))).UTC()
+	return &t, nil
+}
+
+// appendTodoProto encodes todo as a todo.v1.Todo message.
+func appendTodoProto(b []byte, todo *Todo) []byte {
+	b = appendIntField(b, 1, int64(todo.ID))
+	b = appendStringField(b, 2, todo.Title)
+	b = appendStringField(b, 3, todo.Description)
+	b = appendBoolField(b, 4, todo.Completed)
+	for _, a := range todo.Attachments {
+		b = appendStringField(b, 5, a.Path)
+	}
+	for _, st := range todo.Subtasks {
+		var msg []byte
+		msg = appendIntField(msg, 1, int64(st.ID))
+		msg = appendStringField(msg, 2, st.Title)
+		msg = appendBoolField(msg, 3, st.Completed)
+		b = appendMessageField(b, 6, msg)
+	}
+	b = appendStringField(b, 7, todo.Priority)
+	b = appendStringField(b, 8, todo.Project)
+	for _, tag := range todo.Tags {
+		b = appendStringField(b, 9, tag)
+	}
+	b = appendStringField(b, 10, todo.Assignee)
+	b = appendTimestampField(b, 11, todo.DueAt)
+	b = appendTimestampField(b, 12, todo.RemindAt)
+	b = appendTimestampField(b, 13, &todo.CreatedAt)
+	b = appendTimestampField(b, 14, &todo.UpdatedAt)
+	b = appendTimestampField(b, 15, todo.CompletedAt)
+	b = appendStringField(b, 16, todo.Recurrence)
+	b = appendIntField(b, 17, int64(todo.SeriesID))
+	b = appendIntField(b, 18, int64(todo.NextOccurrence))
+	for _, link := range todo.Links {
+		var msg []byte
+		msg = appendStringField(msg, 1, link.Type)
+		msg = appendIntField(msg, 2, int64(link.TodoID))
+		b = appendMessageField(b, 19, msg)
+	}
+	b = appendDoubleField(b, 20, todo.Position)
+	b = appendStringField(b, 21, todo.Status)
+	b = appendStringField(b, 22, todo.UUID)
+	b = appendTimestampField(b, 23, todo.ArchivedAt)
+	b = appendTimestampField(b, 24, todo.ExpiresAt)
+	for _, a := range todo.Attachments {
+		var msg []byte
+		msg = appendIntField(msg, 1, int64(a.ID))
+		msg = appendStringField(msg, 2, a.Name)
+		msg = appendIntField(msg, 3, a.Size)
+		msg = appendStringField(msg, 4, a.MIMEType)
+		msg = appendStringField(msg, 5, a.Checksum)
+		msg = appendStringField(msg, 6, a.Path)
+		msg = appendTimestampField(msg, 7, &a.CreatedAt)
+		b = appendMessageField(b, 25, msg)
+	}
+	return b
+}
+
+// decodeTodoProto decodes a todo.v1.Todo message.
+func decodeTodoProto(msg []byte) (*Todo, error) {
+	todo := &Todo{}
+	err := decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		var n int64
+		var s string
+		var t *time.Time
+		switch num {
+		case 1:
+			n, err = readInt(typ, r)
+			todo.ID = int(n)
+		case 2:
+			todo.Title, err = readString(typ, r)
+		case 3:
+			todo.Description, err = readString(typ, r)
+		case 4:
+			todo.Completed, err = readBool(typ, r)
+		case 6:
+			var st Subtask
+			st, err = decodeSubtaskProto(typ, r)
+			todo.Subtasks = append(todo.Subtasks, st)
+		case 7:
+			todo.Priority, err = readString(typ, r)
+		case 8:
+			todo.Project, err = readString(typ, r)
+		case 9:
+			s, err = readString(typ, r)
+			todo.Tags = append(todo.Tags, s)
+		case 10:
+			todo.Assignee, err = readString(typ, r)
+		case 11:
+			todo.DueAt, err = readTimestamp(typ, r)
+		case 12:
+			todo.RemindAt, err = readTimestamp(typ, r)
+		case 13:
+			if t, err = readTimestamp(typ, r); err == nil {
+				todo.CreatedAt = *t
+			}
+		case 14:
+			if t, err = readTimestamp(typ, r); err == nil {
+				todo.UpdatedAt = *t
+			}
+		case 15:
+			todo.CompletedAt, err = readTimestamp(typ, r)
+		case 16:
+			todo.Recurrence, err = readString(typ, r)
+		case 17:
+			n, err = readInt(typ, r)
+			todo.SeriesID = int(n)
+		case 18:
+			n, err = readInt(typ, r)
+			todo.NextOccurrence = int(n)
+		case 19:
+			var link Link
+			link, err = decodeLinkProto(typ, r)
+			todo.Links = append(todo.Links, link)
+		case 20:
+			todo.Position, err = readDouble(typ, r)
+		case 21:
+			todo.Status, err = readString(typ, r)
+		case 22:
+			todo.UUID, err = readString(typ, r)
+		case 23:
+			todo.ArchivedAt, err = readTimestamp(typ, r)
+		case 24:
+			todo.ExpiresAt, err = readTimestamp(typ, r)
+		case 25:
+			var a Attachment
+			a, err = decodeAttachmentProto(typ, r)
+			todo.Attachments = append(todo.Attachments, a)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return todo, err
+}
+
+func decodeSubtaskProto(typ int, r *protoReader) (Subtask, error) {
+	var st Subtask
+	msg, err := readMessage(typ, r)
+	if err != nil {
+		return st, err
+	}
+	err = decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		var n int64
+		switch num {
+		case 1:
+			n, err = readInt(typ, r)
+			st.ID = int(n)
+		case 2:
+			st.Title, err = readString(typ, r)
+		case 3:
+			st.Completed, err = readBool(typ, r)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return st, err
+}
+
+func decodeLinkProto(typ int, r *protoReader) (Link, error) {
+	var link Link
+	msg, err := readMessage(typ, r)
+	if err != nil {
+		return link, err
+	}
+	err = decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		var n int64
+		switch num {
+		case 1:
+			link.Type, err = readString(typ, r)
+		case 2:
+			n, err = readInt(typ, r)
+			link.TodoID = int(n)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return link, err
+}
+
+func decodeAttachmentProto(typ int, r *protoReader) (Attachment, error) {
+	var a Attachment
+	msg, err := readMessage(typ, r)
+	if err != nil {
+		return a, err
+	}
+	err = decodeFields(msg, func(num, typ int, r *protoReader) (bool, error) {
+		var err error
+		var n int64
+		var t *time.Time
+		switch num {
+		case 1:
+			n, err = readInt(typ, r)
+			a.ID = int(n)
+		case 2:
+			a.Name, err = readString(typ, r)
+		case 3:
+			a.Size, err = readInt(typ, r)
+		case 4:
+			a.MIMEType, err = readString(typ, r)
+		case 5:
+			a.Checksum, err = readString(typ, r)
+		case 6:
+			a.Path, err = readString(typ, r)
+		case 7:
+			if t, err = readTimestamp(typ, r); err == nil {
+				a.CreatedAt = *t
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return a, err
+}
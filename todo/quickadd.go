@@ -0,0 +1,385 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/valyala/fasthttp"
+)
+
+// quickAddHour is the time of day todos are due whose quick-add text names
+// a day but no time.
+const quickAddHour = 9
+
+// quickAddRequest is the JSON body of POST /todos/quickadd.
+type quickAddRequest struct {
+	Text string `json:"text"`
+	// Timezone is the IANA time zone dates and times are read in, the
+	// server's if empty.
+	Timezone string `json:"timezone"`
+	// DryRun only returns the interpretation, creating no todo.
+	DryRun bool `json:"dry_run"`
+}
+
+// quickAdd is the interpretation of a quick-add text.
+type quickAdd struct {
+	Title    string     `json:"title"`
+	DueAt    *time.Time `json:"due_at,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	Priority string     `json:"priority,omitempty"`
+	// Due holds the words read as the due date.
+	Due string `json:"due,omitempty"`
+}
+
+// quickAddResponse is the response to POST /todos/quickadd.
+type quickAddResponse struct {
+	Todo   json.RawMessage `json:"todo,omitempty"`
+	Parsed quickAdd        `json:"parsed"`
+}
+
+// quickAddTodo handles POST /todos/quickadd, creating a todo from a line of
+// text like "Pay rent tomorrow 5pm #finance !high", see parseQuickAdd. The
+// text is sent as a text/plain body or in a JSON object, which can also
+// name a time zone and ask for a dry run. It responds with the todo and how
+// the text was read.
+func quickAddTodo(ctx *fasthttp.RequestCtx) {
+	var req quickAddRequest
+	if bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("application/json")) {
+		if !decodeJSONBody(ctx, &req) {
+			return
+		}
+	} else {
+		req.Text = string(ctx.PostBody())
+	}
+	loc := time.Local
+	if req.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(req.Timezone); err != nil {
+			writeValidationErrors(ctx, "Invalid quick-add request",
+				[]fieldError{{Field: "timezone", Message: "must be an IANA time zone, e.g. Europe/Berlin"}})
+			return
+		}
+	}
+
+	parsed := parseQuickAdd(req.Text, time.Now().In(loc))
+	now := time.Now()
+	todo := &Todo{
+		Title:     parsed.Title,
+		Tags:      parsed.Tags,
+		Priority:  parsed.Priority,
+		DueAt:     parsed.DueAt,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if errs := validateTodo(todo); len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid todo", errs)
+		return
+	}
+	if req.DryRun {
+		writeJSON(ctx, fasthttp.StatusOK, quickAddResponse{Parsed: parsed})
+		return
+	}
+	rejected, warnings := checkSoftRules(nil, todo)
+	if len(rejected) > 0 {
+		writeValidationErrors(ctx, "Rejected by validation rules", rejected)
+		return
+	}
+	addWarnings(ctx, warnings)
+	raw, err := namespaceOf(ctx).addTodo(actorOf(ctx), todo)
+	if err != nil {
+		writeStoreError(ctx, err)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, quickAddResponse{Todo: raw, Parsed: parsed})
+}
+
+// parseQuickAdd reads a todo from a line of text. Words starting with #
+// and a letter are tags, !low, !medium, !high and !urgent set the priority,
+// and the first phrase naming a day and the first naming a time of day, as
+// understood by quickAddDay and quickAddClock, make up the due date, read
+// relative to now. The other words are the title.
+func parseQuickAdd(text string, now time.Time) quickAdd {
+	var parsed quickAdd
+	var title, due []string
+	var day, exact time.Time
+	// hour is -1 until a time of day is read; dayHour is the one implied by
+	// the day, such as "tonight".
+	hour, minute, dayHour := -1, 0, -1
+	words := strings.Fields(text)
+	for i := 0; i < len(words); {
+		w := words[i]
+		if tag, ok := strings.CutPrefix(w, "#"); ok && tag != "" && unicode.IsLetter([]rune(tag)[0]) {
+			if !containsString(parsed.Tags, tag) {
+				parsed.Tags = append(parsed.Tags, tag)
+			}
+			i++
+			continue
+		}
+		if p, ok := strings.CutPrefix(strings.ToLower(w), "!"); ok && p != "" && containsString(priorities, p) {
+			parsed.Priority = p
+			i++
+			continue
+		}
+		if day.IsZero() && exact.IsZero() {
+			if t, n := quickAddIn(words[i:], now); n > 0 {
+				exact = t
+				due = append(due, words[i:i+n]...)
+				i += n
+				continue
+			}
+			if d, h, n := quickAddDay(words[i:], now); n > 0 {
+				day, dayHour = d, h
+				due = append(due, words[i:i+n]...)
+				i += n
+				continue
+			}
+		}
+		if exact.IsZero() && hour < 0 {
+			if h, m, n := quickAddClock(words[i:]); n > 0 {
+				hour, minute = h, m
+				due = append(due, words[i:i+n]...)
+				i += n
+				continue
+			}
+		}
+		title = append(title, w)
+		i++
+	}
+
+	parsed.Title = strings.Join(title, " ")
+	parsed.Due = strings.Join(due, " ")
+	switch {
+	case !exact.IsZero():
+		parsed.DueAt = &exact
+	case !day.IsZero():
+		if hour < 0 {
+			hour = dayHour
+		}
+		if hour < 0 {
+			hour = quickAddHour
+		}
+		t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+		parsed.DueAt = &t
+	case hour >= 0:
+		// A time of day alone is the next one to come.
+		t := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		parsed.DueAt = &t
+	}
+	return parsed
+}
+
+// quickAddWord returns a word of a quick-add text lowercased and without
+// trailing punctuation, for matching.
+func quickAddWord(w string) string {
+	return strings.TrimRight(strings.ToLower(w), ",.;")
+}
+
+// quickAddWeekdays maps the names of weekdays to them. Sat and sun are
+// left out, since they are more often meant as words of the title.
+var quickAddWeekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"mon":       time.Monday,
+	"tuesday":   time.Tuesday,
+	"tue":       time.Tuesday,
+	"tues":      time.Tuesday,
+	"wednesday": time.Wednesday,
+	"wed":       time.Wednesday,
+	"thursday":  time.Thursday,
+	"thu":       time.Thursday,
+	"thurs":     time.Thursday,
+	"friday":    time.Friday,
+	"fri":       time.Friday,
+	"saturday":  time.Saturday,
+}
+
+var quickAddMonths = map[string]time.Month{
+	"january": time.January, "jan": time.January,
+	"february": time.February, "feb": time.February,
+	"march": time.March, "mar": time.March,
+	"april": time.April, "apr": time.April,
+	"may":  time.May,
+	"june": time.June, "jun": time.June,
+	"july": time.July, "jul": time.July,
+	"august": time.August, "aug": time.August,
+	"september": time.September, "sep": time.September, "sept": time.September,
+	"october": time.October, "oct": time.October,
+	"november": time.November, "nov": time.November,
+	"december": time.December, "dec": time.December,
+}
+
+// quickAddDay matches a day at the start of words: today, tonight,
+// tomorrow, "in N days" or "in N weeks", a weekday (the next one after
+// today, also with "next"), "next week" (its Monday), a date such as
+// 2026-11-01, "Nov 1" or "1st November" (the next one to come), optionally
+// preceded by "on", "by" or "due". It returns the day, the hour it implies,
+// -1 for none, and the number of words matched, 0 if none.
+func quickAddDay(words []string, now time.Time) (time.Time, int, int) {
+	skip := 0
+	if len(words) > 1 {
+		switch quickAddWord(words[0]) {
+		case "on", "by", "due":
+			skip = 1
+		}
+	}
+	rest := words[skip:]
+	if len(rest) == 0 {
+		return time.Time{}, -1, 0
+	}
+	w := quickAddWord(rest[0])
+	switch w {
+	case "today":
+		return now, -1, skip + 1
+	case "tonight":
+		return now, 20, skip + 1
+	case "tomorrow", "tmrw", "tmr":
+		return now.AddDate(0, 0, 1), -1, skip + 1
+	}
+	if d, err := time.ParseInLocation("2006-01-02", w, now.Location()); err == nil {
+		return d, -1, skip + 1
+	}
+	if w == "in" && len(rest) > 2 {
+		n, err := strconv.Atoi(rest[1])
+		unit := strings.TrimSuffix(quickAddWord(rest[2]), "s")
+		switch {
+		case err != nil || n < 1:
+		case unit == "day":
+			return now.AddDate(0, 0, n), -1, skip + 3
+		case unit == "week":
+			return now.AddDate(0, 0, 7*n), -1, skip + 3
+		}
+		return time.Time{}, -1, 0
+	}
+	next := w == "next"
+	if next && len(rest) > 1 {
+		w = quickAddWord(rest[1])
+		if w == "week" {
+			days := (int(time.Monday)-int(now.Weekday())+6)%7 + 1
+			return now.AddDate(0, 0, days), -1, skip + 2
+		}
+	}
+	if wd, ok := quickAddWeekdays[w]; ok {
+		days := (int(wd)-int(now.Weekday())+6)%7 + 1
+		n := skip + 1
+		if next {
+			n++
+		}
+		return now.AddDate(0, 0, days), -1, n
+	}
+	if next || len(rest) < 2 {
+		return time.Time{}, -1, 0
+	}
+	// A month and a day, in either order.
+	month, okMonth := quickAddMonths[w]
+	day, okDay := quickAddDayOfMonth(quickAddWord(rest[1]))
+	if !okMonth || !okDay {
+		day, okDay = quickAddDayOfMonth(w)
+		month, okMonth = quickAddMonths[quickAddWord(rest[1])]
+	}
+	if !okMonth || !okDay {
+		return time.Time{}, -1, 0
+	}
+	d := time.Date(now.Year(), month, day, 0, 0, 0, 0, now.Location())
+	if d.Month() != month {
+		return time.Time{}, -1, 0 // E.g. February 30.
+	}
+	if d.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())) {
+		d = d.AddDate(1, 0, 0)
+	}
+	return d, -1, skip + 2
+}
+
+// quickAddDayOfMonth parses a day of the month like 1, 1st or 22nd.
+func quickAddDayOfMonth(w string) (int, bool) {
+	for _, suffix := range []string{"st", "nd", "rd", "th"} {
+		w = strings.TrimSuffix(w, suffix)
+	}
+	day, err := strconv.Atoi(w)
+	return day, err == nil && day >= 1 && day <= 31
+}
+
+// quickAddClock matches a time of day at the start of words, optionally
+// preceded by "at": 5pm, 5:30 pm, 17:00, noon or midnight. It returns the
+// hour, the minute and the number of words matched, 0 if none.
+func quickAddClock(words []string) (int, int, int) {
+	skip := 0
+	if len(words) > 1 && quickAddWord(words[0]) == "at" {
+		skip = 1
+	}
+	rest := words[skip:]
+	if len(rest) == 0 {
+		return 0, 0, 0
+	}
+	w := quickAddWord(rest[0])
+	switch w {
+	case "noon":
+		return 12, 0, skip + 1
+	case "midnight":
+		return 0, 0, skip + 1
+	}
+	n := skip + 1
+	suffix := ""
+	for _, s := range []string{"am", "pm"} {
+		if clock, ok := strings.CutSuffix(w, s); ok && clock != "" {
+			w, suffix = clock, s
+		}
+	}
+	if suffix == "" && len(rest) > 1 {
+		if s := quickAddWord(rest[1]); s == "am" || s == "pm" {
+			suffix = s
+			n++
+		}
+	}
+	hourStr, minStr, hasMinutes := strings.Cut(w, ":")
+	if suffix == "" && !hasMinutes {
+		// A bare number isn't a time.
+		return 0, 0, 0
+	}
+	hour, err := strconv.Atoi(hourStr)
+	if err != nil {
+		return 0, 0, 0
+	}
+	minute := 0
+	if hasMinutes {
+		if minute, err = strconv.Atoi(minStr); err != nil || len(minStr) != 2 || minute > 59 {
+			return 0, 0, 0
+		}
+	}
+	switch {
+	case suffix == "" && hour <= 23:
+	case suffix != "" && hour >= 1 && hour <= 12:
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	default:
+		return 0, 0, 0
+	}
+	return hour, minute, n
+}
+
+// quickAddIn matches "in N minutes" or "in N hours" at the start of words,
+// returning the time and the number of words matched, 0 if none.
+func quickAddIn(words []string, now time.Time) (time.Time, int) {
+	if len(words) < 3 || quickAddWord(words[0]) != "in" {
+		return time.Time{}, 0
+	}
+	n, err := strconv.Atoi(words[1])
+	if err != nil || n < 1 {
+		return time.Time{}, 0
+	}
+	switch strings.TrimSuffix(quickAddWord(words[2]), "s") {
+	case "minute", "min":
+		return now.Add(time.Duration(n) * time.Minute).Truncate(time.Minute), 3
+	case "hour":
+		return now.Add(time.Duration(n) * time.Hour).Truncate(time.Minute), 3
+	}
+	return time.Time{}, 0
+}
@@ -0,0 +1,201 @@
+package todo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// recurrence names a completed recurring todo by its namespace and ID.
+type recurrence struct {
+	ns *namespace
+	id int
+}
+
+// recurrenceQueue carries the completed recurring todos to the goroutine
+// creating their next occurrence.
+var recurrenceQueue = make(chan recurrence, 256)
+
+// validateRecurrence checks that r is empty, "daily", "weekly", "monthly"
+// or a valid cron expression.
+func validateRecurrence(r string) error {
+	switch r {
+	case "", "daily", "weekly", "monthly":
+		return nil
+	}
+	if _, err := parseCron(r); err != nil {
+		return fmt.Errorf("invalid recurrence: %w", err)
+	}
+	return nil
+}
+
+// nextDueDate returns the due date of the occurrence following one due at
+// due, skipping occurrences that would already be in the past at now.
+func nextDueDate(recurrence string, due, now time.Time) time.Time {
+	var step func(time.Time) time.Time
+	switch recurrence {
+	case "daily":
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "weekly":
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	case "monthly":
+		step = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		cron, err := parseCron(recurrence)
+		if err != nil {
+			return time.Time{}
+		}
+		if due.Before(now) {
+			due = now
+		}
+		return cron.next(due)
+	}
+	next := step(due)
+	for !next.After(now) {
+		next = step(next)
+	}
+	return next
+}
+
+// queueRecurrence is subscribed to the event bus and hands recurring todos
+// that are done over to runRecurrence.
+func queueRecurrence(e Event) {
+	if e.Type != "todo.created" && e.Type != "todo.updated" {
+		return
+	}
+	ns := e.namespace()
+	todo, ok := ns.store.get(e.TodoID)
+	if !ok || todo.Recurrence == "" || todo.Status != statusDone || todo.NextOccurrence != 0 {
+		return
+	}
+	select {
+	case recurrenceQueue <- recurrence{ns: ns, id: e.TodoID}:
+	default:
+		log.Printf("recurrence: queue full, dropping todo %d", e.TodoID)
+	}
+}
+
+// runRecurrence creates the next occurrence of every completed recurring
+// todo it receives until ctx is done.
+func runRecurrence(ctx context.Context) {
+	for {
+		select {
+		case r := <-recurrenceQueue:
+			if next, ok := createNextOccurrence(r.ns, r.id, time.Now()); ok {
+				todosChanged()
+				r.ns.publish(Event{Type: "todo.created", TodoID: next, Data: map[string]interface{}{"occurrence_of": r.id}})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// createNextOccurrence adds the occurrence following the todo of ns with the
+// given ID and links the two. The occurrence starts in backlog, and is
+// created on behalf of the creator of the series, so it stays visible to,
+// and counts against the quota of, the same caller. It reports false if the
+// todo is gone, not recurring or not done, or already has a next
+// occurrence, and if the backend doesn't accept the occurrence.
+func createNextOccurrence(ns *namespace, id int, now time.Time) (int, bool) {
+	var next *Todo
+	var series int
+	_, _, err := ns.store.update("recurrence", id, func(todo *Todo) error {
+		if todo.Recurrence == "" || todo.Status != statusDone || todo.NextOccurrence != 0 {
+			return errNoChange
+		}
+		series = todo.SeriesID
+		if series == 0 {
+			series = todo.ID
+			todo.SeriesID = series
+		}
+
+		due := now
+		if todo.DueAt != nil {
+			due = *todo.DueAt
+		}
+		nextDue := nextDueDate(todo.Recurrence, due, now)
+
+		c := todo.clone()
+		next = &Todo{
+			Title:       c.Title,
+			Description: c.Description,
+			Attachments: c.Attachments,
+			Priority:    c.Priority,
+			Project:     c.Project,
+			Tags:        c.Tags,
+			Assignee:    c.Assignee,
+			Recurrence:  c.Recurrence,
+			Status:      statusBacklog,
+			SeriesID:    series,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if !nextDue.IsZero() {
+			next.DueAt = &nextDue
+		}
+		for _, s := range c.Subtasks {
+			s.Completed = false
+			next.Subtasks = append(next.Subtasks, s)
+		}
+		// Reserve the ID now so the link is set in the same update.
+		id, err := ns.store.newID()
+		if err != nil {
+			return err
+		}
+		next.ID = id
+		todo.NextOccurrence = next.ID
+		todo.UpdatedAt = now
+		return nil
+	})
+	if next == nil || err != nil {
+		return 0, false
+	}
+	actor := ns.store.creator(series)
+	if actor == "" {
+		actor = "recurrence"
+	}
+	if err := ns.store.put(actor, next); err != nil {
+		// Unlink the occurrence, so completing the todo again retries.
+		ns.store.update("recurrence", id, func(todo *Todo) error {
+			todo.NextOccurrence = 0
+			return nil
+		})
+		return 0, false
+	}
+	return next.ID, true
+}
+
+// getOccurrences handles GET /todos/{id}/occurrences and lists the todos of
+// the recurring series the todo belongs to that the caller may see, oldest
+// first.
+func getOccurrences(ctx *fasthttp.RequestCtx, id int) {
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	ns := namespaceOf(ctx)
+	todo, ok := ns.store.get(id)
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	series := todo.SeriesID
+	if series == 0 {
+		series = todo.ID
+	}
+
+	occurrences := []Todo{}
+	ns.store.each(func(t *Todo) bool {
+		if (t.ID == series || t.SeriesID == series) && (visible == nil || visible(t)) {
+			occurrences = append(occurrences, t.clone())
+		}
+		return true
+	})
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].ID < occurrences[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, occurrences)
+}
@@ -0,0 +1,266 @@
+package todo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errRedisNil is returned for null replies where a value was expected.
+var errRedisNil = errors.New("redis: nil")
+
+// redisPool is a minimal Redis client speaking RESP2 over a pool of
+// connections. At most size connections are open at once; callers wait
+// for a free one.
+type redisPool struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	idle chan *redisConn
+	// slots holds a token for every connection that may be opened.
+	slots chan struct{}
+}
+
+// redisConn is a connection to the Redis server.
+type redisConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// newRedisPool returns a pool of up to size connections to the server at
+// addr, authenticating with password, if any, and selecting database db.
+func newRedisPool(addr, password string, db, size int, timeout time.Duration) *redisPool {
+	p := &redisPool{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *redisConn, size),
+		slots:    make(chan struct{}, size),
+	}
+	for i := 0; i < size; i++ {
+		p.slots <- struct{}{}
+	}
+	return p
+}
+
+// dial opens a connection and prepares it for commands.
+func (p *redisPool) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	var setup [][]string
+	if p.password != "" {
+		setup = append(setup, []string{"AUTH", p.password})
+	}
+	if p.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(p.db)})
+	}
+	for _, cmd := range setup {
+		if _, err := conn.do(p.timeout, cmd...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// get returns an idle connection or opens a new one, and reports whether
+// the connection was idle.
+func (p *redisPool) get() (*redisConn, bool, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, true, nil
+	default:
+	}
+	select {
+	case conn := <-p.idle:
+		return conn, true, nil
+	case <-p.slots:
+		conn, err := p.dial()
+		if err != nil {
+			p.slots <- struct{}{}
+			return nil, false, err
+		}
+		return conn, false, nil
+	}
+}
+
+// put returns a connection to the pool, closing it if it failed.
+func (p *redisPool) put(conn *redisConn, err error) {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && err != errRedisNil {
+		conn.c.Close()
+		p.slots <- struct{}{}
+		return
+	}
+	p.idle <- conn
+}
+
+// do sends a command and returns its reply: a string for status replies,
+// an int64, a []byte, nil for null replies, or a []interface{} of those.
+// Error replies are returned as redisError.
+func (p *redisPool) do(args ...string) (interface{}, error) {
+	replies, err := p.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends several commands at once and returns their replies in
+// order. It fails with the first error reply. Commands failing on an idle
+// connection are retried once on a new one, since the server may have
+// closed the idle one, e.g., when it restarted.
+func (p *redisPool) pipeline(cmds [][]string) ([]interface{}, error) {
+	for {
+		conn, idle, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		replies, err := conn.pipeline(p.timeout, cmds)
+		p.put(conn, err)
+		var replyErr redisError
+		if idle && err != nil && !errors.As(err, &replyErr) {
+			p.drain()
+			continue
+		}
+		return replies, err
+	}
+}
+
+// drain closes the idle connections.
+func (p *redisPool) drain() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.c.Close()
+			p.slots <- struct{}{}
+		default:
+			return
+		}
+	}
+}
+
+// do sends a single command on the connection.
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	replies, err := c.pipeline(timeout, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends cmds and reads all their replies.
+func (c *redisConn) pipeline(timeout time.Duration, cmds [][]string) ([]interface{}, error) {
+	if timeout > 0 {
+		c.c.SetDeadline(time.Now().Add(timeout))
+	}
+	for _, args := range cmds {
+		c.writeCommand(args)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := c.readReply()
+		if err != nil {
+			var replyErr redisError
+			if !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// writeCommand writes a command as an array of bulk strings.
+func (c *redisConn) writeCommand(args []string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readReply reads one reply.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Errors inside arrays, e.g. of EXEC, are returned as values.
+			item, err := c.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				item, err = replyErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisInt converts an integer or bulk string reply to an int64.
+func redisInt(reply interface{}) (int64, error) {
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case nil:
+		return 0, errRedisNil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+}
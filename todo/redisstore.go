@@ -0,0 +1,337 @@
+package todo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisLoadBatch is the number of todos fetched per round trip on startup.
+const redisLoadBatch = 500
+
+// redisStore is a todoBackend keeping todos in Redis, so several instances
+// can serve the same todos. With prefix "todo:" it uses the keys
+//
+//	todo:todo:{id}       hash holding the JSON encoding of a todo in "json"
+//	                     and its version in "version"; todos saved before
+//	                     versions were kept are at version 1
+//	todo:todos           sorted set of the IDs of all todos, scored by ID
+//	todo:todos:position  sorted set of the IDs, scored by position
+//	todo:next_id         the last todo ID handed out
+//	todo:changes         channel announcing changed todos as "{instance} {id}"
+type redisStore struct {
+	pool   *redisPool
+	prefix string
+	// ttl, if positive, expires todos that weren't changed for that long.
+	ttl time.Duration
+	// instance identifies this process in change notifications, so it can
+	// skip its own.
+	instance string
+}
+
+// newRedisStore returns a Redis backend with the settings of cfg.
+func newRedisStore(cfg Config) (*redisStore, error) {
+	if cfg.RedisPoolSize < 1 {
+		return nil, fmt.Errorf("invalid Redis pool size %d", cfg.RedisPoolSize)
+	}
+	r := &redisStore{
+		pool:     newRedisPool(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.RedisPoolSize, 5*time.Second),
+		prefix:   cfg.RedisPrefix,
+		ttl:      cfg.RedisTTL,
+		instance: randomToken(8),
+	}
+	if _, err := r.pool.do("PING"); err != nil {
+		return nil, fmt.Errorf("connecting to Redis at %s: %w", cfg.RedisAddr, err)
+	}
+	return r, nil
+}
+
+func (r *redisStore) todoKey(id int) string {
+	return r.prefix + "todo:" + strconv.Itoa(id)
+}
+
+func (r *redisStore) load() ([]storedTodo, error) {
+	reply, err := r.pool.do("ZRANGE", r.prefix+"todos", "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]interface{})
+	var stored []storedTodo
+	var expired []string
+	for start := 0; start < len(ids); start += redisLoadBatch {
+		batch := ids[start:min(start+redisLoadBatch, len(ids))]
+		cmds := make([][]string, len(batch))
+		for i, id := range batch {
+			cmds[i] = []string{"HMGET", r.prefix + "todo:" + string(id.([]byte)), "json", "version"}
+		}
+		replies, err := r.pool.pipeline(cmds)
+		if err != nil {
+			return nil, err
+		}
+		for i, reply := range replies {
+			t, err := redisStoredTodo(reply)
+			if err != nil {
+				return nil, err
+			}
+			if t.raw == nil {
+				expired = append(expired, string(batch[i].([]byte)))
+				continue
+			}
+			stored = append(stored, t)
+		}
+	}
+	// Drop the IDs of todos that expired from the sorted sets.
+	if len(expired) > 0 {
+		_, err := r.pool.pipeline([][]string{
+			append([]string{"ZREM", r.prefix + "todos"}, expired...),
+			append([]string{"ZREM", r.prefix + "todos:position"}, expired...),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+func (r *redisStore) fetch(id int) (storedTodo, error) {
+	reply, err := r.pool.do("HMGET", r.todoKey(id), "json", "version")
+	if err != nil {
+		return storedTodo{}, err
+	}
+	return redisStoredTodo(reply)
+}
+
+// redisStoredTodo decodes the reply to HMGET of the "json" and "version"
+// fields of a todo.
+func redisStoredTodo(reply interface{}) (storedTodo, error) {
+	fields, _ := reply.([]interface{})
+	if len(fields) != 2 {
+		return storedTodo{}, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	raw, ok := fields[0].([]byte)
+	if !ok {
+		return storedTodo{}, nil
+	}
+	t := storedTodo{raw: raw, version: 1}
+	if fields[1] != nil {
+		v, err := redisInt(fields[1])
+		if err != nil {
+			return storedTodo{}, err
+		}
+		t.version = v
+	}
+	return t, nil
+}
+
+func (r *redisStore) nextID() (int, error) {
+	reply, err := r.pool.do("INCR", r.prefix+"next_id")
+	if err != nil {
+		return 0, err
+	}
+	id, err := redisInt(reply)
+	return int(id), err
+}
+
+// reserveID raises the ID counter to id unless it is higher already. The
+// counter may overshoot when instances reserve IDs concurrently, which
+// only leaves gaps.
+func (r *redisStore) reserveID(id int) error {
+	key := r.prefix + "next_id"
+	for {
+		reply, err := r.pool.do("GET", key)
+		if err != nil {
+			return err
+		}
+		cur := int64(0)
+		if reply != nil {
+			if cur, err = redisInt(reply); err != nil {
+				return err
+			}
+		}
+		if cur >= int64(id) {
+			return nil
+		}
+		reply, err = r.pool.do("INCRBY", key, strconv.FormatInt(int64(id)-cur, 10))
+		if err != nil {
+			return err
+		}
+		if n, err := redisInt(reply); err != nil || n >= int64(id) {
+			return err
+		}
+	}
+}
+
+// resetIDs starts the ID counter over, so the next ID is 1.
+func (r *redisStore) resetIDs() error {
+	_, err := r.pool.do("SET", r.prefix+"next_id", "0")
+	return err
+}
+
+// redisSaveScript saves a todo, see todoBackend.save, and returns 0 if it
+// isn't at the expected version. The keys are the todo's hash and the
+// sorted sets of IDs and positions; the arguments the expected version,
+// the JSON encoding, the ID, the position, the TTL in milliseconds (0 for
+// none), and the channel and message announcing the change.
+const redisSaveScript = `
+local version = tonumber(redis.call('HGET', KEYS[1], 'version')) or redis.call('EXISTS', KEYS[1])
+local expect = tonumber(ARGV[1])
+if expect >= 0 and version ~= expect then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'json', ARGV[2], 'version', version + 1)
+if tonumber(ARGV[5]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[3])
+redis.call('PUBLISH', ARGV[6], ARGV[7])
+return 1`
+
+// redisRemoveScript removes a todo, see todoBackend.remove, and returns 0
+// if it isn't at the expected version. The keys are those of
+// redisSaveScript; the arguments the expected version, the ID, and the
+// channel and message announcing the change.
+const redisRemoveScript = `
+local version = tonumber(redis.call('HGET', KEYS[1], 'version')) or redis.call('EXISTS', KEYS[1])
+local expect = tonumber(ARGV[1])
+if expect >= 0 and version ~= expect then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[2])
+redis.call('ZREM', KEYS[3], ARGV[2])
+redis.call('PUBLISH', ARGV[3], ARGV[4])
+return 1`
+
+func (r *redisStore) save(todo *Todo, expect int64) error {
+	return r.transaction(r.saveCommand(todo, expect))
+}
+
+func (r *redisStore) remove(id int, expect int64) error {
+	return r.transaction(r.removeCommand(id, expect))
+}
+
+// writeBatch writes several changes in one transaction.
+func (r *redisStore) writeBatch(writes []pendingWrite) error {
+	var cmds [][]string
+	for _, write := range writes {
+		if write.todo == nil {
+			cmds = append(cmds, r.removeCommand(write.id, write.expect))
+		} else {
+			cmds = append(cmds, r.saveCommand(write.todo, write.expect))
+		}
+	}
+	return r.transaction(cmds...)
+}
+
+// saveCommand returns the command saving a todo at version expect.
+func (r *redisStore) saveCommand(todo *Todo, expect int64) []string {
+	id := strconv.Itoa(todo.ID)
+	ttl := int64(0)
+	if r.ttl > 0 {
+		ttl = r.ttl.Milliseconds()
+	}
+	return []string{"EVAL", redisSaveScript, "3", r.todoKey(todo.ID), r.prefix + "todos", r.prefix + "todos:position",
+		strconv.FormatInt(expect, 10), string(todo.raw), id, strconv.FormatFloat(todo.Position, 'g', -1, 64),
+		strconv.FormatInt(ttl, 10), r.prefix + "changes", r.instance + " " + id}
+}
+
+// removeCommand returns the command removing a todo at version expect.
+func (r *redisStore) removeCommand(id int, expect int64) []string {
+	member := strconv.Itoa(id)
+	return []string{"EVAL", redisRemoveScript, "3", r.todoKey(id), r.prefix + "todos", r.prefix + "todos:position",
+		strconv.FormatInt(expect, 10), member, r.prefix + "changes", r.instance + " " + member}
+}
+
+// ping checks that Redis is reachable.
+func (r *redisStore) ping(ctx context.Context) error {
+	_, err := r.pool.do("PING")
+	return err
+}
+
+// transaction runs the scripts of cmds atomically with MULTI and EXEC. It
+// fails with errVersionConflict if a script found its todo at another
+// version and left it alone.
+func (r *redisStore) transaction(cmds ...[]string) error {
+	all := append([][]string{{"MULTI"}}, cmds...)
+	all = append(all, []string{"EXEC"})
+	replies, err := r.pool.pipeline(all)
+	if err != nil {
+		return err
+	}
+	results, _ := replies[len(replies)-1].([]interface{})
+	for _, result := range results {
+		if err, ok := result.(redisError); ok {
+			return err
+		}
+	}
+	for _, result := range results {
+		if result == int64(0) {
+			return errVersionConflict
+		}
+	}
+	return nil
+}
+
+// watch subscribes to the change notifications of other instances,
+// reconnecting after errors. Notifications published while it was
+// disconnected are lost, so it asks for a reload after reconnecting.
+func (r *redisStore) watch(ctx context.Context, fn func(id int)) {
+	for reconnect := false; ctx.Err() == nil; reconnect = true {
+		err := r.subscribe(ctx, fn, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error watching Redis for changes, reconnecting: %s", err)
+		if !sleepCtx(ctx, time.Second) {
+			return
+		}
+	}
+}
+
+// subscribe reads change notifications on a dedicated connection until it
+// fails or ctx is done. With resync it calls fn(0) once subscribed.
+func (r *redisStore) subscribe(ctx context.Context, fn func(id int), resync bool) error {
+	conn, err := r.pool.dial()
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.c.Close() })
+	defer stop()
+	defer conn.c.Close()
+
+	if _, err := conn.do(r.pool.timeout, "SUBSCRIBE", r.prefix+"changes"); err != nil {
+		return err
+	}
+	conn.c.SetDeadline(time.Time{})
+	if resync {
+		fn(0)
+	}
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+		msg, _ := reply.([]interface{})
+		if len(msg) != 3 || string(asBytes(msg[0])) != "message" {
+			continue
+		}
+		instance, idStr, _ := strings.Cut(string(asBytes(msg[2])), " ")
+		id, err := strconv.Atoi(idStr)
+		if instance == r.instance || err != nil {
+			continue
+		}
+		fn(id)
+	}
+}
+
+// asBytes returns a bulk string reply as bytes.
+func asBytes(reply interface{}) []byte {
+	b, _ := reply.([]byte)
+	return b
+}
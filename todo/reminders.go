@@ -0,0 +1,138 @@
+package todo
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// runReminders checks for due reminders every interval and sends them
+// through all notifiers until ctx is done. Reminders about the todos of a
+// tenant namespace only go to the tenant's webhook, if it has one.
+func runReminders(ctx context.Context, interval time.Duration, notifiers []notifier) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// Replicas and cluster followers leave reminders to the primary.
+		if readOnly() {
+			continue
+		}
+		for _, ns := range allNamespaces() {
+			for _, n := range claimDueReminders(ns, now) {
+				for _, nt := range ns.notifiers(n.TodoID, notifiers) {
+					if err := nt.notify(n); err != nil {
+						log.Printf("reminder for todo %d: %s", n.TodoID, err)
+					}
+				}
+				ns.publish(Event{Type: "todo.reminded", TodoID: n.TodoID})
+			}
+		}
+	}
+}
+
+// claimDueReminders clears the reminders of ns that are due at now and
+// returns the notifications to send for them. Clearing them first makes
+// sure every reminder fires only once.
+func claimDueReminders(ns *namespace, now time.Time) []notification {
+	var due []notification
+	ns.store.updateAll("reminders", func(todo *Todo) bool {
+		if todo.RemindAt == nil || todo.RemindAt.After(now) {
+			return false
+		}
+		due = append(due, notification{
+			Kind:    "reminder",
+			TodoID:  todo.ID,
+			Title:   "Reminder: " + todo.Title,
+			Message: reminderMessage(todo),
+			Time:    now,
+		})
+		todo.RemindAt = nil
+		return true
+	})
+	if len(due) > 0 {
+		todosChanged()
+	}
+	return due
+}
+
+func reminderMessage(todo *Todo) string {
+	msg := todo.Title
+	if todo.DueAt != nil {
+		msg += " (due " + todo.DueAt.Format(time.RFC1123) + ")"
+	}
+	if todo.Description != "" {
+		msg += "\n\n" + todo.Description
+	}
+	return msg
+}
+
+// snoozeReminder handles POST /todos/{id}/reminder/snooze. The reminder is
+// moved to ?for= from now (a duration such as "10m", 10 minutes by default)
+// or to the RFC 3339 time given as ?until=.
+func snoozeReminder(ctx *fasthttp.RequestCtx, id int) {
+	remindAt := time.Now().Add(10 * time.Minute)
+	args := ctx.QueryArgs()
+	switch {
+	case args.Has("until"):
+		t, err := time.Parse(time.RFC3339, string(args.Peek("until")))
+		if err != nil {
+			ctx.Error("Invalid until, expected an RFC 3339 timestamp", fasthttp.StatusBadRequest)
+			return
+		}
+		remindAt = t
+	case args.Has("for"):
+		d, err := time.ParseDuration(string(args.Peek("for")))
+		if err != nil || d <= 0 {
+			ctx.Error("Invalid for, expected a positive duration", fasthttp.StatusBadRequest)
+			return
+		}
+		remindAt = time.Now().Add(d)
+	}
+
+	raw, ok, err := namespaceOf(ctx).store.update(actorOf(ctx), id, func(todo *Todo) error {
+		todo.RemindAt = &remindAt
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	todosChanged()
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// cancelReminder handles DELETE /todos/{id}/reminder.
+func cancelReminder(ctx *fasthttp.RequestCtx, id int) {
+	_, ok, err := namespaceOf(ctx).store.update(actorOf(ctx), id, func(todo *Todo) error {
+		if todo.RemindAt == nil {
+			return errNoChange
+		}
+		todo.RemindAt = nil
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if writeStoreError(ctx, err) {
+		return
+	}
+	switch {
+	case !ok:
+		todoNotFound(ctx, id)
+	case err == errNoChange:
+		ctx.Error("Todo has no reminder", fasthttp.StatusNotFound)
+	default:
+		todosChanged()
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}
+}
@@ -0,0 +1,522 @@
+package todo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Replication of the todos of the default namespace from a primary to
+// read-only replicas.
+const (
+	// replicationLogSize is the number of recent changes a primary keeps
+	// for replicas catching up after a reconnect. Replicas further behind
+	// get a snapshot instead.
+	replicationLogSize = 10000
+	// replicationHeartbeat is how often an idle feed sends a heartbeat, and
+	// replicationTimeout how long a replica waits for a message before it
+	// reconnects.
+	replicationHeartbeat = 15 * time.Second
+	replicationTimeout   = 3 * replicationHeartbeat
+)
+
+// replicatedChange is a change of a todo: its JSON encoding, or nil if it
+// was removed. Changes of the roles granted on a todo or project have their
+// grants instead.
+type replicatedChange struct {
+	seq    uint64
+	id     int
+	raw    []byte
+	grants *shareGrants
+}
+
+// changeLog numbers the changes of a store and keeps the most recent ones.
+// Sequence numbers restart with every process, which is told apart by its
+// epoch.
+type changeLog struct {
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	entries []replicatedChange
+	// wait is closed and replaced when a change is appended.
+	wait chan struct{}
+}
+
+func newChangeLog() *changeLog {
+	return &changeLog{epoch: randomToken(8), wait: make(chan struct{})}
+}
+
+// append records a change of the todo with the given ID.
+func (l *changeLog) append(id int, raw []byte) {
+	l.push(replicatedChange{id: id, raw: raw})
+}
+
+// appendShares records a change of the roles granted on a todo or project.
+func (l *changeLog) appendShares(g shareGrants) {
+	l.push(replicatedChange{id: g.id, grants: &g})
+}
+
+func (l *changeLog) push(c replicatedChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	c.seq = l.seq
+	l.entries = append(l.entries, c)
+	if len(l.entries) > replicationLogSize {
+		l.entries = append([]replicatedChange(nil), l.entries[len(l.entries)-replicationLogSize/2:]...)
+	}
+	close(l.wait)
+	l.wait = make(chan struct{})
+}
+
+// since returns the changes after seq and a channel closed on the next
+// change. It reports false if changes after seq were already dropped.
+func (l *changeLog) since(seq uint64) ([]replicatedChange, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq > l.seq || (len(l.entries) > 0 && l.entries[0].seq > seq+1) || (len(l.entries) == 0 && seq < l.seq) {
+		return nil, nil, false
+	}
+	i := len(l.entries) - int(l.seq-seq)
+	return append([]replicatedChange(nil), l.entries[i:]...), l.wait, true
+}
+
+// last returns the sequence number of the latest change.
+func (l *changeLog) last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// feedsStopped is canceled by Shutdown to end the replication feeds and
+// event streams, which would otherwise keep their connections busy.
+var feedsStopped, stopFeeds = context.WithCancel(context.Background())
+
+// replicationMessage is a line of the replication feed:
+//
+//	snapshot   the todos and shares follow as "todo" and "shares"
+//	           messages, up to Seq
+//	todo       a todo of the snapshot
+//	shares     the roles granted on the todo ID, or on Project if set;
+//	           they replace the previous ones
+//	synced     the snapshot is complete; todos and shares it didn't list
+//	           are gone
+//	change     a change after the snapshot; Todo is null for removals
+//	heartbeat  nothing changed for a while
+//
+// Todos carry their Creator, who owns them like on the primary.
+type replicationMessage struct {
+	Type    string          `json:"type"`
+	Epoch   string          `json:"epoch,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	ID      int             `json:"id,omitempty"`
+	Todo    json.RawMessage `json:"todo,omitempty"`
+	Creator string          `json:"creator,omitempty"`
+	Project string          `json:"project,omitempty"`
+	Shares  []Share         `json:"shares,omitempty"`
+}
+
+// sharesMessage returns the message sending the grants g.
+func sharesMessage(g shareGrants) replicationMessage {
+	return replicationMessage{Type: "shares", ID: g.id, Project: g.project, Shares: g.shares}
+}
+
+// getReplicationFeed handles GET /admin/replication/feed, streaming the
+// todos and shares of the default namespace and their changes to a replica as
+// newline-delimited replicationMessages. A replica resuming with the epoch
+// and the sequence number of the last change it applied gets the changes
+// since; otherwise, or if the primary no longer has them, it first gets a
+// snapshot. The feed ends when the replica falls too far behind, which
+// then reconnects.
+func getReplicationFeed(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	changes := store.changes
+	args := ctx.QueryArgs()
+	since, err := strconv.ParseUint(string(args.Peek("since")), 10, 64)
+	snapshot := err != nil || string(args.Peek("epoch")) != changes.epoch
+	if !snapshot {
+		_, _, ok := changes.since(since)
+		snapshot = !ok
+	}
+
+	// The feed outlasts -write-timeout and gets -stream-timeout instead,
+	// see streamConfig.
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		if snapshot {
+			// The todos are collected first so writing to a slow replica
+			// doesn't hold the locks of the shards. Changes made meanwhile
+			// are sent again below; they carry the whole todo, so applying
+			// them twice is harmless.
+			since = changes.last()
+			var msgs []replicationMessage
+			store.each(func(todo *Todo) bool {
+				msgs = append(msgs, replicationMessage{Type: "todo", ID: todo.ID, Todo: todo.raw, Creator: store.audit.creator(todo.ID)})
+				return true
+			})
+			for _, g := range defaultNamespace.shares.all() {
+				msgs = append(msgs, sharesMessage(g))
+			}
+			enc.Encode(replicationMessage{Type: "snapshot", Epoch: changes.epoch, Seq: since})
+			for _, msg := range msgs {
+				enc.Encode(msg)
+			}
+			enc.Encode(replicationMessage{Type: "synced", Epoch: changes.epoch, Seq: since})
+		}
+		heartbeat := time.NewTicker(replicationHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			recent, wait, ok := changes.since(since)
+			if !ok {
+				return
+			}
+			for _, c := range recent {
+				since = c.seq
+				if c.grants != nil {
+					msg := sharesMessage(*c.grants)
+					msg.Seq = c.seq
+					enc.Encode(msg)
+					continue
+				}
+				msg := replicationMessage{Type: "change", Seq: c.seq, ID: c.id, Todo: json.RawMessage(c.raw)}
+				if c.raw == nil {
+					msg.Todo = json.RawMessage("null")
+				} else {
+					msg.Creator = store.creator(c.id)
+				}
+				enc.Encode(msg)
+			}
+			if len(recent) > 0 {
+				continue
+			}
+			select {
+			case <-wait:
+			case <-heartbeat.C:
+				enc.Encode(replicationMessage{Type: "heartbeat"})
+			case <-feedsStopped.Done():
+				return
+			}
+		}
+	})
+}
+
+// replicaState is the state of a replica: the primary it follows and how
+// far it got.
+type replicaState struct {
+	mu      sync.Mutex
+	primary string
+	// stop ends following the primary.
+	stop        context.CancelFunc
+	connected   bool
+	epoch       string
+	seq         uint64
+	lastContact time.Time
+	// term is the cluster term of the leader the replica follows, see
+	// clusterProgress; zero outside of clusters.
+	term uint64
+}
+
+// replica is set while the server is a read-only replica.
+var (
+	replicaMu sync.Mutex
+	replica   *replicaState
+)
+
+// currentReplica returns the state of the replica, or nil if the server is
+// not a replica.
+func currentReplica() *replicaState {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	return replica
+}
+
+// replicaPrimary returns the URL of the primary, or "" if the server is not
+// a replica.
+func replicaPrimary() string {
+	if r := currentReplica(); r != nil {
+		return r.primary
+	}
+	return ""
+}
+
+// parsePrimaryURL checks the URL of -replica-of and returns it without a
+// trailing slash.
+func parsePrimaryURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", s)
+	}
+	return strings.TrimSuffix(s, "/"), nil
+}
+
+// startReplica makes the server a replica of the primary at primary,
+// following its feed until the server shuts down or is promoted.
+func startReplica(primary string) *replicaState {
+	ctx, cancel := context.WithCancel(background.ctx)
+	r := &replicaState{primary: primary, stop: cancel}
+	replicaMu.Lock()
+	replica = r
+	replicaMu.Unlock()
+	background.spawn("replica", func(context.Context) {
+		r.follow(ctx)
+	})
+	return r
+}
+
+// follow applies the feed of the primary, reconnecting after errors.
+func (r *replicaState) follow(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := r.tail(ctx)
+		r.mu.Lock()
+		if r.connected {
+			backoff = time.Second
+		}
+		r.connected = false
+		r.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error replicating from %s, reconnecting: %s", r.primary, err)
+		if !sleepCtx(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// tail reads the feed of the primary until it ends or fails.
+func (r *replicaState) tail(ctx context.Context) error {
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.mu.Lock()
+	feedURL := r.primary + apiPrefix + "/admin/replication/feed?epoch=" + url.QueryEscape(r.epoch) + "&since=" + strconv.FormatUint(r.seq, 10)
+	r.mu.Unlock()
+	req, err := http.NewRequestWithContext(feedCtx, "GET", feedURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Token", adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("feed responded with %s", resp.Status)
+	}
+
+	// Reconnect if the primary goes quiet, e.g., after a network failure.
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+	r.mu.Lock()
+	r.connected = true
+	r.mu.Unlock()
+
+	var snapshot map[int]bool
+	var grants []shareGrants
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			if feedCtx.Err() != nil && ctx.Err() == nil {
+				return fmt.Errorf("no message for %s", replicationTimeout)
+			}
+			return err
+		}
+		watchdog.Reset(replicationTimeout)
+		var msg replicationMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return fmt.Errorf("invalid feed message: %w", err)
+		}
+		switch msg.Type {
+		case "snapshot":
+			snapshot = make(map[int]bool)
+			grants = nil
+		case "todo":
+			if snapshot == nil {
+				return errors.New("todo outside of a snapshot")
+			}
+			if err := applyReplicated(msg.ID, msg.Todo, msg.Creator); err != nil {
+				return err
+			}
+			snapshot[msg.ID] = true
+		case "shares":
+			g := shareGrants{id: msg.ID, project: msg.Project, shares: msg.Shares}
+			if snapshot != nil {
+				grants = append(grants, g)
+				break
+			}
+			defaultNamespace.shares.set(g)
+			todosChanged()
+			r.advance("", msg.Seq)
+		case "synced":
+			for _, id := range store.ids() {
+				if !snapshot[id] {
+					store.applyRemote(id, storedTodo{})
+				}
+			}
+			defaultNamespace.shares.replace(grants)
+			todosChanged()
+			snapshot, grants = nil, nil
+			r.advance(msg.Epoch, msg.Seq)
+		case "change":
+			var raw []byte
+			if !bytes.Equal(msg.Todo, []byte("null")) {
+				raw = msg.Todo
+			}
+			if err := applyReplicated(msg.ID, raw, msg.Creator); err != nil {
+				return err
+			}
+			r.advance("", msg.Seq)
+		}
+		r.mu.Lock()
+		r.lastContact = time.Now()
+		r.mu.Unlock()
+	}
+}
+
+// applyReplicated applies a todo of the primary's feed, or its removal
+// when raw is nil, and records its creator, who owns it on the replica too.
+func applyReplicated(id int, raw []byte, creator string) error {
+	if creator != "" {
+		store.audit.recordCreator(creator, id, raw)
+	}
+	if err := store.applyRemote(id, storedTodo{raw: raw}); err != nil {
+		return fmt.Errorf("applying todo %d: %w", id, err)
+	}
+	return nil
+}
+
+// advance records the last change applied, and the epoch of the primary
+// if it is set.
+func (r *replicaState) advance(epoch string, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch != "" {
+		r.epoch = epoch
+	}
+	r.seq = seq
+}
+
+// primaryOnly wraps a job that changes todos or publishes events about them
+// so that it does nothing while the server is a replica or a cluster
+// follower: the primary or leader runs it, and its changes arrive through
+// the feed.
+func primaryOnly(fn jobFunc) jobFunc {
+	return func(ctx context.Context, job *jobProgress) (interface{}, error) {
+		if readOnly() {
+			return nil, nil
+		}
+		return fn(ctx, job)
+	}
+}
+
+// replicaHandler wraps h, redirecting writes to the primary with 307
+// Temporary Redirect while the server is a replica, and forwarding them to
+// the leader while it is a cluster follower. Promoting the replica, the
+// requests of the cluster nodes and the debug endpoints, which act on the
+// server itself, are the only writes it accepts.
+func replicaHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		switch {
+		case string(ctx.Method()) == "GET", string(ctx.Method()) == "HEAD", string(ctx.Method()) == "OPTIONS",
+			strings.HasSuffix(path, "/admin/replication/promote"), strings.HasSuffix(path, "/admin/cluster/vote"),
+			strings.HasSuffix(path, "/admin/cluster/heartbeat"), isDebugPath(path):
+			h(ctx)
+		case cluster != nil:
+			if role, leader, _ := cluster.status(); role != nodeLeader {
+				forwardToLeader(ctx, leader)
+				return
+			}
+			h(ctx)
+		case replicaPrimary() != "":
+			ctx.Error("This server is a read-only replica, send writes to the primary", fasthttp.StatusTemporaryRedirect)
+			ctx.Response.Header.Set("Location", replicaPrimary()+string(ctx.RequestURI()))
+		default:
+			h(ctx)
+		}
+	}
+}
+
+// getReplication handles GET /admin/replication and reports whether the
+// server is the primary or a replica, and how far it got.
+func getReplication(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	r := currentReplica()
+	if r == nil {
+		writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+			"role":  "primary",
+			"epoch": store.changes.epoch,
+			"seq":   store.changes.last(),
+		})
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := map[string]interface{}{
+		"role":      "replica",
+		"primary":   r.primary,
+		"connected": r.connected,
+		"epoch":     r.epoch,
+		"seq":       r.seq,
+	}
+	if !r.lastContact.IsZero() {
+		status["last_contact"] = r.lastContact
+	}
+	writeJSON(ctx, fasthttp.StatusOK, status)
+}
+
+// promoteReplica handles POST /admin/replication/promote and turns the
+// replica into a primary: it stops following the old primary and accepts
+// writes. Other replicas must be pointed at it and get a snapshot.
+func promoteReplica(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	if cluster != nil {
+		ctx.Error("This server is a cluster node, the cluster elects its leader", fasthttp.StatusConflict)
+		return
+	}
+	replicaMu.Lock()
+	r := replica
+	replica = nil
+	replicaMu.Unlock()
+	if r == nil {
+		ctx.Error("This server is not a replica", fasthttp.StatusConflict)
+		return
+	}
+	r.stop()
+	log.Printf("Promoted to primary, no longer replicating from %s", r.primary)
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"role":  "primary",
+		"epoch": store.changes.epoch,
+		"seq":   store.changes.last(),
+	})
+}
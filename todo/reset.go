@@ -0,0 +1,103 @@
+package todo
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/valyala/fasthttp"
+)
+
+// resetEnabled allows POST /admin/reset, see -enable-reset. It is set once
+// at startup.
+var resetEnabled bool
+
+// idResetter is implemented by backends whose ID counter can be started
+// over.
+type idResetter interface {
+	resetIDs() error
+}
+
+// resetResult summarizes a reset.
+type resetResult struct {
+	Todos    int `json:"todos"`
+	Comments int `json:"comments"`
+	Uploads  int `json:"uploads"`
+}
+
+// resetStore removes all todos of the default namespace together with
+// their comments and history, and starts IDs and positions over, so the
+// next todo gets ID 1. With uploads it also deletes every uploaded file.
+// Removals reach the backend and replicas like any other, but publish no
+// events, so webhooks and rules don't fire. Requests made during a reset
+// may see some todos gone and others not. If the ID counter of the backend
+// can't be reset, the rest of the reset still happens and the error is
+// returned.
+func resetStore(actor string, uploads bool) (resetResult, error) {
+	var result resetResult
+	for _, id := range store.ids() {
+		if _, ok, err := store.remove(actor, id); ok && err == nil {
+			result.Todos++
+		}
+	}
+	store.nextID.Store(1)
+	store.lastPosition.Store(0)
+	store.uuidsMu.Lock()
+	store.uuids = make(map[string]int)
+	store.uuidsMu.Unlock()
+	var backendErr error
+	if r, ok := store.backend.(idResetter); ok {
+		if backendErr = r.resetIDs(); backendErr != nil {
+			backendFailed("resetting the ID counter", backendErr)
+		}
+	}
+
+	// Without history the removed todos are unknown rather than gone, and
+	// can't be restored.
+	activity.mu.Lock()
+	activity.entries = nil
+	activity.byTodo = make(map[int][]int)
+	activity.mu.Unlock()
+
+	result.Comments = defaultNamespace.comments.reset()
+
+	idempotencyMu.Lock()
+	idempotencyResponses = make(map[string]*idempotentResponse)
+	idempotencyMu.Unlock()
+	todosChanged()
+
+	if uploads {
+		entries, err := os.ReadDir("uploads")
+		if err != nil {
+			return result, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if err := os.Remove(filepath.Join("uploads", entry.Name())); err != nil {
+				return result, err
+			}
+			result.Uploads++
+		}
+	}
+	return result, backendErr
+}
+
+// postReset handles POST /admin/reset, see resetStore. ?uploads=true also
+// deletes the uploaded files. It is disabled unless the server was started
+// with -enable-reset.
+func postReset(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	if !resetEnabled {
+		ctx.Error("Reset is disabled, start the server with -enable-reset to enable it", fasthttp.StatusForbidden)
+		return
+	}
+	result, err := resetStore(actorOf(ctx), ctx.QueryArgs().GetBool("uploads"))
+	if err != nil {
+		ctx.Error("Error resetting the store: "+err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, result)
+}
@@ -0,0 +1,140 @@
+package todo
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// role is what the holder of an API key may do across the whole API,
+// independent of the projects it may see. Higher roles include the lower
+// ones.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer may read, but not change anything.
+	roleViewer
+	// roleEditor may also create, change and delete todos.
+	roleEditor
+	// roleAdmin may also configure the server: webhooks, rules,
+	// escalations, imports and the admin endpoints.
+	roleAdmin
+)
+
+// roles maps role names to roles.
+var roles = map[string]role{
+	"viewer": roleViewer,
+	"editor": roleEditor,
+	"admin":  roleAdmin,
+}
+
+func (r role) String() string {
+	for name, known := range roles {
+		if r == known {
+			return name
+		}
+	}
+	return "none"
+}
+
+// defaultRole is the role of API keys that don't name one.
+const defaultRole = roleEditor
+
+// routePermission requires a role for requests matching a method and a
+// route as returned by routePattern. Method "*" matches every method, and
+// a pattern ending in "*" every route starting with the rest.
+type routePermission struct {
+	method  string
+	pattern string
+	role    role
+}
+
+// routePermissions lists the role each route requires when access control
+// is enabled; the first matching entry applies. Routes without an entry
+// require roleViewer to read and roleEditor to write.
+var routePermissions = []routePermission{
+	// Public routes. Logging in needs no key yet, and most admin endpoints
+	// check the admin token or role themselves, see requireAdmin.
+	{"*", "/version", roleNone},
+	{"*", "/health", roleNone},
+	{"*", "/metrics", roleNone},
+	{"*", wellKnownPath, roleNone},
+	{"*", "/auth/*", roleNone},
+	// Feeds check the token in their URL, see feedPrincipal.
+	{"GET", calendarPath, roleNone},
+	{"GET", atomPath, roleNone},
+	{"*", "/admin/gc", roleAdmin},
+	{"*", "/admin/jobs", roleAdmin},
+	{"*", "/admin/*", roleNone},
+	{"*", "/debug/*", roleNone},
+	// The server-rendered UI sends browsers without a key to its login
+	// page and checks the role of the rest itself, see routeUI.
+	{"*", "/ui/*", roleNone},
+	// tus clients discover the server's capabilities before uploading.
+	{"OPTIONS", "/uploads", roleNone},
+
+	// Server configuration.
+	{"*", "/webhooks*", roleAdmin},
+	{"GET", "/rules*", roleViewer},
+	{"*", "/rules*", roleAdmin},
+	{"GET", "/escalations*", roleViewer},
+	{"*", "/escalations*", roleAdmin},
+	{"*", "/import", roleAdmin},
+
+	// Every user may change their own settings.
+	{"*", "/me/*", roleViewer},
+
+	// Reads sent as POST.
+	{"POST", "/todos/export", roleViewer},
+	// MCP tools check the role of the caller themselves.
+	{"POST", "/mcp/messages", roleViewer},
+}
+
+// requiredRole returns the role needed for a request.
+func requiredRole(method, path string) role {
+	route := routePattern(path)
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, p := range routePermissions {
+		if p.method != "*" && p.method != method {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(p.pattern, "*"); ok && strings.HasPrefix(route, prefix) || route == p.pattern {
+			return p.role
+		}
+	}
+	if method == "GET" {
+		return roleViewer
+	}
+	return roleEditor
+}
+
+// roleHandler wraps h, enforcing routePermissions when access control is
+// enabled. Requests without a valid key for routes that need a role get
+// 401 Unauthorized, callers whose role is too low 403 Forbidden.
+func roleHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if len(apiKeys) == 0 {
+			h(ctx)
+			return
+		}
+		need := requiredRole(string(ctx.Method()), string(ctx.Path()))
+		if need == roleNone {
+			h(ctx)
+			return
+		}
+		caller, ok := authenticate(ctx)
+		if !ok {
+			ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+			return
+		}
+		if caller.role < need {
+			writeRequestError(ctx, fasthttp.StatusForbidden, "Forbidden",
+				"this request needs the "+need.String()+" role, the key has the "+caller.role.String()+" role")
+			return
+		}
+		h(ctx)
+	}
+}
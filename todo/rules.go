@@ -0,0 +1,347 @@
+package todo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Rule is a user-defined automation: when Trigger fires for a todo matching
+// all Conditions, the Actions are applied to it.
+type Rule struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Trigger is "created", "updated" or "due".
+	Trigger    string          `json:"trigger"`
+	Conditions []RuleCondition `json:"conditions,omitempty"`
+	Actions    []RuleAction    `json:"actions"`
+	Enabled    bool            `json:"enabled"`
+}
+
+// RuleCondition compares a todo field with a value. Field is one of title,
+// description, priority, project, assignee, tag or completed; Op is "eq",
+// "ne" or "contains". For the tag field, "eq" and "contains" test whether
+// the todo has the tag and "ne" whether it doesn't.
+type RuleCondition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// RuleAction changes a todo or notifies about it. Type is "set_tag" (adds
+// the tag Value), "assign" (sets the assignee), "move_project" (sets the
+// project) or "notify" (emits a rule.notify event carrying Value as message,
+// and posts it to Sink if set, see -notify-sinks).
+type RuleAction struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Sink  string `json:"sink,omitempty"`
+}
+
+var ruleTriggers = map[string]string{
+	"todo.created": "created",
+	"todo.updated": "updated",
+	"todo.due":     "due",
+}
+
+var (
+	rules      = make(map[int]*Rule)
+	nextRuleID = 1
+	rulesMu    sync.RWMutex
+)
+
+func (r *Rule) validate() error {
+	switch r.Trigger {
+	case "created", "updated", "due":
+	default:
+		return fmt.Errorf("invalid trigger %q", r.Trigger)
+	}
+	for i, c := range r.Conditions {
+		switch c.Field {
+		case "title", "description", "priority", "project", "assignee", "tag":
+		case "completed":
+			if _, err := strconv.ParseBool(c.Value); err != nil {
+				return fmt.Errorf("condition %d: completed must be compared with true or false", i)
+			}
+		default:
+			return fmt.Errorf("condition %d: invalid field %q", i, c.Field)
+		}
+		switch c.Op {
+		case "eq", "ne", "contains":
+		default:
+			return fmt.Errorf("condition %d: invalid op %q", i, c.Op)
+		}
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("a rule needs at least one action")
+	}
+	for i, a := range r.Actions {
+		switch a.Type {
+		case "set_tag", "notify":
+			if a.Value == "" {
+				return fmt.Errorf("action %d: %s needs a value", i, a.Type)
+			}
+		case "assign", "move_project":
+		default:
+			return fmt.Errorf("action %d: invalid type %q", i, a.Type)
+		}
+		if a.Sink != "" {
+			if a.Type != "notify" {
+				return fmt.Errorf("action %d: only notify actions have a sink", i)
+			}
+			if _, ok := notifySinks[a.Sink]; !ok {
+				return fmt.Errorf("action %d: unknown sink %q", i, a.Sink)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether todo satisfies every condition of the rule.
+func (r *Rule) matches(todo *Todo) bool {
+	for _, c := range r.Conditions {
+		if !c.matches(todo) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c RuleCondition) matches(todo *Todo) bool {
+	var value string
+	switch c.Field {
+	case "tag":
+		has := containsString(todo.Tags, c.Value)
+		if c.Op == "ne" {
+			return !has
+		}
+		return has
+	case "completed":
+		want, _ := strconv.ParseBool(c.Value)
+		if c.Op == "ne" {
+			return todo.Completed != want
+		}
+		return todo.Completed == want
+	case "title":
+		value = todo.Title
+	case "description":
+		value = todo.Description
+	case "priority":
+		value = todo.Priority
+	case "project":
+		value = todo.Project
+	case "assignee":
+		value = todo.Assignee
+	}
+	switch c.Op {
+	case "eq":
+		return value == c.Value
+	case "ne":
+		return value != c.Value
+	default:
+		return strings.Contains(strings.ToLower(value), strings.ToLower(c.Value))
+	}
+}
+
+// runRules is subscribed to the event bus and applies the enabled rules
+// whose trigger matches e. Changes made by rules don't publish todo.updated
+// events, so rules cannot trigger each other in a loop. Rules only apply to
+// the todos of the default namespace.
+func runRules(e Event) {
+	trigger, ok := ruleTriggers[e.Type]
+	if !ok || e.namespace() != defaultNamespace {
+		return
+	}
+
+	rulesMu.RLock()
+	var matching []Rule
+	for _, rule := range rules {
+		if rule.Enabled && rule.Trigger == trigger {
+			matching = append(matching, *rule)
+		}
+	}
+	rulesMu.RUnlock()
+	if len(matching) == 0 {
+		return
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+
+	var notifications []Event
+	changed := false
+	_, _, _ = store.update("rules", e.TodoID, func(todo *Todo) error {
+		for _, rule := range matching {
+			if !rule.matches(todo) {
+				continue
+			}
+			for _, action := range rule.Actions {
+				switch action.Type {
+				case "set_tag":
+					if !containsString(todo.Tags, action.Value) {
+						todo.Tags = append(todo.Tags, action.Value)
+						changed = true
+					}
+				case "assign":
+					changed = changed || todo.Assignee != action.Value
+					todo.Assignee = action.Value
+				case "move_project":
+					changed = changed || todo.Project != action.Value
+					todo.Project = action.Value
+				case "notify":
+					notifications = append(notifications, Event{
+						Type:   "rule.notify",
+						TodoID: todo.ID,
+						Data: map[string]interface{}{
+							"rule":    rule.ID,
+							"trigger": trigger,
+							"message": action.Value,
+							"title":   todo.Title,
+							"sink":    action.Sink,
+						},
+					})
+				}
+			}
+		}
+		if changed {
+			todo.UpdatedAt = time.Now()
+		}
+		return nil
+	})
+	if changed {
+		todosChanged()
+	}
+	for _, n := range notifications {
+		publish(n)
+	}
+}
+
+// dueFired remembers, per todo, the due date a todo.due event was published
+// for, so each due date fires once.
+var (
+	dueFired   = make(map[int]time.Time)
+	dueFiredMu sync.Mutex
+)
+
+// publishDueEvents is a scheduled task publishing a todo.due event for open
+// todos whose due date has passed.
+func publishDueEvents(ctx context.Context, p *jobProgress) (interface{}, error) {
+	now := time.Now()
+	var due []Event
+
+	dueFiredMu.Lock()
+	store.each(func(todo *Todo) bool {
+		if todo.DueAt == nil || todo.Completed || todo.DueAt.After(now) {
+			return true
+		}
+		if fired, ok := dueFired[todo.ID]; ok && fired.Equal(*todo.DueAt) {
+			return true
+		}
+		dueFired[todo.ID] = *todo.DueAt
+		due = append(due, Event{Type: "todo.due", TodoID: todo.ID, Data: map[string]interface{}{"due_at": *todo.DueAt}})
+		return true
+	})
+	dueFiredMu.Unlock()
+
+	p.setTotal(len(due))
+	for _, e := range due {
+		publish(e)
+		p.advance(1)
+	}
+	return map[string]int{"due": len(due)}, nil
+}
+
+// getRules handles GET /rules.
+func getRules(ctx *fasthttp.RequestCtx) {
+	rulesMu.RLock()
+	list := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		list = append(list, *rule)
+	}
+	rulesMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// getRule handles GET /rules/{id}.
+func getRule(ctx *fasthttp.RequestCtx, id int) {
+	rulesMu.RLock()
+	rule, ok := rules[id]
+	var snapshot Rule
+	if ok {
+		snapshot = *rule
+	}
+	rulesMu.RUnlock()
+
+	if !ok {
+		ctx.Error("Rule not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// decodeRule parses and validates the JSON rule in the request body. Rules
+// are enabled unless the body says otherwise.
+func decodeRule(ctx *fasthttp.RequestCtx) (*Rule, bool) {
+	rule := &Rule{Enabled: true}
+	if !decodeJSONBody(ctx, rule) {
+		return nil, false
+	}
+	if err := rule.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return nil, false
+	}
+	return rule, true
+}
+
+// createRule handles POST /rules.
+func createRule(ctx *fasthttp.RequestCtx) {
+	rule, ok := decodeRule(ctx)
+	if !ok {
+		return
+	}
+
+	rulesMu.Lock()
+	rule.ID = nextRuleID
+	nextRuleID++
+	rules[rule.ID] = rule
+	snapshot := *rule
+	rulesMu.Unlock()
+
+	writeJSON(ctx, fasthttp.StatusCreated, snapshot)
+}
+
+// updateRule handles PUT /rules/{id} and replaces the rule.
+func updateRule(ctx *fasthttp.RequestCtx, id int) {
+	rule, ok := decodeRule(ctx)
+	if !ok {
+		return
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if _, ok := rules[id]; !ok {
+		ctx.Error("Rule not found", fasthttp.StatusNotFound)
+		return
+	}
+	rule.ID = id
+	rules[id] = rule
+	writeJSON(ctx, fasthttp.StatusOK, *rule)
+}
+
+// deleteRule handles DELETE /rules/{id}.
+func deleteRule(ctx *fasthttp.RequestCtx, id int) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if _, ok := rules[id]; !ok {
+		ctx.Error("Rule not found", fasthttp.StatusNotFound)
+		return
+	}
+	delete(rules, id)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
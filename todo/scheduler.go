@@ -0,0 +1,126 @@
+package todo
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// scheduledTask is a maintenance job started periodically according to a
+// cron expression.
+type scheduledTask struct {
+	Name     string     `json:"name"`
+	Kind     string     `json:"kind"`
+	Schedule string     `json:"schedule"`
+	NextRun  time.Time  `json:"next_run"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+	// LastJob is the ID of the job started by the last run. Its outcome is
+	// reported as LastStatus and LastError.
+	LastJob    int    `json:"last_job,omitempty"`
+	LastStatus string `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+	// Skipped counts runs left out because the previous one was still going.
+	Skipped int `json:"skipped"`
+
+	cron *cronSchedule
+	run  jobFunc
+}
+
+var (
+	scheduledTasks   []*scheduledTask
+	scheduledTasksMu sync.Mutex
+)
+
+// scheduleTask registers fn to be started as a job of the given kind
+// whenever the cron expression spec fires. An empty spec disables the task.
+func scheduleTask(name, kind, spec string, fn jobFunc) error {
+	if spec == "" {
+		return nil
+	}
+	cron, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+	scheduledTasksMu.Lock()
+	scheduledTasks = append(scheduledTasks, &scheduledTask{
+		Name:     name,
+		Kind:     kind,
+		Schedule: spec,
+		NextRun:  cron.next(time.Now()),
+		cron:     cron,
+		run:      fn,
+	})
+	scheduledTasksMu.Unlock()
+	return nil
+}
+
+// runScheduler starts due tasks every time the minute changes until ctx is
+// done.
+func runScheduler(ctx context.Context) {
+	for {
+		now := time.Now()
+		if !sleepCtx(ctx, now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+			return
+		}
+		runDueTasks(time.Now())
+	}
+}
+
+func runDueTasks(now time.Time) {
+	scheduledTasksMu.Lock()
+	defer scheduledTasksMu.Unlock()
+	for _, task := range scheduledTasks {
+		if now.Before(task.NextRun) {
+			continue
+		}
+		task.NextRun = task.cron.next(now)
+		if task.LastJob != 0 && jobState(task.LastJob) == jobRunning {
+			task.Skipped++
+			log.Printf("scheduler: skipping %s, previous run (job %d) still running", task.Name, task.LastJob)
+			continue
+		}
+		job := startJob(task.Kind, "", task.run)
+		task.LastRun = &now
+		task.LastJob = job.ID
+	}
+}
+
+// jobState returns the state of the job with the given ID.
+func jobState(id int) string {
+	jobsMu.RLock()
+	defer jobsMu.RUnlock()
+	if job, ok := jobs[id]; ok {
+		return job.State
+	}
+	return ""
+}
+
+// getScheduledTasks handles GET /admin/jobs and lists the maintenance tasks
+// with their schedule and the outcome of their last run.
+func getScheduledTasks(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	scheduledTasksMu.Lock()
+	list := make([]scheduledTask, 0, len(scheduledTasks))
+	for _, task := range scheduledTasks {
+		list = append(list, *task)
+	}
+	scheduledTasksMu.Unlock()
+
+	jobsMu.RLock()
+	for i := range list {
+		if job, ok := jobs[list[i].LastJob]; ok {
+			list[i].LastStatus = job.State
+			list[i].LastError = job.Error
+		}
+	}
+	jobsMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
@@ -0,0 +1,98 @@
+package todo
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultSearchLimit caps the number of search results unless ?limit= asks
+// for a different number.
+const defaultSearchLimit = 50
+
+// searchTodos handles GET /search?q=. It searches the todos of all projects
+// for the whitespace-separated terms of q, case-insensitively, in the title,
+// description, project, tags and subtask titles; a todo must contain every
+// term. ?project= restricts the search to one project. Results only include
+// todos the caller may see, including those shared with it, and are ordered
+// by ID.
+func searchTodos(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	args := ctx.QueryArgs()
+	terms := strings.Fields(strings.ToLower(string(args.Peek("q"))))
+	if len(terms) == 0 {
+		ctx.Error("Missing search query", fasthttp.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if args.Has("limit") {
+		n, err := strconv.Atoi(string(args.Peek("limit")))
+		if err != nil || n <= 0 {
+			ctx.Error("Invalid limit", fasthttp.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	project, hasProject := string(args.Peek("project")), args.Has("project")
+
+	type hit struct {
+		id  int
+		raw []byte
+	}
+	var hits []hit
+	ns := namespaceOf(ctx)
+	done := traceOp(ctx, "store.scan")
+	ns.store.each(func(todo *Todo) bool {
+		if ns.permission(caller, todo) == permNone || (hasProject && todo.Project != project) {
+			return true
+		}
+		if matchesTerms(todo, terms) {
+			hits = append(hits, hit{todo.ID, todo.raw})
+		}
+		return true
+	})
+	done()
+	sort.Slice(hits, func(i, j int) bool { return hits[i].id < hits[j].id })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	raws := make([][]byte, len(hits))
+	for i, h := range hits {
+		raws[i] = h.raw
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, joinJSON(raws))
+}
+
+// matchesTerms reports whether every term occurs in one of the searchable
+// fields of todo. Terms must be lower case.
+func matchesTerms(todo *Todo, terms []string) bool {
+	fields := []string{todo.Title, todo.Description, todo.Project}
+	fields = append(fields, todo.Tags...)
+	for _, st := range todo.Subtasks {
+		fields = append(fields, st.Title)
+	}
+	for i, f := range fields {
+		fields[i] = strings.ToLower(f)
+	}
+
+	for _, term := range terms {
+		found := false
+		for _, f := range fields {
+			if strings.Contains(f, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
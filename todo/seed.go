@@ -0,0 +1,144 @@
+package todo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// seedActor names the changes made by seeding at startup in the activity
+// log.
+const seedActor = "seed"
+
+// seedResult summarizes a seed.
+type seedResult struct {
+	Removed int `json:"removed"`
+	Seeded  int `json:"seeded"`
+}
+
+// parseFixtures decodes fixtures: a JSON array of todos in the format of
+// GET /todos. It reports every invalid todo, by its index, like
+// parseSubtasks.
+func parseFixtures(data []byte) ([]Todo, []fieldError) {
+	var fixtures []Todo
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, []fieldError{{Field: "todos", Message: "must be a JSON array of todos: " + err.Error()}}
+	}
+	var errs []fieldError
+	ids := make(map[int]int)
+	for i := range fixtures {
+		todo := &fixtures[i]
+		prefix := fmt.Sprintf("todos[%d].", i)
+		for _, fe := range validateTodo(todo) {
+			errs = append(errs, fieldError{Field: prefix + fe.Field, Message: fe.Message})
+		}
+		if todo.Status != "" && !validStatus(todo.Status) {
+			errs = append(errs, fieldError{Field: prefix + "status", Message: "must be one of backlog, in_progress, blocked, done"})
+		}
+		if todo.ID < 0 {
+			errs = append(errs, fieldError{Field: prefix + "id", Message: "must be positive"})
+		} else if j, ok := ids[todo.ID]; ok && todo.ID > 0 {
+			errs = append(errs, fieldError{Field: prefix + "id", Message: fmt.Sprintf("is also the ID of todos[%d]", j)})
+		}
+		ids[todo.ID] = i
+		if todo.UUID != "" && !isUUID(todo.UUID) {
+			errs = append(errs, fieldError{Field: prefix + "uuid", Message: "must be a UUID"})
+		}
+		trackSubtaskIDs(todo)
+		if err := assignSubtaskIDs(todo, todo.Subtasks); err != nil {
+			errs = append(errs, fieldError{Field: prefix + "subtasks", Message: err.Error()})
+		}
+	}
+	return fixtures, errs
+}
+
+// seedTodos adds fixtures to the default namespace, removing all todos
+// first with wipe. Fixtures keep their IDs, replacing the todos with the
+// same ID; the others get new IDs in order, so seeding an empty store
+// always gives the same todos. Missing timestamps are set to now. It
+// returns a quotaError, before removing anything, if the new todos would
+// take the actor's tenant beyond its quota, and stops at the first
+// storeError.
+func seedTodos(actor string, fixtures []Todo, wipe bool) (seedResult, error) {
+	var result seedResult
+	if max, _ := defaultNamespace.todoQuota(actor); wipe && max > 0 && len(fixtures) > max {
+		return result, &quotaError{max: max}
+	}
+	if wipe {
+		for _, id := range store.ids() {
+			removed, err := removeTodo(actor, id)
+			if err != nil {
+				return result, err
+			}
+			if removed {
+				result.Removed++
+			}
+		}
+	}
+	now := time.Now()
+	err := defaultNamespace.withinQuota(actor, newTodos(store, fixtures), func() error {
+		for i := range fixtures {
+			todo := fixtures[i].clone()
+			if todo.CreatedAt.IsZero() {
+				todo.CreatedAt = now
+			}
+			if todo.UpdatedAt.IsZero() {
+				todo.UpdatedAt = todo.CreatedAt
+			}
+			if err := store.put(actor, &todo); err != nil {
+				return err
+			}
+			result.Seeded++
+		}
+		return nil
+	})
+	todosChanged()
+	return result, err
+}
+
+// newTodos returns how many of todos putting them into s would add rather
+// than replace.
+func newTodos(s *todoStore, todos []Todo) int {
+	n := 0
+	for i := range todos {
+		if id := todos[i].ID; id <= 0 || !s.exists(id) {
+			n++
+		}
+	}
+	return n
+}
+
+// loadSeed seeds the todos of the fixtures file at path at startup.
+func loadSeed(path string, wipe bool) (seedResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return seedResult{}, err
+	}
+	fixtures, errs := parseFixtures(data)
+	if len(errs) > 0 {
+		return seedResult{}, fmt.Errorf("%s: %s %s", path, errs[0].Field, errs[0].Message)
+	}
+	return seedTodos(seedActor, fixtures, wipe)
+}
+
+// postSeed handles POST /admin/seed. The body holds fixtures, see
+// parseFixtures; ?wipe=true removes all todos first.
+func postSeed(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	fixtures, errs := parseFixtures(ctx.PostBody())
+	if len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid fixtures", errs)
+		return
+	}
+	result, err := seedTodos(actorOf(ctx), fixtures, ctx.QueryArgs().GetBool("wipe"))
+	if err != nil {
+		writeStoreError(ctx, err)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, result)
+}
@@ -0,0 +1,527 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newServer returns the HTTP server for handler with the limits of cfg.
+func newServer(cfg Config, handler fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:            handler,
+		HeaderReceived:     streamConfig(cfg),
+		ErrorHandler:       serverErrorHandler(cfg),
+		MaxRequestBodySize: cfg.MaxBodySize,
+		ReadTimeout:        cfg.ReadTimeout,
+		WriteTimeout:       cfg.WriteTimeout,
+		IdleTimeout:        cfg.IdleTimeout,
+		Concurrency:        cfg.Concurrency,
+	}
+}
+
+// streamPaths are the routes whose responses stream for as long as the
+// client stays, see Config.StreamTimeout.
+var streamPaths = []string{"/events", "/mcp/sse", "/admin/replication/feed"}
+
+// streamConfig returns the HeaderReceived hook of the HTTP server, giving
+// streaming responses StreamTimeout to be written instead of WriteTimeout.
+// fasthttp sets the write deadline once before writing a response, so the
+// stream writers need not, and must not, touch the connection themselves.
+func streamConfig(cfg Config) func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	return func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+		path := string(header.RequestURI())
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		if containsString(streamPaths, strings.TrimPrefix(path, apiPrefix)) {
+			return fasthttp.RequestConfig{WriteTimeout: cfg.StreamTimeout}
+		}
+		return fasthttp.RequestConfig{}
+	}
+}
+
+// serverErrorHandler responds to requests fasthttp couldn't read with the
+// JSON errors of the API rather than its plain text ones.
+func serverErrorHandler(cfg Config) func(ctx *fasthttp.RequestCtx, err error) {
+	return func(ctx *fasthttp.RequestCtx, err error) {
+		var smallBuffer *fasthttp.ErrSmallBuffer
+		var netErr net.Error
+		switch {
+		case errors.Is(err, fasthttp.ErrBodyTooLarge):
+			writeRequestError(ctx, fasthttp.StatusRequestEntityTooLarge, "Request body too large",
+				"the body must not exceed "+strconv.Itoa(cfg.MaxBodySize)+" bytes")
+		case errors.As(err, &smallBuffer):
+			writeRequestError(ctx, fasthttp.StatusRequestHeaderFieldsTooLarge, "Request headers too large",
+				"send fewer or shorter headers")
+		case errors.As(err, &netErr) && netErr.Timeout():
+			writeRequestError(ctx, fasthttp.StatusRequestTimeout, "Request timeout",
+				"the request must be sent within "+cfg.ReadTimeout.String())
+		default:
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Malformed request",
+				"the request could not be parsed as HTTP/1.1")
+		}
+	}
+}
+
+// Server is the todo API: the HTTP handlers, the optional HTTP/2 and gRPC
+// listeners and the background components, such as the scheduler and
+// webhook deliveries.
+//
+// Known limitation: the todos and other state still live in package
+// variables, so a process can only create one Server.
+type Server struct {
+	cfg     Config
+	handler fasthttp.RequestHandler
+	server  *fasthttp.Server
+	// stdioDone is closed when the MCP client on stdin goes away.
+	stdioDone chan struct{}
+	// errs receives the errors of the HTTP/2 and gRPC listeners.
+	errs chan error
+}
+
+// created is set once NewServer accepted a configuration.
+var created atomic.Bool
+
+// NewServer sets up the API with the settings of cfg, see LoadConfig and
+// DefaultConfig, and starts its background components. Requests are served
+// by ListenAndServe, Serve or, when another program embeds the API in its
+// own fasthttp server, by Handler. An invalid cfg is rejected before
+// anything is set up, so NewServer can be called again with a fixed one.
+// So can it when the store can't be opened, loaded or seeded: what was set
+// up by then is undone, see abandonSetup.
+func NewServer(cfg Config) (*Server, error) {
+	if created.Load() {
+		return nil, errors.New("a Server was already created in this process")
+	}
+
+	keys, err := parseAPIKeys(cfg.APIKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API keys: %w", err)
+	}
+	transitions, err := parseStatusTransitions(cfg.StatusTransitions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status transitions: %w", err)
+	}
+	levels, err := parseRuleLevels(cfg.ValidationRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validation rules: %w", err)
+	}
+	weights, err := parseNextWeights(cfg.NextWeights)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next weights: %w", err)
+	}
+	budgets, err := parseLatencyBudgets(cfg.LatencyBudgets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latency budgets: %w", err)
+	}
+	clients, err := parseOAuthClients(cfg.OIDCProviders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid login providers: %w", err)
+	}
+	users, err := parseIdentityUsers(cfg.OIDCUsers, clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid login identities: %w", err)
+	}
+	notifiers, err := buildNotifiers(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification channels: %w", err)
+	}
+	sinks, err := parseNotifySinks(cfg.NotifySinks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification sinks: %w", err)
+	}
+	if cfg.CompletionMode != "derived" && cfg.CompletionMode != "manual" {
+		return nil, fmt.Errorf("invalid completion mode %q, expected derived or manual", cfg.CompletionMode)
+	}
+	if cfg.WebUI != "spa" && cfg.WebUI != "htmx" && cfg.WebUI != "off" {
+		return nil, fmt.Errorf("invalid web UI %q, expected spa, htmx or off", cfg.WebUI)
+	}
+	if cfg.ExpiryAction != "delete" && cfg.ExpiryAction != "archive" {
+		return nil, fmt.Errorf("invalid expiry action %q, expected delete or archive", cfg.ExpiryAction)
+	}
+	if cfg.IDFormat != "int" && cfg.IDFormat != "snowflake" && cfg.IDFormat != "uuid" {
+		return nil, fmt.Errorf("invalid ID format %q, expected int, snowflake or uuid", cfg.IDFormat)
+	}
+	if cfg.ImageQuality < 1 || cfg.ImageQuality > 100 {
+		return nil, fmt.Errorf("invalid image quality %d, expected 1 to 100", cfg.ImageQuality)
+	}
+	if cfg.IDNode < 0 || cfg.IDNode > maxSnowflakeNode {
+		return nil, fmt.Errorf("invalid ID node %d, expected 0 to %d", cfg.IDNode, maxSnowflakeNode)
+	}
+	if (cfg.HTTP2Cert == "") != (cfg.HTTP2Key == "") {
+		return nil, errors.New("invalid HTTP/2 TLS configuration: -http2-cert and -http2-key must be set together")
+	}
+	var exporter *otlpExporter
+	if cfg.OTLPEndpoint != "" {
+		if exporter, err = newOTLPExporter(cfg.OTLPEndpoint, cfg.OTLPHeaders, cfg.ServiceName, cfg.TraceSampleRatio); err != nil {
+			return nil, fmt.Errorf("invalid OpenTelemetry configuration: %w", err)
+		}
+	}
+	var primary string
+	if cfg.ReplicaOf != "" {
+		if primary, err = parsePrimaryURL(cfg.ReplicaOf); err != nil {
+			return nil, fmt.Errorf("invalid primary: %w", err)
+		}
+		if cfg.Store != "memory" {
+			return nil, errors.New("-replica-of requires the memory store")
+		}
+		if cfg.AdminToken == "" {
+			return nil, errors.New("-replica-of requires the admin token of the primary in -admin-token")
+		}
+		if cfg.Seed != "" {
+			return nil, errors.New("-seed can't be used with -replica-of, seed the primary instead")
+		}
+	}
+	var clusterSelf string
+	var clusterPeers []string
+	if cfg.ClusterURL != "" || cfg.ClusterPeers != "" {
+		if clusterSelf, clusterPeers, err = parseClusterPeers(cfg.ClusterURL, cfg.ClusterPeers); err != nil {
+			return nil, err
+		}
+		if cfg.ReplicaOf != "" {
+			return nil, errors.New("-replica-of can't be used with -cluster-peers, the cluster elects its leader")
+		}
+		if cfg.Store != "memory" {
+			return nil, errors.New("-cluster-peers requires the memory store")
+		}
+		if cfg.AdminToken == "" {
+			return nil, errors.New("-cluster-peers requires the admin token the nodes share in -admin-token")
+		}
+		if cfg.Seed != "" {
+			return nil, errors.New("-seed can't be used with -cluster-peers, seed the leader instead")
+		}
+	}
+	switch cfg.Store {
+	case "memory", "redis", "sqlite", "postgres":
+	default:
+		return nil, fmt.Errorf("invalid store %q, expected memory, redis, sqlite or postgres", cfg.Store)
+	}
+	if cfg.WriteBehind && cfg.Store == "memory" {
+		return nil, fmt.Errorf("-write-behind requires a redis, sqlite or postgres store")
+	}
+	archiveSchedule := cfg.ArchiveSchedule
+	if cfg.ArchiveAfter <= 0 {
+		archiveSchedule = ""
+	}
+	tasks := []struct {
+		name, kind, spec string
+		fn               jobFunc
+	}{
+		{"backup", "backup", cfg.BackupSchedule, backupTask(cfg.BackupKeep)},
+		{"uploads-gc", "gc", cfg.GCSchedule, sweepUploads},
+		{"escalations", "escalation", cfg.EscalationSchedule, primaryOnly(evaluateEscalations)},
+		{"due-dates", "due", cfg.DueSchedule, primaryOnly(publishDueEvents)},
+		{"retention", "retention", cfg.RetentionSchedule, primaryOnly(retentionJob(false))},
+		{"archive", "archive", archiveSchedule, primaryOnly(archiveCompleted)},
+		{"digests", "digest", cfg.DigestSchedule, primaryOnly(sendDigests)},
+	}
+	for _, t := range tasks {
+		if t.spec == "" {
+			continue
+		}
+		if _, err := parseCron(t.spec); err != nil {
+			return nil, fmt.Errorf("invalid %s schedule: %w", t.name, err)
+		}
+	}
+
+	// The backend is opened before anything is set up, so a database that
+	// can't be reached doesn't keep NewServer from being called again.
+	var backend todoBackend
+	var closeBackend func()
+	switch cfg.Store {
+	case "memory":
+	case "redis":
+		r, err := newRedisStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backend, closeBackend = r, r.pool.drain
+	case "sqlite", "postgres":
+		dialect := sqliteDialect
+		if cfg.Store == "postgres" {
+			dialect = postgresDialect
+		}
+		db, err := openSQLStore(dialect, cfg.DB, cfg.DBMaxConns, cfg.DBPollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("opening the %s database: %w", cfg.Store, err)
+		}
+		backend, closeBackend = db, db.close
+	}
+
+	// The configuration is valid; from here on the package state is set
+	// up, which can only be done once.
+	if !created.CompareAndSwap(false, true) {
+		if closeBackend != nil {
+			closeBackend()
+		}
+		return nil, errors.New("a Server was already created in this process")
+	}
+	apiKeys = keys
+	notifySinks = sinks
+	digestMailer = nil
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom != "" {
+		digestMailer = func(to string, n notification) error {
+			return emailNotifier{
+				addr:     cfg.SMTPAddr,
+				from:     cfg.SMTPFrom,
+				to:       []string{to},
+				username: cfg.SMTPUsername,
+				password: cfg.SMTPPassword,
+			}.notify(n)
+		}
+	}
+	undoDepth = cfg.UndoDepth
+	strictJSON = cfg.StrictJSON
+	statusTransitions = transitions
+	completionMode = cfg.CompletionMode
+	ruleLevels = levels
+	nextScoring = weights
+	slowThreshold = cfg.SlowThreshold
+	latencyBudgets = budgets
+	resetEnabled = cfg.EnableReset
+	archiveAfter = cfg.ArchiveAfter
+	idFormat = cfg.IDFormat
+	snowflakes.node = int64(cfg.IDNode)
+	store.idGen = newIDGenerator(store)
+	spanExporter = exporter
+	adminToken = cfg.AdminToken
+	uiMode = cfg.WebUI
+	htmxURL = cfg.HTMXURL
+	maxUploadSize = cfg.MaxUploadSize
+	uploadExpiry = cfg.UploadExpiry
+	stripImageMetadata = cfg.StripImageMetadata
+	autoOrientImages = cfg.AutoOrientImages
+	imageQuality = cfg.ImageQuality
+	jwtSecret = []byte(cfg.JWTSecret)
+	if len(jwtSecret) == 0 {
+		jwtSecret = []byte(randomToken(32))
+	}
+	accessTokenTTL = cfg.AccessTokenTTL
+	refreshTokenTTL = cfg.RefreshTokenTTL
+	oauthClients = clients
+	identityUsers = users
+	publicURL = cfg.PublicURL
+	tenantDomain = strings.ToLower(cfg.TenantDomain)
+	features = enabledFeatures(cfg)
+	capabilities = buildCapabilities(cfg)
+	idempotencyWindow = cfg.IdempotencyWindow
+	todoRules = todoPolicy{
+		maxTitle:       cfg.MaxTitle,
+		maxDescription: cfg.MaxDescription,
+	}
+	subtaskRules = subtaskPolicy{
+		maxCount:     cfg.MaxSubtasks,
+		maxTitle:     cfg.MaxSubtaskTitle,
+		uniqueTitles: cfg.UniqueSubtaskTitles,
+	}
+	runningConfig = cfg
+
+	storageBackend = cfg.Store
+	if cfg.WriteBehind {
+		w, err := newWriteBehind(backend, cfg.WriteBehindBatch, cfg.WriteBehindInterval, cfg.WriteBehindQueue)
+		if err != nil {
+			abandonSetup(cfg.ShutdownTimeout, closeBackend)
+			return nil, err
+		}
+		backend = w
+	}
+	if backend != nil {
+		if err := store.attach(backend); err != nil {
+			abandonSetup(cfg.ShutdownTimeout, closeBackend)
+			return nil, fmt.Errorf("loading todos from the %s store: %w", cfg.Store, err)
+		}
+	}
+	if cfg.Seed != "" {
+		result, err := loadSeed(cfg.Seed, cfg.SeedWipe)
+		if err != nil {
+			abandonSetup(cfg.ShutdownTimeout, closeBackend)
+			return nil, fmt.Errorf("seeding todos: %w", err)
+		}
+		log.Printf("Seeded %d todos from %s, removed %d", result.Seeded, cfg.Seed, result.Removed)
+	}
+
+	// Ensure the uploads, exports and backups directories exist.
+	os.MkdirAll("uploads", os.ModePerm)
+	os.MkdirAll("exports", os.ModePerm)
+	os.MkdirAll("backups", os.ModePerm)
+
+	for _, t := range tasks {
+		if err := scheduleTask(t.name, t.kind, t.spec, t.fn); err != nil {
+			return nil, fmt.Errorf("invalid %s schedule: %w", t.name, err)
+		}
+	}
+	background.spawn("scheduler", runScheduler)
+
+	subscribe(logEvent)
+	subscribe(runRules)
+	subscribe(queueRecurrence)
+	subscribe(dispatchWebhooks)
+	subscribe(deliverRuleNotifications)
+	subscribe(feedWatchers)
+	background.spawn("recurrence", runRecurrence)
+	background.spawn("reminders", func(ctx context.Context) {
+		runReminders(ctx, cfg.ReminderInterval, notifiers)
+	})
+	if cfg.TelegramToken != "" {
+		background.spawn("telegram", func(ctx context.Context) {
+			runTelegramBot(ctx, cfg.TelegramToken)
+		})
+	}
+	if cfg.ExpiryInterval > 0 {
+		background.spawn("expiry", func(ctx context.Context) {
+			runExpiry(ctx, cfg.ExpiryInterval, cfg.ExpiryAction == "archive")
+		})
+	}
+
+	background.spawn("uploads", runUploadExpiry)
+
+	if primary != "" {
+		startReplica(primary)
+	}
+	if clusterSelf != "" {
+		startCluster(clusterSelf, clusterPeers)
+	}
+	if exporter != nil {
+		background.spawn("otlp", exporter.run)
+	}
+
+	// The listeners besides the HTTP server report their errors to Serve,
+	// see Errors.
+	errs := make(chan error, 2)
+	if cfg.GRPCAddr != "" {
+		background.spawn("grpc", func(ctx context.Context) {
+			log.Printf("gRPC server started on %s", cfg.GRPCAddr)
+			if err := serveGRPC(ctx, cfg.GRPCAddr); err != nil {
+				errs <- fmt.Errorf("gRPC server: %w", err)
+			}
+		})
+	}
+
+	handler := cacheHandler(shapeHandler(requestHandler), cfg.CacheTTL)
+	handler = consistencyHandler(handler, cfg.ConsistencyWait)
+	handler = shareHandler(handler)
+	handler = tenantHandler(handler)
+	handler = uuidHandler(handler)
+	handler = namespaceHandler(handler)
+	handler = roleHandler(handler)
+	handler = markdownHandler(handler)
+	handler = dateFormatHandler(handler)
+	handler = envelopeHandler(handler)
+	handler = negotiateHandler(handler)
+	handler = compressHandler(handler, cfg.CompressMinSize, cfg.CompressLevel, cfg.BrotliLevel)
+	handler = traceHandler(handler)
+	handler = countRequests(handler)
+	handler = versionHandler(handler)
+	if cfg.WebUI != "off" {
+		handler = webHandler(handler)
+	}
+	handler = replicaHandler(handler)
+
+	if cfg.HTTP2Addr != "" {
+		background.spawn("http2", func(ctx context.Context) {
+			log.Printf("HTTP/2 server started on %s", cfg.HTTP2Addr)
+			if err := serveHTTP2(ctx, cfg, handler); err != nil {
+				errs <- fmt.Errorf("HTTP/2 server: %w", err)
+			}
+		})
+	}
+
+	srv := &Server{cfg: cfg, handler: handler, server: newServer(cfg, handler), errs: errs}
+	if cfg.MCPStdio {
+		srv.stdioDone = make(chan struct{})
+		background.spawn("mcp", func(ctx context.Context) {
+			log.Printf("MCP server started on stdio")
+			serveMCPStdio(ctx, os.Stdin, os.Stdout)
+			close(srv.stdioDone)
+		})
+	}
+	return srv, nil
+}
+
+// abandonSetup undoes the setup of NewServer when the store couldn't be
+// loaded or seeded: it stops the background work started so far, waiting
+// up to timeout, empties the store, closes the backend with closeBackend,
+// unless it is nil, and lets NewServer be called again.
+func abandonSetup(timeout time.Duration, closeBackend func()) {
+	if !background.shutdown(timeout) {
+		log.Printf("Background tasks still running after %s, abandoning them", timeout)
+	}
+	background = newLifecycle()
+	store.detach()
+	if closeBackend != nil {
+		closeBackend()
+	}
+	created.Store(false)
+}
+
+// StdioClosed returns a channel that is closed when stdin ends while the
+// server serves MCP on it, see Config.MCPStdio, so that the program can
+// shut down; otherwise it never is.
+func (s *Server) StdioClosed() <-chan struct{} {
+	return s.stdioDone
+}
+
+// Errors returns the channel receiving the errors of the HTTP/2 and gRPC
+// listeners, such as an address already in use, which stop serving on
+// them. ListenAndServe and Serve return them; programs mounting Handler in
+// their own server should watch it instead.
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Handler returns the handler serving the API, including all middleware,
+// to mount it in another fasthttp server. It expects the paths of the API,
+// such as /v1/todos; a router mounting it under a prefix must strip the
+// prefix first.
+func (s *Server) Handler() fasthttp.RequestHandler {
+	return s.handler
+}
+
+// ListenAndServe serves the API on the address configured by Addr,
+// UnixSocket or SystemdSocket until Shutdown is called, or one of the
+// other listeners fails, see Serve.
+func (s *Server) ListenAndServe() error {
+	ln, addr, err := listen(s.cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("In-memory API server using fasthttp started on %s", addr)
+	logBanner(addr)
+	return s.Serve(ln)
+}
+
+// Serve serves the API on ln until Shutdown is called. If the HTTP/2 or
+// gRPC listener fails meanwhile, it closes ln and returns that error.
+func (s *Server) Serve(ln net.Listener) error {
+	done := make(chan error, 1)
+	go func() { done <- s.server.Serve(ln) }()
+	select {
+	case err := <-done:
+		return err
+	case err := <-s.errs:
+		ln.Close()
+		<-done
+		return err
+	}
+}
+
+// Shutdown stops serving requests, waiting for those in flight, and then
+// stops the background components, waiting up to ShutdownTimeout for them.
+func (s *Server) Shutdown() error {
+	stopFeeds()
+	err := s.server.Shutdown()
+	if !background.shutdown(s.cfg.ShutdownTimeout) {
+		log.Printf("Background tasks still running after %s, exiting anyway", s.cfg.ShutdownTimeout)
+	}
+	return err
+}
@@ -0,0 +1,320 @@
+package todo
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// TestMain runs the tests in a scratch directory, as the server creates
+// its uploads, exports and backups directories in the working directory,
+// and keeps the request logs out of the output unless -v is given.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "todo-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testAdminToken is the admin token of the test server.
+const testAdminToken = "test-admin-token"
+
+// benchTodos is the number of todos in the server of the handler
+// benchmarks.
+const benchTodos = 1000
+
+var (
+	testServerOnce   sync.Once
+	testServer       *Server
+	testServerClient *fasthttp.Client
+	testServerErr    error
+)
+
+// testClient returns a client of a server running the whole handler chain
+// on an in-memory listener, holding benchTodos todos. Only one server can
+// be created per process, so all tests and benchmarks share it.
+func testClient(tb testing.TB) *fasthttp.Client {
+	startTestServer(tb)
+	return testServerClient
+}
+
+// testHandler returns the handler of the server of testClient, to call it
+// without a connection.
+func testHandler(tb testing.TB) fasthttp.RequestHandler {
+	startTestServer(tb)
+	return testServer.Handler()
+}
+
+func startTestServer(tb testing.TB) {
+	testServerOnce.Do(func() {
+		cfg := DefaultConfig()
+		cfg.SlowThreshold = 0
+		cfg.AdminToken = testAdminToken
+		srv, err := NewServer(cfg)
+		if err != nil {
+			testServerErr = err
+			return
+		}
+		ln := fasthttputil.NewInmemoryListener()
+		go srv.Serve(ln)
+		testServer = srv
+		testServerClient = &fasthttp.Client{Dial: func(addr string) (net.Conn, error) { return ln.Dial() }}
+
+		store := srv.Store()
+		for i := 0; i < benchTodos; i++ {
+			todo := Todo{Title: fmt.Sprintf("Todo %d", i), Description: "Prepare the Q3 report", Project: "work"}
+			if _, err := store.Create("test", todo); err != nil {
+				testServerErr = err
+				return
+			}
+		}
+	})
+	if testServerErr != nil {
+		tb.Fatalf("starting the server: %s", testServerErr)
+	}
+}
+
+// doRequest sends a request to the test server and returns an error unless
+// the response has the status want.
+func doRequest(c *fasthttp.Client, method, path string, body []byte, want int) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://test" + path)
+	if body != nil {
+		req.Header.SetContentType("application/json")
+		req.SetBody(body)
+	}
+	if err := c.Do(req, resp); err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if resp.StatusCode() != want {
+		return fmt.Errorf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode(), want, resp.Body())
+	}
+	return nil
+}
+
+// benchmarkHandler measures requests made by next from parallel clients.
+func benchmarkHandler(b *testing.B, next func(i int) (method, path string, body []byte, want int)) {
+	c := testClient(b)
+	var counter atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			method, path, body, want := next(int(counter.Add(1)))
+			if err := doRequest(c, method, path, body, want); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkHandlerGetTodo(b *testing.B) {
+	benchmarkHandler(b, func(i int) (string, string, []byte, int) {
+		return "GET", "/v1/todos/" + strconv.Itoa(i%benchTodos+1), nil, fasthttp.StatusOK
+	})
+}
+
+func BenchmarkHandlerListTodosPage(b *testing.B) {
+	benchmarkHandler(b, func(i int) (string, string, []byte, int) {
+		return "GET", "/v1/todos?limit=50", nil, fasthttp.StatusOK
+	})
+}
+
+func BenchmarkHandlerSearch(b *testing.B) {
+	benchmarkHandler(b, func(i int) (string, string, []byte, int) {
+		return "GET", "/v1/search?q=report", nil, fasthttp.StatusOK
+	})
+}
+
+func BenchmarkHandlerCreateTodo(b *testing.B) {
+	benchmarkHandler(b, func(i int) (string, string, []byte, int) {
+		return "POST", "/v1/todos", []byte(`{"title": "Write report", "tags": ["work"]}`), fasthttp.StatusCreated
+	})
+}
+
+func BenchmarkHandlerUpdateTodo(b *testing.B) {
+	benchmarkHandler(b, func(i int) (string, string, []byte, int) {
+		body := []byte(`{"title": "Write report ` + strconv.Itoa(i) + `"}`)
+		return "PUT", "/v1/todos/" + strconv.Itoa(i%benchTodos+1), body, fasthttp.StatusOK
+	})
+}
+
+func TestNewServerRejectsInvalidConfigFirst(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NotifySinks = "team=slack:https://hooks.slack.com/services/T0/B0/x"
+	cfg.CompletionMode = "sometimes"
+	if _, err := NewServer(cfg); err == nil {
+		t.Fatal("NewServer accepted an invalid completion mode")
+	}
+	if _, ok := notifySinks["team"]; ok {
+		t.Errorf("the rejected configuration set the notification sinks")
+	}
+	// The rejected configuration doesn't count as the process's Server.
+	startTestServer(t)
+	if _, err := NewServer(DefaultConfig()); err == nil {
+		t.Error("NewServer created a second Server")
+	}
+}
+
+func TestNewServerCanBeRetriedWhenTheStoreFails(t *testing.T) {
+	startTestServer(t)
+	// Nothing listens on the address of a closed listener.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// Pretend the test server wasn't created, as a failed NewServer must
+	// leave things.
+	created.Store(false)
+	defer created.Store(true)
+	depth := undoDepth
+	cfg := DefaultConfig()
+	cfg.Store = "redis"
+	cfg.RedisAddr = addr
+	cfg.UndoDepth = depth + 1
+	if _, err := NewServer(cfg); err == nil {
+		t.Fatal("NewServer accepted an unreachable Redis")
+	}
+	if created.Load() {
+		t.Error("the failed NewServer counts as the process's Server")
+	}
+	if undoDepth != depth {
+		t.Errorf("the failed NewServer set the undo depth to %d", undoDepth)
+	}
+}
+
+func TestLogEventOnlyLogsEscalations(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	logEvent(Event{Type: "todo.updated", TodoID: 1})
+	if buf.Len() != 0 {
+		t.Errorf("logged an update: %s", buf.String())
+	}
+	logEvent(Event{Type: "todo.escalated", TodoID: 2, Data: map[string]string{"rule": "stale"}})
+	if !strings.Contains(buf.String(), "event todo.escalated todo=2") {
+		t.Errorf("escalation not logged: %q", buf.String())
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	for _, tt := range []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 1, 12, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{"5", 0, 59, []int{5}},
+		{"1-5", 0, 7, []int{1, 2, 3, 4, 5}},
+		{"1,15", 1, 31, []int{1, 15}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"0-30/10", 0, 59, []int{0, 10, 20, 30}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"1-3,20-22/2", 1, 31, []int{1, 2, 3, 20, 22}},
+	} {
+		bits, err := parseCronField(tt.field, tt.min, tt.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		var got []int
+		for v := 0; v < 64; v++ {
+			if bits&(1<<uint(v)) != 0 {
+				got = append(got, v)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+
+	for _, field := range []string{"60", "5-1", "0-60", "*/0", "*/x", "a", "1-", ""} {
+		if _, err := parseCronField(field, 0, 59); err == nil {
+			t.Errorf("parseCronField(%q) accepted an invalid field", field)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Friday.
+	from := time.Date(2026, 10, 16, 10, 7, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", from, time.Date(2026, 10, 16, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", from, time.Date(2026, 10, 16, 11, 0, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", from, time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)},
+		// Both 0 and 7 mean Sunday.
+		{"0 0 * * 0", from, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1,7", from, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 6-7", from, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted either one is enough: Monday the
+		// 19th for the weekday, Saturday the 17th for the day of the month.
+		{"0 9 1 * 1", from, time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 9 17 * 1", from, time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)},
+		// With one of them "*" the other one has to match.
+		{"0 9 * * 1", from, time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 9 13 * *", from, time.Date(2026, 11, 13, 9, 0, 0, 0, time.UTC)},
+		// Months without the day are skipped, and the year rolls over.
+		{"30 8 31 * *", from, time.Date(2026, 10, 31, 8, 30, 0, 0, time.UTC)},
+		{"30 8 31 * *", time.Date(2026, 10, 31, 8, 30, 0, 0, time.UTC), time.Date(2026, 12, 31, 8, 30, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// The next run is strictly after the given time.
+		{"7 10 16 10 *", from, time.Date(2027, 10, 16, 10, 7, 0, 0, time.UTC)},
+		{"7 10 16 10 *", from.Add(-30 * time.Second), from},
+		// February never has a 31st.
+		{"0 0 31 2 *", from, time.Time{}},
+	} {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "* * * * * *", "@often", "0 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) accepted an invalid expression", spec)
+		}
+	}
+}
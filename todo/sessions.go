@@ -0,0 +1,317 @@
+package todo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Token lifetimes, set once at startup.
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// jwtSecret signs access tokens. It is set once at startup, to a random
+// value unless configured, which invalidates all tokens on restart.
+var jwtSecret []byte
+
+// Session is a login of an API key holder, with the key or through a login
+// provider. It lasts until it is logged out or its refresh token expires,
+// and hands out short-lived access tokens.
+type Session struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+	// Provider is the login provider, such as "github", of sessions not
+	// opened with an API key.
+	Provider   string    `json:"provider,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current is set on the session of the caller when listing sessions.
+	Current bool `json:"current,omitempty"`
+
+	// refreshHash is the SHA-256 of the current refresh token; earlier
+	// refresh tokens of the session are rejected.
+	refreshHash [sha256.Size]byte
+	revoked     bool
+}
+
+// accessClaims are the claims of an access token.
+type accessClaims struct {
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*Session)
+	// revokedTokens maps the IDs of access tokens revoked by logging out
+	// to their expiry, after which they are forgotten.
+	revokedTokens = make(map[string]time.Time)
+)
+
+// tokenResponse is the body of successful login and refresh responses.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// randomToken returns n random bytes, hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// signAccessToken returns the HS256 JWT for the claims.
+func signAccessToken(c accessClaims) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(c)
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAccessToken verifies an access token and returns its claims. Tokens
+// that expired, were revoked or belong to a closed session are invalid.
+func parseAccessToken(token string) (accessClaims, error) {
+	var c accessClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return c, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return c, errInvalidToken
+	}
+	now := time.Now()
+	if now.Unix() >= c.ExpiresAt {
+		return c, errInvalidToken
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if _, revoked := revokedTokens[c.ID]; revoked {
+		return c, errInvalidToken
+	}
+	s, ok := sessions[c.SessionID]
+	if !ok || s.revoked || now.After(s.ExpiresAt) {
+		return c, errInvalidToken
+	}
+	s.LastUsedAt = now
+	return c, nil
+}
+
+// principalForToken returns the principal an access token was issued to.
+func principalForToken(token string) (*principal, bool) {
+	if strings.Count(token, ".") != 2 {
+		return nil, false
+	}
+	c, err := parseAccessToken(token)
+	if err != nil {
+		return nil, false
+	}
+	for _, p := range apiKeys {
+		if p.name == c.Subject {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// issueTokens returns a new access token and a new refresh token for the
+// session, replacing its previous refresh token. sessionsMu must be held.
+func issueTokens(s *Session) tokenResponse {
+	now := time.Now()
+	refresh := s.ID + "." + randomToken(32)
+	s.refreshHash = sha256.Sum256([]byte(refresh))
+	s.ExpiresAt = now.Add(refreshTokenTTL)
+	s.LastUsedAt = now
+	access := signAccessToken(accessClaims{
+		Subject:   s.User,
+		SessionID: s.ID,
+		ID:        randomToken(16),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+	})
+	return tokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}
+}
+
+// pruneSessions forgets expired sessions and revoked tokens. sessionsMu
+// must be held.
+func pruneSessions(now time.Time) {
+	for id, s := range sessions {
+		if s.revoked || now.After(s.ExpiresAt) {
+			delete(sessions, id)
+		}
+	}
+	for id, exp := range revokedTokens {
+		if now.After(exp) {
+			delete(revokedTokens, id)
+		}
+	}
+}
+
+// requireSessions reports whether token authentication is available, which
+// needs API keys, responding with an error if it isn't.
+func requireSessions(ctx *fasthttp.RequestCtx) bool {
+	if len(apiKeys) == 0 {
+		ctx.Error("Sessions are disabled, set -api-keys to enable them", fasthttp.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// login handles POST /auth/login. Callers authenticate with their API key
+// and get an access token and a refresh token for a new session.
+func login(ctx *fasthttp.RequestCtx) {
+	if !requireSessions(ctx) {
+		return
+	}
+	p, ok := apiKeys[callerKey(ctx)]
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, startSession(ctx, p.name, ""))
+}
+
+// startSession opens a session for the user logging in with the request,
+// through provider if it isn't an API key, and returns its first tokens.
+func startSession(ctx *fasthttp.RequestCtx, user, provider string) tokenResponse {
+	now := time.Now()
+	s := &Session{
+		ID:         randomToken(12),
+		User:       user,
+		Provider:   provider,
+		UserAgent:  string(ctx.UserAgent()),
+		RemoteAddr: ctx.RemoteIP().String(),
+		CreatedAt:  now,
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	pruneSessions(now)
+	sessions[s.ID] = s
+	return issueTokens(s)
+}
+
+// refreshTokens handles POST /auth/refresh with a JSON body such as
+// {"refresh_token": "..."} and rotates the session's tokens. Presenting a
+// refresh token that was already used closes the session, since it may have
+// been stolen.
+func refreshTokens(ctx *fasthttp.RequestCtx) {
+	if !requireSessions(ctx) {
+		return
+	}
+	var in struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !decodeJSONBody(ctx, &in) {
+		return
+	}
+	id, _, _ := strings.Cut(in.RefreshToken, ".")
+	hash := sha256.Sum256([]byte(in.RefreshToken))
+
+	sessionsMu.Lock()
+	s, ok := sessions[id]
+	if !ok || s.revoked || time.Now().After(s.ExpiresAt) {
+		sessionsMu.Unlock()
+		ctx.Error("Invalid refresh token", fasthttp.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare(hash[:], s.refreshHash[:]) != 1 {
+		s.revoked = true
+		sessionsMu.Unlock()
+		ctx.Error("Invalid refresh token", fasthttp.StatusUnauthorized)
+		return
+	}
+	tokens := issueTokens(s)
+	sessionsMu.Unlock()
+	writeJSON(ctx, fasthttp.StatusOK, tokens)
+}
+
+// logout handles POST /auth/logout, sent with an access token, and closes
+// its session. The access token is revoked right away instead of when it
+// expires.
+func logout(ctx *fasthttp.RequestCtx) {
+	if !requireSessions(ctx) {
+		return
+	}
+	c, err := parseAccessToken(callerKey(ctx))
+	if err != nil {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	sessionsMu.Lock()
+	if s, ok := sessions[c.SessionID]; ok {
+		s.revoked = true
+	}
+	revokedTokens[c.ID] = time.Unix(c.ExpiresAt, 0)
+	sessionsMu.Unlock()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// getSessions handles GET /auth/sessions and lists the open sessions of the
+// caller, most recently used first.
+func getSessions(ctx *fasthttp.RequestCtx) {
+	if !requireSessions(ctx) {
+		return
+	}
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	current := ""
+	if c, err := parseAccessToken(callerKey(ctx)); err == nil {
+		current = c.SessionID
+	}
+
+	now := time.Now()
+	list := []Session{}
+	sessionsMu.Lock()
+	pruneSessions(now)
+	for _, s := range sessions {
+		if s.User == caller.name {
+			snapshot := *s
+			snapshot.Current = s.ID == current
+			list = append(list, snapshot)
+		}
+	}
+	sessionsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsedAt.After(list[j].LastUsedAt) })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
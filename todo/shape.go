@@ -0,0 +1,184 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// todoRelations are the fields of todos that hold related items. Responses
+// with a sparse fieldset leave them out unless they are asked for with
+// ?include=; comments are only included on request.
+var todoRelations = []string{"subtasks", "attachments", "links", "comments"}
+
+// shapeFields are the JSON names of the fields of todos, in the order they
+// are encoded, followed by the comments included on request.
+var shapeFields = append(jsonFieldNames(reflect.TypeOf(Todo{})), "comments")
+
+// todoShape selects the fields of the todos in a response.
+type todoShape struct {
+	// fields is the sparse fieldset; nil keeps all fields.
+	fields  map[string]bool
+	include map[string]bool
+}
+
+// parseShape reads ?fields= and ?include= from the request, responding with
+// an error if they name unknown fields. Comments can only be included with
+// single todos, of the default namespace.
+func parseShape(ctx *fasthttp.RequestCtx) (*todoShape, bool) {
+	args := ctx.QueryArgs()
+	s := &todoShape{include: make(map[string]bool)}
+	if args.Has("fields") {
+		if string(args.Peek("view")) == "summary" {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid fields",
+				"fields can't be combined with view=summary")
+			return nil, false
+		}
+		s.fields = make(map[string]bool)
+		for _, name := range strings.Split(string(args.Peek("fields")), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !containsString(shapeFields, name) || name == "comments" {
+				writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid fields",
+					"unknown field "+strconv.Quote(name)+", fields are the JSON names of todo fields such as id,title,completed")
+				return nil, false
+			}
+			s.fields[name] = true
+		}
+	}
+	for _, name := range strings.Split(string(args.Peek("include")), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !containsString(todoRelations, name) {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid include",
+				"include must list some of "+strings.Join(todoRelations, ", "))
+			return nil, false
+		}
+		s.include[name] = true
+	}
+	if s.include["comments"] {
+		if _, ok := todoPathID(string(ctx.Path())); !ok {
+			writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid include",
+				"comments can only be included with a single todo, GET /todos/{id}")
+			return nil, false
+		}
+	}
+	return s, true
+}
+
+// todoPathID returns the ID in a path of the form /todos/{id}.
+func todoPathID(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/todos/")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	return id, err == nil
+}
+
+// shapeHandler wraps h, applying ?fields= and ?include= to the todos in
+// the responses to GET /todos, GET /todos/{id} and GET /search, to cut
+// their size for clients that only need some fields:
+//
+//	GET /todos?fields=id,title,completed&include=subtasks
+func shapeHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		args := ctx.QueryArgs()
+		path := string(ctx.Path())
+		_, single := todoPathID(path)
+		if !ctx.IsGet() || (!args.Has("fields") && !args.Has("include")) ||
+			(path != "/todos" && path != "/search" && !single) {
+			h(ctx)
+			return
+		}
+		s, ok := parseShape(ctx)
+		if !ok {
+			return
+		}
+		ctx.SetUserValue(shapeKey, s)
+		h(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK || s.fields == nil ||
+			!bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json")) {
+			return
+		}
+		ctx.SetBody(s.apply(ctx.Response.Body()))
+	}
+}
+
+// shapeKey is the user value holding the shape of a request.
+const shapeKey = "shape"
+
+// includes reports whether the request asked for the relation with
+// ?include=.
+func includes(ctx *fasthttp.RequestCtx, relation string) bool {
+	s, ok := ctx.UserValue(shapeKey).(*todoShape)
+	return ok && s.include[relation]
+}
+
+// apply shapes the todos in body: a todo, an array of todos, or an object
+// holding arrays of todos such as a page or a board.
+func (s *todoShape) apply(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(body, []byte("[")):
+		var items []json.RawMessage
+		if json.Unmarshal(body, &items) != nil {
+			return body
+		}
+		raws := make([][]byte, len(items))
+		for i, item := range items {
+			raws[i] = s.todo(item)
+		}
+		return joinJSON(raws)
+	case bytes.HasPrefix(body, []byte("{")):
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(body, &obj) != nil {
+			return body
+		}
+		if _, ok := obj["id"]; ok {
+			return s.todo(body)
+		}
+		for k, v := range obj {
+			if bytes.HasPrefix(v, []byte("[")) {
+				obj[k] = s.apply(v)
+			}
+		}
+		out, err := json.Marshal(obj)
+		if err != nil {
+			return body
+		}
+		return out
+	}
+	return body
+}
+
+// todo returns the selected fields of the JSON encoded todo, in their usual
+// order.
+func (s *todoShape) todo(raw []byte) []byte {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil {
+		return raw
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for _, name := range shapeFields {
+		v, ok := obj[name]
+		if !ok || !s.fields[name] && !s.include[name] {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(name))
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
@@ -0,0 +1,421 @@
+package todo
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// permission is what a caller may do with a todo. Higher permissions
+// include the lower ones.
+type permission int
+
+const (
+	permNone permission = iota
+	// permViewer may read the todo and its subresources.
+	permViewer
+	// permEditor may also change it, but not delete or share it.
+	permEditor
+	// permOwner may do everything. The creator of a todo and callers with
+	// access to its project own it.
+	permOwner
+)
+
+// shareRoles maps the roles that can be granted to their permissions.
+var shareRoles = map[string]permission{
+	"viewer": permViewer,
+	"editor": permEditor,
+}
+
+// Share grants a user a role on a todo or a whole project.
+type Share struct {
+	User string `json:"user"`
+	// Role is "viewer" or "editor".
+	Role string `json:"role"`
+}
+
+// shareTable holds the roles granted on the todos and projects of a
+// namespace.
+type shareTable struct {
+	mu sync.RWMutex
+	// todos and projects map todo IDs and project names to the roles
+	// granted on them by user.
+	todos    map[int]map[string]string
+	projects map[string]map[string]string
+	// changes, when set, gets the grants of a todo or project whenever they
+	// change, for replicas.
+	changes *changeLog
+}
+
+// newShareTable returns an empty share table appending its changes to
+// changes, if it isn't nil.
+func newShareTable(changes *changeLog) *shareTable {
+	return &shareTable{todos: make(map[int]map[string]string), projects: make(map[string]map[string]string), changes: changes}
+}
+
+// shareGrants are the roles granted on the todo with the given ID, or the
+// project if it isn't "".
+type shareGrants struct {
+	id      int
+	project string
+	shares  []Share
+}
+
+// permission returns the permission the user was granted on the todo,
+// directly or through its project.
+func (t *shareTable) permission(user string, todo *Todo) permission {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	perm := shareRoles[t.todos[todo.ID][user]]
+	if todo.Project != "" {
+		if p := shareRoles[t.projects[todo.Project][user]]; p > perm {
+			perm = p
+		}
+	}
+	return perm
+}
+
+// projectPermission returns the permission the user was granted on the
+// whole project.
+func (t *shareTable) projectPermission(user, project string) permission {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return shareRoles[t.projects[project][user]]
+}
+
+// grant grants the user a role on the todo with the given ID, or the
+// project if it isn't "".
+func (t *shareTable) grant(id int, project string, s Share) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.changed(id, project)
+	if project != "" {
+		if t.projects[project] == nil {
+			t.projects[project] = make(map[string]string)
+		}
+		t.projects[project][s.User] = s.Role
+		return
+	}
+	if t.todos[id] == nil {
+		t.todos[id] = make(map[string]string)
+	}
+	t.todos[id][s.User] = s.Role
+}
+
+// revoke removes the role granted to the user on the todo with the given
+// ID, or the project if it isn't "", and reports whether there was one.
+func (t *shareTable) revoke(id int, project, user string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.changed(id, project)
+	if project != "" {
+		_, ok := t.projects[project][user]
+		delete(t.projects[project], user)
+		if len(t.projects[project]) == 0 {
+			delete(t.projects, project)
+		}
+		return ok
+	}
+	_, ok := t.todos[id][user]
+	delete(t.todos[id], user)
+	if len(t.todos[id]) == 0 {
+		delete(t.todos, id)
+	}
+	return ok
+}
+
+// changed appends the grants of the todo with the given ID, or the project
+// if it isn't "", to the change log, if the table has one. The caller must
+// hold the lock of the table.
+func (t *shareTable) changed(id int, project string) {
+	if t.changes != nil {
+		t.changes.appendShares(shareGrants{id: id, project: project, shares: t.sorted(id, project)})
+	}
+}
+
+// list lists the roles granted on the todo with the given ID, or the
+// project if it isn't "", ordered by user.
+func (t *shareTable) list(id int, project string) []Share {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.sorted(id, project)
+}
+
+// sorted is list for callers holding the lock of the table.
+func (t *shareTable) sorted(id int, project string) []Share {
+	grants := t.todos[id]
+	if project != "" {
+		grants = t.projects[project]
+	}
+	list := make([]Share, 0, len(grants))
+	for user, role := range grants {
+		list = append(list, Share{User: user, Role: role})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+	return list
+}
+
+// all returns the grants of every todo and project with any.
+func (t *shareTable) all() []shareGrants {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var all []shareGrants
+	for id := range t.todos {
+		all = append(all, shareGrants{id: id, shares: t.sorted(id, "")})
+	}
+	for project := range t.projects {
+		all = append(all, shareGrants{project: project, shares: t.sorted(0, project)})
+	}
+	return all
+}
+
+// set replaces the grants of a todo or project, without appending them to
+// the change log. Replicas apply the grants of their primary with it.
+func (t *shareTable) set(g shareGrants) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setLocked(g)
+}
+
+// replace replaces all grants of the table by the given ones, without
+// appending them to the change log.
+func (t *shareTable) replace(all []shareGrants) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.todos = make(map[int]map[string]string)
+	t.projects = make(map[string]map[string]string)
+	for _, g := range all {
+		t.setLocked(g)
+	}
+}
+
+func (t *shareTable) setLocked(g shareGrants) {
+	var grants map[string]string
+	if len(g.shares) > 0 {
+		grants = make(map[string]string, len(g.shares))
+		for _, s := range g.shares {
+			grants[s.User] = s.Role
+		}
+	}
+	switch {
+	case g.project != "" && grants == nil:
+		delete(t.projects, g.project)
+	case g.project != "":
+		t.projects[g.project] = grants
+	case grants == nil:
+		delete(t.todos, g.id)
+	default:
+		t.todos[g.id] = grants
+	}
+}
+
+// permissionOf returns the permission the caller has on a todo of the
+// default namespace, see namespace.permission.
+func permissionOf(caller *principal, todo *Todo) permission {
+	return defaultNamespace.permission(caller, todo)
+}
+
+// requiredPermission returns the permission needed for a request to
+// /todos/{id}, where sub is the part of the path after the ID.
+func requiredPermission(method, sub string) permission {
+	switch {
+	case method == "GET" || method == "HEAD":
+		return permViewer
+	case sub == "" && method == "DELETE", isShareRoute(sub):
+		return permOwner
+	}
+	return permEditor
+}
+
+// shareHandler wraps h, enforcing the permissions of callers on requests for
+// /todos/{id} and its subresources when access control is enabled. Callers
+// that may not see a todo get 404 Not Found, callers whose role doesn't
+// allow the request 403 Forbidden.
+func shareHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if len(apiKeys) == 0 {
+			h(ctx)
+			return
+		}
+		rest, ok := strings.CutPrefix(string(ctx.Path()), "/todos/")
+		if !ok {
+			h(ctx)
+			return
+		}
+		idStr, sub, _ := strings.Cut(rest, "/")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			h(ctx)
+			return
+		}
+		ns := namespaceOf(ctx)
+		todo, ok := ns.store.get(id)
+		if !ok {
+			// Deleted todos, whose history and undo stay available, are
+			// checked as they were before their deletion. Let the handler
+			// tell them apart from missing ones.
+			raw := ns.store.audit.last(id)
+			if raw == nil || json.Unmarshal(raw, &todo) != nil {
+				h(ctx)
+				return
+			}
+		}
+		caller, ok := authenticate(ctx)
+		if !ok {
+			ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+			return
+		}
+		perm := ns.permission(caller, &todo)
+		switch {
+		case perm == permNone:
+			ctx.Error("Todo not found", fasthttp.StatusNotFound)
+		case perm < requiredPermission(string(ctx.Method()), sub):
+			ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		default:
+			h(ctx)
+		}
+	}
+}
+
+// visibleTodos returns the filter of the todos of the request's namespace
+// its caller may see, for the handlers listing them; it is nil when access
+// control is disabled. ok is false, with the response written, if the
+// request carries no valid API key.
+func visibleTodos(ctx *fasthttp.RequestCtx) (visible func(todo *Todo) bool, ok bool) {
+	if len(apiKeys) == 0 {
+		return nil, true
+	}
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return nil, false
+	}
+	ns := namespaceOf(ctx)
+	return func(todo *Todo) bool {
+		return ns.permission(caller, todo) != permNone
+	}, true
+}
+
+// knownUser reports whether name is the name of an API key. Without access
+// control any name is accepted.
+func knownUser(name string) bool {
+	if len(apiKeys) == 0 {
+		return name != ""
+	}
+	for _, p := range apiKeys {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeShare parses and validates the JSON share in the request body.
+func decodeShare(ctx *fasthttp.RequestCtx) (Share, bool) {
+	var s Share
+	if !decodeJSONBody(ctx, &s) {
+		return s, false
+	}
+	if _, ok := shareRoles[s.Role]; !ok {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid role", `role must be "viewer" or "editor"`)
+		return s, false
+	}
+	if !knownUser(s.User) {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Unknown user", "user must be the name of an API key")
+		return s, false
+	}
+	return s, true
+}
+
+// routeShares routes requests for /todos/{id}/share and
+// /todos/{id}/share/{user}; rest is the part after "share".
+func routeShares(ctx *fasthttp.RequestCtx, method string, id int, rest string) {
+	ns := namespaceOf(ctx)
+	if !ns.store.exists(id) {
+		todoNotFound(ctx, id)
+		return
+	}
+	routeShareTable(ctx, method, ns.shares, id, "", rest)
+}
+
+// routeProjectShares routes requests for /projects/{project}/share and
+// /projects/{project}/share/{user}. Only callers with access to the
+// project may manage its shares.
+func routeProjectShares(ctx *fasthttp.RequestCtx, method, project, rest string) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	if !caller.canSee(project) {
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		return
+	}
+	routeShareTable(ctx, method, namespaceOf(ctx).shares, 0, project, rest)
+}
+
+// routeShareTable serves the shares of the todo with the given ID, or the
+// project if it isn't "": rest is "" to list or add them and "/{user}" to
+// remove one. Sharing again with the same user changes the role.
+func routeShareTable(ctx *fasthttp.RequestCtx, method string, shares *shareTable, id int, project, rest string) {
+	if rest == "" {
+		switch method {
+		case "GET":
+			writeJSON(ctx, fasthttp.StatusOK, shares.list(id, project))
+		case "POST":
+			s, ok := decodeShare(ctx)
+			if !ok {
+				return
+			}
+			shares.grant(id, project, s)
+			todosChanged()
+			writeJSON(ctx, fasthttp.StatusCreated, s)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if method != "DELETE" {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !shares.revoke(id, project, strings.TrimPrefix(rest, "/")) {
+		ctx.Error("Share not found", fasthttp.StatusNotFound)
+		return
+	}
+	todosChanged()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// getSharedTodos handles GET /todos?shared=true and lists the todos shared
+// with the caller, directly or through their project, that the caller
+// doesn't own, ordered by ID.
+func getSharedTodos(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	type entry struct {
+		id  int
+		raw []byte
+	}
+	var entries []entry
+	ns := namespaceOf(ctx)
+	ns.store.each(func(todo *Todo) bool {
+		if p := ns.permission(caller, todo); p == permViewer || p == permEditor {
+			entries = append(entries, entry{todo.ID, todo.raw})
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	raws := make([][]byte, len(entries))
+	for i, e := range entries {
+		raws[i] = e.raw
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, joinJSON(raws))
+}
@@ -0,0 +1,104 @@
+package todo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// notifySinks are the named chat destinations rule notify actions can
+// deliver to, configured with -notify-sinks.
+var notifySinks = map[string]notifier{}
+
+// slackNotifier posts notifications to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+// slackText escapes the characters Slack treats as markup.
+var slackText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+func (s slackNotifier) notify(n notification) error {
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s (todo #%d)", slackText(n.Message), slackText(n.Title), n.TodoID),
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, body, nil, 10*time.Second)
+}
+
+// discordNotifier posts notifications to a Discord webhook. Mentions in
+// the message are not resolved, so a todo titled "@everyone" pings nobody.
+type discordNotifier struct {
+	url string
+}
+
+func (d discordNotifier) notify(n notification) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"content":          fmt.Sprintf("**%s**\n%s (todo #%d)", n.Message, n.Title, n.TodoID),
+		"allowed_mentions": map[string][]string{"parse": {}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(d.url, body, nil, 10*time.Second)
+}
+
+// parseNotifySinks parses a comma-separated list of sinks such as
+// "ops=slack:https://hooks.slack.com/services/...". Every sink has a name,
+// a driver ("slack", "discord" or "webhook") and the URL it posts to.
+func parseNotifySinks(spec string) (map[string]notifier, error) {
+	sinks := map[string]notifier{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		driver, url, ok2 := strings.Cut(rest, ":")
+		name = strings.TrimSpace(name)
+		if !ok || !ok2 || name == "" || !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return nil, fmt.Errorf("invalid sink %q, expected name=driver:url", entry)
+		}
+		if _, dup := sinks[name]; dup {
+			return nil, fmt.Errorf("duplicate sink %q", name)
+		}
+		switch driver {
+		case "slack":
+			sinks[name] = slackNotifier{url: url}
+		case "discord":
+			sinks[name] = discordNotifier{url: url}
+		case "webhook":
+			sinks[name] = webhookNotifier{url: url}
+		default:
+			return nil, fmt.Errorf("sink %q: unknown driver %q", name, driver)
+		}
+	}
+	return sinks, nil
+}
+
+// deliverRuleNotifications sends the rule.notify events of rules whose
+// notify action names a sink to that sink.
+func deliverRuleNotifications(e Event) {
+	if e.Type != "rule.notify" {
+		return
+	}
+	data, _ := e.Data.(map[string]interface{})
+	name, _ := data["sink"].(string)
+	sink, ok := notifySinks[name]
+	if !ok {
+		return
+	}
+	n := notification{Kind: "rule", TodoID: e.TodoID, Time: e.Time}
+	n.Title, _ = data["title"].(string)
+	n.Message, _ = data["message"].(string)
+	background.spawn("notifications", func(ctx context.Context) {
+		if err := sink.notify(n); err != nil {
+			log.Printf("notification to sink %s for todo %d: %s", name, e.TodoID, err)
+		}
+	})
+}
@@ -0,0 +1,4 @@
+package todo
+
+// Registers the pure-Go SQLite driver of the sqlite store.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,453 @@
+package todo
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations of the SQL stores, one
+// directory per dialect. Migrations are named {version}_{name}.sql and
+// applied in order of their version.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// sqlDialect describes a database the SQL store can use.
+type sqlDialect struct {
+	// name is the value of -store selecting the dialect; driver is the name
+	// the database/sql driver registers.
+	name, driver string
+	// dsn returns the data source name for the value of -db.
+	dsn func(db string) string
+	// pool, if set, opens the connection pool of up to maxConns connections
+	// in place of database/sql, and returns a function closing it.
+	pool func(dsn string, maxConns int) (*sql.DB, func(), error)
+	// placeholder returns the placeholder of the nth (1-based) argument.
+	placeholder func(n int) string
+	// lock, if set, is run at the start of every migration to keep
+	// instances starting at once from applying it twice.
+	lock string
+	// shared databases serve several instances: changes are recorded in
+	// the todo_changes table, which the instances poll.
+	shared bool
+}
+
+// sqliteDialect stores the todos in a SQLite database file. The
+// write-ahead log lets readers continue while a write is in progress, and
+// writers wait up to five seconds for each other instead of failing.
+var sqliteDialect = sqlDialect{
+	name:   "sqlite",
+	driver: "sqlite",
+	dsn: func(db string) string {
+		return "file:" + db + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+	},
+	placeholder: func(int) string { return "?" },
+}
+
+// postgresDialect stores the todos in PostgreSQL through a pgx pool, so
+// several instances can share them.
+var postgresDialect = sqlDialect{
+	name:        "postgres",
+	driver:      "pgx",
+	dsn:         func(db string) string { return db },
+	pool:        openPostgres,
+	placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	lock:        "SELECT pg_advisory_xact_lock(7238153)",
+	shared:      true,
+}
+
+// Polling the changes of other instances in shared databases.
+const (
+	// changeLookback is how far below the highest sequence number seen
+	// changes are read again: sequence numbers are assigned before commit,
+	// so a change may become visible after changes with higher numbers.
+	changeLookback = 1000
+	// changeRetention is how long recorded changes are kept.
+	changeRetention = time.Hour
+)
+
+// sqlStore is a todoBackend keeping todos in a SQL database, see the
+// migrations of its dialect for the schema.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	// stmts holds the prepared statements by query.
+	stmts map[string]*sql.Stmt
+	// instance identifies this process in recorded changes, so it can skip
+	// its own; poll is the interval they are polled at.
+	instance string
+	poll     time.Duration
+	// release closes the connection pool of dialects with their own pool.
+	release func()
+}
+
+// The queries of sqlStore, with ? placeholders. They are rewritten for the
+// dialect and prepared when the store is opened.
+const (
+	sqlLoadTodos  = "SELECT data, version FROM todos ORDER BY id"
+	sqlFetchTodo  = "SELECT data, version FROM todos WHERE id = ?"
+	sqlNextID     = "UPDATE todo_ids SET next_id = next_id + 1"
+	sqlCurrentID  = "SELECT next_id FROM todo_ids"
+	sqlReserveID  = "UPDATE todo_ids SET next_id = ? WHERE next_id < ?"
+	sqlResetIDs   = "UPDATE todo_ids SET next_id = 0"
+	sqlDeleteTodo = "DELETE FROM todos WHERE id = ?"
+	sqlSaveTodo   = `INSERT INTO todos (id, position, data, updated_at, version) VALUES (?, ?, ?, ?, 1)
+		ON CONFLICT (id) DO UPDATE SET position = excluded.position, data = excluded.data, updated_at = excluded.updated_at,
+		version = todos.version + 1`
+
+	// Changes based on a version of the todo: they affect no row if the
+	// todo exists (for inserts) or is at another version.
+	sqlInsertTodo  = "INSERT INTO todos (id, position, data, updated_at, version) VALUES (?, ?, ?, ?, 1) ON CONFLICT (id) DO NOTHING"
+	sqlUpdateTodo  = "UPDATE todos SET position = ?, data = ?, updated_at = ?, version = version + 1 WHERE id = ? AND version = ?"
+	sqlDeleteAtVer = "DELETE FROM todos WHERE id = ? AND version = ?"
+
+	sqlRecordChange = "INSERT INTO todo_changes (id, instance) VALUES (?, ?)"
+	sqlLastChange   = "SELECT COALESCE(MAX(seq), 0) FROM todo_changes"
+	sqlChanges      = "SELECT seq, id FROM todo_changes WHERE seq > ? AND instance <> ? ORDER BY seq"
+	sqlPruneChanges = "DELETE FROM todo_changes WHERE changed_at < ?"
+)
+
+// openSQLStore opens the database named by db with up to maxConns
+// connections, applies missing migrations and prepares the queries.
+// Shared databases are polled for changes every poll.
+func openSQLStore(d sqlDialect, db string, maxConns int, poll time.Duration) (*sqlStore, error) {
+	if db == "" {
+		return nil, fmt.Errorf("the %s store requires -db", d.name)
+	}
+	if maxConns < 1 {
+		return nil, fmt.Errorf("invalid number of database connections %d", maxConns)
+	}
+	if d.shared && poll <= 0 {
+		return nil, fmt.Errorf("invalid poll interval %s", poll)
+	}
+	s := &sqlStore{
+		dialect:  d,
+		stmts:    make(map[string]*sql.Stmt),
+		instance: randomToken(8),
+		poll:     poll,
+	}
+	if d.pool != nil {
+		conn, release, err := d.pool(d.dsn(db), maxConns)
+		if err != nil {
+			return nil, err
+		}
+		s.db, s.release = conn, release
+	} else {
+		conn, err := sql.Open(d.driver, d.dsn(db))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetMaxIdleConns(maxConns)
+		conn.SetConnMaxIdleTime(5 * time.Minute)
+		s.db = conn
+	}
+	s.db.SetMaxOpenConns(maxConns)
+	if err := s.ping(context.Background()); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := s.migrate(); err != nil {
+		s.close()
+		return nil, fmt.Errorf("migrating the database: %w", err)
+	}
+	queries := []string{sqlLoadTodos, sqlFetchTodo, sqlNextID, sqlCurrentID, sqlReserveID, sqlResetIDs, sqlDeleteTodo, sqlSaveTodo,
+		sqlInsertTodo, sqlUpdateTodo, sqlDeleteAtVer}
+	if d.shared {
+		queries = append(queries, sqlRecordChange, sqlLastChange, sqlChanges, sqlPruneChanges)
+	}
+	for _, q := range queries {
+		stmt, err := s.db.Prepare(s.rebind(q))
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("preparing %q: %w", q, err)
+		}
+		s.stmts[q] = stmt
+	}
+	return s, nil
+}
+
+// close closes the database and the pool of the dialect, if it has one.
+func (s *sqlStore) close() {
+	s.db.Close()
+	if s.release != nil {
+		s.release()
+	}
+}
+
+// rebind replaces the ? placeholders of q with those of the dialect.
+func (s *sqlStore) rebind(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString(s.dialect.placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrate applies the migrations of the dialect that weren't applied yet,
+// each in its own transaction, and records them in schema_migrations.
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	rows, err := s.db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	dir := path.Join("migrations", s.dialect.name)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || !strings.HasSuffix(e.Name(), ".sql") {
+			return fmt.Errorf("invalid migration name %q", e.Name())
+		}
+		if applied[version] {
+			continue
+		}
+		script, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		err = s.transaction(func(tx *sql.Tx) error {
+			if s.dialect.lock != "" {
+				if _, err := tx.Exec(s.dialect.lock); err != nil {
+					return err
+				}
+				// Another instance may have applied it while we waited.
+				var n int
+				err := tx.QueryRow(s.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&n)
+				if err != nil || n > 0 {
+					return err
+				}
+			}
+			if _, err := tx.Exec(string(script)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+				version, e.Name(), time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction, committing it if fn succeeds.
+func (s *sqlStore) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) load() ([]storedTodo, error) {
+	rows, err := s.stmts[sqlLoadTodos].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stored []storedTodo
+	for rows.Next() {
+		var t storedTodo
+		if err := rows.Scan(&t.raw, &t.version); err != nil {
+			return nil, err
+		}
+		stored = append(stored, t)
+	}
+	return stored, rows.Err()
+}
+
+func (s *sqlStore) fetch(id int) (storedTodo, error) {
+	var t storedTodo
+	err := s.stmts[sqlFetchTodo].QueryRow(id).Scan(&t.raw, &t.version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedTodo{}, nil
+	}
+	return t, err
+}
+
+func (s *sqlStore) nextID() (int, error) {
+	var id int
+	err := s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Stmt(s.stmts[sqlNextID]).Exec(); err != nil {
+			return err
+		}
+		return tx.Stmt(s.stmts[sqlCurrentID]).QueryRow().Scan(&id)
+	})
+	return id, err
+}
+
+func (s *sqlStore) reserveID(id int) error {
+	_, err := s.stmts[sqlReserveID].Exec(id, id)
+	return err
+}
+
+func (s *sqlStore) resetIDs() error {
+	_, err := s.stmts[sqlResetIDs].Exec()
+	return err
+}
+
+func (s *sqlStore) save(todo *Todo, expect int64) error {
+	return s.writeBatch([]pendingWrite{{id: todo.ID, todo: todo, expect: expect}})
+}
+
+func (s *sqlStore) remove(id int, expect int64) error {
+	return s.writeBatch([]pendingWrite{{id: id, expect: expect}})
+}
+
+// writeBatch writes several changes in one transaction. If one of the
+// todos isn't at the version its change expects, none of the changes are
+// made and writeBatch returns errVersionConflict.
+func (s *sqlStore) writeBatch(writes []pendingWrite) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		for _, write := range writes {
+			res, err := s.write(tx, write)
+			if err != nil {
+				return err
+			}
+			if write.expect != anyVersion {
+				if n, err := res.RowsAffected(); err != nil || n == 0 {
+					if err == nil {
+						err = errVersionConflict
+					}
+					return err
+				}
+			}
+			if err := s.recordChange(tx, write.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// write makes a change as part of tx.
+func (s *sqlStore) write(tx *sql.Tx, w pendingWrite) (sql.Result, error) {
+	todo := w.todo
+	switch {
+	case todo == nil && w.expect == anyVersion:
+		return tx.Stmt(s.stmts[sqlDeleteTodo]).Exec(w.id)
+	case todo == nil:
+		return tx.Stmt(s.stmts[sqlDeleteAtVer]).Exec(w.id, w.expect)
+	case w.expect == anyVersion:
+		return tx.Stmt(s.stmts[sqlSaveTodo]).Exec(w.id, todo.Position, string(todo.raw), todo.UpdatedAt.UTC())
+	case w.expect == 0:
+		return tx.Stmt(s.stmts[sqlInsertTodo]).Exec(w.id, todo.Position, string(todo.raw), todo.UpdatedAt.UTC())
+	}
+	return tx.Stmt(s.stmts[sqlUpdateTodo]).Exec(todo.Position, string(todo.raw), todo.UpdatedAt.UTC(), w.id, w.expect)
+}
+
+// recordChange announces the change of a todo to the other instances
+// sharing the database, as part of the transaction making it.
+func (s *sqlStore) recordChange(tx *sql.Tx, id int) error {
+	if !s.dialect.shared {
+		return nil
+	}
+	_, err := tx.Stmt(s.stmts[sqlRecordChange]).Exec(id, s.instance)
+	return err
+}
+
+// ping checks that the database is reachable.
+func (s *sqlStore) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// watch polls the changes other instances recorded in a shared database
+// and deletes those older than changeRetention. A database that isn't
+// shared serves this instance only, so watch just waits for ctx.
+func (s *sqlStore) watch(ctx context.Context, fn func(id int)) {
+	if !s.dialect.shared {
+		<-ctx.Done()
+		return
+	}
+	var last int64
+	if err := s.stmts[sqlLastChange].QueryRowContext(ctx).Scan(&last); err != nil && ctx.Err() == nil {
+		backendFailed("reading the last change", err)
+	}
+	// seen holds the sequence numbers within changeLookback of last that
+	// were handled already.
+	seen := make(map[int64]bool)
+	pruned := time.Now()
+	for sleepCtx(ctx, s.poll) {
+		rows, err := s.stmts[sqlChanges].QueryContext(ctx, last-changeLookback, s.instance)
+		if err != nil {
+			if ctx.Err() == nil {
+				backendFailed("polling changes", err)
+			}
+			continue
+		}
+		var ids []int
+		for rows.Next() {
+			var seq int64
+			var id int
+			if err := rows.Scan(&seq, &id); err != nil {
+				break
+			}
+			if !seen[seq] {
+				seen[seq] = true
+				ids = append(ids, id)
+			}
+			last = max(last, seq)
+		}
+		rows.Close()
+		for seq := range seen {
+			if seq <= last-changeLookback {
+				delete(seen, seq)
+			}
+		}
+		for _, id := range ids {
+			fn(id)
+		}
+		if time.Since(pruned) > changeRetention/10 {
+			pruned = time.Now()
+			if _, err := s.stmts[sqlPruneChanges].ExecContext(ctx, pruned.Add(-changeRetention).UTC()); err != nil && ctx.Err() == nil {
+				backendFailed("deleting old changes", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package todo
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// projectStats summarizes the todos of one project.
+type projectStats struct {
+	Project string `json:"project"`
+	Total   int    `json:"total"`
+	Open    int    `json:"open"`
+	Closed  int    `json:"closed"`
+	Overdue int    `json:"overdue"`
+	// Progress is the share of closed todos, between 0 and 1.
+	Progress float64 `json:"progress"`
+	// Subtasks and SubtasksDone count the subtasks of all todos.
+	Subtasks     int             `json:"subtasks"`
+	SubtasksDone int             `json:"subtasks_done"`
+	Burndown     []burndownPoint `json:"burndown"`
+}
+
+// burndownPoint is the number of todos still open at the end of a day.
+type burndownPoint struct {
+	Date string `json:"date"`
+	Open int    `json:"open"`
+}
+
+// defaultBurndownDays is the length of the burndown series unless ?days= says otherwise.
+const defaultBurndownDays = 14
+
+// getProjectStats handles GET /projects/{id}/stats. The burndown series
+// covers the last ?days= days (14 by default) and is derived from the
+// creation and completion times of the project's todos; deleted todos are
+// not part of it. Callers without access to the project, directly or
+// through a share, get 404 Not Found.
+func getProjectStats(ctx *fasthttp.RequestCtx, project string) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	ns := namespaceOf(ctx)
+	if ns.projectPermission(caller, project) == permNone {
+		ctx.Error("Project not found", fasthttp.StatusNotFound)
+		return
+	}
+	days := defaultBurndownDays
+	if ctx.QueryArgs().Has("days") {
+		n, err := ctx.QueryArgs().GetUint("days")
+		if err != nil || n < 1 || n > 366 {
+			ctx.Error("Invalid days, expected 1 to 366", fasthttp.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	type span struct {
+		created   time.Time
+		completed *time.Time
+	}
+	var spans []span
+	stats := projectStats{Project: project}
+	now := time.Now()
+
+	ns.store.each(func(todo *Todo) bool {
+		if todo.Project != project {
+			return true
+		}
+		stats.Total++
+		if todo.Completed {
+			stats.Closed++
+		} else {
+			stats.Open++
+			if todo.DueAt != nil && todo.DueAt.Before(now) {
+				stats.Overdue++
+			}
+		}
+		stats.Subtasks += len(todo.Subtasks)
+		for _, s := range todo.Subtasks {
+			if s.Completed {
+				stats.SubtasksDone++
+			}
+		}
+		sp := span{created: todo.CreatedAt}
+		if todo.CompletedAt != nil {
+			completed := *todo.CompletedAt
+			sp.completed = &completed
+		}
+		spans = append(spans, sp)
+		return true
+	})
+	if stats.Total == 0 {
+		ctx.Error("Project not found", fasthttp.StatusNotFound)
+		return
+	}
+	stats.Progress = float64(stats.Closed) / float64(stats.Total)
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for i := days - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		end := day.AddDate(0, 0, 1)
+		open := 0
+		for _, sp := range spans {
+			if sp.created.Before(end) && (sp.completed == nil || !sp.completed.Before(end)) {
+				open++
+			}
+		}
+		stats.Burndown = append(stats.Burndown, burndownPoint{Date: day.Format("2006-01-02"), Open: open})
+	}
+
+	writeJSON(ctx, fasthttp.StatusOK, stats)
+}
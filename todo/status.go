@@ -0,0 +1,207 @@
+package todo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Workflow statuses of a todo. A todo is completed exactly when its status
+// is done.
+const (
+	statusBacklog    = "backlog"
+	statusInProgress = "in_progress"
+	statusBlocked    = "blocked"
+	statusDone       = "done"
+)
+
+// statuses lists the statuses in board order.
+var statuses = []string{statusBacklog, statusInProgress, statusBlocked, statusDone}
+
+// defaultStatusTransitions is the workflow used unless configured otherwise.
+const defaultStatusTransitions = "backlog=in_progress|done,in_progress=backlog|blocked|done,blocked=backlog|in_progress,done=in_progress"
+
+// statusTransitions maps each status to the statuses a todo may move to
+// from it. It is set once at startup.
+var statusTransitions = mustParseStatusTransitions(defaultStatusTransitions)
+
+// parseStatusTransitions parses a comma-separated list of from=to|to
+// entries such as "backlog=in_progress|done". "*" allows moving to every
+// status. Statuses without an entry are final.
+func parseStatusTransitions(s string) (map[string][]string, error) {
+	transitions := make(map[string][]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		from = strings.TrimSpace(from)
+		if !ok || !validStatus(from) {
+			return nil, fmt.Errorf("invalid transition %q, expected status=status|status", entry)
+		}
+		for _, target := range strings.Split(to, "|") {
+			target = strings.TrimSpace(target)
+			switch {
+			case target == "*":
+				transitions[from] = append(transitions[from], statuses...)
+			case validStatus(target):
+				transitions[from] = append(transitions[from], target)
+			default:
+				return nil, fmt.Errorf("unknown status %q in transition %q", target, entry)
+			}
+		}
+	}
+	return transitions, nil
+}
+
+func mustParseStatusTransitions(s string) map[string][]string {
+	transitions, err := parseStatusTransitions(s)
+	if err != nil {
+		panic(err)
+	}
+	return transitions
+}
+
+func validStatus(status string) bool {
+	return containsString(statuses, status)
+}
+
+// statusError is returned for status changes the workflow doesn't allow.
+type statusError struct {
+	from, to string
+}
+
+func (e *statusError) Error() string {
+	allowed := statusTransitions[e.from]
+	if len(allowed) == 0 {
+		return fmt.Sprintf("cannot change status from %s, it is final", e.from)
+	}
+	return fmt.Sprintf("cannot change status from %s to %s, allowed: %s", e.from, e.to, strings.Join(allowed, ", "))
+}
+
+// setStatus moves todo to status if the workflow allows it, completing the
+// todo when it is done and reopening it otherwise.
+func setStatus(todo *Todo, status string) error {
+	if !validStatus(status) {
+		return fmt.Errorf("invalid status %q, expected one of %s", status, strings.Join(statuses, ", "))
+	}
+	if todo.Status != "" && todo.Status != status && !containsString(statusTransitions[todo.Status], status) {
+		return &statusError{from: todo.Status, to: status}
+	}
+	todo.Status = status
+	todo.Completed = status == statusDone
+	return nil
+}
+
+// completionMode is how todos with subtasks are completed, see
+// -completion-mode: "derived" completes them with their subtasks, "manual"
+// only through their completed flag or status. It is set once at startup.
+var completionMode = "derived"
+
+// completeBySubtasks completes a todo with subtasks when all of them are,
+// and reopens it otherwise, moving its status to done or back to
+// in_progress like setStatus. Todos without subtasks keep their completion,
+// which only their completed flag and status change, and so do all todos in
+// manual completion mode. It returns the statusError of a move the workflow
+// doesn't allow, such as completing a blocked todo, leaving the todo as it
+// is.
+func completeBySubtasks(todo *Todo) error {
+	if completionMode != "derived" || len(todo.Subtasks) == 0 {
+		return nil
+	}
+	switch completed := checkAllSubtasksCompleted(todo.Subtasks); {
+	case completed && !todo.Completed:
+		return setStatus(todo, statusDone)
+	case !completed && todo.Completed:
+		return setStatus(todo, statusInProgress)
+	}
+	return nil
+}
+
+// setCompleted completes or reopens todo for its completed flag, moving
+// its status to done or back to in_progress. In derived completion mode
+// the subtasks of a todo take precedence, so todos with subtasks are left
+// as they are.
+func setCompleted(todo *Todo, completed bool) error {
+	if todo.Completed == completed || completionMode == "derived" && len(todo.Subtasks) > 0 {
+		return nil
+	}
+	if completed {
+		return setStatus(todo, statusDone)
+	}
+	return setStatus(todo, statusInProgress)
+}
+
+// invalidCompleted is the field error for a completed flag that isn't a
+// boolean.
+var invalidCompleted = fieldError{Field: "completed", Message: "must be true or false"}
+
+// syncStatus keeps the completion of todo in line with its status, which
+// only changes through setStatus, so that nothing moves a todo past the
+// workflow by setting its completed flag: a todo is completed exactly when
+// it is done. Todos without a status, such as imported ones, get done or
+// backlog for their completion.
+func syncStatus(todo *Todo) {
+	switch {
+	case todo.Status == "" && todo.Completed:
+		todo.Status = statusDone
+	case todo.Status == "":
+		todo.Status = statusBacklog
+	default:
+		todo.Completed = todo.Status == statusDone
+	}
+}
+
+// getTodoBoard handles GET /todos?group_by=status and responds with the
+// todos grouped into a column per status, in board order, each ordered by
+// position. With summary set the columns hold summaries.
+func getTodoBoard(ctx *fasthttp.RequestCtx, summary bool) {
+	type entry struct {
+		id       int
+		position float64
+		raw      []byte
+	}
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	columns := make(map[string][]entry)
+	namespaceOf(ctx).store.listedFor(visible, func(todo *Todo) bool {
+		columns[todo.Status] = append(columns[todo.Status], entry{todo.ID, todo.Position, todo.raw})
+		return true
+	})
+
+	body := []byte{'{'}
+	for i, status := range statuses {
+		column := columns[status]
+		sort.Slice(column, func(i, j int) bool {
+			if column[i].position != column[j].position {
+				return column[i].position < column[j].position
+			}
+			return column[i].id < column[j].id
+		})
+		raws := make([][]byte, len(column))
+		for j, e := range column {
+			raws[j] = e.raw
+		}
+		if summary {
+			var err error
+			if raws, err = summarizeRaw(raws); err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+				return
+			}
+		}
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, '"')
+		body = append(body, status...)
+		body = append(body, `":`...)
+		body = append(body, joinJSON(raws)...)
+	}
+	body = append(body, '}')
+	writeRawJSON(ctx, fasthttp.StatusOK, body)
+}
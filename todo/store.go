@@ -0,0 +1,659 @@
+package todo
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShardCount is the number of shards of the todo store. More shards
+// mean less lock contention between concurrent writers.
+const defaultShardCount = 32
+
+// todoStore keeps todos in memory. The todos are spread over shards keyed by
+// ID, each guarded by its own lock, so writes to different todos rarely wait
+// on each other.
+type todoStore struct {
+	shards []*storeShard
+	// idGen hands out the IDs of new todos, see newIDGenerator. nextID is
+	// the counter of sequential IDs.
+	idGen  IDGenerator
+	nextID atomic.Int64
+	// lastPosition is the highest whole position handed out, see place.
+	lastPosition atomic.Int64
+	// audit, when set, records every change made to the store.
+	audit *auditLog
+	// backend, when set, persists every change made to the store, see
+	// attach.
+	backend todoBackend
+	// changes, when set, numbers every change for replicas, see
+	// getReplicationFeed.
+	changes *changeLog
+	// uuids maps the UUIDs of todos to their IDs, see alias.
+	uuidsMu sync.RWMutex
+	uuids   map[string]int
+}
+
+type storeShard struct {
+	mu    sync.RWMutex
+	todos map[int]*Todo
+}
+
+// errNoChange can be returned by update callbacks to leave the todo as is.
+var errNoChange = errors.New("no change")
+
+// store holds all todos of the server. Its changes are recorded in the
+// activity log and the change log of the replication feed.
+var store = func() *todoStore {
+	s := newTodoStore(defaultShardCount)
+	s.audit = activity
+	s.changes = newChangeLog()
+	return s
+}()
+
+// newTodoStore returns an empty store with n shards.
+func newTodoStore(n int) *todoStore {
+	s := &todoStore{shards: make([]*storeShard, n), uuids: make(map[string]int)}
+	for i := range s.shards {
+		s.shards[i] = &storeShard{todos: make(map[int]*Todo)}
+	}
+	s.idGen = newIDGenerator(s)
+	s.nextID.Store(1)
+	return s
+}
+
+// shardFor returns the shard responsible for the todo with the given ID.
+// Sequential IDs are spread evenly by a plain modulo; the time bits of
+// snowflake IDs are folded in since their low bits hold the node number,
+// which is the same for all IDs of an instance.
+func (s *todoStore) shardFor(id int) *storeShard {
+	return s.shards[s.shardIndex(id)]
+}
+
+func (s *todoStore) shardIndex(id int) int {
+	return int(uint(id^id>>snowflakeTimeShift) % uint(len(s.shards)))
+}
+
+// place puts todos without a position last and makes sure later todos
+// are placed after todos with a position.
+func (s *todoStore) place(todo *Todo) {
+	if todo.Position == 0 {
+		todo.Position = s.nextPosition()
+		return
+	}
+	for {
+		last := s.lastPosition.Load()
+		if todo.Position <= float64(last) || s.lastPosition.CompareAndSwap(last, int64(math.Ceil(todo.Position))) {
+			return
+		}
+	}
+}
+
+// nextPosition returns a position after those of all todos.
+func (s *todoStore) nextPosition() float64 {
+	return float64(s.lastPosition.Add(1))
+}
+
+// reserve makes sure future local IDs don't collide with id.
+func (s *todoStore) reserve(id int) {
+	for {
+		next := s.nextID.Load()
+		if int64(id) < next || s.nextID.CompareAndSwap(next, int64(id)+1) {
+			return
+		}
+	}
+}
+
+// insert assigns a new ID to todo, adds it to the store and returns its
+// JSON encoding. The caller must not touch todo afterwards. actor names who
+// made the change in the audit log, like for all other mutations. If the
+// backend doesn't accept the todo, insert returns a storeError and the
+// todo isn't added.
+func (s *todoStore) insert(actor string, todo *Todo) ([]byte, error) {
+	id, err := s.newID()
+	if err != nil {
+		return nil, err
+	}
+	todo.ID = id
+	s.identify(todo)
+	s.place(todo)
+	saved(todo)
+	raw := todo.raw
+	sh := s.shardFor(todo.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if err := s.persist(todo.ID, todo, 0); err != nil {
+		return nil, err
+	}
+	sh.todos[todo.ID] = todo
+	s.record(actor, auditCreated, todo.ID, nil, raw)
+	return raw, nil
+}
+
+// put adds todo under its own ID, replacing any todo with the same ID, and
+// makes sure future IDs don't collide with it. Todos without an ID get a
+// new one. The caller must not touch todo afterwards. Like insert, it
+// returns a storeError if the backend doesn't accept the todo.
+func (s *todoStore) put(actor string, todo *Todo) error {
+	if todo.ID <= 0 {
+		_, err := s.insert(actor, todo)
+		return err
+	}
+	s.reserve(todo.ID)
+	if s.backend != nil {
+		if err := s.backend.reserveID(todo.ID); err != nil {
+			backendFailed("reserving an ID", err)
+			return &storeError{op: "reserving an ID", err: err}
+		}
+	}
+	s.identify(todo)
+	s.place(todo)
+	saved(todo)
+	sh := s.shardFor(todo.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, ok := sh.todos[todo.ID]
+	var expect int64
+	if ok {
+		expect = old.version
+	}
+	if err := s.persist(todo.ID, todo, expect); err != nil {
+		return err
+	}
+	if ok {
+		s.record(actor, auditUpdated, todo.ID, old.raw, todo.raw)
+	} else {
+		s.record(actor, auditCreated, todo.ID, nil, todo.raw)
+	}
+	sh.todos[todo.ID] = todo
+	return nil
+}
+
+// raw returns the cached JSON encoding of the todo with the given ID.
+func (s *todoStore) raw(id int) ([]byte, bool) {
+	sh := s.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	todo, ok := sh.todos[id]
+	if !ok {
+		return nil, false
+	}
+	return todo.raw, true
+}
+
+// get returns a deep copy of the todo with the given ID. The copy is safe
+// to use after the shard lock is released, even while the todo is updated.
+func (s *todoStore) get(id int) (Todo, bool) {
+	sh := s.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	todo, ok := sh.todos[id]
+	if !ok {
+		return Todo{}, false
+	}
+	return todo.clone(), true
+}
+
+// exists reports whether a todo with the given ID is stored.
+func (s *todoStore) exists(id int) bool {
+	sh := s.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	_, ok := sh.todos[id]
+	return ok
+}
+
+// update calls fn with a copy of the todo with the given ID while holding
+// its shard's write lock, then refreshes the copy's cached JSON, stores it
+// and returns the JSON. fn may veto the update by returning an error, which
+// update returns as is; the stored todo is then left unchanged. update
+// reports false if there is no such todo.
+func (s *todoStore) update(actor string, id int, fn func(todo *Todo) error) ([]byte, bool, error) {
+	sh := s.shardFor(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	todo, ok := sh.todos[id]
+	if !ok {
+		return nil, false, nil
+	}
+	c := todo.clone()
+	if err := fn(&c); err != nil {
+		return nil, true, err
+	}
+	saved(&c)
+	if err := s.persist(id, &c, todo.version); err != nil {
+		return nil, true, err
+	}
+	sh.todos[id] = &c
+	s.record(actor, auditUpdated, id, todo.raw, c.raw)
+	return c.raw, true, nil
+}
+
+// updateMany changes several todos at once: fn is called with copies of
+// the todos with the given IDs, in that order, while the write locks of
+// all their shards are held, and returns the IDs of those to remove. Only
+// when fn succeeds are the others saved and the copies stored. If the
+// backend fails part way, the changes it already accepted are reverted and
+// its storeError is returned, so either all todos change or none does,
+// unless the backend doesn't take a change back either. If one of the
+// todos doesn't exist, updateMany returns its ID without calling fn. The
+// removed todos are returned; they are no longer shared with the store.
+func (s *todoStore) updateMany(actor string, ids []int, fn func(todos []*Todo) ([]int, error)) (removed []*Todo, missing int, err error) {
+	// Shards are locked in index order so concurrent calls can't deadlock.
+	var locked []int
+	for _, id := range ids {
+		if i := s.shardIndex(id); !slices.Contains(locked, i) {
+			locked = append(locked, i)
+		}
+	}
+	sort.Ints(locked)
+	for _, i := range locked {
+		s.shards[i].mu.Lock()
+		defer s.shards[i].mu.Unlock()
+	}
+
+	todos := make([]*Todo, len(ids))
+	before := make([]*Todo, len(ids))
+	for i, id := range ids {
+		todo, ok := s.shardFor(id).todos[id]
+		if !ok {
+			return nil, id, nil
+		}
+		c := todo.clone()
+		todos[i], before[i] = &c, todo
+	}
+	remove, err := fn(todos)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, todo := range todos {
+		var err error
+		if slices.Contains(remove, todo.ID) {
+			err = s.persist(todo.ID, nil, before[i].version)
+		} else {
+			saved(todo)
+			err = s.persist(todo.ID, todo, before[i].version)
+		}
+		if err != nil {
+			return s.revertMany(actor, todos[:i], before[:i], remove), 0, err
+		}
+	}
+	for i, todo := range todos {
+		if slices.Contains(remove, todo.ID) {
+			delete(s.shardFor(todo.ID).todos, todo.ID)
+			s.record(actor, auditDeleted, todo.ID, before[i].raw, nil)
+			removed = append(removed, todo)
+			continue
+		}
+		s.shardFor(todo.ID).todos[todo.ID] = todo
+		s.record(actor, auditUpdated, todo.ID, before[i].raw, todo.raw)
+	}
+	return removed, 0, nil
+}
+
+// revertMany writes the todos in before back to the backend, which accepted
+// the changes of updateMany that turned them into todos, or removed those
+// whose IDs are in remove. A todo the backend doesn't take back keeps its
+// change in memory as well, so the store still matches the backend; the
+// removed todos among them are returned. The caller holds the write locks
+// of the todos' shards.
+func (s *todoStore) revertMany(actor string, todos, before []*Todo, remove []int) (removed []*Todo) {
+	for i, todo := range todos {
+		gone := slices.Contains(remove, todo.ID)
+		expect := int64(0)
+		if !gone {
+			expect = todo.version
+		}
+		if s.persist(todo.ID, before[i], expect) == nil {
+			continue
+		}
+		if gone {
+			delete(s.shardFor(todo.ID).todos, todo.ID)
+			s.record(actor, auditDeleted, todo.ID, before[i].raw, nil)
+			removed = append(removed, todo)
+		} else {
+			s.shardFor(todo.ID).todos[todo.ID] = todo
+			s.record(actor, auditUpdated, todo.ID, before[i].raw, todo.raw)
+		}
+	}
+	return removed
+}
+
+// updateAll calls fn with a copy of every todo while holding the write
+// lock of its shard. When fn reports a change the copy's cached JSON is
+// refreshed and it replaces the todo. Todos the backend fails to save are
+// left unchanged; the failures are logged.
+func (s *todoStore) updateAll(actor string, fn func(todo *Todo) bool) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for id, todo := range sh.todos {
+			c := todo.clone()
+			if !fn(&c) {
+				continue
+			}
+			saved(&c)
+			if s.persist(id, &c, todo.version) != nil {
+				continue
+			}
+			sh.todos[id] = &c
+			s.record(actor, auditUpdated, id, todo.raw, c.raw)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// remove deletes the todo with the given ID and reports whether it existed.
+// The removed todo is returned; it is no longer shared with the store. If
+// the backend doesn't accept the deletion, remove returns a storeError and
+// the todo stays.
+func (s *todoStore) remove(actor string, id int) (*Todo, bool, error) {
+	sh := s.shardFor(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	todo, ok := sh.todos[id]
+	if !ok {
+		return nil, false, nil
+	}
+	if err := s.persist(id, nil, todo.version); err != nil {
+		return nil, true, err
+	}
+	delete(sh.todos, id)
+	s.record(actor, auditDeleted, id, todo.raw, nil)
+	return todo, true, nil
+}
+
+// revert sets the todo with the given ID back to todo, or removes it when
+// todo is nil, and records the change as undoing the audit entry undoes. The
+// todo's links are kept as they are. It fails with errUndoConflict unless
+// the stored todo is still encoded as expect (nil meaning it doesn't exist).
+// revert returns the new JSON encoding, or the removed todo.
+func (s *todoStore) revert(actor string, id int, expect []byte, todo *Todo, undoes int) ([]byte, *Todo, error) {
+	sh := s.shardFor(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	cur, exists := sh.todos[id]
+	var before []byte
+	if exists {
+		before = cur.raw
+	}
+	if !bytes.Equal(before, expect) {
+		return nil, nil, errUndoConflict
+	}
+
+	var after []byte
+	var version int64
+	if exists {
+		version = cur.version
+	}
+	if todo != nil {
+		todo.ID = id
+		todo.Links = nil
+		if exists {
+			todo.Links = cur.Links
+		}
+		todo.UpdatedAt = time.Now()
+		saved(todo)
+		after = todo.raw
+	}
+	if err := s.persist(id, todo, version); err != nil {
+		return nil, nil, err
+	}
+	if todo == nil {
+		delete(sh.todos, id)
+	} else {
+		s.alias(todo)
+		sh.todos[id] = todo
+	}
+	if s.audit != nil {
+		s.audit.append(AuditEntry{Actor: actor, Action: auditUndone, TodoID: id, Undoes: undoes, before: before, after: after})
+	}
+	if todo == nil {
+		return nil, cur, nil
+	}
+	return after, nil, nil
+}
+
+// record adds a change to the audit log, if the store has one. before and
+// after are the todo's JSON encodings; before is nil for created todos and
+// after for deleted ones.
+func (s *todoStore) record(actor, action string, id int, before, after []byte) {
+	if s.audit != nil {
+		s.audit.record(actor, action, id, before, after)
+	}
+}
+
+// creator returns the actor that created the todo with the given ID, or ""
+// if the store has no audit log or it doesn't have the creation. A creation
+// in progress appends to the change log before recording its creator, both
+// holding the lock of the todo's shard, so creator waits for that lock.
+func (s *todoStore) creator(id int) string {
+	if s.audit == nil {
+		return ""
+	}
+	sh := s.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return s.audit.creator(id)
+}
+
+// each calls fn with every todo while holding the read lock of its shard.
+// fn must neither modify the todo nor keep a reference to it or its slices
+// past the call; use clone for that. Iteration stops when fn returns false.
+func (s *todoStore) each(fn func(todo *Todo) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, todo := range sh.todos {
+			if !fn(todo) {
+				sh.mu.RUnlock()
+				return
+			}
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// list returns deep copies of all todos ordered by ID.
+func (s *todoStore) list() []Todo {
+	var list []Todo
+	s.each(func(todo *Todo) bool {
+		list = append(list, todo.clone())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// listedTodos returns deep copies of the listed todos visible passes
+// ordered by ID.
+func (s *todoStore) listedTodos(visible func(todo *Todo) bool) []Todo {
+	var list []Todo
+	s.listedFor(visible, func(todo *Todo) bool {
+		list = append(list, todo.clone())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// listedIDs returns the IDs of the listed todos visible passes in
+// ascending order.
+func (s *todoStore) listedIDs(visible func(todo *Todo) bool) []int {
+	var ids []int
+	s.listedFor(visible, func(todo *Todo) bool {
+		ids = append(ids, todo.ID)
+		return true
+	})
+	sort.Ints(ids)
+	return ids
+}
+
+// ids returns the IDs of all todos in ascending order.
+func (s *todoStore) ids() []int {
+	var ids []int
+	s.each(func(todo *Todo) bool {
+		ids = append(ids, todo.ID)
+		return true
+	})
+	sort.Ints(ids)
+	return ids
+}
+
+// listed calls fn like each with the todos that are listed, leaving out
+// archived ones.
+func (s *todoStore) listed(fn func(todo *Todo) bool) {
+	s.each(func(todo *Todo) bool {
+		return todo.archived() || fn(todo)
+	})
+}
+
+// listedFor calls fn like listed with the listed todos visible passes, or
+// all of them if visible is nil. visible is called with the todo's shard
+// locked for reading.
+func (s *todoStore) listedFor(visible func(todo *Todo) bool, fn func(todo *Todo) bool) {
+	s.listed(func(todo *Todo) bool {
+		return visible != nil && !visible(todo) || fn(todo)
+	})
+}
+
+// rawList returns the cached JSON encodings of the listed todos visible
+// passes ordered by ID.
+func (s *todoStore) rawList(visible func(todo *Todo) bool) [][]byte {
+	type entry struct {
+		id  int
+		raw []byte
+	}
+	var entries []entry
+	s.listedFor(visible, func(todo *Todo) bool {
+		entries = append(entries, entry{todo.ID, todo.raw})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	raws := make([][]byte, len(entries))
+	for i, e := range entries {
+		raws[i] = e.raw
+	}
+	return raws
+}
+
+// rawListByPosition returns the cached JSON encodings of the listed todos
+// visible passes ordered by position, then ID.
+func (s *todoStore) rawListByPosition(visible func(todo *Todo) bool) [][]byte {
+	type entry struct {
+		id       int
+		position float64
+		raw      []byte
+	}
+	var entries []entry
+	s.listedFor(visible, func(todo *Todo) bool {
+		entries = append(entries, entry{todo.ID, todo.Position, todo.raw})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].position != entries[j].position {
+			return entries[i].position < entries[j].position
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	raws := make([][]byte, len(entries))
+	for i, e := range entries {
+		raws[i] = e.raw
+	}
+	return raws
+}
+
+// rawPage returns the cached JSON encodings of up to limit listed todos
+// visible passes with IDs greater than after, ordered by ID, and the cursor
+// of the next page, which is empty if there are no more todos.
+func (s *todoStore) rawPage(visible func(todo *Todo) bool, after, limit int) ([][]byte, string) {
+	type entry struct {
+		id  int
+		raw []byte
+	}
+	var entries []entry
+	s.listedFor(visible, func(todo *Todo) bool {
+		if todo.ID > after {
+			entries = append(entries, entry{todo.ID, todo.raw})
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = encodeCursor(entries[limit-1].id)
+	}
+	raws := make([][]byte, len(entries))
+	for i, e := range entries {
+		raws[i] = e.raw
+	}
+	return raws, next
+}
+
+// saved must be called after every change to a stored todo, with its shard
+// locked for writing. It maintains the fields derived from others and
+// refreshes the cached JSON.
+func saved(todo *Todo) {
+	syncStatus(todo)
+	if !todo.Completed {
+		todo.CompletedAt = nil
+		todo.ArchivedAt = nil
+	} else if todo.CompletedAt == nil {
+		now := time.Now()
+		todo.CompletedAt = &now
+	}
+	trackSubtaskIDs(todo)
+	trackAttachmentIDs(todo)
+	upgradeImages(todo)
+	todo.refreshJSON()
+}
+
+// clone returns a deep copy of the todo that shares no memory with it, so
+// it can be read and modified without holding the shard lock. The cached
+// JSON is shared because it is never modified in place.
+func (t *Todo) clone() Todo {
+	c := *t
+	if t.Attachments != nil {
+		c.Attachments = append([]Attachment(nil), t.Attachments...)
+	}
+	if t.Images != nil {
+		c.Images = append([]string(nil), t.Images...)
+	}
+	if t.Subtasks != nil {
+		c.Subtasks = append([]Subtask(nil), t.Subtasks...)
+	}
+	if t.Tags != nil {
+		c.Tags = append([]string(nil), t.Tags...)
+	}
+	if t.Links != nil {
+		c.Links = append([]Link(nil), t.Links...)
+	}
+	if t.DueAt != nil {
+		dueAt := *t.DueAt
+		c.DueAt = &dueAt
+	}
+	if t.RemindAt != nil {
+		remindAt := *t.RemindAt
+		c.RemindAt = &remindAt
+	}
+	if t.ExpiresAt != nil {
+		expiresAt := *t.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+	if t.CompletedAt != nil {
+		completedAt := *t.CompletedAt
+		c.CompletedAt = &completedAt
+	}
+	if t.ArchivedAt != nil {
+		archivedAt := *t.ArchivedAt
+		c.ArchivedAt = &archivedAt
+	}
+	return c
+}
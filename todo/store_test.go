@@ -0,0 +1,1169 @@
+package todo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A single shard behaves like the former global map guarded by one
+// sync.RWMutex, so it serves as the baseline for the sharded store.
+var benchShardCounts = []int{1, defaultShardCount}
+
+func BenchmarkStoreConcurrentUpdates(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newTodoStore(shards)
+			const n = 1024
+			for i := 0; i < n; i++ {
+				s.insert("test", &Todo{Title: "todo", Subtasks: []Subtask{{Title: "subtask"}}})
+			}
+			var counter atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := int(counter.Add(1)%n) + 1
+					s.update("test", id, func(todo *Todo) error {
+						todo.Title = "updated"
+						return nil
+					})
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStoreConcurrentInserts(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newTodoStore(shards)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.insert("test", &Todo{Title: "todo", Description: "description"})
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStoreMixedReadWrite(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newTodoStore(shards)
+			const n = 1024
+			for i := 0; i < n; i++ {
+				s.insert("test", &Todo{Title: "todo"})
+			}
+			var counter atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c := counter.Add(1)
+					id := int(c%n) + 1
+					// One write for every four reads.
+					if c%5 == 0 {
+						s.update("test", id, func(todo *Todo) error {
+							todo.Completed = !todo.Completed
+							return nil
+						})
+					} else {
+						s.raw(id)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStoreList(b *testing.B) {
+	s := newTodoStore(defaultShardCount)
+	for i := 0; i < 1024; i++ {
+		s.insert("test", &Todo{Title: "todo", Description: "description"})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		joinJSON(s.rawList(nil))
+	}
+}
+
+func BenchmarkStoreSearch(b *testing.B) {
+	s := newTodoStore(defaultShardCount)
+	for i := 0; i < 1024; i++ {
+		s.insert("test", &Todo{Title: fmt.Sprintf("todo %d", i), Description: "Prepare the Q3 report"})
+	}
+	terms := []string{"q3", "report"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.each(func(todo *Todo) bool {
+			matchesTerms(todo, terms)
+			return true
+		})
+	}
+}
+
+func TestStorePutAdvancesNextID(t *testing.T) {
+	s := newTodoStore(4)
+	s.put("test", &Todo{ID: 10, Title: "imported"})
+	s.insert("test", &Todo{Title: "new"})
+	if !s.exists(11) {
+		t.Fatalf("expected inserted todo to get ID 11")
+	}
+	if raw, ok := s.raw(10); !ok || len(raw) == 0 {
+		t.Fatalf("expected imported todo to be stored with its JSON")
+	}
+}
+
+func TestStoreUUIDsResolveToIDs(t *testing.T) {
+	s := newTodoStore(4)
+	s.idGen = uuidIDs{s.idGen}
+	s.insert("test", &Todo{Title: "first"})
+	s.put("test", &Todo{ID: 5, Title: "imported", UUID: "0190B5A4-1C2D-7E3F-8A4B-5C6D7E8F9A0B"})
+
+	first, _ := s.get(1)
+	if !isUUID(first.UUID) || first.UUID[14] != '7' {
+		t.Fatalf("expected a UUIDv7, got %q", first.UUID)
+	}
+	if id, ok := s.resolveUUID(first.UUID); !ok || id != 1 {
+		t.Fatalf("UUID resolved to %d, %v", id, ok)
+	}
+	if id, ok := s.resolveUUID("0190b5a4-1c2d-7e3f-8a4b-5c6d7e8f9a0b"); !ok || id != 5 {
+		t.Fatalf("imported UUID resolved to %d, %v", id, ok)
+	}
+	s.remove("test", 1)
+	if _, ok := s.resolveUUID(first.UUID); !ok {
+		t.Fatal("expected the UUID of a removed todo to keep resolving")
+	}
+	if a, b := newUUIDv7(), newUUIDv7(); a == b || !isUUID(b) {
+		t.Fatalf("expected distinct UUIDs, got %q and %q", a, b)
+	}
+}
+
+func TestSnowflakeIDsAreUniqueAndIncreasing(t *testing.T) {
+	g := &snowflakeIDs{node: 5}
+	// More IDs than fit in a millisecond, to cover borrowing the next one.
+	last := 0
+	for i := 0; i < 3<<snowflakeSeqBits; i++ {
+		id, err := g.NextID()
+		if err != nil || id <= last {
+			t.Fatalf("ID %d after %d: %v", id, last, err)
+		}
+		if node := id >> snowflakeSeqBits & maxSnowflakeNode; node != 5 {
+			t.Fatalf("ID %d has node %d", id, node)
+		}
+		if id >= 1<<53 {
+			t.Fatalf("ID %d doesn't fit in a JavaScript number", id)
+		}
+		last = id
+	}
+}
+
+func TestStoreReadsAreDeepCopies(t *testing.T) {
+	s := newTodoStore(4)
+	s.insert("test", &Todo{Title: "todo", Attachments: []Attachment{{ID: 1, Path: "a.png"}}, Subtasks: []Subtask{{Title: "subtask"}}})
+
+	got, ok := s.get(1)
+	if !ok {
+		t.Fatal("todo not found")
+	}
+	got.Attachments[0].Path = "changed.png"
+	got.Subtasks[0].Completed = true
+	list := s.list()
+	list[0].Subtasks[0].Title = "changed"
+
+	again, _ := s.get(1)
+	if again.Attachments[0].Path != "a.png" || again.Subtasks[0].Completed || again.Subtasks[0].Title != "subtask" {
+		t.Fatalf("modifying a copy changed the stored todo: %+v", again)
+	}
+}
+
+// TestStoreConcurrentReadWrite is meant to be run with -race.
+func TestStoreConcurrentReadWrite(t *testing.T) {
+	s := newTodoStore(4)
+	s.insert("test", &Todo{Title: "todo", Subtasks: []Subtask{{Title: "subtask"}}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.update("test", 1, func(todo *Todo) error {
+					todo.Subtasks[0].Completed = !todo.Subtasks[0].Completed
+					attach(todo, Attachment{Path: "image.png"})
+					return nil
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				todo, _ := s.get(1)
+				_ = todo.Subtasks[0].Completed
+				_ = len(todo.Attachments)
+				s.list()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// memoryBackend is a todoBackend for tests, keeping the todos in a map.
+// Operations fail with err while it is set. calls counts the saves and
+// removals attempted, writes those that succeeded.
+type memoryBackend struct {
+	mu     sync.Mutex
+	todos  map[int]storedTodo
+	next   int
+	err    error
+	calls  int
+	writes int
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{todos: make(map[int]storedTodo)}
+}
+
+func (m *memoryBackend) load() ([]storedTodo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stored []storedTodo
+	for _, t := range m.todos {
+		stored = append(stored, t)
+	}
+	return stored, m.err
+}
+
+func (m *memoryBackend) fetch(id int) (storedTodo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.todos[id], m.err
+}
+
+func (m *memoryBackend) nextID() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	m.next++
+	return m.next, nil
+}
+
+func (m *memoryBackend) reserveID(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next = max(m.next, id)
+	return m.err
+}
+
+func (m *memoryBackend) save(todo *Todo, expect int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.err != nil {
+		return m.err
+	}
+	cur := m.todos[todo.ID]
+	if expect != anyVersion && cur.version != expect {
+		return errVersionConflict
+	}
+	m.todos[todo.ID] = storedTodo{raw: todo.raw, version: cur.version + 1}
+	m.writes++
+	return nil
+}
+
+func (m *memoryBackend) remove(id int, expect int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.err != nil {
+		return m.err
+	}
+	if expect != anyVersion && m.todos[id].version != expect {
+		return errVersionConflict
+	}
+	delete(m.todos, id)
+	m.writes++
+	return nil
+}
+
+// counts returns the saves and removals attempted and succeeded.
+func (m *memoryBackend) counts() (calls, writes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls, m.writes
+}
+
+// title returns the title of the todo with the given ID in the backend.
+func (m *memoryBackend) title(id int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var todo Todo
+	json.Unmarshal(m.todos[id].raw, &todo)
+	return todo.Title
+}
+
+func (m *memoryBackend) watch(ctx context.Context, fn func(id int)) {}
+
+func (m *memoryBackend) fail(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+func TestStoreRefusesChangesTheBackendFails(t *testing.T) {
+	s := newTodoStore(4)
+	b := newMemoryBackend()
+	s.backend = b
+	if _, err := s.insert("test", &Todo{Title: "saved"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b.fail(errors.New("connection refused"))
+	var failed *storeError
+	if _, err := s.insert("test", &Todo{Title: "lost"}); !errors.As(err, &failed) {
+		t.Errorf("insert: got %v, want a storeError", err)
+	}
+	if _, ok, err := s.update("test", 1, func(todo *Todo) error {
+		todo.Title = "lost"
+		return nil
+	}); !ok || !errors.As(err, &failed) {
+		t.Errorf("update: got %v, want a storeError", err)
+	}
+	if _, _, err := s.remove("test", 1); !errors.As(err, &failed) {
+		t.Errorf("remove: got %v, want a storeError", err)
+	}
+	if todo, ok := s.get(1); !ok || todo.Title != "saved" || len(s.ids()) != 1 {
+		t.Errorf("the store has %v, %+v after failed changes, want only the saved todo", s.ids(), todo)
+	}
+}
+
+func TestUpdateManyRevertsWhenTheBackendFailsPartWay(t *testing.T) {
+	s := newTodoStore(4)
+	b := newMemoryBackend()
+	s.backend = b
+	for _, title := range []string{"target", "source", "changed elsewhere"} {
+		if _, err := s.insert("test", &Todo{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another instance changes the last todo, so its save conflicts after
+	// the first two changes were written.
+	b.mu.Lock()
+	b.todos[3] = storedTodo{raw: b.todos[3].raw, version: b.todos[3].version + 1}
+	b.mu.Unlock()
+
+	removed, _, err := s.updateMany("test", []int{1, 2, 3}, func(todos []*Todo) ([]int, error) {
+		for _, todo := range todos {
+			todo.Title = "merged"
+		}
+		return []int{2}, nil
+	})
+	var failed *storeError
+	if !errors.As(err, &failed) || len(removed) != 0 {
+		t.Fatalf("updateMany: got %v and removed %v, want a storeError and nothing removed", err, removed)
+	}
+	if todo, ok := s.get(1); !ok || todo.Title != "target" || b.title(1) != "target" {
+		t.Errorf("the target is %q in memory and %q in the backend, want it unchanged", todo.Title, b.title(1))
+	}
+	if todo, ok := s.get(2); !ok || todo.Title != "source" || b.title(2) != "source" {
+		t.Errorf("the source is %q in memory and %q in the backend, want it back", todo.Title, b.title(2))
+	}
+	// The todos match the backend again, so they can be changed.
+	if _, ok, err := s.update("test", 2, func(todo *Todo) error {
+		todo.Title = "renamed"
+		return nil
+	}); !ok || err != nil {
+		t.Errorf("updating the restored source: %v", err)
+	}
+	if _, ok, err := s.update("test", 1, func(todo *Todo) error {
+		todo.Title = "renamed"
+		return nil
+	}); !ok || err != nil {
+		t.Errorf("updating the target: %v", err)
+	}
+}
+
+func TestStoreDetectsChangesOfOtherInstances(t *testing.T) {
+	b := newMemoryBackend()
+	a := newTodoStore(4)
+	a.backend = b
+	a.insert("test", &Todo{Title: "Draft"})
+	c := newTodoStore(4)
+	stored, _ := b.load()
+	for _, st := range stored {
+		c.apply(0, st)
+	}
+	c.backend = b
+
+	rename := func(s *todoStore, title string) error {
+		_, _, err := s.update("test", 1, func(todo *Todo) error {
+			todo.Title = title
+			return nil
+		})
+		return err
+	}
+	if err := rename(a, "First"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(c, "Second"); !errors.Is(err, errVersionConflict) {
+		t.Fatalf("stale update: got %v, want errVersionConflict", err)
+	}
+	// The conflict reloaded the todo, so a retry is based on the change.
+	if todo, _ := c.get(1); todo.Title != "First" {
+		t.Fatalf("after the conflict the todo is %q, want the other instance's change", todo.Title)
+	}
+	if err := rename(c, "Second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.remove("test", 1); !errors.Is(err, errVersionConflict) {
+		t.Fatalf("stale removal: got %v, want errVersionConflict", err)
+	}
+}
+
+func TestWriteBehindRefusesChangesWhileFull(t *testing.T) {
+	// Without a worker the queue never drains.
+	w := &writeBehind{todoBackend: newMemoryBackend(), batch: 10, interval: time.Hour, limit: 1,
+		pending: make(map[int]pendingWrite), wake: make(chan struct{}, 1)}
+	s := newTodoStore(4)
+	s.backend = w
+	if _, err := s.insert("test", &Todo{Title: "queued"}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.insert("test", &Todo{Title: "refused"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errWriteBehindFull) {
+			t.Errorf("insert into a full queue: got %v, want errWriteBehindFull", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("insert into a full queue blocked")
+	}
+	// Changes of the queued todo replace the queued change.
+	if _, _, err := s.update("test", 1, func(todo *Todo) error {
+		todo.Title = "changed"
+		return nil
+	}); err != nil {
+		t.Errorf("update of the queued todo: %v", err)
+	}
+	if n := w.length(); n != 1 {
+		t.Errorf("%d todos queued, want 1", n)
+	}
+}
+
+// newTestWriteBehind returns a write-behind queue in front of b whose
+// worker isn't running, so tests flush it themselves.
+func newTestWriteBehind(b todoBackend, batch, limit int, interval time.Duration) *writeBehind {
+	return &writeBehind{todoBackend: b, batch: batch, interval: interval, limit: limit,
+		pending: make(map[int]pendingWrite), wake: make(chan struct{}, 1)}
+}
+
+func TestWriteBehindCoalescesChanges(t *testing.T) {
+	b := newMemoryBackend()
+	w := newTestWriteBehind(b, 10, 10, time.Hour)
+	s := newTodoStore(4)
+	s.backend = w
+	s.insert("test", &Todo{Title: "Draft"})
+	s.insert("test", &Todo{Title: "Scratch"})
+	for _, title := range []string{"Second draft", "Final"} {
+		s.update("test", 1, func(todo *Todo) error {
+			todo.Title = title
+			return nil
+		})
+	}
+	s.remove("test", 2)
+	if n := w.length(); n != 2 {
+		t.Fatalf("%d todos queued, want 2", n)
+	}
+	if _, writes := b.counts(); writes != 0 {
+		t.Fatalf("%d changes written before the flush, want 0", writes)
+	}
+
+	if n, err := w.flush(); n != 2 || err != nil {
+		t.Fatalf("flush: got %d, %v, want 2 changes written", n, err)
+	}
+	if _, writes := b.counts(); writes != 2 {
+		t.Errorf("%d changes written, want the latest change of each todo", writes)
+	}
+	if title := b.title(1); title != "Final" {
+		t.Errorf("the backend has %q, want the latest title", title)
+	}
+	if stored, _ := b.fetch(2); stored.raw != nil {
+		t.Error("the removed todo is still in the backend")
+	}
+}
+
+func TestWriteBehindRetriesUntilTheBackendRecovers(t *testing.T) {
+	b := newMemoryBackend()
+	w := newTestWriteBehind(b, 10, 2, time.Millisecond)
+	s := newTodoStore(4)
+	s.backend = w
+	for _, title := range []string{"One", "Two", "Three"} {
+		s.insert("test", &Todo{Title: title})
+		w.flush()
+	}
+
+	b.fail(errors.New("connection refused"))
+	rename := func(id int, title string) error {
+		_, _, err := s.update("test", id, func(todo *Todo) error {
+			todo.Title = title
+			return nil
+		})
+		return err
+	}
+	rename(1, "One, changed")
+	rename(2, "Two, changed")
+	if err := rename(3, "Three, changed"); !errors.Is(err, errWriteBehindFull) {
+		t.Errorf("change of a third todo: got %v, want errWriteBehindFull", err)
+	}
+	calls, _ := b.counts()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+	w.wake <- struct{}{}
+	// Retries back off from 2 ms, doubling each time: within 100 ms the
+	// worker tries about six times, where retrying every interval would
+	// have tried a hundred times.
+	time.Sleep(100 * time.Millisecond)
+	if failed, _ := b.counts(); failed-calls < 2 || failed-calls > 8 {
+		t.Errorf("%d writes attempted while the backend failed, want a few with backoff", failed-calls)
+	}
+	if n := w.length(); n != 2 {
+		t.Errorf("%d todos queued while the backend fails, want the 2 changes kept", n)
+	}
+
+	b.fail(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for w.length() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.title(1) != "One, changed" || b.title(2) != "Two, changed" {
+		t.Errorf("after recovering the backend has %q and %q, want the queued changes", b.title(1), b.title(2))
+	}
+	if err := rename(3, "Three, changed"); err != nil {
+		t.Errorf("change of a third todo after the queue drained: %v", err)
+	}
+	cancel()
+	<-done
+}
+
+func TestWriteBehindFlushesOnClose(t *testing.T) {
+	b := newMemoryBackend()
+	w := newTestWriteBehind(b, 1, 10, time.Hour)
+	s := newTodoStore(4)
+	s.backend = w
+	for _, title := range []string{"One", "Two", "Three"} {
+		s.insert("test", &Todo{Title: title})
+	}
+	w.close()
+	if _, writes := b.counts(); writes != 3 || w.length() != 0 {
+		t.Errorf("close wrote %d changes and left %d queued, want all 3 written", writes, w.length())
+	}
+	// Once closed, changes are written through.
+	s.update("test", 1, func(todo *Todo) error {
+		todo.Title = "Closed"
+		return nil
+	})
+	if title := b.title(1); title != "Closed" || w.length() != 0 {
+		t.Errorf("change after close: the backend has %q, want it written through", title)
+	}
+}
+
+func TestShareChangesReachReplicas(t *testing.T) {
+	primary := newShareTable(newChangeLog())
+	primary.grant(1, "", Share{User: "bob", Role: "editor"})
+	primary.grant(0, "work", Share{User: "carol", Role: "viewer"})
+	primary.revoke(1, "", "bob")
+
+	replica := newShareTable(nil)
+	replica.replace(primary.all())
+	changes, _, _ := primary.changes.since(0)
+	if len(changes) != 3 {
+		t.Fatalf("the change log has %d changes, want 3", len(changes))
+	}
+	replica.set(*changes[0].grants)
+	replica.set(*changes[1].grants)
+	todo := &Todo{ID: 1, Project: "work"}
+	if p := replica.permission("bob", todo); p != permEditor {
+		t.Errorf("bob has permission %d before the revocation, want editor", p)
+	}
+	replica.set(*changes[2].grants)
+	if p := replica.permission("bob", todo); p != permNone {
+		t.Errorf("bob has permission %d after the revocation, want none", p)
+	}
+	if p := replica.permission("carol", todo); p != permViewer {
+		t.Errorf("carol has permission %d on the project, want viewer", p)
+	}
+}
+
+func TestSQLiteStoreMigratesAndKeepsTodos(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todos.db")
+	migrations, err := fs.ReadDir(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() *sqlStore {
+		t.Helper()
+		db, err := openSQLStore(sqliteDialect, path, 1, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var applied int
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("%d migrations recorded, want %d", applied, len(migrations))
+		}
+		return db
+	}
+
+	db := open()
+	s := newTodoStore(4)
+	if err := s.attach(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.insert("test", &Todo{Title: "Draft"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.update("test", 1, func(todo *Todo) error {
+		todo.Title = "Final"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The update made version 2, so a change based on version 1 is stale.
+	if err := db.save(&Todo{ID: 1, Title: "Stale", raw: []byte(`{"id":1,"title":"Stale"}`)}, 1); !errors.Is(err, errVersionConflict) {
+		t.Errorf("stale save: got %v, want errVersionConflict", err)
+	}
+	db.db.Close()
+
+	// Reopening applies no migration twice and finds the todo.
+	db = open()
+	defer db.db.Close()
+	s = newTodoStore(4)
+	if err := s.attach(db); err != nil {
+		t.Fatal(err)
+	}
+	if todo, ok := s.get(1); !ok || todo.Title != "Final" {
+		t.Errorf("after reopening the store has %+v, want the updated todo", todo)
+	}
+	if id, err := db.nextID(); err != nil || id != 2 {
+		t.Errorf("next ID after reopening: got %d, %v, want 2", id, err)
+	}
+}
+
+// TestPostgresStore runs against the database at TODO_TEST_POSTGRES_URL, a
+// postgres:// URL, in a schema of its own that it drops afterwards.
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("TODO_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TODO_TEST_POSTGRES_URL isn't set")
+	}
+	admin, release, err := openPostgres(url, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(release)
+	t.Cleanup(func() { admin.Close() })
+	schema := "todo_test_" + randomToken(4)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run last to first, so the schema is dropped after the
+	// stores opened below are closed.
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	url += sep + "search_path=" + schema
+
+	open := func() (*sqlStore, *todoStore) {
+		t.Helper()
+		db, err := openSQLStore(postgresDialect, url, 4, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(db.close)
+		s := newTodoStore(4)
+		if err := s.attach(db); err != nil {
+			t.Fatal(err)
+		}
+		return db, s
+	}
+	dbA, a := open()
+	dbB, b := open()
+	if err := dbA.ping(context.Background()); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if _, err := a.insert("test", &Todo{Title: "Draft", Subtasks: []Subtask{{Title: "Outline"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var subtask string
+	if err := dbA.db.QueryRow("SELECT subtasks->0->>'title' FROM todos WHERE id = 1").Scan(&subtask); err != nil || subtask != "Outline" {
+		t.Errorf("subtasks column: got %q, %v, want the subtask title", subtask, err)
+	}
+
+	// b learns of the todo from the changes a recorded.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dbB.watch(ctx, func(id int) {
+		if stored, err := dbB.fetch(id); err == nil {
+			b.applyRemote(id, stored)
+		}
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if todo, ok := b.get(1); ok && todo.Title == "Draft" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the other instance didn't pick up the new todo")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if _, _, err := a.update("test", 1, func(todo *Todo) error {
+		todo.Title = "First"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.update("test", 1, func(todo *Todo) error {
+		todo.Title = "Second"
+		return nil
+	}); !errors.Is(err, errVersionConflict) {
+		t.Errorf("stale update: got %v, want errVersionConflict", err)
+	}
+}
+
+// testCluster connects cluster nodes in memory. Nodes that are down
+// neither send nor answer requests.
+type testCluster struct {
+	nodes map[string]*clusterNode
+
+	mu        sync.Mutex
+	positions map[string]clusterPosition
+	down      map[string]bool
+	changes   []string
+}
+
+func newTestCluster(names ...string) *testCluster {
+	c := &testCluster{nodes: make(map[string]*clusterNode), positions: make(map[string]clusterPosition), down: make(map[string]bool)}
+	for _, self := range names {
+		var peers []string
+		for _, p := range names {
+			if p != self {
+				peers = append(peers, p)
+			}
+		}
+		n := newClusterNode(self, peers)
+		n.call = func(ctx context.Context, peer, rpc string, req, resp interface{}) error {
+			c.mu.Lock()
+			down := c.down[self] || c.down[peer]
+			c.mu.Unlock()
+			if down {
+				return errors.New("unreachable")
+			}
+			switch rpc {
+			case "vote":
+				*resp.(*voteResponse) = c.nodes[peer].vote(req.(voteRequest), time.Now())
+			case "heartbeat":
+				*resp.(*heartbeatResponse) = c.nodes[peer].heartbeat(req.(heartbeatRequest), time.Now())
+			}
+			return nil
+		}
+		n.position = func() clusterPosition {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.positions[self]
+		}
+		n.changed = func(role, leader string, term uint64) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.changes = append(c.changes, fmt.Sprintf("%s: %s of %q in term %d", self, role, leader, term))
+		}
+		c.nodes[self] = n
+	}
+	return c
+}
+
+func (c *testCluster) set(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn()
+}
+
+func (c *testCluster) expect(t *testing.T, name, role, leader string, term uint64) {
+	t.Helper()
+	if r, l, n := c.nodes[name].status(); r != role || l != leader || n != term {
+		t.Errorf("%s is %s of %q in term %d, want %s of %q in term %d", name, r, l, n, role, leader, term)
+	}
+}
+
+func TestClusterElectsLeaders(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	ctx := context.Background()
+	now := time.Now()
+
+	c.nodes["a"].campaign(ctx, now)
+	c.expect(t, "a", nodeLeader, "a", 1)
+	c.expect(t, "b", nodeFollower, "a", 1)
+	c.expect(t, "c", nodeFollower, "a", 1)
+	if resp := c.nodes["c"].vote(voteRequest{Term: 1, Candidate: "b"}, now); resp.Granted {
+		t.Error("c voted twice in term 1")
+	}
+
+	// a fails. c is behind b, so b doesn't vote for it, and a majority
+	// elects b instead.
+	c.set(func() {
+		c.down["a"] = true
+		c.positions["b"] = clusterPosition{Term: 1, Seq: 10}
+		c.positions["c"] = clusterPosition{Term: 1, Seq: 5}
+	})
+	c.nodes["c"].campaign(ctx, now)
+	c.expect(t, "c", nodeCandidate, "", 2)
+	c.nodes["b"].campaign(ctx, now)
+	c.expect(t, "b", nodeLeader, "b", 3)
+	c.expect(t, "c", nodeFollower, "b", 3)
+
+	// a comes back and learns of the newer term from its first heartbeat.
+	c.expect(t, "a", nodeLeader, "a", 1)
+	c.set(func() { c.down["a"] = false })
+	c.nodes["a"].broadcast(ctx, now)
+	c.expect(t, "a", nodeFollower, "", 3)
+	c.nodes["b"].broadcast(ctx, now)
+	c.expect(t, "a", nodeFollower, "b", 3)
+
+	// Cut off from the others, b steps down once an election timeout
+	// passes without a majority hearing it.
+	c.set(func() {
+		c.down["a"] = true
+		c.down["c"] = true
+	})
+	c.nodes["b"].broadcast(ctx, now)
+	c.expect(t, "b", nodeLeader, "b", 3)
+	c.nodes["b"].broadcast(ctx, now.Add(2*clusterElectionTimeout))
+	c.expect(t, "b", nodeFollower, "", 3)
+
+	want := []string{
+		`b: follower of "a" in term 1`,
+		`c: follower of "a" in term 1`,
+		`a: leader of "a" in term 1`,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range want {
+		if !slices.Contains(c.changes, w) {
+			t.Errorf("changes %q lack %q", c.changes, w)
+		}
+	}
+}
+
+func TestRedisConnReadsReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &redisConn{c: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+	cmds := [][]string{{"SET", "k", "v 1"}, {"INCR", "n"}, {"GET", "k"}, {"GET", "missing"}, {"EXEC"}, {"LPUSH", "k", "x"}}
+	sent := make(chan string, 1)
+	encoded := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\nv 1\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n*1\r\n$4\r\nEXEC\r\n*3\r\n$5\r\nLPUSH\r\n$1\r\nk\r\n$1\r\nx\r\n"
+	go func() {
+		defer server.Close()
+		buf := make([]byte, len(encoded))
+		io.ReadFull(server, buf)
+		sent <- string(buf)
+		io.WriteString(server, "+OK\r\n:42\r\n$3\r\nv 1\r\n$-1\r\n*3\r\n:1\r\n-ERR boom\r\n$0\r\n\r\n-WRONGTYPE not a list\r\n")
+	}()
+
+	replies, err := conn.pipeline(time.Second, cmds)
+	if err == nil || err.Error() != "redis: WRONGTYPE not a list" {
+		t.Errorf("got error %v, want the WRONGTYPE reply", err)
+	}
+	want := []interface{}{"OK", int64(42), []byte("v 1"), nil, []interface{}{int64(1), redisError("ERR boom"), []byte{}}, nil}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("got replies %#v, want %#v", replies, want)
+	}
+	if got := <-sent; got != encoded {
+		t.Errorf("sent %q, want %q", got, encoded)
+	}
+}
+
+func TestRedisConnRejectsMalformedReplies(t *testing.T) {
+	for _, reply := range []string{"OK\n", "+OK\n", "?what\r\n", "$5\r\nab"} {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(server, reply)
+			server.Close()
+		}()
+		conn := &redisConn{c: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+		if got, err := conn.readReply(); err == nil {
+			t.Errorf("reply %q: got %#v, want an error", reply, got)
+		}
+		client.Close()
+	}
+}
+
+// fakeRedis serves the commands of redisStore from memory over RESP, with
+// the save and remove scripts implemented in Go.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	conns     []net.Conn
+	commands  []string
+	hashes    map[string]map[string]string
+	values    map[string]int64
+	sets      map[string]map[string]float64
+	published []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, hashes: make(map[string]map[string]string), values: make(map[string]int64),
+		sets: make(map[string]map[string]float64)}
+	t.Cleanup(func() { ln.Close(); f.drop() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, c)
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// drop closes all connections, like a restarting server.
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	conn := &redisConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	var queued [][]string
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args[0])
+		switch {
+		case args[0] == "MULTI":
+			queued = [][]string{}
+			writeRESP(conn.w, "OK")
+		case args[0] == "EXEC":
+			results := make([]interface{}, len(queued))
+			for i, cmd := range queued {
+				results[i] = f.exec(cmd)
+			}
+			queued = nil
+			writeRESP(conn.w, results)
+		case queued != nil:
+			queued = append(queued, args)
+			writeRESP(conn.w, "QUEUED")
+		default:
+			writeRESP(conn.w, f.exec(args))
+		}
+		f.mu.Unlock()
+		conn.w.Flush()
+	}
+}
+
+// exec runs a command. The caller holds f.mu.
+func (f *fakeRedis) exec(args []string) interface{} {
+	switch args[0] {
+	case "PING":
+		return "PONG"
+	case "AUTH", "SELECT":
+		return "OK"
+	case "INCR":
+		f.values[args[1]]++
+		return f.values[args[1]]
+	case "HMGET":
+		var fields []interface{}
+		for _, field := range args[2:] {
+			if v, ok := f.hashes[args[1]][field]; ok {
+				fields = append(fields, []byte(v))
+			} else {
+				fields = append(fields, nil)
+			}
+		}
+		return fields
+	case "ZRANGE":
+		var ids []int
+		for member := range f.sets[args[1]] {
+			id, _ := strconv.Atoi(member)
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		var members []interface{}
+		for _, id := range ids {
+			members = append(members, []byte(strconv.Itoa(id)))
+		}
+		return members
+	case "EVAL":
+		keys, argv := args[3:6], args[6:]
+		hash := f.hashes[keys[0]]
+		version := int64(0)
+		if hash != nil {
+			version = 1
+			if v, ok := hash["version"]; ok {
+				version, _ = strconv.ParseInt(v, 10, 64)
+			}
+		}
+		if expect, _ := strconv.ParseInt(argv[0], 10, 64); expect >= 0 && version != expect {
+			return int64(0)
+		}
+		for _, set := range keys[1:] {
+			if f.sets[set] == nil {
+				f.sets[set] = make(map[string]float64)
+			}
+		}
+		switch args[1] {
+		case redisSaveScript:
+			f.hashes[keys[0]] = map[string]string{"json": argv[1], "version": strconv.FormatInt(version+1, 10)}
+			f.sets[keys[1]][argv[2]], _ = strconv.ParseFloat(argv[2], 64)
+			f.sets[keys[2]][argv[2]], _ = strconv.ParseFloat(argv[3], 64)
+			f.published = append(f.published, argv[6])
+		case redisRemoveScript:
+			delete(f.hashes, keys[0])
+			delete(f.sets[keys[1]], argv[1])
+			delete(f.sets[keys[2]], argv[1])
+			f.published = append(f.published, argv[3])
+		default:
+			return redisError("NOSCRIPT unknown script")
+		}
+		return int64(1)
+	}
+	return redisError("ERR unknown command " + args[0])
+}
+
+// writeRESP writes a reply as returned by redisConn.readReply.
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	}
+}
+
+func TestRedisStoreChecksVersions(t *testing.T) {
+	f := newFakeRedis(t)
+	newBackend := func(instance string) *redisStore {
+		return &redisStore{pool: newRedisPool(f.ln.Addr().String(), "secret", 2, 2, time.Second), prefix: "t:", instance: instance}
+	}
+	ra := newBackend("a")
+	a := newTodoStore(4)
+	a.backend = ra
+	if _, err := a.insert("test", &Todo{Title: "Draft"}); err != nil {
+		t.Fatal(err)
+	}
+	b := newTodoStore(4)
+	b.backend = newBackend("b")
+	stored, err := b.backend.load()
+	if err != nil || len(stored) != 1 || stored[0].version != 1 {
+		t.Fatalf("loaded %v, %v, want the todo at version 1", stored, err)
+	}
+	b.apply(0, stored[0])
+
+	rename := func(s *todoStore, title string) error {
+		_, _, err := s.update("test", 1, func(todo *Todo) error {
+			todo.Title = title
+			return nil
+		})
+		return err
+	}
+	if err := rename(a, "First"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(b, "Second"); !errors.Is(err, errVersionConflict) {
+		t.Fatalf("stale update: got %v, want errVersionConflict", err)
+	}
+	if todo, _ := b.get(1); todo.Title != "First" {
+		t.Fatalf("after the conflict the todo is %q, want the other instance's change", todo.Title)
+	}
+	if err := rename(b, "Second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.remove("test", 1); !errors.Is(err, errVersionConflict) {
+		t.Fatalf("stale removal: got %v, want errVersionConflict", err)
+	}
+	if _, _, err := b.remove("test", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	if got, want := f.published, []string{"a 1", "a 1", "b 1", "b 1"}; !slices.Equal(got, want) {
+		t.Errorf("published %q, want %q", got, want)
+	}
+	if len(f.commands) < 2 || f.commands[0] != "AUTH" || f.commands[1] != "SELECT" {
+		t.Errorf("new connections sent %q first, want AUTH and SELECT", f.commands)
+	}
+	f.mu.Unlock()
+
+	// Commands failing on a connection the server closed are retried on a
+	// new one.
+	f.drop()
+	if err := ra.ping(context.Background()); err != nil {
+		t.Errorf("ping after the server dropped the connections: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// strictJSON makes JSON bodies with unknown fields fail with 400 Bad
+// Request instead of ignoring those fields. Requests can override it with
+// ?strict=true or ?strict=false.
+var strictJSON bool
+
+// todoFields are the fields todos are created and updated with.
+var todoFields = []string{
+	"title", "description", "priority", "project", "tags", "assignee",
+	"due_at", "remind_at", "expires_at", "ttl", "recurrence", "subtasks", "status",
+	"completed",
+}
+
+// strictRequested reports whether unknown JSON fields are rejected for the
+// request.
+func strictRequested(ctx *fasthttp.RequestCtx) bool {
+	if v := ctx.QueryArgs().Peek("strict"); v != nil {
+		if strict, err := strconv.ParseBool(string(v)); err == nil {
+			return strict
+		}
+	}
+	return strictJSON
+}
+
+// decodeJSONBody unmarshals the JSON request body into v. In strict mode
+// it lists every unknown field of the body. It responds with 400 Bad
+// Request and reports false if the body can't be used.
+func decodeJSONBody(ctx *fasthttp.RequestCtx, v any) bool {
+	defer traceOp(ctx, "request.parse")()
+	body := ctx.PostBody()
+	if !strictRequested(ctx) {
+		if err := json.Unmarshal(body, v); err != nil {
+			ctx.Error("Invalid JSON body", fasthttp.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil {
+		if unknown := unknownKeys(fields, jsonFieldNames(reflect.TypeOf(v))); len(unknown) > 0 {
+			writeUnknownFields(ctx, unknown)
+			return false
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		// Unknown fields of nested objects only show up here.
+		if name, ok := unknownFieldName(err); ok {
+			writeUnknownFields(ctx, []string{name})
+			return false
+		}
+		ctx.Error("Invalid JSON body", fasthttp.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// unknownKeys returns the sorted keys of fields not in known. Like
+// encoding/json, keys match case-insensitively.
+func unknownKeys(fields map[string]json.RawMessage, known []string) []string {
+	var unknown []string
+	for key := range fields {
+		found := false
+		for _, name := range known {
+			if strings.EqualFold(key, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonFieldNames returns the JSON names of the fields of the struct t (or
+// pointer to one), including those of embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// unknownFieldName extracts the field name from the error returned by a
+// decoder that disallows unknown fields.
+func unknownFieldName(err error) (string, bool) {
+	name, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !ok {
+		return "", false
+	}
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		name = unquoted
+	}
+	return name, true
+}
+
+// unknownFieldMessage is the message of the field errors reporting unknown
+// fields.
+const unknownFieldMessage = "unknown field"
+
+// writeUnknownFields responds with 400 Bad Request listing unknown fields.
+func writeUnknownFields(ctx *fasthttp.RequestCtx, names []string) {
+	errs := make([]fieldError, len(names))
+	for i, name := range names {
+		errs[i] = fieldError{Field: name, Message: unknownFieldMessage}
+	}
+	writeFieldErrors(ctx, fasthttp.StatusBadRequest, "Unknown fields in JSON body", errs)
+}
+
+// unknownFields returns the fields reported unknown among errs, such as
+// those of subtasks parsed in strict mode. They are rejected with 400 Bad
+// Request before the values are validated.
+func unknownFields(errs []fieldError) []string {
+	var names []string
+	for _, e := range errs {
+		if e.Message == unknownFieldMessage {
+			names = append(names, e.Field)
+		}
+	}
+	return names
+}
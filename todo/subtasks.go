@@ -0,0 +1,260 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// assignSubtaskIDs gives the subtasks sent for todo their IDs. Subtasks
+// without an ID are new and get the next free one; subtasks with an ID must
+// refer to a current subtask of todo, so IDs stay stable across updates and
+// are never reused. It must be called with the todo's shard locked, or
+// before the todo is stored.
+func assignSubtaskIDs(todo *Todo, subtasks []Subtask) error {
+	known := make(map[int]bool, len(todo.Subtasks))
+	for _, st := range todo.Subtasks {
+		known[st.ID] = true
+	}
+	seen := make(map[int]bool, len(subtasks))
+	for _, st := range subtasks {
+		if st.ID == 0 {
+			continue
+		}
+		if !known[st.ID] {
+			return fmt.Errorf("unknown subtask ID %d", st.ID)
+		}
+		if seen[st.ID] {
+			return fmt.Errorf("duplicate subtask ID %d", st.ID)
+		}
+		seen[st.ID] = true
+	}
+
+	next := max(todo.nextSubtaskID, 1)
+	for i := range subtasks {
+		if subtasks[i].ID == 0 {
+			subtasks[i].ID = next
+			next++
+		}
+	}
+	todo.nextSubtaskID = next
+	return nil
+}
+
+// trackSubtaskIDs makes sure the todo's next subtask ID is above the IDs of
+// all its subtasks, such as those of an imported todo.
+func trackSubtaskIDs(todo *Todo) {
+	for _, st := range todo.Subtasks {
+		if st.ID >= todo.nextSubtaskID {
+			todo.nextSubtaskID = st.ID + 1
+		}
+	}
+}
+
+// subtaskPolicy limits the subtasks of a todo.
+type subtaskPolicy struct {
+	// maxCount is the maximum number of subtasks.
+	maxCount int
+	// maxTitle is the maximum length of a title in characters.
+	maxTitle int
+	// uniqueTitles rejects subtasks whose titles only differ in case.
+	uniqueTitles bool
+}
+
+// subtaskRules is the policy enforced on incoming subtasks.
+var subtaskRules = subtaskPolicy{maxCount: 100, maxTitle: 200}
+
+// fieldError describes why a field of a request is invalid. Field is the
+// path of the field, such as "subtasks[2].title". Rule names the soft
+// validation rule that found the problem, see softRules.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// writeValidationErrors responds with 422 Unprocessable Entity and a JSON
+// body listing errs. It is meant for bodies that parse but hold invalid
+// values; see writeUnknownFields for strict mode.
+func writeValidationErrors(ctx *fasthttp.RequestCtx, msg string, errs []fieldError) {
+	writeFieldErrors(ctx, fasthttp.StatusUnprocessableEntity, msg, errs)
+}
+
+// writeFieldErrors responds with status and a JSON body listing errs.
+func writeFieldErrors(ctx *fasthttp.RequestCtx, status int, msg string, errs []fieldError) {
+	writeJSON(ctx, status, map[string]interface{}{
+		"error":  msg,
+		"errors": errs,
+	})
+}
+
+// parseSubtasks decodes the JSON array of subtasks sent with a todo and
+// normalizes them. It reports every problem found, with the index of the
+// offending subtask. An empty string means no subtasks. With strict set,
+// subtasks with unknown fields are rejected.
+func parseSubtasks(s string, strict bool) ([]Subtask, []fieldError) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(s), &items); err != nil {
+		return nil, []fieldError{{Field: "subtasks", Message: "must be a JSON array of subtasks"}}
+	}
+
+	var errs []fieldError
+	subtasks := make([]Subtask, len(items))
+	for i, item := range items {
+		dec := json.NewDecoder(bytes.NewReader(item))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(&subtasks[i]); err != nil {
+			if name, ok := unknownFieldName(err); ok {
+				errs = append(errs, fieldError{
+					Field:   fmt.Sprintf("subtasks[%d].%s", i, name),
+					Message: unknownFieldMessage,
+				})
+				continue
+			}
+			errs = append(errs, fieldError{
+				Field:   fmt.Sprintf("subtasks[%d]", i),
+				Message: "must be an object with a title, and optionally an id and completed flag",
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if errs := normalizeSubtasks(subtasks); len(errs) > 0 {
+		return nil, errs
+	}
+	return subtasks, nil
+}
+
+// normalizeSubtasks trims the titles of subtasks and checks them against
+// subtaskRules, reporting every problem with the index of the offending
+// subtask.
+func normalizeSubtasks(subtasks []Subtask) []fieldError {
+	var errs []fieldError
+	if len(subtasks) > subtaskRules.maxCount {
+		errs = append(errs, fieldError{
+			Field:   "subtasks",
+			Message: fmt.Sprintf("must not have more than %d subtasks", subtaskRules.maxCount),
+		})
+	}
+	titles := make(map[string]int)
+	for i := range subtasks {
+		field := fmt.Sprintf("subtasks[%d]", i)
+		st := &subtasks[i]
+		st.Title = strings.TrimSpace(st.Title)
+		switch n := utf8.RuneCountInString(st.Title); {
+		case n == 0:
+			errs = append(errs, fieldError{Field: field + ".title", Message: "must not be empty"})
+			continue
+		case n > subtaskRules.maxTitle:
+			errs = append(errs, fieldError{
+				Field:   field + ".title",
+				Message: fmt.Sprintf("must not be longer than %d characters", subtaskRules.maxTitle),
+			})
+		}
+		if subtaskRules.uniqueTitles {
+			key := strings.ToLower(st.Title)
+			if first, dup := titles[key]; dup {
+				errs = append(errs, fieldError{
+					Field:   field + ".title",
+					Message: fmt.Sprintf("duplicates the title of subtasks[%d]", first),
+				})
+			} else {
+				titles[key] = i
+			}
+		}
+	}
+	return errs
+}
+
+// completeAllSubtasks handles POST /todos/{id}/subtasks/complete-all, which
+// completes every subtask of the todo and so the todo itself, without
+// sending the subtasks back. Todos without subtasks are left as they are,
+// and those the workflow doesn't let move to done, such as blocked ones,
+// are refused with 409 Conflict.
+func completeAllSubtasks(ctx *fasthttp.RequestCtx, id int) {
+	ns := namespaceOf(ctx)
+	raw, ok, err := ns.changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		if len(todo.Subtasks) == 0 || checkAllSubtasksCompleted(todo.Subtasks) {
+			return errNoChange
+		}
+		for i := range todo.Subtasks {
+			todo.Subtasks[i].Completed = true
+		}
+		if err := completeBySubtasks(todo); err != nil {
+			return err
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if err == errNoChange {
+		raw, ok = ns.store.raw(id)
+		err = nil
+	}
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
+
+// toggleTodo handles POST /todos/{id}/toggle, which completes an open todo
+// and reopens a completed one, together with all its subtasks. The status
+// moves to done or back to in_progress, following the workflow.
+func toggleTodo(ctx *fasthttp.RequestCtx, id int) {
+	raw, ok, err := namespaceOf(ctx).changeTodo(actorOf(ctx), id, func(todo *Todo) error {
+		completed := !todo.Completed
+		status := statusInProgress
+		if completed {
+			status = statusDone
+		}
+		if err := setStatus(todo, status); err != nil {
+			return err
+		}
+		for i := range todo.Subtasks {
+			todo.Subtasks[i].Completed = completed
+		}
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if !ok {
+		todoNotFound(ctx, id)
+		return
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusOK, raw)
+}
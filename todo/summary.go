@@ -0,0 +1,96 @@
+package todo
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TodoSummary is the compact representation of a todo returned by
+// GET /todos?view=summary for list screens.
+type TodoSummary struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Completed bool   `json:"completed"`
+	Status    string `json:"status"`
+	// Progress is the percentage of completed subtasks; a completed todo is
+	// always at 100.
+	Progress int           `json:"progress"`
+	Counts   SummaryCounts `json:"counts"`
+}
+
+// SummaryCounts counts the parts of a todo left out of its summary.
+type SummaryCounts struct {
+	Subtasks          int `json:"subtasks"`
+	CompletedSubtasks int `json:"completed_subtasks"`
+	Attachments       int `json:"attachments"`
+	Links             int `json:"links"`
+}
+
+// summarize returns the summary of todo.
+func summarize(todo *Todo) TodoSummary {
+	s := TodoSummary{
+		ID:        todo.ID,
+		Title:     todo.Title,
+		Completed: todo.Completed,
+		Status:    todo.Status,
+		Counts: SummaryCounts{
+			Subtasks:    len(todo.Subtasks),
+			Attachments: len(todo.Attachments),
+			Links:       len(todo.Links),
+		},
+	}
+	for _, st := range todo.Subtasks {
+		if st.Completed {
+			s.Counts.CompletedSubtasks++
+		}
+	}
+	switch {
+	case todo.Completed:
+		s.Progress = 100
+	case s.Counts.Subtasks > 0:
+		s.Progress = s.Counts.CompletedSubtasks * 100 / s.Counts.Subtasks
+	}
+	return s
+}
+
+// validView reports whether view names a list representation of todos.
+func validView(view string) bool {
+	return view == "" || view == "full" || view == "summary"
+}
+
+// getTodoSummaries handles GET /todos?view=summary, ordered by ID or, if
+// byPosition is set, by position.
+func getTodoSummaries(ctx *fasthttp.RequestCtx, byPosition bool) {
+	visible, ok := visibleTodos(ctx)
+	if !ok {
+		return
+	}
+	todos := namespaceOf(ctx).store.listedTodos(visible)
+	if byPosition {
+		sortByPosition(todos)
+	}
+	summaries := make([]TodoSummary, len(todos))
+	for i := range todos {
+		summaries[i] = summarize(&todos[i])
+	}
+	writeJSON(ctx, fasthttp.StatusOK, summaries)
+}
+
+// summarizeRaw returns the JSON encodings of the summaries of the todos
+// encoded in raws.
+func summarizeRaw(raws [][]byte) ([][]byte, error) {
+	out := make([][]byte, len(raws))
+	for i, raw := range raws {
+		var todo Todo
+		if err := json.Unmarshal(raw, &todo); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(summarize(&todo))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = b
+	}
+	return out, nil
+}
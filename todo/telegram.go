@@ -0,0 +1,300 @@
+package todo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// telegramAPI is the base URL of the Telegram Bot API.
+const telegramAPI = "https://api.telegram.org"
+
+// telegramLinkTTL is how long a link code can be sent to the bot.
+const telegramLinkTTL = 10 * time.Minute
+
+// telegramListLimit caps the number of todos /list replies with.
+const telegramListLimit = 20
+
+// A telegramLink is a pending link code and the user it links a chat to.
+type telegramLink struct {
+	user      string
+	expiresAt time.Time
+}
+
+var (
+	// telegramChats maps the linked chats to their users.
+	telegramChats = make(map[int64]string)
+	telegramLinks = make(map[string]telegramLink)
+	telegramMu    sync.Mutex
+)
+
+// createTelegramLink handles POST /me/telegram and responds with a one-time
+// code that links the Telegram chat it is sent from to the caller.
+func createTelegramLink(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	code := randomToken(8)
+	expiresAt := time.Now().Add(telegramLinkTTL)
+
+	telegramMu.Lock()
+	for c, link := range telegramLinks {
+		if time.Now().After(link.expiresAt) {
+			delete(telegramLinks, c)
+		}
+	}
+	telegramLinks[code] = telegramLink{user: caller.name, expiresAt: expiresAt}
+	telegramMu.Unlock()
+
+	writeJSON(ctx, fasthttp.StatusCreated, map[string]interface{}{
+		"code":       code,
+		"command":    "/link " + code,
+		"expires_at": expiresAt,
+	})
+}
+
+// deleteTelegramLinks handles DELETE /me/telegram and unlinks every chat
+// linked to the caller.
+func deleteTelegramLinks(ctx *fasthttp.RequestCtx) {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	telegramMu.Lock()
+	for chat, user := range telegramChats {
+		if user == caller.name {
+			delete(telegramChats, chat)
+		}
+	}
+	telegramMu.Unlock()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// telegramHelp is the reply to /start, /help and unknown commands.
+const telegramHelp = `Commands:
+/link CODE - link this chat to your account, get a code from POST /v1/me/telegram
+/list - list your newest open todos
+/add TITLE - add a todo
+/done ID - complete a todo
+/unlink - unlink this chat`
+
+// telegramReply runs the chat command text sent from chat and returns the
+// reply.
+func telegramReply(chat int64, text string) string {
+	command, arg, _ := strings.Cut(strings.TrimSpace(text), " ")
+	// In groups commands may be addressed as /list@SomeBot.
+	command, _, _ = strings.Cut(command, "@")
+	arg = strings.TrimSpace(arg)
+
+	if command == "/link" {
+		telegramMu.Lock()
+		defer telegramMu.Unlock()
+		link, ok := telegramLinks[arg]
+		if !ok || time.Now().After(link.expiresAt) {
+			return "That code is invalid or has expired. Get a new one from POST /v1/me/telegram."
+		}
+		delete(telegramLinks, arg)
+		telegramChats[chat] = link.user
+		return "Linked to " + link.user + "."
+	}
+
+	telegramMu.Lock()
+	name, linked := telegramChats[chat]
+	if command == "/unlink" {
+		delete(telegramChats, chat)
+	}
+	telegramMu.Unlock()
+	switch {
+	case command == "/unlink":
+		return "Unlinked."
+	case command != "/list" && command != "/add" && command != "/done":
+		return telegramHelp
+	case !linked:
+		return "This chat isn't linked yet. Send /link CODE with a code from POST /v1/me/telegram."
+	}
+	user, ok := principalNamed(name)
+	if !ok {
+		return "Your account no longer exists. Send /unlink."
+	}
+	if command != "/list" && len(apiKeys) > 0 && user.role < roleEditor {
+		return "Your account may only read todos."
+	}
+
+	actor := "telegram:" + user.name
+	switch command {
+	case "/list":
+		var open []Todo
+		store.listed(func(todo *Todo) bool {
+			if !todo.Completed && permissionOf(user, todo) != permNone {
+				open = append(open, todo.clone())
+			}
+			return true
+		})
+		if len(open) == 0 {
+			return "No open todos."
+		}
+		sort.Slice(open, func(i, j int) bool { return open[i].ID > open[j].ID })
+		var b strings.Builder
+		for i, todo := range open {
+			if i == telegramListLimit {
+				fmt.Fprintf(&b, "and %d more", len(open)-i)
+				break
+			}
+			fmt.Fprintf(&b, "#%d %s\n", todo.ID, todo.Title)
+		}
+		return strings.TrimSpace(b.String())
+
+	case "/add":
+		if !user.canSee("") {
+			return "Your account may only add todos to projects, use the API."
+		}
+		now := time.Now()
+		todo := &Todo{Title: arg, CreatedAt: now, UpdatedAt: now}
+		if errs := validateTodo(todo); len(errs) > 0 {
+			return "Invalid todo: " + errs[0].Field + " " + errs[0].Message
+		}
+		if rejected, _ := checkSoftRules(nil, todo); len(rejected) > 0 {
+			return "Rejected: " + rejected[0].Field + " " + rejected[0].Message
+		}
+		if _, err := addTodo(actor, todo); err != nil {
+			return "Not added: " + err.Error() + "."
+		}
+		return fmt.Sprintf("Added #%d %s", todo.ID, todo.Title)
+
+	default: // "/done"
+		id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+		if err != nil {
+			return "Usage: /done ID"
+		}
+		var title string
+		_, ok, err := changeTodo(actor, id, func(todo *Todo) error {
+			if permissionOf(user, todo) < permEditor {
+				return errNotVisible
+			}
+			title = todo.Title
+			if todo.Completed {
+				return errNoChange
+			}
+			if err := setStatus(todo, statusDone); err != nil {
+				return err
+			}
+			for i := range todo.Subtasks {
+				todo.Subtasks[i].Completed = true
+			}
+			todo.UpdatedAt = time.Now()
+			return nil
+		})
+		var statusErr *statusError
+		switch {
+		case !ok || errors.Is(err, errNotVisible):
+			return fmt.Sprintf("Todo #%d not found.", id)
+		case errors.Is(err, errNoChange):
+			return fmt.Sprintf("#%d %s is already done.", id, title)
+		case errors.As(err, &statusErr):
+			return "Can't complete it: " + err.Error()
+		case err != nil:
+			return "Failed: " + err.Error()
+		}
+		return fmt.Sprintf("Done: #%d %s", id, title)
+	}
+}
+
+// errNotVisible rejects changes to todos the user may not edit.
+var errNotVisible = errors.New("todo not visible")
+
+// telegramUpdate is the part of a Telegram update the bot uses.
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// telegramCall calls a method of the Bot API and decodes its result into
+// out.
+func telegramCall(token, method string, params interface{}, timeout time.Duration, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(telegramAPI + "/bot" + token + "/" + method)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+	if err := fasthttp.DoTimeout(req, resp, timeout); err != nil {
+		return err
+	}
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &reply); err != nil {
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram %s: %s", method, reply.Description)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, out)
+}
+
+// runTelegramBot long-polls the Bot API for messages to the bot with the
+// given token and answers the commands in them until ctx is done.
+func runTelegramBot(ctx context.Context, token string) {
+	const pollTimeout = 30
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := telegramCall(token, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         pollTimeout,
+			"allowed_updates": []string{"message"},
+		}, (pollTimeout+10)*time.Second, &updates)
+		if err != nil {
+			log.Printf("telegram: %s", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			// Replicas and cluster followers leave the bot to the primary,
+			// but still skip updates so that they don't pile up.
+			if u.Message == nil || u.Message.Text == "" || readOnly() {
+				continue
+			}
+			reply := telegramReply(u.Message.Chat.ID, u.Message.Text)
+			err := telegramCall(token, "sendMessage", map[string]interface{}{
+				"chat_id": u.Message.Chat.ID,
+				"text":    reply,
+			}, 10*time.Second, nil)
+			if err != nil {
+				log.Printf("telegram: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package todo
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Template is a reusable todo skeleton. Its title, description, subtasks
+// and project may hold {{variable}} placeholders, which are filled in when
+// a todo is created from the template.
+type Template struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Subtasks    []string `json:"subtasks,omitempty"`
+	Priority    string   `json:"priority,omitempty"`
+	Project     string   `json:"project,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Variables lists the placeholders used by the template, except the
+	// built-in ones. It is derived from the other fields.
+	Variables []string  `json:"variables"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	templates      = make(map[int]*Template)
+	nextTemplateID = 1
+	templatesMu    sync.RWMutex
+)
+
+// templateVariable matches the placeholders of a template, such as
+// {{client}}.
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// builtinVariables returns the values of the variables every template may
+// use without them being given.
+func builtinVariables(now time.Time) map[string]string {
+	_, week := now.ISOWeek()
+	return map[string]string{
+		"date":  now.Format("2006-01-02"),
+		"week":  strconv.Itoa(week),
+		"month": now.Format("January"),
+		"year":  strconv.Itoa(now.Year()),
+	}
+}
+
+// texts returns the fields of the template that may hold placeholders.
+func (t *Template) texts() []string {
+	return append([]string{t.Title, t.Description, t.Project}, t.Subtasks...)
+}
+
+func (t *Template) validate() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if strings.TrimSpace(t.Title) == "" {
+		return errors.New("title is required")
+	}
+	if !validPriority(t.Priority) {
+		return errors.New("priority " + invalidPriority.Message)
+	}
+	if len(t.Subtasks) > subtaskRules.maxCount {
+		return errors.New("too many subtasks, the maximum is " + strconv.Itoa(subtaskRules.maxCount))
+	}
+	for i, st := range t.Subtasks {
+		if strings.TrimSpace(st) == "" {
+			return errors.New("subtasks[" + strconv.Itoa(i) + "] must not be empty")
+		}
+	}
+	t.Tags = parseTags(strings.Join(t.Tags, ","))
+
+	builtins := builtinVariables(time.Now())
+	t.Variables = []string{}
+	for _, text := range t.texts() {
+		for _, m := range templateVariable.FindAllStringSubmatch(text, -1) {
+			if _, ok := builtins[m[1]]; !ok && !containsString(t.Variables, m[1]) {
+				t.Variables = append(t.Variables, m[1])
+			}
+		}
+	}
+	sort.Strings(t.Variables)
+	return nil
+}
+
+// instantiate returns a new todo built from the template with its
+// placeholders replaced by vars and the built-in variables. It reports the
+// variables of the template missing from vars as field errors.
+func (t *Template) instantiate(vars map[string]string, now time.Time) (*Todo, []fieldError) {
+	var errs []fieldError
+	for _, name := range t.Variables {
+		if _, ok := vars[name]; !ok {
+			errs = append(errs, fieldError{Field: "variables." + name, Message: "is required"})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	values := builtinVariables(now)
+	for name, value := range vars {
+		values[name] = value
+	}
+	fill := func(s string) string {
+		return templateVariable.ReplaceAllStringFunc(s, func(m string) string {
+			return values[templateVariable.FindStringSubmatch(m)[1]]
+		})
+	}
+
+	todo := &Todo{
+		Title:       fill(t.Title),
+		Description: fill(t.Description),
+		Priority:    t.Priority,
+		Project:     fill(t.Project),
+		Tags:        append([]string(nil), t.Tags...),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	for _, title := range t.Subtasks {
+		todo.Subtasks = append(todo.Subtasks, Subtask{Title: fill(title)})
+	}
+	if errs := normalizeSubtasks(todo.Subtasks); len(errs) > 0 {
+		return nil, errs
+	}
+	return todo, validateTodo(todo)
+}
+
+// getTemplates handles GET /templates.
+func getTemplates(ctx *fasthttp.RequestCtx) {
+	templatesMu.RLock()
+	list := make([]Template, 0, len(templates))
+	for _, tmpl := range templates {
+		list = append(list, *tmpl)
+	}
+	templatesMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// getTemplate handles GET /templates/{id}.
+func getTemplate(ctx *fasthttp.RequestCtx, id int) {
+	templatesMu.RLock()
+	tmpl, ok := templates[id]
+	var snapshot Template
+	if ok {
+		snapshot = *tmpl
+	}
+	templatesMu.RUnlock()
+
+	if !ok {
+		ctx.Error("Template not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// decodeTemplate parses and validates the JSON template in the request
+// body.
+func decodeTemplate(ctx *fasthttp.RequestCtx) (*Template, bool) {
+	tmpl := &Template{}
+	if !decodeJSONBody(ctx, tmpl) {
+		return nil, false
+	}
+	if err := tmpl.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return nil, false
+	}
+	return tmpl, true
+}
+
+// createTemplate handles POST /templates.
+func createTemplate(ctx *fasthttp.RequestCtx) {
+	tmpl, ok := decodeTemplate(ctx)
+	if !ok {
+		return
+	}
+	tmpl.CreatedAt = time.Now()
+
+	templatesMu.Lock()
+	tmpl.ID = nextTemplateID
+	nextTemplateID++
+	templates[tmpl.ID] = tmpl
+	snapshot := *tmpl
+	templatesMu.Unlock()
+
+	ctx.Response.Header.Set("Location", apiPrefix+"/templates/"+strconv.Itoa(snapshot.ID))
+	writeJSON(ctx, fasthttp.StatusCreated, snapshot)
+}
+
+// updateTemplate handles PUT /templates/{id} and replaces the template.
+// Todos created from it earlier are not affected.
+func updateTemplate(ctx *fasthttp.RequestCtx, id int) {
+	tmpl, ok := decodeTemplate(ctx)
+	if !ok {
+		return
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	old, ok := templates[id]
+	if !ok {
+		ctx.Error("Template not found", fasthttp.StatusNotFound)
+		return
+	}
+	tmpl.ID = id
+	tmpl.CreatedAt = old.CreatedAt
+	templates[id] = tmpl
+	writeJSON(ctx, fasthttp.StatusOK, tmpl)
+}
+
+// deleteTemplate handles DELETE /templates/{id}.
+func deleteTemplate(ctx *fasthttp.RequestCtx, id int) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if _, ok := templates[id]; !ok {
+		ctx.Error("Template not found", fasthttp.StatusNotFound)
+		return
+	}
+	delete(templates, id)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// createTodoFromTemplate handles POST /todos/from-template/{id} with a JSON
+// body such as {"variables": {"client": "Acme"}}, creating a todo from the
+// template. The body may be left out for templates without variables.
+func createTodoFromTemplate(ctx *fasthttp.RequestCtx, id int) {
+	var req struct {
+		Variables map[string]string `json:"variables"`
+	}
+	if len(ctx.PostBody()) > 0 && !decodeJSONBody(ctx, &req) {
+		return
+	}
+	templatesMu.RLock()
+	tmpl, ok := templates[id]
+	var snapshot Template
+	if ok {
+		snapshot = *tmpl
+	}
+	templatesMu.RUnlock()
+	if !ok {
+		ctx.Error("Template not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	todo, errs := snapshot.instantiate(req.Variables, time.Now())
+	if len(errs) > 0 {
+		writeValidationErrors(ctx, "Invalid todo", errs)
+		return
+	}
+	rejected, warnings := checkSoftRules(nil, todo)
+	if len(rejected) > 0 {
+		writeValidationErrors(ctx, "Rejected by validation rules", rejected)
+		return
+	}
+	addWarnings(ctx, warnings)
+	raw, err := namespaceOf(ctx).addTodo(actorOf(ctx), todo)
+	if err != nil {
+		writeStoreError(ctx, err)
+		return
+	}
+	writeRawJSON(ctx, fasthttp.StatusCreated, raw)
+}
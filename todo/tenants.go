@@ -0,0 +1,516 @@
+package todo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TenantConfig overrides server settings for one tenant: a tenant namespace
+// or, in the default namespace, the caller identified by the name of an API
+// key ("anonymous" without access control). Zero values leave the global
+// settings in effect.
+type TenantConfig struct {
+	// MaxTodos caps the number of todos the tenant may have created;
+	// zero means no limit.
+	MaxTodos int `json:"max_todos,omitempty"`
+	// Retention is how long after completion the tenant's todos are
+	// deleted, as a Go duration such as "2160h"; empty keeps them.
+	Retention string `json:"retention,omitempty"`
+	// TrashRetention is how long deleted todos of the tenant stay
+	// restorable, as a Go duration; afterwards their history is dropped and
+	// they are gone for good. Empty keeps them.
+	TrashRetention string `json:"trash_retention,omitempty"`
+	// MaxActivity caps the tenant's activity log at its most recent
+	// entries, sparing those that record who created existing todos. Zero
+	// means no cap.
+	MaxActivity int `json:"max_activity,omitempty"`
+	// RetentionDryRun makes retention runs only report what they would
+	// delete for the tenant.
+	RetentionDryRun bool `json:"retention_dry_run,omitempty"`
+	// WebhookURL receives the reminders about the tenant's todos instead of
+	// -notify-webhook-url.
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// Features turns the features in tenantFeatures off (false) for the
+	// tenant. Features disabled for the whole server can't be turned on.
+	Features map[string]bool `json:"features,omitempty"`
+
+	retention, trashRetention time.Duration
+}
+
+// tenantFeatures are the features that can be turned off per tenant, each
+// with the requests it covers.
+var tenantFeatures = map[string]func(method, path string) bool{
+	"comments": func(method, path string) bool {
+		return strings.HasPrefix(path, "/todos/") && strings.Contains(path, "/comments")
+	},
+	"export": func(method, path string) bool {
+		return path == "/export" || path == "/todos/export"
+	},
+	"import": func(method, path string) bool {
+		return path == "/import"
+	},
+	"undo": func(method, path string) bool {
+		return strings.HasPrefix(path, "/todos/") && strings.HasSuffix(path, "/undo")
+	},
+	"webhooks": func(method, path string) bool {
+		return path == "/webhooks" || strings.HasPrefix(path, "/webhooks/")
+	},
+	// Idempotency-Key headers are ignored rather than rejected, see
+	// tenantHandler.
+	"idempotency": func(method, path string) bool {
+		return false
+	},
+}
+
+var (
+	tenantsMu sync.RWMutex
+	tenants   = make(map[string]*TenantConfig)
+)
+
+// tenantConfig returns the overrides of the named tenant, or nil if it has
+// none. The result must not be modified.
+func tenantConfig(name string) *TenantConfig {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[name]
+}
+
+// validate checks the overrides and parses the retention period.
+func (t *TenantConfig) validate() error {
+	if t.MaxTodos < 0 {
+		return fmt.Errorf("max_todos must not be negative")
+	}
+	if t.MaxActivity < 0 {
+		return fmt.Errorf("max_activity must not be negative")
+	}
+	var err error
+	if t.retention, err = parseRetention("retention", t.Retention); err != nil {
+		return err
+	}
+	if t.trashRetention, err = parseRetention("trash_retention", t.TrashRetention); err != nil {
+		return err
+	}
+	if t.WebhookURL != "" {
+		u, err := url.Parse(t.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
+		}
+	}
+	for name := range t.Features {
+		if _, ok := tenantFeatures[name]; !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+// parseRetention parses the retention period in the named field; empty
+// means none.
+func parseRetention(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as \"2160h\"", field)
+	}
+	return d, nil
+}
+
+// hasRetention reports whether the overrides set any retention policy.
+func (t *TenantConfig) hasRetention() bool {
+	return t.retention > 0 || t.trashRetention > 0 || t.MaxActivity > 0
+}
+
+// disables reports whether the overrides turn the feature off.
+func (t *TenantConfig) disables(feature string) bool {
+	enabled, ok := t.Features[feature]
+	return ok && !enabled
+}
+
+// redacted returns a copy of the overrides that is safe to respond with.
+func (t *TenantConfig) redacted() TenantConfig {
+	c := *t
+	if c.WebhookURL != "" {
+		c.WebhookURL = "[redacted]"
+	}
+	return c
+}
+
+// tenantHandler wraps h, applying the overrides of the calling tenant:
+// requests for features turned off get 403 Forbidden. The todo quota is
+// enforced where todos are created, see withinQuota.
+func tenantHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		name := ""
+		if ns := namespaceOf(ctx); ns != defaultNamespace {
+			name = ns.id
+		} else if caller, ok := authenticate(ctx); ok {
+			name = caller.name
+		}
+		t := tenantConfig(name)
+		if t == nil {
+			h(ctx)
+			return
+		}
+
+		method, path := string(ctx.Method()), string(ctx.Path())
+		for name, covers := range tenantFeatures {
+			if t.disables(name) && covers(method, path) {
+				ctx.Error("The "+name+" feature is disabled for this tenant", fasthttp.StatusForbidden)
+				return
+			}
+		}
+		if t.disables("idempotency") {
+			ctx.Request.Header.Del("Idempotency-Key")
+		}
+		h(ctx)
+	}
+}
+
+// quotaError is returned when creating todos would take a tenant beyond
+// its MaxTodos.
+type quotaError struct {
+	max int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("this tenant may have at most %d todos, delete some to create new ones", e.max)
+}
+
+// quotaMu serializes creating todos under a quota, so concurrent requests
+// can't together take a tenant beyond it.
+var quotaMu sync.Mutex
+
+// withinQuota calls create, which adds n new todos to ns on behalf of
+// actor, unless that would take the tenant beyond its MaxTodos, and
+// returns its error. The tenant is the namespace, or in the default
+// namespace the caller actor names.
+func (ns *namespace) withinQuota(actor string, n int, create func() error) error {
+	max, count := ns.todoQuota(actor)
+	if max == 0 || n == 0 {
+		return create()
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if count()+n > max {
+		return &quotaError{max: max}
+	}
+	return create()
+}
+
+// todoQuota returns the MaxTodos of the tenant actor creates todos for in
+// ns, zero if there is none, and a function counting the tenant's todos.
+func (ns *namespace) todoQuota(actor string) (int, func() int) {
+	name, count := ns.id, ns.count
+	if ns == defaultNamespace {
+		name = callerOf(actor)
+		count = func() int { return tenantTodoCount(name) }
+	}
+	t := tenantConfig(name)
+	if t == nil {
+		return 0, count
+	}
+	return t.MaxTodos, count
+}
+
+// callerOf returns the caller an actor names, without the channel prefix
+// of changes made through MCP or Telegram. Key names can't contain colons.
+func callerOf(actor string) string {
+	return actor[strings.LastIndex(actor, ":")+1:]
+}
+
+// tenantTodoCount returns the number of existing todos the tenant created
+// in the default namespace, through any channel.
+func tenantTodoCount(name string) int {
+	n := 0
+	store.each(func(todo *Todo) bool {
+		if callerOf(activity.creator(todo.ID)) == name {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// notifiers returns the notifiers for a reminder about the todo of ns with
+// the given ID. In the default namespace its creator's webhook URL replaces
+// the webhook channel; the reminders of a tenant namespace only go to the
+// tenant's webhook URL.
+func (ns *namespace) notifiers(id int, notifiers []notifier) []notifier {
+	if ns != defaultNamespace {
+		if t := tenantConfig(ns.id); t != nil && t.WebhookURL != "" {
+			return []notifier{webhookNotifier{url: t.WebhookURL}}
+		}
+		return nil
+	}
+	t := tenantConfig(activity.creator(id))
+	if t == nil || t.WebhookURL == "" {
+		return notifiers
+	}
+	list := []notifier{webhookNotifier{url: t.WebhookURL}}
+	for _, nt := range notifiers {
+		if _, ok := nt.(webhookNotifier); !ok {
+			list = append(list, nt)
+		}
+	}
+	return list
+}
+
+// retentionResult summarizes a finished retention job, listing the tenants
+// it deleted anything for.
+type retentionResult struct {
+	DryRun  bool              `json:"dry_run,omitempty"`
+	Tenants []tenantRetention `json:"tenants"`
+}
+
+// tenantRetention reports what a retention run deleted for one tenant, or
+// would have deleted in a dry run.
+type tenantRetention struct {
+	Tenant string `json:"tenant"`
+	// Namespace is set for tenant namespaces. Otherwise the tenant's todos
+	// are those it created in the default namespace.
+	Namespace bool `json:"namespace,omitempty"`
+	DryRun    bool `json:"dry_run,omitempty"`
+	// Completed lists the IDs of the completed todos deleted, Trash those
+	// of the deleted todos purged.
+	Completed []int `json:"completed"`
+	Trash     []int `json:"trash"`
+	// Activity is the number of activity log entries removed.
+	Activity int `json:"activity"`
+}
+
+// expiredTodos returns the IDs of the completed todos of s for which
+// period returns a retention period that has passed since completion.
+func expiredTodos(s *todoStore, period func(todo *Todo) (time.Duration, bool)) []int {
+	var expired []int
+	now := time.Now()
+	s.each(func(todo *Todo) bool {
+		if todo.CompletedAt == nil {
+			return true
+		}
+		if d, ok := period(todo); ok && now.Sub(*todo.CompletedAt) > d {
+			expired = append(expired, todo.ID)
+		}
+		return true
+	})
+	sort.Ints(expired)
+	return expired
+}
+
+// retentionJob returns the job applying the retention policies of all
+// tenants. With dryRun set it only reports what it would delete.
+func retentionJob(dryRun bool) jobFunc {
+	return func(ctx context.Context, p *jobProgress) (interface{}, error) {
+		return applyRetention(ctx, p, dryRun)
+	}
+}
+
+// applyRetention applies the retention policy of every tenant to the
+// default namespace, where the tenant of a todo is its creator, and to the
+// tenant's namespace if it has one.
+func applyRetention(ctx context.Context, p *jobProgress, dryRun bool) (interface{}, error) {
+	tenantsMu.RLock()
+	policies := make(map[string]TenantConfig)
+	for name, t := range tenants {
+		if t.hasRetention() {
+			policies[name] = *t
+		}
+	}
+	tenantsMu.RUnlock()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type scope struct {
+		ns     *namespace
+		tenant string
+	}
+	var scopes []scope
+	namespacesMu.RLock()
+	for _, name := range names {
+		scopes = append(scopes, scope{defaultNamespace, name})
+		if ns, ok := namespaces[name]; ok {
+			scopes = append(scopes, scope{ns, name})
+		}
+	}
+	namespacesMu.RUnlock()
+
+	result := retentionResult{DryRun: dryRun, Tenants: []tenantRetention{}}
+	p.setTotal(len(scopes))
+	for _, sc := range scopes {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		policy := policies[sc.tenant]
+		r := applyPolicy(sc.ns, sc.tenant, &policy, dryRun || policy.RetentionDryRun)
+		p.advance(1)
+		if len(r.Completed) > 0 || len(r.Trash) > 0 || r.Activity > 0 {
+			result.Tenants = append(result.Tenants, r)
+		}
+	}
+	return result, nil
+}
+
+// applyPolicy applies the retention policy t of tenant to its todos in ns.
+func applyPolicy(ns *namespace, tenant string, t *TenantConfig, dryRun bool) tenantRetention {
+	r := tenantRetention{
+		Tenant:    tenant,
+		Namespace: ns != defaultNamespace,
+		DryRun:    dryRun,
+		Completed: []int{},
+		Trash:     []int{},
+	}
+	audit := ns.store.audit
+	// Creators are looked up before any history is removed.
+	owned := make(map[int]bool)
+	owns := func(id int) bool {
+		if ns != defaultNamespace {
+			return true
+		}
+		mine, ok := owned[id]
+		if !ok {
+			mine = audit.creator(id) == tenant
+			owned[id] = mine
+		}
+		return mine
+	}
+
+	if t.retention > 0 {
+		for _, id := range expiredTodos(ns.store, func(todo *Todo) (time.Duration, bool) { return t.retention, owns(todo.ID) }) {
+			if !dryRun {
+				if removed, _ := ns.removeTodo("retention", id); !removed {
+					continue
+				}
+			}
+			r.Completed = append(r.Completed, id)
+		}
+	}
+
+	if t.trashRetention > 0 {
+		purge := make(map[int]bool)
+		for id, deletedAt := range audit.deletions() {
+			if time.Since(deletedAt) > t.trashRetention && owns(id) {
+				purge[id] = true
+				r.Trash = append(r.Trash, id)
+			}
+		}
+		sort.Ints(r.Trash)
+		if !dryRun && len(purge) > 0 {
+			audit.prune(func(e *AuditEntry) bool { return purge[e.TodoID] })
+			todosChanged()
+		}
+	}
+
+	if t.MaxActivity > 0 {
+		var mine []AuditEntry
+		for _, e := range audit.since(time.Time{}) {
+			if owns(e.TodoID) {
+				mine = append(mine, e)
+			}
+		}
+		drop := make(map[int]bool)
+		for _, e := range mine {
+			if len(mine)-len(drop) <= t.MaxActivity {
+				break
+			}
+			if e.Action == auditCreated && ns.store.exists(e.TodoID) {
+				continue
+			}
+			drop[e.ID] = true
+		}
+		r.Activity = len(drop)
+		if !dryRun && len(drop) > 0 {
+			audit.prune(func(e *AuditEntry) bool { return drop[e.ID] })
+		}
+	}
+	return r
+}
+
+// runRetention handles POST /admin/retention and starts a retention run
+// right away, which only reports what it would delete with ?dry_run=true.
+func runRetention(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	respondJobStarted(ctx, startJob("retention", actorOf(ctx), retentionJob(ctx.QueryArgs().GetBool("dry_run"))))
+}
+
+// getTenants handles GET /admin/tenants and lists the overrides of all
+// tenants by name.
+func getTenants(ctx *fasthttp.RequestCtx) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	tenantsMu.RLock()
+	list := make(map[string]TenantConfig, len(tenants))
+	for name, t := range tenants {
+		list[name] = t.redacted()
+	}
+	tenantsMu.RUnlock()
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// getTenant handles GET /admin/tenants/{name}.
+func getTenant(ctx *fasthttp.RequestCtx, name string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	t := tenantConfig(name)
+	if t == nil {
+		ctx.Error("Tenant not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, t.redacted())
+}
+
+// putTenant handles PUT /admin/tenants/{name} and replaces the overrides of
+// a tenant with the JSON body.
+func putTenant(ctx *fasthttp.RequestCtx, name string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	var t TenantConfig
+	if !decodeJSONBody(ctx, &t) {
+		return
+	}
+	if err := t.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	tenantsMu.Lock()
+	_, existed := tenants[name]
+	tenants[name] = &t
+	tenantsMu.Unlock()
+	status := fasthttp.StatusOK
+	if !existed {
+		status = fasthttp.StatusCreated
+	}
+	writeJSON(ctx, status, t.redacted())
+}
+
+// deleteTenant handles DELETE /admin/tenants/{name}; the tenant falls back
+// to the global settings.
+func deleteTenant(ctx *fasthttp.RequestCtx, name string) {
+	if !requireAdmin(ctx) {
+		return
+	}
+	tenantsMu.Lock()
+	_, ok := tenants[name]
+	delete(tenants, name)
+	tenantsMu.Unlock()
+	if !ok {
+		ctx.Error("Tenant not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
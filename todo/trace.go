@@ -0,0 +1,208 @@
+package todo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// slowThreshold is the duration above which requests are logged as slow,
+// with the timing of the store and file operations they made. Zero
+// disables tracing. It is set once at startup.
+var slowThreshold time.Duration
+
+// latencyBudgets overrides slowThreshold for some routes, keyed by method
+// and route, such as "GET /todos/{id}", or by route alone for all methods.
+// It is set once at startup.
+var latencyBudgets map[string]time.Duration
+
+// tracedOp is the timing of an operation made while serving a request.
+type tracedOp struct {
+	name  string
+	start time.Time
+	took  time.Duration
+}
+
+// requestTrace collects the operations of a request.
+type requestTrace struct {
+	ops []tracedOp
+	// span is the OpenTelemetry span of the request, if it is sampled.
+	span *span
+}
+
+// traceKey is the user value holding the trace of a request.
+const traceKey = "trace"
+
+// traceOp starts timing the operation name, such as "store.get" or
+// "file.save", of a request. Calling the returned function ends it:
+//
+//	defer traceOp(ctx, "store.list")()
+func traceOp(ctx *fasthttp.RequestCtx, name string) func() {
+	t, ok := ctx.UserValue(traceKey).(*requestTrace)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.ops = append(t.ops, tracedOp{name, start, time.Since(start)})
+	}
+}
+
+// Phases of a request in the timing breakdown of slow requests. Operations
+// are assigned to them by the prefix of their name, see opPhase.
+var requestPhases = []string{"parse", "store", "marshal", "write"}
+
+// opPhase returns the phase the operation name belongs to: "request.parse"
+// to parse, "response.marshal" to marshal, other "response." operations,
+// such as compression, to write, and the store, comment and file
+// operations to store.
+func opPhase(name string) string {
+	switch {
+	case name == "request.parse":
+		return "parse"
+	case name == "response.marshal":
+		return "marshal"
+	case strings.HasPrefix(name, "response."):
+		return "write"
+	default:
+		return "store"
+	}
+}
+
+// parseLatencyBudgets parses a comma-separated list of route=duration
+// entries such as "GET /todos=100ms,/search=1s". Routes are written as
+// GET /admin/stats reports them and may be preceded by a method.
+func parseLatencyBudgets(s string) (map[string]time.Duration, error) {
+	budgets := make(map[string]time.Duration)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		route = strings.Join(strings.Fields(route), " ")
+		if !ok || route == "" {
+			return nil, fmt.Errorf("invalid budget %q, expected [method ]route=duration", entry)
+		}
+		method, path, hasMethod := strings.Cut(route, " ")
+		if !hasMethod {
+			path = method
+		} else if method != strings.ToUpper(method) {
+			return nil, fmt.Errorf("invalid method %q in budget %q", method, entry)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid route %q in budget %q, expected a path such as /todos/{id}", path, entry)
+		}
+		budget, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || budget <= 0 {
+			return nil, fmt.Errorf("invalid duration %q in budget %q", strings.TrimSpace(value), entry)
+		}
+		budgets[route] = budget
+	}
+	return budgets, nil
+}
+
+// latencyBudget returns the duration above which a request for route with
+// method is slow, or zero if it is never logged.
+func latencyBudget(method, route string) time.Duration {
+	if budget, ok := latencyBudgets[method+" "+route]; ok {
+		return budget
+	}
+	if budget, ok := latencyBudgets[route]; ok {
+		return budget
+	}
+	return slowThreshold
+}
+
+// slowCounts counts slow requests per method and route, like routeCounts.
+var (
+	slowCountsMu sync.Mutex
+	slowCounts   = make(map[string]uint64)
+)
+
+// traceHandler wraps h, timing requests and logging those that take longer
+// than the latency budget of their route together with the operations they
+// made and the time spent in each phase, so operators can tell which
+// endpoints degrade as the todos grow, and why. Sampled
+// requests are exported as OpenTelemetry spans, see spanExporter.
+func traceHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if slowThreshold <= 0 && len(latencyBudgets) == 0 && spanExporter == nil {
+			h(ctx)
+			return
+		}
+		t := &requestTrace{}
+		ctx.SetUserValue(traceKey, t)
+		start := time.Now()
+		if spanExporter != nil {
+			t.span = startServerSpan(ctx, start)
+		}
+		h(ctx)
+		end := time.Now()
+		took := end.Sub(start)
+		if t.span != nil {
+			finishServerSpan(ctx, t, end)
+		}
+		method, pattern := string(ctx.Method()), routePattern(string(ctx.Path()))
+		budget := latencyBudget(method, pattern)
+		if budget <= 0 || took < budget {
+			return
+		}
+
+		route := method + " " + pattern
+		counted := route
+		slowCountsMu.Lock()
+		if _, ok := slowCounts[counted]; !ok && len(slowCounts) >= maxCountedRoutes {
+			counted = "other"
+		}
+		slowCounts[counted]++
+		slowCountsMu.Unlock()
+
+		var ops []string
+		phases := make(map[string]time.Duration, len(requestPhases))
+		for _, op := range t.ops {
+			entry := fmt.Sprintf("%s %s", op.name, op.took.Round(time.Microsecond))
+			if op.took >= budget {
+				entry += " (slow)"
+			}
+			ops = append(ops, entry)
+			phases[opPhase(op.name)] += op.took
+		}
+		// Time not spent in a traced operation, such as in validation or
+		// the middleware, is other.
+		other := took
+		var breakdown []string
+		for _, phase := range requestPhases {
+			other -= phases[phase]
+			breakdown = append(breakdown, fmt.Sprintf("%s %s", phase, phases[phase].Round(time.Microsecond)))
+		}
+		breakdown = append(breakdown, fmt.Sprintf("other %s", max(other, 0).Round(time.Microsecond)))
+		if len(ops) == 0 {
+			ops = append(ops, "none traced")
+		}
+		if query := ctx.URI().QueryString(); len(query) > 0 {
+			route += "?" + string(query)
+		}
+		requestID := string(ctx.Response.Header.Peek("X-Request-ID"))
+		if t.span != nil {
+			requestID += ", trace ID " + hex.EncodeToString(t.span.traceID[:])
+		}
+		log.Printf("Slow request %s: %s (budget %s), status %d, namespace %s, caller %s, request ID %s; timing: %s; operations: %s",
+			route, took.Round(time.Microsecond), budget, ctx.Response.StatusCode(),
+			namespaceName(namespaceOf(ctx)), actorOf(ctx), requestID,
+			strings.Join(breakdown, ", "), strings.Join(ops, ", "))
+	}
+}
+
+// namespaceName returns the name of ns for logs.
+func namespaceName(ns *namespace) string {
+	if ns == defaultNamespace {
+		return "default"
+	}
+	return ns.id
+}
@@ -0,0 +1,479 @@
+package todo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Resumable uploads follow the tus protocol, version 1.0.0, with the
+// creation, creation-with-upload, termination and expiration extensions
+// (https://tus.io/protocols/resumable-upload). A client creates an upload
+// for a todo with POST /uploads, sends the file in chunks with PATCH
+// /uploads/{id}, asking HEAD /uploads/{id} where to resume after losing
+// its connection, and the completed file is attached to the todo.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	// tusChunkType is the Content-Type of chunks.
+	tusChunkType = "application/offset+octet-stream"
+	// tusReapInterval is how often expired uploads are removed.
+	tusReapInterval = time.Minute
+)
+
+var (
+	// maxUploadSize is the largest file accepted, set from
+	// Config.MaxUploadSize.
+	maxUploadSize = 1 << 30
+	// uploadExpiry is how long an unfinished upload is kept after its
+	// last chunk, set from Config.UploadExpiry.
+	uploadExpiry = 24 * time.Hour
+)
+
+// tusUpload is an unfinished resumable upload. Its bytes are kept in a
+// partial file until all length of them have arrived.
+type tusUpload struct {
+	// mu serializes the chunks of the upload.
+	mu     sync.Mutex
+	id     string
+	ns     *namespace
+	owner  string
+	todoID int
+	name   string
+	// mimeType is the filetype of the metadata, if any.
+	mimeType string
+	// metadata is the Upload-Metadata header it was created with.
+	metadata string
+	length   int64
+	offset   int64
+	path     string
+	expires  time.Time
+}
+
+var (
+	// tusUploads maps upload IDs to the unfinished uploads.
+	tusUploads   = make(map[string]*tusUpload)
+	tusUploadsMu sync.Mutex
+)
+
+// routeUploads routes the tus requests for /uploads and /uploads/{id}; rest
+// is the part after "/uploads".
+func routeUploads(ctx *fasthttp.RequestCtx, method, rest string) {
+	ctx.Response.Header.Set("Tus-Resumable", tusVersion)
+	if method == "OPTIONS" {
+		ctx.Response.Header.Set("Tus-Version", tusVersion)
+		ctx.Response.Header.Set("Tus-Extension", tusExtensions)
+		ctx.Response.Header.Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+	if v := string(ctx.Request.Header.Peek("Tus-Resumable")); v != tusVersion {
+		ctx.Response.Header.Set("Tus-Version", tusVersion)
+		writeRequestError(ctx, fasthttp.StatusPreconditionFailed, "Unsupported tus version",
+			"send a Tus-Resumable: "+tusVersion+" header")
+		return
+	}
+	if rest == "" {
+		if method == "POST" {
+			createUpload(ctx)
+		} else {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id := strings.TrimPrefix(rest, "/")
+	switch method {
+	case "HEAD", "GET":
+		getUploadOffset(ctx, id)
+	case "PATCH":
+		patchUpload(ctx, id)
+	case "DELETE":
+		deleteUpload(ctx, id)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// parseUploadMetadata parses an Upload-Metadata header, comma-separated
+// keys each followed by a space and a base64-encoded value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("the value of " + key + " is not base64")
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// createUpload handles POST /uploads. The Upload-Length header gives the
+// size of the file, and the Upload-Metadata header the todo_id of the todo
+// to attach it to, its filename and optionally its filetype. A body of
+// type application/offset+octet-stream is the first chunk.
+func createUpload(ctx *fasthttp.RequestCtx) {
+	length, err := strconv.ParseInt(string(ctx.Request.Header.Peek("Upload-Length")), 10, 64)
+	switch {
+	case ctx.Request.Header.Peek("Upload-Defer-Length") != nil:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Deferred length not supported",
+			"send the size of the file in the Upload-Length header")
+		return
+	case err != nil || length < 0:
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid Upload-Length",
+			"send the size of the file in bytes in the Upload-Length header")
+		return
+	case length > int64(maxUploadSize):
+		writeRequestError(ctx, fasthttp.StatusRequestEntityTooLarge, "Upload too large",
+			"files must not be larger than "+strconv.Itoa(maxUploadSize)+" bytes, see Tus-Max-Size")
+		return
+	}
+	header := string(ctx.Request.Header.Peek("Upload-Metadata"))
+	meta, err := parseUploadMetadata(header)
+	if err != nil {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid Upload-Metadata", err.Error())
+		return
+	}
+	todoID, err := strconv.Atoi(meta["todo_id"])
+	if err != nil {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Missing todo_id",
+			"name the todo to attach the file to with todo_id in the Upload-Metadata header")
+		return
+	}
+	name := filepath.Base(meta["filename"])
+	if name == "." || name == "/" {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Missing filename",
+			"name the file with filename in the Upload-Metadata header")
+		return
+	}
+	ns := namespaceOf(ctx)
+	if !mayAttach(ctx, ns, todoID) {
+		return
+	}
+
+	dir := filepath.Join(ns.uploads, ".partial")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	u := &tusUpload{
+		id:       randomToken(16),
+		ns:       ns,
+		owner:    actorOf(ctx),
+		todoID:   todoID,
+		name:     name,
+		mimeType: meta["filetype"],
+		metadata: header,
+		length:   length,
+		expires:  time.Now().Add(uploadExpiry),
+	}
+	u.path = filepath.Join(dir, u.id)
+	if err := os.WriteFile(u.path, nil, 0o644); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	tusUploadsMu.Lock()
+	tusUploads[u.id] = u
+	tusUploadsMu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ok := true
+	if len(ctx.PostBody()) > 0 && string(ctx.Request.Header.ContentType()) == tusChunkType {
+		ok = writeChunk(ctx, u, 0)
+	} else if length == 0 {
+		ok = finishUpload(ctx, u)
+	}
+	if !ok {
+		// The client gets no Location to resume at.
+		removeUpload(u.id)
+		if u.path != "" {
+			os.Remove(u.path)
+			u.path = ""
+		}
+		return
+	}
+	ctx.Response.Header.Set("Location", apiPrefix+"/uploads/"+u.id)
+	ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	setUploadExpires(ctx, u)
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+}
+
+// mayAttach reports whether the caller may attach files to the todo with
+// the given ID, which takes the editor permission. If not, it responds
+// like shareHandler does.
+func mayAttach(ctx *fasthttp.RequestCtx, ns *namespace, todoID int) bool {
+	caller, ok := authenticate(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return false
+	}
+	todo, ok := ns.store.get(todoID)
+	if !ok {
+		todoNotFound(ctx, todoID)
+		return false
+	}
+	switch perm := ns.permission(caller, &todo); {
+	case perm == permNone:
+		ctx.Error("Todo not found", fasthttp.StatusNotFound)
+	case perm < permEditor:
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+	default:
+		return true
+	}
+	return false
+}
+
+// findUpload returns the upload id of the caller, responding with 404 Not
+// Found if there is none.
+func findUpload(ctx *fasthttp.RequestCtx, id string) (*tusUpload, bool) {
+	tusUploadsMu.Lock()
+	u, ok := tusUploads[id]
+	tusUploadsMu.Unlock()
+	if !ok || u.owner != actorOf(ctx) || u.ns != namespaceOf(ctx) {
+		ctx.Error("Upload not found", fasthttp.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+// setUploadExpires sets the Upload-Expires header of an unfinished upload.
+func setUploadExpires(ctx *fasthttp.RequestCtx, u *tusUpload) {
+	if u.offset < u.length {
+		ctx.Response.Header.Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// getUploadOffset handles HEAD /uploads/{id}, which tells the client how
+// much of the file has arrived.
+func getUploadOffset(ctx *fasthttp.RequestCtx, id string) {
+	u, ok := findUpload(ctx, id)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	ctx.Response.Header.Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	if u.metadata != "" {
+		ctx.Response.Header.Set("Upload-Metadata", u.metadata)
+	}
+	setUploadExpires(ctx, u)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// patchUpload handles PATCH /uploads/{id}, which appends the chunk in the
+// body at the offset in the Upload-Offset header. The chunk completing the
+// file attaches it to the todo.
+func patchUpload(ctx *fasthttp.RequestCtx, id string) {
+	if string(ctx.Request.Header.ContentType()) != tusChunkType {
+		writeRequestError(ctx, fasthttp.StatusUnsupportedMediaType, "Unsupported Content-Type",
+			"send chunks as "+tusChunkType)
+		return
+	}
+	offset, err := strconv.ParseInt(string(ctx.Request.Header.Peek("Upload-Offset")), 10, 64)
+	if err != nil || offset < 0 {
+		writeRequestError(ctx, fasthttp.StatusBadRequest, "Invalid Upload-Offset",
+			"send the offset of the chunk in bytes in the Upload-Offset header")
+		return
+	}
+	u, ok := findUpload(ctx, id)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !writeChunk(ctx, u, offset) {
+		return
+	}
+	ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	setUploadExpires(ctx, u)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// writeChunk appends the body of the request to the upload at offset,
+// finishing the upload once it is complete. u.mu must be held. It responds
+// with an error and returns false if the chunk doesn't fit.
+func writeChunk(ctx *fasthttp.RequestCtx, u *tusUpload, offset int64) bool {
+	chunk := ctx.PostBody()
+	switch {
+	case u.path == "":
+		// Finished or removed while the chunk was waiting for the lock.
+		ctx.Error("Upload not found", fasthttp.StatusNotFound)
+		return false
+	case offset != u.offset:
+		writeRequestError(ctx, fasthttp.StatusConflict, "Offset mismatch",
+			"the upload is at offset "+strconv.FormatInt(u.offset, 10)+"; ask HEAD for it and resume from there")
+		return false
+	case offset+int64(len(chunk)) > u.length:
+		writeRequestError(ctx, fasthttp.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length",
+			"the upload has "+strconv.FormatInt(u.length-u.offset, 10)+" bytes left")
+		return false
+	}
+	done := traceOp(ctx, "file.save")
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.Write(chunk)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	done()
+	if err != nil {
+		// Drop what was written, if anything, so the offset is right.
+		os.Truncate(u.path, u.offset)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+	u.offset += int64(len(chunk))
+	u.expires = time.Now().Add(uploadExpiry)
+	if u.offset == u.length {
+		return finishUpload(ctx, u)
+	}
+	return true
+}
+
+// finishUpload moves the completed file of u into the uploads directory and
+// attaches it to the todo, responding with the attachment's URL in the
+// X-Attachment-Location header. u.mu must be held.
+func finishUpload(ctx *fasthttp.RequestCtx, u *tusUpload) bool {
+	removeUpload(u.id)
+	partial := u.path
+	u.path = ""
+	// The caller may have lost access to the todo during the upload.
+	if !mayAttach(ctx, u.ns, u.todoID) {
+		os.Remove(partial)
+		return false
+	}
+	f, err := os.Open(partial)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+	a, err := copyAttachment(io.Discard, f, u.name, u.mimeType)
+	f.Close()
+	if err != nil {
+		os.Remove(partial)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+	a.Path = filepath.Join(u.ns.uploads, strconv.FormatInt(time.Now().UnixNano(), 10)+"_"+u.name)
+	if err := os.Rename(partial, a.Path); err != nil {
+		os.Remove(partial)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+	if a, err = processImage(a); err != nil {
+		os.Remove(a.Path)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+
+	done := traceOp(ctx, "store.update")
+	_, ok, err := u.ns.changeTodo(actorOf(ctx), u.todoID, func(todo *Todo) error {
+		attach(todo, a)
+		a = todo.Attachments[len(todo.Attachments)-1]
+		todo.UpdatedAt = time.Now()
+		return nil
+	})
+	done()
+	if err != nil && writeStoreError(ctx, err) {
+		os.Remove(a.Path)
+		return false
+	}
+	if !ok {
+		// The todo was deleted during the upload.
+		os.Remove(a.Path)
+		todoNotFound(ctx, u.todoID)
+		return false
+	}
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return false
+	}
+	ctx.Response.Header.Set("X-Attachment-Location",
+		apiPrefix+"/todos/"+strconv.Itoa(u.todoID)+"/attachments/"+strconv.Itoa(a.ID))
+	return true
+}
+
+// removeUpload forgets the upload id.
+func removeUpload(id string) {
+	tusUploadsMu.Lock()
+	delete(tusUploads, id)
+	tusUploadsMu.Unlock()
+}
+
+// deleteUpload handles DELETE /uploads/{id}, which abandons an unfinished
+// upload and removes its partial file.
+func deleteUpload(ctx *fasthttp.RequestCtx, id string) {
+	u, ok := findUpload(ctx, id)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.path == "" {
+		ctx.Error("Upload not found", fasthttp.StatusNotFound)
+		return
+	}
+	removeUpload(id)
+	os.Remove(u.path)
+	u.path = ""
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// runUploadExpiry removes the uploads that got no chunk for uploadExpiry,
+// until ctx is canceled.
+func runUploadExpiry(ctx context.Context) {
+	ticker := time.NewTicker(tusReapInterval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		reapUploads(now)
+	}
+}
+
+// reapUploads removes the uploads that expired by now.
+func reapUploads(now time.Time) {
+	tusUploadsMu.Lock()
+	var expired []*tusUpload
+	for id, u := range tusUploads {
+		// Uploads receiving a chunk are busy, not expired.
+		if u.mu.TryLock() {
+			if now.After(u.expires) {
+				delete(tusUploads, id)
+				expired = append(expired, u)
+			} else {
+				u.mu.Unlock()
+			}
+		}
+	}
+	tusUploadsMu.Unlock()
+	for _, u := range expired {
+		os.Remove(u.path)
+		u.path = ""
+		u.mu.Unlock()
+	}
+}
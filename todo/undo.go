@@ -0,0 +1,143 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/valyala/fasthttp"
+)
+
+// undoDepth is how many of the most recent changes of a todo can be undone.
+// Zero disables undo.
+var undoDepth = 10
+
+// errUndoConflict is returned when a todo changed between planning and
+// applying an undo.
+var errUndoConflict = errors.New("todo changed concurrently")
+
+// undoPlan is the change an undo reverts.
+type undoPlan struct {
+	// entry is the change to revert.
+	entry AuditEntry
+	// current is the todo's JSON encoding the plan was made for; nil if
+	// the todo doesn't exist.
+	current []byte
+}
+
+// undoTarget returns the most recent change of the todo with the given ID
+// that hasn't been undone yet, provided it is one of the depth most recent
+// changes. Undos themselves are not counted as changes.
+func (l *auditLog) undoTarget(id, depth int) (undoPlan, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	indexes := l.byTodo[id]
+	if len(indexes) == 0 {
+		return undoPlan{}, false
+	}
+	current := l.entries[indexes[len(indexes)-1]].after
+
+	undone := make(map[int]bool)
+	steps := 0
+	for i := len(indexes) - 1; i >= 0; i-- {
+		e := l.entries[indexes[i]]
+		if e.Action == auditUndone {
+			undone[e.Undoes] = true
+			continue
+		}
+		steps++
+		if steps > depth {
+			break
+		}
+		if !undone[e.ID] {
+			return undoPlan{entry: e, current: current}, true
+		}
+	}
+	return undoPlan{}, false
+}
+
+// restores reports whether undoing one of the depth most recent changes of
+// a todo could bring back an attachment of the file at path, which must
+// then be kept.
+func (l *auditLog) restores(path string, depth int) bool {
+	quoted, _ := json.Marshal(path)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, indexes := range l.byTodo {
+		steps := 0
+		for i := len(indexes) - 1; i >= 0 && steps < depth; i-- {
+			e := l.entries[indexes[i]]
+			if e.Action == auditUndone {
+				continue
+			}
+			steps++
+			// Only decode the todos that may have the file attached.
+			if !bytes.Contains(e.before, quoted) {
+				continue
+			}
+			var todo struct {
+				Attachments []Attachment `json:"attachments"`
+			}
+			if json.Unmarshal(e.before, &todo) != nil {
+				continue
+			}
+			for _, a := range todo.Attachments {
+				if a.Path == path {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// undoTodo handles POST /todos/{id}/undo and reverts the most recent change
+// of a todo that hasn't been undone yet. Repeated calls step further back,
+// up to undoDepth changes. Undoing a creation deletes the todo (204 No
+// Content), undoing a deletion restores it. The todo's links are left as
+// they are.
+func undoTodo(ctx *fasthttp.RequestCtx, id int) {
+	ns := namespaceOf(ctx)
+	plan, ok := ns.store.audit.undoTarget(id, undoDepth)
+	if !ok {
+		if !ns.store.exists(id) && len(ns.store.audit.history(id)) == 0 {
+			ctx.Error("Todo not found", fasthttp.StatusNotFound)
+		} else {
+			ctx.Error("Nothing to undo", fasthttp.StatusConflict)
+		}
+		return
+	}
+
+	var restored *Todo
+	if plan.entry.before != nil {
+		restored = &Todo{}
+		if err := json.Unmarshal(plan.entry.before, restored); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+	}
+
+	actor := actorOf(ctx)
+	raw, removed, err := ns.store.revert(actor, id, plan.current, restored, plan.entry.ID)
+	if writeStoreError(ctx, err) {
+		return
+	}
+	if err != nil {
+		ctx.Error("Todo changed while undoing, try again", fasthttp.StatusConflict)
+		return
+	}
+	todosChanged()
+
+	switch {
+	case removed != nil:
+		ns.unlinkAll(actor, removed)
+		ns.publish(Event{Type: "todo.deleted", TodoID: id})
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	case plan.current == nil:
+		ns.publish(Event{Type: "todo.created", TodoID: id})
+		writeRawJSON(ctx, fasthttp.StatusOK, raw)
+	default:
+		ns.publish(Event{Type: "todo.updated", TodoID: id})
+		writeRawJSON(ctx, fasthttp.StatusOK, raw)
+	}
+}
@@ -0,0 +1,116 @@
+package todo
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newUUIDv7 returns a random UUID version 7, which starts with the current
+// Unix time in milliseconds so that UUIDs sort by creation time.
+func newUUIDv7() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ms[2:])
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+
+	var s [36]byte
+	hex.Encode(s[0:8], u[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], u[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], u[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], u[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], u[10:])
+	return string(s[:])
+}
+
+// isUUID reports whether s is a UUID in its canonical textual form, in
+// either case.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// identify gives todo a UUID if the store's IDs come with one and it has
+// none, and makes its UUID resolve to its ID. It is called for every todo
+// added to the store.
+func (s *todoStore) identify(todo *Todo) {
+	if _, ok := s.idGen.(uuidIDs); ok && todo.UUID == "" {
+		todo.UUID = newUUIDv7()
+	}
+	s.alias(todo)
+}
+
+// alias makes the UUID of todo, if it has one, resolve to its ID. Aliases
+// outlive removed todos, so requests for them still get 410 Gone.
+func (s *todoStore) alias(todo *Todo) {
+	if todo.UUID == "" {
+		return
+	}
+	s.uuidsMu.Lock()
+	s.uuids[strings.ToLower(todo.UUID)] = todo.ID
+	s.uuidsMu.Unlock()
+}
+
+// resolveUUID returns the ID of the todo with the given UUID.
+func (s *todoStore) resolveUUID(uuid string) (int, bool) {
+	s.uuidsMu.RLock()
+	defer s.uuidsMu.RUnlock()
+	id, ok := s.uuids[strings.ToLower(uuid)]
+	return id, ok
+}
+
+// uuidHandler wraps h, rewriting request paths that name a todo by UUID,
+// such as /todos/{uuid}/subtasks/2, to its ID, so handlers only deal with
+// IDs. Unknown UUIDs get 404 Not Found.
+func uuidHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		rest, ok := strings.CutPrefix(string(ctx.Path()), "/todos/")
+		if !ok {
+			h(ctx)
+			return
+		}
+		segment, sub, hasSub := strings.Cut(rest, "/")
+		if !isUUID(segment) {
+			h(ctx)
+			return
+		}
+		id, ok := namespaceOf(ctx).store.resolveUUID(segment)
+		if !ok {
+			ctx.Error("Todo not found", fasthttp.StatusNotFound)
+			return
+		}
+		path := "/todos/" + strconv.Itoa(id)
+		if hasSub {
+			path += "/" + sub
+		}
+		ctx.URI().SetPath(path)
+		h(ctx)
+	}
+}
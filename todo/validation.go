@@ -0,0 +1,98 @@
+package todo
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// todoPolicy limits the fields of todos.
+type todoPolicy struct {
+	// maxTitle and maxDescription are the maximum lengths in characters.
+	maxTitle       int
+	maxDescription int
+}
+
+// todoRules is the policy enforced on incoming todos. It is set once at
+// startup.
+var todoRules = todoPolicy{maxTitle: 200, maxDescription: 10000}
+
+// Fixed limits of the short text fields of todos.
+const (
+	maxTags      = 20
+	maxTagLength = 50
+	maxNameField = 100
+)
+
+// Problems with fields that only take known values.
+var (
+	invalidPriority = fieldError{Field: "priority", Message: "must be one of " + strings.Join(priorities, ", ")}
+	invalidStatus   = fieldError{Field: "status", Message: "must be one of " + strings.Join(statuses, ", ")}
+)
+
+// validationError is returned from inside store updates for todos that
+// fail validation, with every problem found.
+type validationError struct {
+	msg  string
+	errs []fieldError
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.msg, e.errs[0].Field, e.errs[0].Message)
+}
+
+// validateTodo checks the text fields of a todo against todoRules and
+// reports every problem found. Subtasks are checked when they are parsed,
+// see normalizeSubtasks.
+func validateTodo(todo *Todo) []fieldError {
+	var errs []fieldError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch n := utf8.RuneCountInString(todo.Title); {
+	case strings.TrimSpace(todo.Title) == "":
+		add("title", "is required")
+	case n > todoRules.maxTitle:
+		add("title", "must not be longer than %d characters", todoRules.maxTitle)
+	}
+	if hasControl(todo.Title, "") {
+		add("title", "must not contain control characters")
+	}
+	if utf8.RuneCountInString(todo.Description) > todoRules.maxDescription {
+		add("description", "must not be longer than %d characters", todoRules.maxDescription)
+	}
+	if hasControl(todo.Description, "\n\r\t") {
+		add("description", "must not contain control characters other than line breaks and tabs")
+	}
+	for _, f := range []struct{ name, value string }{{"project", todo.Project}, {"assignee", todo.Assignee}} {
+		if utf8.RuneCountInString(f.value) > maxNameField {
+			add(f.name, "must not be longer than %d characters", maxNameField)
+		}
+		if hasControl(f.value, "") {
+			add(f.name, "must not contain control characters")
+		}
+	}
+	if len(todo.Tags) > maxTags {
+		add("tags", "must not have more than %d tags", maxTags)
+	}
+	for i, tag := range todo.Tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			add(field, "must not be longer than %d characters", maxTagLength)
+		}
+		if hasControl(tag, "") {
+			add(field, "must not contain control characters")
+		}
+	}
+	return errs
+}
+
+// hasControl reports whether s contains control characters other than
+// those in allowed.
+func hasControl(s, allowed string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsControl(r) && !strings.ContainsRune(allowed, r)
+	}) >= 0
+}
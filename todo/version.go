@@ -0,0 +1,100 @@
+package todo
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// apiVersion is the current version of the HTTP API. Its routes live under
+// /v1; the unversioned routes are kept as deprecated aliases.
+const apiVersion = 1
+
+// apiPrefix is the path prefix of the current API version.
+const apiPrefix = "/v1"
+
+// legacyDeprecation is the Deprecation header (RFC 9745) sent with responses
+// to unversioned paths: the time they were deprecated.
+var legacyDeprecation = "@" + strconv.FormatInt(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC).Unix(), 10)
+
+// unversionedPaths are served outside the versioned API, like the debug
+// endpoints, see isDebugPath, and the server-rendered UI under /ui/.
+var unversionedPaths = []string{"/metrics", "/version", "/health", wellKnownPath}
+
+// versionHandler routes versioned requests to h. Paths under /v1 are served
+// with the prefix removed. Unversioned paths are still served as the
+// current version, but with Deprecation and Link headers pointing to their
+// /v1 successor, unless the client asks for a version explicitly with an
+// Accept header such as application/vnd.todo.v1+json or an API-Version
+// header. Other versions are rejected.
+func versionHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		version, versioned := pathVersion(path)
+		legacy := false
+		switch {
+		case containsString(unversionedPaths, path) || isDebugPath(path) || strings.HasPrefix(path, "/ui/"):
+			h(ctx)
+			return
+		case versioned && version == apiVersion:
+			rest := strings.TrimPrefix(path, apiPrefix)
+			if rest == "" {
+				rest = "/"
+			}
+			ctx.URI().SetPath(rest)
+		case versioned:
+			ctx.Error("Unsupported API version", fasthttp.StatusNotFound)
+			return
+		default:
+			requested, ok := requestedVersion(ctx)
+			if ok && requested != apiVersion {
+				ctx.Error("Unsupported API version "+strconv.Itoa(requested), fasthttp.StatusNotAcceptable)
+				return
+			}
+			legacy = !ok
+		}
+
+		h(ctx)
+
+		ctx.Response.Header.Set("API-Version", strconv.Itoa(apiVersion))
+		if legacy {
+			ctx.Response.Header.Set("Deprecation", legacyDeprecation)
+			ctx.Response.Header.Add("Link", "<"+apiPrefix+path+`>; rel="successor-version"`)
+		}
+	}
+}
+
+// pathVersion returns the version N of a path starting with /vN.
+func pathVersion(path string) (int, bool) {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(segment) < 2 || segment[0] != 'v' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(segment[1:])
+	return n, err == nil && n > 0
+}
+
+// requestedVersion returns the API version the client asked for in the
+// API-Version header or with an application/vnd.todo.vN+json media type in
+// its Accept header.
+func requestedVersion(ctx *fasthttp.RequestCtx) (int, bool) {
+	if v := ctx.Request.Header.Peek("API-Version"); len(v) > 0 {
+		n, err := strconv.Atoi(strings.TrimPrefix(string(v), "v"))
+		return n, err == nil
+	}
+	for _, accept := range strings.Split(string(ctx.Request.Header.Peek("Accept")), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if v, ok := strings.CutPrefix(mediaType, "application/vnd.todo.v"); ok {
+			if n, err := strconv.Atoi(strings.TrimSuffix(v, "+json")); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
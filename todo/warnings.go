@@ -0,0 +1,164 @@
+package todo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Levels of the soft validation rules.
+const (
+	ruleOff    = "off"
+	ruleWarn   = "warn"
+	ruleReject = "reject"
+)
+
+// longTitle is the length in characters above which titles are reported by
+// the long-title rule.
+const longTitle = 120
+
+// softRule is a validation rule whose findings are returned as warnings
+// with the written todo unless it is configured to reject them.
+type softRule struct {
+	name  string
+	field string
+	// check inspects todo, which was old before the request or nil if it
+	// is new, and returns a message if the rule finds a problem. Rules only
+	// report fields the request changed.
+	check func(old, todo *Todo, now time.Time) (string, bool)
+}
+
+// softRules are the soft validation rules, in the order they are reported.
+var softRules = []softRule{
+	{"due-in-past", "due_at", func(old, todo *Todo, now time.Time) (string, bool) {
+		if todo.DueAt == nil || todo.Completed || old != nil && sameTime(old.DueAt, todo.DueAt) {
+			return "", false
+		}
+		return "due date is in the past", todo.DueAt.Before(now)
+	}},
+	{"long-title", "title", func(old, todo *Todo, now time.Time) (string, bool) {
+		if old != nil && old.Title == todo.Title {
+			return "", false
+		}
+		return fmt.Sprintf("title is longer than %d characters", longTitle), utf8.RuneCountInString(todo.Title) > longTitle
+	}},
+	{"remind-after-due", "remind_at", func(old, todo *Todo, now time.Time) (string, bool) {
+		if todo.RemindAt == nil || todo.DueAt == nil ||
+			old != nil && sameTime(old.RemindAt, todo.RemindAt) && sameTime(old.DueAt, todo.DueAt) {
+			return "", false
+		}
+		return "reminder is after the due date", todo.RemindAt.After(*todo.DueAt)
+	}},
+}
+
+// defaultRuleLevels is the level of every soft rule unless configured
+// otherwise.
+const defaultRuleLevels = "due-in-past=warn,long-title=warn,remind-after-due=warn"
+
+// ruleLevels maps the soft rules to their levels. It is set once at startup.
+var ruleLevels = mustParseRuleLevels(defaultRuleLevels)
+
+// parseRuleLevels parses comma-separated rule=level entries such as
+// "long-title=reject,due-in-past=off". Rules left out are off.
+func parseRuleLevels(s string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, level, _ := strings.Cut(entry, "=")
+		name, level = strings.TrimSpace(name), strings.TrimSpace(level)
+		known := false
+		for _, r := range softRules {
+			known = known || r.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown validation rule %q", name)
+		}
+		if level != ruleOff && level != ruleWarn && level != ruleReject {
+			return nil, fmt.Errorf("invalid level %q of rule %s, expected off, warn or reject", level, name)
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+func mustParseRuleLevels(s string) map[string]string {
+	levels, err := parseRuleLevels(s)
+	if err != nil {
+		panic(err)
+	}
+	return levels
+}
+
+// checkSoftRules applies the soft rules to todo, which was old before the
+// request or nil if it is new. It returns the findings of rules that reject
+// and of rules that warn.
+func checkSoftRules(old, todo *Todo) (rejected, warnings []fieldError) {
+	now := time.Now()
+	for _, r := range softRules {
+		level := ruleLevels[r.name]
+		if level == "" || level == ruleOff {
+			continue
+		}
+		msg, found := r.check(old, todo, now)
+		if !found {
+			continue
+		}
+		finding := fieldError{Field: r.field, Message: msg, Rule: r.name}
+		if level == ruleReject {
+			rejected = append(rejected, finding)
+		} else {
+			warnings = append(warnings, finding)
+		}
+	}
+	return rejected, warnings
+}
+
+// sameTime reports whether two optional times are equal.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// warningsKey is the user value holding the warnings of a request.
+const warningsKey = "warnings"
+
+// addWarnings records warnings to return with the response to a request.
+func addWarnings(ctx *fasthttp.RequestCtx, warnings []fieldError) {
+	if len(warnings) == 0 {
+		return
+	}
+	list, _ := ctx.UserValue(warningsKey).([]fieldError)
+	ctx.SetUserValue(warningsKey, append(list, warnings...))
+}
+
+// warningsOf returns the warnings recorded for a request.
+func warningsOf(ctx *fasthttp.RequestCtx) []fieldError {
+	list, _ := ctx.UserValue(warningsKey).([]fieldError)
+	return list
+}
+
+// withWarnings adds a "warnings" member to the JSON object body.
+func withWarnings(body []byte, warnings []fieldError) []byte {
+	encoded, _ := json.Marshal(warnings)
+	end := len(body) - 1
+	for end > 0 && body[end] != '}' {
+		end--
+	}
+	out := make([]byte, 0, len(body)+len(encoded)+16)
+	out = append(out, body[:end]...)
+	if strings.TrimSpace(string(body[1:end])) != "" {
+		out = append(out, ',')
+	}
+	out = append(out, `"warnings":`...)
+	out = append(out, encoded...)
+	return append(out, body[end:]...)
+}
@@ -0,0 +1,301 @@
+// The web UI of the todo API: a list of todos with a detail pane for
+// editing one, kept up to date by the event stream. It talks to the API
+// under /v1 like any other client, sending the API key kept in
+// localStorage when the server asks for one.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+const state = {
+  todos: new Map(),
+  selected: null,
+  // subtasks being edited in the detail pane.
+  subtasks: [],
+  key: localStorage.getItem("todo-api-key") || "",
+};
+
+// api sends a request to the API and returns its JSON response, if any. A
+// 401 response asks for an API key and retries.
+async function api(method, path, body) {
+  const headers = {};
+  if (state.key) headers["Authorization"] = "Bearer " + state.key;
+  if (body !== undefined && !(body instanceof FormData)) {
+    headers["Content-Type"] = "application/json";
+    body = JSON.stringify(body);
+  }
+  const resp = await fetch("/v1" + path, { method, headers, body });
+  if (resp.status === 401 && askForKey()) {
+    return api(method, path, body);
+  }
+  const text = await resp.text();
+  if (!resp.ok) {
+    let msg = text.trim() || resp.statusText;
+    try {
+      const err = JSON.parse(text);
+      msg = err.error + (err.errors ? ": " + err.errors.map((e) => e.field + " " + e.message).join(", ") : "");
+    } catch (e) { /* plain text error */ }
+    throw new Error(msg);
+  }
+  return text ? JSON.parse(text) : null;
+}
+
+function askForKey() {
+  const key = prompt("API key", state.key);
+  if (key === null) return false;
+  state.key = key.trim();
+  localStorage.setItem("todo-api-key", state.key);
+  $("key-button").hidden = false;
+  return true;
+}
+
+function showError(err) {
+  const el = $("error");
+  el.textContent = err.message || String(err);
+  el.hidden = false;
+  clearTimeout(showError.timer);
+  showError.timer = setTimeout(() => { el.hidden = true; }, 5000);
+}
+
+// run calls fn, reporting its failure.
+function run(fn) {
+  return (...args) => Promise.resolve(fn(...args)).catch(showError);
+}
+
+async function reload() {
+  const todos = await api("GET", "/todos");
+  state.todos = new Map(todos.map((t) => [t.id, t]));
+  render();
+}
+
+function el(tag, props = {}, ...children) {
+  const node = Object.assign(document.createElement(tag), props);
+  node.append(...children);
+  return node;
+}
+
+function render() {
+  const filter = $("filter").value.trim().toLowerCase();
+  const showDone = $("show-done").checked;
+  const list = [...state.todos.values()]
+    .filter((t) => showDone || !t.completed)
+    .filter((t) => !filter || [t.title, t.description, t.project, t.assignee, ...(t.tags || [])]
+      .join(" ").toLowerCase().includes(filter))
+    .sort((a, b) => a.id - b.id);
+
+  const items = list.map((t) => {
+    const check = el("input", { type: "checkbox", checked: t.completed, title: "Complete" });
+    check.addEventListener("click", (e) => e.stopPropagation());
+    check.addEventListener("change", run(() => api("POST", `/todos/${t.id}/toggle`)));
+    const subtasks = t.subtasks || [];
+    const meta = [
+      t.priority ? el("span", { className: "priority-" + t.priority, textContent: t.priority }) : "",
+      subtasks.length ? ` ${subtasks.filter((s) => s.completed).length}/${subtasks.length} subtasks` : "",
+      t.attachments && t.attachments.length ? ` ${t.attachments.length} file${t.attachments.length > 1 ? "s" : ""}` : "",
+    ];
+    const li = el("li", { className: (t.completed ? "done" : "") + (t.id === state.selected ? " selected" : "") },
+      check, el("span", { className: "title", textContent: t.title }), el("span", { className: "meta" }, ...meta));
+    li.addEventListener("click", () => select(t.id));
+    acceptFiles(li, () => t.id);
+    return li;
+  });
+  $("todos").replaceChildren(...items);
+  $("empty").hidden = items.length > 0;
+
+  if (state.selected !== null && !state.todos.has(state.selected)) {
+    closeDetail();
+  }
+}
+
+// select opens the detail pane of a todo.
+function select(id) {
+  const t = state.todos.get(id);
+  state.selected = id;
+  $("detail-title").value = t.title;
+  $("detail-description").value = t.description || "";
+  state.subtasks = (t.subtasks || []).map((s) => ({ ...s }));
+  renderSubtasks();
+  renderAttachments(t);
+  $("detail").hidden = false;
+  render();
+}
+
+function closeDetail() {
+  state.selected = null;
+  $("detail").hidden = true;
+  render();
+}
+
+function renderSubtasks() {
+  const items = state.subtasks.map((s, i) => {
+    const check = el("input", { type: "checkbox", checked: s.completed });
+    check.addEventListener("change", () => { s.completed = check.checked; });
+    const title = el("input", { value: s.title, maxLength: 200, placeholder: "Subtask" });
+    title.addEventListener("input", () => { s.title = title.value; });
+    const remove = el("button", { type: "button", textContent: "✕", title: "Remove" });
+    remove.addEventListener("click", () => { state.subtasks.splice(i, 1); renderSubtasks(); });
+    return el("li", {}, check, title, remove);
+  });
+  $("subtasks").replaceChildren(...items);
+}
+
+function renderAttachments(t) {
+  const items = (t.attachments || []).map((a) => {
+    const name = el("a", { href: "#", textContent: a.name, title: a.mime_type });
+    name.addEventListener("click", (e) => { e.preventDefault(); run(download)(t.id, a); });
+    const remove = el("button", { type: "button", textContent: "✕", title: "Remove" });
+    remove.addEventListener("click", run(async () => {
+      await api("DELETE", `/todos/${t.id}/attachments/${a.id}`);
+      await refresh(t.id);
+    }));
+    return el("li", {}, name, ` ${formatSize(a.size)} `, remove);
+  });
+  $("attachments").replaceChildren(...items);
+}
+
+function formatSize(n) {
+  if (n < 1024) return n + " B";
+  if (n < 1024 * 1024) return (n / 1024).toFixed(1) + " KB";
+  return (n / 1024 / 1024).toFixed(1) + " MB";
+}
+
+// download saves an attachment. It is fetched rather than linked to, since
+// links can't send the API key.
+async function download(id, a) {
+  const headers = state.key ? { Authorization: "Bearer " + state.key } : {};
+  const resp = await fetch(`/v1/todos/${id}/attachments/${a.id}/content`, { headers });
+  if (!resp.ok) throw new Error(`Downloading ${a.name} failed: ${resp.status} ${resp.statusText}`);
+  const url = URL.createObjectURL(await resp.blob());
+  el("a", { href: url, download: a.name }).click();
+  setTimeout(() => URL.revokeObjectURL(url), 1000);
+}
+
+// refresh reloads a todo after its attachments changed.
+async function refresh(id) {
+  const t = await api("GET", `/todos/${id}`);
+  state.todos.set(t.id, t);
+  if (state.selected === id) renderAttachments(t);
+  render();
+}
+
+// subtasksJSON returns the subtasks of the todo for an update, which
+// replaces them: the edited ones for the selected todo, else its own.
+function subtasksJSON(id) {
+  const subtasks = id === state.selected ? state.subtasks : (state.todos.get(id).subtasks || []);
+  return subtasks
+    .filter((s) => s.title.trim() !== "")
+    .map((s) => (s.id ? { id: s.id, title: s.title, completed: s.completed } : { title: s.title, completed: s.completed }));
+}
+
+async function save(e) {
+  e.preventDefault();
+  const id = state.selected;
+  const t = await api("PUT", `/todos/${id}`, {
+    title: $("detail-title").value,
+    description: $("detail-description").value,
+    subtasks: subtasksJSON(id),
+  });
+  state.todos.set(t.id, t);
+  select(t.id);
+}
+
+async function upload(id, files) {
+  if (files.length === 0) return;
+  const form = new FormData();
+  for (const file of files) form.append("attachments", file);
+  await api("POST", `/todos/${id}/attachments`, form);
+  await refresh(id);
+}
+
+// acceptFiles makes node a drop target for files, attached to the todo
+// returned by id.
+function acceptFiles(node, id) {
+  node.addEventListener("dragover", (e) => {
+    if (![...e.dataTransfer.types].includes("Files")) return;
+    e.preventDefault();
+    node.classList.add("dragover");
+  });
+  node.addEventListener("dragleave", () => node.classList.remove("dragover"));
+  node.addEventListener("drop", (e) => {
+    e.preventDefault();
+    node.classList.remove("dragover");
+    run(upload)(id(), e.dataTransfer.files);
+  });
+}
+
+// follow reads the event stream, applying every event to the list. fetch
+// is used rather than EventSource, which can't send the API key. After a
+// disconnect it reloads the todos, since missed events aren't replayed.
+async function follow() {
+  for (;;) {
+    try {
+      const headers = state.key ? { Authorization: "Bearer " + state.key } : {};
+      const resp = await fetch("/v1/events", { headers });
+      if (!resp.ok) throw new Error("event stream: " + resp.status);
+      $("live").textContent = "live";
+      $("live").classList.add("on");
+      await reload();
+      const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += value;
+        let end;
+        while ((end = buffer.indexOf("\n\n")) >= 0) {
+          const message = buffer.slice(0, end);
+          buffer = buffer.slice(end + 2);
+          const data = message.split("\n").find((line) => line.startsWith("data: "));
+          if (data) apply(JSON.parse(data.slice(6)));
+        }
+      }
+    } catch (err) {
+      console.warn(err);
+    }
+    $("live").textContent = "offline";
+    $("live").classList.remove("on");
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
+function apply(event) {
+  if (event.type === "todo.deleted") {
+    state.todos.delete(event.todo_id);
+  } else if (event.todo) {
+    state.todos.set(event.todo_id, event.todo);
+  }
+  render();
+}
+
+$("add-form").addEventListener("submit", run(async (e) => {
+  e.preventDefault();
+  const t = await api("POST", "/todos", { title: $("add-title").value });
+  state.todos.set(t.id, t);
+  $("add-title").value = "";
+  render();
+}));
+$("filter").addEventListener("input", render);
+$("show-done").addEventListener("change", render);
+$("detail-form").addEventListener("submit", run(save));
+$("close-detail").addEventListener("click", closeDetail);
+$("add-subtask").addEventListener("click", () => {
+  state.subtasks.push({ title: "", completed: false });
+  renderSubtasks();
+  $("subtasks").lastElementChild.querySelector("input:not([type=checkbox])").focus();
+});
+$("delete-todo").addEventListener("click", run(async () => {
+  const id = state.selected;
+  if (!confirm(`Delete "${state.todos.get(id).title}"?`)) return;
+  await api("DELETE", `/todos/${id}`);
+  state.todos.delete(id);
+  closeDetail();
+}));
+$("file-input").addEventListener("change", run(async (e) => {
+  await upload(state.selected, e.target.files);
+  e.target.value = "";
+}));
+acceptFiles($("drop"), () => state.selected);
+$("key-button").hidden = !state.key;
+$("key-button").addEventListener("click", () => askForKey() && run(reload)());
+
+run(reload)();
+follow();
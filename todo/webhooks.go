@@ -0,0 +1,282 @@
+package todo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Webhook is a callback URL that receives todo events as signed JSON POSTs.
+type Webhook struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+	// Events lists the event types delivered to the hook, such as
+	// "todo.created". An empty list means all todo events.
+	Events []string `json:"events,omitempty"`
+	// Secret is the HMAC-SHA256 key used to sign payloads. It is generated
+	// when not given and only returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Outcome of the most recent delivery.
+	LastDeliveryAt *time.Time `json:"last_delivery_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// webhookEvents are the events webhooks can subscribe to.
+var webhookEvents = map[string]bool{
+	"todo.created": true,
+	"todo.updated": true,
+	"todo.deleted": true,
+}
+
+// Delivery attempts are retried with exponential backoff, starting at
+// webhookBackoff and doubling after every failure.
+const (
+	webhookAttempts = 6
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+)
+
+var (
+	webhooks      = make(map[int]*Webhook)
+	nextWebhookID = 1
+	webhooksMu    sync.RWMutex
+)
+
+// webhookPayload is the body POSTed to webhooks. Todo holds the todo after
+// the change; it is absent for deletions.
+type webhookPayload struct {
+	Event  string          `json:"event"`
+	TodoID int             `json:"todo_id"`
+	Time   time.Time       `json:"time"`
+	Todo   json.RawMessage `json:"todo,omitempty"`
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	for _, event := range w.Events {
+		if !webhookEvents[event] {
+			return errors.New("unknown event " + strconv.Quote(event))
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) wants(event string) bool {
+	return len(w.Events) == 0 || containsString(w.Events, event)
+}
+
+// redacted returns a copy of the webhook without its secret.
+func (w *Webhook) redacted() Webhook {
+	c := *w
+	c.Secret = ""
+	return c
+}
+
+// dispatchWebhooks is an event subscriber that delivers todo events to the
+// webhooks interested in them. Deliveries run in the background so slow
+// receivers never hold up the request that caused the event. Only events of
+// the default namespace are delivered.
+func dispatchWebhooks(e Event) {
+	if !webhookEvents[e.Type] || e.namespace() != defaultNamespace {
+		return
+	}
+	payload := webhookPayload{Event: e.Type, TodoID: e.TodoID, Time: e.Time}
+	if e.Type != "todo.deleted" {
+		if raw, ok := store.raw(e.TodoID); ok {
+			payload.Todo = raw
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("webhook payload for todo %d: %s", e.TodoID, err)
+		return
+	}
+
+	webhooksMu.RLock()
+	defer webhooksMu.RUnlock()
+	for _, hook := range webhooks {
+		if hook.wants(e.Type) {
+			id, hookURL, secret := hook.ID, hook.URL, hook.Secret
+			background.spawn("webhooks", func(ctx context.Context) {
+				deliverWebhook(ctx, id, hookURL, secret, e.Type, body)
+			})
+		}
+	}
+}
+
+// deliverWebhook POSTs body to hookURL, retrying failed attempts with
+// exponential backoff. The body is signed with secret in the
+// X-Webhook-Signature header as "sha256=<hex HMAC>". Retries stop when ctx
+// is done.
+func deliverWebhook(ctx context.Context, id int, hookURL, secret, event string, body []byte) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	headers := map[string]string{
+		"X-Webhook-Event":     event,
+		"X-Webhook-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	}
+
+	var err error
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		headers["X-Webhook-Attempt"] = strconv.Itoa(attempt)
+		if err = postJSON(hookURL, body, headers, webhookTimeout); err == nil {
+			break
+		}
+		if attempt < webhookAttempts {
+			if !sleepCtx(ctx, backoff) {
+				break
+			}
+			backoff *= 2
+		}
+	}
+	if err != nil {
+		log.Printf("webhook %d: giving up on %s: %s", id, event, err)
+	}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if hook, ok := webhooks[id]; ok {
+		now := time.Now()
+		hook.LastDeliveryAt = &now
+		hook.LastError = ""
+		if err != nil {
+			hook.LastError = err.Error()
+		}
+	}
+}
+
+// newWebhookSecret returns a random secret for signing payloads.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getWebhooks handles GET /webhooks.
+func getWebhooks(ctx *fasthttp.RequestCtx) {
+	webhooksMu.RLock()
+	list := make([]Webhook, 0, len(webhooks))
+	for _, hook := range webhooks {
+		list = append(list, hook.redacted())
+	}
+	webhooksMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(ctx, fasthttp.StatusOK, list)
+}
+
+// getWebhook handles GET /webhooks/{id}.
+func getWebhook(ctx *fasthttp.RequestCtx, id int) {
+	webhooksMu.RLock()
+	hook, ok := webhooks[id]
+	var snapshot Webhook
+	if ok {
+		snapshot = hook.redacted()
+	}
+	webhooksMu.RUnlock()
+
+	if !ok {
+		ctx.Error("Webhook not found", fasthttp.StatusNotFound)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, snapshot)
+}
+
+// decodeWebhook parses and validates the JSON webhook in the request body.
+func decodeWebhook(ctx *fasthttp.RequestCtx) (*Webhook, bool) {
+	hook := &Webhook{}
+	if !decodeJSONBody(ctx, hook) {
+		return nil, false
+	}
+	if err := hook.validate(); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return nil, false
+	}
+	hook.LastDeliveryAt = nil
+	hook.LastError = ""
+	return hook, true
+}
+
+// createWebhook handles POST /webhooks. The response is the only one that
+// includes the secret.
+func createWebhook(ctx *fasthttp.RequestCtx) {
+	hook, ok := decodeWebhook(ctx)
+	if !ok {
+		return
+	}
+	if hook.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		hook.Secret = secret
+	}
+	hook.CreatedAt = time.Now()
+
+	webhooksMu.Lock()
+	hook.ID = nextWebhookID
+	nextWebhookID++
+	webhooks[hook.ID] = hook
+	snapshot := *hook
+	webhooksMu.Unlock()
+
+	ctx.Response.Header.Set("Location", apiPrefix+"/webhooks/"+strconv.Itoa(snapshot.ID))
+	writeJSON(ctx, fasthttp.StatusCreated, snapshot)
+}
+
+// updateWebhook handles PUT /webhooks/{id} and replaces the webhook. The
+// secret is kept unless the body sets a new one.
+func updateWebhook(ctx *fasthttp.RequestCtx, id int) {
+	hook, ok := decodeWebhook(ctx)
+	if !ok {
+		return
+	}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	old, ok := webhooks[id]
+	if !ok {
+		ctx.Error("Webhook not found", fasthttp.StatusNotFound)
+		return
+	}
+	hook.ID = id
+	hook.CreatedAt = old.CreatedAt
+	if hook.Secret == "" {
+		hook.Secret = old.Secret
+	}
+	webhooks[id] = hook
+	writeJSON(ctx, fasthttp.StatusOK, hook.redacted())
+}
+
+// deleteWebhook handles DELETE /webhooks/{id}.
+func deleteWebhook(ctx *fasthttp.RequestCtx, id int) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if _, ok := webhooks[id]; !ok {
+		ctx.Error("Webhook not found", fasthttp.StatusNotFound)
+		return
+	}
+	delete(webhooks, id)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
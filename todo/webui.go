@@ -0,0 +1,81 @@
+package todo
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// webFiles holds the single-page web UI.
+//
+//go:embed web
+var webFiles embed.FS
+
+// webAsset is an embedded file of the web UI with its ETag.
+type webAsset struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+// webAssets maps the paths the web UI is served at to its files: / to
+// index.html and /ui/{name} to the other files.
+var webAssets = loadWebAssets()
+
+func loadWebAssets() map[string]webAsset {
+	assets := make(map[string]webAsset)
+	fs.WalkDir(webFiles, "web", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := webFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		asset := webAsset{
+			body:        body,
+			contentType: mime.TypeByExtension(path.Ext(name)),
+			etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+		urlPath := "/ui/" + strings.TrimPrefix(name, "web/")
+		if urlPath == "/ui/index.html" {
+			urlPath = "/"
+		}
+		assets[urlPath] = asset
+		return nil
+	})
+	return assets
+}
+
+// webHandler wraps h, serving the web UI at / and /ui/ and everything else
+// with h. With the server-rendered UI, / redirects to its list of todos and
+// only the stylesheet it shares with the single-page app is used. The UI talks to the API under /v1 like any other client, so it
+// needs no access of its own: with -api-keys set it asks for a key.
+func webHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		asset, ok := webAssets[string(ctx.Path())]
+		if ok && uiMode == "htmx" && string(ctx.Path()) == "/" && (ctx.IsGet() || ctx.IsHead()) {
+			ctx.Redirect("/ui/todos", fasthttp.StatusFound)
+			return
+		}
+		if !ok || !ctx.IsGet() && !ctx.IsHead() {
+			h(ctx)
+			return
+		}
+		ctx.Response.Header.Set("ETag", asset.etag)
+		ctx.Response.Header.Set("Cache-Control", "no-cache")
+		if string(ctx.Request.Header.Peek("If-None-Match")) == asset.etag {
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+			return
+		}
+		ctx.SetContentType(asset.contentType)
+		ctx.SetBody(asset.body)
+	}
+}
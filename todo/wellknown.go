@@ -0,0 +1,80 @@
+package todo
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+
+// wellKnownPath is where clients discover the capabilities of the server.
+const wellKnownPath = "/.well-known/todo-api"
+
+// capabilities describes what the server supports, so generic clients can
+// configure themselves. It is set once at startup.
+var capabilities serverCapabilities
+
+type serverCapabilities struct {
+	APIVersions []int  `json:"api_versions"`
+	BasePath    string `json:"base_path"`
+	Formats     struct {
+		Request  []string `json:"request"`
+		Response []string `json:"response"`
+	} `json:"formats"`
+	DateFormats []string `json:"date_formats"`
+	Auth        struct {
+		Required bool     `json:"required"`
+		Schemes  []string `json:"schemes"`
+	} `json:"auth"`
+	Limits struct {
+		MaxBodySize     int `json:"max_body_size"`
+		MaxUploadSize   int `json:"max_upload_size"`
+		MaxSubtasks     int `json:"max_subtasks"`
+		MaxSubtaskTitle int `json:"max_subtask_title"`
+	} `json:"limits"`
+	Pagination struct {
+		Style        string `json:"style"`
+		DefaultLimit int    `json:"default_limit"`
+		MaxLimit     int    `json:"max_limit"`
+	} `json:"pagination"`
+	Statuses []string        `json:"statuses"`
+	Features map[string]bool `json:"features"`
+}
+
+// buildCapabilities returns the capabilities of a server running with cfg.
+func buildCapabilities(cfg Config) serverCapabilities {
+	var c serverCapabilities
+	c.APIVersions = []int{apiVersion}
+	c.BasePath = apiPrefix
+	c.Formats.Request = []string{"multipart/form-data", "application/x-www-form-urlencoded", "application/json"}
+	c.Formats.Response = []string{formatJSON, formatXML, formatMsgpack, formatProtobuf}
+	c.DateFormats = []string{dateRFC3339, dateEpochMillis, dateOnly}
+	c.Auth.Required = cfg.APIKeys != ""
+	c.Auth.Schemes = []string{"api-key", "bearer"}
+	c.Limits.MaxBodySize = cfg.MaxBodySize
+	c.Limits.MaxUploadSize = cfg.MaxUploadSize
+	c.Limits.MaxSubtasks = cfg.MaxSubtasks
+	c.Limits.MaxSubtaskTitle = cfg.MaxSubtaskTitle
+	c.Pagination.Style = "cursor"
+	c.Pagination.DefaultLimit = defaultPageSize
+	c.Pagination.MaxLimit = maxPageSize
+	c.Statuses = statuses
+	c.Features = enabledFeatures(cfg)
+	return c
+}
+
+// logBanner logs the address and capabilities of the server as a single
+// JSON line at startup.
+func logBanner(addr string) {
+	banner, _ := json.Marshal(map[string]interface{}{
+		"addr":         addr,
+		"version":      buildVersion,
+		"capabilities": capabilities,
+	})
+	log.Printf("Server capabilities: %s", banner)
+}
+
+// getCapabilities handles GET /.well-known/todo-api.
+func getCapabilities(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, fasthttp.StatusOK, capabilities)
+}
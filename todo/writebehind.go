@@ -0,0 +1,280 @@
+package todo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxWriteBehindBackoff caps the wait between retries of a failed flush.
+const maxWriteBehindBackoff = 30 * time.Second
+
+// errWriteBehindFull is returned for changes of further todos while the
+// write-behind queue is full.
+var errWriteBehindFull = errors.New("write-behind queue is full")
+
+// pendingWrite is a change waiting to be written to the backend: the todo
+// to save, or its removal when todo is nil.
+type pendingWrite struct {
+	id   int
+	todo *Todo
+	// expect is the version of the todo the change is based on, see
+	// todoBackend.save. Queued changes use anyVersion.
+	expect int64
+	// seq tells apart successive changes of the same todo.
+	seq uint64
+}
+
+// batchWriter is implemented by backends that can write several changes
+// at once, in a single round trip or transaction.
+type batchWriter interface {
+	writeBatch(writes []pendingWrite) error
+}
+
+// writeBehind is a todoBackend that queues saves and removals and writes
+// them to the wrapped backend from a background worker, so requests don't
+// wait for the backend. Queued changes of the same todo are coalesced into
+// the latest one, which overwrites the todo in the backend whatever its
+// version, so changes made by other instances meanwhile are lost. Once
+// limit todos have changes queued, changes of further todos are refused
+// until the worker catches up; they can't wait for it, as the store calls
+// save and remove holding the lock of the todo's shard.
+type writeBehind struct {
+	todoBackend
+	batch    int
+	interval time.Duration
+	limit    int
+
+	mu      sync.Mutex
+	pending map[int]pendingWrite
+	// order holds the IDs in pending that aren't being written, in the
+	// order they were queued.
+	order []int
+	seq   uint64
+	// closed is set once the worker stopped; changes are then written
+	// through directly.
+	closed bool
+	wake   chan struct{}
+}
+
+// writeBehindFlushed counts the changes written by write-behind workers.
+var writeBehindFlushed atomic.Uint64
+
+// writeBehindQueue reports the number of todos with queued changes, or nil
+// without write-behind.
+var writeBehindQueue func() int
+
+// newWriteBehind wraps b in a write-behind queue flushing up to batch
+// changes at once, at least every interval, and holding changes of up to
+// limit todos. The worker runs until the server shuts down, then writes
+// the changes still queued.
+func newWriteBehind(b todoBackend, batch int, interval time.Duration, limit int) (*writeBehind, error) {
+	if batch < 1 || limit < 1 || interval <= 0 {
+		return nil, fmt.Errorf("invalid write-behind batch %d, interval %s or queue %d", batch, interval, limit)
+	}
+	w := &writeBehind{
+		todoBackend: b,
+		batch:       batch,
+		interval:    interval,
+		limit:       limit,
+		pending:     make(map[int]pendingWrite),
+		wake:        make(chan struct{}, 1),
+	}
+	writeBehindQueue = w.length
+	background.spawn("write-behind", w.run)
+	return w, nil
+}
+
+func (w *writeBehind) save(todo *Todo, expect int64) error {
+	// The store changes todos in place, but replaces their encoding, so a
+	// copy of the fields the backends use is a consistent snapshot.
+	return w.enqueue(todo.ID, &Todo{ID: todo.ID, Position: todo.Position, UpdatedAt: todo.UpdatedAt, raw: todo.raw})
+}
+
+func (w *writeBehind) remove(id int, expect int64) error {
+	return w.enqueue(id, nil)
+}
+
+// enqueue queues a change. Changes of todos without queued changes fail
+// with errWriteBehindFull while the queue is full.
+func (w *writeBehind) enqueue(id int, todo *Todo) error {
+	w.mu.Lock()
+	if _, ok := w.pending[id]; !ok && !w.closed && len(w.pending) >= w.limit {
+		w.mu.Unlock()
+		return errWriteBehindFull
+	}
+	if w.closed {
+		w.mu.Unlock()
+		return w.writeBatch([]pendingWrite{{id: id, todo: todo, expect: anyVersion}})
+	}
+	w.seq++
+	if _, ok := w.pending[id]; !ok {
+		w.order = append(w.order, id)
+	}
+	w.pending[id] = pendingWrite{id: id, todo: todo, expect: anyVersion, seq: w.seq}
+	full := len(w.order) >= w.batch
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// watch passes on the changes of other instances, except to todos with
+// changes still queued here: those would be overwritten in memory by the
+// older version in the backend.
+func (w *writeBehind) watch(ctx context.Context, fn func(id int)) {
+	w.todoBackend.watch(ctx, func(id int) {
+		w.mu.Lock()
+		_, queued := w.pending[id]
+		w.mu.Unlock()
+		if !queued {
+			fn(id)
+		}
+	})
+}
+
+// ping checks the wrapped backend, if it can be checked.
+func (w *writeBehind) ping(ctx context.Context) error {
+	if p, ok := w.todoBackend.(backendPinger); ok {
+		return p.ping(ctx)
+	}
+	return nil
+}
+
+// resetIDs resets the ID counter of the wrapped backend, if it can be
+// reset.
+func (w *writeBehind) resetIDs() error {
+	if r, ok := w.todoBackend.(idResetter); ok {
+		return r.resetIDs()
+	}
+	return nil
+}
+
+// length returns the number of todos with queued changes.
+func (w *writeBehind) length() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// run flushes the queue whenever a batch is full or interval passed,
+// retrying failed batches with exponential backoff.
+func (w *writeBehind) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	backoff := w.interval
+	for {
+		select {
+		case <-ctx.Done():
+			w.close()
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+		for {
+			n, err := w.flush()
+			if err != nil {
+				backendFailed(fmt.Sprintf("writing %d queued changes", n), err)
+				backoff = min(backoff*2, maxWriteBehindBackoff)
+				if !sleepCtx(ctx, backoff) {
+					break
+				}
+				continue
+			}
+			backoff = w.interval
+			if n < w.batch {
+				break
+			}
+		}
+	}
+}
+
+// flush writes the next batch of queued changes and returns its size. The
+// changes stay queued if writing them fails.
+func (w *writeBehind) flush() (int, error) {
+	w.mu.Lock()
+	n := min(w.batch, len(w.order))
+	writes := make([]pendingWrite, n)
+	for i, id := range w.order[:n] {
+		writes[i] = w.pending[id]
+	}
+	w.order = w.order[n:]
+	w.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+
+	err := w.writeBatch(writes)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		// Retry the batch first. Changes queued meanwhile replace the
+		// failed ones.
+		ids := make([]int, n, n+len(w.order))
+		for i, write := range writes {
+			ids[i] = write.id
+		}
+		w.order = append(ids, w.order...)
+		return n, err
+	}
+	for _, write := range writes {
+		if w.pending[write.id].seq == write.seq {
+			delete(w.pending, write.id)
+		} else {
+			// Changed again while being written.
+			w.order = append(w.order, write.id)
+		}
+	}
+	writeBehindFlushed.Add(uint64(n))
+	return n, nil
+}
+
+// close writes the changes still queued, giving up after the first
+// failure, and makes later changes write through.
+func (w *writeBehind) close() {
+	for {
+		n, err := w.flush()
+		if err != nil {
+			backendFailed(fmt.Sprintf("writing %d queued changes on shutdown", n), err)
+			break
+		}
+		if n == 0 {
+			break
+		}
+	}
+	w.mu.Lock()
+	if lost := len(w.pending); lost > 0 {
+		log.Printf("Error: %d queued changes weren't written to the %s store", lost, storageBackend)
+	}
+	w.closed = true
+	w.mu.Unlock()
+}
+
+// writeBatch writes the changes with the batchWriter of the backend, if it
+// has one, or one by one.
+func (w *writeBehind) writeBatch(writes []pendingWrite) error {
+	if b, ok := w.todoBackend.(batchWriter); ok {
+		return b.writeBatch(writes)
+	}
+	for _, write := range writes {
+		var err error
+		if write.todo == nil {
+			err = w.todoBackend.remove(write.id, write.expect)
+		} else {
+			err = w.todoBackend.save(write.todo, write.expect)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}